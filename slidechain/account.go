@@ -0,0 +1,352 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/op"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// The account view treats the standard pay-to-multisig outputs
+// locked by a single pubkey alone as that pubkey's account,
+// keeping its balance in each asset in the account_balances table.
+
+// creditAccount adds the new output m,
+// which must be locked by one pubkey alone,
+// to the pubkey's account balance.
+func creditAccount(ctx context.Context, dbtx *sql.Tx, m *multisigOutput) error {
+	const q = `INSERT INTO account_balances (pubkey, txvm_asset, amount, outputs) VALUES ($1, $2, $3, 1)
+		ON CONFLICT (pubkey, txvm_asset) DO UPDATE SET amount=amount+excluded.amount, outputs=outputs+1`
+	_, err := dbtx.ExecContext(ctx, q, m.Pubkeys[0], m.AssetID, m.Amount)
+	return errors.Wrapf(err, "crediting account %x", m.Pubkeys[0])
+}
+
+// spendAccountOutput deducts the output with the given ID,
+// if it is an unspent account output, from its account balance.
+func spendAccountOutput(ctx context.Context, dbtx *sql.Tx, outputID []byte) error {
+	var (
+		pubkeys, assetID []byte
+		quorum, amount   int64
+	)
+	const q = `SELECT pubkeys, quorum, txvm_asset, amount FROM utxos WHERE output_id=$1 AND spent_height IS NULL`
+	err := dbtx.QueryRowContext(ctx, q, outputID).Scan(&pubkeys, &quorum, &assetID, &amount)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading output %x", outputID)
+	}
+	if quorum != 1 || len(pubkeys) != ed25519.PublicKeySize {
+		return nil
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE account_balances SET amount=amount-$1, outputs=outputs-1 WHERE pubkey=$2 AND txvm_asset=$3`, amount, pubkeys, assetID)
+	if err != nil {
+		return errors.Wrapf(err, "debiting account %x", pubkeys)
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM account_balances WHERE pubkey=$1 AND txvm_asset=$2 AND outputs<=0`, pubkeys, assetID)
+	return errors.Wrapf(err, "debiting account %x", pubkeys)
+}
+
+// AccountBalance is one asset of a /accounts/{pubkey}/balances response.
+type AccountBalance struct {
+	AssetID string `json:"asset_id"`
+	Asset   string `json:"asset,omitempty"` // main-chain asset or wrapped code, if known
+	Amount  int64  `json:"amount"`
+	Outputs int64  `json:"outputs"`
+}
+
+// AccountBalances is the response of /accounts/{pubkey}/balances,
+// as of the block at Height, the latest indexed.
+type AccountBalances struct {
+	Height   uint64           `json:"height"`
+	Balances []AccountBalance `json:"balances"`
+}
+
+// An AccountOutput is an unspent output of an account,
+// as needed to spend it.
+type AccountOutput struct {
+	OutputID []byte `json:"output_id"`
+	Anchor   []byte `json:"anchor"`
+	Amount   int64  `json:"amount"`
+}
+
+// OutputSelection is the response of /accounts/{pubkey}/outputs:
+// unspent outputs of the account in the asset
+// totaling at least the requested amount,
+// for BuildTransferTx.
+type OutputSelection struct {
+	AssetID []byte          `json:"asset_id"`
+	Amount  int64           `json:"amount"`
+	Total   int64           `json:"total"`
+	Outputs []AccountOutput `json:"outputs"`
+}
+
+// accountView serves /accounts/{pubkey}/balances and /accounts/{pubkey}/outputs.
+// The outputs parameters are the hex asset_id and the amount to spend,
+// and delegated=1 to select the pubkey's delegated outputs instead.
+func (c *Custodian) accountView(w http.ResponseWriter, req *http.Request, pubkey []byte, view string) {
+	ctx := req.Context()
+	var height uint64
+	err := c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name=$1`, utxoPin).Scan(&height)
+	if err != nil && err != sql.ErrNoRows {
+		net.Errorf(w, http.StatusInternalServerError, "reading indexed height: %s", err)
+		return
+	}
+	if view == "balances" {
+		names, err := c.assetNames(ctx)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		resp := AccountBalances{Height: height, Balances: []AccountBalance{}}
+		const q = `SELECT txvm_asset, amount, outputs FROM account_balances WHERE pubkey=$1 ORDER BY txvm_asset`
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, pubkey, func(assetID []byte, amount, outputs int64) {
+			resp.Balances = append(resp.Balances, AccountBalance{
+				AssetID: hex.EncodeToString(assetID),
+				Asset:   names[bc.HashFromBytes(assetID)],
+				Amount:  amount,
+				Outputs: outputs,
+			})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading balances: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	assetID, err := hex.DecodeString(req.FormValue("asset_id"))
+	if err != nil || len(assetID) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "asset_id must be 32 hex-encoded bytes")
+		return
+	}
+	amount, err := strconv.ParseInt(req.FormValue("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		net.Errorf(w, http.StatusBadRequest, "amount must be a positive integer")
+		return
+	}
+	lock := pubkey
+	if req.FormValue("delegated") == "1" {
+		signers := c.delegatedSigners(pubkey)
+		lock = bytes.Join([][]byte{signers[0], signers[1]}, nil)
+	}
+	sel, err := c.selectOutputs(ctx, lock, assetID, amount)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if sel.Total < amount {
+		net.Errorf(w, http.StatusConflict, "balance %d as of block %d is less than %d", sel.Total, height, amount)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sel)
+}
+
+// selectOutputs chooses unspent outputs in assetID
+// locked with quorum 1 by the pubkeys concatenated in lock,
+// largest first, until they total at least amount.
+// If they cannot, it returns them all.
+func (c *Custodian) selectOutputs(ctx context.Context, lock, assetID []byte, amount int64) (*OutputSelection, error) {
+	sel := &OutputSelection{AssetID: assetID, Amount: amount, Outputs: []AccountOutput{}}
+	const q = `SELECT output_id, anchor, amount FROM utxos
+		WHERE pubkeys=$1 AND quorum=1 AND txvm_asset=$2 AND spent_height IS NULL AND anchor IS NOT NULL
+		ORDER BY amount DESC, output_id`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, lock, assetID, func(outputID, anchor []byte, n int64) {
+		if sel.Total >= amount {
+			return
+		}
+		sel.Outputs = append(sel.Outputs, AccountOutput{OutputID: outputID, Anchor: anchor, Amount: n})
+		sel.Total += n
+	})
+	return sel, errors.Wrap(err, "selecting outputs")
+}
+
+// BuildTransferTx builds a tx spending the account outputs of prv's pubkey
+// in the asset assetID,
+// as selected by /accounts/{pubkey}/outputs,
+// paying amount to the pubkey to and the change back to prv's.
+// Each output is spent by its anchor, so the tx needs no nonce;
+// if another tx spends one of them first, select outputs again.
+func BuildTransferTx(assetID bc.Hash, inputs []AccountOutput, amount int64, to ed25519.PublicKey, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	return buildTransferTx(assetID, inputs, amount, []ed25519.PublicKey{to}, nil, prv)
+}
+
+// BuildDelegatedSpendTx is BuildTransferTx
+// spending delegated outputs of prv's pubkey,
+// those it locks with the custodian's pubkey custodian,
+// as selected by /accounts/{pubkey}/outputs?delegated=1.
+// The change goes back to a delegated output.
+func BuildDelegatedSpendTx(assetID bc.Hash, inputs []AccountOutput, amount int64, to, custodian ed25519.PublicKey, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	signers := []ed25519.PublicKey{prv.Public().(ed25519.PublicKey), custodian}
+	return buildTransferTx(assetID, inputs, amount, []ed25519.PublicKey{to}, signers, prv)
+}
+
+// buildTransferTx is BuildTransferTx,
+// paying amount to an output any one of the pubkeys in to can spend,
+// or retiring it if to is nil.
+// The inputs and change are locked with quorum 1 by signers,
+// or by prv's pubkey alone if signers is nil.
+func buildTransferTx(assetID bc.Hash, inputs []AccountOutput, amount int64, to, signers []ed25519.PublicKey, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("no outputs to spend")
+	}
+	var total int64
+	for _, in := range inputs {
+		if in.Amount <= 0 || in.Amount > math.MaxInt64-total {
+			return nil, fmt.Errorf("output amount %d out of range", in.Amount)
+		}
+		total += in.Amount
+	}
+	if amount <= 0 || total < amount {
+		return nil, fmt.Errorf("cannot pay %d from outputs totaling %d", amount, total)
+	}
+	pubkey := prv.Public().(ed25519.PublicKey)
+	if signers == nil {
+		signers = []ed25519.PublicKey{pubkey}
+	}
+	pos := -1
+	for i, p := range signers {
+		if bytes.Equal(p, pubkey) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, errors.New("not a signer of the outputs")
+	}
+	b := new(txvmutil.Builder)
+	for i, in := range inputs {
+		b.PushdataBytes(nil).Op(op.Put) // arg stack: spendrefdata
+		standard.SpendMultisig(b, 1, signers, in.Amount, assetID, in.Anchor, standard.PayToMultisigSeed1[:])
+		b.Op(op.Get).Op(op.Get) // con stack: sigcheck..., [value,] sigcheck, value
+		if i > 0 {
+			b.PushdataInt64(2).Op(op.Roll).Op(op.Merge) // con stack: sigcheck..., sigcheck, value
+		}
+	}
+	b.PushdataInt64(0).Op(op.Split)      // con stack: sigcheck..., value, zeroval
+	b.PushdataInt64(1).Op(op.Roll)       // con stack: sigcheck..., zeroval, value
+	b.PushdataInt64(amount).Op(op.Split) // con stack: sigcheck..., zeroval, change, payment
+	if to == nil {
+		b.Op(op.Retire) // con stack: sigcheck..., zeroval, change
+	} else {
+		payToAny(b, to) // con stack: sigcheck..., zeroval, change
+	}
+	if total > amount {
+		payToAny(b, signers) // con stack: sigcheck..., zeroval
+	} else {
+		b.Op(op.Drop)
+	}
+	b.Op(op.Finalize) // con stack: sigcheck...
+	vm, err := txvm.Validate(b.Build(), 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	sigProg := standard.VerifyTxID(vm.TxID)
+	sigs := make([][]byte, len(signers))
+	for i := len(inputs) - 1; i >= 0; i-- {
+		sigs[pos] = ed25519.Sign(prv, append(append([]byte{}, sigProg...), inputs[i].Anchor...))
+		signExportProg(b, sigs, sigProg)
+	}
+	return newTx(b.Build())
+}
+
+// accountCheck is the response of /admin/accounts/check.
+type accountCheck struct {
+	Height uint64 `json:"height"`
+
+	// UTXOSet reports whether the indexed outputs were also checked
+	// against the chain's UTXO set,
+	// which is possible only when the index has caught up to the chain.
+	UTXOSet  bool     `json:"utxo_set"`
+	Problems []string `json:"problems"`
+}
+
+// checkAccounts compares the account view
+// with the indexed outputs it summarizes
+// and the indexed unspent outputs with the chain's UTXO set.
+func (c *Custodian) checkAccounts(ctx context.Context) (*accountCheck, error) {
+	dbtx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning db tx")
+	}
+	defer dbtx.Rollback()
+
+	check := &accountCheck{Problems: []string{}}
+	err = dbtx.QueryRowContext(ctx, `SELECT height FROM pins WHERE name=$1`, utxoPin).Scan(&check.Height)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "reading indexed height")
+	}
+
+	type key struct{ pubkey, assetID string }
+	type sums struct{ amount, outputs int64 }
+	view := make(map[key]sums)
+	err = sqlutil.ForQueryRows(ctx, dbtx, `SELECT pubkey, txvm_asset, amount, outputs FROM account_balances`, func(pubkey, assetID []byte, amount, outputs int64) {
+		view[key{string(pubkey), string(assetID)}] = sums{amount, outputs}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading account balances")
+	}
+	const q = `SELECT pubkeys, txvm_asset, SUM(amount), COUNT(*) FROM utxos
+		WHERE quorum=1 AND LENGTH(pubkeys)=32 AND spent_height IS NULL
+		GROUP BY pubkeys, txvm_asset ORDER BY pubkeys, txvm_asset`
+	err = sqlutil.ForQueryRows(ctx, dbtx, q, func(pubkey, assetID []byte, amount, outputs int64) {
+		k := key{string(pubkey), string(assetID)}
+		if got := view[k]; got != (sums{amount, outputs}) {
+			check.Problems = append(check.Problems, fmt.Sprintf("account %x has %d of asset %x in %d outputs, but its outputs hold %d in %d", pubkey, got.amount, assetID, got.outputs, amount, outputs))
+		}
+		delete(view, k)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "summing account outputs")
+	}
+	for k, got := range view {
+		check.Problems = append(check.Problems, fmt.Sprintf("account %x has %d of asset %x in %d outputs, but no unspent outputs", []byte(k.pubkey), got.amount, []byte(k.assetID), got.outputs))
+	}
+
+	if c.S == nil || c.S.chain == nil {
+		return check, nil
+	}
+	st := c.S.chain.State()
+	if st.Height() != check.Height {
+		return check, nil
+	}
+	check.UTXOSet = true
+	err = sqlutil.ForQueryRows(ctx, dbtx, `SELECT output_id FROM utxos WHERE spent_height IS NULL ORDER BY output_id`, func(outputID []byte) {
+		if !st.ContractsTree.Contains(outputID) {
+			check.Problems = append(check.Problems, fmt.Sprintf("output %x is unspent in the index but not in the UTXO set", outputID))
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading unspent outputs")
+	}
+	return check, nil
+}
+
+// CheckAccounts is the admin handler for /admin/accounts/check,
+// serving the inconsistencies checkAccounts finds.
+func (c *Custodian) CheckAccounts(w http.ResponseWriter, req *http.Request) {
+	check, err := c.checkAccounts(req.Context())
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "checking accounts: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
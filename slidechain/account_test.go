@@ -0,0 +1,131 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestAccountView(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		index := func() {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		get := func(path string, wantCode int, v interface{}) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.AccountHistory(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != wantCode {
+				t.Fatalf("GET %s: got status %d, want %d: %s", path, w.Code, wantCode, w.Body)
+			}
+			if v != nil {
+				err := json.NewDecoder(w.Body).Decode(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		assetID := issuanceContracts[1].assetID(assetXDR)
+		balance := func(pubkey ed25519.PublicKey) int64 {
+			t.Helper()
+			var resp AccountBalances
+			get("/accounts/"+hex.EncodeToString(pubkey)+"/balances", http.StatusOK, &resp)
+			var total int64
+			for _, b := range resp.Balances {
+				if b.AssetID == hex.EncodeToString(assetID.Bytes()) {
+					total += b.Amount
+				}
+			}
+			return total
+		}
+		checkConsistent := func() {
+			t.Helper()
+			check, err := c.checkAccounts(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !check.UTXOSet || len(check.Problems) > 0 {
+				t.Errorf("checked UTXO set %v, found problems %v", check.UTXOSet, check.Problems)
+			}
+		}
+
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 5, expMS+1)
+		index()
+		if got := balance(pub); got != 15 {
+			t.Errorf("after imports got balance %d, want 15", got)
+		}
+		checkConsistent()
+
+		outputsPath := fmt.Sprintf("/accounts/%x/outputs?asset_id=%x&amount=", []byte(pub), assetID.Bytes())
+		get(outputsPath+"16", http.StatusConflict, nil)
+		var sel OutputSelection
+		get(outputsPath+"12", http.StatusOK, &sel)
+		if len(sel.Outputs) != 2 || sel.Total != 15 {
+			t.Fatalf("selected %d outputs totaling %d for 12, want 2 totaling 15", len(sel.Outputs), sel.Total)
+		}
+		tx, err := BuildTransferTx(assetID, sel.Outputs, 12, payee, prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, tx)
+		index()
+		if got := balance(pub); got != 3 {
+			t.Errorf("after transfer got balance %d, want 3", got)
+		}
+		if got := balance(payee); got != 12 {
+			t.Errorf("payee got balance %d, want 12", got)
+		}
+		checkConsistent()
+
+		_, err = db.Exec(`UPDATE account_balances SET amount=amount+1 WHERE pubkey=$1`, []byte(payee))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check, err := c.checkAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(check.Problems) != 1 {
+			t.Errorf("got problems %v after corrupting a balance, want 1", check.Problems)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// accountGuardAlert is the kind of alert raised
+// when a Stellar tx changes the signers or thresholds of the custodian account,
+// merges it, or removes one of its trustlines.
+// The running custodian never does any of these itself,
+// so such a tx, unless from SetupMultisig,
+// means its key, or a signer's, is in other hands.
+const accountGuardAlert = "account-guard"
+
+// errAccountMismatch is the error for a custodian account
+// whose signers or thresholds differ from the custodian config.
+var errAccountMismatch = errors.New("custodian account does not match config")
+
+// expectedSigners returns the signers of the custodian account at addr,
+// with their weights, that cfg requires.
+func expectedSigners(cfg config.Custodian, addr string) map[string]int32 {
+	if len(cfg.Signers) == 0 {
+		return map[string]int32{addr: 1}
+	}
+	signers := make(map[string]int32)
+	for _, entry := range cfg.Signers {
+		key, weight := config.SplitNamed(entry)
+		w, _ := strconv.Atoi(weight) // checked by config.Validate
+		signers[key] = int32(w)
+	}
+	return signers
+}
+
+// checkAccount checks that the signers and thresholds of the custodian account
+// are the ones cfg requires,
+// returning errAccountMismatch, with the differences, if not.
+func (s *stellarChain) checkAccount(ctx context.Context, cfg config.Custodian) error {
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	addr := s.account
+	acct, err := stellar.WithContext(tctx, s.hclient).LoadAccount(addr)
+	if err != nil {
+		return errors.Wrap(err, "loading custodian account")
+	}
+
+	var diffs []string
+	want := expectedSigners(cfg, addr)
+	got := make(map[string]int32)
+	for _, signer := range acct.Signers {
+		if signer.Weight > 0 {
+			got[signer.Key] = signer.Weight
+		}
+	}
+	for key, w := range want {
+		if got[key] != w {
+			diffs = append(diffs, fmt.Sprintf("signer %s has weight %d, want %d", key, got[key], w))
+		}
+	}
+	for key, w := range got {
+		if _, ok := want[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected signer %s with weight %d", key, w))
+		}
+	}
+	sort.Strings(diffs)
+
+	thresholds := cfg.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = []int64{0, 0, 0}
+	}
+	th := acct.Thresholds
+	if int64(th.LowThreshold) != thresholds[0] || int64(th.MedThreshold) != thresholds[1] || int64(th.HighThreshold) != thresholds[2] {
+		diffs = append(diffs, fmt.Sprintf("thresholds are %d/%d/%d, want %d/%d/%d", th.LowThreshold, th.MedThreshold, th.HighThreshold, thresholds[0], thresholds[1], thresholds[2]))
+	}
+	if len(diffs) > 0 {
+		return errors.WithDetailf(errAccountMismatch, "%s: %s", addr, strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// accountThreats describes the ops of a Stellar tx
+// that endanger the custodian account:
+// those, with it as their source,
+// that change its signers or thresholds, merge it,
+// or remove a trustline.
+func accountThreats(envXDR string, custodian string) ([]string, error) {
+	tx, err := stellar.DecodeTx(envXDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling Stellar tx")
+	}
+	var threats []string
+	for i, op := range tx.Ops {
+		if stellar.BaseAccount(tx.OpSource(i)) != custodian {
+			continue
+		}
+		switch op := op.(type) {
+		case stellar.SetOptions:
+			if op.Signer != nil || op.MasterWeight != nil {
+				threats = append(threats, fmt.Sprintf("op %d changes signers", i))
+			}
+			if op.LowThreshold != nil || op.MedThreshold != nil || op.HighThreshold != nil {
+				threats = append(threats, fmt.Sprintf("op %d changes thresholds", i))
+			}
+		case stellar.AccountMerge:
+			threats = append(threats, fmt.Sprintf("op %d merges the account into %s", i, op.Destination))
+		case stellar.ChangeTrust:
+			if op.Limit == 0 {
+				threats = append(threats, fmt.Sprintf("op %d removes the trustline of %s", i, stellar.AssetKey(op.Asset)))
+			}
+		}
+	}
+	return threats, nil
+}
+
+// opThreats is accountThreats for a tx,
+// such as one of a later protocol, that the vendored XDR cannot decode,
+// from its ops in Horizon.
+func opThreats(ops []stellar.Operation, custodian string) []string {
+	var threats []string
+	for i, op := range ops {
+		if op.SourceAccount != custodian {
+			continue
+		}
+		switch op.Type {
+		case "set_options":
+			if op.SignerKey != "" || op.MasterKeyWeight != nil {
+				threats = append(threats, fmt.Sprintf("op %d changes signers", i))
+			}
+			if op.LowThreshold != nil || op.MedThreshold != nil || op.HighThreshold != nil {
+				threats = append(threats, fmt.Sprintf("op %d changes thresholds", i))
+			}
+		case "account_merge":
+			threats = append(threats, fmt.Sprintf("op %d merges the account into %s", i, op.Into))
+		case "change_trust":
+			if limit, err := stellar.ParseAmount(op.Limit); err != nil || limit == 0 {
+				threats = append(threats, fmt.Sprintf("op %d removes the trustline of %s:%s", i, op.AssetCode, op.AssetIssuer))
+			}
+		}
+	}
+	return threats
+}
+
+// guardAccount raises an accountGuardAlert,
+// once per tx, if a tx of the custodian account endangers it;
+// see accountThreats.
+// The ops of a tx the vendored XDR cannot decode
+// are read from Horizon instead,
+// and one whose ops cannot be read at all is taken to endanger it.
+func (c *Custodian) guardAccount(ctx context.Context, tx stellar.Transaction) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil
+	}
+	threats, err := accountThreats(tx.EnvelopeXdr, sc.account)
+	if err != nil {
+		ops, err := stellar.TxOperations(ctx, sc.hclient, tx.Hash)
+		if err != nil {
+			threats = []string{fmt.Sprintf("its ops cannot be read: %s", err)}
+		} else {
+			threats = opThreats(ops, sc.account)
+		}
+	}
+	if len(threats) == 0 {
+		return nil
+	}
+	key := []byte(tx.ID)
+	alerted, err := c.alerted(ctx, accountGuardAlert, key)
+	if err != nil || alerted {
+		return err
+	}
+	detail := fmt.Sprintf("Stellar tx %s endangers the custodian account: %s", tx.ID, strings.Join(threats, "; "))
+	return c.alert(ctx, accountGuardAlert, key, detail)
+}
@@ -0,0 +1,200 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestAccountGuard(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	otherKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := newCustodian(ctx, db, srv.Client(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+
+		err = sc.checkAccount(ctx, cfg.Custodian)
+		if err != nil {
+			t.Errorf("checking account with the default config: %s", err)
+		}
+		for _, want := range []config.Custodian{
+			{Thresholds: []int64{1, 2, 2}},
+			{Signers: []string{custKP.Address() + "=1", otherKP.Address() + "=1"}},
+			{Signers: []string{custKP.Address() + "=2"}},
+		} {
+			err = sc.checkAccount(ctx, want)
+			if errors.Root(err) != errAccountMismatch {
+				t.Errorf("checking account against %+v: got %v, want errAccountMismatch", want, err)
+			}
+		}
+
+		submit := func(ops ...stellar.Op) {
+			t.Helper()
+			_, err := stellar.NewSequencer(srv.Client()).Submit(custKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+				return &stellar.Tx{
+					Network: srv.Passphrase,
+					Source:  custKP.Address(),
+					SeqNum:  seqnum,
+					Ops:     ops,
+				}, nil
+			}, custKP.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		domain := "example.com"
+		submit(stellar.SetOptions{HomeDomain: &domain})
+		submit(stellar.SetOptions{Signer: &stellar.AccountSigner{Key: otherKP.Address(), Weight: 1}})
+		submit(stellar.SetOptions{LowThreshold: weight(1), MedThreshold: weight(1), HighThreshold: weight(1)})
+
+		txs := srv.AccountTransactions(custKP.Address(), "")
+		if len(txs) != 3 {
+			t.Fatalf("got %d txs of the custodian account, want 3", len(txs))
+		}
+		for _, tx := range txs {
+			err = c.guardAccount(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.guardAccount(ctx, tx) // alerts once per tx
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, want := range []bool{false, true, true} {
+			alerted, err := c.alerted(ctx, accountGuardAlert, []byte(txs[i].ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alerted != want {
+				t.Errorf("tx %d: got alerted %v, want %v", i, alerted, want)
+			}
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, accountGuardAlert).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %d %s alerts, want 2", n, accountGuardAlert)
+		}
+
+		custodian := custKP.Address()
+		usd, err := stellar.NewAsset("USD", otherKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range []stellar.Op{
+			stellar.AccountMerge{Destination: otherKP.Address()},
+			stellar.ChangeTrust{Asset: usd, Limit: 0},
+		} {
+			tx := &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  custKP.Address(),
+				SeqNum:  1,
+				Ops:     []stellar.Op{op},
+			}
+			envXDR, err := tx.Sign(custKP.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+			threats, err := accountThreats(envXDR, custodian)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(threats) != 1 {
+				t.Errorf("got threats %q, want 1", threats)
+			}
+		}
+
+		// The same txs in envelopes of a later protocol
+		// are read from their ops in Horizon.
+		submitFuture := func(ops ...stellar.Op) stellar.Transaction {
+			t.Helper()
+			seqnum, err := srv.Client().SequenceForAccount(custKP.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx := &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  custKP.Address(),
+				SeqNum:  seqnum + 1,
+				Ops:     ops,
+			}
+			env, err := tx.Sign(custKP.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+			future, err := horizonmock.FutureEnvelope(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			succ, err := srv.Client().SubmitTransaction(future)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := srv.Client().LoadTransaction(succ.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accountThreats(got.EnvelopeXdr, custodian); err == nil {
+				t.Fatal("decoded an envelope of a later protocol")
+			}
+			return got
+		}
+		srv.Fund(otherKP.Address(), horizonmock.FriendbotAmount) // to merge into
+		domain = "example.org"
+		harmless := submitFuture(stellar.SetOptions{HomeDomain: &domain})
+		// A tx Horizon has no ops for is taken to endanger the account.
+		unreadable := harmless
+		unreadable.ID, unreadable.Hash = "unknown", "unknown"
+		for _, tc := range []struct {
+			tx   stellar.Transaction
+			want bool
+		}{
+			{harmless, false},
+			{submitFuture(stellar.SetOptions{Signer: &stellar.AccountSigner{Key: otherKP.Address()}}), true},
+			{submitFuture(stellar.SetOptions{LowThreshold: weight(0), MedThreshold: weight(0), HighThreshold: weight(0)}), true},
+			{submitFuture(stellar.ChangeTrust{Asset: usd, Limit: 0}), true},
+			{submitFuture(stellar.AccountMerge{Destination: otherKP.Address()}), true},
+			{unreadable, true},
+		} {
+			err = c.guardAccount(ctx, tc.tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alerted, err := c.alerted(ctx, accountGuardAlert, []byte(tc.tx.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alerted != tc.want {
+				t.Errorf("tx %s of a later protocol: got alerted %v, want %v", tc.tx.ID, alerted, tc.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// alert is a problem needing an operator's attention.
+type alert struct {
+	TimeMS int64  `json:"time_ms"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key"` // hex, e.g. the txid of an export
+	Detail string `json:"detail"`
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// alert records an alert of the given kind about the peg-in, export, etc.
+// with the given key,
+// logs it,
+// and sends it to the configured webhook, if any.
+// The webhook is sent the alert in the background;
+// failure to deliver it is only logged.
+func (c *Custodian) alert(ctx context.Context, kind string, key []byte, detail string) error {
+	a := alert{
+		TimeMS: c.nowMS(),
+		Kind:   kind,
+		Key:    hex.EncodeToString(key),
+		Detail: detail,
+	}
+	const q = `INSERT INTO alerts (time_ms, kind, key, detail) VALUES ($1, $2, $3, $4)`
+	_, err := c.DB.ExecContext(ctx, q, a.TimeMS, kind, key, detail)
+	if err != nil {
+		return errors.Wrapf(err, "recording %s alert", kind)
+	}
+	log.Printf("ALERT %s %s: %s", kind, a.Key, detail)
+
+	if cfg := c.config(); cfg != nil && cfg.Alert.WebhookURL != "" {
+		go postAlert(cfg.Alert.WebhookURL, a)
+	}
+	return nil
+}
+
+// alerted reports whether an alert of the given kind
+// has been raised about the given key.
+func (c *Custodian) alerted(ctx context.Context, kind string, key []byte) (bool, error) {
+	var n int
+	const q = `SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`
+	err := c.DB.QueryRowContext(ctx, q, kind, key).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking for %s alert", kind)
+	}
+	return n > 0, nil
+}
+
+func postAlert(url string, a alert) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("marshaling %s alert: %s", a.Kind, err)
+		return
+	}
+	resp, err := alertClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("sending %s alert to webhook: %s", a.Kind, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("sending %s alert to webhook: status %s", a.Kind, resp.Status)
+	}
+}
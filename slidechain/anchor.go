@@ -0,0 +1,168 @@
+package slidechain
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// An output's anchor is that of the value it holds,
+// which txvm derives from the anchors of the values it was split or merged from.
+// The functions below derive the anchors of the outputs
+// of the txs this package builds,
+// so that a client can spend them without waiting to look them up.
+
+// ImportAnchor returns the anchor of the output of an import tx
+// whose issued value has the anchor issued,
+// as in the tx's Issuances.
+func ImportAnchor(issued []byte) []byte {
+	a := txvm.VMHash("Split1", issued)
+	return a[:]
+}
+
+// ExportChangeAnchor returns the anchor of the change output
+// of a partial export by BuildExportTx of the output with the given anchor.
+func ExportChangeAnchor(input []byte) []byte {
+	a := txvm.VMHash("Split1", input)
+	return a[:]
+}
+
+// TransferAnchors returns the anchors of the payment and change outputs
+// of a tx built by BuildTransferTx or BuildDelegatedTransferTx
+// spending outputs with the given anchors, in order.
+// There is a change output only if the inputs total more than the payment.
+func TransferAnchors(inputs [][]byte) (payment, change []byte) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	nonzero := txvm.VMHash("Split1", mergedAnchor(inputs)) // after splitting off the finalize zeroval
+	p := txvm.VMHash("Split2", nonzero[:])
+	ch := txvm.VMHash("Split1", nonzero[:])
+	return p[:], ch[:]
+}
+
+// consolidatedAnchor returns the anchor of the output
+// of a consolidation tx spending outputs with the given anchors, in order.
+func consolidatedAnchor(inputs [][]byte) []byte {
+	a := txvm.VMHash("Split1", mergedAnchor(inputs))
+	return a[:]
+}
+
+// mergedAnchor returns the anchor of the value
+// that merging values with the given anchors in turn produces,
+// each merged onto the sum of those before it.
+func mergedAnchor(inputs [][]byte) []byte {
+	merged := inputs[0]
+	for _, in := range inputs[1:] {
+		h := txvm.VMHash("Merge", append(append([]byte{}, merged...), in...))
+		merged = h[:]
+	}
+	return merged
+}
+
+// AnchorInfo is the response of /accounts/{pubkey}/anchor:
+// an unspent account output to spend in BuildExportTx.
+type AnchorInfo struct {
+	AssetID []byte `json:"asset_id"`
+
+	// Version is the issuance contract version of an imported asset.
+	Version int `json:"version,omitempty"`
+
+	OutputID []byte `json:"output_id"`
+	Anchor   []byte `json:"anchor"`
+	Amount   int64  `json:"amount"`
+
+	// Height is that of the latest indexed block.
+	Height uint64 `json:"height"`
+}
+
+// anchorLookup serves /accounts/{pubkey}/anchor.
+// The asset is given by its hex asset_id,
+// or by its main-chain asset (as in /export-estimate)
+// and the version of the issuance contract that imported it,
+// by default the version new peg-ins are imported with.
+// It is the smallest output holding at least the given amount,
+// or without an amount the largest.
+func (c *Custodian) anchorLookup(w http.ResponseWriter, req *http.Request, pubkey []byte) {
+	ctx := req.Context()
+	var info AnchorInfo
+	if s := req.FormValue("asset_id"); s != "" {
+		assetID, err := hex.DecodeString(s)
+		if err != nil || len(assetID) != 32 {
+			net.Errorf(w, http.StatusBadRequest, "asset_id must be 32 hex-encoded bytes")
+			return
+		}
+		info.AssetID = assetID
+	} else {
+		asset, err := stellar.ParseAssetKey(req.FormValue("asset"))
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "asset_id or asset is required: %s", err)
+			return
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "marshaling asset: %s", err)
+			return
+		}
+		wrapped, err := c.wrappedAssetByXDR(ctx, assetXDR)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+			return
+		}
+		if wrapped != nil {
+			info.AssetID = wrapped.TxvmAsset
+		} else {
+			ic := c.issuance()
+			if s := req.FormValue("version"); s != "" {
+				v, err := strconv.Atoi(s)
+				if err != nil || issuanceContracts[v] == nil {
+					net.Errorf(w, http.StatusBadRequest, "unknown issuance version %q", s)
+					return
+				}
+				ic = issuanceContracts[v]
+			}
+			info.AssetID = ic.assetID(assetXDR).Bytes()
+			info.Version = ic.version
+		}
+	}
+	var amount int64
+	if s := req.FormValue("amount"); s != "" {
+		var err error
+		amount, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || amount <= 0 {
+			net.Errorf(w, http.StatusBadRequest, "amount must be a positive integer")
+			return
+		}
+	}
+
+	err := c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name=$1`, utxoPin).Scan(&info.Height)
+	if err != nil && err != sql.ErrNoRows {
+		net.Errorf(w, http.StatusInternalServerError, "reading indexed height: %s", err)
+		return
+	}
+	q := `SELECT output_id, anchor, amount FROM utxos
+		WHERE pubkeys=$1 AND quorum=1 AND txvm_asset=$2 AND amount >= $3 AND spent_height IS NULL AND anchor IS NOT NULL
+		ORDER BY amount DESC, output_id LIMIT 1`
+	if amount > 0 {
+		q = `SELECT output_id, anchor, amount FROM utxos
+			WHERE pubkeys=$1 AND quorum=1 AND txvm_asset=$2 AND amount >= $3 AND spent_height IS NULL AND anchor IS NOT NULL
+			ORDER BY amount, output_id LIMIT 1`
+	}
+	err = c.DB.QueryRowContext(ctx, q, pubkey, info.AssetID, amount).Scan(&info.OutputID, &info.Anchor, &info.Amount)
+	if err == sql.ErrNoRows {
+		net.Errorf(w, http.StatusConflict, "no output of asset %x holds %d or more as of block %d", info.AssetID, amount, info.Height)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "looking up output: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,106 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestAnchorLookup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		// lookup checks the anchor of the output /accounts/{pubkey}/anchor serves
+		// after indexing the chain.
+		lookup := func(pubkey ed25519.PublicKey, query string, wantAmount int64, wantAnchor []byte) {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := fmt.Sprintf("/accounts/%x/anchor?%s", []byte(pubkey), query)
+			w := httptest.NewRecorder()
+			c.AccountHistory(w, httptest.NewRequest("GET", path, nil))
+			if wantAnchor == nil {
+				if w.Code != http.StatusConflict {
+					t.Errorf("GET %s: got status %d, want %d", path, w.Code, http.StatusConflict)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s: got status %d: %s", path, w.Code, w.Body)
+			}
+			var info AnchorInfo
+			err = json.NewDecoder(w.Body).Decode(&info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Amount != wantAmount || !bytes.Equal(info.Anchor, wantAnchor) {
+				t.Errorf("GET %s: got %d with anchor %x, want %d with %x", path, info.Amount, info.Anchor, wantAmount, wantAnchor)
+			}
+		}
+
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		import10 := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		import5 := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 5, expMS+1)
+		anchor10 := ImportAnchor(import10.Issuances[0].Anchor)
+		anchor5 := ImportAnchor(import5.Issuances[0].Anchor)
+		lookup(pub, "asset=native&version=1", 10, anchor10)
+		lookup(pub, "asset=native&version=1&amount=4", 5, anchor5)
+		lookup(pub, "asset=native&version=1&amount=11", 0, nil)
+
+		assetID := issuanceContracts[1].assetID(assetXDR)
+		inputs := []AccountOutput{{Anchor: anchor10, Amount: 10}, {Anchor: anchor5, Amount: 5}}
+		tx, err := BuildTransferTx(assetID, inputs, 12, payee, prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, tx)
+		payment, change := TransferAnchors([][]byte{anchor10, anchor5})
+		lookup(payee, fmt.Sprintf("asset_id=%x", assetID.Bytes()), 12, payment)
+		lookup(pub, "asset=native", 3, change)
+
+		// A chain of partial exports, each spending the last one's change.
+		anchor := change
+		for amount := int64(3); amount > 1; amount-- {
+			tx, err := BuildExportTx(ctx, native, 1, 1, amount, importTestAccountID, anchor, prv, 1, TimeBounds{}, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			submitTestTx(ctx, t, c, tx)
+			anchor = ExportChangeAnchor(anchor)
+			lookup(pub, "asset=native", amount-1, anchor)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// SubmitDigest returns the message that the proof of work
+// or stake signature of a submission of the raw tx commits to.
+func SubmitDigest(rawTx []byte) []byte {
+	h := sha3.Sum256(append([]byte("slidechain submit\x00"), rawTx...))
+	return h[:]
+}
+
+// workZeros is the number of leading zero bits
+// of the hash of the proof of work nonce for rawTx.
+func workZeros(rawTx, nonce []byte) int {
+	h := sha3.Sum256(append(SubmitDigest(rawTx), nonce...))
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// SolveWork finds a proof of work for submitting rawTx
+// whose hash has at least zeros leading zero bits.
+// It takes about 2^zeros hashes.
+func SolveWork(rawTx []byte, zeros int) []byte {
+	nonce := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(nonce, i)
+		if workZeros(rawTx, nonce) >= zeros {
+			return nonce
+		}
+	}
+}
+
+// SetSubmitWork sets the X-Submit-Work header of req,
+// a submission of rawTx,
+// to a proof of work with the given number of leading zero bits.
+func SetSubmitWork(req *http.Request, rawTx []byte, zeros int) {
+	req.Header.Set("X-Submit-Work", hex.EncodeToString(SolveWork(rawTx, zeros)))
+}
+
+// SetSubmitStake sets the X-Submit-Pubkey and X-Submit-Signature headers of req,
+// a submission of rawTx,
+// to the staked key prv and its signature of SubmitDigest.
+func SetSubmitStake(req *http.Request, rawTx []byte, prv ed25519.PrivateKey) {
+	req.Header.Set("X-Submit-Pubkey", hex.EncodeToString(prv.Public().(ed25519.PublicKey)))
+	req.Header.Set("X-Submit-Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(prv, SubmitDigest(rawTx))))
+}
+
+// AntiSpam wraps the tx submission handler
+// so that, in the mode of antispam.mode,
+// an anonymous caller must prove work or stake with each tx it submits.
+// Callers with API keys are not gated.
+func (c *Custodian) AntiSpam(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := c.config()
+		if cfg == nil || cfg.AntiSpam.Mode == "" || req.Method != http.MethodPost {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if tier, _, _ := apiCaller(cfg, req); tier != tierAnonymous {
+			h.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		a := cfg.AntiSpam
+		switch a.Mode {
+		case "pow":
+			if !checkWork(w, req, body, a.WorkBits) {
+				return
+			}
+		case "stake":
+			pubkey, err := hex.DecodeString(req.Header.Get("X-Submit-Pubkey"))
+			if err != nil || len(pubkey) != ed25519.PublicKeySize {
+				net.Errorf(w, http.StatusForbidden, "X-Submit-Pubkey must be a hex ed25519 public key")
+				return
+			}
+			sig, err := base64.StdEncoding.DecodeString(req.Header.Get("X-Submit-Signature"))
+			if err != nil || !ed25519.Verify(pubkey, SubmitDigest(body), sig) {
+				net.Errorf(w, http.StatusForbidden, "X-Submit-Signature is not the pubkey's signature of the submission")
+				return
+			}
+			asset, err := hex.DecodeString(a.StakeAsset)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "decoding antispam.stake_asset: %s", err)
+				return
+			}
+			staked, err := c.accountBalance(req.Context(), pubkey, asset)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+			if staked < a.StakeMin {
+				net.Errorf(w, http.StatusForbidden, "pubkey holds %d of the stake asset, and the minimum is %d", staked, a.StakeMin)
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// checkWork checks the proof of work in the X-Submit-Work header of req,
+// a submission of rawTx,
+// responding with an error if it lacks the given number of leading zero bits.
+func checkWork(w http.ResponseWriter, req *http.Request, rawTx []byte, zeros int) bool {
+	nonce, err := hex.DecodeString(req.Header.Get("X-Submit-Work"))
+	if err != nil || len(nonce) == 0 || len(nonce) > 64 {
+		net.Errorf(w, http.StatusForbidden, "X-Submit-Work must be a hex proof of work with %d leading zero bits", zeros)
+		return false
+	}
+	if workZeros(rawTx, nonce) < zeros {
+		net.Errorf(w, http.StatusForbidden, "proof of work has fewer than %d leading zero bits", zeros)
+		return false
+	}
+	return true
+}
+
+// accountBalance is the account view's balance of pubkey in the given asset.
+func (c *Custodian) accountBalance(ctx context.Context, pubkey, asset []byte) (int64, error) {
+	var amount int64
+	err := c.DB.QueryRowContext(ctx, `SELECT amount FROM account_balances WHERE pubkey=$1 AND txvm_asset=$2`, pubkey, asset).Scan(&amount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return amount, errors.Wrapf(err, "reading balance of %x", pubkey)
+}
@@ -0,0 +1,72 @@
+package slidechain
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+func TestAntiSpam(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.API.Partners = []string{"acme=s3cret"}
+		cfg.AntiSpam.Mode = "pow"
+		cfg.AntiSpam.WorkBits = 8
+		c := &Custodian{DB: db, cfg: cfg}
+		h := c.AntiSpam(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var buf bytes.Buffer
+			buf.ReadFrom(req.Body)
+			if buf.String() != "tx" {
+				t.Errorf("handler got body %q, want the submitted tx", buf.String())
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		rawTx := []byte("tx")
+		submit := func(wantCode int, prepare func(*http.Request)) {
+			t.Helper()
+			req := httptest.NewRequest("POST", "/submit", bytes.NewReader(rawTx))
+			prepare(req)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != wantCode {
+				t.Errorf("status code %d, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+
+		submit(http.StatusForbidden, func(req *http.Request) {})
+		submit(http.StatusNoContent, func(req *http.Request) { SetSubmitWork(req, rawTx, 8) })
+		submit(http.StatusNoContent, func(req *http.Request) { req.Header.Set("X-API-Key", "s3cret") })
+		// Work for another tx does not count.
+		submit(http.StatusForbidden, func(req *http.Request) { SetSubmitWork(req, []byte("other"), 8) })
+
+		pub, prv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := bytes.Repeat([]byte{7}, 32)
+		cfg.AntiSpam.Mode = "stake"
+		cfg.AntiSpam.StakeAsset = hex.EncodeToString(asset)
+		cfg.AntiSpam.StakeMin = 100
+		stake := func(req *http.Request) { SetSubmitStake(req, rawTx, prv) }
+		submit(http.StatusForbidden, stake)
+		_, err = db.Exec(`INSERT INTO account_balances (pubkey, txvm_asset, amount, outputs) VALUES ($1, $2, 100, 1)`, []byte(pub), asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(http.StatusNoContent, stake)
+		submit(http.StatusForbidden, func(req *http.Request) {
+			stake(req)
+			req.Header.Set("X-Submit-Signature", "AAAA")
+		})
+	})
+}
@@ -0,0 +1,217 @@
+package slidechain
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// An apiTier is a class of public API callers with its own limits.
+type apiTier int
+
+const (
+	tierAnonymous apiTier = iota
+	tierPartner
+	tierAdmin
+	numAPITiers
+)
+
+var apiTierNames = [...]string{"anonymous", "partner", "admin"}
+
+func (t apiTier) String() string {
+	if t < 0 || t >= numAPITiers {
+		return fmt.Sprintf("tier %d", int(t))
+	}
+	return apiTierNames[t]
+}
+
+// apiCaller returns the tier and name of the caller whose key req bears
+// in its X-API-Key header,
+// or the anonymous tier and the client IP address if it bears none.
+// It reports false if the key is unknown.
+func apiCaller(cfg *config.Config, req *http.Request) (apiTier, string, bool) {
+	presented := req.Header.Get("X-API-Key")
+	if presented == "" {
+		return tierAnonymous, net.ClientIP(req), true
+	}
+	if cfg == nil {
+		return 0, "", false
+	}
+	for _, l := range []struct {
+		tier    apiTier
+		entries []string
+	}{
+		{tierPartner, cfg.API.Partners},
+		{tierAdmin, cfg.API.Admins},
+	} {
+		for _, entry := range l.entries {
+			name, key := config.SplitNamed(entry)
+			if name != "" && subtle.ConstantTimeCompare([]byte(key), []byte(presented)) == 1 {
+				return l.tier, name, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// tierLimits returns the rate, burst, and daily quota of tier under r.
+func tierLimits(r config.RateLimit, tier apiTier) (float64, int64, int64) {
+	switch tier {
+	case tierPartner:
+		return r.PartnerRate, r.PartnerBurst, r.PartnerQuota
+	case tierAdmin:
+		return r.AdminRate, r.AdminBurst, r.AdminQuota
+	}
+	return r.Rate, r.Burst, r.Quota
+}
+
+func newTierLimiters(r config.RateLimit) [numAPITiers]*net.Limiter {
+	var limiters [numAPITiers]*net.Limiter
+	for tier := range limiters {
+		rate, burst, _ := tierLimits(r, apiTier(tier))
+		limiters[tier] = net.NewLimiter(rate, burst)
+	}
+	return limiters
+}
+
+// usageKey identifies the callers whose requests are counted together in metrics:
+// each named caller, and all anonymous callers.
+type usageKey struct {
+	tier   apiTier
+	caller string
+}
+
+// usageCounts are the requests of one usageKey since the server started.
+type usageCounts struct {
+	served, rateLimited, overQuota int64
+}
+
+// apiUsage counts public API requests
+// for the daily quotas and for metrics.
+type apiUsage struct {
+	mu     sync.Mutex
+	day    string                    // the UTC date that today counts
+	today  map[usageKey]int64        // by caller, with anonymous callers by client IP
+	totals map[usageKey]*usageCounts // by metrics key
+}
+
+// take counts a request by the caller on the UTC day of now,
+// reporting whether it is within quota, where zero means unlimited.
+func (u *apiUsage) take(tier apiTier, caller string, quota int64, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != u.day {
+		u.day = day
+		u.today = make(map[usageKey]int64)
+	}
+	k := usageKey{tier, caller}
+	if quota > 0 && u.today[k] >= quota {
+		u.countLocked(tier, caller, func(c *usageCounts) { c.overQuota++ })
+		return false
+	}
+	u.today[k]++
+	u.countLocked(tier, caller, func(c *usageCounts) { c.served++ })
+	return true
+}
+
+func (u *apiUsage) count(tier apiTier, caller string, f func(*usageCounts)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.countLocked(tier, caller, f)
+}
+
+func (u *apiUsage) countLocked(tier apiTier, caller string, f func(*usageCounts)) {
+	if tier == tierAnonymous {
+		caller = ""
+	}
+	if u.totals == nil {
+		u.totals = make(map[usageKey]*usageCounts)
+	}
+	k := usageKey{tier, caller}
+	c := u.totals[k]
+	if c == nil {
+		c = new(usageCounts)
+		u.totals[k] = c
+	}
+	f(c)
+}
+
+// RateLimit wraps h with the rate limit and daily quota
+// of the caller's tier, which may be changed by Reload.
+// A request bearing an unknown API key is refused.
+func (c *Custodian) RateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := c.config()
+		tier, caller, ok := apiCaller(cfg, req)
+		if !ok {
+			net.Errorf(w, http.StatusUnauthorized, "unknown API key")
+			return
+		}
+		now := time.Unix(0, c.nowMS()*int64(time.Millisecond))
+		if !c.limiters[tier].Allow(caller, now) {
+			c.usage.count(tier, caller, func(c *usageCounts) { c.rateLimited++ })
+			net.Errorf(w, http.StatusTooManyRequests, "rate limit exceeded for %s", caller)
+			return
+		}
+		var quota int64
+		if cfg != nil {
+			_, _, quota = tierLimits(cfg.RateLimit, tier)
+		}
+		if !c.usage.take(tier, caller, quota, now) {
+			net.Errorf(w, http.StatusTooManyRequests, "daily quota of %d requests exceeded for %s", quota, caller)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Metrics serves the public API usage counters
+// in the Prometheus text exposition format,
+// labeled by tier and, except for anonymous callers, caller name.
+func (c *Custodian) Metrics(w http.ResponseWriter, req *http.Request) {
+	var pegIns bytes.Buffer
+	err := c.writePegInMetrics(req.Context(), &pegIns)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	c.usage.mu.Lock()
+	keys := make([]usageKey, 0, len(c.usage.totals))
+	totals := make(map[usageKey]usageCounts, len(c.usage.totals))
+	for k, counts := range c.usage.totals {
+		keys = append(keys, k)
+		totals[k] = *counts
+	}
+	c.usage.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tier != keys[j].tier {
+			return keys[i].tier < keys[j].tier
+		}
+		return keys[i].caller < keys[j].caller
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      func(usageCounts) int64
+	}{
+		{"slidechain_api_requests_total", "Public API requests served.", func(u usageCounts) int64 { return u.served }},
+		{"slidechain_api_rate_limited_total", "Public API requests refused by the rate limit.", func(u usageCounts) int64 { return u.rateLimited }},
+		{"slidechain_api_over_quota_total", "Public API requests refused by the daily quota.", func(u usageCounts) int64 { return u.overQuota }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{tier=%q,caller=%q} %d\n", m.name, k.tier, k.caller, m.value(totals[k]))
+		}
+	}
+	pegIns.WriteTo(w)
+	c.writeHorizonMetrics(w)
+}
@@ -0,0 +1,86 @@
+package slidechain
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+func TestAPITiers(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Quota = 2
+	cfg.RateLimit.PartnerQuota = 3
+	cfg.API.Partners = []string{"acme=s3cret"}
+	cfg.API.Admins = []string{"ops=hunter2"}
+	now := time.Date(2019, 1, 1, 23, 59, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{
+			DB:       db,
+			cfg:      cfg,
+			limiters: newTierLimiters(cfg.RateLimit),
+			now:      func() time.Time { return now },
+		}
+		h := c.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		call := func(key string, wantCode int) {
+			t.Helper()
+			req := httptest.NewRequest("GET", "/export-status", nil)
+			if key != "" {
+				req.Header.Set("X-API-Key", key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != wantCode {
+				t.Errorf("status code %d with key %q, want %d", w.Code, key, wantCode)
+			}
+		}
+
+		call("", http.StatusNoContent)
+		call("", http.StatusNoContent)
+		call("", http.StatusTooManyRequests)
+		for i := 0; i < 3; i++ {
+			call("s3cret", http.StatusNoContent)
+		}
+		call("s3cret", http.StatusTooManyRequests)
+		for i := 0; i < 5; i++ {
+			call("hunter2", http.StatusNoContent)
+		}
+		call("wrong", http.StatusUnauthorized)
+
+		// Quotas are per UTC day.
+		now = now.Add(time.Minute)
+		call("", http.StatusNoContent)
+
+		w := httptest.NewRecorder()
+		c.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		for _, want := range []string{
+			`slidechain_api_requests_total{tier="anonymous",caller=""} 3`,
+			`slidechain_api_requests_total{tier="partner",caller="acme"} 3`,
+			`slidechain_api_requests_total{tier="admin",caller="ops"} 5`,
+			`slidechain_api_over_quota_total{tier="anonymous",caller=""} 1`,
+			`slidechain_api_over_quota_total{tier="partner",caller="acme"} 1`,
+		} {
+			if !strings.Contains(w.Body.String(), want+"\n") {
+				t.Errorf("metrics lack %s:\n%s", want, w.Body)
+			}
+		}
+
+		// Rate limits are per tier too, and may be reloaded.
+		cfg.RateLimit.PartnerRate = 1
+		cfg.RateLimit.PartnerBurst = 1
+		c.applyDynamic(cfg)
+		call("s3cret", http.StatusNoContent)
+		call("s3cret", http.StatusTooManyRequests)
+		call("hunter2", http.StatusNoContent)
+	})
+}
@@ -0,0 +1,16 @@
+package slidechain
+
+import (
+	"context"
+
+	"github.com/chain/txvm/errors"
+)
+
+// recordAudit adds an entry to the audit log.
+// Source identifies who or what caused the action,
+// e.g. "sighup" or "admin-api 127.0.0.1:51234".
+func (c *Custodian) recordAudit(ctx context.Context, action, source, detail string) error {
+	const q = `INSERT INTO audit_log (time_ms, action, source, detail) VALUES ($1, $2, $3, $4)`
+	_, err := c.DB.ExecContext(ctx, q, c.nowMS(), action, source, detail)
+	return errors.Wrapf(err, "recording audit entry for %s", action)
+}
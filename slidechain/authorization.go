@@ -0,0 +1,328 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+// notAuthorizedAlert is the kind of alert raised for an export
+// held because its payee's trustline is not authorized by the asset's issuer,
+// and for an authorization the custodian could not revoke.
+const notAuthorizedAlert = "not-authorized"
+
+// noTrustlineAlert is the kind of alert raised for an export
+// held because its payee has no trustline to its asset.
+const noTrustlineAlert = "no-trustline"
+
+var authorizationHookClient = &http.Client{Timeout: 10 * time.Second}
+
+// AuthorizationRequest is the body POSTed to pegout.authorization_hook
+// about an export held for authorization.
+type AuthorizationRequest struct {
+	TxID    string `json:"txid"`    // hex, of the export tx
+	Account string `json:"account"` // the payee, whose trustline needs authorizing
+	Asset   string `json:"asset"`   // "CODE:ISSUER"
+	Amount  int64  `json:"amount"`
+}
+
+// checkAuthorization reports whether an export may proceed
+// as far as its payee's trustline is concerned.
+// A peg-out to an unauthorized trustline would fail with op_not_authorized
+// and be refunded, so the export is held instead,
+// in the authorization_holds table, until the trustline is authorized.
+// If the custodian issues the asset in issuer mode,
+// it authorizes the trustline itself for good;
+// if instead pegout.authorize_trustlines is set,
+// it authorizes the trustline to be revoked after the peg-out;
+// otherwise, for the issuer to authorize it,
+// pegout.authorization_hook is sent the export once
+// and operators are alerted.
+// An export whose payee has no trustline at all
+// is left to checkMissingTrustline.
+func (c *Custodian) checkAuthorization(ctx context.Context, p *pegOut) (bool, error) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return true, nil
+	}
+	asset, err := stellar.DecodeAsset(p.AssetXDR)
+	if err != nil || asset.IsNative() {
+		// A malformed asset fails at submission.
+		return true, nil
+	}
+	payee := p.payee()
+	trusted, authorized, err := c.trustline(ctx, sc, payee, asset)
+	if err != nil {
+		// Horizon is unavailable; try again next pass.
+		log.Printf("checking trustline of %s for export %x: %s", payee, p.TxID, err)
+		return false, nil
+	}
+	if !trusted {
+		return c.checkMissingTrustline(ctx, p, payee, asset)
+	}
+	nowMS := c.nowMS()
+	if authorized {
+		// An authorization the custodian made for another export to the payee
+		// must now outlast this one too.
+		const q = `INSERT OR IGNORE INTO authorization_holds (txid, payee, asset_xdr, held_ms, authorized_ms)
+			SELECT $1, $2, $3, $4, MAX(authorized_ms) FROM authorization_holds
+			WHERE payee=$2 AND asset_xdr=$3 AND authorized_ms > 0 AND revoked_ms = 0
+			GROUP BY payee, asset_xdr`
+		_, err = c.DB.ExecContext(ctx, q, p.TxID, payee, p.AssetXDR, nowMS)
+		if err != nil {
+			return false, errors.Wrapf(err, "recording authorization of export %x", p.TxID)
+		}
+		return true, c.releaseAuthorizationHold(ctx, p.TxID, nowMS)
+	}
+
+	_, err = c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO authorization_holds (txid, payee, asset_xdr, held_ms) VALUES ($1, $2, $3, $4)`, p.TxID, payee, p.AssetXDR, nowMS)
+	if err != nil {
+		return false, errors.Wrapf(err, "holding export %x for authorization", p.TxID)
+	}
+	code, issuer := asset.Code, asset.Issuer
+	cfg := c.config()
+	if cfg != nil && cfg.Issuer.Enabled && issuer == sc.account {
+		// In issuer mode the authorization is kept,
+		// so that the payee can pay the asset back in a peg-in.
+		err = sc.allowTrust(ctx, payee, code, true)
+		if err != nil {
+			log.Printf("authorizing trustline of %s for export %x: %s", payee, p.TxID, err)
+			return false, nil
+		}
+		log.Printf("authorized trustline of %s to %s for export %x", payee, stellar.AssetKey(asset), p.TxID)
+		return true, c.releaseAuthorizationHold(ctx, p.TxID, nowMS)
+	}
+	if cfg != nil && cfg.PegOut.AuthorizeTrustlines && issuer == sc.account {
+		err = sc.allowTrust(ctx, payee, code, true)
+		if err != nil {
+			log.Printf("authorizing trustline of %s for export %x: %s", payee, p.TxID, err)
+			return false, nil
+		}
+		log.Printf("authorized trustline of %s to %s for export %x", payee, stellar.AssetKey(asset), p.TxID)
+		_, err = c.DB.ExecContext(ctx, `UPDATE authorization_holds SET authorized_ms=$1 WHERE txid=$2`, nowMS, p.TxID)
+		if err != nil {
+			return false, errors.Wrapf(err, "recording authorization of export %x", p.TxID)
+		}
+		return true, c.releaseAuthorizationHold(ctx, p.TxID, nowMS)
+	}
+
+	var hookMS int64
+	err = c.DB.QueryRowContext(ctx, `SELECT hook_ms FROM authorization_holds WHERE txid=$1`, p.TxID).Scan(&hookMS)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading authorization hold of export %x", p.TxID)
+	}
+	if cfg != nil && cfg.PegOut.AuthorizationHook != "" && hookMS == 0 {
+		r := AuthorizationRequest{
+			TxID:    hex.EncodeToString(p.TxID),
+			Account: payee,
+			Asset:   stellar.AssetKey(asset),
+			Amount:  p.Amount,
+		}
+		err = postAuthorizationHook(ctx, sc, cfg.PegOut.AuthorizationHook, r, nowMS)
+		if err != nil {
+			// Tried again next pass.
+			log.Printf("requesting authorization of %s for export %x: %s", payee, p.TxID, err)
+		} else {
+			_, err = c.DB.ExecContext(ctx, `UPDATE authorization_holds SET hook_ms=$1 WHERE txid=$2`, nowMS, p.TxID)
+			if err != nil {
+				return false, errors.Wrapf(err, "recording authorization request of export %x", p.TxID)
+			}
+			// The issuer may have authorized the trustline before responding.
+			_, authorized, err = c.trustline(ctx, sc, payee, asset)
+			if err == nil && authorized {
+				return true, c.releaseAuthorizationHold(ctx, p.TxID, nowMS)
+			}
+		}
+	}
+
+	alerted, err := c.alerted(ctx, notAuthorizedAlert, p.TxID)
+	if err != nil || alerted {
+		return false, err
+	}
+	detail := fmt.Sprintf("export %x of %d %s held until the trustline of %s is authorized", p.TxID, p.Amount, stellar.AssetKey(asset), payee)
+	return false, c.alert(ctx, notAuthorizedAlert, p.TxID, detail)
+}
+
+// checkMissingTrustline reports whether an export
+// whose payee has no trustline to its asset may proceed.
+// Under pegout.missing_trustline = "refund",
+// or once the export's time bounds have passed,
+// it proceeds, to fail and be refunded.
+// Otherwise it is held in the authorization_holds table,
+// and operators are alerted once,
+// until the payee adds the trustline
+// and checkAuthorization releases it.
+func (c *Custodian) checkMissingTrustline(ctx context.Context, p *pegOut, payee string, asset stellar.Asset) (bool, error) {
+	cfg := c.config()
+	if cfg == nil || cfg.PegOut.MissingTrustline != "hold" {
+		return true, nil
+	}
+	nowMS := c.nowMS()
+	if p.MaxTime > 0 && nowMS/1000 >= p.MaxTime {
+		return true, nil
+	}
+	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO authorization_holds (txid, payee, asset_xdr, held_ms) VALUES ($1, $2, $3, $4)`, p.TxID, payee, p.AssetXDR, nowMS)
+	if err != nil {
+		return false, errors.Wrapf(err, "holding export %x for a trustline", p.TxID)
+	}
+	alerted, err := c.alerted(ctx, noTrustlineAlert, p.TxID)
+	if err != nil || alerted {
+		return false, err
+	}
+	detail := fmt.Sprintf("export %x of %d %s held until %s adds a trustline to it", p.TxID, p.Amount, stellar.AssetKey(asset), payee)
+	return false, c.alert(ctx, noTrustlineAlert, p.TxID, detail)
+}
+
+// releaseAuthorizationHold records that a held export's trustline
+// has been authorized.
+func (c *Custodian) releaseAuthorizationHold(ctx context.Context, txid []byte, nowMS int64) error {
+	_, err := c.DB.ExecContext(ctx, `UPDATE authorization_holds SET released_ms=$1 WHERE txid=$2 AND released_ms=0`, nowMS, txid)
+	return errors.Wrapf(err, "releasing authorization hold of export %x", txid)
+}
+
+// revokeAuthorizations revokes the trustline authorizations
+// the custodian made for the peg-outs of sh, all of them if it is nil,
+// once every export to each payee that holds one
+// has been pegged out or refunded.
+// An authorization Stellar refuses to revoke,
+// as when the custodian account is not AUTH_REVOCABLE,
+// is left in place and operators are alerted.
+func (c *Custodian) revokeAuthorizations(ctx context.Context, sh *pegOutShard) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil
+	}
+	type grant struct {
+		payee    string
+		assetXDR []byte
+	}
+	var grants []grant
+	const q = `
+		SELECT DISTINCT a.payee, a.asset_xdr FROM authorization_holds a
+		WHERE a.authorized_ms > 0 AND a.revoked_ms = 0
+		AND NOT EXISTS (
+			SELECT 1 FROM authorization_holds h JOIN exports e ON e.txid = h.txid
+			WHERE h.payee = a.payee AND h.asset_xdr = a.asset_xdr AND h.revoked_ms = 0 AND e.pegged_out IN ($1, $2)
+		)
+	`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, func(payee string, assetXDR []byte) {
+		if sh.has(assetXDR) {
+			grants = append(grants, grant{payee: payee, assetXDR: assetXDR})
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading trustline authorizations to revoke")
+	}
+	for _, g := range grants {
+		asset, err := stellar.DecodeAsset(g.assetXDR)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling asset")
+		}
+		code := asset.Code
+		err = sc.allowTrust(ctx, g.payee, code, false)
+		if se := stellar.ParseSubmitError(err); err != nil && (se == nil || se.Retriable) {
+			// Tried again next pass.
+			log.Printf("revoking trustline authorization of %s: %s", g.payee, err)
+			continue
+		}
+		nowMS := c.nowMS()
+		_, dberr := c.DB.ExecContext(ctx, `UPDATE authorization_holds SET revoked_ms=$1 WHERE payee=$2 AND asset_xdr=$3 AND revoked_ms=0`, nowMS, g.payee, g.assetXDR)
+		if dberr != nil {
+			return errors.Wrap(dberr, "recording revoked trustline authorization")
+		}
+		if err != nil {
+			detail := fmt.Sprintf("could not revoke the trustline authorization of %s to %s: %s", g.payee, stellar.AssetKey(asset), err)
+			err = c.alert(ctx, notAuthorizedAlert, []byte(g.payee), detail)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("revoked trustline authorization of %s to %s", g.payee, stellar.AssetKey(asset))
+	}
+	return nil
+}
+
+// trustline is stellar.Trustline with chainCallTimeout.
+func (c *Custodian) trustline(ctx context.Context, sc *stellarChain, addr string, asset stellar.Asset) (trusted, authorized bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	return stellar.Trustline(ctx, sc.hclient, addr, asset)
+}
+
+// allowTrust authorizes the trustline of trustor
+// to the asset with the given code that the custodian issues,
+// or revokes its authorization,
+// with allow_trust, which the stellar package builds.
+// A trustor's M-address is taken as its base account,
+// which holds the trustline.
+func (s *stellarChain) allowTrust(ctx context.Context, trustor, code string, authorize bool) error {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	custodian := s.account
+	_, err := s.seqs.SubmitContext(ctx, custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: s.network,
+			Source:  custodian,
+			SeqNum:  seqnum,
+			Ops: []stellar.Op{
+				stellar.AllowTrust{Trustor: stellar.BaseAccount(trustor), Code: code, Authorize: authorize},
+			},
+		}, nil
+	}, s.seed)
+	return errors.Wrapf(err, "allow-trust of %s", trustor)
+}
+
+// postAuthorizationHook posts r to the hook URL
+// signed by the custodian account,
+// with a signature of "TIMESTAMP.HOST.BODY" as in SEP-31 callbacks.
+func postAuthorizationHook(ctx context.Context, sc *stellarChain, hook string, r AuthorizationRequest, nowMS int64) error {
+	kp, err := keypair.Parse(sc.seed)
+	if err != nil {
+		return errors.Wrap(err, "parsing custodian seed")
+	}
+	full, ok := kp.(*keypair.Full)
+	if !ok {
+		return errors.New("custodian seed is not a seed")
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "encoding authorization request")
+	}
+	u, err := url.Parse(hook)
+	if err != nil {
+		return errors.Wrap(err, "parsing authorization hook URL")
+	}
+	ts := nowMS / 1000
+	sig, err := full.Sign([]byte(fmt.Sprintf("%d.%s.%s", ts, u.Host, body)))
+	if err != nil {
+		return errors.Wrap(err, "signing authorization request")
+	}
+	req, err := http.NewRequest("POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Signature", fmt.Sprintf("t=%d, s=%s", ts, base64.StdEncoding.EncodeToString(sig)))
+	resp, err := authorizationHookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "posting to %s", hook)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s from %s", resp.Status, hook)
+	}
+	return nil
+}
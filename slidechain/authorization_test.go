@@ -0,0 +1,289 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestTrustlineAuthorization(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	// The custodian issues USD, and requires authorization to hold it.
+	usd, err := stellar.NewAsset("USD", custKP.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit := func(kp *keypair.Full, op stellar.Op) {
+		_, err := stellar.NewSequencer(srv.Client()).Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  kp.Address(),
+				SeqNum:  seqnum,
+				Ops:     []stellar.Op{op},
+			}, nil
+		}, kp.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	submit(custKP, stellar.SetOptions{SetFlags: stellar.AuthRequired})
+	submit(exporterKP, stellar.ChangeTrust{Asset: usd, Limit: stellar.MaxTrustLimit})
+
+	var (
+		mu    sync.Mutex
+		hooks []AuthorizationRequest
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r AuthorizationRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		hooks = append(hooks, r)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.AuthorizationHook = hook.URL
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), usd, 100, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("usd export")
+		p := &pegOut{
+			TxID:     txid,
+			AssetXDR: usdXDR,
+			TempAddr: tempAddr,
+			Seqnum:   int64(seqnum),
+			Exporter: exporterKP.Address(),
+			Amount:   100,
+			Anchor:   []byte{},
+			Pubkey:   []byte{},
+		}
+		err = c.insertExport(ctx, txid, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := func() pegOutState {
+			var s pegOutState
+			err := db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, txid).Scan(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+
+		// Unauthorized, the export is held,
+		// and the issuer's hook asked once to authorize it.
+		for i := 0; i < 2; i++ {
+			_, err = c.pegOutPending(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s := state(); s != pegOutNotYet {
+			t.Errorf("held export is in state %s, want not yet", s)
+		}
+		mu.Lock()
+		if len(hooks) != 1 || hooks[0].Account != exporterKP.Address() || hooks[0].Amount != 100 {
+			t.Errorf("got hook requests %+v, want one for the exporter", hooks)
+		}
+		mu.Unlock()
+		alerted, err := c.alerted(ctx, notAuthorizedAlert, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for the held export")
+		}
+
+		// As the issuer, the custodian authorizes the trustline,
+		// pegs out, and revokes the authorization.
+		cfg.PegOut.AuthorizeTrustlines = true
+		_, err = c.pegOutPending(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := state(); s != pegOutOK {
+			t.Errorf("export is in state %s, want ok", s)
+		}
+		var authorizedMS, releasedMS, revokedMS int64
+		err = db.QueryRow(`SELECT authorized_ms, released_ms, revoked_ms FROM authorization_holds WHERE txid=$1`, txid).Scan(&authorizedMS, &releasedMS, &revokedMS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorizedMS == 0 || releasedMS == 0 || revokedMS == 0 {
+			t.Errorf("got authorized_ms %d, released_ms %d, revoked_ms %d, want all set", authorizedMS, releasedMS, revokedMS)
+		}
+		trusted, authorized, err := stellar.Trustline(ctx, srv.Client(), exporterKP.Address(), usd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !trusted || authorized {
+			t.Errorf("got trusted %t, authorized %t, want a revoked trustline", trusted, authorized)
+		}
+	})
+}
+
+func TestMissingTrustline(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	var kps []*keypair.Full
+	for i := 0; i < 3; i++ {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		kps = append(kps, kp)
+	}
+	custKP, exporterKP, payeeKP := kps[0], kps[1], kps[2]
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.MissingTrustline = "hold"
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usd, err := stellar.NewAsset("USD", custKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The pre-export tx adds the exporter's trustline,
+		// but cannot add another payee's.
+		_, _, err = SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), usd, 100, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, _, err := stellar.Trustline(ctx, srv.Client(), exporterKP.Address(), usd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !trusted {
+			t.Error("pre-export tx added no trustline for the exporter")
+		}
+		_, _, err = SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), usd, 100, TimeBounds{}, Destination{Account: payeeKP.Address()})
+		if err == nil {
+			t.Error("got no error exporting to a payee with no trustline")
+		}
+
+		// The custodian holds an export to a payee without one.
+		p := &pegOut{
+			TxID:        []byte("usd export"),
+			AssetXDR:    usdXDR,
+			Exporter:    exporterKP.Address(),
+			Amount:      100,
+			Destination: Destination{Account: payeeKP.Address()},
+		}
+		ok, err := c.checkAuthorization(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("export to a payee with no trustline proceeded under missing_trustline = hold")
+		}
+		alerted, err := c.alerted(ctx, noTrustlineAlert, p.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for the held export")
+		}
+
+		// Past its time bounds it proceeds, to be refunded.
+		p.MaxTime = now.Unix() - 1
+		ok, err = c.checkAuthorization(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("expired export stayed held")
+		}
+		p.MaxTime = 0
+
+		// The payee adds the trustline, and the hold is released.
+		_, err = stellar.NewSequencer(srv.Client()).Submit(payeeKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  payeeKP.Address(),
+				SeqNum:  seqnum,
+				Ops:     []stellar.Op{stellar.ChangeTrust{Asset: usd, Limit: stellar.MaxTrustLimit}},
+			}, nil
+		}, payeeKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err = c.checkAuthorization(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("export stayed held after its payee added the trustline")
+		}
+		var releasedMS int64
+		err = db.QueryRow(`SELECT released_ms FROM authorization_holds WHERE txid=$1`, p.TxID).Scan(&releasedMS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if releasedMS == 0 {
+			t.Error("hold not released")
+		}
+	})
+}
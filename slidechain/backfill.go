@@ -0,0 +1,164 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/chain/txvm/errors"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// backfillPage is how many Stellar txs a backfill reads per Horizon request.
+const backfillPage = 200
+
+// BackfillReport is the response of /admin/backfill,
+// counting what a rescan of a ledger range found.
+type BackfillReport struct {
+	FromLedger int32 `json:"from_ledger"`
+	ToLedger   int32 `json:"to_ledger"`
+
+	// Txs is the number of txs of the custodian account in the range,
+	// and Deposits the number of peg-in payments among them.
+	Txs      int `json:"txs"`
+	Deposits int `json:"deposits"`
+
+	// Recorded counts the deposits that had been missed
+	// and are now recorded for import.
+	Recorded int `json:"recorded"`
+
+	// Known counts the deposits that were already recorded.
+	Known int `json:"known"`
+
+	// Unmatched counts the deposits paying no peg-in.
+	Unmatched int `json:"unmatched"`
+
+	// Duplicates counts the deposits reusing the nonce
+	// of a peg-in another deposit paid.
+	// Each raises a duplicate-deposit alert, as when watched.
+	Duplicates int `json:"duplicates"`
+}
+
+// Backfill is the admin handler that rescans the custodian account's Stellar txs
+// in the ledgers from from_ledger through to_ledger
+// for peg-in deposits the deposit watcher missed,
+// records them, and wakes the importer to issue them.
+// Deposits already recorded are left alone,
+// so a range may be rescanned any number of times.
+func (c *Custodian) Backfill(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "backfill requires POST")
+		return
+	}
+	from, err := strconv.ParseInt(req.FormValue("from_ledger"), 10, 32)
+	if err != nil || from <= 0 {
+		net.Errorf(w, http.StatusBadRequest, "from_ledger must be a ledger sequence number")
+		return
+	}
+	to, err := strconv.ParseInt(req.FormValue("to_ledger"), 10, 32)
+	if err != nil || to < from {
+		net.Errorf(w, http.StatusBadRequest, "to_ledger must be a ledger sequence number no less than from_ledger")
+		return
+	}
+	ctx := req.Context()
+	rep, err := c.backfill(ctx, int32(from), int32(to))
+	if err != nil {
+		net.Errorf(w, http.StatusBadGateway, "backfilling ledgers %d through %d: %s", from, to, err)
+		return
+	}
+	detail := fmt.Sprintf("ledgers %d through %d: %d deposits, %d recorded", from, to, rep.Deposits, rep.Recorded)
+	err = c.recordAudit(ctx, "backfill", "admin-api "+req.RemoteAddr, detail)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// backfill rescans the ledgers from through to, as Backfill does.
+func (c *Custodian) backfill(ctx context.Context, from, to int32) (*BackfillReport, error) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil, errors.New("custodian has no Stellar account")
+	}
+	rep := &BackfillReport{FromLedger: from, ToLedger: to}
+	cur := stellar.LedgerCursor(from)
+	for done := false; !done; {
+		tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		txs, err := stellar.AccountTransactions(tctx, sc.hclient, sc.account, cur, backfillPage)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		done = len(txs) < backfillPage
+		for _, tx := range txs {
+			if tx.Ledger > to {
+				done = true
+				break
+			}
+			rep.Txs++
+			err = sc.deposits(ctx, tx, func(d Deposit) error {
+				return c.backfillDeposit(ctx, d, rep)
+			})
+			if err != nil {
+				return nil, err
+			}
+			cur = tx.PT
+		}
+	}
+	if rep.Recorded > 0 {
+		c.imports.Broadcast()
+	}
+	return rep, nil
+}
+
+// backfillDeposit records d if it was missed,
+// counting it in rep.
+// Unlike recordDeposit, it leaves the watch cursor alone,
+// which is usually past d.
+func (c *Custodian) backfillDeposit(ctx context.Context, d Deposit, rep *BackfillReport) error {
+	rep.Deposits++
+	recorded, err := c.depositRecorded(ctx, d)
+	if err != nil {
+		return err
+	}
+	if recorded {
+		rep.Known++
+		return nil
+	}
+	paid, err := c.payPegIn(ctx, d)
+	if scerrors.Is(err, scerrors.ErrDuplicateDeposit) {
+		log.Printf("backfill: ignoring deposit: %s", err)
+		rep.Duplicates++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if paid {
+		err = c.recordDepositOp(ctx, d)
+		if err != nil {
+			return err
+		}
+		log.Printf("backfill: recorded missed deposit in tx %s with nonce hash %x", d.TxID, d.NonceHash)
+		rep.Recorded++
+		return nil
+	}
+	var n int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM pegs WHERE nonce_hash=$1 AND deposit_txid=$2`, d.NonceHash, d.TxID).Scan(&n)
+	if err != nil {
+		return errors.Wrapf(err, "looking up peg-in with hash %x", d.NonceHash)
+	}
+	if n > 0 {
+		rep.Known++
+	} else {
+		rep.Unmatched++
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := srv.Client()
+
+		// deposit pays the custodian with the nonce hash of a peg-in,
+		// recorded first if record is set,
+		// and returns the hash and the deposit's ledger.
+		deposit := func(expMS int64, record bool) ([]byte, int32) {
+			t.Helper()
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			if record {
+				err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			succ, err := stellar.NewSequencer(hclient).Submit(payerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+				return stellar.BuildPegInTx(payerKP.Address(), seqnum, nonceHash, "10", "", "", custKP.Address(), hclient)
+			}, payerKP.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nonceHash[:], succ.Ledger
+		}
+		first, firstLedger := deposit(1, true)
+		_, _ = deposit(2, false)
+		second, secondLedger := deposit(3, true)
+		outside, _ := deposit(4, true)
+
+		backfill := func(from, to int32) BackfillReport {
+			t.Helper()
+			target := fmt.Sprintf("/admin/backfill?from_ledger=%d&to_ledger=%d", from, to)
+			w := httptest.NewRecorder()
+			c.Backfill(w, httptest.NewRequest("POST", target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code %d from %s: %s", w.Code, target, w.Body)
+			}
+			var rep BackfillReport
+			err := json.Unmarshal(w.Body.Bytes(), &rep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rep
+		}
+		state := func(nonceHash []byte) pegInState {
+			t.Helper()
+			var state pegInState
+			err := db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+
+		rep := backfill(firstLedger, secondLedger)
+		if rep.Deposits != 3 || rep.Recorded != 2 || rep.Unmatched != 1 || rep.Known != 0 {
+			t.Errorf("got report %+v, want 3 deposits, 2 recorded, 1 unmatched", rep)
+		}
+		for _, nonceHash := range [][]byte{first, second} {
+			if got := state(nonceHash); got != pegInPaid {
+				t.Errorf("got state %s for peg-in %x in range, want %s", got, nonceHash, pegInPaid)
+			}
+		}
+		if got := state(outside); got != pegInRecorded {
+			t.Errorf("got state %s for peg-in %x after range, want %s", got, outside, pegInRecorded)
+		}
+		var cursor string
+		err = db.QueryRow(`SELECT cursor FROM custodian`).Scan(&cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor != "" {
+			t.Errorf("backfill moved the watch cursor to %q", cursor)
+		}
+
+		rep = backfill(firstLedger, secondLedger)
+		if rep.Recorded != 0 || rep.Known != 2 {
+			t.Errorf("got report %+v rescanning, want 0 recorded and 2 known", rep)
+		}
+
+		w := httptest.NewRecorder()
+		c.Backfill(w, httptest.NewRequest("POST", fmt.Sprintf("/admin/backfill?from_ledger=%d&to_ledger=%d", secondLedger, firstLedger), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status code %d for a reversed range, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
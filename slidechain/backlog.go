@@ -0,0 +1,397 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+const (
+	backlogLimit    = 100
+	maxBacklogLimit = 1000
+)
+
+// backlogSorts maps the sort parameter of the backlog views to its column.
+var backlogSorts = map[string]string{
+	"created": "created_ms",
+	"updated": "state_ms",
+	"amount":  "amount",
+	"state":   "state",
+}
+
+// backlogQuery accumulates the conditions and args
+// of a query of a backlog view.
+type backlogQuery struct {
+	conds []string
+	args  []interface{}
+}
+
+// add adds a condition on the next arg,
+// whose number cond formats with %d.
+func (q *backlogQuery) add(cond string, arg interface{}) {
+	q.args = append(q.args, arg)
+	q.conds = append(q.conds, fmt.Sprintf(cond, len(q.args)))
+}
+
+func (q *backlogQuery) where() string {
+	if len(q.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conds, " AND ")
+}
+
+// backlogPage is the paging and ordering of a backlog view.
+type backlogPage struct {
+	order         string
+	limit, offset int
+	csv           bool
+}
+
+// parseBacklog parses the parameters of req
+// common to the backlog views into q:
+// state, a comma-separated list of names,
+// all, or unset for the unfinished states in pending;
+// asset; min_age and max_age;
+// and the sort, limit, offset, and format of the response.
+func parseBacklog(req *http.Request, q *backlogQuery, names []string, pending []int, nowMS int64) (backlogPage, error) {
+	page := backlogPage{order: "created_ms", limit: backlogLimit, csv: req.FormValue("format") == "csv"}
+	if page.csv {
+		page.limit = 0
+	}
+
+	var states []string
+	for _, s := range req.Form["state"] {
+		states = append(states, strings.Split(s, ",")...)
+	}
+	if len(states) == 0 {
+		for _, s := range pending {
+			states = append(states, strconv.Itoa(s))
+		}
+	} else if len(states) != 1 || states[0] != "all" {
+		for i, s := range states {
+			n := -1
+			for j, name := range names {
+				if s == name {
+					n = j
+				}
+			}
+			if n < 0 {
+				return page, fmt.Errorf("state %q must be all or one of %s", s, strings.Join(names, ", "))
+			}
+			states[i] = strconv.Itoa(n)
+		}
+	} else {
+		states = nil
+	}
+	if len(states) > 0 {
+		// The states are numbers, safe to inline.
+		q.conds = append(q.conds, "state IN ("+strings.Join(states, ", ")+")")
+	}
+
+	if s := req.FormValue("asset"); s != "" {
+		asset, err := stellar.ParseAssetKey(s)
+		if err != nil {
+			return page, errors.Wrap(err, "parsing asset")
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			return page, errors.Wrap(err, "marshaling asset")
+		}
+		q.add("asset_xdr=$%d", assetXDR)
+	}
+	for _, p := range []struct {
+		name, cond string
+	}{
+		{"min_age", "created_ms <= $%d"},
+		{"max_age", "created_ms >= $%d"},
+	} {
+		s := req.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return page, fmt.Errorf("%s %q is not a nonnegative duration", p.name, s)
+		}
+		q.add(p.cond, nowMS-int64(d/time.Millisecond))
+	}
+
+	if s := req.FormValue("sort"); s != "" {
+		dir := ""
+		if strings.HasPrefix(s, "-") {
+			s, dir = s[1:], " DESC"
+		}
+		col, ok := backlogSorts[s]
+		if !ok {
+			return page, fmt.Errorf("sort %q must be created, updated, amount, or state, optionally prefixed with -", s)
+		}
+		page.order = col + dir
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"limit", &page.limit, maxBacklogLimit},
+		{"offset", &page.offset, -1},
+	} {
+		s := req.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || (p.max > 0 && (n == 0 || n > p.max)) {
+			return page, fmt.Errorf("%s %q is out of range", p.name, s)
+		}
+		*p.dst = n
+	}
+	return page, nil
+}
+
+// clause is the ORDER BY, LIMIT, and OFFSET clauses of p,
+// ordering ties by key.
+func (p backlogPage) clause() string {
+	s := " ORDER BY " + p.order + ", key"
+	if p.limit > 0 {
+		s += fmt.Sprintf(" LIMIT %d", p.limit)
+	} else if p.offset > 0 {
+		s += " LIMIT -1"
+	}
+	if p.offset > 0 {
+		s += fmt.Sprintf(" OFFSET %d", p.offset)
+	}
+	return s
+}
+
+// countBacklog counts the rows of the view selected by q.
+func (c *Custodian) countBacklog(ctx context.Context, view string, q *backlogQuery) (int, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+view+")"+q.where(), q.args...).Scan(&n)
+	return n, errors.Wrap(err, "counting backlog")
+}
+
+// backlogEntry is an export or peg-in in a backlog view.
+type backlogEntry struct {
+	Key         string `json:"key"` // the export's txid or the peg-in's nonce hash, in hex
+	State       string `json:"state"`
+	Asset       string `json:"asset"`
+	Amount      int64  `json:"amount"`
+	Destination string `json:"destination"` // the payee account of an export, the recipient pubkey of a peg-in
+	CreatedMS   int64  `json:"created_ms"`
+	StateMS     int64  `json:"state_ms"` // when it entered its state
+	Partner     string `json:"partner,omitempty"`
+
+	// Of exports.
+	FeeLevel   int    `json:"fee_level,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// Of peg-ins.
+	DepositTxID string `json:"deposit_txid,omitempty"`
+	ExpMS       int64  `json:"exp_ms,omitempty"`
+}
+
+// backlogResp is the JSON response of a backlog view.
+type backlogResp struct {
+	Total   int            `json:"total"` // matching entries, before paging
+	Offset  int            `json:"offset"`
+	Entries []backlogEntry `json:"entries"`
+}
+
+// errorClass is the class of a Stellar rejection recorded in submit_error:
+// its first failing op code, or else its tx code.
+func errorClass(se *stellar.SubmitError) string {
+	for _, code := range se.OpCodes {
+		if code != "op_success" {
+			return code
+		}
+	}
+	return se.TxCode
+}
+
+// exportsView selects the exports for the backlog view,
+// with the times they were recorded and entered their states.
+const exportsView = `SELECT e.txid AS key, e.pegged_out AS state, e.asset_xdr, e.amount,
+	CASE e.destination WHEN '' THEN e.exporter ELSE e.destination END AS destination,
+	e.fee_level, COALESCE(e.submit_error, '') AS submit_error, e.partner,
+	COALESCE((SELECT MIN(s.time_ms) FROM state_events s WHERE s.kind='export' AND s.key=e.txid), 0) AS created_ms,
+	COALESCE((SELECT MAX(s.time_ms) FROM state_events s WHERE s.kind='export' AND s.key=e.txid), 0) AS state_ms
+	FROM exports e`
+
+// importsView selects the peg-ins for the backlog view,
+// with the times they were recorded and entered their states.
+const importsView = `SELECT p.nonce_hash AS key, p.state, COALESCE(p.asset_xdr, x'') AS asset_xdr, COALESCE(p.amount, 0) AS amount,
+	p.recipient_pubkey AS destination, COALESCE(p.deposit_txid, '') AS deposit_txid, p.nonce_expms, p.partner,
+	COALESCE((SELECT MIN(s.time_ms) FROM state_events s WHERE s.kind='peg-in' AND s.key=p.nonce_hash), 0) AS created_ms,
+	COALESCE((SELECT MAX(s.time_ms) FROM state_events s WHERE s.kind='peg-in' AND s.key=p.nonce_hash), 0) AS state_ms
+	FROM pegs p`
+
+// ListExports is the admin handler for /admin/exports,
+// listing exports for triage, by default those not yet finished,
+// filtered by state, asset, destination, age, and error_class,
+// sorted, and paged; see Running.md.
+// With format=csv it serves CSV; otherwise JSON.
+func (c *Custodian) ListExports(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	req.ParseForm()
+	var q backlogQuery
+	pending := []int{int(pegOutNotYet), int(pegOutOK), int(pegOutRetry), int(pegOutFail)}
+	page, err := parseBacklog(req, &q, pegOutStateNames, pending, c.nowMS())
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if s := req.FormValue("destination"); s != "" {
+		q.add("destination=$%d", s)
+	}
+	if s := req.FormValue("error_class"); s != "" {
+		q.add("instr(submit_error, $%d) > 0", `"`+s+`"`)
+	}
+	resp := backlogResp{Offset: page.offset, Entries: []backlogEntry{}}
+	resp.Total, err = c.countBacklog(ctx, exportsView, &q)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	sel := "SELECT key, state, asset_xdr, amount, destination, fee_level, submit_error, partner, created_ms, state_ms FROM (" + exportsView + ")" + q.where() + page.clause()
+	rows, err := c.DB.QueryContext(ctx, sel, q.args...)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "querying exports: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e              backlogEntry
+			txid, assetXDR []byte
+			state          pegOutState
+			submitErr      string
+		)
+		err = rows.Scan(&txid, &state, &assetXDR, &e.Amount, &e.Destination, &e.FeeLevel, &submitErr, &e.Partner, &e.CreatedMS, &e.StateMS)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "scanning export: %s", err)
+			return
+		}
+		e.Key, e.State, e.Asset = hex.EncodeToString(txid), state.String(), assetName(assetXDR)
+		if submitErr != "" {
+			var se stellar.SubmitError
+			if json.Unmarshal([]byte(submitErr), &se) == nil {
+				e.ErrorClass, e.Error = errorClass(&se), se.Message
+			}
+		}
+		resp.Entries = append(resp.Entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading exports: %s", err)
+		return
+	}
+	serveBacklog(w, page, resp, []string{"txid", "state", "asset", "amount", "destination", "created_ms", "state_ms", "partner", "fee_level", "error_class", "error"}, func(e backlogEntry) []string {
+		return []string{strconv.Itoa(e.FeeLevel), e.ErrorClass, e.Error}
+	})
+}
+
+// ListImports is the admin handler for /admin/imports,
+// listing peg-ins for triage, by default those not yet imported,
+// filtered by state, asset, recipient (the destination parameter, in hex), and age,
+// sorted, and paged; see Running.md.
+// With format=csv it serves CSV; otherwise JSON.
+func (c *Custodian) ListImports(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	req.ParseForm()
+	var q backlogQuery
+	pending := []int{int(pegInRecorded), int(pegInPaid)}
+	page, err := parseBacklog(req, &q, pegInStateNames[:pegInExpired], pending, c.nowMS())
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if s := req.FormValue("destination"); s != "" {
+		recip, err := hex.DecodeString(s)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "destination of a peg-in must be a hex recipient pubkey")
+			return
+		}
+		q.add("destination=$%d", recip)
+	}
+	if req.FormValue("error_class") != "" {
+		net.Errorf(w, http.StatusBadRequest, "error_class applies only to exports")
+		return
+	}
+	resp := backlogResp{Offset: page.offset, Entries: []backlogEntry{}}
+	resp.Total, err = c.countBacklog(ctx, importsView, &q)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	sel := "SELECT key, state, asset_xdr, amount, destination, deposit_txid, nonce_expms, partner, created_ms, state_ms FROM (" + importsView + ")" + q.where() + page.clause()
+	rows, err := c.DB.QueryContext(ctx, sel, q.args...)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "querying peg-ins: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e                          backlogEntry
+			nonceHash, assetXDR, recip []byte
+			state                      pegInState
+		)
+		err = rows.Scan(&nonceHash, &state, &assetXDR, &e.Amount, &recip, &e.DepositTxID, &e.ExpMS, &e.Partner, &e.CreatedMS, &e.StateMS)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "scanning peg-in: %s", err)
+			return
+		}
+		e.Key, e.State, e.Destination = hex.EncodeToString(nonceHash), state.String(), hex.EncodeToString(recip)
+		if len(assetXDR) > 0 {
+			e.Asset = assetName(assetXDR)
+		}
+		resp.Entries = append(resp.Entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading peg-ins: %s", err)
+		return
+	}
+	serveBacklog(w, page, resp, []string{"nonce_hash", "state", "asset", "amount", "recipient", "created_ms", "state_ms", "partner", "deposit_txid", "exp_ms"}, func(e backlogEntry) []string {
+		return []string{e.DepositTxID, strconv.FormatInt(e.ExpMS, 10)}
+	})
+}
+
+// serveBacklog writes resp as JSON,
+// or as CSV with the given header
+// and, after the columns common to exports and peg-ins,
+// those of extra.
+// The CSV total is in the X-Total-Count header.
+func serveBacklog(w http.ResponseWriter, page backlogPage, resp backlogResp, header []string, extra func(backlogEntry) []string) {
+	if !page.csv {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("X-Total-Count", strconv.Itoa(resp.Total))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, e := range resp.Entries {
+		cw.Write(append([]string{
+			e.Key,
+			e.State,
+			e.Asset,
+			strconv.FormatInt(e.Amount, 10),
+			e.Destination,
+			strconv.FormatInt(e.CreatedMS, 10),
+			strconv.FormatInt(e.StateMS, 10),
+			e.Partner,
+		}, extra(e)...))
+	}
+	cw.Flush()
+}
@@ -0,0 +1,195 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestBacklog(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, now: func() time.Time { return now }}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usd, err := stellar.ParseAssetKey("USD:GCEZWKCA5VLDNRLN3RPRJMRZOX3Z6G5CHCGSNFHEYVXM3XOJMDS674JZ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, e := range []struct {
+			assetXDR []byte
+			amount   int64
+			dest     string
+		}{
+			{nativeXDR, 10, ""},
+			{usdXDR, 30, "GDEST"},
+			{nativeXDR, 20, "GDEST"},
+			{nativeXDR, 40, ""},
+		} {
+			txid := bytes.Repeat([]byte{byte(i + 1)}, 32)
+			err = c.insertExport(ctx, txid, &pegOut{
+				TxID:        txid,
+				AssetXDR:    e.assetXDR,
+				TempAddr:    "temp",
+				Exporter:    "GEXPORTER",
+				Amount:      e.amount,
+				Anchor:      []byte{},
+				Pubkey:      []byte{},
+				Destination: Destination{Account: e.dest},
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Hour)
+		}
+		failed := &pegOut{TxID: bytes.Repeat([]byte{2}, 32), State: pegOutNotYet}
+		err = c.markFailed(ctx, failed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`UPDATE exports SET submit_error=$1 WHERE txid=$2`, `{"tx_code":"tx_failed","op_codes":["op_success","op_no_trust"],"message":"destination has no trustline for the asset"}`, failed.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.movePegOut(ctx, bytes.Repeat([]byte{4}, 32), pegOutNotYet, pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.movePegOut(ctx, bytes.Repeat([]byte{4}, 32), pegOutOK, pegOutRetired)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list := func(h http.HandlerFunc, uri string, wantCode int) backlogResp {
+			t.Helper()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest("GET", uri, nil))
+			if w.Code != wantCode {
+				t.Fatalf("%s: got status %d, want %d: %s", uri, w.Code, wantCode, w.Body)
+			}
+			var resp backlogResp
+			if wantCode == http.StatusOK {
+				err := json.NewDecoder(w.Body).Decode(&resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return resp
+		}
+		amounts := func(resp backlogResp) []int64 {
+			var got []int64
+			for _, e := range resp.Entries {
+				got = append(got, e.Amount)
+			}
+			return got
+		}
+		for _, tc := range []struct {
+			uri       string
+			want      []int64
+			wantTotal int
+		}{
+			{"/admin/exports", []int64{10, 30, 20}, 3},
+			{"/admin/exports?state=all&sort=-amount", []int64{40, 30, 20, 10}, 4},
+			{"/admin/exports?state=not-yet,retired", []int64{10, 20, 40}, 3},
+			{"/admin/exports?asset=native", []int64{10, 20}, 2},
+			{"/admin/exports?destination=GDEST", []int64{30, 20}, 2},
+			{"/admin/exports?destination=GEXPORTER", []int64{10}, 1},
+			{"/admin/exports?error_class=op_no_trust", []int64{30}, 1},
+			{"/admin/exports?min_age=150m", []int64{10, 30}, 2},
+			{"/admin/exports?max_age=150m&state=all", []int64{20, 40}, 2},
+			{"/admin/exports?sort=amount&limit=2&offset=1", []int64{20, 30}, 3},
+		} {
+			resp := list(c.ListExports, tc.uri, http.StatusOK)
+			if got := amounts(resp); !reflect.DeepEqual(got, tc.want) || resp.Total != tc.wantTotal {
+				t.Errorf("%s: got amounts %v of %d, want %v of %d", tc.uri, got, resp.Total, tc.want, tc.wantTotal)
+			}
+		}
+		resp := list(c.ListExports, "/admin/exports?state=fail", http.StatusOK)
+		if len(resp.Entries) != 1 || resp.Entries[0].ErrorClass != "op_no_trust" || resp.Entries[0].Destination != "GDEST" {
+			t.Errorf("got failed exports %+v", resp.Entries)
+		}
+		for _, uri := range []string{"/admin/exports?state=stuck", "/admin/exports?sort=age", "/admin/exports?limit=0", "/admin/exports?min_age=soon", "/admin/exports?asset=gold"} {
+			list(c.ListExports, uri, http.StatusBadRequest)
+		}
+
+		w := httptest.NewRecorder()
+		c.ListExports(w, httptest.NewRequest("GET", "/admin/exports?format=csv&state=all", nil))
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 5 || records[0][0] != "txid" || records[2][9] != "op_no_trust" {
+			t.Errorf("got CSV %v", records)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != "4" {
+			t.Errorf("got X-Total-Count %q, want 4", got)
+		}
+
+		recip := bytes.Repeat([]byte{7}, 32)
+		for i, nonceHash := range []string{"recorded", "paid", "imported"} {
+			err = c.insertPegIn(ctx, []byte(nonceHash), recip, int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = db.Exec(`UPDATE pegs SET amount=5, asset_xdr=$1 WHERE nonce_hash IN ($2, $3)`, nativeXDR, []byte("paid"), []byte("imported"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, nonceHash := range []string{"paid", "imported"} {
+			_, err = c.transitionPegIn(ctx, []byte(nonceHash), pegInRecorded, pegInPaid)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = c.transitionPegIn(ctx, []byte("imported"), pegInPaid, pegInImported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = list(c.ListImports, "/admin/imports?destination="+hex.EncodeToString(recip), http.StatusOK)
+		if resp.Total != 2 || resp.Entries[0].Asset != "native" || resp.Entries[1].State != "recorded" {
+			t.Errorf("got pending imports %+v", resp)
+		}
+		if resp := list(c.ListImports, "/admin/imports?state=imported", http.StatusOK); resp.Total != 1 {
+			t.Errorf("got imported peg-ins %+v", resp)
+		}
+		list(c.ListImports, "/admin/imports?error_class=op_no_trust", http.StatusBadRequest)
+		list(c.ListImports, "/admin/imports?state=expired", http.StatusBadRequest)
+	})
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		se   stellar.SubmitError
+		want string
+	}{
+		{stellar.SubmitError{TxCode: "tx_bad_seq"}, "tx_bad_seq"},
+		{stellar.SubmitError{TxCode: "tx_failed", OpCodes: []string{"op_success", "op_underfunded"}}, "op_underfunded"},
+	} {
+		if got := errorClass(&tc.se); got != tc.want {
+			t.Errorf("errorClass(%+v) = %q, want %q", tc.se, got, tc.want)
+		}
+	}
+}
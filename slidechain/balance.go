@@ -0,0 +1,178 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/oracle"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+const lowBalanceAlert = "low-balance"
+
+// baseReserve is the Stellar reserve for an account and each of its subentries.
+const baseReserve = xlm.Lumen / 2
+
+// spareBalance returns the custodian account's native balance
+// less its reserve and the lumens it holds for pegged-in value
+// that has not been pegged out.
+func (c *Custodian) spareBalance(ctx context.Context, sc *stellarChain) (xlm.Amount, error) {
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	acct, err := stellar.WithContext(tctx, sc.hclient).LoadAccount(sc.account)
+	if err != nil {
+		return 0, errors.Wrap(err, "loading custodian account")
+	}
+	s, err := acct.GetNativeBalance()
+	if err != nil {
+		return 0, errors.Wrap(err, "reading custodian balance")
+	}
+	bal, err := xlm.Parse(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing custodian balance %q", s)
+	}
+	owed, err := c.owedLumens(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return bal - xlm.Amount(2+acct.SubentryCount)*baseReserve - owed, nil
+}
+
+// owedLumens returns the lumens pegged in
+// less those pegged out.
+func (c *Custodian) owedLumens(ctx context.Context) (xlm.Amount, error) {
+	nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+	if err != nil {
+		return 0, errors.Wrap(err, "marshaling native asset")
+	}
+	var in, out int64
+	const inQ = `SELECT COALESCE(SUM(amount), 0) FROM pegs WHERE asset_xdr=$1 AND state IN ($2, $3)`
+	err = c.DB.QueryRowContext(ctx, inQ, nativeXDR, pegInPaid, pegInImported).Scan(&in)
+	if err != nil {
+		return 0, errors.Wrap(err, "summing native peg-ins")
+	}
+	const outQ = `SELECT COALESCE(SUM(amount), 0) FROM exports WHERE asset_xdr=$1 AND pegged_out IN ($2, $3)`
+	err = c.DB.QueryRowContext(ctx, outQ, nativeXDR, pegOutOK, pegOutRetired).Scan(&out)
+	if err != nil {
+		return 0, errors.Wrap(err, "summing native peg-outs")
+	}
+	return xlm.Amount(in - out), nil
+}
+
+// watchBalance checks the custodian's spare balance
+// every balance.check_interval.
+func (c *Custodian) watchBalance(ctx context.Context, sc *stellarChain, interval time.Duration) {
+	defer log.Print("watchBalance exiting")
+
+	below := make(map[int64]bool)
+	belowValue := make(map[int64]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := c.checkBalance(ctx, sc, below)
+		if err != nil {
+			log.Printf("checking custodian balance: %s", err)
+		}
+		err = c.checkBalanceValue(ctx, sc, belowValue)
+		if err != nil {
+			log.Printf("valuing custodian balance: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBalance tops up the custodian's spare balance, if configured,
+// and raises an alert for each threshold it has newly fallen below.
+// The thresholds it is below are kept in below,
+// so that a threshold alerts again once the balance recovers and falls again.
+func (c *Custodian) checkBalance(ctx context.Context, sc *stellarChain, below map[int64]bool) error {
+	cfg := c.config()
+	if cfg == nil {
+		return nil
+	}
+	spare, err := c.spareBalance(ctx, sc)
+	if err != nil {
+		return err
+	}
+	if cfg.Balance.TopUp {
+		level := cfg.Balance.MinSpare
+		for _, t := range cfg.Balance.AlertThresholds {
+			if t > level {
+				level = t
+			}
+		}
+		if int64(spare) < level {
+			err = stellar.TopUpFrom(sc.hclient, cfg.Horizon.FriendbotURL, sc.network, sc.account)
+			if err != nil {
+				return errors.Wrap(err, "topping up custodian account")
+			}
+			log.Printf("topped up custodian account from %s spare", spare)
+			spare, err = c.spareBalance(ctx, sc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range cfg.Balance.AlertThresholds {
+		if int64(spare) >= t {
+			delete(below, t)
+			continue
+		}
+		if below[t] {
+			continue
+		}
+		below[t] = true
+		detail := fmt.Sprintf("custodian account %s has %s spare, below %s", sc.account, spare, xlm.Amount(t))
+		err = c.alert(ctx, lowBalanceAlert, []byte(strconv.FormatInt(t, 10)), detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBalanceValue is like checkBalance for balance.alert_values,
+// pricing the spare balance with the oracle.
+func (c *Custodian) checkBalanceValue(ctx context.Context, sc *stellarChain, below map[int64]bool) error {
+	cfg := c.config()
+	if cfg == nil || len(cfg.Balance.AlertValues) == 0 {
+		return nil
+	}
+	o := c.oracle()
+	if o == nil {
+		return nil
+	}
+	spare, err := c.spareBalance(ctx, sc)
+	if err != nil {
+		return err
+	}
+	value, err := oracle.Value(ctx, o, stellar.NativeAsset(), int64(spare))
+	if err != nil {
+		return errors.Wrap(err, "pricing lumens")
+	}
+	for _, t := range cfg.Balance.AlertValues {
+		if value >= t {
+			delete(below, t)
+			continue
+		}
+		if below[t] {
+			continue
+		}
+		below[t] = true
+		detail := fmt.Sprintf("custodian account %s has %s spare, worth %d %s, below %d", sc.account, spare, value, cfg.Oracle.Currency, t)
+		err = c.alert(ctx, lowBalanceAlert, []byte("value:"+strconv.FormatInt(t, 10)), detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
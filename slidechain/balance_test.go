@@ -0,0 +1,118 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestBalance(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), int64(10*xlm.Lumen))
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = srv.URL() + "/friendbot"
+	cfg.Admin.PauseFile = ""
+	cfg.Balance.MinSpare = int64(xlm.Lumen)
+	cfg.Balance.AlertThresholds = []int64{int64(5 * xlm.Lumen), int64(100 * xlm.Lumen)}
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+
+		alerts := func() int {
+			t.Helper()
+			var n int
+			err := db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, lowBalanceAlert).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		check := func(below map[int64]bool) {
+			t.Helper()
+			err := c.checkBalance(ctx, sc, below)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 10 lumens less the 1-lumen account reserve.
+		spare, err := c.spareBalance(ctx, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 9 * xlm.Lumen; spare != want {
+			t.Errorf("got spare balance %s, want %s", spare, want)
+		}
+		below := make(map[int64]bool)
+		check(below)
+		check(below)
+		if got := alerts(); got != 1 {
+			t.Errorf("got %d low-balance alerts at %s spare, want 1", got, spare)
+		}
+
+		// Pegged-in lumens are not spare.
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, $3, $4, 1, $5)`, []byte("nonce"), int64(6*xlm.Lumen), nativeXDR, testRecipPubKey, pegInPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(below)
+		if got := alerts(); got != 2 {
+			t.Errorf("got %d low-balance alerts at 3 lumens spare, want 2", got)
+		}
+		body, err := json.Marshal(PrePegIn{Amount: 1, AssetXDR: nativeXDR, RecipPubkey: testRecipPubKey, ExpMS: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("pre-peg-in at 3 lumens spare: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+
+		cfg.Balance.TopUp = true
+		check(below)
+		spare, err = c.spareBalance(ctx, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spare < 1000*xlm.Lumen {
+			t.Errorf("got spare balance %s after topping up", spare)
+		}
+		if len(below) != 0 {
+			t.Errorf("still below thresholds %v after topping up", below)
+		}
+		if got := alerts(); got != 2 {
+			t.Errorf("got %d low-balance alerts after topping up, want 2", got)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+const pegCapAlert = "peg-cap"
+
+// assetCap is an entry of /admin/caps:
+// a cap on the outstanding issuance of an asset.
+type assetCap struct {
+	Asset       string `json:"asset"` // native or CODE:ISSUER
+	Cap         int64  `json:"cap"`
+	Note        string `json:"note"`
+	Outstanding int64  `json:"outstanding"` // in a GET response
+	TimeMS      int64  `json:"time_ms,omitempty"`
+}
+
+// outstandingIssuance is the amount of the asset
+// imported onto txvm and not paid out on Stellar since,
+// counting the amount paid on Stellar and awaiting import if pending is true.
+func (c *Custodian) outstandingIssuance(ctx context.Context, assetXDR []byte, pending bool) (int64, error) {
+	imported := pegInImported
+	if pending {
+		imported = pegInPaid
+	}
+	const q = `SELECT
+		(SELECT COALESCE(SUM(amount), 0) FROM pegs WHERE asset_xdr=$1 AND state IN ($2, $3)) -
+		(SELECT COALESCE(SUM(amount), 0) FROM exports WHERE asset_xdr=$1 AND pegged_out IN ($4, $5))`
+	var n int64
+	err := c.DB.QueryRowContext(ctx, q, assetXDR, imported, pegInImported, pegOutOK, pegOutRetired).Scan(&n)
+	return n, errors.Wrapf(err, "totaling outstanding issuance of %s", assetName(assetXDR))
+}
+
+// pegCapRoom is how much more of the asset may be issued under its cap,
+// as outstandingIssuance counts it,
+// reporting false if it has no cap.
+func (c *Custodian) pegCapRoom(ctx context.Context, assetXDR []byte, pending bool) (int64, bool, error) {
+	var limit int64
+	err := c.DB.QueryRowContext(ctx, `SELECT cap FROM asset_caps WHERE asset_xdr=$1`, assetXDR).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "reading cap of %s", assetName(assetXDR))
+	}
+	outstanding, err := c.outstandingIssuance(ctx, assetXDR, pending)
+	if err != nil {
+		return 0, false, err
+	}
+	return limit - outstanding, true, nil
+}
+
+// checkPegCap reports whether the paid peg-in p may be imported
+// within its asset's cap.
+// The first time a peg-in is held for exceeding the cap,
+// operators are alerted.
+func (c *Custodian) checkPegCap(ctx context.Context, p *pegIn) (bool, error) {
+	room, capped, err := c.pegCapRoom(ctx, p.AssetXDR, false)
+	if err != nil || !capped || p.Amount <= room {
+		return err == nil, err
+	}
+	alerted, err := c.alerted(ctx, pegCapAlert, p.NonceHash)
+	if err != nil || alerted {
+		return false, err
+	}
+	detail := fmt.Sprintf("peg-in %x of %d %s held: %d more may be issued under its cap", p.NonceHash, p.Amount, assetName(p.AssetXDR), room)
+	return false, c.alert(ctx, pegCapAlert, p.NonceHash, detail)
+}
+
+// overPegCap reports whether the deposit d pays a recorded peg-in
+// that would take its asset past its cap,
+// counting the peg-ins paid and awaiting import.
+func (c *Custodian) overPegCap(ctx context.Context, d Deposit) (bool, error) {
+	room, capped, err := c.pegCapRoom(ctx, d.Asset, true)
+	if err != nil || !capped || d.Amount <= room {
+		return false, err
+	}
+	var n int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM pegs WHERE nonce_hash=$1 AND state=$2`, d.NonceHash, pegInRecorded).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading peg-in %x", d.NonceHash)
+	}
+	return n > 0, nil
+}
+
+func (c *Custodian) assetsConfig() config.Assets {
+	if cfg := c.config(); cfg != nil {
+		return cfg.Assets
+	}
+	return config.Default().Assets
+}
+
+// Caps is the admin handler for the caps on outstanding issuance.
+// GET lists them with each asset's outstanding issuance,
+// POST adds or replaces the cap given as a JSON assetCap,
+// and DELETE removes the cap on the asset parameter.
+// Held peg-ins are reconsidered after each change.
+func (c *Custodian) Caps(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	source := "admin-api " + req.RemoteAddr
+	parse := func(key string) ([]byte, bool) {
+		asset, err := stellar.ParseAssetKey(key)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "asset: %s", err)
+			return nil, false
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "marshaling asset: %s", err)
+			return nil, false
+		}
+		return assetXDR, true
+	}
+	switch req.Method {
+	case http.MethodGet:
+		var (
+			entries = []assetCap{}
+			assets  [][]byte
+		)
+		const q = `SELECT asset_xdr, cap, note, time_ms FROM asset_caps`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(assetXDR []byte, limit int64, note string, timeMS int64) {
+			entries = append(entries, assetCap{Asset: assetName(assetXDR), Cap: limit, Note: note, TimeMS: timeMS})
+			assets = append(assets, assetXDR)
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading caps: %s", err)
+			return
+		}
+		for i := range entries {
+			entries[i].Outstanding, err = c.outstandingIssuance(ctx, assets[i], false)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+
+	case http.MethodPost:
+		var a assetCap
+		err := json.NewDecoder(req.Body).Decode(&a)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+			return
+		}
+		if a.Cap < 0 {
+			net.Errorf(w, http.StatusBadRequest, "cap must not be negative")
+			return
+		}
+		assetXDR, ok := parse(a.Asset)
+		if !ok {
+			return
+		}
+		const q = `INSERT INTO asset_caps (asset_xdr, cap, note, time_ms) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (asset_xdr) DO UPDATE SET cap=excluded.cap, note=excluded.note, time_ms=excluded.time_ms`
+		_, err = c.DB.ExecContext(ctx, q, assetXDR, a.Cap, a.Note, c.nowMS())
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "recording cap: %s", err)
+			return
+		}
+		err = c.recordAudit(ctx, "cap.set", source, fmt.Sprintf("%s: %d: %s", assetName(assetXDR), a.Cap, a.Note))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+
+	case http.MethodDelete:
+		assetXDR, ok := parse(req.FormValue("asset"))
+		if !ok {
+			return
+		}
+		res, err := c.DB.ExecContext(ctx, `DELETE FROM asset_caps WHERE asset_xdr=$1`, assetXDR)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "removing cap: %s", err)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			net.Errorf(w, http.StatusNotFound, "%s has no cap", assetName(assetXDR))
+			return
+		}
+		err = c.recordAudit(ctx, "cap.remove", source, assetName(assetXDR))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "caps support GET, POST, and DELETE")
+		return
+	}
+	if c.imports != nil {
+		c.imports.Broadcast()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
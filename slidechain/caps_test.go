@@ -0,0 +1,116 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestPegCaps(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db, imports: sync.NewCond(new(sync.Mutex))}
+		assetXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		caps := func(method, uri, body string) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.Caps(w, httptest.NewRequest(method, uri, strings.NewReader(body)))
+			return w
+		}
+		if w := caps("POST", "/admin/caps", `{"asset": "native", "cap": -1}`); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for a negative cap, want %d", w.Code, http.StatusBadRequest)
+		}
+		if w := caps("POST", "/admin/caps", `{"asset": "native", "cap": 100, "note": "pilot"}`); w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d setting a cap: %s", w.Code, w.Body)
+		}
+
+		const q = `INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, $3, $4, 1, $5)`
+		for _, p := range []struct {
+			nonceHash string
+			amount    int64
+			state     pegInState
+		}{
+			{"imported", 60, pegInImported},
+			{"paid", 50, pegInPaid},
+			{"recorded", 0, pegInRecorded},
+		} {
+			_, err = db.Exec(q, []byte(p.nonceHash), p.amount, assetXDR, []byte("recip"), p.state)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		paid := &pegIn{NonceHash: []byte("paid"), Amount: 50, AssetXDR: assetXDR}
+		ok, err := c.checkPegCap(ctx, paid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("imported 50 with only 40 left under the cap")
+		}
+		alerted, err := c.alerted(ctx, pegCapAlert, paid.NonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for a peg-in held by its cap")
+		}
+		d := Deposit{NonceHash: []byte("recorded"), Amount: 1, Asset: assetXDR}
+		over, err := c.overPegCap(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !over {
+			t.Error("deposit of 1 is within the cap with 110 imported or awaiting import")
+		}
+
+		// Paying out an export makes room.
+		_, err = db.Exec(`INSERT INTO exports (txid, exporter, amount, asset_xdr, temp_addr, seqnum, anchor, pubkey, pegged_out) VALUES ('tx', 'exporter', 20, $1, 'temp', 1, x'01', x'02', $2)`, assetXDR, pegOutRetired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err = c.checkPegCap(ctx, paid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("held a peg-in of 50 with 60 left under the cap")
+		}
+		w := caps("GET", "/admin/caps", "")
+		var entries []assetCap
+		err = json.Unmarshal(w.Body.Bytes(), &entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Asset != "native" || entries[0].Cap != 100 || entries[0].Outstanding != 40 {
+			t.Errorf("got caps %+v, want native capped at 100 with 40 outstanding", entries)
+		}
+
+		if w := caps("DELETE", "/admin/caps?asset=native", ""); w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d removing a cap: %s", w.Code, w.Body)
+		}
+		over, err = c.overPegCap(ctx, Deposit{NonceHash: []byte("recorded"), Amount: 1000, Asset: assetXDR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if over {
+			t.Error("deposit over a removed cap")
+		}
+		if w := caps("DELETE", "/admin/caps?asset=native", ""); w.Code != http.StatusNotFound {
+			t.Errorf("got status %d removing a missing cap, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
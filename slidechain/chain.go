@@ -0,0 +1,165 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Chain is the main chain that slidechain is pegged to.
+// Values are pegged in by deposits to the custodian there,
+// and pegged out by withdrawals from the custodian there.
+// The custodian's peg-in and peg-out logic works only through this interface,
+// so another main chain can be supported by implementing it.
+// See stellarChain for the Stellar implementation.
+type Chain interface {
+	// WatchDeposits calls f on each deposit to the custodian
+	// in the main-chain txs after cursor, in order,
+	// until ctx is canceled, the chain fails, or f returns an error.
+	// It returns the cursor after the last tx it read,
+	// from which watching can resume.
+	WatchDeposits(ctx context.Context, cursor string, f func(Deposit) error) (string, error)
+
+	// SubmitWithdrawal submits the withdrawal at the given fee level,
+	// in [0, FeeLevels()),
+	// and reports whether it was applied.
+	// If the result is not WithdrawalApplied, the error says why.
+	// It is ErrFeeNotAuthorized if the withdrawal
+	// cannot be made at that fee level.
+	SubmitWithdrawal(ctx context.Context, w *Withdrawal, feeLevel int) (WithdrawalResult, error)
+
+	// VerifyFinality reports whether the withdrawal has been applied,
+	// at any fee level,
+	// and can no longer be reverted.
+	VerifyFinality(ctx context.Context, w *Withdrawal) (bool, error)
+
+	// VerifyDeposit reports whether the main chain has the deposit d,
+	// as passed to the callback of WatchDeposits,
+	// by looking it up again.
+	VerifyDeposit(ctx context.Context, d Deposit) (bool, error)
+
+	// ValidateWithdrawal checks the main-chain parts of a withdrawal
+	// taken from the untrusted reference data of an export tx:
+	// its asset and addresses.
+	// It must return an error, not panic, on malformed input.
+	ValidateWithdrawal(w *Withdrawal) error
+
+	// FeeLevels is the number of fee levels at which
+	// a withdrawal can be submitted.
+	// Level 0 is the cheapest.
+	FeeLevels() int
+}
+
+// Deposit is a payment to the custodian on the main chain,
+// made for a peg-in.
+type Deposit struct {
+	TxID      string // main-chain tx ID
+	OpIndex   int    // distinguishes the deposits of one main-chain tx
+	Cursor    string // resumes watching without missing later deposits
+	NonceHash []byte // identifies the peg-in recorded by the pre-peg-in tx
+	Asset     []byte // main-chain asset, as recorded in the pegs table
+	Amount    int64
+
+	// Sender is the main-chain account that made the deposit,
+	// and TimeMS when the main chain included it,
+	// if known.
+	Sender string
+	TimeMS int64
+}
+
+// sameDeposit reports whether a and b are the same deposit.
+// Cursors are not compared.
+func sameDeposit(a, b Deposit) bool {
+	return a.TxID == b.TxID && bytes.Equal(a.NonceHash, b.NonceHash) && bytes.Equal(a.Asset, b.Asset) && a.Amount == b.Amount
+}
+
+// Withdrawal is a payment from the custodian on the main chain,
+// made for a peg-out.
+// It is described by the reference data of the export tx.
+type Withdrawal struct {
+	ExportTxID []byte
+	Asset      []byte // main-chain asset, as in the export's reference data
+	Amount     int64
+	Recipient  string // main-chain address of the exporter
+
+	// TempAddr and Seqnum identify the account created for the withdrawal
+	// by the exporter's pre-export tx.
+	TempAddr string
+	Seqnum   int64
+
+	// TimeBounds are those of the preauthorized withdrawal txs, if any.
+	TimeBounds TimeBounds
+
+	// Destination is the account paid in place of Recipient, if any.
+	Destination Destination
+}
+
+// WithdrawalResult is the outcome of submitting a withdrawal.
+type WithdrawalResult int
+
+const (
+	// WithdrawalPending means the withdrawal may or may not have been applied,
+	// e.g. after a timeout,
+	// and must be submitted again.
+	WithdrawalPending WithdrawalResult = iota
+
+	// WithdrawalApplied means the withdrawal has been applied.
+	WithdrawalApplied
+
+	// WithdrawalRejected means the withdrawal was not applied
+	// and never will be.
+	// The exported value is refunded on txvm.
+	WithdrawalRejected
+)
+
+// ErrFeeNotAuthorized is the error from SubmitWithdrawal
+// for a fee level at which the withdrawal cannot be made.
+var ErrFeeNotAuthorized = errors.New("withdrawal fee level not authorized")
+
+// chainCallTimeout bounds each withdrawal call to the main chain,
+// so that an unresponsive node holds up the peg-outs
+// only until the call is retried.
+// A call that times out may still have been applied;
+// its withdrawal is pending, like one after any other error.
+const chainCallTimeout = 30 * time.Second
+
+// submitWithdrawal is c.chain.SubmitWithdrawal with chainCallTimeout.
+func (c *Custodian) submitWithdrawal(ctx context.Context, w *Withdrawal, feeLevel int) (WithdrawalResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	return c.chain.SubmitWithdrawal(ctx, w, feeLevel)
+}
+
+// verifyFinality is c.chain.VerifyFinality with chainCallTimeout.
+func (c *Custodian) verifyFinality(ctx context.Context, w *Withdrawal) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	return c.chain.VerifyFinality(ctx, w)
+}
+
+// pegOutState is the export state for the withdrawal result.
+func (r WithdrawalResult) pegOutState() pegOutState {
+	switch r {
+	case WithdrawalApplied:
+		return pegOutOK
+	case WithdrawalRejected:
+		return pegOutFail
+	}
+	return pegOutRetry
+}
+
+// withdrawal is the withdrawal that pegs out the export.
+func (p *pegOut) withdrawal() *Withdrawal {
+	return &Withdrawal{
+		ExportTxID:  p.TxID,
+		Asset:       p.AssetXDR,
+		Amount:      p.Amount,
+		Recipient:   p.Exporter,
+		TempAddr:    p.TempAddr,
+		Seqnum:      p.Seqnum,
+		TimeBounds:  p.TimeBounds,
+		Destination: p.Destination,
+	}
+}
@@ -0,0 +1,95 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// checkpointDataName is the name of the custodian account's data entry
+// holding the latest checkpoint:
+// the 8-byte big-endian height of a slidechain block followed by its ID.
+// The checkpoint tx also has the block ID as its hash memo,
+// so every checkpoint remains in the account's tx history.
+const checkpointDataName = "slidechain.checkpoint"
+
+// Runs as a goroutine.
+func (c *Custodian) anchorCheckpoints(ctx context.Context, interval time.Duration) {
+	defer log.Print("anchorCheckpoints exiting")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.checkpoint(ctx)
+		if err != nil {
+			log.Printf("anchoring checkpoint: %s", err)
+		}
+	}
+}
+
+// checkpoint publishes the ID of the latest block to Stellar
+// if checkpoint.interval has passed since the last checkpoint
+// and there is a new block.
+func (c *Custodian) checkpoint(ctx context.Context) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil
+	}
+	cfg := c.config()
+	if cfg == nil || cfg.Checkpoint.Interval <= 0 {
+		return nil
+	}
+	var lastHeight, lastMS int64
+	err := c.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(height), 0), COALESCE(MAX(time_ms), 0) FROM checkpoints`).Scan(&lastHeight, &lastMS)
+	if err != nil {
+		return errors.Wrap(err, "reading last checkpoint")
+	}
+	interval := time.Duration(cfg.Checkpoint.Interval)
+	if c.nowMS() < lastMS+int64(interval/time.Millisecond) {
+		return nil
+	}
+	height := c.S.chain.Height()
+	if int64(height) <= lastHeight {
+		return nil
+	}
+	block, err := c.S.chain.GetBlock(ctx, height)
+	if err != nil {
+		return errors.Wrapf(err, "getting block %d", height)
+	}
+	id := block.Hash()
+
+	value := make([]byte, 8, 40)
+	binary.BigEndian.PutUint64(value, height)
+	value = append(value, id.Bytes()...)
+	addr := sc.account
+	succ, err := sc.seqs.Submit(addr, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: sc.network,
+			Source:  addr,
+			SeqNum:  seqnum,
+			Memo:    stellar.MemoHash(id.Byte32()),
+			Ops: []stellar.Op{
+				stellar.ManageData{Name: checkpointDataName, Value: value},
+			},
+		}, nil
+	}, sc.seed)
+	if err != nil {
+		return errors.Wrapf(err, "anchoring block %d", height)
+	}
+	const q = `INSERT INTO checkpoints (height, block_id, stellar_txid, time_ms) VALUES ($1, $2, $3, $4)`
+	_, err = c.DB.ExecContext(ctx, q, height, id.Bytes(), succ.Hash, c.nowMS())
+	if err != nil {
+		return errors.Wrapf(err, "recording checkpoint of block %d", height)
+	}
+	log.Printf("anchored block %d (%x) in Stellar tx %s", height, id.Bytes(), succ.Hash)
+	return nil
+}
@@ -0,0 +1,112 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Checkpoint.Interval = config.Duration(time.Hour)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newBlock := func() {
+			t.Helper()
+			expMS := int64(bc.Millis(now.Add(time.Duration(c.S.chain.Height()) * time.Minute)))
+			tx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), nil, testRecipPubKey, 1, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.S.submitTx(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// checkAnchored checks that the custodian account's checkpoint
+		// is the latest block, at the given height.
+		checkAnchored := func(height uint64) {
+			t.Helper()
+			acct, err := srv.Client().LoadAccount(custKP.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := base64.StdEncoding.DecodeString(acct.Data[checkpointDataName])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := c.S.chain.GetBlock(ctx, height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(value) != 40 || binary.BigEndian.Uint64(value) != height || !bytes.Equal(value[8:], b.Hash().Bytes()) {
+				t.Errorf("got checkpoint %x, want block %d (%x)", value, height, b.Hash().Bytes())
+			}
+		}
+
+		newBlock()
+		err = c.checkpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnchored(2)
+
+		// The next checkpoint waits for the interval.
+		newBlock()
+		err = c.checkpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnchored(2)
+		now = now.Add(time.Hour)
+		err = c.checkpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnchored(3)
+
+		// With no new block, there is nothing to anchor.
+		now = now.Add(time.Hour)
+		err = c.checkpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM checkpoints`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %d checkpoints, want 2", n)
+		}
+	})
+}
@@ -0,0 +1,374 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/amount"
+)
+
+// The issuer of a pegged credit asset with AUTH_CLAWBACK_ENABLED
+// can claw back the custodian's balance of it,
+// leaving the imported value on slidechain unbacked.
+// The custodian detects a clawback as a shortfall
+// of its balance against the value pegged in and not out,
+// records it in the clawbacks table,
+// and attributes it to the latest imported peg-in of the same amount,
+// whose recipient's balance of the imported asset clawback.policy
+// freezes or claws back.
+// Frozen balances are recorded in the frozen table;
+// txs submitted from outside that spend them are refused.
+
+// errFrozen is the error for a submitted tx that spends frozen value.
+var errFrozen = errors.New("spends frozen value")
+
+func (c *Custodian) watchClawbacks(ctx context.Context, sc *stellarChain, interval time.Duration) {
+	defer log.Print("watchClawbacks exiting")
+
+	short := make(map[string]int64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.checkClawbacks(ctx, sc, short)
+		if err != nil {
+			log.Printf("checking for clawbacks: %s", err)
+		}
+	}
+}
+
+// checkClawbacks compares the custodian's balance of each pegged credit asset
+// with what it owes for it.
+// The shortfall of each asset at the last check is kept in short, by asset key;
+// a shortfall in two checks running is a clawback of the lesser of the two.
+// (Requiring two rides out a peg-in or peg-out
+// caught between Stellar and the db.)
+// The custodian's own wrapped assets are reconciled in issuer mode instead.
+func (c *Custodian) checkClawbacks(ctx context.Context, sc *stellarChain, short map[string]int64) error {
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	acct, err := stellar.WithContext(tctx, sc.hclient).LoadAccount(sc.account)
+	if err != nil {
+		return errors.Wrap(err, "loading custodian account")
+	}
+	balances := make(map[string]int64)
+	for _, bal := range acct.Balances {
+		if bal.AssetType == "native" {
+			continue
+		}
+		n, err := amount.ParseInt64(bal.Balance)
+		if err != nil {
+			return errors.Wrapf(err, "parsing custodian balance of %s:%s", bal.AssetCode, bal.AssetIssuer)
+		}
+		balances[bal.AssetCode+":"+bal.AssetIssuer] = n
+	}
+
+	var assets [][]byte
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs WHERE asset_xdr IS NOT NULL AND state IN ($1, $2)`, pegInPaid, pegInImported, func(assetXDR []byte) {
+		assets = append(assets, assetXDR)
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading pegged-in assets")
+	}
+	for _, assetXDR := range assets {
+		asset, err := stellar.DecodeAsset(assetXDR)
+		if err != nil || asset.IsNative() {
+			continue
+		}
+		code, issuer := asset.Code, asset.Issuer
+		if issuer == sc.account {
+			continue
+		}
+		key := code + ":" + issuer
+		owed, err := c.owed(ctx, assetXDR)
+		if err != nil {
+			return err
+		}
+		shortfall := owed - balances[key]
+		prev := short[key]
+		if shortfall <= 0 {
+			delete(short, key)
+			continue
+		}
+		short[key] = shortfall
+		if prev <= 0 {
+			continue
+		}
+		if prev < shortfall {
+			shortfall = prev
+		}
+		delete(short, key)
+		err = c.recordClawback(ctx, assetXDR, key, shortfall)
+		if err != nil {
+			return errors.Wrapf(err, "recording clawback of %d %s", shortfall, key)
+		}
+	}
+	return nil
+}
+
+// owed returns the amount of the main-chain asset pegged in
+// less that pegged out,
+// deposits awaiting refund,
+// and that clawed back from the custodian.
+func (c *Custodian) owed(ctx context.Context, assetXDR []byte) (int64, error) {
+	var owed int64
+	const q = `SELECT
+		(SELECT COALESCE(SUM(amount), 0) FROM pegs WHERE asset_xdr=$1 AND state IN ($2, $3))
+		- (SELECT COALESCE(SUM(amount), 0) FROM exports WHERE asset_xdr=$1 AND pegged_out IN ($4, $5))
+		+ (SELECT COALESCE(SUM(amount), 0) FROM deposit_refunds WHERE asset_xdr=$1 AND state!=$6)
+		- (SELECT COALESCE(SUM(amount), 0) FROM clawbacks WHERE asset_xdr=$1)`
+	err := c.DB.QueryRowContext(ctx, q, assetXDR, pegInPaid, pegInImported, pegOutOK, pegOutRetired, refundPaid).Scan(&owed)
+	return owed, errors.Wrap(err, "computing amount owed")
+}
+
+// recordClawback records a clawback of amount of the main-chain asset assetXDR,
+// named key, and applies clawback.policy to it.
+func (c *Custodian) recordClawback(ctx context.Context, assetXDR []byte, key string, amount int64) error {
+	policy := "alert"
+	if cfg := c.config(); cfg != nil {
+		policy = cfg.Clawback.Policy
+	}
+	var (
+		nonceHash, recip []byte
+		version          int
+	)
+	const pegQ = `SELECT nonce_hash, recipient_pubkey, issuance_version FROM pegs
+		WHERE asset_xdr=$1 AND amount=$2 AND state=$3 ORDER BY rowid DESC LIMIT 1`
+	err := c.DB.QueryRowContext(ctx, pegQ, assetXDR, amount, pegInImported).Scan(&nonceHash, &recip, &version)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "attributing clawback")
+	}
+	nowMS := c.nowMS()
+	const q = `INSERT INTO clawbacks (asset_xdr, amount, detected_ms, nonce_hash, recipient_pubkey, policy) VALUES ($1, $2, $3, $4, $5, $6)`
+	res, err := c.DB.ExecContext(ctx, q, assetXDR, amount, nowMS, nonceHash, recip, policy)
+	if err != nil {
+		return errors.Wrap(err, "recording clawback")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "getting clawback id")
+	}
+	detail := fmt.Sprintf("%d of %s clawed back from the custodian account", amount, key)
+	switch {
+	case recip == nil:
+		detail += "; no imported peg-in of that amount to attribute it to"
+	case policy == "alert":
+		detail += fmt.Sprintf(", matching peg-in %x to %x", nonceHash, recip)
+	default:
+		ic := issuanceContracts[version]
+		assetID := ic.assetID(assetXDR)
+		var clawed int64
+		if policy == "clawback" && ic.delegated {
+			var txid []byte
+			clawed, txid, err = c.clawBack(ctx, recip, assetID, amount)
+			if err != nil {
+				return errors.Wrapf(err, "clawing back %d of %x from %x", amount, assetID.Bytes(), recip)
+			}
+			if clawed > 0 {
+				_, err = c.DB.ExecContext(ctx, `UPDATE clawbacks SET clawed_back=$1, txid=$2 WHERE id=$3`, clawed, txid, id)
+				if err != nil {
+					return errors.Wrap(err, "recording slidechain clawback")
+				}
+				detail += fmt.Sprintf("; %d retired from %x in tx %x", clawed, recip, txid)
+			}
+		}
+		if clawed < amount {
+			err = c.freeze(ctx, recip, assetID.Bytes(), fmt.Sprintf("clawback %d", id), id)
+			if err != nil {
+				return err
+			}
+			detail += fmt.Sprintf("; imported asset %x of %x frozen", assetID.Bytes(), recip)
+		}
+	}
+	log.Print(detail)
+	return c.alert(ctx, clawbackAlert, []byte(fmt.Sprintf("clawback %d", id)), detail)
+}
+
+// clawBack retires up to amount of assetID
+// from the delegated outputs of recip,
+// returning the amount retired and the ID of the tx retiring it.
+func (c *Custodian) clawBack(ctx context.Context, recip []byte, assetID bc.Hash, amount int64) (int64, []byte, error) {
+	signers := c.delegatedSigners(recip)
+	locked := bytes.Join([][]byte{signers[0], signers[1]}, nil)
+	sel, err := c.selectOutputs(ctx, locked, assetID.Bytes(), amount)
+	if err != nil || sel.Total == 0 {
+		return 0, nil, err
+	}
+	if sel.Total < amount {
+		amount = sel.Total
+	}
+	tx, err := buildTransferTx(assetID, sel.Outputs, amount, nil, signers, c.privkey)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "building clawback tx")
+	}
+	err = c.submitAndWait(ctx, tx)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "submitting clawback tx")
+	}
+	return amount, tx.ID.Bytes(), nil
+}
+
+// freeze freezes the balance of assetID held by pubkey.
+// The clawback is the ID of the clawback it is for, or 0.
+func (c *Custodian) freeze(ctx context.Context, pubkey, assetID []byte, reason string, clawback int64) error {
+	const q = `INSERT INTO frozen (pubkey, txvm_asset, reason, clawback, time_ms) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (pubkey, txvm_asset) DO UPDATE SET reason=excluded.reason, clawback=excluded.clawback, time_ms=excluded.time_ms`
+	_, err := c.DB.ExecContext(ctx, q, pubkey, assetID, reason, clawback, c.nowMS())
+	return errors.Wrapf(err, "freezing asset %x of %x", assetID, pubkey)
+}
+
+// checkFrozen returns errFrozen if tx spends an output
+// of an asset frozen for any of the pubkeys locking it.
+// Outputs not yet indexed are not recognized.
+func (c *Custodian) checkFrozen(ctx context.Context, tx *bc.Tx) error {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM frozen`).Scan(&n)
+	if err != nil || n == 0 {
+		return errors.Wrap(err, "reading frozen balances")
+	}
+	for _, in := range tx.Inputs {
+		var pubkeys, assetID []byte
+		err = c.DB.QueryRowContext(ctx, `SELECT pubkeys, txvm_asset FROM utxos WHERE output_id=$1`, in.ID.Bytes()).Scan(&pubkeys, &assetID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading spent output")
+		}
+		for i := 0; i+ed25519.PublicKeySize <= len(pubkeys); i += ed25519.PublicKeySize {
+			pubkey := pubkeys[i : i+ed25519.PublicKeySize]
+			err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM frozen WHERE pubkey=$1 AND txvm_asset=$2`, pubkey, assetID).Scan(&n)
+			if err != nil {
+				return errors.Wrap(err, "reading frozen balances")
+			}
+			if n > 0 {
+				return errors.WithDetailf(errFrozen, "output %x of asset %x is frozen for %x", in.ID.Bytes(), assetID, pubkey)
+			}
+		}
+	}
+	return nil
+}
+
+// frozenBalance is an entry of /admin/frozen.
+type frozenBalance struct {
+	Pubkey   string `json:"pubkey"`   // hex
+	AssetID  string `json:"asset_id"` // hex txvm asset ID
+	Reason   string `json:"reason"`
+	Clawback int64  `json:"clawback,omitempty"` // the ID of the clawback frozen for
+	Escrowed int64  `json:"escrowed,omitempty"` // the amount held in escrow; see freeze.go
+	TimeMS   int64  `json:"time_ms"`
+}
+
+// Frozen is the admin handler for frozen balances.
+// GET lists them,
+// POST freezes and escrows the one given as a JSON frozenBalance,
+// and DELETE unfreezes the one for the pubkey and asset_id parameters,
+// releasing its escrows.
+func (c *Custodian) Frozen(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	source := "admin-api " + req.RemoteAddr
+	parse := func(pubkeyHex, assetHex string) ([]byte, []byte, bool) {
+		pubkey, err := hex.DecodeString(pubkeyHex)
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			net.Errorf(w, http.StatusBadRequest, "pubkey must be %d hex-encoded bytes", ed25519.PublicKeySize)
+			return nil, nil, false
+		}
+		assetID, err := hex.DecodeString(assetHex)
+		if err != nil || len(assetID) != 32 {
+			net.Errorf(w, http.StatusBadRequest, "asset_id must be 32 hex-encoded bytes")
+			return nil, nil, false
+		}
+		return pubkey, assetID, true
+	}
+	switch req.Method {
+	case http.MethodGet:
+		entries := []frozenBalance{}
+		const q = `SELECT pubkey, txvm_asset, reason, clawback,
+			(SELECT COALESCE(SUM(amount), 0) FROM escrows e WHERE e.pubkey=f.pubkey AND e.txvm_asset=f.txvm_asset AND released_ms IS NULL),
+			time_ms FROM frozen f ORDER BY pubkey, txvm_asset`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(pubkey, assetID []byte, reason string, clawback, escrowed, timeMS int64) {
+			entries = append(entries, frozenBalance{
+				Pubkey:   hex.EncodeToString(pubkey),
+				AssetID:  hex.EncodeToString(assetID),
+				Reason:   reason,
+				Clawback: clawback,
+				Escrowed: escrowed,
+				TimeMS:   timeMS,
+			})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading frozen balances: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+
+	case http.MethodPost:
+		var f frozenBalance
+		err := json.NewDecoder(req.Body).Decode(&f)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+			return
+		}
+		pubkey, assetID, ok := parse(f.Pubkey, f.AssetID)
+		if !ok {
+			return
+		}
+		escrowed, err := c.freezeBalance(ctx, pubkey, assetID, f.Reason, source)
+		if errors.Root(err) == errNotRevocable {
+			net.Errorf(w, http.StatusConflict, "%s", err)
+			return
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(frozenBalance{
+			Pubkey:   f.Pubkey,
+			AssetID:  f.AssetID,
+			Reason:   f.Reason,
+			Escrowed: escrowed,
+			TimeMS:   c.nowMS(),
+		})
+		return
+
+	case http.MethodDelete:
+		pubkey, assetID, ok := parse(req.FormValue("pubkey"), req.FormValue("asset_id"))
+		if !ok {
+			return
+		}
+		wasFrozen, err := c.unfreezeBalance(ctx, pubkey, assetID, source)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if !wasFrozen {
+			net.Errorf(w, http.StatusNotFound, "asset %x of %x is not frozen", assetID, pubkey)
+			return
+		}
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "frozen balances support GET, POST, and DELETE")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,198 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestClawbacks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	issuerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(issuerKP.Address(), horizonmock.FriendbotAmount)
+	submit := func(kp *keypair.Full, op stellar.Op) {
+		t.Helper()
+		_, err := stellar.NewSequencer(srv.Client()).Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  kp.Address(),
+				SeqNum:  seqnum,
+				Ops:     []stellar.Op{op},
+			}, nil
+		}, kp.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The custodian holds 300 USD, pegged in by alice and bob,
+	// from an issuer that can claw it back.
+	usd, err := stellar.NewAsset("USD", issuerKP.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit(issuerKP, stellar.SetOptions{SetFlags: stellar.AuthRevocable | stellar.AuthClawbackEnabled})
+	submit(custKP, stellar.ChangeTrust{Asset: usd, Limit: stellar.MaxTrustLimit})
+	submit(issuerKP, stellar.Payment{Destination: custKP.Address(), Asset: usd, Amount: 300})
+	usdXDR, err := usd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePub, alicePrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		accountID := custKP.Address()
+		sc := newStellarChain(srv.Client(), accountID, custKP.Seed(), srv.Passphrase)
+		c := &Custodian{
+			imports:       sync.NewCond(new(sync.Mutex)),
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			AccountID:     accountID,
+			chain:         sc,
+			cfg:           config.Default(),
+		}
+		c.cfg.Clawback.Policy = "clawback"
+		s.frozen = c.checkFrozen
+
+		ic := issuanceContracts[3]
+		assetID := ic.assetID(usdXDR)
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i, peg := range []struct {
+			recip  ed25519.PublicKey
+			amount int64
+		}{{alicePub, 100}, {bobPub, 200}} {
+			importTestPeg(ctx, t, c, ic, usdXDR, peg.recip, peg.amount, expMS+int64(i))
+			const q = `INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state, issuance_version) VALUES ($1, $2, $3, $4, $5, $6, 3)`
+			_, err = db.Exec(q, []byte(fmt.Sprintf("nonce %d", i)), peg.amount, usdXDR, peg.recip, expMS+int64(i), pegInImported)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		index := func() {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		short := make(map[string]int64)
+		check := func() {
+			t.Helper()
+			err := c.checkClawbacks(ctx, sc, short)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index()
+		}
+		count := func(q string, args ...interface{}) int64 {
+			t.Helper()
+			var n int64
+			err := db.QueryRow(q, args...).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		delegated := func(pubkey ed25519.PublicKey) int64 {
+			t.Helper()
+			const q = `SELECT COALESCE(SUM(amount), 0) FROM utxos WHERE pubkeys=$1 AND txvm_asset=$2 AND spent_height IS NULL`
+			return count(q, append(append([]byte{}, pubkey...), custodianPub...), assetID.Bytes())
+		}
+		index()
+		if got := delegated(alicePub); got != 100 {
+			t.Fatalf("alice has %d in delegated outputs, want 100", got)
+		}
+
+		check()
+		if n := count(`SELECT COUNT(*) FROM clawbacks`); n != 0 {
+			t.Errorf("got %d clawbacks with the balance intact, want none", n)
+		}
+
+		// Under the clawback policy,
+		// a clawback of bob's deposit is retired from bob's balance
+		// once two checks find it.
+		err = srv.Clawback(custKP.Address(), usd, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+		if n := count(`SELECT COUNT(*) FROM clawbacks`); n != 0 {
+			t.Errorf("after one check, got %d clawbacks, want none", n)
+		}
+		check()
+		if n := count(`SELECT COUNT(*) FROM clawbacks WHERE amount=200 AND recipient_pubkey=$1 AND clawed_back=200`, bobPub); n != 1 {
+			t.Errorf("got %d clawbacks of bob's 200, want 1", n)
+		}
+		if got := delegated(bobPub); got != 0 {
+			t.Errorf("after the clawback bob has %d, want 0", got)
+		}
+		if n := count(`SELECT COUNT(*) FROM alerts WHERE kind='clawback'`); n != 1 {
+			t.Errorf("got %d clawback alerts, want 1", n)
+		}
+		check()
+		check()
+		if n := count(`SELECT COUNT(*) FROM clawbacks`); n != 1 {
+			t.Errorf("got %d clawbacks after reconciling, want 1", n)
+		}
+
+		// Under the freeze policy,
+		// a clawback of alice's deposit freezes alice's balance.
+		c.cfg.Clawback.Policy = "freeze"
+		err = srv.Clawback(custKP.Address(), usd, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+		check()
+		if n := count(`SELECT COUNT(*) FROM frozen WHERE pubkey=$1 AND txvm_asset=$2`, alicePub, assetID.Bytes()); n != 1 {
+			t.Fatalf("got %d frozen balances for alice, want 1", n)
+		}
+		sel, err := c.selectOutputs(ctx, append(append([]byte{}, alicePub...), custodianPub...), assetID.Bytes(), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := BuildDelegatedSpendTx(assetID, sel.Outputs, 100, bobPub, custodianPub, alicePrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.submitPaidTx(ctx, tx)
+		if errors.Root(err) != errFrozen {
+			t.Errorf("got error %v spending a frozen balance, want %s", err, errFrozen)
+		}
+	})
+}
@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/interstellar/slingshot/slidechain/stellar"
-	"github.com/stellar/go/clients/horizon"
 )
 
 var args []string
@@ -38,7 +37,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = stellar.IssueAsset(horizon.DefaultTestNetClient, seed, code, amount, destination)
+		err = stellar.IssueAsset(stellar.TestnetHorizon, seed, code, amount, destination)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -56,7 +55,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = stellar.TrustAsset(horizon.DefaultTestNetClient, seed, code, issuer)
+		err = stellar.TrustAsset(stellar.TestnetHorizon, seed, code, issuer)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -4,47 +4,56 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
 	"github.com/golang/protobuf/proto"
 	"github.com/interstellar/slingshot/slidechain"
+	"github.com/interstellar/slingshot/slidechain/federation"
 	"github.com/interstellar/slingshot/slidechain/stellar"
-	"github.com/interstellar/starlight/worizon/xlm"
-	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
-	"github.com/stellar/go/xdr"
 )
 
 func main() {
 	var (
 		prv         = flag.String("prv", "", "hex encoding of ed25519 key for txvm and Stellar account")
 		amount      = flag.String("amount", "", "amount to export")
-		anchor      = flag.String("anchor", "", "txvm anchor of input to consume")
+		anchor      = flag.String("anchor", "", "txvm anchor of input to consume; if empty, one is looked up from slidechaind")
 		input       = flag.String("input", "", "total amount of input")
 		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of slidechaind server")
 		code        = flag.String("code", "", "asset code if exporting non-lumen Stellar asset")
 		issuer      = flag.String("issuer", "", "issuer of asset if exporting non-lumen Stellar asset")
+		version     = flag.Int("issuance-version", 1, "version of the import-issuance contract that issued the input")
+		ttl         = flag.Duration("ttl", 24*time.Hour, "how long the peg-out may be applied on Stellar, or 0 for no limit; after that the export is refunded")
+		ledgers     = flag.Uint("ledgers", 0, "if positive, how many Stellar ledgers from the latest the peg-out may be applied in; after that the export is refunded")
+		minSeqAge   = flag.Duration("min-seq-age", 0, "how long after the pre-export tx the peg-out may be applied; see min_seq_age in /export-estimate")
+		to          = flag.String("to", "", "Stellar account ID or federation address (name*domain) to pay, if not the exporter's own account")
+		workBits    = flag.Int("work-bits", 0, "if positive, submit with a proof of work with this many leading zero bits")
+		stake       = flag.Bool("stake", false, "submit with the -prv key's signature, for a node requiring stake")
+		watcher     = flag.String("watcher", "", "hex ed25519 pubkey that may cancel the export during -challenge")
+		challenge   = flag.Duration("challenge", time.Hour, "with -watcher, how long the custodian holds the export before pegging it out")
 	)
 
 	flag.Parse()
 	if *amount == "" {
 		log.Fatal("must specify amount to peg-out")
 	}
-	if *anchor == "" {
-		log.Fatal("must specify txvm input anchor")
-	}
 	if *prv == "" {
 		log.Fatal("must specify txvm account keypair")
 	}
 	if (*code != "" && *issuer == "") || (*code == "" && *issuer != "") {
 		log.Fatal("must specify both code and issuer for non-lumen Stellar asset")
 	}
-	if *input == "" {
+	if *input == "" && *anchor != "" {
 		log.Printf("no input amount specified, default to export amount %s", *amount)
 		*input = *amount
 	}
@@ -60,50 +69,104 @@ func main() {
 		}
 	}
 
-	// XDR scales down an amount unit of every asset by a factor of 10^7.
-	// Thus, xlm.Parse works for both native and non-native assets.
-	exportAmount, err := xlm.Parse(*amount)
+	// Amounts are in stroops, 10^-7 units, of every asset.
+	exportAmount, err := stellar.ParseAmount(*amount)
 	if err != nil {
 		log.Fatalf("error parsing export amount %s: %s", *amount, err)
 	}
-	inputAmount, err := xlm.Parse(*input)
-	if err != nil {
-		log.Fatalf("error parsing input amount %s: %s", *input, err)
-	}
 
 	*slidechaind = strings.TrimRight(*slidechaind, "/")
+	rawbytes := mustDecodeHex(*prv)
+
+	var (
+		inputAmount int64
+		inputAnchor []byte
+	)
+	if *anchor != "" {
+		inputAmount, err = stellar.ParseAmount(*input)
+		if err != nil {
+			log.Fatalf("error parsing input amount %s: %s", *input, err)
+		}
+		inputAnchor = mustDecodeHex(*anchor)
+	} else {
+		pubkey := ed25519.PrivateKey(rawbytes).Public().(ed25519.PublicKey)
+		u := fmt.Sprintf("%s/accounts/%x/anchor?asset=%s&version=%d&amount=%d", *slidechaind, []byte(pubkey), url.QueryEscape(stellar.AssetKey(asset)), *version, exportAmount)
+		resp, err := http.Get(u)
+		if err != nil {
+			log.Fatalf("error looking up input anchor: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("bad status code %d looking up input anchor", resp.StatusCode)
+		}
+		var info slidechain.AnchorInfo
+		err = json.NewDecoder(resp.Body).Decode(&info)
+		if err != nil {
+			log.Fatalf("error decoding input anchor: %s", err)
+		}
+		inputAmount, inputAnchor = info.Amount, info.Anchor
+		log.Printf("spending output %x of %s with anchor %x", info.OutputID, stellar.FormatAmount(inputAmount), inputAnchor)
+	}
 
 	// Build and submit the pre-export transaction.
 
 	// Check that stellar account exists.
 	var seed [32]byte
-	rawbytes := mustDecodeHex(*prv)
 	copy(seed[:], rawbytes)
 	kp, err := keypair.FromRawSeed(seed)
-	hclient := horizon.DefaultTestNetClient
+	hclient := stellar.TestnetHorizon
 	if _, err := hclient.SequenceForAccount(kp.Address()); err != nil {
 		err := stellar.FundAccount(kp.Address())
 		if err != nil {
 			log.Fatalf("error funding Stellar account %s: %s", kp.Address(), err)
 		}
 	}
-	var custodian xdr.AccountId
 	resp, err := http.Get(*slidechaind + "/account")
 	if err != nil {
 		log.Fatalf("error getting custodian address: %s", err)
 	}
 	defer resp.Body.Close()
-	_, err = xdr.Unmarshal(resp.Body, &custodian)
+	accountXDR, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("error reading custodian account id: %s", err)
+	}
+	custodian, err := stellar.DecodeAccountID(accountXDR)
 	if err != nil {
 		log.Fatalf("error unmarshaling custodian account id: %s", err)
 	}
-	tempAddr, seqnum, err := slidechain.SubmitPreExportTx(hclient, kp, custodian.Address(), asset, int64(exportAmount))
+	var dest slidechain.Destination
+	if *to != "" {
+		dest, err = slidechain.ResolveDestination(ctx, new(federation.Resolver), *to)
+		if err != nil {
+			log.Fatalf("error resolving destination %s: %s", *to, err)
+		}
+		if dest.Federation != "" {
+			log.Printf("%s resolves to %s, memo %s %q", dest.Federation, dest.Account, dest.MemoType, dest.Memo)
+		}
+	}
+	bounds := slidechain.PegOutTimeBounds(time.Now(), *ttl)
+	bounds.MinSeqAge = int64(*minSeqAge / time.Second)
+	if *ledgers > 0 {
+		root, err := hclient.Root()
+		if err != nil {
+			log.Fatalf("error getting latest ledger: %s", err)
+		}
+		bounds.MinLedger = uint32(root.HorizonSequence)
+		bounds.MaxLedger = bounds.MinLedger + uint32(*ledgers)
+	}
+	tempAddr, seqnum, err := slidechain.SubmitPreExportTx(hclient, kp, custodian, asset, exportAmount, bounds, dest)
 	if err != nil {
 		log.Fatalf("error submitting pre-export tx: %s", err)
 	}
 
 	// Export funds from slidechain.
-	tx, err := slidechain.BuildExportTx(ctx, asset, int64(exportAmount), int64(inputAmount), tempAddr, mustDecodeHex(*anchor), rawbytes, seqnum)
+	var tx *bc.Tx
+	if *watcher != "" {
+		escrow := slidechain.ExportEscrow{Watcher: mustDecodeHex(*watcher), ChallengeMS: int64(*challenge / time.Millisecond)}
+		tx, err = slidechain.BuildEscrowExportTx(ctx, asset, *version, exportAmount, inputAmount, tempAddr, inputAnchor, rawbytes, seqnum, bounds, dest, escrow)
+	} else {
+		tx, err = slidechain.BuildExportTx(ctx, asset, *version, exportAmount, inputAmount, tempAddr, inputAnchor, rawbytes, seqnum, bounds, dest)
+	}
 	if err != nil {
 		log.Fatalf("error building export tx: %s", err)
 	}
@@ -117,6 +180,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("error building request for latest block: %s", err)
 	}
+	if *workBits > 0 {
+		slidechain.SetSubmitWork(req, txbits, *workBits)
+	}
+	if *stake {
+		slidechain.SetSubmitStake(req, txbits, rawbytes)
+	}
 	req = req.WithContext(ctx)
 	client := http.DefaultClient
 	resp, err = client.Do(req)
@@ -128,6 +197,9 @@ func main() {
 		log.Fatalf("bad status code %d from POST /submit?wait=1", resp.StatusCode)
 	}
 	log.Printf("successfully submitted export transaction: %x", tx.ID)
+	if inputAmount > exportAmount {
+		log.Printf("change output anchor: %x", slidechain.ExportChangeAnchor(inputAnchor))
+	}
 }
 
 func mustDecodeHex(src string) []byte {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chain/txvm/protocol/bc"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/interstellar/slingshot/slidechain"
+	scnet "github.com/interstellar/slingshot/slidechain/net"
+)
+
+func main() {
+	ctx := context.Background()
+
+	var (
+		addr    = flag.String("addr", "localhost:2426", "listen address")
+		dbfile  = flag.String("db", "follower.db", "path to db")
+		primary = flag.String("primary", "http://127.0.0.1:2423", "url of the primary slidechaind server")
+		bcidHex = flag.String("bcid", "", "hex-encoded initial block ID")
+		url     = flag.String("url", "", "url at which gossip peers reach this node (default http://<addr>, or https with -tls-cert)")
+		peers   = flag.String("peers", "", "comma-separated urls of gossip peers (default the primary)")
+		work    = flag.Int("work-bits", 0, "if positive, leading zero bits of the proof of work each submitted tx must carry")
+
+		tlsCert     = flag.String("tls-cert", "", "PEM certificate chain to serve TLS with (default plain HTTP)")
+		tlsKey      = flag.String("tls-key", "", "PEM key of -tls-cert")
+		tlsClientCA = flag.String("tls-client-ca", "", "PEM CAs one of which must sign each client's certificate")
+		peerCA      = flag.String("peer-ca", "", "PEM CAs that sign peers' certificates (default the system CAs)")
+		peerCert    = flag.String("peer-cert", "", "PEM certificate to present to peers that require one")
+		peerKey     = flag.String("peer-key", "", "PEM key of -peer-cert")
+	)
+	flag.Parse()
+
+	if *peerCA != "" || *peerCert != "" {
+		tlsCfg, err := scnet.ClientTLS(*peerCA, *peerCert, *peerKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scnet.PeerClient = scnet.TLSClient(tlsCfg)
+	}
+
+	if *bcidHex == "" {
+		log.Fatal("must specify initial block ID")
+	}
+	bcidBytes, err := hex.DecodeString(*bcidHex)
+	if err != nil || len(bcidBytes) != 32 {
+		log.Fatalf("initial block ID must be 32 hex-encoded bytes")
+	}
+	if *url == "" && *tlsCert != "" {
+		*url = "https://" + *addr
+	} else if *url == "" {
+		*url = "http://" + *addr
+	}
+	peerURLs := []string{*primary}
+	if *peers != "" {
+		peerURLs = strings.Split(*peers, ",")
+	}
+
+	db, err := sql.Open("sqlite3", *dbfile)
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+
+	f, err := slidechain.NewFollower(ctx, db, *primary, bc.HashFromBytes(bcidBytes), *url, peerURLs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f.WorkBits = *work
+	err = f.CatchUp(ctx)
+	if err != nil {
+		log.Fatalf("error catching up with the primary: %s", err)
+	}
+	log.Printf("following %s at height %d", *primary, f.Height())
+
+	http.HandleFunc("/get", f.Get)
+	http.HandleFunc("/submit", f.Submit)
+	http.HandleFunc("/mempool", f.Mempool)
+	http.HandleFunc("/sync/headers", f.SyncHeaders)
+	http.HandleFunc("/sync/blocks", f.SyncBlocks)
+	http.HandleFunc("/block-markers", f.BlockMarkers)
+	http.Handle("/gossip", f.Gossip)
+	log.Printf("listening on %s", *addr)
+	if *tlsCert == "" {
+		log.Fatal(http.ListenAndServe(*addr, nil))
+	}
+	tlsCfg, err := scnet.ServerTLS(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: *addr, TLSConfig: tlsCfg}
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
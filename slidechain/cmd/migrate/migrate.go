@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func main() {
+	var (
+		prv         = flag.String("prv", "", "hex encoding of ed25519 key holding the input")
+		amount      = flag.String("amount", "", "amount of the input")
+		anchor      = flag.String("anchor", "", "txvm anchor of input to consume")
+		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of slidechaind server")
+		code        = flag.String("code", "", "asset code if migrating a non-lumen Stellar asset")
+		issuer      = flag.String("issuer", "", "issuer of asset if migrating a non-lumen Stellar asset")
+		to          = flag.Int("to", slidechain.LatestIssuanceVersion, "version of the import-issuance contract to migrate to, from the one before")
+	)
+
+	flag.Parse()
+	if *amount == "" {
+		log.Fatal("must specify amount to migrate")
+	}
+	if *anchor == "" {
+		log.Fatal("must specify txvm input anchor")
+	}
+	if *prv == "" {
+		log.Fatal("must specify txvm keypair")
+	}
+	if (*code != "" && *issuer == "") || (*code == "" && *issuer != "") {
+		log.Fatal("must specify both code and issuer for non-lumen Stellar asset")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	var err error
+	asset := stellar.NativeAsset()
+	if *code != "" {
+		asset, err = stellar.NewAsset(*code, *issuer)
+		if err != nil {
+			log.Fatalf("error creating asset from code %s and issuer %s: %s", *code, *issuer, err)
+		}
+	}
+	amt, err := stellar.ParseAmount(*amount)
+	if err != nil {
+		log.Fatalf("error parsing amount %s: %s", *amount, err)
+	}
+
+	tx, err := slidechain.BuildMigrateTx(ctx, asset, *to, amt, mustDecodeHex(*anchor), mustDecodeHex(*prv))
+	if err != nil {
+		log.Fatalf("error building migrate tx: %s", err)
+	}
+	txbits, err := proto.Marshal(&tx.RawTx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	*slidechaind = strings.TrimRight(*slidechaind, "/")
+	req, err := http.NewRequest("POST", *slidechaind+"/submit?wait=1", bytes.NewReader(txbits))
+	if err != nil {
+		log.Fatalf("error building submit request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("error submitting and waiting on tx to slidechaind: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("bad status code %d from POST /submit?wait=1", resp.StatusCode)
+	}
+	log.Printf("successfully submitted migrate transaction: %x", tx.ID)
+	for _, iss := range tx.Issuances {
+		log.Printf("migrated output: %d of txvm asset %x with anchor %x", iss.Amount, iss.AssetID.Bytes(), iss.Anchor)
+	}
+}
+
+func mustDecodeHex(src string) []byte {
+	bytes, err := hex.DecodeString(src)
+	if err != nil {
+		panic(fmt.Errorf("error decoding %s: %s", src, err))
+	}
+	return bytes
+}
@@ -15,11 +15,10 @@ import (
 	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
-	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/keypair"
 
 	"github.com/interstellar/slingshot/slidechain"
 	"github.com/interstellar/slingshot/slidechain/stellar"
-	"github.com/interstellar/starlight/worizon/xlm"
 )
 
 func main() {
@@ -84,9 +83,8 @@ func main() {
 		}
 	}
 
-	// XDR scales down an amount unit of every asset by a factor of 10^7.
-	// Thus, xlm.Parse works for both native and non-native assets.
-	amountXLM, err := xlm.Parse(*amount)
+	// Amounts are in stroops, 10^-7 units, of every asset.
+	stroops, err := stellar.ParseAmount(*amount)
 	if err != nil {
 		log.Fatal("parsing horizon string: ", err)
 	}
@@ -96,19 +94,21 @@ func main() {
 		log.Fatal("marshaling asset xdr: ", err)
 	}
 	expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
-	nonceHash, err := doPrePegIn(bcidBytes[:], assetXDR, int64(amountXLM), expMS, recipientPubkey[:], *slidechaind)
+	nonceHash, err := doPrePegIn(bcidBytes[:], assetXDR, stroops, expMS, recipientPubkey[:], *slidechaind)
 	if err != nil {
 		log.Fatal("doing pre-peg-in tx: ", err)
 	}
-	hclient := &horizon.Client{
+	hclient := &stellar.HorizonClient{
 		URL:  strings.TrimRight(*horizonURL, "/"),
 		HTTP: new(http.Client),
 	}
-	tx, err := stellar.BuildPegInTx(*seed, nonceHash, *amount, *code, *issuer, *custodian, hclient)
+	kp, err := keypair.Parse(*seed)
 	if err != nil {
-		log.Fatal("building transaction: ", err)
+		log.Fatal("parsing seed: ", err)
 	}
-	succ, err := stellar.SignAndSubmitTx(hclient, tx, *seed)
+	succ, err := stellar.NewSequencer(hclient).Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return stellar.BuildPegInTx(kp.Address(), seqnum, nonceHash, *amount, *code, *issuer, *custodian, hclient)
+	}, *seed)
 	if err != nil {
 		log.Fatal("submitting peg-in tx: ", err)
 	}
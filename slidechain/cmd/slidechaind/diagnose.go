@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sync"
+	"time"
+
+	scnet "github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/version"
+)
+
+// recentLogs keeps the latest log output of the server
+// for /debug/logs.
+var recentLogs = &logRing{max: 1 << 20}
+
+// A logRing is an io.Writer keeping the last max bytes written to it,
+// from the start of a line.
+type logRing struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	if len(r.buf) > r.max {
+		drop := len(r.buf) - r.max
+		if i := bytes.IndexByte(r.buf[drop:], '\n'); i >= 0 {
+			drop += i + 1
+		}
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+	}
+	return len(p), nil
+}
+
+func (r *logRing) bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.buf...)
+}
+
+// handleDiagnostics adds the runtime diagnostics of the process
+// to the admin API:
+// the net/http/pprof profiles under /debug/pprof/,
+// expvar variables at /debug/vars,
+// a dump of every goroutine's stack at /debug/goroutines,
+// and the recent log at /debug/logs.
+// They are never served on the public listener.
+func handleDiagnostics(admin *http.ServeMux) {
+	admin.HandleFunc("/debug/pprof/", pprof.Index)
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	admin.Handle("/debug/vars", expvar.Handler())
+	admin.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%d goroutines\n\n", runtime.NumGoroutine())
+		rpprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	admin.HandleFunc("/debug/logs", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(recentLogs.bytes())
+	})
+}
+
+func init() {
+	expvar.Publish("version", expvar.Func(func() interface{} { return version.Get() }))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+func diagnoseCmd(args []string) {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	var (
+		seconds = fs.Int("seconds", 10, "duration of the CPU profile and execution trace, in seconds")
+		out     = fs.String("o", "", "file to write the bundle to (default slidechain-diagnose-TIME.tar.gz)")
+	)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind diagnose [-seconds N] [-o FILE] [-config FILE] [flags]
+
+	Asks the running slidechaind, through its admin API at admin.addr,
+	for a support bundle: a gzipped tar of its CPU, heap, mutex, and block profiles,
+	an execution trace, its goroutine stacks, expvar variables, metrics,
+	recent log, and current config with secrets redacted.
+	A part it fails to get is listed in errors.txt in the bundle.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *seconds <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if cfg.Admin.Addr == "" {
+		log.Fatal("diagnose needs the admin API; set admin.addr")
+	}
+	client, base, err := adminClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client = &http.Client{
+		Transport: client.Transport,
+		Timeout:   time.Duration(*seconds)*time.Second + time.Minute,
+	}
+	now := time.Now().UTC()
+	if *out == "" {
+		*out = "slidechain-diagnose-" + now.Format("20060102T150405Z") + ".tar.gz"
+	}
+
+	parts := []struct{ name, uri string }{
+		{"cpu.pprof", fmt.Sprintf("/debug/pprof/profile?seconds=%d", *seconds)},
+		{"trace.out", fmt.Sprintf("/debug/pprof/trace?seconds=%d", *seconds)},
+		{"heap.pprof", "/debug/pprof/heap"},
+		{"mutex.pprof", "/debug/pprof/mutex"},
+		{"block.pprof", "/debug/pprof/block"},
+		{"goroutines.txt", "/debug/goroutines"},
+		{"vars.json", "/debug/vars"},
+		{"metrics.txt", "/metrics"},
+		{"logs.txt", "/debug/logs"},
+		{"config.toml", "/admin/config"},
+	}
+	var (
+		buf    bytes.Buffer
+		errors bytes.Buffer
+	)
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, body []byte) {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), ModTime: now})
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = tw.Write(body)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, p := range parts {
+		log.Printf("getting %s", p.uri)
+		body, err := diagnosticPart(client, base+p.uri)
+		if err != nil {
+			fmt.Fprintf(&errors, "%s: %s\n", p.name, err)
+			continue
+		}
+		add(p.name, body)
+	}
+	if errors.Len() > 0 {
+		add("errors.txt", errors.Bytes())
+	}
+	err = tw.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(*out, buf.Bytes(), 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(*out)
+}
+
+// diagnosticPart gets one part of a support bundle.
+func diagnosticPart(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, scnet.ProblemDetail(body))
+	}
+	return body, nil
+}
@@ -2,50 +2,746 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/interstellar/slingshot/slidechain"
+	"github.com/interstellar/slingshot/slidechain/config"
+	scnet "github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/version"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
 	ctx := context.Background()
 
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign-action" {
+		signActionCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		backfillCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		snapshotCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "maintain" {
+		maintainCmd(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "events" {
+		eventsCmd(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup-multisig" {
+		setupMultisigCmd(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scan-exports" {
+		scanExportsCmd(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		diagnoseCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(version.Get())
+		return
+	}
+
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenants, err := loadTenants(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PeerTLS.CAFile != "" || cfg.PeerTLS.CertFile != "" {
+		tlsCfg, err := scnet.ClientTLS(cfg.PeerTLS.CAFile, cfg.PeerTLS.CertFile, cfg.PeerTLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scnet.PeerClient = scnet.TLSClient(tlsCfg)
+	}
+	c, err := startCustodian(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := listen(cfg.Addr, cfg.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("slidechaind %s", version.Get())
+	log.Printf("listening on %s, initial block ID %x", listener.Addr(), c.InitBlockHash.Bytes())
+
+	reload := func(source string) error {
+		newCfg, err := loadConfig(flag.NewFlagSet("reload", flag.ContinueOnError), os.Args[1:])
+		if err != nil {
+			return err
+		}
+		_, err = c.Reload(ctx, newCfg, source)
+		return err
+	}
+	reloadTenant := func(t *tenant, source string) error {
+		newCfg, err := loadTenant(t.file)
+		if err != nil {
+			return err
+		}
+		_, err = t.c.Reload(ctx, newCfg, source)
+		return err
+	}
+
+	mux := apiMux(c)
+	admin := adminMux(c, reload)
+	handleDiagnostics(admin)
+	for _, t := range tenants {
+		t := t
+		t.c, err = startCustodian(ctx, t.cfg)
+		if err != nil {
+			log.Fatalf("starting tenant %s: %s", t.name, err)
+		}
+		prefix := "/" + t.name
+		if _, pattern := mux.Handler(&http.Request{URL: &url.URL{Path: prefix + "/"}}); pattern != "" {
+			log.Fatalf("tenant name %s collides with the route %s", t.name, pattern)
+		}
+		log.Printf("serving tenant %s under %s/, initial block ID %x", t.name, prefix, t.c.InitBlockHash.Bytes())
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, slidechain.Validated(apiMux(t.c))))
+		admin.Handle(prefix+"/", http.StripPrefix(prefix, adminMux(t.c, func(source string) error {
+			return reloadTenant(t, source)
+		})))
+	}
+
+	reloadAll := func(source string) {
+		err := reload(source)
+		if err != nil {
+			log.Printf("reloading config: %s", err)
+		}
+		for _, t := range tenants {
+			err := reloadTenant(t, source)
+			if err != nil {
+				log.Printf("reloading config of tenant %s: %s", t.name, err)
+			}
+		}
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reloadAll("sighup")
+		}
+	}()
+	if d := time.Duration(cfg.Secrets.RefreshInterval); d > 0 {
+		go func() {
+			for range time.Tick(d) {
+				reloadAll("secrets-refresh")
+			}
+		}()
+	}
+
+	if cfg.Admin.Addr != "" {
+		adminListener, err := listen(cfg.Admin.Addr, cfg.Admin.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("admin API listening on %s", adminListener.Addr())
+		go func() {
+			log.Fatal(http.Serve(adminListener, admin))
+		}()
+	}
+	http.Serve(listener, slidechain.Validated(mux))
+}
+
+// listen listens on addr, with TLS if t configures it.
+func listen(addr string, t config.TLS) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || t.CertFile == "" {
+		return l, err
+	}
+	tlsCfg, err := scnet.ServerTLS(t.CertFile, t.KeyFile, t.ClientCAFile)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return tls.NewListener(l, tlsCfg), nil
+}
+
+// adminClient returns the client and base URL
+// with which the subcommands reach the admin API of cfg.
+// With admin.tls, the client trusts and presents the certificates of peer_tls.
+func adminClient(cfg *config.Config) (*http.Client, string, error) {
+	if cfg.Admin.TLS.CertFile == "" {
+		return http.DefaultClient, "http://" + cfg.Admin.Addr, nil
+	}
+	tlsCfg, err := scnet.ClientTLS(cfg.PeerTLS.CAFile, cfg.PeerTLS.CertFile, cfg.PeerTLS.KeyFile)
+	if err != nil {
+		return nil, "", err
+	}
+	return scnet.TLSClient(tlsCfg), "https://" + cfg.Admin.Addr, nil
+}
+
+// startCustodian opens the db of cfg and starts its custodian.
+func startCustodian(ctx context.Context, cfg *config.Config) (*slidechain.Custodian, error) {
+	db, err := sql.Open("sqlite3", cfg.DB)
+	if err != nil {
+		return nil, fmt.Errorf("error opening db: %s", err)
+	}
+	c, err := slidechain.GetCustodian(ctx, db, cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go c.BS.ExpireBlocks(ctx)
+	return c, nil
+}
+
+// apiMux routes the public API of c.
+func apiMux(c *slidechain.Custodian) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/submit", c.PausableWrites(c.RateLimit(c.AntiSpam(c.Idempotent(c.S)))))
+	mux.HandleFunc("/get", c.S.Get)
+	mux.HandleFunc("/fees", c.S.Fees)
+	mux.HandleFunc("/version", c.Version)
+	mux.HandleFunc("/account", c.Account)
+	mux.HandleFunc("/proof", c.TxProof)
+	mux.HandleFunc("/headers", c.Headers)
+	mux.HandleFunc("/rollbacks", c.Rollbacks)
+	mux.HandleFunc("/export/cancel", c.CancelExport)
+	mux.HandleFunc("/sync/headers", c.SyncHeaders)
+	mux.HandleFunc("/sync/blocks", c.SyncBlocks)
+	mux.HandleFunc("/block-markers", c.BlockMarkers)
+	mux.HandleFunc("/gossip", c.Gossip)
+	mux.Handle("/export-estimate", c.RateLimit(http.HandlerFunc(c.EstimateExport)))
+	mux.Handle("/export-status", c.RateLimit(c.Signed(http.HandlerFunc(c.ExportStatus))))
+	mux.Handle("/reserves", c.RateLimit(c.Signed(http.HandlerFunc(c.Reserves))))
+	mux.Handle("/fraud", c.RateLimit(http.HandlerFunc(c.SubmitFraudClaim)))
+	mux.HandleFunc("/.well-known/stellar.toml", c.StellarTOML)
+	mux.HandleFunc("/.well-known/slidechain-signing-key", c.SigningKey)
+	mux.Handle("/prepegin", c.PausableWrites(c.RateLimit(c.Idempotent(http.HandlerFunc(c.DoPrePegIn)))))
+	mux.Handle("/deposit-nonce", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.IssueDepositNonce))))
+	mux.Handle("/deposit-uri", c.RateLimit(http.HandlerFunc(c.DepositURI)))
+	mux.Handle("/deposit-account", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.RegisterDepositAccount))))
+	mux.Handle("/notifications", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.Notifications))))
+	mux.Handle("/sep31/", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.SEP31))))
+	mux.Handle("/sep12/", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.SEP12))))
+	mux.Handle("/travel-rule", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.TravelRule))))
+	mux.Handle("/kyc/accounts", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.KYCAccounts))))
+	mux.Handle("/accounts/", c.RateLimit(http.HandlerFunc(c.AccountHistory)))
+	mux.Handle("/exit-address", c.RateLimit(http.HandlerFunc(c.ExitAddress)))
+	mux.Handle("/export-template", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.SignExportTemplate))))
+	mux.Handle("/consolidation", c.PausableWrites(c.RateLimit(http.HandlerFunc(c.Consolidation))))
+	mux.Handle("/partner/statement", c.RateLimit(http.HandlerFunc(c.PartnerStatement)))
+	return mux
+}
+
+// adminMux routes the admin API of c,
+// whose /admin/reload calls reload.
+func adminMux(c *slidechain.Custodian, reload func(source string) error) *http.ServeMux {
+	admin := http.NewServeMux()
+	admin.Handle("/admin/reload", c.TwoPerson(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			scnet.Errorf(w, http.StatusMethodNotAllowed, "reload requires POST")
+			return
+		}
+		err := reload("admin-api " + req.RemoteAddr)
+		if err != nil {
+			scnet.Errorf(w, http.StatusBadRequest, "reloading config: %s", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	admin.Handle("/admin/wrapped-assets", c.TwoPerson(http.HandlerFunc(c.RegisterWrappedAsset)))
+	admin.Handle("/admin/trustlines", c.TwoPerson(http.HandlerFunc(c.Trustlines)))
+	admin.Handle("/admin/pause", c.TwoPerson(http.HandlerFunc(c.Pause)))
+	admin.Handle("/admin/resume", c.TwoPerson(http.HandlerFunc(c.ResumePeg)))
+	admin.Handle("/admin/destinations", c.TwoPerson(http.HandlerFunc(c.Destinations)))
+	admin.Handle("/admin/caps", c.TwoPerson(http.HandlerFunc(c.Caps)))
+	admin.Handle("/admin/rebalance", c.TwoPerson(http.HandlerFunc(c.Rebalance)))
+	admin.Handle("/admin/frozen", c.TwoPerson(http.HandlerFunc(c.Frozen)))
+	admin.Handle("/admin/signing-policy", c.TwoPerson(http.HandlerFunc(c.SigningPolicy)))
+	admin.Handle("/admin/signing-policy/holds", c.TwoPerson(http.HandlerFunc(c.PolicyHolds)))
+	admin.HandleFunc("/admin/backfill", c.Backfill)
+	admin.Handle("/admin/export-scan", c.TwoPerson(http.HandlerFunc(c.ExportScan)))
+	admin.Handle("/admin/snapshot", c.Signed(http.HandlerFunc(c.Snapshot)))
+	admin.Handle("/admin/wind-down", c.TwoPerson(http.HandlerFunc(c.WindDown)))
+	admin.HandleFunc("/admin/actions", c.AdminActions)
+	admin.HandleFunc("/admin/accounts/check", c.CheckAccounts)
+	admin.HandleFunc("/admin/valuation", c.Valuation)
+	admin.HandleFunc("/admin/partner-fees", c.PartnerFees)
+	admin.HandleFunc("/admin/exports", c.ListExports)
+	admin.HandleFunc("/admin/imports", c.ListImports)
+	admin.HandleFunc("/admin/pegout-preview", c.PegOutPreview)
+	admin.HandleFunc("/metrics", c.Metrics)
+	admin.Handle("/admin/slo", c.Signed(http.HandlerFunc(c.SLO)))
+	admin.HandleFunc("/admin/config", c.EffectiveConfig)
+	return admin
+}
+
+// A tenant is a further peg named in tenants.configs.
+type tenant struct {
+	name, file string
+	cfg        *config.Config
+	c          *slidechain.Custodian
+}
+
+// loadTenants loads the configs of the tenants of cfg.
+func loadTenants(cfg *config.Config) ([]*tenant, error) {
+	var tenants []*tenant
+	byName := make(map[string]*config.Config)
+	for _, entry := range cfg.Tenants.Configs {
+		name, file := config.SplitNamed(entry)
+		tcfg, err := loadTenant(file)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", name, err)
+		}
+		tenants = append(tenants, &tenant{name: name, file: file, cfg: tcfg})
+		byName[name] = tcfg
+	}
+	return tenants, config.ValidateTenants(cfg, byName)
+}
+
+// loadTenant builds the configuration of a tenant:
+// defaults, then its config file, with its secrets resolved.
+// Environment variables and flags apply only to the root config.
+func loadTenant(file string) (*config.Config, error) {
+	cfg := config.Default()
+	err := config.Load(cfg, file)
+	if err != nil {
+		return nil, err
+	}
+	err = resolveSecrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// resolveSecrets replaces the secret references in cfg
+// through the providers of its secrets section.
+func resolveSecrets(cfg *config.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return config.ResolveSecrets(ctx, cfg, cfg.Secrets.Providers(os.LookupEnv))
+}
+
+// loadConfig builds the effective configuration:
+// defaults, then the -config file, then environment variables,
+// then any explicitly set command-line flags,
+// and finally resolves its secret references.
+func loadConfig(fs *flag.FlagSet, args []string) (*config.Config, error) {
 	var (
-		addr          = flag.String("addr", "localhost:2423", "server listen address")
-		dbfile        = flag.String("db", "slidechain.db", "path to db")
-		url           = flag.String("horizon", "https://horizon-testnet.stellar.org", "horizon server url")
-		blockInterval = flag.Duration("interval", slidechain.DefaultBlockInterval, "expected interval between txvm blocks")
+		configFile    = fs.String("config", "", "path to TOML config file")
+		addr          = fs.String("addr", "", "server listen address (overrides addr)")
+		dbfile        = fs.String("db", "", "path to db (overrides db)")
+		url           = fs.String("horizon", "", "horizon server url (overrides horizon.url)")
+		blockInterval = fs.Duration("interval", 0, "expected interval between txvm blocks (overrides block_interval)")
 	)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
 
-	flag.Parse()
+	cfg := config.Default()
+	if *configFile != "" {
+		err = config.Load(cfg, *configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = config.ApplyEnv(cfg, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "db":
+			cfg.DB = *dbfile
+		case "horizon":
+			cfg.Horizon.URL = *url
+		case "interval":
+			cfg.BlockInterval = config.Duration(*blockInterval)
+		}
+	})
+	err = resolveSecrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func configCmd(args []string) {
+	if len(args) == 0 || args[0] != "print-effective" {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind config print-effective [-config FILE] [flags]
 
-	db, err := sql.Open("sqlite3", *dbfile)
+	Prints the configuration slidechaind would run with,
+	after applying the config file, SLIDECHAIN_* environment variables,
+	and flags, with secrets redacted.
+`)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("print-effective", flag.ExitOnError)
+	cfg, err := loadConfig(fs, args[1:])
+	if cfg == nil {
+		log.Fatal(err)
+	}
+	werr := cfg.WriteEffective(os.Stdout)
+	if werr != nil {
+		log.Fatal(werr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func signActionCmd(args []string) {
+	fs := flag.NewFlagSet("sign-action", flag.ExitOnError)
+	var (
+		prv    = fs.String("prv", os.Getenv("SLIDECHAIN_OPERATOR_PRV"), "hex encoding of the operator's ed25519 private key (default $SLIDECHAIN_OPERATOR_PRV)")
+		timeMS = fs.Int64("time", 0, "the action's time in milliseconds: X-Action-Time, or created_ms of a pending action (default now)")
+		body   = fs.String("body", "", "the request body")
+	)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind sign-action [-prv HEX] [-time MS] [-body BODY] METHOD URI
+
+	Prints the base64 X-Signature with which an operator
+	proposes or approves an admin action under governance.operators,
+	and the X-Action-Time it signed.
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	key, err := hex.DecodeString(*prv)
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		log.Fatalf("private key must be %d hex-encoded bytes", ed25519.PrivateKeySize)
+	}
+	if *timeMS == 0 {
+		*timeMS = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	sig := ed25519.Sign(key, slidechain.ActionDigest(fs.Arg(0), fs.Arg(1), []byte(*body), *timeMS))
+	fmt.Printf("X-Action-Time: %d\nX-Signature: %s\n", *timeMS, base64.StdEncoding.EncodeToString(sig))
+}
+
+func backfillCmd(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	var (
+		from = fs.Int("from-ledger", 0, "first Stellar ledger to rescan")
+		to   = fs.Int("to-ledger", 0, "last Stellar ledger to rescan")
+	)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind backfill -from-ledger N -to-ledger M [-config FILE] [flags]
+
+	Asks the running slidechaind, through its admin API at admin.addr,
+	to rescan the custodian's Stellar txs in ledgers N through M
+	for deposits it missed, and to issue them.
+	Deposits already recorded are not issued again.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *from <= 0 || *to < *from {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if cfg.Admin.Addr == "" {
+		log.Fatal("backfill needs the admin API; set admin.addr")
+	}
+	client, base, err := adminClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := fmt.Sprintf("%s/admin/backfill?%s", base, url.Values{
+		"from_ledger": {strconv.Itoa(*from)},
+		"to_ledger":   {strconv.Itoa(*to)},
+	}.Encode())
+	resp, err := client.Post(u, "", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("backfill: %s: %s", resp.Status, scnet.ProblemDetail(msg))
+	}
+	io.Copy(os.Stdout, resp.Body)
+}
+
+func snapshotCmd(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	var (
+		height = fs.Uint64("height", 0, "block height of the snapshot (default the latest indexed)")
+		format = fs.String("format", "csv", "csv or json")
+		out    = fs.String("o", "", "file to write the snapshot to, with its signature in FILE.sig (default stdout)")
+	)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind snapshot [-height N] [-format csv|json] [-o FILE] [-config FILE] [flags]
+
+	Asks the running slidechaind, through its admin API at admin.addr,
+	for the balance of each pubkey in each asset as of block N,
+	signed by the custodian.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *format != "csv" && *format != "json" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if cfg.Admin.Addr == "" {
+		log.Fatal("snapshot needs the admin API; set admin.addr")
+	}
+	q := url.Values{"format": {*format}}
+	if *height > 0 {
+		q.Set("height", strconv.FormatUint(*height, 10))
+	}
+	client, base, err := adminClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uri := "/admin/snapshot?" + q.Encode()
+	resp, err := client.Get(base + uri)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("snapshot: %s: %s", resp.Status, scnet.ProblemDetail(body))
+	}
+	sig := fmt.Sprintf("uri: %s\nX-Custodian-Time: %s\nX-Custodian-Signature: %s\n",
+		uri, resp.Header.Get("X-Custodian-Time"), resp.Header.Get("X-Custodian-Signature"))
+	if *out == "" {
+		os.Stdout.Write(body)
+		fmt.Fprint(os.Stderr, sig)
+		return
+	}
+	err = ioutil.WriteFile(*out, body, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(*out+".sig", []byte(sig), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func maintainCmd(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("maintain", flag.ExitOnError)
+	var (
+		fix    = fs.Bool("fix", false, "create missing indexes, rebuild the rest, and analyze")
+		vacuum = fs.Bool("vacuum", false, "compact the db; stop slidechaind first")
+	)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind maintain [-fix] [-vacuum] [-config FILE] [flags]
+
+	Reports the growth of each table of the db since the last run,
+	the free pages a vacuum would reclaim,
+	and the plan of each hot query, with any index it is missing.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", cfg.DB)
 	if err != nil {
 		log.Fatalf("error opening db: %s", err)
 	}
 	defer db.Close()
-	c, err := slidechain.GetCustodian(ctx, db, *url, *blockInterval)
+	r, err := slidechain.Maintain(ctx, db, slidechain.MaintainOptions{Fix: *fix, Vacuum: *vacuum}, time.Now())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go c.BS.ExpireBlocks(ctx)
+	fmt.Println("tables:")
+	for _, t := range r.Tables {
+		since := "first run"
+		if t.LastMS > 0 {
+			since = "since " + time.Unix(0, t.LastMS*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("  %-24s %10d rows  %+d %s\n", t.Name, t.Rows, t.Growth, since)
+	}
+	fmt.Printf("pages: %d of %d bytes, %d of them free\n", r.Pages, r.PageSize, r.FreePages)
+	if r.Vacuumed {
+		fmt.Printf("vacuumed: %d pages\n", r.PagesAfter)
+	}
+	fmt.Println("queries:")
+	for _, q := range r.Queries {
+		var notes []string
+		switch {
+		case q.Created:
+			notes = append(notes, "created index "+q.Index)
+		case q.Missing:
+			notes = append(notes, "missing index "+q.Index+"; run with -fix")
+		}
+		if q.FullScan {
+			notes = append(notes, "full scan")
+		}
+		fmt.Printf("  %s", q.Name)
+		if len(notes) > 0 {
+			fmt.Printf(" (%s)", strings.Join(notes, ", "))
+		}
+		fmt.Println()
+		for _, step := range q.Plan {
+			fmt.Printf("    %s\n", step)
+		}
+	}
+}
 
-	listener, err := net.Listen("tcp", *addr)
+func scanExportsCmd(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("scan-exports", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind scan-exports [-config FILE] [flags]
+
+	Scans the blocks that slidechaind saves to the db for exports,
+	recording them for slidechaind to peg out,
+	until killed.
+	It resumes from its own pin in the db,
+	which POST /admin/export-scan rewinds.
+	Requires pegout.scanner = "external".
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
 	if err != nil {
 		log.Fatal(err)
 	}
+	db, err := sql.Open("sqlite3", cfg.DB)
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+	err = slidechain.ScanExports(ctx, db, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	log.Printf("listening on %s, initial block ID %x", listener.Addr(), c.InitBlockHash.Bytes())
+func setupMultisigCmd(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("setup-multisig", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind setup-multisig [-config FILE] [flags]
+
+	Sets the signers and thresholds of the custodian Stellar account
+	to custodian.signers and custodian.thresholds,
+	in a tx signed by the custodian key,
+	and checks the result on-chain.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", cfg.DB)
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+	changes, err := slidechain.SetupMultisig(ctx, db, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(changes) == 0 {
+		fmt.Println("custodian account already matches config")
+	}
+	for _, s := range changes {
+		fmt.Println(s)
+	}
+}
+
+func eventsCmd(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "set each drifted state to the event log's")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage:
+	slidechaind events [-fix] [-config FILE] [flags]
 
-	http.Handle("/submit", c.S)
-	http.HandleFunc("/get", c.S.Get)
-	http.HandleFunc("/account", c.Account)
-	http.HandleFunc("/prepegin", c.DoPrePegIn)
-	http.Serve(listener, nil)
+	Replays the event log of the db,
+	reporting events that do not follow from the ones before
+	and peg-ins and exports whose state differs from the log's.
+`)
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", cfg.DB)
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+	r, err := slidechain.ProjectStates(ctx, db, *fix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("events: %d\n", r.Events)
+	for _, s := range r.Invalid {
+		fmt.Printf("  invalid: %s\n", s)
+	}
+	for _, d := range r.Drift {
+		note := "run with -fix"
+		if d.Fixed {
+			note = "fixed"
+		}
+		fmt.Printf("  drift: %s %s is %s, log says %s (%s)\n", d.Kind, d.Key, d.Table, d.Log, note)
+	}
+	for _, s := range r.Missing {
+		fmt.Printf("  missing: %s\n", s)
+	}
+	if r.Unlogged > 0 {
+		fmt.Printf("unlogged: %d peg-ins and exports from before the log\n", r.Unlogged)
+	}
 }
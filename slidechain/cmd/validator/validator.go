@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+
+	scnet "github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/validator"
+)
+
+func main() {
+	var (
+		addr        = flag.String("addr", "localhost:2425", "listen address")
+		prv         = flag.String("prv", "", "hex encoding of the validator's ed25519 private key")
+		bcidHex     = flag.String("bcid", "", "hex-encoded initial block ID")
+		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of slidechaind server")
+
+		tlsCert     = flag.String("tls-cert", "", "PEM certificate chain to serve TLS with (default plain HTTP)")
+		tlsKey      = flag.String("tls-key", "", "PEM key of -tls-cert")
+		tlsClientCA = flag.String("tls-client-ca", "", "PEM CAs one of which must sign each client's certificate")
+		peerCA      = flag.String("peer-ca", "", "PEM CAs that sign peers' certificates (default the system CAs)")
+		peerCert    = flag.String("peer-cert", "", "PEM certificate to present to peers that require one")
+		peerKey     = flag.String("peer-key", "", "PEM key of -peer-cert")
+	)
+	flag.Parse()
+
+	if *peerCA != "" || *peerCert != "" {
+		tlsCfg, err := scnet.ClientTLS(*peerCA, *peerCert, *peerKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scnet.PeerClient = scnet.TLSClient(tlsCfg)
+	}
+
+	if *bcidHex == "" {
+		log.Fatal("must specify initial block ID")
+	}
+	var key ed25519.PrivateKey
+	if *prv == "" {
+		log.Print("no private key specified, generating one...")
+		var err error
+		_, key, err = ed25519.GenerateKey(nil)
+		if err != nil {
+			log.Fatalf("error generating key: %s", err)
+		}
+		log.Printf("private key %x", []byte(key))
+	} else {
+		key = mustDecodeHex(*prv)
+		if len(key) != ed25519.PrivateKeySize {
+			log.Fatalf("private key must be %d bytes", ed25519.PrivateKeySize)
+		}
+	}
+
+	*slidechaind = strings.TrimRight(*slidechaind, "/")
+	resp, err := scnet.PeerClient.Get(*slidechaind + "/get?height=1")
+	if err != nil {
+		log.Fatalf("error getting initial block: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("bad status code %d getting initial block", resp.StatusCode)
+	}
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("error reading initial block: %s", err)
+	}
+	initial := new(bc.Block)
+	err = initial.FromBytes(bits)
+	if err != nil {
+		log.Fatalf("error parsing initial block: %s", err)
+	}
+	if !bytes.Equal(initial.Hash().Bytes(), mustDecodeHex(*bcidHex)) {
+		log.Fatalf("initial block ID is %x, not %s", initial.Hash().Bytes(), *bcidHex)
+	}
+
+	node, err := validator.New(key, initial, *slidechaind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/sign", node)
+	log.Printf("validator %x listening on %s", []byte(node.Pubkey()), *addr)
+	if *tlsCert == "" {
+		log.Fatal(http.ListenAndServe(*addr, nil))
+	}
+	tlsCfg, err := scnet.ServerTLS(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: *addr, TLSConfig: tlsCfg}
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+func mustDecodeHex(src string) []byte {
+	bytes, err := hex.DecodeString(src)
+	if err != nil {
+		panic(fmt.Errorf("error decoding %s: %s", src, err))
+	}
+	return bytes
+}
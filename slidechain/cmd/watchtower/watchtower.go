@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/interstellar/slingshot/slidechain"
+	scnet "github.com/interstellar/slingshot/slidechain/net"
+)
+
+func main() {
+	ctx := context.Background()
+
+	var (
+		addr        = flag.String("addr", "localhost:2427", "listen address")
+		dbfile      = flag.String("db", "watchtower.db", "path to db")
+		prv         = flag.String("prv", "", "hex encoding of the ed25519 private key that signs evidence")
+		custodian   = flag.String("custodian", "", "Stellar account ID of the custodian account")
+		horizonURL  = flag.String("horizon", "https://horizon-testnet.stellar.org", "horizon URL")
+		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of the slidechaind server or a follower")
+		bcidHex     = flag.String("bcid", "", "hex-encoded initial block ID")
+		sla         = flag.Duration("sla", 0, "how long an export may await its peg-out or refund (default 1h)")
+		grace       = flag.Duration("grace", 0, "how long an import may await the watchtower's sight of its deposit (default 10m)")
+		webhook     = flag.String("webhook", "", "url to POST each piece of evidence to, as an alert")
+		claim       = flag.Bool("claim", false, "submit each unbacked issuance to -slidechaind as a fraud claim")
+
+		peerCA   = flag.String("peer-ca", "", "PEM CAs that sign the certificate of -slidechaind (default the system CAs)")
+		peerCert = flag.String("peer-cert", "", "PEM certificate to present to -slidechaind if it requires one")
+		peerKey  = flag.String("peer-key", "", "PEM key of -peer-cert")
+	)
+	flag.Parse()
+
+	if *peerCA != "" || *peerCert != "" {
+		tlsCfg, err := scnet.ClientTLS(*peerCA, *peerCert, *peerKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scnet.PeerClient = scnet.TLSClient(tlsCfg)
+	}
+
+	if *custodian == "" {
+		log.Fatal("must specify custodian account")
+	}
+	if *bcidHex == "" {
+		log.Fatal("must specify initial block ID")
+	}
+	bcidBytes, err := hex.DecodeString(*bcidHex)
+	if err != nil || len(bcidBytes) != 32 {
+		log.Fatalf("initial block ID must be 32 hex-encoded bytes")
+	}
+	var key ed25519.PrivateKey
+	if *prv == "" {
+		log.Print("no private key specified, generating one...")
+		_, key, err = ed25519.GenerateKey(nil)
+		if err != nil {
+			log.Fatalf("error generating key: %s", err)
+		}
+		log.Printf("private key %x", []byte(key))
+	} else {
+		key, err = hex.DecodeString(*prv)
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			log.Fatalf("private key must be %d hex-encoded bytes", ed25519.PrivateKeySize)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", *dbfile)
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+
+	hclient := &stellar.HorizonClient{
+		URL:  strings.TrimRight(*horizonURL, "/"),
+		HTTP: new(http.Client),
+	}
+	w, err := slidechain.NewWatchtower(ctx, db, hclient, *custodian, *slidechaind, bc.HashFromBytes(bcidBytes), key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *sla > 0 {
+		w.SLA = *sla
+	}
+	if *grace > 0 {
+		w.Grace = *grace
+	}
+	w.WebhookURL = *webhook
+	w.ClaimFraud = *claim
+	go w.Run(ctx)
+
+	http.HandleFunc("/status", w.Status)
+	http.HandleFunc("/evidence", w.ListEvidence)
+	log.Printf("watchtower %x of custodian %s listening on %s", []byte(w.Pubkey()), *custodian, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,2173 @@
+// Package config defines the configuration of a slidechaind server.
+//
+// A Config starts from Default,
+// is overlaid with the contents of a TOML file (see Load),
+// then with environment variables (see ApplyEnv),
+// and is finally checked with Validate before the server starts.
+//
+// Settings tagged reload:"true" may be changed in a running server
+// (see Changes and ApplyReloadable);
+// all others take effect only on restart.
+package config
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/evm"
+	"github.com/interstellar/slingshot/slidechain/oracle"
+	"github.com/interstellar/slingshot/slidechain/secret"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// EnvPrefix is prepended to the upper-cased, underscore-separated
+// path of each config key to get the name of the environment variable
+// that overrides it.
+// For example, horizon.url is overridden by SLIDECHAIN_HORIZON_URL.
+const EnvPrefix = "SLIDECHAIN_"
+
+// Config is the complete configuration of a slidechaind server.
+type Config struct {
+	// Addr is the listen address of the public HTTP API.
+	Addr string `toml:"addr"`
+
+	// TLS, if configured, secures the public HTTP API.
+	TLS TLS `toml:"tls"`
+
+	// DB is the path to the sqlite database.
+	DB string `toml:"db"`
+
+	// BlockInterval is the expected duration between txvm blocks.
+	BlockInterval Duration `toml:"block_interval"`
+
+	Horizon    Horizon    `toml:"horizon"`
+	Custodian  Custodian  `toml:"custodian"`
+	Admin      Admin      `toml:"admin"`
+	Log        Log        `toml:"log"`
+	RateLimit  RateLimit  `toml:"ratelimit"`
+	API        API        `toml:"api"`
+	Assets     Assets     `toml:"assets"`
+	PegIn      PegIn      `toml:"pegin"`
+	PegOut     PegOut     `toml:"pegout"`
+	Alert      Alert      `toml:"alert"`
+	EVM        EVM        `toml:"evm"`
+	SEP1       SEP1       `toml:"sep1"`
+	Issuer     Issuer     `toml:"issuer"`
+	Checkpoint Checkpoint `toml:"checkpoint"`
+	Validators Validators `toml:"validators"`
+	Gossip     Gossip     `toml:"gossip"`
+	Fees       Fees       `toml:"fees"`
+	AntiSpam   AntiSpam   `toml:"antispam"`
+
+	DepositAccounts DepositAccounts `toml:"deposit_accounts"`
+	Notify          Notify          `toml:"notify"`
+	Screening       Screening       `toml:"screening"`
+	SEP31           SEP31           `toml:"sep31"`
+	SEP12           SEP12           `toml:"sep12"`
+	TravelRule      TravelRule      `toml:"travel_rule"`
+	KYC             KYC             `toml:"kyc"`
+	Governance      Governance      `toml:"governance"`
+	Balance         Balance         `toml:"balance"`
+	Clawback        Clawback        `toml:"clawback"`
+	ExportTemplates ExportTemplates `toml:"export_templates"`
+	Consolidation   Consolidation   `toml:"consolidation"`
+	DepositNonces   DepositNonces   `toml:"deposit_nonces"`
+	Tenants         Tenants         `toml:"tenants"`
+	Secrets         Secrets         `toml:"secrets"`
+	PeerTLS         PeerTLS         `toml:"peer_tls"`
+	SLO             SLO             `toml:"slo"`
+	Oracle          Oracle          `toml:"oracle"`
+	Rebalance       Rebalance       `toml:"rebalance"`
+	PartnerFees     PartnerFees     `toml:"partner_fees"`
+}
+
+// Horizon configures the connection to the Stellar network.
+type Horizon struct {
+	// URL is the base URL of the Horizon server.
+	URL string `toml:"url"`
+
+	// FriendbotURL is the friendbot used to fund
+	// a newly created custodian account.
+	FriendbotURL string `toml:"friendbot_url"`
+
+	// AsyncSubmit submits peg-out txs through Horizon's /transactions_async endpoint
+	// and polls for their results,
+	// instead of waiting on synchronous submission.
+	AsyncSubmit bool `toml:"async_submit"`
+
+	// AllowUnknownProtocol runs the custodian on a network
+	// past the latest Stellar protocol version it supports,
+	// instead of refusing to start and refusing new peg-ins.
+	AllowUnknownProtocol bool `toml:"allow_unknown_protocol"`
+
+	// Region is the region the custodian runs in,
+	// which is also that of URL.
+	Region string `toml:"region"`
+
+	// Endpoints are further Horizon servers of the same network,
+	// as "REGION=URL" entries.
+	// The custodian uses the fastest healthy server in its region,
+	// fails over to the fastest elsewhere while none there is healthy,
+	// and fails back when one recovers.
+	Endpoints []string `toml:"endpoints"`
+
+	// ProbeInterval is how often the latency of each server is measured
+	// when there are Endpoints.
+	ProbeInterval Duration `toml:"probe_interval"`
+}
+
+// problems lists what is wrong with the region settings of the horizon section.
+func (h Horizon) problems() []string {
+	if len(h.Endpoints) == 0 {
+		return nil
+	}
+	var problems []string
+	if h.Region == "" {
+		problems = append(problems, "horizon.region must be set with horizon.endpoints")
+	}
+	for _, entry := range h.Endpoints {
+		region, endpoint := SplitNamed(entry)
+		if region == "" {
+			problems = append(problems, fmt.Sprintf("horizon.endpoints: %q is not REGION=URL", entry))
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("horizon.endpoints: %q is not an http(s) URL", endpoint))
+		}
+	}
+	if h.ProbeInterval <= 0 {
+		problems = append(problems, "horizon.probe_interval must be positive with horizon.endpoints")
+	}
+	return problems
+}
+
+// Custodian configures the custodian's Stellar account.
+type Custodian struct {
+	// Seed is the Stellar seed of the custodian account.
+	// If empty, the seed stored in the db is used,
+	// or a new account is created and funded on first run.
+	Seed string `toml:"seed" secret:"true"`
+
+	// IssuanceVersion is the version of the import-issuance contract
+	// new peg-ins are imported with.
+	// Assets imported by earlier versions remain exportable
+	// and can be migrated to later ones.
+	IssuanceVersion int64 `toml:"issuance_version"`
+
+	// Signers are the signers the custodian account must have,
+	// as "ADDRESS=WEIGHT" entries including the custodian's own key.
+	// If empty, the account must be signed by its own key alone, with weight 1.
+	Signers []string `toml:"signers"`
+
+	// Thresholds are the low, medium, and high thresholds
+	// the custodian account must have.
+	// If empty, all must be 0.
+	Thresholds []int64 `toml:"thresholds"`
+}
+
+// Admin configures the admin listener.
+type Admin struct {
+	// Addr is the listen address of the admin HTTP API.
+	// If empty, the admin API is disabled.
+	// It should never be reachable from the public network.
+	Addr string `toml:"addr"`
+
+	// PauseFile, if set, is a local file whose presence pauses the server
+	// without the admin API:
+	// each of its lines names a pause scope,
+	// and an empty file pauses them all.
+	PauseFile string `toml:"pause_file" reload:"true"`
+
+	// TLS, if configured, secures the admin HTTP API.
+	TLS TLS `toml:"tls"`
+}
+
+// TLS configures TLS on a listener.
+// The files are read again when they change,
+// so renewed certificates take effect without a restart.
+type TLS struct {
+	// CertFile and KeyFile hold the PEM certificate chain and key.
+	// If empty, the listener serves plain HTTP.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// ClientCAFile, if set, holds the PEM CAs
+	// one of which must have signed the certificate each client presents.
+	ClientCAFile string `toml:"client_ca_file"`
+}
+
+// PeerTLS configures TLS on the requests that slidechain nodes make of one another:
+// the custodian's of its validators, and gossip.
+type PeerTLS struct {
+	// CAFile, if set, holds the PEM CAs that sign peers' certificates,
+	// in place of the system CAs.
+	CAFile string `toml:"ca_file"`
+
+	// CertFile and KeyFile, if set, hold the PEM certificate and key
+	// presented to peers that require client certificates.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// Log configures logging.
+type Log struct {
+	// Level is "info" or "debug".
+	Level string `toml:"level" reload:"true"`
+}
+
+// RateLimit limits the rate of requests to the public write endpoints.
+// Anonymous callers are limited per client IP address,
+// and callers presenting a key from the api section per key,
+// with the limits of their tier.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second allowed.
+	// Zero means unlimited.
+	Rate float64 `toml:"rate" reload:"true"`
+
+	// Burst is the number of requests allowed in excess of Rate
+	// after a quiet period.
+	Burst int64 `toml:"burst" reload:"true"`
+
+	// Quota is the number of requests allowed per UTC day.
+	// Zero means unlimited.
+	Quota int64 `toml:"quota" reload:"true"`
+
+	// PartnerRate, PartnerBurst, and PartnerQuota
+	// are the limits of callers with api.partners keys.
+	PartnerRate  float64 `toml:"partner_rate" reload:"true"`
+	PartnerBurst int64   `toml:"partner_burst" reload:"true"`
+	PartnerQuota int64   `toml:"partner_quota" reload:"true"`
+
+	// AdminRate, AdminBurst, and AdminQuota
+	// are the limits of callers with api.admins keys.
+	AdminRate  float64 `toml:"admin_rate" reload:"true"`
+	AdminBurst int64   `toml:"admin_burst" reload:"true"`
+	AdminQuota int64   `toml:"admin_quota" reload:"true"`
+}
+
+// API configures the keys that identify callers of the public API
+// for the limits of their tiers.
+// Each is presented in the X-API-Key header.
+type API struct {
+	// Partners are the wallet partners' keys, in the form "NAME=KEY".
+	Partners []string `toml:"partners" secret:"true" reload:"true"`
+
+	// Admins are the operators' keys, in the form "NAME=KEY".
+	Admins []string `toml:"admins" secret:"true" reload:"true"`
+}
+
+// PartnerFees configures the fees the operator accrues
+// on the peg-ins and exports of the wallet partners it white-labels the peg for,
+// to bill them.
+// A peg-in is attributed to the partner whose api.partners key requested it,
+// or else to the partner of the referral code in its intent;
+// an export, to the partner of its exporter's latest attributed peg-in.
+type PartnerFees struct {
+	// Schedules are the fee schedules, in the form "NAME=IMPORT_BPS/EXPORT_BPS",
+	// charging basis points of each amount imported and exported.
+	Schedules []string `toml:"schedules" reload:"true"`
+
+	// Partners assign schedules to partners, in the form "PARTNER=SCHEDULE".
+	Partners []string `toml:"partners" reload:"true"`
+
+	// Default is the schedule of partners not in Partners.
+	// If empty, their volume is reported without a fee.
+	Default string `toml:"default" reload:"true"`
+
+	// ReferralCodes attribute peg-ins to partners, in the form "CODE=PARTNER".
+	ReferralCodes []string `toml:"referral_codes" reload:"true"`
+}
+
+// FeeSchedule is a parsed entry of partner_fees.schedules.
+type FeeSchedule struct {
+	Name                 string
+	ImportBPS, ExportBPS int64
+}
+
+// ParseFeeSchedule parses an entry of partner_fees.schedules.
+func ParseFeeSchedule(s string) (FeeSchedule, error) {
+	var f FeeSchedule
+	name, rates := SplitNamed(s)
+	parts := strings.Split(rates, "/")
+	if name == "" || len(parts) != 2 {
+		return f, fmt.Errorf("%q is not NAME=IMPORT_BPS/EXPORT_BPS", s)
+	}
+	f.Name = name
+	for i, dst := range []*int64{&f.ImportBPS, &f.ExportBPS} {
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || n < 0 || n > 10000 {
+			return f, fmt.Errorf("%q: %q is not between 0 and 10000 basis points", s, parts[i])
+		}
+		*dst = n
+	}
+	return f, nil
+}
+
+// Schedule returns the fee schedule of partner,
+// reporting false if it has none.
+func (p PartnerFees) Schedule(partner string) (FeeSchedule, bool) {
+	name := p.Default
+	for _, entry := range p.Partners {
+		if n, sched := SplitNamed(entry); n == partner {
+			name = sched
+			break
+		}
+	}
+	if name == "" {
+		return FeeSchedule{}, false
+	}
+	for _, entry := range p.Schedules {
+		if f, err := ParseFeeSchedule(entry); err == nil && f.Name == name {
+			return f, true
+		}
+	}
+	return FeeSchedule{}, false
+}
+
+// Referrer returns the partner of a referral code,
+// or "" if the code is unknown.
+func (p PartnerFees) Referrer(code string) string {
+	for _, entry := range p.ReferralCodes {
+		if c, partner := SplitNamed(entry); c != "" && c == code {
+			return partner
+		}
+	}
+	return ""
+}
+
+// Assets restricts the Stellar assets that may be pegged in.
+type Assets struct {
+	// Allowlist is a list of assets in the form "native" or "CODE:ISSUER".
+	// If empty, all assets are allowed.
+	Allowlist []string `toml:"allowlist" reload:"true"`
+
+	// CapAction is what becomes of a deposit for a peg-in
+	// that would take its asset's outstanding issuance past the cap
+	// set for it through /admin/caps:
+	// "hold", under which it waits to be imported until the cap allows,
+	// or "refund", under which it is refunded to its sender.
+	CapAction string `toml:"cap_action" reload:"true"`
+}
+
+// PegIn configures the custodian's handling of peg-ins
+// whose deposits have not arrived.
+type PegIn struct {
+	// IntentTTL is how long a recorded peg-in waits for its deposit
+	// before it expires, and a later deposit for it is refunded.
+	// Zero means never.
+	IntentTTL Duration `toml:"intent_ttl" reload:"true"`
+}
+
+// PegOut configures the custodian's handling of peg-outs
+// that Stellar has not confirmed.
+type PegOut struct {
+	// StuckAfter is how long a peg-out may go without confirmation
+	// before the custodian looks it up on Stellar
+	// and, if it is not there, resubmits it with a higher fee.
+	StuckAfter Duration `toml:"stuck_after" reload:"true"`
+
+	// CheckInterval is how often to look for stuck peg-outs.
+	CheckInterval Duration `toml:"check_interval"`
+
+	// DestinationPolicy is "denylist",
+	// under which exports may be pegged out to any account
+	// not on the deny list in the peg_out_destinations table,
+	// or "allowlist", under which only accounts on the allow list may be paid.
+	// Exports to other accounts are held.
+	DestinationPolicy string `toml:"destination_policy" reload:"true"`
+
+	// FederationTTL is how long the custodian caches
+	// the resolutions of federation addresses
+	// that it checks the destinations of exports against.
+	FederationTTL Duration `toml:"federation_ttl"`
+
+	// NetMin, if at least 2, is how many pending exports
+	// of the same asset to the same account and memo
+	// the custodian nets into a single payment.
+	// Smaller groups are pegged out separately.
+	NetMin int `toml:"net_min" reload:"true"`
+
+	// Shards are assets pegged out by workers of their own,
+	// so that a backlog in one does not delay the others,
+	// in the form "ASSET" or "ASSET=RATE"
+	// with ASSET as in assets.allowlist
+	// and RATE the most peg-outs per second, zero for unlimited.
+	// Exports of other assets are pegged out by the default worker.
+	Shards []string `toml:"shards"`
+
+	// AuthorizationHook, if set, is a URL POSTed once
+	// about each export held because its payee's trustline
+	// is not authorized by the asset's issuer,
+	// for the issuer to authorize it.
+	AuthorizationHook string `toml:"authorization_hook" reload:"true"`
+
+	// AuthorizeTrustlines, for assets the custodian account issues,
+	// has the custodian authorize an unauthorized payee trustline
+	// for a peg-out and revoke the authorization afterward.
+	AuthorizeTrustlines bool `toml:"authorize_trustlines" reload:"true"`
+
+	// MissingTrustline is what becomes of an export of a credit asset
+	// whose payee has no trustline to it:
+	// "refund", under which its peg-out fails and it is refunded,
+	// or "hold", under which it is held until the payee adds the trustline
+	// or the export's time bounds pass.
+	MissingTrustline string `toml:"missing_trustline" reload:"true"`
+
+	// MinSeqAge is the least minimum sequence age
+	// the peg-out tx of an export must carry:
+	// how long the temp account, the channel account
+	// the peg-out tx is sourced from and merges,
+	// must stand unchanged after the pre-export tx sets it up.
+	// MaxLedgers, if positive, is the most ledgers
+	// the peg-out tx may be valid in:
+	// it must carry ledger bounds no wider.
+	// An export whose peg-out tx falls short
+	// cannot have it rebuilt, since the pre-export tx preauthorized it,
+	// so it fails and is refunded.
+	MinSeqAge  Duration `toml:"min_seq_age" reload:"true"`
+	MaxLedgers int      `toml:"max_ledgers" reload:"true"`
+
+	// Scanner is "internal", under which slidechaind itself
+	// scans new blocks for exports,
+	// or "external", under which it leaves that
+	// to a slidechaind scan-exports process sharing its db.
+	Scanner string `toml:"scanner"`
+}
+
+// Alert configures how operators are alerted
+// to problems the custodian cannot resolve itself.
+// Alerts are always logged and recorded in the alerts table.
+type Alert struct {
+	// WebhookURL, if set, is sent each alert as a JSON POST.
+	WebhookURL string `toml:"webhook_url" reload:"true"`
+}
+
+// EVM configures an Ethereum-compatible chain
+// as the main chain, in place of Stellar.
+type EVM struct {
+	// RPCURL is the JSON-RPC endpoint of a node on the chain.
+	// If empty, the main chain is Stellar
+	// and the rest of this section is ignored.
+	RPCURL string `toml:"rpc_url"`
+
+	// Contract is the address of the custodian contract,
+	// which receives deposits and makes withdrawals.
+	Contract string `toml:"contract"`
+
+	// From is the account that sends withdrawal txs.
+	// The node signs them, so it must hold the account's key,
+	// and the contract must accept withdrawals from it.
+	From string `toml:"from"`
+
+	// StartBlock is the first block scanned for deposits
+	// when the db has no cursor.
+	StartBlock int64 `toml:"start_block"`
+
+	// Confirmations is how many blocks must follow
+	// the block of a deposit or withdrawal before it is final.
+	Confirmations int64 `toml:"confirmations"`
+
+	// GasLimit is the gas limit of a withdrawal tx.
+	GasLimit int64 `toml:"gas_limit"`
+
+	// MaxGasPrice caps the gas price of a withdrawal tx, in wei.
+	// Zero means no cap.
+	MaxGasPrice int64 `toml:"max_gas_price"`
+}
+
+// SEP1 configures the stellar.toml (SEP-1) file
+// describing the Stellar assets the custodian issues
+// to represent slidechain-native assets.
+type SEP1 struct {
+	// HomeDomain is the domain serving the file
+	// at /.well-known/stellar.toml.
+	// If set, the custodian account's home domain is set to it on startup.
+	HomeDomain string `toml:"home_domain"`
+
+	// OrgName and OrgURL describe the custodian's operator.
+	OrgName string `toml:"org_name" reload:"true"`
+	OrgURL  string `toml:"org_url" reload:"true"`
+}
+
+// Issuer configures the custodian account as the Stellar issuer
+// of the wrapped assets, those originating on slidechain.
+type Issuer struct {
+	// Enabled has the custodian keep its account's flags as set here,
+	// authorize the trustlines of wrapped peg-outs' payees,
+	// and reconcile the Stellar supply of each wrapped asset
+	// with its slidechain reserve.
+	Enabled bool `toml:"enabled"`
+
+	// AuthRequired, AuthRevocable, and Clawback are the account's
+	// AUTH_REQUIRED, AUTH_REVOCABLE, and AUTH_CLAWBACK_ENABLED flags.
+	// Clawback requires AuthRevocable.
+	AuthRequired  bool `toml:"auth_required"`
+	AuthRevocable bool `toml:"auth_revocable"`
+	Clawback      bool `toml:"clawback"`
+
+	// ReconcileInterval is how often the Stellar supply
+	// of each wrapped asset is checked.
+	ReconcileInterval Duration `toml:"reconcile_interval"`
+}
+
+// Checkpoint configures the anchoring of slidechain blocks onto Stellar.
+type Checkpoint struct {
+	// Interval is how often the ID of the latest block
+	// is published in a tx from the custodian account.
+	// Zero means never.
+	Interval Duration `toml:"interval"`
+}
+
+// Validators configures the set of validator nodes
+// that must sign each slidechain block.
+type Validators struct {
+	// Pubkeys are the hex-encoded ed25519 public keys of the validators.
+	// If empty, blocks are not signed.
+	Pubkeys []string `toml:"pubkeys"`
+
+	// URLs are the base URLs of the validators,
+	// in the same order as Pubkeys.
+	URLs []string `toml:"urls"`
+
+	// Quorum is how many of the validators must sign a block.
+	Quorum int64 `toml:"quorum"`
+}
+
+// Gossip configures the exchange of blocks and txs
+// with follower nodes.
+type Gossip struct {
+	// URL is the base URL at which peers reach this node.
+	// If empty, gossip is disabled.
+	URL string `toml:"url"`
+
+	// Peers are the base URLs of the nodes to gossip with,
+	// in addition to any that send gossip to this one.
+	Peers []string `toml:"peers"`
+}
+
+// Fees configures the fees that slidechain txs submitted to this node must pay.
+// The custodian's own txs pay none.
+type Fees struct {
+	// Asset is the hex txvm asset ID fees are paid in:
+	// a pegged asset, or a fee token issued on the slidechain.
+	// If empty, txs pay no fees.
+	Asset string `toml:"asset"`
+
+	// Collector is the hex ed25519 public key fees are paid to.
+	// A tx's fee is the total of Asset
+	// in its pay-to-multisig outputs locked by Collector alone.
+	Collector string `toml:"collector"`
+
+	// Min is the least fee a tx must pay, in units of Asset.
+	Min int64 `toml:"min" reload:"true"`
+
+	// MaxBlockTxs caps the txs in a block.
+	// Pending txs are added highest fee first,
+	// and those left out wait for the next block.
+	// Zero means no cap beyond txvm's own.
+	MaxBlockTxs int `toml:"max_block_txs" reload:"true"`
+}
+
+// AntiSpam configures the gate that anonymous callers of /submit must pass,
+// so that a public node cannot be flooded with txs.
+type AntiSpam struct {
+	// Mode is "pow", for a proof of work with each submission;
+	// "stake", for a signature by a pubkey holding StakeMin of StakeAsset;
+	// or empty, for no gate.
+	Mode string `toml:"mode" reload:"true"`
+
+	// WorkBits is how many leading zero bits
+	// the hash of a proof of work must have.
+	WorkBits int `toml:"work_bits" reload:"true"`
+
+	// StakeAsset is the hex txvm asset ID, normally of a pegged asset,
+	// that a submitting pubkey must hold.
+	StakeAsset string `toml:"stake_asset" reload:"true"`
+
+	// StakeMin is how much of StakeAsset it must hold,
+	// in the outputs locked by it alone.
+	StakeMin int64 `toml:"stake_min" reload:"true"`
+}
+
+// DepositAccounts configures per-recipient Stellar deposit accounts.
+type DepositAccounts struct {
+	// Enabled turns on /deposit-account,
+	// which gives each slidechain recipient its own Stellar account for peg-ins.
+	// The custodian funds each account's reserve.
+	Enabled bool `toml:"enabled"`
+}
+
+// Notify configures the notifications users can opt in to
+// about their own peg-ins and peg-outs.
+type Notify struct {
+	// SMTPAddr is the host:port of the SMTP server
+	// that delivers the email channel.
+	// If empty, email is not offered.
+	SMTPAddr     string `toml:"smtp_addr"`
+	SMTPFrom     string `toml:"smtp_from"`
+	SMTPUsername string `toml:"smtp_username"`
+	SMTPPassword string `toml:"smtp_password" secret:"true"`
+
+	// Webhooks are further channels, such as SMS or push gateways,
+	// in the form "NAME=URL".
+	// Each message on channel NAME is sent to URL as a JSON POST.
+	Webhooks []string `toml:"webhooks"`
+
+	// TemplateDir, if set, is a directory of templates
+	// named EVENT.subject and EVENT.body
+	// that replace the built-in ones.
+	TemplateDir string `toml:"template_dir"`
+}
+
+// Screening configures compliance screening of pegs.
+type Screening struct {
+	// URL, if set, is the screening service
+	// that each peg-out is sent to as a JSON POST before it is paid.
+	// If empty, every peg is approved.
+	URL string `toml:"url"`
+
+	// APIKey, if set, is sent to the service as a bearer token.
+	APIKey string `toml:"api_key" secret:"true"`
+
+	// PegIns sends each peg-in to the service too,
+	// before its value is issued on txvm.
+	PegIns bool `toml:"pegins"`
+}
+
+// SEP31 configures the SEP-31 endpoints
+// through which sending anchors push cross-border payments into the slidechain.
+type SEP31 struct {
+	// Assets are the Stellar assets that may be received,
+	// in the form used by assets.allowlist.
+	// If empty, the endpoints are disabled.
+	Assets []string `toml:"assets" reload:"true"`
+
+	// Senders are the sending anchors allowed to use the endpoints,
+	// in the form "NAME=KEY".
+	// Each presents its KEY as a bearer token.
+	Senders []string `toml:"senders" secret:"true" reload:"true"`
+
+	// URL, if set, is the public base URL of the endpoints,
+	// published in stellar.toml as DIRECT_PAYMENT_SERVER.
+	URL string `toml:"url"`
+}
+
+// SEP12 configures the SEP-12 customer endpoints
+// through which anchors and wallets register the KYC information
+// of slidechain pubkeys for review against kyc.tiers.
+type SEP12 struct {
+	// Clients are the anchors and wallets allowed to use the endpoints,
+	// in the form "NAME=KEY".
+	// Each presents its KEY as a bearer token.
+	// If empty, the endpoints are disabled.
+	Clients []string `toml:"clients" secret:"true" reload:"true"`
+
+	// Fields are the SEP-9 fields a customer must provide,
+	// such as "first_name" and "email_address".
+	Fields []string `toml:"fields" reload:"true"`
+
+	// Tier, if set, is the tier of kyc.tiers
+	// that a customer still in the first tier is moved to
+	// on providing all of Fields,
+	// without waiting for the KYC system.
+	Tier string `toml:"tier" reload:"true"`
+
+	// Key is the hex 32-byte AES key
+	// with which the custodian stores customer information.
+	Key string `toml:"key" secret:"true"`
+
+	// URL, if set, is the public base URL of the endpoints,
+	// published in stellar.toml as KYC_SERVER.
+	URL string `toml:"url"`
+}
+
+// TravelRule configures the originator and beneficiary information
+// that large peg-outs must carry.
+type TravelRule struct {
+	// Thresholds are the peg-out amounts, in base units,
+	// at and above which the information is required,
+	// in the form "ASSET=AMOUNT" with ASSET as in assets.allowlist.
+	// If empty, it is never required.
+	Thresholds []string `toml:"thresholds" reload:"true"`
+
+	// Key is the hex 32-byte AES key
+	// with which the custodian stores the information.
+	Key string `toml:"key" secret:"true"`
+}
+
+// KYC configures the tiers of slidechain pubkeys
+// and the import and export limits of each.
+type KYC struct {
+	// Tiers are the tier names.
+	// A pubkey not assigned a tier is in the first.
+	// If empty, no limits are enforced.
+	Tiers []string `toml:"tiers" reload:"true"`
+
+	// Limits are the UTC-day and UTC-month totals a pubkey may import or export
+	// in its tier, in base units,
+	// in the form "TIER:import:ASSET=DAILY,MONTHLY" or "TIER:export:ASSET=DAILY,MONTHLY"
+	// with ASSET as in assets.allowlist,
+	// or ValueAsset for a limit on the total of every asset
+	// in base units of oracle.currency.
+	// Either amount may be empty for no limit.
+	// An asset with no entry for a tier is unlimited in it.
+	Limits []string `toml:"limits" reload:"true"`
+
+	// APIKey is the bearer token with which the external KYC system
+	// assigns tiers through /kyc/accounts.
+	APIKey string `toml:"api_key" secret:"true"`
+}
+
+// Governance configures the two-person rule for destructive admin actions.
+type Governance struct {
+	// Operators are the operators' ed25519 public keys,
+	// in the form "NAME=HEXPUBKEY".
+	// If set, each destructive admin action
+	// must be signed by two different operators before it runs.
+	Operators []string `toml:"operators"`
+
+	// TTL is how long a proposed action waits for its second signature.
+	TTL Duration `toml:"ttl"`
+}
+
+// Balance configures the checks on the custodian's spare lumens:
+// its Stellar balance beyond its account reserve
+// and the lumens it holds for pegged-in value.
+type Balance struct {
+	// MinSpare is the spare balance, in stroops,
+	// below which new peg-ins are refused,
+	// beyond the cost of the peg-out each will eventually need.
+	MinSpare int64 `toml:"min_spare" reload:"true"`
+
+	// AlertThresholds are spare balances, in stroops,
+	// each raising an alert when the balance falls below it.
+	AlertThresholds []int64 `toml:"alert_thresholds" reload:"true"`
+
+	// AlertValues are like AlertThresholds
+	// but in base units of oracle.currency,
+	// raising an alert when the spare balance is worth less.
+	AlertValues []int64 `toml:"alert_values" reload:"true"`
+
+	// CheckInterval is how often the spare balance is checked.
+	CheckInterval Duration `toml:"check_interval"`
+
+	// TopUp, on a test network, requests friendbot lumens
+	// whenever the spare balance falls below min_spare or an alert threshold.
+	TopUp bool `toml:"top_up"`
+}
+
+// Clawback configures the detection of clawbacks
+// of pegged credit assets from the custodian account by their issuers,
+// and what is done about the slidechain value they backed.
+type Clawback struct {
+	// CheckInterval is how often the custodian's balance of each pegged asset
+	// is compared with the value pegged in and not out.
+	// Zero means never.
+	CheckInterval Duration `toml:"check_interval"`
+
+	// Policy is "alert", "freeze", or "clawback".
+	// Every clawback is recorded and alerted;
+	// with "freeze", the balance of the imported asset held by the recipient
+	// of the clawed-back peg-in is frozen;
+	// with "clawback", it is retired from the recipient's delegated outputs,
+	// where version 3 of the import-issuance contract imports to,
+	// and whatever cannot be retired is frozen.
+	Policy string `toml:"policy" reload:"true"`
+}
+
+// ExportTemplates configures the custodian's validation and countersignature
+// of export txs built by custodial integrators.
+type ExportTemplates struct {
+	// Enabled turns on /export-template.
+	Enabled bool `toml:"enabled"`
+
+	// MaxAmounts are the largest exports, in base units,
+	// that the custodian countersigns,
+	// in the form "ASSET=AMOUNT" with ASSET as in assets.allowlist.
+	// Exports of other assets are not limited.
+	MaxAmounts []string `toml:"max_amounts" reload:"true"`
+}
+
+// Consolidation configures the merging of small outputs
+// of users who delegate it to the custodian.
+type Consolidation struct {
+	// Interval is how often outputs are consolidated.
+	// Zero means never, and turns off /consolidation.
+	Interval Duration `toml:"interval"`
+
+	// MinOutputs is how many delegated outputs of one asset
+	// a user must have before they are consolidated.
+	MinOutputs int `toml:"min_outputs" reload:"true"`
+
+	// MaxInputs is the most outputs merged by one tx,
+	// the smallest first.
+	MaxInputs int `toml:"max_inputs" reload:"true"`
+}
+
+// DepositNonces configures the single-use peg-in memos
+// that the custodian issues to depositors.
+type DepositNonces struct {
+	// TTL is how long an issued memo may be paid.
+	// Zero turns off /deposit-nonce.
+	TTL Duration `toml:"ttl"`
+}
+
+// SLO configures the peg latency targets
+// that /admin/slo reports each day against.
+type SLO struct {
+	// ImportP99 is the most time from seeing a deposit
+	// to its import that 99% of a day's peg-ins may take.
+	// Zero means no target.
+	ImportP99 Duration `toml:"import_p99" reload:"true"`
+
+	// ExportP99 is the most time from seeing a retirement
+	// to its peg-out that 99% of a day's exports may take.
+	// Zero means no target.
+	ExportP99 Duration `toml:"export_p99" reload:"true"`
+}
+
+// Tenants configures the further pegs that one slidechaind process serves
+// alongside the one this config describes.
+type Tenants struct {
+	// Configs are the pegs' config files, in the form "NAME=FILE".
+	// Each peg's API is served under /NAME/ on this config's addr,
+	// and its admin API under /NAME/ on admin.addr.
+	Configs []string `toml:"configs"`
+}
+
+// Secrets configures where the values of secret settings are kept.
+// A secret setting, or the KEY of a NAME=KEY entry of one,
+// of the form SCHEME:REF is a reference,
+// replaced by ResolveSecrets with the secret it refers to:
+// env:NAME, file:PATH, vault:PATH#FIELD,
+// aws-sm:ID or aws-sm:ID#FIELD, and gcp-sm:NAME or gcp-sm:NAME#FIELD
+// (see package secret).
+type Secrets struct {
+	// RefreshInterval is how often the config is reloaded,
+	// resolving its references again
+	// so that rotated values of reloadable settings take effect.
+	// Zero means only on SIGHUP or /admin/reload.
+	RefreshInterval Duration `toml:"refresh_interval"`
+
+	// VaultAddr is the base URL of the Vault server for vault: references.
+	VaultAddr string `toml:"vault_addr"`
+
+	// VaultTokenFile is the file holding the Vault token,
+	// read on each lookup.
+	// If empty, the token is $VAULT_TOKEN.
+	VaultTokenFile string `toml:"vault_token_file"`
+
+	// AWSRegion is the region of the AWS Secrets Manager for aws-sm: references.
+	AWSRegion string `toml:"aws_region"`
+}
+
+// Providers returns the secret providers of the configured schemes.
+// The env, file, and gcp-sm schemes are always available;
+// vault requires vault_addr, and aws-sm aws_region.
+func (s Secrets) Providers(lookup func(string) (string, bool)) secret.Schemes {
+	p := secret.Schemes{
+		"env":    secret.Env{Lookup: lookup},
+		"file":   secret.File{},
+		"gcp-sm": new(secret.GCPSecretManager),
+	}
+	if s.VaultAddr != "" {
+		token, _ := lookup("VAULT_TOKEN")
+		p["vault"] = &secret.Vault{Addr: s.VaultAddr, Token: token, TokenFile: s.VaultTokenFile}
+	}
+	if s.AWSRegion != "" {
+		p["aws-sm"] = &secret.AWSSecretsManager{Region: s.AWSRegion, Lookup: lookup}
+	}
+	return p
+}
+
+// ResolveSecrets replaces each reference among the secret settings of cfg
+// with the secret it refers to in p.
+func ResolveSecrets(ctx context.Context, cfg *Config, p secret.Schemes) error {
+	for _, f := range fields(cfg) {
+		if !f.secret {
+			continue
+		}
+		switch f.v.Kind() {
+		case reflect.String:
+			if !p.IsRef(f.v.String()) {
+				continue
+			}
+			s, err := p.Secret(ctx, f.v.String())
+			if err != nil {
+				return errors.Wrapf(err, "resolving %s", f.key)
+			}
+			f.v.SetString(s)
+		case reflect.Slice:
+			for i := 0; i < f.v.Len(); i++ {
+				entry := f.v.Index(i)
+				name, ref := SplitNamed(entry.String())
+				if name == "" || !p.IsRef(ref) {
+					continue
+				}
+				s, err := p.Secret(ctx, ref)
+				if err != nil {
+					return errors.Wrapf(err, "resolving %s of %s", name, f.key)
+				}
+				entry.SetString(name + "=" + s)
+			}
+		}
+	}
+	return nil
+}
+
+// Oracle configures the pricing of assets in a reference currency,
+// in which kyc.limits and balance.alert_values may be given
+// and /admin/valuation reports.
+type Oracle struct {
+	// Currency is the reference currency, as in assets.allowlist.
+	// If empty, assets are not priced.
+	Currency string `toml:"currency"`
+
+	// Source is "dex", pricing assets at the mid-price
+	// of their Stellar DEX order books against currency,
+	// falling back to rates,
+	// or "static", pricing them only at rates.
+	Source string `toml:"source"`
+
+	// Rates are fixed prices in currency,
+	// in the form "ASSET=PRICE" with ASSET as in assets.allowlist
+	// and PRICE a decimal or fraction, such as 0.25 or 1/4.
+	Rates []string `toml:"rates" reload:"true"`
+
+	// TTL is how long a DEX price is reused.
+	TTL Duration `toml:"ttl"`
+}
+
+// Rebalance configures /admin/rebalance,
+// which converts the custodian's surplus reserves
+// from one asset to another on the Stellar DEX.
+type Rebalance struct {
+	// Enabled allows rebalancing.
+	Enabled bool `toml:"enabled" reload:"true"`
+
+	// MaxSlippage is the most, as a fraction,
+	// by which the value of the most a rebalance may sell
+	// may exceed the value of what it buys,
+	// when the oracle prices both.
+	MaxSlippage float64 `toml:"max_slippage" reload:"true"`
+}
+
+// ValueAsset is the asset of a kyc.limits entry
+// limiting the value of every asset together, priced by the oracle.
+const ValueAsset = "value"
+
+// KYCLimit is a parsed entry of kyc.limits.
+// Daily or Monthly is negative for no limit.
+type KYCLimit struct {
+	Tier, Direction, Asset string
+	Daily, Monthly         int64
+}
+
+// ParseKYCLimit parses an entry of kyc.limits.
+func ParseKYCLimit(s string) (KYCLimit, error) {
+	var l KYCLimit
+	key, amounts := SplitNamed(s)
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return l, fmt.Errorf("%q is not TIER:DIRECTION:ASSET=DAILY,MONTHLY", s)
+	}
+	l.Tier, l.Direction, l.Asset = parts[0], parts[1], parts[2]
+	if l.Direction != "import" && l.Direction != "export" {
+		return l, fmt.Errorf("%q: direction must be import or export", s)
+	}
+	windows := strings.Split(amounts, ",")
+	if len(windows) != 2 {
+		return l, fmt.Errorf("%q is not TIER:DIRECTION:ASSET=DAILY,MONTHLY", s)
+	}
+	for i, dst := range []*int64{&l.Daily, &l.Monthly} {
+		if windows[i] == "" {
+			*dst = -1
+			continue
+		}
+		n, err := strconv.ParseInt(windows[i], 10, 64)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("%q: limit %q is not a nonnegative integer", s, windows[i])
+		}
+		*dst = n
+	}
+	return l, nil
+}
+
+// Duration is a time.Duration that is written and parsed
+// in the form accepted by time.ParseDuration.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Default returns the configuration used when no file
+// or environment overrides are given.
+func Default() *Config {
+	return &Config{
+		Addr:          "localhost:2423",
+		DB:            "slidechain.db",
+		BlockInterval: Duration(5 * time.Second),
+		Horizon: Horizon{
+			URL:           "https://horizon-testnet.stellar.org",
+			FriendbotURL:  stellar.TestnetFriendbot,
+			ProbeInterval: Duration(30 * time.Second),
+		},
+		Custodian: Custodian{
+			IssuanceVersion: 1,
+		},
+		Assets: Assets{
+			CapAction: "hold",
+		},
+		Admin: Admin{
+			PauseFile: "slidechain.pause",
+		},
+		Governance: Governance{
+			TTL: Duration(time.Hour),
+		},
+		Balance: Balance{
+			CheckInterval: Duration(time.Minute),
+		},
+		Oracle: Oracle{
+			Source: "dex",
+			TTL:    Duration(time.Minute),
+		},
+		Rebalance: Rebalance{
+			MaxSlippage: 0.02,
+		},
+		Clawback: Clawback{
+			Policy: "alert",
+		},
+		Consolidation: Consolidation{
+			MinOutputs: 10,
+			MaxInputs:  50,
+		},
+		Log: Log{
+			Level: "info",
+		},
+		AntiSpam: AntiSpam{
+			WorkBits: 20,
+		},
+		Issuer: Issuer{
+			ReconcileInterval: Duration(10 * time.Minute),
+		},
+		PegOut: PegOut{
+			StuckAfter:        Duration(10 * time.Minute),
+			CheckInterval:     Duration(time.Minute),
+			DestinationPolicy: "denylist",
+			FederationTTL:     Duration(10 * time.Minute),
+			MissingTrustline:  "refund",
+			Scanner:           "internal",
+		},
+		EVM: EVM{
+			Confirmations: 12,
+			GasLimit:      200000,
+		},
+	}
+}
+
+// Load reads the TOML file at path and applies its settings on top of cfg.
+// Keys in the file that do not correspond to a config field are an error.
+func Load(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening config file")
+	}
+	defer f.Close()
+	err = Parse(cfg, f)
+	return errors.Wrapf(err, "loading %s", path)
+}
+
+// Parse reads TOML from r and applies its settings on top of cfg.
+func Parse(cfg *Config, r io.Reader) error {
+	vals, err := parseTOML(r)
+	if err != nil {
+		return err
+	}
+	fields := fieldMap(cfg)
+	for key, val := range vals {
+		f, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown config key %s", key)
+		}
+		err = setField(f.v, val)
+		if err != nil {
+			return errors.Wrapf(err, "setting %s", key)
+		}
+	}
+	return nil
+}
+
+// ApplyEnv overrides settings in cfg from environment variables,
+// as returned by lookup (normally os.LookupEnv).
+// List-valued settings are given as comma-separated values.
+func ApplyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	for _, f := range fields(cfg) {
+		name := EnvName(f.key)
+		s, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		var val interface{} = s
+		if f.v.Kind() == reflect.Slice {
+			val = splitList(s)
+		}
+		err := setField(f.v, val)
+		if err != nil {
+			return errors.Wrapf(err, "setting %s from %s", f.key, name)
+		}
+	}
+	return nil
+}
+
+// EnvName returns the name of the environment variable
+// that overrides the config key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Validate checks that cfg is usable,
+// returning an error describing every problem found.
+func (cfg *Config) Validate() error {
+	var problems []string
+	if cfg.Addr == "" {
+		problems = append(problems, "addr missing")
+	}
+	if cfg.DB == "" {
+		problems = append(problems, "db missing")
+	}
+	if cfg.BlockInterval <= 0 {
+		problems = append(problems, "block_interval must be positive")
+	}
+	if cfg.Horizon.URL == "" {
+		problems = append(problems, "horizon.url missing")
+	} else if u, err := url.Parse(cfg.Horizon.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("horizon.url %q is not an http(s) URL", cfg.Horizon.URL))
+	}
+	if cfg.Horizon.FriendbotURL != "" {
+		if u, err := url.Parse(cfg.Horizon.FriendbotURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("horizon.friendbot_url %q is not an http(s) URL", cfg.Horizon.FriendbotURL))
+		}
+	}
+	problems = append(problems, cfg.Horizon.problems()...)
+	if cfg.Custodian.IssuanceVersion < 1 {
+		problems = append(problems, "custodian.issuance_version must be positive")
+	}
+	problems = append(problems, cfg.Custodian.problems()...)
+	if cfg.Log.Level != "info" && cfg.Log.Level != "debug" {
+		problems = append(problems, fmt.Sprintf("log.level %q must be info or debug", cfg.Log.Level))
+	}
+	problems = append(problems, cfg.RateLimit.problems()...)
+	problems = append(problems, cfg.API.problems()...)
+	problems = append(problems, cfg.PartnerFees.problems()...)
+	for _, a := range cfg.Assets.Allowlist {
+		if _, err := stellar.ParseAssetKey(a); err != nil {
+			problems = append(problems, fmt.Sprintf("assets.allowlist: %s", err))
+		}
+	}
+	if a := cfg.Assets.CapAction; a != "hold" && a != "refund" {
+		problems = append(problems, fmt.Sprintf("assets.cap_action %q must be hold or refund", a))
+	}
+	if cfg.PegIn.IntentTTL < 0 {
+		problems = append(problems, "pegin.intent_ttl must not be negative")
+	}
+	if cfg.PegOut.StuckAfter <= 0 {
+		problems = append(problems, "pegout.stuck_after must be positive")
+	}
+	if cfg.PegOut.CheckInterval <= 0 {
+		problems = append(problems, "pegout.check_interval must be positive")
+	}
+	if p := cfg.PegOut.DestinationPolicy; p != "denylist" && p != "allowlist" {
+		problems = append(problems, fmt.Sprintf("pegout.destination_policy %q must be denylist or allowlist", p))
+	}
+	if m := cfg.PegOut.MissingTrustline; m != "refund" && m != "hold" {
+		problems = append(problems, fmt.Sprintf("pegout.missing_trustline %q must be refund or hold", m))
+	}
+	if s := cfg.PegOut.Scanner; s != "internal" && s != "external" {
+		problems = append(problems, fmt.Sprintf("pegout.scanner %q must be internal or external", s))
+	}
+	if cfg.PegOut.NetMin < 0 {
+		problems = append(problems, "pegout.net_min must not be negative")
+	}
+	if cfg.PegOut.MinSeqAge < 0 {
+		problems = append(problems, "pegout.min_seq_age must not be negative")
+	}
+	if cfg.PegOut.MaxLedgers < 0 {
+		problems = append(problems, "pegout.max_ledgers must not be negative")
+	}
+	shards := make(map[string]bool)
+	for _, sh := range cfg.PegOut.Shards {
+		asset, rate := SplitNamed(sh)
+		if asset == "" {
+			asset, rate = sh, "0"
+		}
+		if _, err := stellar.ParseAssetKey(asset); err != nil {
+			problems = append(problems, fmt.Sprintf("pegout.shards: %s", err))
+		} else if shards[asset] {
+			problems = append(problems, fmt.Sprintf("pegout.shards: %s has more than one shard", asset))
+		}
+		shards[asset] = true
+		if r, err := strconv.ParseFloat(rate, 64); err != nil || r < 0 {
+			problems = append(problems, fmt.Sprintf("pegout.shards: %q is not ASSET=RATE with a rate of at least 0", sh))
+		}
+	}
+	if cfg.PegOut.AuthorizationHook != "" {
+		if u, err := url.Parse(cfg.PegOut.AuthorizationHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("pegout.authorization_hook %q is not an http(s) URL", cfg.PegOut.AuthorizationHook))
+		}
+	}
+	if cfg.Issuer.Clawback && !cfg.Issuer.AuthRevocable {
+		problems = append(problems, "issuer.clawback requires issuer.auth_revocable")
+	}
+	if cfg.Issuer.Enabled && cfg.Issuer.ReconcileInterval <= 0 {
+		problems = append(problems, "issuer.reconcile_interval must be positive")
+	}
+	if cfg.Alert.WebhookURL != "" {
+		if u, err := url.Parse(cfg.Alert.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("alert.webhook_url %q is not an http(s) URL", cfg.Alert.WebhookURL))
+		}
+	}
+	if d := cfg.SEP1.HomeDomain; len(d) > 32 || strings.ContainsAny(d, "/: ") {
+		problems = append(problems, fmt.Sprintf("sep1.home_domain %q must be a domain name of at most 32 characters", d))
+	}
+	if cfg.SEP1.OrgURL != "" {
+		if u, err := url.Parse(cfg.SEP1.OrgURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("sep1.org_url %q is not an http(s) URL", cfg.SEP1.OrgURL))
+		}
+	}
+	if cfg.SLO.ImportP99 < 0 || cfg.SLO.ExportP99 < 0 {
+		problems = append(problems, "slo targets must not be negative")
+	}
+	if cfg.Checkpoint.Interval < 0 {
+		problems = append(problems, "checkpoint.interval must not be negative")
+	}
+	problems = append(problems, cfg.Validators.problems()...)
+	for _, s := range append([]string{cfg.Gossip.URL}, cfg.Gossip.Peers...) {
+		if u, err := url.Parse(s); s != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			problems = append(problems, fmt.Sprintf("gossip: %q is not an http(s) URL", s))
+		}
+	}
+	if cfg.Gossip.URL == "" && len(cfg.Gossip.Peers) > 0 {
+		problems = append(problems, "gossip.peers requires gossip.url")
+	}
+	problems = append(problems, cfg.Fees.problems()...)
+	problems = append(problems, cfg.AntiSpam.problems()...)
+	problems = append(problems, cfg.Notify.problems()...)
+	if cfg.Screening.URL != "" {
+		if u, err := url.Parse(cfg.Screening.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("screening.url %q is not an http(s) URL", cfg.Screening.URL))
+		}
+	} else if cfg.Screening.PegIns {
+		problems = append(problems, "screening.pegins requires screening.url")
+	}
+	problems = append(problems, cfg.SEP31.problems()...)
+	problems = append(problems, cfg.SEP12.problems()...)
+	if len(cfg.SEP12.Clients) > 0 {
+		if len(cfg.KYC.Tiers) == 0 {
+			problems = append(problems, "sep12.clients requires kyc.tiers")
+		} else if t := cfg.SEP12.Tier; t != "" {
+			found := false
+			for _, tier := range cfg.KYC.Tiers {
+				found = found || tier == t
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("sep12.tier %s is not in kyc.tiers", t))
+			}
+		}
+	}
+	problems = append(problems, cfg.TravelRule.problems()...)
+	problems = append(problems, cfg.KYC.problems()...)
+	problems = append(problems, cfg.Governance.problems()...)
+	problems = append(problems, cfg.Balance.problems()...)
+	problems = append(problems, cfg.Oracle.problems()...)
+	if cfg.Rebalance.MaxSlippage < 0 {
+		problems = append(problems, "rebalance.max_slippage must not be negative")
+	}
+	if cfg.Oracle.Currency == "" {
+		if len(cfg.Balance.AlertValues) > 0 {
+			problems = append(problems, "balance.alert_values requires oracle.currency")
+		}
+		for _, s := range cfg.KYC.Limits {
+			if l, err := ParseKYCLimit(s); err == nil && l.Asset == ValueAsset {
+				problems = append(problems, fmt.Sprintf("kyc.limits: %s requires oracle.currency", s))
+			}
+		}
+	}
+	for _, m := range cfg.ExportTemplates.MaxAmounts {
+		asset, amount := SplitNamed(m)
+		if n, err := strconv.ParseInt(amount, 10, 64); asset == "" || err != nil || n <= 0 {
+			problems = append(problems, fmt.Sprintf("export_templates.max_amounts: %q is not ASSET=AMOUNT with a positive amount", m))
+		}
+	}
+	if c := cfg.Consolidation; c.Interval < 0 {
+		problems = append(problems, "consolidation.interval must not be negative")
+	} else if c.Interval > 0 && (c.MinOutputs < 2 || c.MaxInputs < c.MinOutputs) {
+		problems = append(problems, fmt.Sprintf("consolidation.min_outputs %d must be at least 2 and at most consolidation.max_inputs %d", c.MinOutputs, c.MaxInputs))
+	}
+	if cfg.DepositNonces.TTL < 0 {
+		problems = append(problems, "deposit_nonces.ttl must not be negative")
+	}
+	problems = append(problems, cfg.Tenants.problems()...)
+	problems = append(problems, cfg.TLS.problems("tls")...)
+	problems = append(problems, cfg.Admin.TLS.problems("admin.tls")...)
+	if (cfg.PeerTLS.CertFile == "") != (cfg.PeerTLS.KeyFile == "") {
+		problems = append(problems, "peer_tls.cert_file and peer_tls.key_file must be set together")
+	}
+	if cfg.Secrets.RefreshInterval < 0 {
+		problems = append(problems, "secrets.refresh_interval must not be negative")
+	}
+	if cfg.Secrets.VaultAddr != "" {
+		if u, err := url.Parse(cfg.Secrets.VaultAddr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("secrets.vault_addr %q is not an http(s) URL", cfg.Secrets.VaultAddr))
+		}
+	}
+	if cfg.Balance.TopUp && cfg.Horizon.FriendbotURL == "" {
+		problems = append(problems, "balance.top_up requires horizon.friendbot_url")
+	}
+	switch cfg.Clawback.Policy {
+	case "alert", "freeze":
+	case "clawback":
+		if cfg.Custodian.IssuanceVersion < 3 {
+			problems = append(problems, "clawback.policy clawback requires custodian.issuance_version 3 or later")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("clawback.policy %q must be alert, freeze, or clawback", cfg.Clawback.Policy))
+	}
+	if cfg.Clawback.CheckInterval < 0 {
+		problems = append(problems, "clawback.check_interval must not be negative")
+	}
+	if cfg.EVM.RPCURL != "" {
+		problems = append(problems, cfg.EVM.problems()...)
+		if cfg.Checkpoint.Interval > 0 {
+			problems = append(problems, "checkpoint.interval requires Stellar as the main chain and must be zero with evm.rpc_url")
+		}
+		if len(cfg.Assets.Allowlist) > 0 {
+			problems = append(problems, "assets.allowlist lists Stellar assets and must be empty with evm.rpc_url")
+		}
+		if cfg.DepositAccounts.Enabled {
+			problems = append(problems, "deposit_accounts.enabled requires Stellar as the main chain")
+		}
+		if cfg.ExportTemplates.Enabled {
+			problems = append(problems, "export_templates.enabled requires Stellar as the main chain")
+		}
+		if cfg.PegOut.NetMin > 1 {
+			problems = append(problems, "pegout.net_min requires Stellar as the main chain")
+		}
+		if cfg.PegOut.MinSeqAge > 0 || cfg.PegOut.MaxLedgers > 0 {
+			problems = append(problems, "pegout.min_seq_age and pegout.max_ledgers require Stellar as the main chain")
+		}
+		if cfg.Issuer.Enabled {
+			problems = append(problems, "issuer.enabled requires Stellar as the main chain")
+		}
+		if cfg.PegOut.AuthorizationHook != "" || cfg.PegOut.AuthorizeTrustlines {
+			problems = append(problems, "pegout.authorization_hook and pegout.authorize_trustlines require Stellar as the main chain")
+		}
+		if cfg.DepositNonces.TTL > 0 {
+			problems = append(problems, "deposit_nonces.ttl requires Stellar as the main chain and must be zero with evm.rpc_url")
+		}
+		if len(cfg.SEP31.Assets) > 0 {
+			problems = append(problems, "sep31.assets requires Stellar as the main chain")
+		}
+		if cfg.Balance.TopUp {
+			problems = append(problems, "balance.top_up requires Stellar as the main chain")
+		}
+		if cfg.Rebalance.Enabled {
+			problems = append(problems, "rebalance.enabled requires Stellar as the main chain")
+		}
+		if cfg.Clawback.CheckInterval > 0 {
+			problems = append(problems, "clawback.check_interval requires Stellar as the main chain")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// problems lists what is wrong with the TLS section named key.
+func (t TLS) problems(key string) []string {
+	var problems []string
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		problems = append(problems, fmt.Sprintf("%s.cert_file and %s.key_file must be set together", key, key))
+	}
+	if t.ClientCAFile != "" && t.CertFile == "" {
+		problems = append(problems, fmt.Sprintf("%s.client_ca_file requires %s.cert_file", key, key))
+	}
+	return problems
+}
+
+// problems lists what is wrong with the tenants section.
+func (t Tenants) problems() []string {
+	var problems []string
+	names := make(map[string]bool)
+	for _, entry := range t.Configs {
+		name, file := SplitNamed(entry)
+		if name == "" || file == "" {
+			problems = append(problems, fmt.Sprintf("tenants.configs: %q is not NAME=FILE", entry))
+			continue
+		}
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			problems = append(problems, fmt.Sprintf("tenants.configs: name %q must be lower-case letters, digits, and hyphens", name))
+		}
+		if names[name] {
+			problems = append(problems, fmt.Sprintf("tenants.configs: duplicate tenant %s", name))
+		}
+		names[name] = true
+	}
+	return problems
+}
+
+// ValidateTenants checks that the pegs of root's tenants.configs,
+// loaded into tenants by name, can share a process with root:
+// each has its own db and custodian account,
+// and none has tenants of its own.
+func ValidateTenants(root *Config, tenants map[string]*Config) error {
+	var problems []string
+	dbs := map[string]string{root.DB: "the root config"}
+	seeds := make(map[string]string)
+	if root.Custodian.Seed != "" {
+		seeds[root.Custodian.Seed] = "the root config"
+	}
+	var names []string
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := tenants[name]
+		if other, ok := dbs[cfg.DB]; ok {
+			problems = append(problems, fmt.Sprintf("tenant %s: db %s is already used by %s", name, cfg.DB, other))
+		}
+		dbs[cfg.DB] = "tenant " + name
+		if cfg.Custodian.Seed != "" {
+			// Do not echo the seed.
+			if other, ok := seeds[cfg.Custodian.Seed]; ok {
+				problems = append(problems, fmt.Sprintf("tenant %s: custodian.seed is already used by %s", name, other))
+			}
+			seeds[cfg.Custodian.Seed] = "tenant " + name
+		}
+		if len(cfg.Tenants.Configs) > 0 {
+			problems = append(problems, fmt.Sprintf("tenant %s: tenants.configs must be empty", name))
+		}
+		if cfg.Log.Level != root.Log.Level {
+			problems = append(problems, fmt.Sprintf("tenant %s: log.level %q must match the root config's %q", name, cfg.Log.Level, root.Log.Level))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid tenants: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// problems lists what is wrong with the notify section.
+func (n Notify) problems() []string {
+	var problems []string
+	if (n.SMTPAddr == "") != (n.SMTPFrom == "") {
+		problems = append(problems, "notify.smtp_addr and notify.smtp_from must be set together")
+	}
+	seen := map[string]bool{"email": true}
+	for _, wh := range n.Webhooks {
+		name, u := SplitNamed(wh)
+		if name == "" || u == "" {
+			problems = append(problems, fmt.Sprintf("notify.webhooks: %q is not NAME=URL", wh))
+			continue
+		}
+		if seen[name] {
+			problems = append(problems, fmt.Sprintf("notify.webhooks: duplicate channel %s", name))
+		}
+		seen[name] = true
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			problems = append(problems, fmt.Sprintf("notify.webhooks: %q is not an http(s) URL", u))
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the balance section.
+func (b Balance) problems() []string {
+	var problems []string
+	if b.MinSpare < 0 {
+		problems = append(problems, "balance.min_spare must not be negative")
+	}
+	for _, t := range b.AlertThresholds {
+		if t <= 0 {
+			problems = append(problems, fmt.Sprintf("balance.alert_thresholds: %d is not positive", t))
+		}
+	}
+	for _, t := range b.AlertValues {
+		if t <= 0 {
+			problems = append(problems, fmt.Sprintf("balance.alert_values: %d is not positive", t))
+		}
+	}
+	if b.CheckInterval <= 0 {
+		problems = append(problems, "balance.check_interval must be positive")
+	}
+	return problems
+}
+
+// problems lists what is wrong with the oracle section.
+func (o Oracle) problems() []string {
+	var problems []string
+	if o.Currency != "" {
+		if _, err := stellar.ParseAssetKey(o.Currency); err != nil {
+			problems = append(problems, fmt.Sprintf("oracle.currency: %s", err))
+		}
+	}
+	if o.Source != "dex" && o.Source != "static" {
+		problems = append(problems, fmt.Sprintf("oracle.source %q must be dex or static", o.Source))
+	}
+	if _, err := oracle.ParseRates(o.Rates); err != nil {
+		problems = append(problems, fmt.Sprintf("oracle.rates: %s", err))
+	}
+	if o.TTL < 0 {
+		problems = append(problems, "oracle.ttl must not be negative")
+	}
+	return problems
+}
+
+// problems lists what is wrong with the ratelimit section.
+func (r RateLimit) problems() []string {
+	var problems []string
+	for _, t := range []struct {
+		prefix       string
+		rate         float64
+		burst, quota int64
+	}{
+		{"", r.Rate, r.Burst, r.Quota},
+		{"partner_", r.PartnerRate, r.PartnerBurst, r.PartnerQuota},
+		{"admin_", r.AdminRate, r.AdminBurst, r.AdminQuota},
+	} {
+		if t.rate < 0 {
+			problems = append(problems, fmt.Sprintf("ratelimit.%srate must not be negative", t.prefix))
+		}
+		if t.rate > 0 && t.burst < 1 {
+			problems = append(problems, fmt.Sprintf("ratelimit.%sburst must be at least 1 when ratelimit.%srate is set", t.prefix, t.prefix))
+		}
+		if t.quota < 0 {
+			problems = append(problems, fmt.Sprintf("ratelimit.%squota must not be negative", t.prefix))
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the expected signers and thresholds
+// of the custodian section.
+func (c Custodian) problems() []string {
+	var problems []string
+	signers := make(map[string]bool)
+	for _, entry := range c.Signers {
+		addr, weight := SplitNamed(entry)
+		if _, err := strkey.Decode(strkey.VersionByteAccountID, addr); err != nil {
+			problems = append(problems, fmt.Sprintf("custodian.signers: %q is not ADDRESS=WEIGHT with a Stellar account address", entry))
+			continue
+		}
+		if w, err := strconv.Atoi(weight); err != nil || w < 1 || w > 255 {
+			problems = append(problems, fmt.Sprintf("custodian.signers: %q must have a weight from 1 to 255", entry))
+		}
+		if signers[addr] {
+			problems = append(problems, fmt.Sprintf("custodian.signers: duplicate signer %s", addr))
+		}
+		signers[addr] = true
+	}
+	if n := len(c.Thresholds); n != 0 && n != 3 {
+		problems = append(problems, "custodian.thresholds must be empty or low, medium, and high")
+	}
+	for _, t := range c.Thresholds {
+		if t < 0 || t > 255 {
+			problems = append(problems, fmt.Sprintf("custodian.thresholds: %d is not from 0 to 255", t))
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the api section.
+func (a API) problems() []string {
+	var problems []string
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, l := range []struct {
+		key     string
+		entries []string
+	}{
+		{"api.partners", a.Partners},
+		{"api.admins", a.Admins},
+	} {
+		for _, entry := range l.entries {
+			// Do not echo the entry, which holds a secret.
+			name, key := SplitNamed(entry)
+			if name == "" || key == "" {
+				problems = append(problems, fmt.Sprintf("%s: an entry is not NAME=KEY", l.key))
+				continue
+			}
+			if names[name] {
+				problems = append(problems, fmt.Sprintf("%s: duplicate caller %s", l.key, name))
+			}
+			if keys[key] {
+				problems = append(problems, fmt.Sprintf("%s: the key of %s is already in use", l.key, name))
+			}
+			names[name] = true
+			keys[key] = true
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the partner_fees section.
+func (p PartnerFees) problems() []string {
+	var problems []string
+	schedules := make(map[string]bool)
+	for _, entry := range p.Schedules {
+		f, err := ParseFeeSchedule(entry)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("partner_fees.schedules: %s", err))
+			continue
+		}
+		if schedules[f.Name] {
+			problems = append(problems, fmt.Sprintf("partner_fees.schedules: duplicate schedule %s", f.Name))
+		}
+		schedules[f.Name] = true
+	}
+	partners := make(map[string]bool)
+	for _, entry := range p.Partners {
+		partner, sched := SplitNamed(entry)
+		if partner == "" || !schedules[sched] {
+			problems = append(problems, fmt.Sprintf("partner_fees.partners: %q is not PARTNER=SCHEDULE with a schedule in partner_fees.schedules", entry))
+			continue
+		}
+		if partners[partner] {
+			problems = append(problems, fmt.Sprintf("partner_fees.partners: duplicate partner %s", partner))
+		}
+		partners[partner] = true
+	}
+	if p.Default != "" && !schedules[p.Default] {
+		problems = append(problems, fmt.Sprintf("partner_fees.default %q is not in partner_fees.schedules", p.Default))
+	}
+	codes := make(map[string]bool)
+	for _, entry := range p.ReferralCodes {
+		code, partner := SplitNamed(entry)
+		if code == "" || partner == "" {
+			problems = append(problems, fmt.Sprintf("partner_fees.referral_codes: %q is not CODE=PARTNER", entry))
+			continue
+		}
+		if codes[code] {
+			problems = append(problems, fmt.Sprintf("partner_fees.referral_codes: duplicate code %s", code))
+		}
+		codes[code] = true
+	}
+	return problems
+}
+
+// problems lists what is wrong with the sep31 section.
+func (s SEP31) problems() []string {
+	var problems []string
+	for _, a := range s.Assets {
+		if _, err := stellar.ParseAssetKey(a); err != nil {
+			problems = append(problems, fmt.Sprintf("sep31.assets: %s", err))
+		}
+	}
+	names := make(map[string]bool)
+	for _, sender := range s.Senders {
+		// Do not echo the entry, which holds a secret.
+		name, key := SplitNamed(sender)
+		if name == "" || key == "" {
+			problems = append(problems, "sep31.senders: an entry is not NAME=KEY")
+			continue
+		}
+		if names[name] {
+			problems = append(problems, fmt.Sprintf("sep31.senders: duplicate sender %s", name))
+		}
+		names[name] = true
+	}
+	if len(s.Assets) > 0 && len(s.Senders) == 0 {
+		problems = append(problems, "sep31.assets requires sep31.senders")
+	}
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("sep31.url %q is not an http(s) URL", s.URL))
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the sep12 section.
+func (s SEP12) problems() []string {
+	var problems []string
+	names := make(map[string]bool)
+	for _, client := range s.Clients {
+		// Do not echo the entry, which holds a secret.
+		name, key := SplitNamed(client)
+		if name == "" || key == "" {
+			problems = append(problems, "sep12.clients: an entry is not NAME=KEY")
+			continue
+		}
+		if names[name] {
+			problems = append(problems, fmt.Sprintf("sep12.clients: duplicate client %s", name))
+		}
+		names[name] = true
+	}
+	for _, f := range s.Fields {
+		if f == "" || strings.Trim(f, "abcdefghijklmnopqrstuvwxyz_") != "" {
+			problems = append(problems, fmt.Sprintf("sep12.fields: %q is not a SEP-9 field name", f))
+		}
+	}
+	if len(s.Clients) > 0 {
+		// Do not echo the key.
+		if b, err := hex.DecodeString(s.Key); err != nil || len(b) != 32 {
+			problems = append(problems, "sep12.key must be 32 hex-encoded bytes")
+		}
+	}
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("sep12.url %q is not an http(s) URL", s.URL))
+		}
+	}
+	return problems
+}
+
+// SplitNamed splits a "NAME=VALUE" entry,
+// as in notify.webhooks, sep31.senders, and sep12.clients,
+// returning empty strings if it has no "=".
+func SplitNamed(s string) (name, value string) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// problems lists what is wrong with the travel_rule section.
+func (t TravelRule) problems() []string {
+	var problems []string
+	for _, th := range t.Thresholds {
+		asset, amount := SplitNamed(th)
+		if n, err := strconv.ParseInt(amount, 10, 64); asset == "" || err != nil || n <= 0 {
+			problems = append(problems, fmt.Sprintf("travel_rule.thresholds: %q is not ASSET=AMOUNT with a positive amount", th))
+		}
+	}
+	if t.Key != "" || len(t.Thresholds) > 0 {
+		// Do not echo the key.
+		if b, err := hex.DecodeString(t.Key); err != nil || len(b) != 32 {
+			problems = append(problems, "travel_rule.key must be 32 hex-encoded bytes")
+		}
+	}
+	return problems
+}
+
+// problems lists what is wrong with the kyc section.
+func (k KYC) problems() []string {
+	var problems []string
+	tiers := make(map[string]bool)
+	for _, t := range k.Tiers {
+		if t == "" || tiers[t] {
+			problems = append(problems, fmt.Sprintf("kyc.tiers: %q is empty or duplicated", t))
+		}
+		tiers[t] = true
+	}
+	for _, s := range k.Limits {
+		l, err := ParseKYCLimit(s)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("kyc.limits: %s", err))
+		} else if !tiers[l.Tier] {
+			problems = append(problems, fmt.Sprintf("kyc.limits: tier %s is not in kyc.tiers", l.Tier))
+		}
+	}
+	if len(k.Tiers) > 0 && k.APIKey == "" {
+		problems = append(problems, "kyc.tiers requires kyc.api_key")
+	}
+	return problems
+}
+
+// problems lists what is wrong with the governance section.
+func (g Governance) problems() []string {
+	var problems []string
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, op := range g.Operators {
+		name, key := SplitNamed(op)
+		if b, err := hex.DecodeString(key); name == "" || err != nil || len(b) != ed25519.PublicKeySize {
+			problems = append(problems, fmt.Sprintf("governance.operators: %q is not NAME=HEXPUBKEY", op))
+			continue
+		}
+		if names[name] || keys[strings.ToLower(key)] {
+			problems = append(problems, fmt.Sprintf("governance.operators: %s or its key is listed twice", name))
+		}
+		names[name] = true
+		keys[strings.ToLower(key)] = true
+	}
+	if len(g.Operators) == 1 {
+		problems = append(problems, "governance.operators must list at least two operators")
+	}
+	if len(g.Operators) > 0 && g.TTL <= 0 {
+		problems = append(problems, "governance.ttl must be positive")
+	}
+	return problems
+}
+
+// problems lists what is wrong with an EVM section that sets rpc_url.
+func (e EVM) problems() []string {
+	var problems []string
+	if u, err := url.Parse(e.RPCURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("evm.rpc_url %q is not an http(s) URL", e.RPCURL))
+	}
+	if _, err := evm.ParseAddress(e.Contract); err != nil {
+		problems = append(problems, fmt.Sprintf("evm.contract: %s", err))
+	}
+	if _, err := evm.ParseAddress(e.From); err != nil {
+		problems = append(problems, fmt.Sprintf("evm.from: %s", err))
+	}
+	if e.StartBlock < 0 {
+		problems = append(problems, "evm.start_block must not be negative")
+	}
+	if e.Confirmations < 1 {
+		problems = append(problems, "evm.confirmations must be at least 1")
+	}
+	if e.GasLimit <= 0 {
+		problems = append(problems, "evm.gas_limit must be positive")
+	}
+	if e.MaxGasPrice < 0 {
+		problems = append(problems, "evm.max_gas_price must not be negative")
+	}
+	return problems
+}
+
+// problems lists what is wrong with a Validators section.
+func (v Validators) problems() []string {
+	var problems []string
+	for _, pk := range v.Pubkeys {
+		if b, err := hex.DecodeString(pk); err != nil || len(b) != ed25519.PublicKeySize {
+			problems = append(problems, fmt.Sprintf("validators.pubkeys: %q is not a hex ed25519 public key", pk))
+		}
+	}
+	if len(v.URLs) != len(v.Pubkeys) {
+		problems = append(problems, fmt.Sprintf("validators.urls has %d entries for %d pubkeys", len(v.URLs), len(v.Pubkeys)))
+	}
+	for _, s := range v.URLs {
+		if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("validators.urls: %q is not an http(s) URL", s))
+		}
+	}
+	if len(v.Pubkeys) > 0 && (v.Quorum < 1 || v.Quorum > int64(len(v.Pubkeys))) {
+		problems = append(problems, fmt.Sprintf("validators.quorum must be between 1 and %d", len(v.Pubkeys)))
+	}
+	if len(v.Pubkeys) == 0 && v.Quorum != 0 {
+		problems = append(problems, "validators.quorum must be zero with no validators.pubkeys")
+	}
+	return problems
+}
+
+// problems lists what is wrong with the fees section.
+func (f Fees) problems() []string {
+	var problems []string
+	if f.Asset == "" {
+		if f.Collector != "" || f.Min != 0 || f.MaxBlockTxs != 0 {
+			problems = append(problems, "fees.collector, fees.min, and fees.max_block_txs require fees.asset")
+		}
+		return problems
+	}
+	if b, err := hex.DecodeString(f.Asset); err != nil || len(b) != 32 {
+		problems = append(problems, fmt.Sprintf("fees.asset %q is not a hex txvm asset ID", f.Asset))
+	}
+	if b, err := hex.DecodeString(f.Collector); err != nil || len(b) != ed25519.PublicKeySize {
+		problems = append(problems, fmt.Sprintf("fees.collector %q is not a hex ed25519 public key", f.Collector))
+	}
+	if f.Min < 0 {
+		problems = append(problems, "fees.min must not be negative")
+	}
+	if f.MaxBlockTxs < 0 {
+		problems = append(problems, "fees.max_block_txs must not be negative")
+	}
+	return problems
+}
+
+// problems lists what is wrong with the antispam section.
+func (a AntiSpam) problems() []string {
+	var problems []string
+	switch a.Mode {
+	case "":
+	case "pow":
+		if a.WorkBits < 1 || a.WorkBits > 64 {
+			problems = append(problems, "antispam.work_bits must be between 1 and 64")
+		}
+	case "stake":
+		if b, err := hex.DecodeString(a.StakeAsset); err != nil || len(b) != 32 {
+			problems = append(problems, fmt.Sprintf("antispam.stake_asset %q is not a hex txvm asset ID", a.StakeAsset))
+		}
+		if a.StakeMin < 1 {
+			problems = append(problems, "antispam.stake_min must be positive")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("antispam.mode %q must be pow, stake, or empty", a.Mode))
+	}
+	return problems
+}
+
+// Features lists the optional capabilities cfg enables,
+// by the names of their config sections, in a fixed order.
+func (cfg *Config) Features() []string {
+	var features []string
+	add := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	add(cfg.EVM.RPCURL != "", "evm")
+	add(len(cfg.Assets.Allowlist) > 0, "assets")
+	add(cfg.Admin.Addr != "", "admin")
+	add(len(cfg.API.Partners) > 0 || len(cfg.API.Admins) > 0, "api")
+	add(cfg.Alert.WebhookURL != "", "alert")
+	add(cfg.SEP1.HomeDomain != "", "sep1")
+	add(cfg.Issuer.Enabled, "issuer")
+	add(cfg.Checkpoint.Interval > 0, "checkpoint")
+	add(len(cfg.Validators.Pubkeys) > 0, "validators")
+	add(cfg.Gossip.URL != "", "gossip")
+	add(cfg.Fees.Asset != "", "fees")
+	add(cfg.AntiSpam.Mode != "", "antispam")
+	add(cfg.DepositAccounts.Enabled, "deposit_accounts")
+	add(cfg.Notify.SMTPAddr != "" || len(cfg.Notify.Webhooks) > 0, "notify")
+	add(cfg.Screening.URL != "", "screening")
+	add(len(cfg.SEP31.Assets) > 0, "sep31")
+	add(len(cfg.SEP12.Clients) > 0, "sep12")
+	add(cfg.TravelRule.Key != "", "travel_rule")
+	add(len(cfg.KYC.Tiers) > 0, "kyc")
+	add(len(cfg.Governance.Operators) > 0, "governance")
+	add(cfg.Balance.TopUp, "balance")
+	add(cfg.Clawback.CheckInterval > 0, "clawback")
+	add(cfg.ExportTemplates.Enabled, "export_templates")
+	add(cfg.Consolidation.Interval > 0, "consolidation")
+	add(cfg.DepositNonces.TTL > 0, "deposit_nonces")
+	add(len(cfg.Tenants.Configs) > 0, "tenants")
+	add(cfg.TLS.CertFile != "" || cfg.Admin.TLS.CertFile != "", "tls")
+	add(cfg.PeerTLS.CAFile != "" || cfg.PeerTLS.CertFile != "", "peer_tls")
+	add(cfg.Oracle.Currency != "", "oracle")
+	add(len(cfg.PartnerFees.Schedules) > 0 || len(cfg.PartnerFees.ReferralCodes) > 0, "partner_fees")
+	add(cfg.Secrets.RefreshInterval > 0 || cfg.Secrets.VaultAddr != "" || cfg.Secrets.AWSRegion != "", "secrets")
+	return features
+}
+
+// WriteEffective writes cfg to w in TOML form,
+// replacing the values of secret settings with "REDACTED".
+func (cfg *Config) WriteEffective(w io.Writer) error {
+	var (
+		section string
+		err     error
+	)
+	for _, f := range fields(cfg) {
+		sec, name := "", f.key
+		if i := strings.LastIndex(f.key, "."); i >= 0 {
+			sec, name = f.key[:i], f.key[i+1:]
+		}
+		if sec != section {
+			_, err = fmt.Fprintf(w, "\n[%s]\n", sec)
+			if err != nil {
+				return err
+			}
+			section = sec
+		}
+		val := formatValue(f.v)
+		if f.secret && !isZero(f.v) {
+			val = strconv.Quote("REDACTED")
+		}
+		_, err = fmt.Fprintf(w, "%s = %s\n", name, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Change describes a setting that differs between two configs.
+type Change struct {
+	Key        string
+	Old, New   string // formatted as in WriteEffective, with secrets redacted
+	Reloadable bool
+}
+
+func (ch Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", ch.Key, ch.Old, ch.New)
+}
+
+// Changes lists the settings that differ between old and new.
+func Changes(old, new *Config) []Change {
+	var (
+		changes []Change
+		newf    = fieldMap(new)
+	)
+	for _, f := range fields(old) {
+		nf := newf[f.key]
+		if reflect.DeepEqual(f.v.Interface(), nf.v.Interface()) {
+			continue
+		}
+		ch := Change{
+			Key:        f.key,
+			Old:        formatValue(f.v),
+			New:        formatValue(nf.v),
+			Reloadable: f.reload,
+		}
+		if f.secret {
+			ch.Old, ch.New = strconv.Quote("REDACTED"), strconv.Quote("REDACTED")
+		}
+		changes = append(changes, ch)
+	}
+	return changes
+}
+
+// ApplyReloadable copies the reloadable settings of src into dst,
+// leaving the others alone.
+func ApplyReloadable(dst, src *Config) {
+	srcf := fieldMap(src)
+	for _, f := range fields(dst) {
+		if f.reload {
+			f.v.Set(srcf[f.key].v)
+		}
+	}
+}
+
+type field struct {
+	key    string
+	v      reflect.Value
+	secret bool
+	reload bool
+}
+
+// fields returns the settable leaf fields of cfg in declaration order,
+// with top-level settings before any section.
+func fields(cfg *Config) []field {
+	var top, sections []field
+	walk(reflect.ValueOf(cfg).Elem(), "", &top, &sections)
+	return append(top, sections...)
+}
+
+func walk(v reflect.Value, prefix string, top, sections *[]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Tag.Get("toml")
+		if name == "" {
+			continue
+		}
+		key := prefix + name
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			walk(fv, key+".", sections, sections)
+			continue
+		}
+		*top = append(*top, field{
+			key:    key,
+			v:      fv,
+			secret: sf.Tag.Get("secret") == "true",
+			reload: sf.Tag.Get("reload") == "true",
+		})
+	}
+}
+
+func fieldMap(cfg *Config) map[string]field {
+	m := make(map[string]field)
+	for _, f := range fields(cfg) {
+		m[f.key] = f
+	}
+	return m
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// setField sets v from val,
+// which is a string for scalar settings
+// and a []string for list settings.
+func setField(v reflect.Value, val interface{}) error {
+	if v.Kind() == reflect.Slice {
+		list, ok := val.([]string)
+		if !ok {
+			return fmt.Errorf("want a list, got %v", val)
+		}
+		out := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, s := range list {
+			err := setField(out.Index(i), s)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(out)
+		return nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return fmt.Errorf("want a single value, got a list")
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return strconv.Quote(Duration(v.Int()).String())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		var items []string
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, formatValue(v.Index(i)))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
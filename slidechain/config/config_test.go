@@ -0,0 +1,274 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	const src = `
+# slidechaind config
+addr = "0.0.0.0:2423" # public listener
+block_interval = "2s"
+
+[horizon]
+url = 'http://localhost:8000'
+
+[custodian]
+seed = "SEEDSEED"
+`
+	cfg := Default()
+	err := Parse(cfg, strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "0.0.0.0:2423" {
+		t.Errorf("got addr %q, want 0.0.0.0:2423", cfg.Addr)
+	}
+	if cfg.DB != "slidechain.db" {
+		t.Errorf("got db %q, want default slidechain.db", cfg.DB)
+	}
+	if time.Duration(cfg.BlockInterval) != 2*time.Second {
+		t.Errorf("got block_interval %s, want 2s", cfg.BlockInterval)
+	}
+	if cfg.Horizon.URL != "http://localhost:8000" {
+		t.Errorf("got horizon.url %q, want http://localhost:8000", cfg.Horizon.URL)
+	}
+	if cfg.Custodian.Seed != "SEEDSEED" {
+		t.Errorf("got custodian.seed %q, want SEEDSEED", cfg.Custodian.Seed)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"bogus = 1", "unknown config key bogus"},
+		{"[horizon]\nurl", "expected key = value"},
+		{"block_interval = \"soon\"", "setting block_interval"},
+		{"addr = \"a\"\naddr = \"b\"", "duplicate key addr"},
+		{"[horizon\nurl = \"x\"", "malformed section header"},
+	}
+	for _, c := range cases {
+		err := Parse(Default(), strings.NewReader(c.src))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Parse(%q): got error %v, want one containing %q", c.src, err, c.want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"SLIDECHAIN_HORIZON_URL":    "https://horizon.stellar.org",
+		"SLIDECHAIN_BLOCK_INTERVAL": "10s",
+	}
+	cfg := Default()
+	err := ApplyEnv(cfg, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Horizon.URL != "https://horizon.stellar.org" {
+		t.Errorf("got horizon.url %q", cfg.Horizon.URL)
+	}
+	if time.Duration(cfg.BlockInterval) != 10*time.Second {
+		t.Errorf("got block_interval %s, want 10s", cfg.BlockInterval)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	cfg := Default()
+	if got := cfg.Features(); len(got) != 0 {
+		t.Errorf("default config enables %v", got)
+	}
+	cfg.KYC.Tiers = []string{"basic=1000"}
+	cfg.EVM.RPCURL = "http://localhost:8545"
+	cfg.DepositAccounts.Enabled = true
+	want := []string{"evm", "deposit_accounts", "kyc"}
+	if got := cfg.Features(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got features %v, want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config is invalid: %s", err)
+	}
+	cfg.Horizon.URL = ""
+	cfg.BlockInterval = 0
+	cfg.PegOut.StuckAfter = 0
+	cfg.EVM.RPCURL = "http://localhost:8545"
+	cfg.EVM.Contract = "0x1234"
+	cfg.Validators.Pubkeys = []string{"1234"}
+	cfg.Validators.Quorum = 2
+	cfg.Notify.Webhooks = []string{"sms=ftp://gateway", "push"}
+	cfg.Screening.PegIns = true
+	cfg.SEP31.Assets = []string{"native"}
+	cfg.SEP12.Clients = []string{"wallet=k"}
+	cfg.SEP12.Tier = "gold"
+	cfg.PegOut.DestinationPolicy = "none"
+	cfg.PegOut.NetMin = -1
+	cfg.PegOut.MinSeqAge = -1
+	cfg.PegOut.MaxLedgers = 10
+	cfg.PegOut.Shards = []string{"native=fast", "native"}
+	cfg.PegOut.AuthorizationHook = "issuer.example"
+	cfg.Issuer.Enabled = true
+	cfg.Issuer.Clawback = true
+	cfg.Issuer.ReconcileInterval = 0
+	cfg.Clawback.Policy = "confiscate"
+	cfg.Clawback.CheckInterval = -1
+	cfg.Fees.Asset = "00"
+	cfg.Fees.Min = -1
+	cfg.AntiSpam.Mode = "captcha"
+	cfg.TravelRule.Thresholds = []string{"native"}
+	cfg.KYC.Tiers = []string{"basic"}
+	cfg.KYC.Limits = []string{"gold:export:native=1,2", "basic:sideways:native=1,2"}
+	cfg.Governance.Operators = []string{"alice=zz"}
+	cfg.Balance.AlertThresholds = []int64{0}
+	cfg.Balance.TopUp = true
+	cfg.RateLimit.PartnerRate = 1
+	cfg.API.Partners = []string{"acme=k"}
+	cfg.API.Admins = []string{"ops=k"}
+	cfg.Tenants.Configs = []string{"Testnet=testnet.toml", "pubnet"}
+	cfg.TLS.CertFile = "cert.pem"
+	cfg.Admin.TLS.ClientCAFile = "ca.pem"
+	cfg.Custodian.Signers = []string{"GXYZ=1"}
+	cfg.Custodian.Thresholds = []int64{1, 2}
+	cfg.Horizon.Endpoints = []string{"eu=ftp://horizon.eu"}
+	cfg.PartnerFees.Schedules = []string{"standard=25/10", "steep=25/20000"}
+	cfg.PartnerFees.Partners = []string{"acme=gold"}
+	cfg.PartnerFees.ReferralCodes = []string{"WELCOME"}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("got no error validating bad config")
+	}
+	for _, want := range []string{"horizon.url missing", "block_interval must be positive", "pegout.stuck_after must be positive", "evm.contract", "evm.from", "validators.pubkeys", "validators.urls", "validators.quorum", "notify.webhooks: \"ftp://gateway\"", "notify.webhooks: \"push\"", "screening.pegins requires screening.url", "sep31.assets requires sep31.senders", "sep31.assets requires Stellar", "sep12.key must be 32", "sep12.tier gold is not in kyc.tiers", "pegout.destination_policy", "pegout.net_min must not be negative", "pegout.min_seq_age must not be negative", "pegout.min_seq_age and pegout.max_ledgers require Stellar", `pegout.shards: "native=fast"`, "native has more than one shard", "pegout.authorization_hook \"issuer.example\" is not", "pegout.authorization_hook and pegout.authorize_trustlines require Stellar", "issuer.clawback requires issuer.auth_revocable", "issuer.reconcile_interval must be positive", "issuer.enabled requires Stellar", "clawback.policy \"confiscate\" must be", "clawback.check_interval must not be negative", "fees.asset \"00\" is not a hex txvm asset ID", "fees.collector", "fees.min must not be negative", "antispam.mode \"captcha\"", "travel_rule.thresholds", "travel_rule.key", "tier gold is not in kyc.tiers", "direction must be import or export", "kyc.tiers requires kyc.api_key", "governance.operators: \"alice=zz\"", "at least two operators", "balance.alert_thresholds: 0", "balance.top_up requires Stellar", "ratelimit.partner_burst must be at least 1", "api.admins: the key of ops is already in use", `name "Testnet" must be lower-case`, `"pubnet" is not NAME=FILE`, "tls.cert_file and tls.key_file must be set together", "admin.tls.client_ca_file requires admin.tls.cert_file", `custodian.signers: "GXYZ=1"`, "custodian.thresholds must be empty", "horizon.region must be set", `horizon.endpoints: "ftp://horizon.eu"`, `"20000" is not between 0 and 10000`, `partner_fees.partners: "acme=gold"`, `partner_fees.referral_codes: "WELCOME"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %q, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	root := Default()
+	root.Custodian.Seed = "SROOT"
+	testnet, pubnet := Default(), Default()
+	testnet.DB = "testnet.db"
+	pubnet.DB = "pubnet.db"
+	pubnet.Custodian.Seed = "SPUBNET"
+	if err := ValidateTenants(root, map[string]*Config{"testnet": testnet, "pubnet": pubnet}); err != nil {
+		t.Fatalf("got error %q validating distinct tenants", err)
+	}
+
+	pubnet.DB = testnet.DB
+	pubnet.Custodian.Seed = root.Custodian.Seed
+	pubnet.Tenants.Configs = []string{"more=more.toml"}
+	testnet.Log.Level = "debug"
+	err := ValidateTenants(root, map[string]*Config{"testnet": testnet, "pubnet": pubnet})
+	if err == nil {
+		t.Fatal("got no error validating overlapping tenants")
+	}
+	for _, want := range []string{"tenant testnet: db testnet.db is already used by tenant pubnet", "custodian.seed is already used by the root config", "tenant pubnet: tenants.configs must be empty", "tenant testnet: log.level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %q, want it to mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "SROOT") {
+		t.Errorf("error %q echoes a seed", err)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	env := map[string]string{"SEED": "SABC", "ACME_KEY": "acme-key"}
+	lookup := func(name string) (string, bool) { v, ok := env[name]; return v, ok }
+	cfg := Default()
+	cfg.Custodian.Seed = "env:SEED"
+	cfg.API.Partners = []string{"acme=env:ACME_KEY", "other=literal"}
+	cfg.Horizon.URL = "env:SEED" // not a secret setting
+	err := ResolveSecrets(context.Background(), cfg, cfg.Secrets.Providers(lookup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Custodian.Seed != "SABC" {
+		t.Errorf("got custodian.seed %q, want SABC", cfg.Custodian.Seed)
+	}
+	if want := []string{"acme=acme-key", "other=literal"}; !reflect.DeepEqual(cfg.API.Partners, want) {
+		t.Errorf("got api.partners %v, want %v", cfg.API.Partners, want)
+	}
+	if cfg.Horizon.URL != "env:SEED" {
+		t.Errorf("resolved horizon.url to %q", cfg.Horizon.URL)
+	}
+
+	cfg.KYC.APIKey = "env:MISSING"
+	err = ResolveSecrets(context.Background(), cfg, cfg.Secrets.Providers(lookup))
+	if err == nil || !strings.Contains(err.Error(), "kyc.api_key") {
+		t.Errorf("got error %v resolving a missing secret, want it to mention kyc.api_key", err)
+	}
+}
+
+func TestWriteEffective(t *testing.T) {
+	cfg := Default()
+	cfg.Custodian.Seed = "SECRETSEED"
+	buf := new(bytes.Buffer)
+	err := cfg.WriteEffective(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "SECRETSEED") {
+		t.Errorf("secret leaked into effective config:\n%s", out)
+	}
+
+	// The output must round-trip.
+	got := Default()
+	err = Parse(got, strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("parsing effective config: %s\n%s", err, out)
+	}
+	if got.Addr != cfg.Addr || got.Horizon.URL != cfg.Horizon.URL || got.BlockInterval != cfg.BlockInterval {
+		t.Errorf("effective config did not round-trip:\n%s", out)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Addr = "localhost:9999"
+	new.RateLimit.Rate = 5
+	new.RateLimit.Burst = 10
+	new.Custodian.Seed = "SECRETSEED"
+
+	changes := Changes(old, new)
+	byKey := make(map[string]Change)
+	for _, ch := range changes {
+		byKey[ch.Key] = ch
+	}
+	if len(byKey) != 4 {
+		t.Fatalf("got %d changes, want 4: %v", len(byKey), changes)
+	}
+	if byKey["addr"].Reloadable {
+		t.Error("addr should not be reloadable")
+	}
+	if !byKey["ratelimit.rate"].Reloadable {
+		t.Error("ratelimit.rate should be reloadable")
+	}
+	if strings.Contains(byKey["custodian.seed"].New, "SECRETSEED") {
+		t.Error("secret leaked into change description")
+	}
+
+	ApplyReloadable(old, new)
+	if old.Addr != "localhost:2423" {
+		t.Errorf("non-reloadable addr changed to %s", old.Addr)
+	}
+	if old.RateLimit.Rate != 5 || old.RateLimit.Burst != 10 {
+		t.Errorf("got rate limit %v/%d, want 5/10", old.RateLimit.Rate, old.RateLimit.Burst)
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML used by slidechaind config files:
+// [section] headers (possibly dotted),
+// key = value pairs where value is a quoted string, a bare number or boolean,
+// or a single-line array of those,
+// and # comments.
+// It returns a map from dotted key path to value,
+// where each value is a string or a []string.
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	var (
+		vals    = make(map[string]interface{})
+		section string
+		lineno  int
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section header", lineno)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == "" {
+				return nil, fmt.Errorf("line %d: empty section name", lineno)
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", lineno)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, ok := vals[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineno, key)
+		}
+		val, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		vals[key] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+func parseValue(s string) (interface{}, error) {
+	if s == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+	if !strings.HasPrefix(s, "[") {
+		return parseScalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated array")
+	}
+	var list []string
+	for _, item := range splitArray(s[1 : len(s)-1]) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v, err := parseScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	if list == nil {
+		list = []string{}
+	}
+	return list, nil
+}
+
+func parseScalar(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return v, nil
+	}
+	if strings.HasPrefix(s, "'") {
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+	if strings.ContainsAny(s, " \t\"'") {
+		return "", fmt.Errorf("bad value %s", s)
+	}
+	return s, nil
+}
+
+// splitArray splits the body of an array on commas outside quotes.
+func splitArray(s string) []string {
+	var (
+		items []string
+		quote rune
+		start int
+	)
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote && (quote == '\'' || i == 0 || s[i-1] != '\\') {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripComment removes a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote && (quote == '\'' || i == 0 || line[i-1] != '\\') {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,278 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/op"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// A user who opts in to consolidation delegates to the custodian
+// the signing of its delegated outputs:
+// those locked with quorum 1 by the user's pubkey and the custodian's.
+// Either can spend them alone,
+// and the custodian spends them only to merge the small ones
+// into one output locked the same way.
+
+// ConsolidationRequest is the request body of /consolidation.
+type ConsolidationRequest struct {
+	Pubkey  []byte `json:"pubkey"`
+	Enabled bool   `json:"enabled"`
+
+	// TimeMS is when the request was made.
+	// A request older than the last one for the same pubkey is refused.
+	TimeMS int64 `json:"time_ms"`
+
+	// Signature is by Pubkey of SigMsg.
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message signed in a /consolidation request.
+func (r *ConsolidationRequest) SigMsg() []byte {
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(r.TimeMS))
+	msg := []byte("slidechain consolidation\x00")
+	msg = append(msg, r.Pubkey...)
+	if r.Enabled {
+		msg = append(msg, 1)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, timeBytes[:]...)
+	return msg
+}
+
+// DelegatedSigners is the response of /consolidation:
+// the signers of the user's delegated outputs.
+type DelegatedSigners struct {
+	Enabled bool     `json:"enabled"`
+	Quorum  int      `json:"quorum"`
+	Pubkeys [][]byte `json:"pubkeys"`
+}
+
+// Consolidation is the handler for /consolidation,
+// opting a pubkey in to or out of consolidation.
+// Delegated outputs are not consolidated while their user is opted out.
+func (c *Custodian) Consolidation(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if cfg == nil || cfg.Consolidation.Interval <= 0 {
+		net.Errorf(w, http.StatusNotFound, "consolidation is not enabled")
+		return
+	}
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "opting in to consolidation requires POST")
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var r ConsolidationRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(r.Pubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	if !c.checkRequestTime(w, "time_ms", r.TimeMS) {
+		return
+	}
+	if !ed25519.Verify(r.Pubkey, r.SigMsg(), r.Signature) {
+		net.Errorf(w, http.StatusUnauthorized, "bad signature")
+		return
+	}
+	const q = `INSERT INTO consolidations (pubkey, enabled, time_ms) VALUES ($1, $2, $3)
+		ON CONFLICT (pubkey) DO UPDATE SET enabled=excluded.enabled, time_ms=excluded.time_ms
+		WHERE excluded.time_ms > consolidations.time_ms`
+	res, err := c.DB.ExecContext(req.Context(), q, r.Pubkey, r.Enabled, r.TimeMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording consolidation: %s", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		net.Errorf(w, http.StatusConflict, "a newer request for this pubkey has been made")
+		return
+	}
+	resp := DelegatedSigners{Enabled: r.Enabled, Quorum: 1}
+	for _, p := range c.delegatedSigners(r.Pubkey) {
+		resp.Pubkeys = append(resp.Pubkeys, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// delegatedSigners returns the signers of pubkey's delegated outputs.
+func (c *Custodian) delegatedSigners(pubkey []byte) []ed25519.PublicKey {
+	return []ed25519.PublicKey{pubkey, c.privkey.Public().(ed25519.PublicKey)}
+}
+
+// BuildDelegatedTransferTx is BuildTransferTx,
+// paying amount to a delegated output of the pubkey to
+// that the custodian with pubkey custodian may consolidate.
+func BuildDelegatedTransferTx(assetID bc.Hash, inputs []AccountOutput, amount int64, to, custodian ed25519.PublicKey, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	return buildTransferTx(assetID, inputs, amount, []ed25519.PublicKey{to, custodian}, nil, prv)
+}
+
+// consolidateOutputs runs consolidate every interval.
+func (c *Custodian) consolidateOutputs(ctx context.Context, interval time.Duration) {
+	defer log.Print("consolidateOutputs exiting")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := c.consolidate(ctx)
+		if err != nil {
+			log.Printf("consolidating outputs: %s", err)
+		}
+	}
+}
+
+// consolidate merges, for each opted-in pubkey and asset
+// with at least consolidation.min_outputs delegated outputs,
+// the smallest consolidation.max_inputs of them into one.
+// It returns the txs it submitted.
+func (c *Custodian) consolidate(ctx context.Context) ([]*bc.Tx, error) {
+	cfg := c.config()
+	if cfg == nil || cfg.Consolidation.Interval <= 0 {
+		return nil, nil
+	}
+	var pubkeys [][]byte
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT pubkey FROM consolidations WHERE enabled ORDER BY pubkey`, func(pubkey []byte) {
+		pubkeys = append(pubkeys, pubkey)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading opted-in pubkeys")
+	}
+	var txs []*bc.Tx
+	for _, pubkey := range pubkeys {
+		signers := c.delegatedSigners(pubkey)
+		locked := bytes.Join([][]byte{signers[0], signers[1]}, nil)
+		var assetIDs [][]byte
+		const q = `SELECT txvm_asset FROM utxos
+			WHERE pubkeys=$1 AND quorum=1 AND spent_height IS NULL AND anchor IS NOT NULL
+			GROUP BY txvm_asset HAVING COUNT(*) >= $2 ORDER BY txvm_asset`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, locked, cfg.Consolidation.MinOutputs, func(assetID []byte) {
+			assetIDs = append(assetIDs, assetID)
+		})
+		if err != nil {
+			return txs, errors.Wrapf(err, "counting delegated outputs of %x", pubkey)
+		}
+		for _, assetID := range assetIDs {
+			var inputs []AccountOutput
+			const q = `SELECT output_id, anchor, amount FROM utxos
+				WHERE pubkeys=$1 AND quorum=1 AND txvm_asset=$2 AND spent_height IS NULL AND anchor IS NOT NULL
+				ORDER BY amount, output_id LIMIT $3`
+			err := sqlutil.ForQueryRows(ctx, c.DB, q, locked, assetID, cfg.Consolidation.MaxInputs, func(outputID, anchor []byte, amount int64) {
+				inputs = append(inputs, AccountOutput{OutputID: outputID, Anchor: anchor, Amount: amount})
+			})
+			if err != nil {
+				return txs, errors.Wrapf(err, "selecting delegated outputs of %x", pubkey)
+			}
+			tx, err := buildConsolidationTx(bc.HashFromBytes(assetID), inputs, signers, c.privkey)
+			if err != nil {
+				return txs, errors.Wrapf(err, "building consolidation tx for %x", pubkey)
+			}
+			err = c.submitAndWait(ctx, tx)
+			if err != nil {
+				return txs, errors.Wrapf(err, "submitting consolidation tx %x", tx.ID.Bytes())
+			}
+			anchors := make([][]byte, len(inputs))
+			for i, in := range inputs {
+				anchors[i] = in.Anchor
+			}
+			log.Printf("consolidated %d outputs of asset %x for %x in tx %x, into the output with anchor %x", len(inputs), assetID, pubkey, tx.ID.Bytes(), consolidatedAnchor(anchors))
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+// buildConsolidationTx builds a tx merging inputs,
+// each locked with quorum 1 by signers,
+// into one output locked the same way,
+// signing for each input with prv, which must be one of the signers.
+func buildConsolidationTx(assetID bc.Hash, inputs []AccountOutput, signers []ed25519.PublicKey, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	if len(inputs) < 2 {
+		return nil, fmt.Errorf("cannot consolidate %d outputs", len(inputs))
+	}
+	pub := prv.Public().(ed25519.PublicKey)
+	pos := -1
+	for i, p := range signers {
+		if bytes.Equal(p, pub) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, errors.New("not a signer of the outputs")
+	}
+	var total int64
+	for _, in := range inputs {
+		if in.Amount > math.MaxInt64-total {
+			return nil, errors.New("outputs total too much to merge")
+		}
+		total += in.Amount
+	}
+	b := new(txvmutil.Builder)
+	for i, in := range inputs {
+		b.PushdataBytes(nil).Op(op.Put) // arg stack: spendrefdata
+		standard.SpendMultisig(b, 1, signers, in.Amount, assetID, in.Anchor, standard.PayToMultisigSeed1[:])
+		b.Op(op.Get).Op(op.Get) // con stack: sigcheck..., [value,] sigcheck, value
+		if i > 0 {
+			b.PushdataInt64(2).Op(op.Roll).Op(op.Merge) // con stack: sigcheck..., sigcheck, value
+		}
+	}
+	b.PushdataInt64(0).Op(op.Split) // con stack: sigcheck..., value, zeroval
+	b.PushdataInt64(1).Op(op.Roll)  // con stack: sigcheck..., zeroval, value
+	payToAny(b, signers)            // con stack: sigcheck..., zeroval
+	b.Op(op.Finalize)               // con stack: sigcheck...
+	vm, err := txvm.Validate(b.Build(), 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	sigProg := standard.VerifyTxID(vm.TxID)
+	sigs := make([][]byte, len(signers))
+	for i := len(inputs) - 1; i >= 0; i-- {
+		sigs[pos] = ed25519.Sign(prv, append(append([]byte{}, sigProg...), inputs[i].Anchor...))
+		signExportProg(b, sigs, sigProg)
+	}
+	return newTx(b.Build())
+}
+
+// payToAny pays the value on top of the contract stack
+// to an output any one of pubkeys can spend.
+func payToAny(b *txvmutil.Builder, pubkeys []ed25519.PublicKey) {
+	b.PushdataBytes(nil).Op(op.Put) // arg stack: refdata
+	b.Op(op.Put)                    // arg stack: refdata, value
+	b.Tuple(func(tup *txvmutil.TupleBuilder) {
+		for _, p := range pubkeys {
+			tup.PushdataBytes(p)
+		}
+	}).Op(op.Put) // arg stack: refdata, value, {pubkeys}
+	b.PushdataInt64(1).Op(op.Put) // arg stack: refdata, value, {pubkeys}, 1
+	b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)
+}
@@ -0,0 +1,128 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestConsolidate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		cfg := config.Default()
+		cfg.Consolidation.Interval = config.Duration(time.Hour)
+		cfg.Consolidation.MinOutputs = 4
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			cfg:           cfg,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		index := func() {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		consolidate := func(want int) {
+			t.Helper()
+			txs, err := c.consolidate(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txs) != want {
+				t.Errorf("got %d consolidation txs, want %d", len(txs), want)
+			}
+			index()
+		}
+		optIn := func(enabled bool, timeMS int64, wantCode int) {
+			t.Helper()
+			r := ConsolidationRequest{Pubkey: pub, Enabled: enabled, TimeMS: timeMS}
+			r.Signature = ed25519.Sign(prv, r.SigMsg())
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.Consolidation(w, httptest.NewRequest("POST", "/consolidation", bytes.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from /consolidation, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+		delegated := func() (n, total int64) {
+			t.Helper()
+			const q = `SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM utxos WHERE pubkeys=$1 AND quorum=1 AND spent_height IS NULL`
+			err := db.QueryRow(q, append(append([]byte{}, pub...), custodianPub...)).Scan(&n, &total)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n, total
+		}
+
+		assetID := issuanceContracts[1].assetID(assetXDR)
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i, amount := range []int64{10, 5, 3} {
+			importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, amount, expMS+int64(i))
+		}
+		index()
+		sel, err := c.selectOutputs(ctx, pub, assetID.Bytes(), 18)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, out := range sel.Outputs {
+			tx, err := BuildDelegatedTransferTx(assetID, []AccountOutput{out}, out.Amount, pub, custodianPub, prv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			submitTestTx(ctx, t, c, tx)
+		}
+		index()
+		if n, _ := delegated(); n != 3 {
+			t.Fatalf("got %d delegated outputs, want 3", n)
+		}
+
+		consolidate(0) // not opted in
+		optIn(true, c.nowMS(), http.StatusOK)
+		optIn(false, c.nowMS()-1000, http.StatusConflict)
+		consolidate(0) // too few outputs
+		cfg.Consolidation.MinOutputs = 3
+		consolidate(1)
+		if n, total := delegated(); n != 1 || total != 18 {
+			t.Errorf("after consolidation got %d delegated outputs totaling %d, want 1 totaling 18", n, total)
+		}
+		check, err := c.checkAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(check.Problems) > 0 {
+			t.Errorf("found problems %v after consolidation", check.Problems)
+		}
+
+		cfg.Consolidation.Interval = 0
+		optIn(false, c.nowMS(), http.StatusNotFound)
+	})
+}
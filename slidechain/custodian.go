@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -17,11 +18,16 @@ import (
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol"
 	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/federation"
+	"github.com/interstellar/slingshot/slidechain/gossip"
 	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/oracle"
+	"github.com/interstellar/slingshot/slidechain/screening"
+	"github.com/interstellar/slingshot/slidechain/stellar"
 	"github.com/interstellar/slingshot/slidechain/store"
-	"github.com/stellar/go/clients/horizon"
+	"github.com/interstellar/slingshot/slidechain/version"
 	"github.com/stellar/go/keypair"
-	"github.com/stellar/go/xdr"
 )
 
 const custodianPrvHex = "508c64dfa1522aba45219495bf484ee4d1edb6c2051bf2a4356b43b24084db1637235cf548300f400b9afd671b8f701175c6d2549b96415743ae61a58bb437d7"
@@ -36,45 +42,120 @@ var (
 // values.
 type Custodian struct {
 	seed    string
-	hclient horizon.ClientInterface
+	hclient stellar.Client
+	chain   Chain // the main chain: hclient's Stellar network, or an EVM chain
 	imports *sync.Cond
 	exports *sync.Cond
-	network string
 	privkey ed25519.PrivateKey
+	now     func() time.Time // nil means time.Now
+
+	limiters [numAPITiers]*net.Limiter // by tier
+	usage    apiUsage
+
+	screener   screening.Screener
+	federation *federation.Resolver
+	dex        *oracle.DEX // nil unless oracle.source is dex on Stellar
+
+	// nonceMu serializes the choice of the pre-peg-in nonces
+	// that the custodian makes itself.
+	nonceMu sync.Mutex
+
+	// cfgMu protects cfg, which is replaced wholesale on reload.
+	cfgMu sync.Mutex
+	cfg   *config.Config
 
 	DB            *sql.DB
 	BS            *store.BlockStore
 	S             *submitter
 	InitBlockHash bc.Hash
-	AccountID     xdr.AccountId
+	AccountID     string
 }
 
-// GetCustodian returns a Custodian object, loading the preset
-// account ID and seed from the db if it exists, otherwise generating
-// a new keypair and funding the account.
-func GetCustodian(ctx context.Context, db *sql.DB, horizonURL string, blockInterval time.Duration) (*Custodian, error) {
-	c, err := newCustodian(ctx, db, hclient(horizonURL), blockInterval)
+// GetCustodian returns a Custodian object configured by cfg.
+// The custodian account seed is taken from cfg if present,
+// else loaded from the db if it exists there,
+// otherwise a new keypair is generated and the account funded.
+func GetCustodian(ctx context.Context, db *sql.DB, cfg *config.Config) (*Custodian, error) {
+	hc := horizonClient(cfg.Horizon)
+	if r, ok := hc.HTTP.(*stellar.Regional); ok {
+		// Start on the endpoint the probes prefer.
+		pctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		r.Probe(pctx)
+		cancel()
+	}
+	c, err := newCustodian(ctx, db, hc, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if s, ok := c.chain.(*stellarChain); ok && cfg.SEP1.HomeDomain != "" {
+		err = s.setHomeDomain(cfg.SEP1.HomeDomain)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := c.chain.(*stellarChain); ok && cfg.Issuer.Enabled {
+		err = s.setIssuerFlags(ctx, cfg.Issuer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := c.chain.(*stellarChain); ok {
+		err = s.checkAccount(ctx, cfg.Custodian)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.applyDynamic(cfg)
 	c.launch(ctx)
 	return c, nil
 }
 
-func newCustodian(ctx context.Context, db *sql.DB, hclient horizon.ClientInterface, blockInterval time.Duration) (*Custodian, error) {
+func newCustodian(ctx context.Context, db *sql.DB, hclient stellar.Client, cfg *config.Config) (*Custodian, error) {
+	if v := cfg.Custodian.IssuanceVersion; v != 0 && issuanceContracts[int(v)] == nil {
+		return nil, fmt.Errorf("unknown custodian.issuance_version %d; the latest is %d", v, LatestIssuanceVersion)
+	}
 	err := setSchema(db)
 	if err != nil {
 		return nil, errors.Wrap(err, "setting db schema")
 	}
 
-	root, err := hclient.Root()
-	if err != nil {
-		return nil, errors.Wrap(err, "getting horizon client root")
-	}
-
-	custAccountID, seed, err := custodianAccount(ctx, db, hclient)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating/fetching custodian account")
+	var (
+		mainChain Chain
+		accountID string
+		seed      string
+	)
+	if cfg.EVM.RPCURL != "" {
+		mainChain, err = newEVMChain(cfg.EVM)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring EVM chain")
+		}
+		// With no Stellar account,
+		// the custodian row holds only the deposit cursor.
+		_, err = db.Exec("INSERT OR IGNORE INTO custodian (seed) VALUES ('')")
+		if err != nil {
+			return nil, errors.Wrap(err, "storing custodian row")
+		}
+	} else {
+		root, err := hclient.Root()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting horizon client root")
+		}
+		custAccountID, custSeed, err := custodianAccount(ctx, db, hclient, cfg.Custodian.Seed, cfg.Horizon.FriendbotURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating/fetching custodian account")
+		}
+		accountID, seed = custAccountID, custSeed
+		compat, err := checkProtocol(root.ProtocolVersion, cfg.Horizon.AllowUnknownProtocol)
+		if err != nil {
+			return nil, err
+		}
+		if compat != stellar.Supported {
+			log.Printf("network protocol %d is %s: supported %d to %d, fully to %d", root.ProtocolVersion, compat, stellar.MinProtocol, stellar.MaxProtocol, stellar.XDRProtocol)
+		}
+		sc := newStellarChain(hclient, accountID, seed, root.NetworkPassphrase)
+		sc.async = cfg.Horizon.AsyncSubmit
+		sc.protocol = root.ProtocolVersion
+		mainChain = sc
 	}
 
 	heights := make(chan uint64)
@@ -82,6 +163,7 @@ func newCustodian(ctx context.Context, db *sql.DB, hclient horizon.ClientInterfa
 	if err != nil {
 		log.Fatal(err)
 	}
+	bs.Markers = blockMarkers
 
 	initialBlock, err := bs.GetBlock(ctx, 1)
 	if err != nil {
@@ -96,99 +178,168 @@ func newCustodian(ctx context.Context, db *sql.DB, hclient horizon.ClientInterfa
 	if err != nil {
 		log.Fatal(err)
 	}
+	validators, err := newValidatorSet(cfg.Validators)
+	if err != nil {
+		return nil, err
+	}
+	tip := chain.State().Header
+	if tip == nil {
+		tip = initialBlock.BlockHeader
+	}
+	err = checkValidators(validators, tip)
+	if err != nil {
+		return nil, err
+	}
 
-	return &Custodian{
+	c := &Custodian{
 		seed:      seed,
-		AccountID: *custAccountID,
+		AccountID: accountID,
 		S: &submitter{
 			w:             multichan.New((*bc.Block)(nil)),
 			chain:         chain,
 			initialBlock:  initialBlock,
-			blockInterval: blockInterval,
+			blockInterval: time.Duration(cfg.BlockInterval),
+			validators:    validators,
 		},
 		DB:            db,
 		BS:            bs,
 		hclient:       hclient,
+		chain:         mainChain,
 		imports:       sync.NewCond(new(sync.Mutex)),
 		exports:       sync.NewCond(new(sync.Mutex)),
-		network:       root.NetworkPassphrase,
 		privkey:       custodianPrv,
+		limiters:      newTierLimiters(cfg.RateLimit),
+		now:           time.Now,
+		cfg:           cfg,
 		InitBlockHash: initialBlock.Hash(),
-	}, nil
+	}
+	c.S.fees, err = newFeeSchedule(cfg.Fees)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Gossip.URL != "" {
+		c.S.gossip = gossip.New(ctx, cfg.Gossip.URL, cfg.Gossip.Peers, c.S.handleGossip)
+	}
+	c.S.paused = func(ctx context.Context) (bool, error) {
+		return c.paused(ctx, pauseBlocks)
+	}
+	c.S.frozen = c.checkFrozen
+	if sc, ok := mainChain.(*stellarChain); ok {
+		sc.nonceHash = c.paymentNonceHash
+		sc.guard = c.guardAccount
+		sc.unreadable = c.unreadableDeposit
+	}
+	c.federation = &federation.Resolver{TTL: time.Duration(cfg.PegOut.FederationTTL)}
+	c.screener = screening.Noop{}
+	if cfg.Screening.URL != "" {
+		c.screener = &screening.HTTP{URL: cfg.Screening.URL, APIKey: cfg.Screening.APIKey}
+	}
+	if _, ok := mainChain.(*stellarChain); ok && cfg.Oracle.Currency != "" && cfg.Oracle.Source == "dex" {
+		ref, err := stellar.ParseAssetKey(cfg.Oracle.Currency)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing oracle.currency")
+		}
+		c.dex = &oracle.DEX{Client: hclient, Reference: ref, TTL: time.Duration(cfg.Oracle.TTL)}
+	}
+	err = c.detectRollback(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking for a rollback")
+	}
+	return c, nil
 }
 
-func custodianAccount(ctx context.Context, db *sql.DB, hclient horizon.ClientInterface) (*xdr.AccountId, string, error) {
+// custodianAccount returns the custodian's account ID and seed.
+// If configSeed is non-empty it must match the seed in the db, if any,
+// and is stored there otherwise.
+// A new account is funded from friendbotURL.
+func custodianAccount(ctx context.Context, db *sql.DB, hclient stellar.Client, configSeed, friendbotURL string) (string, string, error) {
 	var seed string
 	err := db.QueryRow("SELECT seed FROM custodian").Scan(&seed)
 	if err == sql.ErrNoRows {
-		return makeNewCustodianAccount(ctx, db, hclient)
-	}
-	if err != nil {
-		return nil, "", errors.Wrap(err, "reading seed from db")
+		if configSeed == "" {
+			return makeNewCustodianAccount(ctx, db, hclient, friendbotURL)
+		}
+		_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", configSeed)
+		if err != nil {
+			return "", "", errors.Wrap(err, "storing configured custodian seed")
+		}
+		seed = configSeed
+	} else if err != nil {
+		return "", "", errors.Wrap(err, "reading seed from db")
+	} else if configSeed != "" && configSeed != seed {
+		return "", "", errors.New("configured custodian seed does not match seed in db")
 	}
 
 	kp, err := keypair.Parse(seed)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "parsing keypair from seed")
+		return "", "", errors.Wrap(err, "parsing keypair from seed")
 	}
 	log.Printf("using preexisting custodian account %s", kp.Address())
 
-	var custAccountID xdr.AccountId
-	err = custAccountID.SetAddress(kp.Address())
-	return &custAccountID, seed, err
+	return kp.Address(), seed, nil
 }
 
-func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient horizon.ClientInterface) (*xdr.AccountId, string, error) {
+func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient stellar.Client, friendbotURL string) (string, string, error) {
 	pair, err := keypair.Random()
 	if err != nil {
-		return nil, "", errors.Wrap(err, "generating new keypair")
+		return "", "", errors.Wrap(err, "generating new keypair")
 	}
 
 	log.Printf("seed: %s", pair.Seed())
 	log.Printf("addr: %s", pair.Address())
 
-	resp, err := http.Get("https://friendbot.stellar.org/?addr=" + pair.Address())
+	if friendbotURL == "" {
+		return "", "", errors.New("no custodian seed configured and no friendbot to fund a new account")
+	}
+	resp, err := http.Get(friendbotURL + "?addr=" + pair.Address())
 	if err != nil {
-		return nil, "", errors.Wrap(err, "requesting lumens through friendbot")
+		return "", "", errors.Wrap(err, "requesting lumens through friendbot")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, "", errors.Wrapf(err, "reading response from bad friendbot request %d", resp.StatusCode)
+			return "", "", errors.Wrapf(err, "reading response from bad friendbot request %d", resp.StatusCode)
 		}
-		return nil, "", fmt.Errorf("error funding address through friendbot. got bad status code %d, response %s", resp.StatusCode, body)
+		return "", "", fmt.Errorf("error funding address through friendbot. got bad status code %d, response %s", resp.StatusCode, body)
 	}
 	log.Println("account successfully funded")
 
 	account, err := hclient.LoadAccount(pair.Address())
 	if err != nil {
-		return nil, "", errors.Wrap(err, "loading testnet account")
+		return "", "", errors.Wrap(err, "loading testnet account")
 	}
 	log.Printf("balances for account: %s", pair.Address())
 
 	for _, balance := range account.Balances {
-		if balance.Type == "native" {
+		if balance.AssetType == "native" {
 			log.Printf("%s lumens", balance.Balance)
 		} else {
-			log.Printf("%s of %s", balance.Balance, balance.Asset.Code)
+			log.Printf("%s of %s", balance.Balance, balance.AssetCode)
 		}
 	}
 
 	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", pair.Seed())
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "storing new custodian account")
+		return "", "", errors.Wrapf(err, "storing new custodian account")
 	}
 
-	var custAccountID xdr.AccountId
-	err = custAccountID.SetAddress(pair.Address())
-	return &custAccountID, pair.Seed(), err
+	return pair.Address(), pair.Seed(), nil
 }
 
 // Account returns the Stellar account ID of the custodian.
 func (c *Custodian) Account(w http.ResponseWriter, req *http.Request) {
-	_, err := xdr.Marshal(w, c.AccountID)
+	if _, ok := c.chain.(*stellarChain); !ok {
+		net.Errorf(w, http.StatusNotFound, "custodian has no Stellar account")
+		return
+	}
+	accountXDR, err := stellar.MarshalAccountID(c.AccountID)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "marshaling account ID: %s", err)
+		return
+	}
+	_, err = w.Write(accountXDR)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
 		return
@@ -196,15 +347,71 @@ func (c *Custodian) Account(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// Version serves the build of the running server
+// and the features its current config enables,
+// as a JSON version.Info.
+func (c *Custodian) Version(w http.ResponseWriter, req *http.Request) {
+	info := version.Get()
+	if cfg := c.config(); cfg != nil {
+		info.Features = cfg.Features()
+	}
+	if info.Features == nil {
+		info.Features = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
 // launch kicks off the Custodian's long-running goroutines
 // that stream txs, import, and export.
 func (c *Custodian) launch(ctx context.Context) {
 	pegouts := make(chan pegOut)
 	go c.watchPegIns(ctx)
 	go c.importFromPegIns(ctx, nil)
-	go c.watchExports(ctx)
+	if c.pegOutConfig().Scanner == "external" {
+		go c.pollExports(ctx)
+	} else {
+		go c.watchExports(ctx)
+	}
+	go c.indexTxs(ctx)
+	go c.indexUTXOs(ctx)
 	go c.pegOutFromExports(ctx, pegouts)
+	go c.watchChallenges(ctx)
 	go c.watchPegOuts(ctx, pegouts)
+	if c.S.gossip != nil {
+		go c.S.gossipBlocks(ctx)
+	}
+	if sc, ok := c.chain.(*stellarChain); ok {
+		go c.watchDepositAccounts(ctx)
+		go c.sep31Callbacks(ctx)
+		go c.payExits(ctx, sc)
+		go c.refundDeposits(ctx, sc)
+		go c.watchProtocol(ctx, sc)
+		go c.watchAccountConfig(ctx, sc)
+		if r := sc.regional(); r != nil {
+			go c.probeHorizon(ctx, r)
+		}
+	}
+	go c.notifyUsers(ctx)
+	go c.rollUpLatencies(ctx)
+	go c.expirePegIns(ctx)
+	if cfg := c.config(); cfg != nil && cfg.Checkpoint.Interval > 0 {
+		go c.anchorCheckpoints(ctx, time.Duration(cfg.Checkpoint.Interval))
+	}
+	if cfg := c.config(); cfg != nil && cfg.Consolidation.Interval > 0 {
+		go c.consolidateOutputs(ctx, time.Duration(cfg.Consolidation.Interval))
+	}
+	if sc, ok := c.chain.(*stellarChain); ok {
+		if cfg := c.config(); cfg != nil && cfg.Balance.CheckInterval > 0 {
+			go c.watchBalance(ctx, sc, time.Duration(cfg.Balance.CheckInterval))
+		}
+		if cfg := c.config(); cfg != nil && cfg.Issuer.Enabled {
+			go c.reconcileSupply(ctx, sc, time.Duration(cfg.Issuer.ReconcileInterval))
+		}
+		if cfg := c.config(); cfg != nil && cfg.Clawback.CheckInterval > 0 {
+			go c.watchClawbacks(ctx, sc, time.Duration(cfg.Clawback.CheckInterval))
+		}
+	}
 }
 
 func mustDecodeHex(inp string) []byte {
@@ -217,12 +424,32 @@ func mustDecodeHex(inp string) []byte {
 
 func setSchema(db *sql.DB) error {
 	_, err := db.Exec(schema)
-	return errors.Wrap(err, "creating db schema")
+	if err != nil {
+		return errors.Wrap(err, "creating db schema")
+	}
+	return migrateSchema(db)
 }
 
-func hclient(url string) *horizon.Client {
-	return &horizon.Client{
+func hclient(url string) *stellar.HorizonClient {
+	return &stellar.HorizonClient{
 		URL:  strings.TrimRight(url, "/"),
 		HTTP: new(http.Client),
 	}
 }
+
+// horizonClient returns the Horizon client of cfg,
+// which, with horizon.endpoints,
+// sends its requests to the endpoint a stellar.Regional selects.
+func horizonClient(cfg config.Horizon) *stellar.HorizonClient {
+	hc := hclient(cfg.URL)
+	if len(cfg.Endpoints) == 0 {
+		return hc
+	}
+	endpoints := []stellar.Endpoint{{Region: cfg.Region, URL: cfg.URL}}
+	for _, entry := range cfg.Endpoints {
+		region, url := config.SplitNamed(entry)
+		endpoints = append(endpoints, stellar.Endpoint{Region: region, URL: url})
+	}
+	hc.HTTP = stellar.NewRegional(cfg.Region, endpoints, hc.HTTP)
+	return hc
+}
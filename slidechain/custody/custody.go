@@ -0,0 +1,310 @@
+// Package custody verifies that a slidechain export was paid out on Stellar,
+// for exchanges and others that credit users for exports,
+// without depending on the custodian.
+//
+// The chain of custody of an export is:
+// the export tx is in a slidechain block,
+// by its inclusion proof against the block's header;
+// the tx locks the exported value in the export contract,
+// with reference data describing the Stellar payment;
+// and the Stellar tx is one of the peg-out txs
+// that the exporter's pre-export tx preauthorized by hash,
+// which pay exactly that.
+package custody
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+	"github.com/stellar/go/strkey"
+)
+
+// ExportContractSeed is the contract seed of the slidechain export contract,
+// which logs it in every export tx.
+var ExportContractSeed = mustDecodeHex("c8dcc5453e4257838aabac0ca1248fa3fb22258883b7de75ff3c50cad360e060")
+
+// PegOutFees are the per-operation fees of the peg-out txs
+// a pre-export tx preauthorizes, in stroops.
+var PegOutFees = []uint64{100, 1000, 10000}
+
+const settleFee = 100
+
+var (
+	// ErrHeader means a proof is not for the trusted block header.
+	ErrHeader = errors.New("proof is not for the trusted block")
+
+	// ErrNotExport means a tx is not a slidechain export.
+	ErrNotExport = errors.New("tx is not an export")
+
+	// ErrPegOut means a Stellar tx is not a peg-out of the export.
+	ErrPegOut = errors.New("Stellar tx is not a peg-out of the export")
+
+	// ErrNetted means the Stellar tx is the settlement tx of a netted export,
+	// which the custodian paid together with others
+	// in a payment that no pre-export tx commits to.
+	ErrNetted = errors.New("export was netted")
+)
+
+// Receipt is the evidence that an export was paid out.
+// Tx is the export tx, a serialized bc.RawTx,
+// which its exporter built
+// and which the filtered /headers stream also serves;
+// Proof is its inclusion proof, from /proof;
+// and StellarTxHash is the hex hash of its peg-out tx,
+// from /export-status.
+type Receipt struct {
+	Tx            []byte         `json:"tx"`
+	Proof         *txproof.Proof `json:"proof"`
+	StellarTxHash string         `json:"stellar_tx_hash"`
+}
+
+// Export is the reference data of an export tx.
+type Export struct {
+	AssetXDR []byte `json:"asset"`
+	TempAddr string `json:"temp"`
+	Seqnum   int64  `json:"seqnum"`
+	Exporter string `json:"exporter"`
+	Amount   int64  `json:"amount"`
+	Anchor   []byte `json:"anchor"`
+	Pubkey   []byte `json:"pubkey"`
+
+	// MinTime and MaxTime are the time bounds of the peg-out txs, if any.
+	MinTime int64 `json:"min_time,omitempty"`
+	MaxTime int64 `json:"max_time,omitempty"`
+
+	// Destination is the account the peg-out pays, if not the exporter's,
+	// with the memo the payment carries.
+	Destination string `json:"destination,omitempty"`
+	MemoType    string `json:"memo_type,omitempty"` // text, id, or hash
+	Memo        string `json:"memo,omitempty"`      // a hash memo is base64
+	Federation  string `json:"federation,omitempty"`
+
+	Nettable bool `json:"nettable,omitempty"`
+}
+
+// Payee returns the Stellar account the export pays.
+func (e *Export) Payee() string {
+	if e.Destination != "" {
+		return e.Destination
+	}
+	return e.Exporter
+}
+
+// Verify checks the chain of custody of the export with ID txid
+// and returns its reference data.
+// The header is the trusted header of the block containing it:
+// one the caller has checked the signatures of,
+// for instance with the lightclient package.
+// The custodian is the address of the custodian's Stellar account
+// and network is the Stellar network passphrase.
+// Verify does not consult Stellar;
+// the caller must still confirm there that the peg-out tx succeeded.
+func Verify(r *Receipt, txid bc.Hash, header *bc.BlockHeader, custodian, network string) (*Export, error) {
+	var raw bc.RawTx
+	err := proto.Unmarshal(r.Tx, &raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing export tx")
+	}
+	tx, err := bc.NewTx(raw.Program, raw.Version, raw.Runlimit)
+	if err != nil {
+		return nil, errors.Wrap(err, "running export tx")
+	}
+	if r.Proof == nil || tx.ID != txid {
+		return nil, txproof.ErrTx
+	}
+	block, err := txproof.VerifyTx(r.Proof, tx)
+	if err != nil {
+		return nil, err
+	}
+	if block.Hash() != header.Hash() {
+		return nil, errors.WithDetailf(ErrHeader, "proof is for block %d", block.Height)
+	}
+	e, err := FromLog(tx.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := PegOutTxHashes(e, custodian, network)
+	if err != nil {
+		return nil, err
+	}
+	got := strings.ToLower(r.StellarTxHash)
+	for _, h := range hashes {
+		if got == h {
+			return e, nil
+		}
+	}
+	if e.Nettable {
+		settle, err := SettleTx(e, custodian, network)
+		if err != nil {
+			return nil, err
+		}
+		h, err := stellar.TxHash(settle)
+		if err != nil {
+			return nil, errors.Wrap(err, "hashing settlement tx")
+		}
+		if got == h {
+			return nil, ErrNetted
+		}
+	}
+	return nil, errors.WithDetailf(ErrPegOut, "%s", r.StellarTxHash)
+}
+
+// FromLog parses the reference data of an export tx from its log,
+// returning ErrNotExport if the log is not an export's.
+func FromLog(log []txvm.Tuple) (*Export, error) {
+	// An export's log is an input, the log of its reference data,
+	// perhaps a change output and its log,
+	// the export contract's log, and its output.
+	if len(log) != 5 && len(log) != 7 {
+		return nil, ErrNotExport
+	}
+	if logCode(log[0]) != txvm.InputCode || logCode(log[1]) != txvm.LogCode || logCode(log[len(log)-2]) != txvm.OutputCode {
+		return nil, ErrNotExport
+	}
+	seedItem := log[len(log)-3]
+	seed, ok := logBytes(seedItem, 1)
+	if logCode(seedItem) != txvm.LogCode || !ok || !bytes.Equal(seed, ExportContractSeed) {
+		return nil, ErrNotExport
+	}
+	refdata, ok := logBytes(log[1], 2)
+	if !ok {
+		return nil, errors.WithDetail(ErrNotExport, "reference data missing")
+	}
+	var e Export
+	err := json.Unmarshal(refdata, &e)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing export reference data")
+	}
+	if e.Amount <= 0 {
+		return nil, errors.New("export amount must be positive")
+	}
+	if len(e.Pubkey) != ed25519.PublicKeySize {
+		return nil, errors.New("export pubkey has wrong size")
+	}
+	for _, addr := range []string{e.Exporter, e.TempAddr} {
+		_, err = strkey.Decode(strkey.VersionByteAccountID, addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing export address %q", addr)
+		}
+	}
+	return &e, nil
+}
+
+// PegOutTxHashes returns the hex hashes of the peg-out txs of e,
+// one per fee in PegOutFees,
+// at most one of which can be applied.
+func PegOutTxHashes(e *Export, custodian, network string) ([]string, error) {
+	var hashes []string
+	for _, fee := range PegOutFees {
+		tx, err := PegOutTx(e, custodian, network, fee)
+		if err != nil {
+			return nil, err
+		}
+		h, err := stellar.TxHash(tx)
+		if err != nil {
+			return nil, errors.Wrap(err, "hashing peg-out tx")
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// PegOutTx builds the peg-out tx of e with the given per-operation fee,
+// as the custodian does:
+// it merges the temp account into the exporter's
+// and pays the export from the custodian account.
+func PegOutTx(e *Export, custodian, network string, fee uint64) (*stellar.Tx, error) {
+	asset, err := stellar.DecodeAsset(e.AssetXDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling export asset")
+	}
+	tx := &stellar.Tx{
+		Network: network,
+		Source:  e.TempAddr,
+		SeqNum:  stellar.SequenceNumber(e.Seqnum) + 1,
+		BaseFee: fee,
+		Memo:    e.memo(),
+		Ops: []stellar.Op{
+			stellar.AccountMerge{Destination: e.Exporter},
+			stellar.Payment{
+				Source:      custodian,
+				Destination: e.Payee(),
+				Asset:       asset,
+				Amount:      e.Amount,
+			},
+		},
+	}
+	if e.MinTime != 0 || e.MaxTime != 0 {
+		tx.TimeBounds = &stellar.TimeBounds{MinTime: e.MinTime, MaxTime: e.MaxTime}
+	}
+	return tx, nil
+}
+
+// SettleTx builds the settlement tx of e, which is nettable:
+// it merges the temp account into the exporter's
+// without paying the export.
+func SettleTx(e *Export, custodian, network string) (*stellar.Tx, error) {
+	return &stellar.Tx{
+		Network: network,
+		Source:  e.TempAddr,
+		SeqNum:  stellar.SequenceNumber(e.Seqnum) + 1,
+		BaseFee: settleFee,
+		Ops: []stellar.Op{
+			stellar.BumpSequence{Source: custodian, BumpTo: 0},
+			stellar.AccountMerge{Destination: e.Exporter},
+		},
+	}, nil
+}
+
+// memo returns the memo of the peg-out payment, or nil.
+func (e *Export) memo() stellar.Memo {
+	switch e.MemoType {
+	case "text":
+		return stellar.MemoText(e.Memo)
+	case "id":
+		id, _ := strconv.ParseUint(e.Memo, 10, 64)
+		return stellar.MemoID(id)
+	case "hash":
+		var h stellar.MemoHash
+		raw, _ := base64.StdEncoding.DecodeString(e.Memo)
+		copy(h[:], raw)
+		return h
+	}
+	return nil
+}
+
+func logCode(item txvm.Tuple) byte {
+	b, ok := logBytes(item, 0)
+	if !ok || len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func logBytes(item txvm.Tuple, i int) (txvm.Bytes, bool) {
+	if i >= len(item) {
+		return nil, false
+	}
+	b, ok := item[i].(txvm.Bytes)
+	return b, ok
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
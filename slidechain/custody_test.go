@@ -0,0 +1,143 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/custody"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+func TestCustody(t *testing.T) {
+	if !bytes.Equal(custody.ExportContractSeed, exportContract1Seed[:]) {
+		t.Fatalf("custody.ExportContractSeed is %x, want %x", custody.ExportContractSeed, exportContract1Seed[:])
+	}
+	if !reflect.DeepEqual(custody.PegOutFees, pegOutFees) {
+		t.Fatalf("custody.PegOutFees is %v, want %v", custody.PegOutFees, pegOutFees)
+	}
+
+	ctx := context.Background()
+	cust, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd, err := stellar.NewAsset("USD", cust.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usdXDR, err := usd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := TimeBounds{MinTime: 1000, MaxTime: 2000}
+	dest := Destination{Account: cust.Address(), MemoType: "id", Memo: "42"}
+	const seqnum = 7
+	tx, err := buildExportTx(usdXDR, issuanceContracts[1].assetID(usdXDR), 10, 15, temp.Address(), make([]byte, 32), prv, seqnum, bounds, dest, ExportEscrow{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTx, err := proto.Marshal(&tx.RawTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db}
+		root := bc.TxMerkleRoot([]*bc.Tx{tx})
+		b := &bc.Block{UnsignedBlock: &bc.UnsignedBlock{
+			BlockHeader: &bc.BlockHeader{
+				Version:          3,
+				Height:           2,
+				TransactionsRoot: &root,
+				NextPredicate:    &bc.Predicate{Version: 1},
+			},
+			Transactions: []*bc.Tx{tx},
+		}}
+		err = c.indexBlock(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := c.txProof(ctx, tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := exportFromLog(tx.Log, new(stellarChain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset, err := stellar.DecodeAsset(usdXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for level := range pegOutFees {
+			pegOutTx, err := buildPegOutTx(cust.Address(), p.Exporter, temp.Address(), network.TestNetworkPassphrase, asset, p.Amount, seqnum, pegOutFee(level), bounds, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash, err := stellar.TxHash(pegOutTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &custody.Receipt{Tx: rawTx, Proof: proof, StellarTxHash: hash}
+			e, err := custody.Verify(r, tx.ID, b.BlockHeader, cust.Address(), network.TestNetworkPassphrase)
+			if err != nil {
+				t.Fatalf("fee level %d: %s", level, err)
+			}
+			if e.Amount != 10 || e.Payee() != cust.Address() || e.Memo != "42" {
+				t.Errorf("fee level %d: got export %+v", level, e)
+			}
+		}
+
+		settleTx, err := buildSettleTx(cust.Address(), p.Exporter, temp.Address(), network.TestNetworkPassphrase, seqnum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settleHash, err := stellar.TxHash(settleTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := *b.BlockHeader
+		other.Height = 3
+		cases := []struct {
+			name      string
+			hash      string
+			header    *bc.BlockHeader
+			custodian string
+			want      error
+		}{
+			{"netted", settleHash, b.BlockHeader, cust.Address(), custody.ErrNetted},
+			{"other Stellar tx", settleHash[2:] + "00", b.BlockHeader, cust.Address(), custody.ErrPegOut},
+			{"other custodian", settleHash, b.BlockHeader, temp.Address(), custody.ErrPegOut},
+			{"other block", settleHash, &other, cust.Address(), custody.ErrHeader},
+		}
+		for _, tc := range cases {
+			r := &custody.Receipt{Tx: rawTx, Proof: proof, StellarTxHash: tc.hash}
+			_, err := custody.Verify(r, tx.ID, tc.header, tc.custodian, network.TestNetworkPassphrase)
+			if errors.Root(err) != tc.want {
+				t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+			}
+		}
+	})
+}
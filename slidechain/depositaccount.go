@@ -0,0 +1,451 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	i10rnet "github.com/interstellar/starlight/net"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+)
+
+// forwardExpiry is how long after a deposit to a deposit account
+// its pre-peg-in nonce expires.
+const forwardExpiry = time.Hour
+
+// A depositAccount is a Stellar account belonging to the custodian
+// whose incoming payments are forwarded to the custodian account
+// as peg-ins for a fixed slidechain recipient,
+// so that the payer needs no memo.
+type depositAccount struct {
+	idx     int64
+	address string
+	recip   []byte
+}
+
+// DepositAccountRequest is the request body of /deposit-account.
+type DepositAccountRequest struct {
+	RecipPubkey []byte `json:"recip_pubkey"`
+}
+
+// DepositAccountResponse is the response to /deposit-account.
+type DepositAccountResponse struct {
+	Address string `json:"address"`
+}
+
+// depositAccountKey derives the keypair of the deposit account with index idx
+// from the custodian's seed,
+// so that the accounts can be recovered from the seed alone.
+func depositAccountKey(custodianSeed string, idx int64) (*keypair.Full, error) {
+	raw, err := strkey.Decode(strkey.VersionByteSeed, custodianSeed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding custodian seed")
+	}
+	var idxBytes [8]byte
+	binary.BigEndian.PutUint64(idxBytes[:], uint64(idx))
+	msg := append([]byte("slidechain deposit account\x00"), raw...)
+	return keypair.FromRawSeed(sha3.Sum256(append(msg, idxBytes[:]...)))
+}
+
+// RegisterDepositAccount is the handler for /deposit-account,
+// returning the address of the Stellar account
+// whose incoming payments are pegged in to the given recipient,
+// and creating it first if need be.
+func (c *Custodian) RegisterDepositAccount(w http.ResponseWriter, req *http.Request) {
+	sc, ok := c.chain.(*stellarChain)
+	if cfg := c.config(); !ok || cfg == nil || !cfg.DepositAccounts.Enabled {
+		net.Errorf(w, http.StatusNotFound, "deposit accounts are not enabled")
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var p DepositAccountRequest
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(p.RecipPubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "recip_pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	addr, err := c.depositAccount(req.Context(), sc, p.RecipPubkey)
+	if err != nil {
+		net.Errorf(w, scerrors.Status(err), "getting deposit account: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DepositAccountResponse{Address: addr})
+}
+
+// depositAccount returns the address of recip's deposit account,
+// creating the account on Stellar if it has none.
+func (c *Custodian) depositAccount(ctx context.Context, sc *stellarChain, recip []byte) (string, error) {
+	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO deposit_accounts (recipient_pubkey, created_ms) VALUES ($1, $2)`, recip, c.nowMS())
+	if err != nil {
+		return "", errors.Wrap(err, "recording deposit account")
+	}
+	var (
+		idx  int64
+		addr sql.NullString
+	)
+	err = c.DB.QueryRowContext(ctx, `SELECT idx, address FROM deposit_accounts WHERE recipient_pubkey=$1`, recip).Scan(&idx, &addr)
+	if err != nil {
+		return "", errors.Wrap(err, "reading deposit account")
+	}
+	if addr.Valid {
+		return addr.String, nil
+	}
+
+	// The account is created on Stellar before its address is stored,
+	// so a stored address is always that of an existing account.
+	kp, err := depositAccountKey(sc.seed, idx)
+	if err != nil {
+		return "", err
+	}
+	err = c.createDepositAccount(sc, kp)
+	if err != nil {
+		// It may have been created before a crash.
+		if _, lerr := sc.hclient.LoadAccount(kp.Address()); lerr != nil {
+			return "", errors.Wrapf(err, "creating deposit account %s", kp.Address())
+		}
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE deposit_accounts SET address=$1 WHERE idx=$2`, kp.Address(), idx)
+	if err != nil {
+		return "", errors.Wrap(err, "storing deposit account address")
+	}
+	log.Printf("created deposit account %s for recipient %x", kp.Address(), recip)
+	return kp.Address(), nil
+}
+
+// createDepositAccount creates the account kp on Stellar
+// with trustlines for the allowlisted assets,
+// funding its reserve from the custodian account.
+func (c *Custodian) createDepositAccount(sc *stellarChain, kp *keypair.Full) error {
+	var trust []stellar.Op
+	if cfg := c.config(); cfg != nil {
+		for _, key := range cfg.Assets.Allowlist {
+			asset, err := stellar.ParseAssetKey(key)
+			if err != nil || asset.IsNative() {
+				continue
+			}
+			trust = append(trust, stellar.ChangeTrust{Source: kp.Address(), Asset: asset, Limit: stellar.MaxTrustLimit})
+		}
+	}
+	// The reserve is half a lumen each for the account and its trustlines.
+	balance := xlm.Amount(2+len(trust)) * xlm.Lumen / 2
+
+	custodian := sc.account
+	_, err := sc.seqs.Submit(custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: sc.network,
+			Source:  custodian,
+			SeqNum:  seqnum,
+			Ops:     append([]stellar.Op{stellar.CreateAccount{Destination: kp.Address(), Amount: int64(balance)}}, trust...),
+		}, nil
+	}, sc.seed, kp.Seed())
+	if rerr := resultError(err); rerr != nil {
+		err = errors.Sub(rerr, err)
+	}
+	return err
+}
+
+// Runs as a goroutine until ctx is canceled.
+func (c *Custodian) watchDepositAccounts(ctx context.Context) {
+	defer log.Print("watchDepositAccounts exiting")
+
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	watching := make(map[string]bool)
+	for {
+		accts, err := c.depositAccounts(ctx)
+		if err != nil {
+			log.Printf("listing deposit accounts: %s", err)
+		}
+		for _, acct := range accts {
+			if !watching[acct.address] {
+				watching[acct.address] = true
+				go c.watchDepositAccount(ctx, sc, acct)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchDepositAccount forwards the deposits to acct as they arrive.
+// Runs as a goroutine until ctx is canceled.
+func (c *Custodian) watchDepositAccount(ctx context.Context, sc *stellarChain, acct *depositAccount) {
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+	for {
+		err := c.forwardDeposits(ctx, sc, acct)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("error forwarding deposits to %s: %s, retrying...", acct.address, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// depositAccounts lists the created deposit accounts.
+func (c *Custodian) depositAccounts(ctx context.Context) ([]*depositAccount, error) {
+	const q = `SELECT idx, address, recipient_pubkey FROM deposit_accounts WHERE address IS NOT NULL ORDER BY idx`
+	rows, err := c.DB.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying deposit accounts")
+	}
+	defer rows.Close()
+	var accts []*depositAccount
+	for rows.Next() {
+		acct := new(depositAccount)
+		err = rows.Scan(&acct.idx, &acct.address, &acct.recip)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning deposit account")
+		}
+		accts = append(accts, acct)
+	}
+	return accts, errors.Wrap(rows.Err(), "iterating over deposit accounts")
+}
+
+// forwardDeposits forwards the payments to acct
+// after the cursor stored for it,
+// returning when the tx stream ends or forwarding fails.
+func (c *Custodian) forwardDeposits(ctx context.Context, sc *stellarChain, acct *depositAccount) error {
+	var cur string
+	err := c.DB.QueryRowContext(ctx, `SELECT cursor FROM deposit_accounts WHERE idx=$1`, acct.idx).Scan(&cur)
+	if err != nil {
+		return errors.Wrapf(err, "reading cursor of deposit account %s", acct.address)
+	}
+	_, err = sc.watchAccount(ctx, acct.address, cur, func(tx stellar.Transaction) error {
+		err := c.forwardTx(ctx, sc, acct, tx)
+		if err != nil {
+			return err
+		}
+		_, err = c.DB.ExecContext(ctx, `UPDATE deposit_accounts SET cursor=$1 WHERE idx=$2`, tx.PT, acct.idx)
+		return errors.Wrapf(err, "updating cursor of deposit account %s", acct.address)
+	})
+	return err
+}
+
+// forwardTx forwards each payment to acct in a Stellar tx.
+func (c *Custodian) forwardTx(ctx context.Context, sc *stellarChain, acct *depositAccount, tx stellar.Transaction) error {
+	stx, err := stellar.DecodeTx(tx.EnvelopeXdr)
+	if err != nil || hasOtherOps(stx) {
+		// The payments of a tx the vendored XDR cannot decode,
+		// or with ops it does not model, as for errHorizonOps,
+		// are read from its ops in Horizon instead.
+		return c.forwardOps(ctx, sc, acct, tx)
+	}
+	for i, op := range stx.Ops {
+		payment, ok := op.(stellar.Payment)
+		if !ok || stellar.BaseAccount(payment.Destination) != acct.address {
+			continue
+		}
+		err = c.forwardPayment(ctx, sc, acct, tx.ID, i, payment)
+		if err != nil {
+			return errors.Wrapf(err, "forwarding payment %d of tx %s", i, tx.ID)
+		}
+	}
+	return nil
+}
+
+// forwardOps forwards each payment to acct
+// among the ops of a Stellar tx in Horizon.
+// A payment that cannot be read raises an unrefundedDepositAlert.
+func (c *Custodian) forwardOps(ctx context.Context, sc *stellarChain, acct *depositAccount, tx stellar.Transaction) error {
+	ops, err := stellar.TxOperations(ctx, sc.hclient, tx.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "reading Stellar tx %s", tx.ID)
+	}
+	for i, op := range ops {
+		if !op.IsPayment() || op.To != acct.address {
+			continue
+		}
+		payment, err := opPayment(op, acct.address)
+		if err != nil {
+			err = c.unreadableDeposit(ctx, tx, errors.Wrapf(err, "op %d", i))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = c.forwardPayment(ctx, sc, acct, tx.ID, i, payment)
+		if err != nil {
+			return errors.Wrapf(err, "forwarding payment %d of tx %s", i, tx.ID)
+		}
+	}
+	return nil
+}
+
+// forwardPayment makes a peg-in of a payment to acct:
+// it does the pre-peg-in for acct's recipient,
+// then pays the amount from acct to the custodian account
+// with the peg-in's nonce hash as memo,
+// where it is recorded like any other peg-in deposit.
+// Each step is skipped if it was done before.
+func (c *Custodian) forwardPayment(ctx context.Context, sc *stellarChain, acct *depositAccount, txid string, opIndex int, payment stellar.Payment) error {
+	assetXDR, err := payment.Asset.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshaling asset xdr")
+	}
+	allowed, err := c.assetAllowed(assetXDR)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("not forwarding payment of disallowed asset %x to deposit account %s in tx %s", assetXDR, acct.address, txid)
+		return nil
+	}
+
+	var (
+		nonceHash []byte
+		expMS     int64
+		forwarded sql.NullString
+	)
+	const q = `SELECT nonce_hash, nonce_expms, forward_txid FROM deposit_forwards WHERE deposit_txid=$1 AND op_index=$2`
+	err = c.DB.QueryRowContext(ctx, q, txid, opIndex).Scan(&nonceHash, &expMS, &forwarded)
+	if err == sql.ErrNoRows {
+		nonceHash, expMS, err = c.newForward(ctx, acct, txid, opIndex)
+	}
+	if err != nil {
+		return err
+	}
+	if forwarded.Valid {
+		return nil
+	}
+
+	paused, err := c.pegPaused(ctx)
+	if err != nil {
+		return err
+	}
+	if paused {
+		return errors.New("the peg is paused")
+	}
+
+	var n int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&n)
+	if err != nil {
+		return errors.Wrap(err, "checking for forwarded peg-in")
+	}
+	if n == 0 {
+		prepegTx, err := buildPrePegInTx(c.issuance(), c.InitBlockHash.Bytes(), assetXDR, acct.recip, payment.Amount, expMS)
+		if err != nil {
+			return err
+		}
+		r, err := c.S.submitTx(ctx, prepegTx)
+		if err != nil {
+			return errors.Wrap(err, "submitting pre-peg-in tx")
+		}
+		err = c.S.waitOnTx(ctx, prepegTx.ID, r)
+		if err != nil {
+			return errors.Wrap(err, "waiting for pre-peg-in tx")
+		}
+		err = c.insertPegIn(ctx, nonceHash, acct.recip, expMS)
+		if err != nil {
+			return err
+		}
+	}
+
+	kp, err := depositAccountKey(sc.seed, acct.idx)
+	if err != nil {
+		return err
+	}
+	custodian := sc.account
+	var memo stellar.MemoHash
+	copy(memo[:], nonceHash)
+	succ, err := sc.seqs.Submit(custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: sc.network,
+			Source:  custodian,
+			SeqNum:  seqnum,
+			Memo:    memo,
+			Ops: []stellar.Op{
+				stellar.Payment{
+					Source:      kp.Address(),
+					Destination: custodian,
+					Asset:       payment.Asset,
+					Amount:      payment.Amount,
+				},
+			},
+		}, nil
+	}, sc.seed, kp.Seed())
+	if err != nil {
+		return errors.Wrap(err, "submitting forwarding tx")
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE deposit_forwards SET forward_txid=$1 WHERE deposit_txid=$2 AND op_index=$3`, succ.Hash, txid, opIndex)
+	if err != nil {
+		return errors.Wrap(err, "recording forwarding tx")
+	}
+	log.Printf("forwarded deposit to %s in tx %s as peg-in with nonce hash %x in tx %s", acct.address, txid, nonceHash, succ.Hash)
+	return nil
+}
+
+// newForward records the forwarding of a payment with a new pre-peg-in nonce,
+// returning its hash and expiration.
+func (c *Custodian) newForward(ctx context.Context, acct *depositAccount, txid string, opIndex int) ([]byte, int64, error) {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	expMS, err := c.newNonceExp(ctx, forwardExpiry)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+	const ins = `INSERT INTO deposit_forwards (deposit_txid, op_index, address, nonce_hash, nonce_expms) VALUES ($1, $2, $3, $4, $5)`
+	_, err = c.DB.ExecContext(ctx, ins, txid, opIndex, acct.address, nonceHash[:], expMS)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "recording deposit forward")
+	}
+	return nonceHash[:], expMS, nil
+}
+
+// newNonceExp returns an expiration time ttl from now
+// for a pre-peg-in nonce made by the custodian itself,
+// later than that of any other so that the nonce is unique.
+// It must be called with c.nonceMu held until the nonce is recorded.
+func (c *Custodian) newNonceExp(ctx context.Context, ttl time.Duration) (int64, error) {
+	var maxMS int64
+	const q = `SELECT COALESCE(MAX(nonce_expms), 0) FROM (
+		SELECT nonce_expms FROM pegs
+		UNION ALL SELECT nonce_expms FROM deposit_forwards
+		UNION ALL SELECT nonce_expms FROM sep31_transactions
+		UNION ALL SELECT nonce_expms FROM deposit_nonces
+	)`
+	err := c.DB.QueryRowContext(ctx, q).Scan(&maxMS)
+	if err != nil {
+		return 0, errors.Wrap(err, "finding latest nonce expiration")
+	}
+	expMS := c.nowMS() + int64(ttl/time.Millisecond)
+	if expMS <= maxMS {
+		expMS = maxMS + 1
+	}
+	return expMS, nil
+}
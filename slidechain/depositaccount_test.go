@@ -0,0 +1,190 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestDepositAccount(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.DepositAccounts.Enabled = true
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+
+		register := func() string {
+			t.Helper()
+			body, err := json.Marshal(DepositAccountRequest{RecipPubkey: testRecipPubKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.RegisterDepositAccount(w, httptest.NewRequest("POST", "/deposit-account", bytes.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code %d from /deposit-account: %s", w.Code, w.Body)
+			}
+			var resp DepositAccountResponse
+			err = json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.Address
+		}
+		addr := register()
+		if again := register(); again != addr {
+			t.Fatalf("registering again gave deposit account %s, want %s", again, addr)
+		}
+		reserve := int64(xlm.Lumen)
+		if bal, _ := srv.Balance(addr, stellar.NativeAsset()); bal != reserve {
+			t.Fatalf("deposit account balance %d, want %d", bal, reserve)
+		}
+
+		// Pay the deposit account with no memo.
+		const amount = 10 * int64(xlm.Lumen)
+		_, err = stellar.NewSequencer(srv.Client()).Submit(payerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  payerKP.Address(),
+				SeqNum:  seqnum,
+				Ops: []stellar.Op{stellar.Payment{
+					Destination: addr,
+					Asset:       stellar.NativeAsset(),
+					Amount:      amount,
+				}},
+			}, nil
+		}, payerKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accts, err := c.depositAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(accts) != 1 || accts[0].address != addr {
+			t.Fatalf("got deposit accounts %v, want just %s", accts, addr)
+		}
+		// forward runs the deposit account's part of Step;
+		// horizonmock streams never end, so the txs are passed directly.
+		forward := func() {
+			t.Helper()
+			for _, tx := range srv.AccountTransactions(addr, "") {
+				err := c.forwardTx(ctx, sc, accts[0], tx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		forward()
+		if bal, _ := srv.Balance(addr, stellar.NativeAsset()); bal != reserve {
+			t.Errorf("deposit account balance %d after forwarding, want %d", bal, reserve)
+		}
+
+		// The forwarded payment is a peg-in deposit like any other.
+		for _, tx := range srv.AccountTransactions(custKP.Address(), "") {
+			err = sc.deposits(ctx, tx, func(d Deposit) error {
+				return c.recordDeposit(ctx, d)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var (
+			recip     []byte
+			gotAmount int64
+			state     pegInState
+		)
+		err = db.QueryRow(`SELECT recipient_pubkey, amount, state FROM pegs`).Scan(&recip, &gotAmount, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recip, testRecipPubKey) || gotAmount != amount || state != pegInPaid {
+			t.Errorf("got peg-in of %d to %x in state %s, want %d to %x in state %s", gotAmount, recip, state, amount, testRecipPubKey, pegInPaid)
+		}
+
+		// Forwarding again does nothing.
+		n := len(srv.Transactions())
+		forward()
+		if len(srv.Transactions()) != n {
+			t.Error("payment forwarded twice")
+		}
+
+		// A payment in a tx of a later protocol
+		// is forwarded too.
+		seqnum, err := srv.Client().SequenceForAccount(payerKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := &stellar.Tx{
+			Network: srv.Passphrase,
+			Source:  payerKP.Address(),
+			SeqNum:  seqnum + 1,
+			Ops: []stellar.Op{stellar.Payment{
+				Destination: addr,
+				Asset:       stellar.NativeAsset(),
+				Amount:      amount,
+			}},
+		}
+		env, err := tx.Sign(payerKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		future, err := horizonmock.FutureEnvelope(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = srv.Client().SubmitTransaction(future)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forward()
+		if bal, _ := srv.Balance(addr, stellar.NativeAsset()); bal != reserve {
+			t.Errorf("deposit account balance %d after forwarding a payment of a later protocol, want %d", bal, reserve)
+		}
+		var forwards int
+		err = db.QueryRow(`SELECT COUNT(*) FROM deposit_forwards WHERE forward_txid IS NOT NULL`).Scan(&forwards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if forwards != 2 {
+			t.Errorf("got %d payments forwarded, want 2", forwards)
+		}
+	})
+}
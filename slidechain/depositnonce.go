@@ -0,0 +1,441 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// States of a deposit refund.
+const (
+	refundWaiting    = 0 // for the next pass
+	refundSubmitting = 1 // submitted, and possibly applied
+	refundPaid       = 2
+)
+
+// depositRefundInterval is how often the custodian pays deposit refunds.
+const depositRefundInterval = 30 * time.Second
+
+// refundTxTTL bounds the time in which a refund tx can be applied,
+// so that one left submitting can be resolved.
+const refundTxTTL = 2 * time.Minute
+
+// unrefundedDepositAlert is the kind of alert raised for a deposit
+// that must be refunded to an unknown sender.
+const unrefundedDepositAlert = "unrefunded-deposit"
+
+// DepositNonceRequest is the request body of /deposit-nonce.
+type DepositNonceRequest struct {
+	RecipPubkey []byte `json:"recip_pubkey"`
+	AssetXDR    []byte `json:"asset_xdr"`
+	Amount      int64  `json:"amount"`
+
+	// Referral is a code in partner_fees.referral_codes
+	// attributing the peg-in to a partner.
+	Referral string `json:"referral,omitempty"`
+}
+
+// DepositNonce is the response of /deposit-nonce:
+// the hash memo that one deposit to the custodian account
+// must carry before ExpMS to be imported for the recipient.
+type DepositNonce struct {
+	Address string `json:"address"`
+	Memo    []byte `json:"memo"`
+	ExpMS   int64  `json:"exp_ms"`
+	URI     string `json:"uri"` // SEP-7, as from /deposit-uri
+}
+
+// IssueDepositNonce is the handler for /deposit-nonce.
+// It does the pre-peg-in for a new nonce bound to the recipient
+// and responds with the memo.
+// A second deposit with the memo, or one after it expires,
+// is refunded to its sender instead of imported.
+func (c *Custodian) IssueDepositNonce(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	sc, ok := c.chain.(*stellarChain)
+	if !ok || cfg == nil || cfg.DepositNonces.TTL <= 0 {
+		net.Errorf(w, http.StatusNotFound, "deposit nonces are not enabled")
+		return
+	}
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "deposit nonces must be requested with POST")
+		return
+	}
+	ctx := req.Context()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var r DepositNonceRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(r.RecipPubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "recip_pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	if r.Amount <= 0 {
+		net.Errorf(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	if code, err := c.checkPegIn(ctx, r.AssetXDR); err != nil {
+		net.Errorf(w, code, "%s", err)
+		return
+	}
+	partner, err := c.pegInPartner(req, r.Referral)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	nonceHash, expMS, err := c.newDepositNonce(ctx, r, time.Duration(cfg.DepositNonces.TTL))
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	prepegTx, err := buildPrePegInTx(c.issuance(), c.InitBlockHash.Bytes(), r.AssetXDR, r.RecipPubkey, r.Amount, expMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "building pre-peg-in tx: %s", err)
+		return
+	}
+	err = c.submitAndWait(ctx, prepegTx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "submitting pre-peg-in tx: %s", err)
+		return
+	}
+	err = c.insertPegIn(ctx, nonceHash, r.RecipPubkey, expMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	err = c.attributePegIn(ctx, nonceHash, partner)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	log.Printf("issued deposit nonce with hash %x for %x, expiring at %d", nonceHash, r.RecipPubkey, expMS)
+	pay := sep7Pay{Destination: sc.account, AssetXDR: r.AssetXDR, Amount: r.Amount, Memo: nonceHash, Network: sc.network}
+	uri, err := sep7PayURI(pay, cfg.SEP1.HomeDomain, sc.seed)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DepositNonce{
+		Address: sc.account,
+		Memo:    nonceHash,
+		ExpMS:   expMS,
+		URI:     uri,
+	})
+}
+
+// newDepositNonce records a deposit nonce for r expiring ttl from now,
+// returning its hash and expiration.
+func (c *Custodian) newDepositNonce(ctx context.Context, r DepositNonceRequest, ttl time.Duration) ([]byte, int64, error) {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	expMS, err := c.newNonceExp(ctx, ttl)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+	const q = `INSERT INTO deposit_nonces (nonce_hash, recipient_pubkey, asset_xdr, amount, nonce_expms, created_ms) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = c.DB.ExecContext(ctx, q, nonceHash[:], r.RecipPubkey, r.AssetXDR, r.Amount, expMS, c.nowMS())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "recording deposit nonce")
+	}
+	return nonceHash[:], expMS, nil
+}
+
+// depositRefundReason reports why the deposit d must be refunded:
+// "reused" if it pays a peg-in that another op of its own tx paid,
+// as a payment of a multi-payment tx bound to no peg-in does,
+// or pays an issued deposit nonce that another deposit paid,
+// "expired" if it pays one after its expiration
+// or pays a peg-in expired by pegin.intent_ttl,
+// and "" otherwise, including for a nonce the custodian did not issue.
+func (c *Custodian) depositRefundReason(ctx context.Context, d Deposit) (string, error) {
+	expired, err := c.pegInHasExpired(ctx, d.NonceHash)
+	if err != nil {
+		return "", err
+	}
+	if expired {
+		return "expired", nil
+	}
+	var (
+		paidBy sql.NullString
+		paidOp int
+	)
+	err = c.DB.QueryRowContext(ctx, `SELECT deposit_txid, deposit_op FROM pegs WHERE nonce_hash=$1`, d.NonceHash).Scan(&paidBy, &paidOp)
+	if err != nil && err != sql.ErrNoRows {
+		return "", errors.Wrapf(err, "reading peg-in %x", d.NonceHash)
+	}
+	paidHere := paidBy.Valid && paidBy.String == d.TxID
+	if paidHere && paidOp != d.OpIndex {
+		return "reused", nil
+	}
+	var expMS int64
+	err = c.DB.QueryRowContext(ctx, `SELECT nonce_expms FROM deposit_nonces WHERE nonce_hash=$1`, d.NonceHash).Scan(&expMS)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "reading deposit nonce %x", d.NonceHash)
+	}
+	if paidBy.Valid {
+		if paidHere {
+			return "", nil
+		}
+		return "reused", nil
+	}
+	timeMS := d.TimeMS
+	if timeMS == 0 {
+		timeMS = c.nowMS()
+	}
+	if timeMS > expMS {
+		return "expired", nil
+	}
+	return "", nil
+}
+
+// queueRefund records that the deposit d is to be refunded to its sender.
+// If the sender is unknown, it raises an alert instead,
+// so that an operator can refund it.
+func (c *Custodian) queueRefund(ctx context.Context, d Deposit, reason string) error {
+	if d.Sender == "" {
+		key := []byte(fmt.Sprintf("%s %d %x", d.TxID, d.OpIndex, d.NonceHash))
+		alerted, err := c.alerted(ctx, unrefundedDepositAlert, key)
+		if err != nil || alerted {
+			return err
+		}
+		detail := fmt.Sprintf("deposit of %d %s in tx %s pays the %s deposit nonce %x from an unknown sender; refund it by hand", d.Amount, assetName(d.Asset), d.TxID, reason, d.NonceHash)
+		return c.alert(ctx, unrefundedDepositAlert, key, detail)
+	}
+	const q = `INSERT OR IGNORE INTO deposit_refunds
+		(deposit_txid, op_index, asset_xdr, nonce_hash, sender, amount, reason, deposit_cursor, state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	res, err := c.DB.ExecContext(ctx, q, d.TxID, d.OpIndex, d.Asset, d.NonceHash, d.Sender, d.Amount, reason, d.Cursor, refundWaiting)
+	if err != nil {
+		return errors.Wrap(err, "recording deposit refund")
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("refunding deposit of %d %s in tx %s to %s: deposit nonce %x %s", d.Amount, assetName(d.Asset), d.TxID, d.Sender, d.NonceHash, reason)
+	}
+	return nil
+}
+
+// unreadableDeposit raises an unrefundedDepositAlert, once,
+// for a Stellar tx paying the custodian or a deposit account
+// whose deposits cannot be read for the reason in readErr,
+// so that an operator can refund them.
+func (c *Custodian) unreadableDeposit(ctx context.Context, tx stellar.Transaction, readErr error) error {
+	key := []byte(tx.ID)
+	alerted, err := c.alerted(ctx, unrefundedDepositAlert, key)
+	if err != nil || alerted {
+		return err
+	}
+	detail := fmt.Sprintf("the deposits in Stellar tx %s cannot be read (%s); refund them by hand", tx.ID, readErr)
+	return c.alert(ctx, unrefundedDepositAlert, key, detail)
+}
+
+// refundDeposits runs as a goroutine,
+// paying deposit refunds every depositRefundInterval.
+func (c *Custodian) refundDeposits(ctx context.Context, sc *stellarChain) {
+	defer log.Print("refundDeposits exiting")
+
+	ticker := time.NewTicker(depositRefundInterval)
+	defer ticker.Stop()
+	for {
+		err := c.payRefundsPending(ctx, sc)
+		if err != nil {
+			log.Printf("paying deposit refunds: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// payRefundsPending pays each waiting deposit refund
+// that the signing policy passes.
+// A refund left submitting, as by a crash,
+// is first looked for in the custodian account's history since its deposit
+// once its tx can no longer be applied:
+// it is paid if its memo is found there, and waiting otherwise.
+// Nothing is paid while the custodian account has drifted from the custodian config.
+func (c *Custodian) payRefundsPending(ctx context.Context, sc *stellarChain) error {
+	if c.accountHeld() {
+		return nil
+	}
+	err := c.resolveRefundsSubmitting(ctx, sc)
+	if err != nil {
+		return err
+	}
+	type refund struct {
+		txid, sender string
+		op           int
+		assetXDR     []byte
+		amount       int64
+	}
+	var refunds []refund
+	const q = `SELECT deposit_txid, op_index, asset_xdr, sender, amount FROM deposit_refunds WHERE state=$1 ORDER BY deposit_txid, op_index, asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, refundWaiting, func(txid string, op int, assetXDR []byte, sender string, amount int64) {
+		refunds = append(refunds, refund{txid: txid, op: op, sender: sender, assetXDR: assetXDR, amount: amount})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading deposit refunds")
+	}
+	for _, r := range refunds {
+		memo := refundMemo(r.txid, r.op, r.assetXDR)
+		ok, err := c.checkSigningPolicy(ctx, signing{Kind: "refund", ID: memo[:], Destination: r.sender, AssetXDR: r.assetXDR, Amount: r.amount})
+		if err == nil && ok {
+			err = c.payRefund(ctx, sc, r.txid, r.op, r.assetXDR, r.amount, r.sender)
+		}
+		if err != nil {
+			log.Printf("refunding deposit of %d %s in tx %s to %s: %s", r.amount, assetName(r.assetXDR), r.txid, r.sender, err)
+		}
+	}
+	return nil
+}
+
+// payRefund pays one deposit refund to sender,
+// with the refund's memo so that it can be found again.
+func (c *Custodian) payRefund(ctx context.Context, sc *stellarChain, txid string, op int, assetXDR []byte, amt int64, sender string) error {
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling asset")
+	}
+	nowMS := c.nowMS()
+	_, err = c.DB.ExecContext(ctx, `UPDATE deposit_refunds SET state=$1, submitted_ms=$2 WHERE deposit_txid=$3 AND op_index=$4 AND asset_xdr=$5`, refundSubmitting, nowMS, txid, op, assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "recording refund submission")
+	}
+	maxTime := int64((time.Duration(nowMS)*time.Millisecond + refundTxTTL) / time.Second)
+	custodian := sc.account
+	succ, err := sc.seqs.SubmitContext(ctx, custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network:    sc.network,
+			Source:     custodian,
+			SeqNum:     seqnum,
+			TimeBounds: &stellar.TimeBounds{MaxTime: maxTime},
+			Memo:       refundMemo(txid, op, assetXDR),
+			Ops: []stellar.Op{
+				stellar.Payment{Destination: sender, Asset: asset, Amount: amt},
+			},
+		}, nil
+	}, sc.seed)
+	if resultCode(err) != "" {
+		// Rejected by Stellar, so not applied; try again next pass.
+		_, dberr := c.DB.ExecContext(ctx, `UPDATE deposit_refunds SET state=$1, error=$2 WHERE deposit_txid=$3 AND op_index=$4 AND asset_xdr=$5`, refundWaiting, err.Error(), txid, op, assetXDR)
+		if dberr != nil {
+			return errors.Wrap(dberr, "recording refund failure")
+		}
+		return err
+	}
+	if err != nil {
+		// Possibly applied; resolved from the account's history next pass.
+		return err
+	}
+	return c.recordRefundPaid(ctx, txid, op, assetXDR, succ.Hash)
+}
+
+func (c *Custodian) recordRefundPaid(ctx context.Context, txid string, op int, assetXDR []byte, hash string) error {
+	const q = `UPDATE deposit_refunds SET state=$1, stellar_tx_hash=$2, error=NULL WHERE deposit_txid=$3 AND op_index=$4 AND asset_xdr=$5`
+	_, err := c.DB.ExecContext(ctx, q, refundPaid, hash, txid, op, assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "recording deposit refund")
+	}
+	log.Printf("refunded deposit of %s in tx %s op %d in Stellar tx %s", assetName(assetXDR), txid, op, hash)
+	return nil
+}
+
+// resolveRefundsSubmitting settles the refunds left submitting past refundTxTTL
+// by looking for their memos among the custodian account's txs
+// after the earliest of their deposits.
+func (c *Custodian) resolveRefundsSubmitting(ctx context.Context, sc *stellarChain) error {
+	type key struct {
+		txid     string
+		op       int
+		assetXDR []byte
+	}
+	var cursor string
+	pending := make(map[string]key)
+	// Paging tokens are decimal, so the shortest is the earliest.
+	const q = `SELECT deposit_txid, op_index, asset_xdr, deposit_cursor FROM deposit_refunds WHERE state=$1 AND submitted_ms < $2
+		ORDER BY LENGTH(deposit_cursor), deposit_cursor`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, refundSubmitting, c.nowMS()-int64(refundTxTTL/time.Millisecond), func(txid string, op int, assetXDR []byte, depositCursor string) {
+		memo := refundMemo(txid, op, assetXDR)
+		pending[base64.StdEncoding.EncodeToString(memo[:])] = key{txid, op, assetXDR}
+		if len(pending) == 1 {
+			cursor = depositCursor
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading submitted deposit refunds")
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	const pageSize = 200
+	for {
+		tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		txs, err := stellar.AccountTransactions(tctx, sc.hclient, sc.account, cursor, pageSize)
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "reading custodian txs")
+		}
+		for _, tx := range txs {
+			cursor = tx.PT
+			if k, ok := pending[tx.Memo]; ok && tx.MemoType == "hash" && tx.Account == sc.account {
+				err = c.recordRefundPaid(ctx, k.txid, k.op, k.assetXDR, tx.Hash)
+				if err != nil {
+					return err
+				}
+				delete(pending, tx.Memo)
+			}
+		}
+		if len(txs) < pageSize {
+			break
+		}
+	}
+	// The rest were never applied.
+	for _, k := range pending {
+		_, err = c.DB.ExecContext(ctx, `UPDATE deposit_refunds SET state=$1 WHERE deposit_txid=$2 AND op_index=$3 AND asset_xdr=$4`, refundWaiting, k.txid, k.op, k.assetXDR)
+		if err != nil {
+			return errors.Wrap(err, "resetting deposit refund")
+		}
+	}
+	return nil
+}
+
+// refundMemo is the memo of the refund of the deposit of assetXDR
+// at op in tx txid.
+// Op 0 keeps the memo refunds had when they were keyed by tx alone,
+// so that those left submitting are still found.
+func refundMemo(txid string, op int, assetXDR []byte) stellar.MemoHash {
+	msg := append([]byte("slidechain refund\x00"), txid...)
+	msg = append(append(msg, 0), assetXDR...)
+	if op != 0 {
+		msg = append(append(msg, 0), strconv.Itoa(op)...)
+	}
+	return sha3.Sum256(msg)
+}
@@ -0,0 +1,174 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestDepositNonces(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	cfg.DepositNonces.TTL = config.Duration(time.Hour)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.Now = func() time.Time { return now }
+	native := stellar.NativeAsset()
+	nativeXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const amount = 10 * int64(xlm.Lumen)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		pay := func() {
+			t.Helper()
+			err := c.payRefundsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		issue := func() DepositNonce {
+			t.Helper()
+			body, err := json.Marshal(DepositNonceRequest{RecipPubkey: testRecipPubKey, AssetXDR: nativeXDR, Amount: amount})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.IssueDepositNonce(w, httptest.NewRequest("POST", "/deposit-nonce", bytes.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code %d from /deposit-nonce: %s", w.Code, w.Body)
+			}
+			var n DepositNonce
+			err = json.Unmarshal(w.Body.Bytes(), &n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Address != custKP.Address() || len(n.Memo) != 32 {
+				t.Fatalf("got deposit nonce %x for %s, want a 32-byte memo for %s", n.Memo, n.Address, custKP.Address())
+			}
+			return n
+		}
+		var cursor string
+		deposit := func(n DepositNonce) {
+			t.Helper()
+			var memo stellar.MemoHash
+			copy(memo[:], n.Memo)
+			_, err := stellar.NewSequencer(srv.Client()).Submit(payerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+				return &stellar.Tx{
+					Network: srv.Passphrase,
+					Source:  payerKP.Address(),
+					SeqNum:  seqnum,
+					Memo:    memo,
+					Ops: []stellar.Op{stellar.Payment{
+						Destination: n.Address,
+						Asset:       stellar.NativeAsset(),
+						Amount:      amount,
+					}},
+				}, nil
+			}, payerKP.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// horizonmock streams never end, so the txs are passed directly.
+			for _, tx := range srv.AccountTransactions(n.Address, cursor) {
+				cursor = tx.PT
+				err = sc.deposits(ctx, tx, func(d Deposit) error {
+					return c.recordDeposit(ctx, d)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = c.importPending(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pay()
+		}
+		refunds := func() map[string]int {
+			t.Helper()
+			got := make(map[string]int)
+			err := sqlutil.ForQueryRows(ctx, db, `SELECT reason, state FROM deposit_refunds`, func(reason string, state int) {
+				if state == refundPaid {
+					got[reason]++
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		balance := func() int64 {
+			bal, _ := srv.Balance(payerKP.Address(), native)
+			return bal
+		}
+
+		const fee = 100
+		start := balance()
+		n := issue()
+		deposit(n)
+		deposit(n) // reused
+		if got := refunds(); got["reused"] != 1 || len(got) != 1 {
+			t.Errorf("got paid refunds %v, want one reused", got)
+		}
+		var state pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, n.Memo).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegInImported {
+			t.Errorf("peg-in in state %s, want %s", state, pegInImported)
+		}
+
+		n = issue()
+		now = now.Add(2 * time.Hour)
+		deposit(n) // expired
+		if got := refunds(); got["expired"] != 1 || got["reused"] != 1 {
+			t.Errorf("got paid refunds %v, want one reused and one expired", got)
+		}
+		if got, want := balance(), start-3*(amount+fee)+2*amount; got != want {
+			t.Errorf("depositor balance %d, want %d", got, want)
+		}
+
+		// Further passes pay nothing more.
+		pay()
+		if got, want := balance(), start-3*(amount+fee)+2*amount; got != want {
+			t.Errorf("depositor balance %d after another pass, want %d", got, want)
+		}
+	})
+}
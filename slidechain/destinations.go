@@ -0,0 +1,170 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/evm"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+const pegOutBlockedAlert = "peg-out-blocked"
+
+// destination is an entry of the peg-out destination lists
+// in the peg_out_destinations table.
+type destination struct {
+	Address string `json:"address"`
+	List    string `json:"list"` // "allow" or "deny"
+	Note    string `json:"note"`
+	TimeMS  int64  `json:"time_ms,omitempty"`
+}
+
+// canonicalAddress returns the form of a main-chain account address
+// stored in the peg_out_destinations table:
+// a Stellar account ID, or a lower-case 0x-prefixed EVM address.
+// An M-address is stored as its base account,
+// so that a policy on an account covers its muxed accounts.
+func canonicalAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, "0x") || strings.HasPrefix(addr, "0X") {
+		a, err := evm.ParseAddress(addr)
+		if err != nil {
+			return "", err
+		}
+		return a.String(), nil
+	}
+	base := stellar.BaseAccount(addr)
+	_, err := strkey.Decode(strkey.VersionByteAccountID, base)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a Stellar account ID or EVM address", addr)
+	}
+	return base, nil
+}
+
+// destinationAllowed reports whether exports may be pegged out to addr
+// under pegout.destination_policy.
+func (c *Custodian) destinationAllowed(ctx context.Context, addr string) (bool, error) {
+	if canon, err := canonicalAddress(addr); err == nil {
+		addr = canon
+	}
+	var list string
+	err := c.DB.QueryRowContext(ctx, `SELECT list FROM peg_out_destinations WHERE address=$1`, addr).Scan(&list)
+	if err != nil && err != sql.ErrNoRows {
+		return false, errors.Wrapf(err, "looking up peg-out destination %s", addr)
+	}
+	if c.pegOutConfig().DestinationPolicy == "allowlist" {
+		return list == "allow", nil
+	}
+	return list != "deny", nil
+}
+
+// checkDestination reports whether the export may be pegged out
+// to its destination.
+// The first time an export is blocked,
+// operators are alerted and the block is audited.
+func (c *Custodian) checkDestination(ctx context.Context, p *pegOut) (bool, error) {
+	ok, err := c.destinationAllowed(ctx, p.payee())
+	if err != nil || ok {
+		return ok, err
+	}
+	alerted, err := c.alerted(ctx, pegOutBlockedAlert, p.TxID)
+	if err != nil || alerted {
+		return false, err
+	}
+	detail := fmt.Sprintf("export %x to %s held by pegout.destination_policy %s", p.TxID, p.payee(), c.pegOutConfig().DestinationPolicy)
+	err = c.recordAudit(ctx, "pegout.blocked", "destination-policy", detail)
+	if err != nil {
+		return false, err
+	}
+	return false, c.alert(ctx, pegOutBlockedAlert, p.TxID, detail)
+}
+
+// Destinations is the admin handler for the peg-out destination lists.
+// GET lists the entries,
+// POST adds or replaces the entry given as a JSON destination,
+// and DELETE removes the entry for the address parameter.
+// Held exports are reconsidered after each change.
+func (c *Custodian) Destinations(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	source := "admin-api " + req.RemoteAddr
+	switch req.Method {
+	case http.MethodGet:
+		entries := []destination{}
+		const q = `SELECT address, list, note, time_ms FROM peg_out_destinations ORDER BY address`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(address, list, note string, timeMS int64) {
+			entries = append(entries, destination{Address: address, List: list, Note: note, TimeMS: timeMS})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading peg-out destinations: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+
+	case http.MethodPost:
+		var d destination
+		err := json.NewDecoder(req.Body).Decode(&d)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+			return
+		}
+		if d.List != "allow" && d.List != "deny" {
+			net.Errorf(w, http.StatusBadRequest, "list %q must be allow or deny", d.List)
+			return
+		}
+		d.Address, err = canonicalAddress(d.Address)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		const q = `INSERT INTO peg_out_destinations (address, list, note, time_ms) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (address) DO UPDATE SET list=excluded.list, note=excluded.note, time_ms=excluded.time_ms`
+		_, err = c.DB.ExecContext(ctx, q, d.Address, d.List, d.Note, c.nowMS())
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "recording peg-out destination: %s", err)
+			return
+		}
+		err = c.recordAudit(ctx, "destination."+d.List, source, fmt.Sprintf("%s: %s", d.Address, d.Note))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+
+	case http.MethodDelete:
+		addr, err := canonicalAddress(req.FormValue("address"))
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		res, err := c.DB.ExecContext(ctx, `DELETE FROM peg_out_destinations WHERE address=$1`, addr)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "removing peg-out destination: %s", err)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			net.Errorf(w, http.StatusNotFound, "%s is on neither list", addr)
+			return
+		}
+		err = c.recordAudit(ctx, "destination.remove", source, addr)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "peg-out destinations support GET, POST, and DELETE")
+		return
+	}
+	if c.exports != nil {
+		c.exports.Broadcast()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/screening"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestDestinations(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		screener := &testScreener{results: make(map[string]screening.Result)}
+		cfg := config.Default()
+		c := &Custodian{DB: db, screener: screener, cfg: cfg}
+
+		lumenXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &pegOut{TxID: []byte("export"), AssetXDR: lumenXDR, Amount: 10, Exporter: importTestAccountID, Pubkey: testRecipPubKey}
+		_, err = db.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, '', 0, $4, x'', $5)", p.TxID, p.Amount, p.AssetXDR, p.Exporter, p.Pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		screener.results[hex.EncodeToString(p.TxID)] = screening.Result{Decision: screening.Approve}
+
+		do := func(method, target, body string, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.Destinations(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from %s %s, want %d: %s", w.Code, method, target, wantCode, w.Body)
+			}
+			return w
+		}
+		check := func(want bool) {
+			t.Helper()
+			ok, err := c.screenPegOut(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("screening export gave %v, want %v", ok, want)
+			}
+			var state pegOutState
+			err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != pegOutNotYet {
+				t.Errorf("export is in state %s, want %s", state, pegOutNotYet)
+			}
+		}
+
+		do("POST", "/admin/destinations", `{"address": "GNOTANACCOUNT", "list": "deny"}`, http.StatusBadRequest)
+		do("POST", "/admin/destinations", `{"address": "`+importTestAccountID+`", "list": "maybe"}`, http.StatusBadRequest)
+
+		// Under the denylist policy, only denied destinations are held.
+		check(true)
+		do("POST", "/admin/destinations", `{"address": "`+importTestAccountID+`", "list": "deny", "note": "reported"}`, http.StatusNoContent)
+		check(false)
+		check(false)
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, pegOutBlockedAlert, p.TxID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d %s alerts, want 1", n, pegOutBlockedAlert)
+		}
+
+		var entries []destination
+		err = json.NewDecoder(do("GET", "/admin/destinations", "", http.StatusOK).Body).Decode(&entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Address != importTestAccountID || entries[0].List != "deny" || entries[0].Note != "reported" {
+			t.Errorf("got destinations %+v, want %s denied", entries, importTestAccountID)
+		}
+
+		do("DELETE", "/admin/destinations?address="+importTestAccountID, "", http.StatusNoContent)
+		do("DELETE", "/admin/destinations?address="+importTestAccountID, "", http.StatusNotFound)
+		check(true)
+
+		// Under the allowlist policy, only allowed destinations are released.
+		cfg.PegOut.DestinationPolicy = "allowlist"
+		check(false)
+		do("POST", "/admin/destinations", `{"address": "`+importTestAccountID+`", "list": "allow"}`, http.StatusNoContent)
+		check(true)
+
+		for _, action := range []string{"destination.deny", "destination.remove", "destination.allow", "pegout.blocked"} {
+			err = db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE action=$1`, action).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("got %d %s audit entries, want 1", n, action)
+			}
+		}
+	})
+}
@@ -0,0 +1,448 @@
+//go:build e2e
+// +build e2e
+
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+// The end-to-end tests run the custodian against a standalone Stellar network.
+// By default they start one in Docker from the stellar/quickstart image;
+// set SLIDECHAIN_E2E_HORIZON (and SLIDECHAIN_E2E_FRIENDBOT)
+// to use an already-running network instead.
+//
+//	go test -tags e2e -run E2E -timeout 20m
+const quickstartImage = "stellar/quickstart"
+
+var (
+	e2eHorizonURL   string
+	e2eFriendbotURL string
+	e2eContainer    string
+)
+
+func TestMain(m *testing.M) {
+	err := startStellar()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "starting standalone Stellar network: %s\n", err)
+		stopStellar()
+		os.Exit(1)
+	}
+	code := m.Run()
+	stopStellar()
+	os.Exit(code)
+}
+
+func startStellar() error {
+	e2eHorizonURL = os.Getenv("SLIDECHAIN_E2E_HORIZON")
+	e2eFriendbotURL = os.Getenv("SLIDECHAIN_E2E_FRIENDBOT")
+	if e2eHorizonURL == "" {
+		out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::8000", quickstartImage, "--standalone").Output()
+		if err != nil {
+			return fmt.Errorf("docker run: %s", err)
+		}
+		e2eContainer = strings.TrimSpace(string(out))
+		out, err = exec.Command("docker", "port", e2eContainer, "8000").Output()
+		if err != nil {
+			return fmt.Errorf("docker port: %s", err)
+		}
+		hostport := strings.TrimSpace(strings.Split(string(out), "\n")[0])
+		e2eHorizonURL = "http://" + hostport
+	}
+	if e2eFriendbotURL == "" {
+		e2eFriendbotURL = e2eHorizonURL + "/friendbot"
+	}
+
+	// Wait for Horizon to ingest ledgers and friendbot to be funded.
+	hc := hclient(e2eHorizonURL)
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		root, err := hc.Root()
+		if err == nil && root.HorizonSequence <= 2 {
+			err = fmt.Errorf("horizon at ledger %d", root.HorizonSequence)
+		}
+		if err == nil {
+			var kp *keypair.Full
+			kp, err = keypair.Random()
+			if err != nil {
+				return err
+			}
+			err = stellar.FundAccountFrom(e2eFriendbotURL, kp.Address())
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for Horizon at %s: %s", e2eHorizonURL, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func stopStellar() {
+	if e2eContainer != "" {
+		exec.Command("docker", "rm", "-f", e2eContainer).Run()
+	}
+}
+
+// e2eCustodian is a custodian and its HTTP server,
+// which can be stopped and restarted on the same db
+// to simulate a process restart.
+type e2eCustodian struct {
+	t      *testing.T
+	cfg    *config.Config
+	dbs    []*sql.DB
+	c      *Custodian
+	srv    *httptest.Server
+	cancel context.CancelFunc
+}
+
+func newE2ECustodian(t *testing.T) *e2eCustodian {
+	dir, err := ioutil.TempDir("", "slidechain-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.DB = filepath.Join(dir, "slidechain.db")
+	cfg.BlockInterval = config.Duration(time.Second)
+	cfg.Horizon.URL = e2eHorizonURL
+	cfg.Horizon.FriendbotURL = e2eFriendbotURL
+	e := &e2eCustodian{t: t, cfg: cfg}
+	e.start()
+	return e
+}
+
+func (e *e2eCustodian) start() {
+	db, err := sql.Open("sqlite3", e.cfg.DB)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.dbs = append(e.dbs, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := GetCustodian(ctx, db, e.cfg)
+	if err != nil {
+		cancel()
+		e.t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/submit", c.S)
+	mux.HandleFunc("/get", c.S.Get)
+	mux.HandleFunc("/account", c.Account)
+	mux.HandleFunc("/prepegin", c.DoPrePegIn)
+	e.c, e.srv, e.cancel = c, httptest.NewServer(mux), cancel
+}
+
+// stop shuts down the custodian's goroutines and server.
+// Its db is left open until close,
+// since goroutines may still be finishing with it.
+func (e *e2eCustodian) stop() {
+	e.srv.Close()
+	e.cancel()
+	time.Sleep(time.Second)
+}
+
+func (e *e2eCustodian) restart() {
+	e.t.Log("restarting custodian")
+	e.stop()
+	e.start()
+}
+
+func (e *e2eCustodian) close() {
+	e.stop()
+	for _, db := range e.dbs {
+		db.Close()
+	}
+	os.RemoveAll(filepath.Dir(e.cfg.DB))
+}
+
+// e2eUser is a Stellar account with a matching txvm key.
+type e2eUser struct {
+	kp  *keypair.Full
+	pub ed25519.PublicKey
+	prv ed25519.PrivateKey
+}
+
+func newE2EUser(t *testing.T) *e2eUser {
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seed [32]byte
+	copy(seed[:], prv)
+	kp, err := keypair.FromRawSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stellar.FundAccountFrom(e2eFriendbotURL, kp.Address())
+	if err != nil {
+		t.Fatalf("funding %s: %s", kp.Address(), err)
+	}
+	return &e2eUser{kp: kp, pub: pub, prv: prv}
+}
+
+var e2eNative = stellar.NativeAsset()
+
+// prePegIn asks the custodian to record a peg-in of amount lumens for u,
+// returning the nonce hash to use as the peg-in tx memo.
+func (e *e2eCustodian) prePegIn(ctx context.Context, u *e2eUser, amount xlm.Amount) [32]byte {
+	assetXDR, err := e2eNative.MarshalBinary()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	body, err := json.Marshal(PrePegIn{
+		BcID:        e.c.InitBlockHash.Bytes(),
+		Amount:      int64(amount),
+		AssetXDR:    assetXDR,
+		RecipPubkey: u.pub,
+		ExpMS:       int64(bc.Millis(time.Now().Add(10 * time.Minute))),
+	})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", e.srv.URL+"/prepegin", bytes.NewReader(body))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e.t.Fatalf("status %d from /prepegin: %s", resp.StatusCode, respBody)
+	}
+	var nonceHash [32]byte
+	copy(nonceHash[:], respBody)
+	return nonceHash
+}
+
+func (e *e2eCustodian) pegIn(u *e2eUser, nonceHash [32]byte, amount xlm.Amount) {
+	hc := hclient(e2eHorizonURL)
+	_, err := stellar.NewSequencer(hc).Submit(u.kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return stellar.BuildPegInTx(u.kp.Address(), seqnum, nonceHash, amount.HorizonString(), "", "", e.c.AccountID, hc)
+	}, u.kp.Seed())
+	if err != nil {
+		e.t.Fatalf("submitting peg-in tx: %s", err)
+	}
+}
+
+// waitImported waits for the peg-in with the given nonce hash to be imported
+// and returns the anchor of the imported value.
+func (e *e2eCustodian) waitImported(ctx context.Context, u *e2eUser, nonceHash [32]byte, amount xlm.Amount) []byte {
+	assetXDR, err := e2eNative.MarshalBinary()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.waitFor(ctx, "import", func() bool {
+		var state pegInState
+		err := e.c.DB.QueryRowContext(ctx, `SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash[:]).Scan(&state)
+		return err == nil && state == pegInImported
+	})
+	var anchor []byte
+	e.waitFor(ctx, "import tx in a block", func() bool {
+		e.scanBlocks(ctx, func(tx *bc.Tx) bool {
+			if isImportTx(tx, int64(amount), assetXDR, u.pub) {
+				anchor = txresult.New(tx).Outputs[0].Value.Anchor
+				return true
+			}
+			return false
+		})
+		return anchor != nil
+	})
+	return anchor
+}
+
+// export retires exportAmount of the inputAmount imported at anchor,
+// returning the temp account and its sequence number.
+func (e *e2eCustodian) export(ctx context.Context, u *e2eUser, anchor []byte, inputAmount, exportAmount xlm.Amount) (string, stellar.SequenceNumber) {
+	tempAddr, seqnum, err := SubmitPreExportTx(hclient(e2eHorizonURL), u.kp, e.c.AccountID, e2eNative, int64(exportAmount), TimeBounds{}, Destination{})
+	if err != nil {
+		e.t.Fatalf("submitting pre-export tx: %s", err)
+	}
+	exportTx, err := BuildExportTx(ctx, e2eNative, 1, int64(exportAmount), int64(inputAmount), tempAddr, anchor, u.prv, seqnum, TimeBounds{}, Destination{})
+	if err != nil {
+		e.t.Fatalf("building export tx: %s", err)
+	}
+	txbits, err := proto.Marshal(&exportTx.RawTx)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", e.srv.URL+"/submit?wait=1", bytes.NewReader(txbits))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.t.Fatalf("status code %d from POST /submit?wait=1", resp.StatusCode)
+	}
+	return tempAddr, seqnum
+}
+
+// waitPegOut waits for the export from tempAddr to be paid out on Stellar
+// and retired on txvm.
+func (e *e2eCustodian) waitPegOut(ctx context.Context, u *e2eUser, anchor []byte, tempAddr string, seqnum stellar.SequenceNumber, exportAmount xlm.Amount) {
+	e.waitFor(ctx, "peg-out", func() bool {
+		var peggedOut pegOutState
+		err := e.c.DB.QueryRowContext(ctx, `SELECT pegged_out FROM exports WHERE temp_addr=$1`, tempAddr).Scan(&peggedOut)
+		if err == nil && (peggedOut == pegOutFail || peggedOut == pegOutRefunded) {
+			e.t.Fatalf("peg-out from %s failed", tempAddr)
+		}
+		return err == nil && (peggedOut == pegOutOK || peggedOut == pegOutRetired)
+	})
+	if _, err := hclient(e2eHorizonURL).LoadAccount(tempAddr); err == nil {
+		e.t.Errorf("temp account %s still exists after peg-out", tempAddr)
+	}
+
+	retireAnchor1 := txvm.VMHash("Split2", anchor)
+	retireAnchor := txvm.VMHash("Split1", retireAnchor1[:])
+	found := false
+	e.waitFor(ctx, "post-peg-out tx in a block", func() bool {
+		e.scanBlocks(ctx, func(tx *bc.Tx) bool {
+			found = isPostPegOutTx(tx, e2eNative, int64(exportAmount), tempAddr, u.kp.Address(), int64(seqnum), retireAnchor[:], u.pub)
+			return found
+		})
+		return found
+	})
+}
+
+// scanBlocks calls f on each tx in the chain until it returns true.
+func (e *e2eCustodian) scanBlocks(ctx context.Context, f func(*bc.Tx) bool) {
+	height, err := e.c.BS.Height(ctx)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	for h := uint64(1); h <= height; h++ {
+		b, err := e.c.BS.GetBlock(ctx, h)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		for _, tx := range b.Transactions {
+			if f(tx) {
+				return
+			}
+		}
+	}
+}
+
+func (e *e2eCustodian) waitFor(ctx context.Context, what string, cond func() bool) {
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			e.t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func TestE2EPegInPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	e := newE2ECustodian(t)
+	defer e.close()
+	u := newE2EUser(t)
+
+	nonceHash := e.prePegIn(ctx, u, 5*xlm.Lumen)
+	e.pegIn(u, nonceHash, 5*xlm.Lumen)
+	anchor := e.waitImported(ctx, u, nonceHash, 5*xlm.Lumen)
+	tempAddr, seqnum := e.export(ctx, u, anchor, 5*xlm.Lumen, 3*xlm.Lumen)
+	e.waitPegOut(ctx, u, anchor, tempAddr, seqnum, 3*xlm.Lumen)
+}
+
+// TestE2ERestartDuringPegIn stops the custodian after the pre-peg-in
+// and makes the Stellar peg-in payment while it is down.
+// The restarted custodian must find the payment from its stored cursor
+// and import it.
+func TestE2ERestartDuringPegIn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	e := newE2ECustodian(t)
+	defer e.close()
+	u := newE2EUser(t)
+
+	nonceHash := e.prePegIn(ctx, u, 5*xlm.Lumen)
+	e.stop()
+	e.pegIn(u, nonceHash, 5*xlm.Lumen)
+	e.start()
+	anchor := e.waitImported(ctx, u, nonceHash, 5*xlm.Lumen)
+	tempAddr, seqnum := e.export(ctx, u, anchor, 5*xlm.Lumen, 5*xlm.Lumen)
+	e.waitPegOut(ctx, u, anchor, tempAddr, seqnum, 5*xlm.Lumen)
+}
+
+// TestE2ERestartDuringPegOut restarts the custodian
+// as soon as the export tx is on txvm.
+// The restarted custodian must complete the peg-out exactly once.
+func TestE2ERestartDuringPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	e := newE2ECustodian(t)
+	defer e.close()
+	u := newE2EUser(t)
+
+	nonceHash := e.prePegIn(ctx, u, 5*xlm.Lumen)
+	e.pegIn(u, nonceHash, 5*xlm.Lumen)
+	anchor := e.waitImported(ctx, u, nonceHash, 5*xlm.Lumen)
+
+	before, err := hclient(e2eHorizonURL).LoadAccount(u.kp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempAddr, seqnum := e.export(ctx, u, anchor, 5*xlm.Lumen, 3*xlm.Lumen)
+	e.restart()
+	e.waitPegOut(ctx, u, anchor, tempAddr, seqnum, 3*xlm.Lumen)
+
+	after, err := hclient(e2eHorizonURL).LoadAccount(u.kp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotIncrease := nativeBalance(t, after) - nativeBalance(t, before)
+	// The user receives the payment plus the temp account's merged balance,
+	// less the fee for the pre-export tx, but never the payment twice.
+	if gotIncrease < 3*xlm.Lumen-xlm.Lumen || gotIncrease >= 6*xlm.Lumen {
+		t.Errorf("balance increased by %s, want about %s", gotIncrease, 3*xlm.Lumen)
+	}
+}
+
+func nativeBalance(t *testing.T, acct stellar.Account) xlm.Amount {
+	for _, b := range acct.Balances {
+		if b.AssetType == "native" {
+			amt, err := xlm.Parse(b.Balance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return amt
+		}
+	}
+	t.Fatalf("no native balance in account %s", acct.AccountID)
+	return 0
+}
@@ -0,0 +1,91 @@
+// Package errors defines the errors the slidechain custodian
+// gives for conditions a client can act on,
+// and the HTTP status with which each is reported.
+//
+// The errors are wrapped with github.com/chain/txvm/errors like any other;
+// use Is, not ==, to test for one,
+// since it looks through the typed errors here as well as through Wrap.
+package errors
+
+import (
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+)
+
+var (
+	// ErrNoTrustline means a Stellar account cannot receive an asset
+	// for want of a trustline to it.
+	ErrNoTrustline = errors.New("no trustline for asset")
+
+	// ErrNotAuthorized means a Stellar account cannot receive an asset
+	// until the asset's issuer authorizes its trustline.
+	ErrNotAuthorized = errors.New("trustline not authorized")
+
+	// ErrInsufficientReserve means the custodian account
+	// lacks the lumens to fund an operation.
+	ErrInsufficientReserve = errors.New("insufficient reserve")
+
+	// ErrUnknownAsset means an asset is not one the custodian pegs.
+	ErrUnknownAsset = errors.New("unknown asset")
+
+	// ErrDuplicateDeposit means a deposit reuses the nonce
+	// of a peg-in whose deposit was already recorded.
+	ErrDuplicateDeposit = errors.New("duplicate deposit")
+)
+
+// AssetError is an error concerning a particular asset,
+// named "native" or "CODE:ISSUER".
+type AssetError struct {
+	Asset string
+	Err   error
+}
+
+func (e *AssetError) Error() string {
+	return e.Err.Error() + " " + e.Asset
+}
+
+// Unwrap returns the error e wraps.
+func (e *AssetError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether err is target
+// or wraps it.
+func Is(err, target error) bool {
+	for err != nil {
+		err = errors.Root(err)
+		if err == target {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+var statuses = []struct {
+	err    error
+	status int
+}{
+	{ErrNoTrustline, http.StatusUnprocessableEntity},
+	{ErrNotAuthorized, http.StatusUnprocessableEntity},
+	{ErrInsufficientReserve, http.StatusServiceUnavailable},
+	{ErrUnknownAsset, http.StatusForbidden},
+	{ErrDuplicateDeposit, http.StatusConflict},
+}
+
+// Status returns the HTTP status code for reporting err:
+// that of the error in this package it wraps,
+// or 500 Internal Server Error if it wraps none.
+func Status(err error) int {
+	for _, s := range statuses {
+		if Is(err, s.err) {
+			return s.status
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,254 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// ledgerInterval is the usual time between Stellar ledgers.
+const ledgerInterval = 5 * time.Second
+
+// estimateSamples is how many recent peg-outs
+// an export's completion time is estimated from.
+const estimateSamples = 20
+
+// ExportEstimate is the response of /export-estimate,
+// the cost and duration of an export before it is built.
+// Fees are in stroops of lumens, paid by the exporter's Stellar account;
+// amounts are in stroops of the exported asset.
+type ExportEstimate struct {
+	Asset       string `json:"asset"`
+	Amount      int64  `json:"amount"`
+	Destination string `json:"destination"`
+
+	// PreExportFee is the fee of the two pre-export txs,
+	// which create the temporary account and set its signers.
+	PreExportFee int64 `json:"pre_export_fee"`
+
+	// PegOutFee is the fee of the peg-out tx
+	// at the fee level current network fees call for,
+	// and MaxPegOutFee is its fee at the highest level.
+	// It is paid from the temporary account.
+	PegOutFee    int64 `json:"peg_out_fee"`
+	MaxPegOutFee int64 `json:"max_peg_out_fee"`
+
+	// NetworkFee is PreExportFee plus PegOutFee.
+	NetworkFee int64 `json:"network_fee"`
+
+	// TempAccountBalance is the lumens the exporter funds the temporary account with.
+	// The peg-out merges them back, less PegOutFee.
+	TempAccountBalance int64 `json:"temp_account_balance"`
+
+	// CustodianFee is the custodian's charge, in the exported asset.
+	// There is none.
+	CustodianFee int64 `json:"custodian_fee"`
+
+	// MinReceived is the least the destination receives.
+	// A peg-out is a payment, not a path payment,
+	// so it is always Amount less CustodianFee.
+	MinReceived int64 `json:"min_received"`
+
+	// EstimatedSeconds is how long the export is expected to take
+	// from its submission to txvm to its payment on Stellar.
+	EstimatedSeconds int64 `json:"estimated_seconds"`
+
+	// MinSeqAge and MaxLedgers are the preconditions
+	// that pegout.min_seq_age and pegout.max_ledgers require
+	// of the peg-out tx, and so of the pre-export tx that preauthorizes it:
+	// a minimum sequence age of at least MinSeqAge seconds
+	// and, if MaxLedgers is positive, ledger bounds no wider.
+	// An export without them is refunded.
+	MinSeqAge  int64 `json:"min_seq_age,omitempty"`
+	MaxLedgers int   `json:"max_ledgers,omitempty"`
+
+	// Holds lists what would now hold the export
+	// before it is pegged out.
+	Holds []string `json:"holds,omitempty"`
+}
+
+// EstimateExport is the handler for /export-estimate.
+// Its parameters are the asset ("native" or "CODE:ISSUER"),
+// the amount in stroops,
+// and the destination Stellar account, which is the exporter's.
+func (c *Custodian) EstimateExport(w http.ResponseWriter, req *http.Request) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		net.Errorf(w, http.StatusNotFound, "custodian has no Stellar account")
+		return
+	}
+	ctx := req.Context()
+	asset, err := stellar.ParseAssetKey(req.FormValue("asset"))
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing asset: %s", err)
+		return
+	}
+	amount, err := strconv.ParseInt(req.FormValue("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		net.Errorf(w, http.StatusBadRequest, "amount must be a positive number of stroops")
+		return
+	}
+	dest := req.FormValue("destination")
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, stellar.BaseAccount(dest)); err != nil {
+		net.Errorf(w, http.StatusBadRequest, "destination %q is not a Stellar account ID", dest)
+		return
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "marshaling asset: %s", err)
+		return
+	}
+	allowed, err := c.assetAllowed(assetXDR)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+		return
+	}
+	if !allowed {
+		wrapped, err := c.wrappedAssetByXDR(ctx, assetXDR)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+			return
+		}
+		allowed = wrapped != nil
+	}
+	if !allowed {
+		err = &scerrors.AssetError{Asset: stellar.AssetKey(asset), Err: scerrors.ErrUnknownAsset}
+		net.Errorf(w, scerrors.Status(err), "%s", err)
+		return
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	hclient := stellar.WithContext(tctx, sc.hclient)
+	acct, err := hclient.LoadAccount(dest)
+	if stellar.IsNotFound(err) {
+		net.Errorf(w, http.StatusUnprocessableEntity, "destination account %s does not exist", dest)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusBadGateway, "loading destination account: %s", err)
+		return
+	}
+	if !hasTrustline(acct, asset) {
+		err = &scerrors.AssetError{Asset: stellar.AssetKey(asset), Err: scerrors.ErrNoTrustline}
+		net.Errorf(w, scerrors.Status(err), "destination %s: %s", dest, err)
+		return
+	}
+
+	// A peg-out that Stellar's fees outbid is bumped a fee level
+	// each time it is stuck.
+	level := 0
+	if fee, err := stellar.AcceptedFee(tctx, sc.hclient); err == nil {
+		for level < len(pegOutFees)-1 && pegOutFees[level] < uint64(fee) {
+			level++
+		}
+	}
+	const pegOutOps = 2 // merge and payment
+	est := ExportEstimate{
+		Asset:              stellar.AssetKey(asset),
+		Amount:             amount,
+		Destination:        dest,
+		PreExportFee:       baseFee * (1 + int64(len(pegOutFees)+1)), // one op, then a signer per fee level and the thresholds
+		PegOutFee:          pegOutOps * int64(pegOutFees[level]),
+		MaxPegOutFee:       pegOutOps * int64(pegOutFees[len(pegOutFees)-1]),
+		TempAccountBalance: int64(tempAccountBalance),
+		MinReceived:        amount,
+		MinSeqAge:          int64(time.Duration(c.pegOutConfig().MinSeqAge) / time.Second),
+		MaxLedgers:         c.pegOutConfig().MaxLedgers,
+	}
+	est.NetworkFee = est.PreExportFee + est.PegOutFee
+
+	estimate := c.blockInterval() + ledgerInterval + time.Duration(level)*time.Duration(c.pegOutConfig().StuckAfter)
+	recent, err := c.recentPegOutDuration(ctx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if recent > estimate {
+		estimate = recent
+	}
+	est.EstimatedSeconds = int64((estimate + time.Second - 1) / time.Second)
+
+	paused, err := c.paused(ctx, pausePegOut)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if paused {
+		est.Holds = append(est.Holds, "peg-outs are paused")
+	}
+	destOK, err := c.destinationAllowed(ctx, dest)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if !destOK {
+		est.Holds = append(est.Holds, "the destination is blocked")
+	}
+	if cfg := c.config(); cfg != nil && cfg.TravelRule.Key != "" {
+		if threshold, ok := travelRuleThreshold(cfg.TravelRule, est.Asset); ok && amount >= threshold {
+			est.Holds = append(est.Holds, "travel-rule information is required")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(est)
+}
+
+// hasTrustline reports whether acct can receive asset.
+func hasTrustline(acct stellar.Account, asset stellar.Asset) bool {
+	if asset.IsNative() {
+		return true
+	}
+	for _, bal := range acct.Balances {
+		if bal.AssetCode == asset.Code && bal.AssetIssuer == asset.Issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// blockInterval is the expected time between txvm blocks.
+func (c *Custodian) blockInterval() time.Duration {
+	if c.S != nil && c.S.blockInterval > 0 {
+		return c.S.blockInterval
+	}
+	if cfg := c.config(); cfg != nil {
+		return time.Duration(cfg.BlockInterval)
+	}
+	return time.Duration(config.Default().BlockInterval)
+}
+
+// recentPegOutDuration is the median time
+// from recording to successful peg-out
+// of the most recent exports,
+// or zero if there are none.
+func (c *Custodian) recentPegOutDuration(ctx context.Context) (time.Duration, error) {
+	const q = `SELECT ok.time_ms - rec.time_ms FROM state_events ok
+		JOIN state_events rec ON rec.kind='export' AND rec.key=ok.key AND rec.from_state=''
+		WHERE ok.kind='export' AND ok.to_state=$1
+		ORDER BY ok.id DESC LIMIT $2`
+	var durations []int64
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutOK.String(), estimateSamples, func(ms int64) {
+		durations = append(durations, ms)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "reading recent peg-outs")
+	}
+	if len(durations) == 0 {
+		return 0, nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return time.Duration(durations[len(durations)/2]) * time.Millisecond, nil
+}
@@ -0,0 +1,104 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestEstimateExport(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	destKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(destKP.Address(), horizonmock.FriendbotAmount)
+	missingKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credit := "USD:" + custKP.Address()
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Assets.Allowlist = []string{"native", credit}
+	cfg.Admin.PauseFile = ""
+	cfg.PegOut.MinSeqAge = config.Duration(time.Minute)
+	cfg.PegOut.MaxLedgers = 100
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate := func(asset, dest string, wantCode int) ExportEstimate {
+			t.Helper()
+			q := url.Values{"asset": {asset}, "amount": {"1000"}, "destination": {dest}}
+			w := httptest.NewRecorder()
+			c.EstimateExport(w, httptest.NewRequest("GET", "/export-estimate?"+q.Encode(), nil))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d estimating %s to %s, want %d: %s", w.Code, asset, dest, wantCode, w.Body)
+			}
+			var est ExportEstimate
+			if w.Code == http.StatusOK {
+				err := json.NewDecoder(w.Body).Decode(&est)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return est
+		}
+
+		est := estimate("native", destKP.Address(), http.StatusOK)
+		want := ExportEstimate{
+			Asset:              "native",
+			Amount:             1000,
+			Destination:        destKP.Address(),
+			PreExportFee:       500,
+			PegOutFee:          200,
+			MaxPegOutFee:       20000,
+			NetworkFee:         700,
+			TempAccountBalance: int64(tempAccountBalance),
+			MinReceived:        1000,
+			MinSeqAge:          60,
+			MaxLedgers:         100,
+			EstimatedSeconds:   int64((time.Duration(cfg.BlockInterval) + ledgerInterval) / time.Second),
+		}
+		if !reflect.DeepEqual(est, want) {
+			t.Errorf("got estimate %+v, want %+v", est, want)
+		}
+
+		estimate(credit, destKP.Address(), http.StatusUnprocessableEntity) // no trustline
+		estimate("native", missingKP.Address(), http.StatusUnprocessableEntity)
+		estimate("EUR:"+custKP.Address(), destKP.Address(), http.StatusForbidden)
+
+		err = c.pausePeg(ctx, "test", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est := estimate("native", destKP.Address(), http.StatusOK); len(est.Holds) != 1 {
+			t.Errorf("got holds %q while paused, want one", est.Holds)
+		}
+	})
+}
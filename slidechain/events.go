@@ -0,0 +1,175 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+)
+
+// The state_events table is the append-only log of every peg-in and export:
+// each is recorded with an event from the empty state,
+// and every later change of its state goes through transition,
+// which appends the event in the same db transaction.
+// The state columns of pegs and exports are projections of it,
+// which ProjectStates checks and rebuilds,
+// and the events view names each event by what it records,
+// such as deposit_detected or pegout_submitted,
+// for audits and new read models.
+
+// A projection is a table whose state column is projected
+// from the state events of one kind.
+type projection struct {
+	kind, table, keyCol, stateCol string
+	names                         []string // state names, by value
+	allowed                       func(from, to int) bool
+	removed                       int // the state whose rows are removed from table, or -1
+}
+
+var projections = []projection{
+	{
+		kind: "peg-in", table: "pegs", keyCol: "nonce_hash", stateCol: "state",
+		names:   pegInStateNames,
+		allowed: func(from, to int) bool { return pegInAllowed(pegInState(from), pegInState(to)) },
+		removed: int(pegInExpired),
+	},
+	{
+		kind: "export", table: "exports", keyCol: "txid", stateCol: "pegged_out",
+		names:   pegOutStateNames,
+		allowed: func(from, to int) bool { return pegOutAllowed(pegOutState(from), pegOutState(to)) },
+		removed: -1,
+	},
+}
+
+// ProjectionReport is the result of ProjectStates.
+type ProjectionReport struct {
+	Events   int          `json:"events"`
+	Invalid  []string     `json:"invalid,omitempty"`  // events that do not follow from the ones before
+	Drift    []StateDrift `json:"drift,omitempty"`    // rows whose state differs from the log's
+	Missing  []string     `json:"missing,omitempty"`  // logged peg-ins and exports with no row, other than expired peg-ins
+	Unlogged int          `json:"unlogged,omitempty"` // rows with no events, from before the log
+}
+
+// StateDrift is a peg-in or export
+// whose state column differs from the state its events project.
+type StateDrift struct {
+	Kind  string `json:"kind"`
+	Key   string `json:"key"` // hex
+	Table string `json:"table_state"`
+	Log   string `json:"log_state"`
+	Fixed bool   `json:"fixed,omitempty"`
+}
+
+// ProjectStates replays the state events of db in order,
+// checking that each follows from the state before it,
+// and compares the state each peg-in and export ends in
+// with its row in pegs or exports.
+// With fix, it sets each drifted row's state to the log's.
+// Rows of other tables are not yet projected from the log.
+func ProjectStates(ctx context.Context, db *sql.DB, fix bool) (*ProjectionReport, error) {
+	err := setSchema(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting db schema")
+	}
+	r := new(ProjectionReport)
+	for _, p := range projections {
+		err = p.project(ctx, db, fix, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// project replays p's events and checks its table against them,
+// adding what it finds to r.
+func (p projection) project(ctx context.Context, db *sql.DB, fix bool, r *ProjectionReport) error {
+	state := make(map[string]int)
+	var order []string
+	const q = `SELECT id, key, from_state, to_state FROM state_events WHERE kind=$1 ORDER BY id`
+	err := sqlutil.ForQueryRows(ctx, db, q, p.kind, func(id int64, key []byte, from, to string) {
+		r.Events++
+		k := string(key)
+		cur, seen := state[k]
+		toState := p.stateOf(to)
+		switch {
+		case toState < 0:
+			r.Invalid = append(r.Invalid, fmt.Sprintf("event %d: %s %x: unknown state %q", id, p.kind, key, to))
+			return
+		case !seen && from != "":
+			r.Invalid = append(r.Invalid, fmt.Sprintf("event %d: %s %x: first event is from %s, not new", id, p.kind, key, from))
+		case seen && from != p.names[cur]:
+			r.Invalid = append(r.Invalid, fmt.Sprintf("event %d: %s %x: from %s, but its state was %s", id, p.kind, key, from, p.names[cur]))
+		case seen && !p.allowed(cur, toState):
+			r.Invalid = append(r.Invalid, fmt.Sprintf("event %d: %s %x: transition from %s to %s not allowed", id, p.kind, key, from, to))
+		}
+		if !seen {
+			order = append(order, k)
+		}
+		state[k] = toState
+	})
+	if err != nil {
+		return errors.Wrapf(err, "reading %s events", p.kind)
+	}
+
+	var logged int
+	for _, k := range order {
+		var got int
+		sel := fmt.Sprintf(`SELECT %s FROM %s WHERE %s=$1`, p.stateCol, p.table, p.keyCol)
+		err = db.QueryRowContext(ctx, sel, []byte(k)).Scan(&got)
+		if err == sql.ErrNoRows && state[k] == p.removed {
+			continue
+		}
+		if err == sql.ErrNoRows {
+			r.Missing = append(r.Missing, fmt.Sprintf("%s %x", p.kind, k))
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading %s %x", p.kind, k)
+		}
+		logged++
+		want := state[k]
+		if got == want {
+			continue
+		}
+		d := StateDrift{Kind: p.kind, Key: hex.EncodeToString([]byte(k)), Table: p.name(got), Log: p.names[want]}
+		if fix {
+			upd := fmt.Sprintf(`UPDATE %s SET %s=$1 WHERE %s=$2`, p.table, p.stateCol, p.keyCol)
+			_, err = db.ExecContext(ctx, upd, want, []byte(k))
+			if err != nil {
+				return errors.Wrapf(err, "rebuilding state of %s %x", p.kind, k)
+			}
+			d.Fixed = true
+		}
+		r.Drift = append(r.Drift, d)
+	}
+
+	var total int
+	err = db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, p.table)).Scan(&total)
+	if err != nil {
+		return errors.Wrapf(err, "counting %s", p.table)
+	}
+	r.Unlogged += total - logged
+	return nil
+}
+
+// stateOf returns the value of the state named s, or -1.
+func (p projection) stateOf(s string) int {
+	for i, name := range p.names {
+		if name == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// name returns the name of state value v.
+func (p projection) name(v int) string {
+	if v < 0 || v >= len(p.names) {
+		return fmt.Sprintf("%s state %d", p.kind, v)
+	}
+	return p.names[v]
+}
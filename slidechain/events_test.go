@@ -0,0 +1,117 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestProjectStates(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{
+			DB:  db,
+			now: func() time.Time { return time.Unix(1, 0) },
+		}
+		nonceHash := []byte("nonce hash")
+		dbtx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dbtx.Exec(`INSERT INTO pegs (nonce_hash, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, 0, $3)`, nonceHash, []byte{}, pegInRecorded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = recordStateEvent(ctx, dbtx, c.nowMS(), "peg-in", nonceHash, "", pegInRecorded.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dbtx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.transitionPegIn(ctx, nonceHash, pegInRecorded, pegInPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A peg-in from before the log.
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, 0, $3)`, []byte("old"), []byte{}, pegInImported)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		err = func() error {
+			rows, err := db.Query(`SELECT name FROM events WHERE key=$1 ORDER BY id`, nonceHash)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					return err
+				}
+				names = append(names, name)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 || names[0] != "peg_in_recorded" || names[1] != "deposit_detected" {
+			t.Errorf("got events %q, want peg_in_recorded and deposit_detected", names)
+		}
+
+		r, err := ProjectStates(ctx, db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Events != 2 || len(r.Invalid) != 0 || len(r.Drift) != 0 || len(r.Missing) != 0 || r.Unlogged != 1 {
+			t.Errorf("got report %+v, want 2 consistent events and 1 unlogged peg-in", r)
+		}
+
+		// Surgery on the state column drifts from the log, and -fix rebuilds it.
+		_, err = db.Exec(`UPDATE pegs SET state=$1 WHERE nonce_hash=$2`, pegInImported, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fix := range []bool{false, true} {
+			r, err = ProjectStates(ctx, db, fix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := StateDrift{Kind: "peg-in", Key: hex.EncodeToString(nonceHash), Table: "imported", Log: "paid", Fixed: fix}
+			if len(r.Drift) != 1 || r.Drift[0] != want {
+				t.Errorf("fix=%v: got drift %+v, want %+v", fix, r.Drift, want)
+			}
+		}
+		var state pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegInPaid {
+			t.Errorf("got rebuilt state %s, want paid", state)
+		}
+
+		// An event that skips a state is reported.
+		_, err = db.Exec(`INSERT INTO state_events (time_ms, kind, key, from_state, to_state) VALUES (2000, 'export', 'txid', 'not-yet', 'ok')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = ProjectStates(ctx, db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Invalid) != 1 || len(r.Missing) != 1 {
+			t.Errorf("got invalid %q and missing %q, want one of each for the export", r.Invalid, r.Missing)
+		}
+	})
+}
@@ -0,0 +1,41 @@
+pragma solidity ^0.8.0;
+
+interface IERC20 {
+    function transfer(address to, uint256 amount) external returns (bool);
+    function transferFrom(address from, address to, uint256 amount) external returns (bool);
+}
+
+// Custodian holds the ERC-20 tokens pegged in to slidechain
+// and pays them out when they are pegged out.
+// Its events and functions must match evmchain.go.
+contract Custodian {
+    address public immutable owner;
+
+    // withdrawn records the IDs (export txids) of the withdrawals made.
+    mapping(bytes32 => bool) public withdrawn;
+
+    event Deposit(bytes32 indexed nonceHash, address indexed token, uint256 amount);
+    event Withdrawal(bytes32 indexed id, address indexed token, address indexed to, uint256 amount);
+
+    constructor(address _owner) {
+        owner = _owner;
+    }
+
+    // deposit pegs in amount of token
+    // for the pre-peg-in tx with the given nonce hash.
+    // The caller must first approve the transfer.
+    function deposit(address token, uint256 amount, bytes32 nonceHash) external {
+        require(IERC20(token).transferFrom(msg.sender, address(this), amount), "transfer failed");
+        emit Deposit(nonceHash, token, amount);
+    }
+
+    // withdraw pegs out the export with the given txid,
+    // at most once.
+    function withdraw(bytes32 id, address token, address to, uint256 amount) external {
+        require(msg.sender == owner, "not owner");
+        require(!withdrawn[id], "already withdrawn");
+        withdrawn[id] = true;
+        require(IERC20(token).transfer(to, amount), "transfer failed");
+        emit Withdrawal(id, token, to, amount);
+    }
+}
@@ -0,0 +1,151 @@
+// Package evm is a minimal client for Ethereum-compatible chains,
+// enough for slidechain to use one as its main chain:
+// reading logs, calling contracts, and sending txs
+// through a node's JSON-RPC API.
+//
+// It does no signing.
+// Txs are sent with eth_sendTransaction,
+// so the node (or a signer behind it) must hold the sending account's key.
+package evm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// TransferTopic is the topic of the ERC-20 Transfer event,
+// keccak256("Transfer(address,address,uint256)").
+var TransferTopic = MustParseWord("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+
+// Address is an account or contract address.
+type Address [20]byte
+
+// ParseAddress parses a 0x-prefixed hex address.
+// The case of the hex digits is not checked.
+func ParseAddress(s string) (Address, error) {
+	var a Address
+	b, err := decodeHex(s)
+	if err != nil {
+		return a, errors.Wrapf(err, "parsing address %q", s)
+	}
+	if len(b) != len(a) {
+		return a, fmt.Errorf("address %q is %d bytes, want %d", s, len(b), len(a))
+	}
+	copy(a[:], b)
+	return a, nil
+}
+
+// String returns a in lower-case 0x-prefixed hex.
+func (a Address) String() string {
+	return "0x" + hex.EncodeToString(a[:])
+}
+
+// Word is a 32-byte ABI word: an event topic or a call argument.
+type Word [32]byte
+
+// ParseWord parses a 0x-prefixed hex word.
+func ParseWord(s string) (Word, error) {
+	var w Word
+	b, err := decodeHex(s)
+	if err != nil {
+		return w, errors.Wrapf(err, "parsing word %q", s)
+	}
+	if len(b) != len(w) {
+		return w, fmt.Errorf("word %q is %d bytes, want %d", s, len(b), len(w))
+	}
+	copy(w[:], b)
+	return w, nil
+}
+
+// MustParseWord is like ParseWord but panics on error.
+func MustParseWord(s string) Word {
+	w, err := ParseWord(s)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+func (w Word) String() string {
+	return "0x" + hex.EncodeToString(w[:])
+}
+
+// AddressWord is the ABI encoding of an address.
+func AddressWord(a Address) Word {
+	var w Word
+	copy(w[12:], a[:])
+	return w
+}
+
+// Address decodes w as an address,
+// reporting whether it is one.
+func (w Word) Address() (Address, bool) {
+	var a Address
+	for _, b := range w[:12] {
+		if b != 0 {
+			return a, false
+		}
+	}
+	copy(a[:], w[12:])
+	return a, true
+}
+
+// UintWord is the ABI encoding of a uint256.
+// It panics if n is negative or too large.
+func UintWord(n *big.Int) Word {
+	var w Word
+	if n.Sign() < 0 || n.BitLen() > 256 {
+		panic(fmt.Sprintf("%s out of range for uint256", n))
+	}
+	b := n.Bytes()
+	copy(w[32-len(b):], b)
+	return w
+}
+
+// Uint decodes w as a uint256.
+func (w Word) Uint() *big.Int {
+	return new(big.Int).SetBytes(w[:])
+}
+
+// Calldata is the ABI encoding of a call
+// to the function with the given selector
+// and static arguments.
+func Calldata(selector [4]byte, args ...Word) []byte {
+	data := append([]byte{}, selector[:]...)
+	for _, a := range args {
+		data = append(data, a[:]...)
+	}
+	return data
+}
+
+func decodeHex(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return nil, errors.New("missing 0x prefix")
+	}
+	return hex.DecodeString(s[2:])
+}
+
+func encodeHex(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
+
+// quantity is a JSON-RPC quantity: a 0x-prefixed hex number
+// without leading zeros.
+func quantity(n *big.Int) string {
+	return "0x" + n.Text(16)
+}
+
+func parseQuantity(s string) (*big.Int, error) {
+	if !strings.HasPrefix(s, "0x") || len(s) == 2 {
+		return nil, fmt.Errorf("bad quantity %q", s)
+	}
+	n, ok := new(big.Int).SetString(s[2:], 16)
+	if !ok {
+		return nil, fmt.Errorf("bad quantity %q", s)
+	}
+	return n, nil
+}
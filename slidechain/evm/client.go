@@ -0,0 +1,275 @@
+package evm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Client calls the JSON-RPC API of a node.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// NewClient returns a Client for the node at url.
+func NewClient(url string) *Client {
+	return &Client{URL: url, HTTP: new(http.Client)}
+}
+
+// Error is an error response from the node.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Call calls the given JSON-RPC method
+// and unmarshals its result into result.
+func (c *Client) Call(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(request{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return errors.Wrapf(err, "marshaling %s request", method)
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "building %s request", method)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "calling %s", method)
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s response", method)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("calling %s: status %s: %s", method, resp.Status, body)
+	}
+	var r response
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s response", method)
+	}
+	if r.Error != nil {
+		return errors.Wrapf(r.Error, "calling %s", method)
+	}
+	return errors.Wrapf(json.Unmarshal(r.Result, result), "parsing %s result", method)
+}
+
+// BlockNumber returns the number of the latest block.
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	n, err := c.callQuantity(ctx, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsUint64() {
+		return 0, fmt.Errorf("block number %s out of range", n)
+	}
+	return n.Uint64(), nil
+}
+
+// GasPrice returns the node's suggested gas price, in wei.
+func (c *Client) GasPrice(ctx context.Context) (*big.Int, error) {
+	return c.callQuantity(ctx, "eth_gasPrice")
+}
+
+// PendingNonce returns the nonce of the next tx from the account,
+// counting the txs the node has pending.
+func (c *Client) PendingNonce(ctx context.Context, a Address) (uint64, error) {
+	n, err := c.callQuantity(ctx, "eth_getTransactionCount", a.String(), "pending")
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsUint64() {
+		return 0, fmt.Errorf("nonce %s out of range", n)
+	}
+	return n.Uint64(), nil
+}
+
+func (c *Client) callQuantity(ctx context.Context, method string, params ...interface{}) (*big.Int, error) {
+	var s string
+	err := c.Call(ctx, &s, method, params...)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseQuantity(s)
+	return n, errors.Wrapf(err, "parsing %s result", method)
+}
+
+// Filter selects logs in a range of blocks, inclusive.
+// A log matches if it was emitted by one of Addresses (any, if empty)
+// and, for each i, its i'th topic is one of Topics[i] (any, if empty).
+type Filter struct {
+	FromBlock, ToBlock uint64
+	Addresses          []Address
+	Topics             [][]Word
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"fromBlock": quantity(new(big.Int).SetUint64(f.FromBlock)),
+		"toBlock":   quantity(new(big.Int).SetUint64(f.ToBlock)),
+	}
+	if len(f.Addresses) > 0 {
+		var addrs []string
+		for _, a := range f.Addresses {
+			addrs = append(addrs, a.String())
+		}
+		m["address"] = addrs
+	}
+	if len(f.Topics) > 0 {
+		topics := make([]interface{}, len(f.Topics))
+		for i, ts := range f.Topics {
+			if len(ts) == 0 {
+				continue
+			}
+			var strs []string
+			for _, t := range ts {
+				strs = append(strs, t.String())
+			}
+			topics[i] = strs
+		}
+		m["topics"] = topics
+	}
+	return json.Marshal(m)
+}
+
+// Log is an event emitted by a contract.
+type Log struct {
+	Address     Address
+	Topics      []Word
+	Data        []byte
+	BlockNumber uint64
+	TxHash      Word
+	LogIndex    uint64
+	Removed     bool // by a reorg
+}
+
+func (l *Log) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Address     string   `json:"address"`
+		Topics      []string `json:"topics"`
+		Data        string   `json:"data"`
+		BlockNumber string   `json:"blockNumber"`
+		TxHash      string   `json:"transactionHash"`
+		LogIndex    string   `json:"logIndex"`
+		Removed     bool     `json:"removed"`
+	}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+	l.Address, err = ParseAddress(raw.Address)
+	if err != nil {
+		return err
+	}
+	l.Topics = nil
+	for _, t := range raw.Topics {
+		w, err := ParseWord(t)
+		if err != nil {
+			return err
+		}
+		l.Topics = append(l.Topics, w)
+	}
+	l.Data, err = decodeHex(raw.Data)
+	if err != nil {
+		return errors.Wrap(err, "parsing log data")
+	}
+	blockNum, err := parseQuantity(raw.BlockNumber)
+	if err != nil {
+		return errors.Wrap(err, "parsing log block number")
+	}
+	logIndex, err := parseQuantity(raw.LogIndex)
+	if err != nil {
+		return errors.Wrap(err, "parsing log index")
+	}
+	if !blockNum.IsUint64() || !logIndex.IsUint64() {
+		return errors.New("log position out of range")
+	}
+	l.BlockNumber, l.LogIndex = blockNum.Uint64(), logIndex.Uint64()
+	l.TxHash, err = ParseWord(raw.TxHash)
+	if err != nil {
+		return err
+	}
+	l.Removed = raw.Removed
+	return nil
+}
+
+// Logs returns the logs matching f.
+func (c *Client) Logs(ctx context.Context, f Filter) ([]Log, error) {
+	var logs []Log
+	err := c.Call(ctx, &logs, "eth_getLogs", f)
+	return logs, err
+}
+
+// CallContract runs a read-only call of the contract
+// against the state as of the given block
+// and returns its output.
+func (c *Client) CallContract(ctx context.Context, to Address, data []byte, block uint64) ([]byte, error) {
+	msg := map[string]string{
+		"to":   to.String(),
+		"data": encodeHex(data),
+	}
+	var s string
+	err := c.Call(ctx, &s, "eth_call", msg, quantity(new(big.Int).SetUint64(block)))
+	if err != nil {
+		return nil, err
+	}
+	out, err := decodeHex(s)
+	return out, errors.Wrap(err, "parsing eth_call result")
+}
+
+// Tx is a tx for the node to sign and send.
+type Tx struct {
+	From, To Address
+	Data     []byte
+	Gas      uint64
+	GasPrice *big.Int
+	Nonce    uint64
+}
+
+// SendTransaction has the node sign and send tx,
+// returning its hash.
+func (c *Client) SendTransaction(ctx context.Context, tx Tx) (Word, error) {
+	msg := map[string]string{
+		"from":     tx.From.String(),
+		"to":       tx.To.String(),
+		"data":     encodeHex(tx.Data),
+		"gas":      quantity(new(big.Int).SetUint64(tx.Gas)),
+		"gasPrice": quantity(tx.GasPrice),
+		"nonce":    quantity(new(big.Int).SetUint64(tx.Nonce)),
+	}
+	var s string
+	err := c.Call(ctx, &s, "eth_sendTransaction", msg)
+	if err != nil {
+		return Word{}, err
+	}
+	return ParseWord(s)
+}
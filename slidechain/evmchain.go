@@ -0,0 +1,409 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/evm"
+)
+
+// The custodian contract on an EVM chain (see evm/Custodian.sol)
+// takes deposits of ERC-20 tokens,
+// emitting Deposit(bytes32 indexed nonceHash, address indexed token, uint256 amount),
+// and makes withdrawals with withdraw(bytes32 id, address token, address to, uint256 amount),
+// at most once per id,
+// recording them in withdrawn(bytes32 id).
+var (
+	// keccak256("Deposit(bytes32,address,uint256)")
+	evmDepositTopic = evm.MustParseWord("0x182fa52899142d44ff5c45a6354d3b3e868d5b07db6a65580b39bd321bdaf8ac")
+
+	evmWithdrawSelector  = [4]byte{0x8e, 0x0c, 0xc1, 0x76} // withdraw(bytes32,address,address,uint256)
+	evmWithdrawnSelector = [4]byte{0x38, 0x23, 0xd6, 0x6c} // withdrawn(bytes32)
+)
+
+// evmGasPriceSteps are the gas prices of the evmChain fee levels,
+// as percentages of the node's suggested gas price.
+var evmGasPriceSteps = []int64{100, 150, 225}
+
+const (
+	// evmMaxLogRange is the most blocks scanned for deposits in one request.
+	evmMaxLogRange = 1000
+
+	evmPollInterval = 5 * time.Second
+)
+
+// evmChain is the implementation of Chain for an Ethereum-compatible chain.
+// Deposits are ERC-20 transfers to the custodian contract
+// made by its deposit function,
+// which records the nonce hash.
+// The asset of a deposit or withdrawal is the 20-byte token address,
+// and the recipient of a withdrawal is a 0x-prefixed hex address.
+//
+// A deposit or withdrawal is final once its block
+// has the configured number of confirmations,
+// and deposits are not seen until then.
+//
+// Withdrawals are made by the node's from account.
+// A resubmitted withdrawal reuses the nonce of the earlier tx,
+// replacing it if it is still pending,
+// at a gas price at least 12.5% higher, as nodes require.
+// If that is lost (e.g. on restart) the contract still makes each withdrawal
+// at most once, so a duplicate tx reverts.
+type evmChain struct {
+	client        *evm.Client
+	contract      evm.Address
+	from          evm.Address
+	startBlock    uint64
+	confirmations uint64
+	gasLimit      uint64
+	maxGasPrice   *big.Int // nil means no cap
+
+	mu   sync.Mutex
+	sent map[evm.Word]evmSent // by export txid
+}
+
+// evmSent is the last tx sent for a withdrawal.
+type evmSent struct {
+	nonce    uint64
+	gasPrice *big.Int
+}
+
+func newEVMChain(cfg config.EVM) (*evmChain, error) {
+	contract, err := evm.ParseAddress(cfg.Contract)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing custodian contract address")
+	}
+	from, err := evm.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing withdrawal account address")
+	}
+	e := &evmChain{
+		client:        evm.NewClient(cfg.RPCURL),
+		contract:      contract,
+		from:          from,
+		startBlock:    uint64(cfg.StartBlock),
+		confirmations: uint64(cfg.Confirmations),
+		gasLimit:      uint64(cfg.GasLimit),
+		sent:          make(map[evm.Word]evmSent),
+	}
+	if cfg.MaxGasPrice > 0 {
+		e.maxGasPrice = big.NewInt(cfg.MaxGasPrice)
+	}
+	return e, nil
+}
+
+// WatchDeposits polls for confirmed blocks.
+// Its cursor is the number of the next block to scan.
+func (e *evmChain) WatchDeposits(ctx context.Context, cursor string, f func(Deposit) error) (string, error) {
+	from := e.startBlock
+	if cursor != "" {
+		var err error
+		from, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return cursor, errors.Wrapf(err, "parsing cursor %q", cursor)
+		}
+	}
+	for {
+		head, err := e.client.BlockNumber(ctx)
+		if err != nil {
+			return strconv.FormatUint(from, 10), err
+		}
+		if head >= e.confirmations && head-e.confirmations >= from {
+			to := head - e.confirmations
+			if to-from >= evmMaxLogRange {
+				to = from + evmMaxLogRange - 1
+			}
+			err = e.deposits(ctx, from, to, f)
+			if err != nil {
+				return strconv.FormatUint(from, 10), err
+			}
+			from = to + 1
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return strconv.FormatUint(from, 10), ctx.Err()
+		case <-time.After(evmPollInterval):
+		}
+	}
+}
+
+// deposits calls f on the deposits in the given blocks.
+// Each Deposit log of the contract must be matched
+// by an earlier Transfer log in the same tx,
+// from the token contract to the custodian contract, of the same amount,
+// so the tokens are known to have arrived.
+// The cursor of a deposit is its own block,
+// so a crash before the rest of the block is recorded
+// rescans it;
+// deposits already recorded then match no pending peg-in.
+func (e *evmChain) deposits(ctx context.Context, from, to uint64, f func(Deposit) error) error {
+	transfers, err := e.client.Logs(ctx, evm.Filter{
+		FromBlock: from,
+		ToBlock:   to,
+		Topics:    [][]evm.Word{{evm.TransferTopic}, nil, {evm.AddressWord(e.contract)}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "getting transfers to custodian contract")
+	}
+	depositLogs, err := e.client.Logs(ctx, evm.Filter{
+		FromBlock: from,
+		ToBlock:   to,
+		Addresses: []evm.Address{e.contract},
+		Topics:    [][]evm.Word{{evmDepositTopic}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "getting custodian contract deposits")
+	}
+	sort.Slice(depositLogs, func(i, j int) bool {
+		a, b := depositLogs[i], depositLogs[j]
+		return a.BlockNumber < b.BlockNumber || (a.BlockNumber == b.BlockNumber && a.LogIndex < b.LogIndex)
+	})
+
+	transfersByTx := make(map[evm.Word][]*evm.Log)
+	for i := range transfers {
+		t := &transfers[i]
+		if !t.Removed && len(t.Topics) == 3 && len(t.Data) == 32 {
+			transfersByTx[t.TxHash] = append(transfersByTx[t.TxHash], t)
+		}
+	}
+	used := make(map[*evm.Log]bool)
+
+	for _, d := range depositLogs {
+		if d.Removed {
+			continue
+		}
+		if len(d.Topics) != 3 || len(d.Data) != 32 {
+			log.Printf("skipping malformed deposit log %d in tx %s", d.LogIndex, d.TxHash)
+			continue
+		}
+		token, ok := d.Topics[2].Address()
+		if !ok {
+			log.Printf("skipping deposit log %d in tx %s with bad token address", d.LogIndex, d.TxHash)
+			continue
+		}
+		var amountWord evm.Word
+		copy(amountWord[:], d.Data)
+		amount := amountWord.Uint()
+		if !amount.IsInt64() || amount.Sign() <= 0 {
+			log.Printf("skipping deposit log %d in tx %s with amount %s out of range", d.LogIndex, d.TxHash, amount)
+			continue
+		}
+
+		var transfer *evm.Log
+		for _, t := range transfersByTx[d.TxHash] {
+			if !used[t] && t.Address == token && t.LogIndex < d.LogIndex && new(big.Int).SetBytes(t.Data).Cmp(amount) == 0 {
+				transfer = t
+				break
+			}
+		}
+		if transfer == nil {
+			log.Printf("skipping deposit log %d in tx %s with no matching transfer of %s", d.LogIndex, d.TxHash, token)
+			continue
+		}
+		used[transfer] = true
+
+		nonceHash := d.Topics[1]
+		err = f(Deposit{
+			TxID:      d.TxHash.String(),
+			OpIndex:   int(d.LogIndex),
+			Cursor:    strconv.FormatUint(d.BlockNumber, 10),
+			NonceHash: nonceHash[:],
+			Asset:     token[:],
+			Amount:    amount.Int64(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *evmChain) SubmitWithdrawal(ctx context.Context, w *Withdrawal, feeLevel int) (WithdrawalResult, error) {
+	id, data, err := e.withdrawCall(w)
+	if err != nil {
+		return WithdrawalRejected, err
+	}
+	head, err := e.client.BlockNumber(ctx)
+	if err != nil {
+		return WithdrawalPending, err
+	}
+	done, err := e.withdrawn(ctx, id, head)
+	if err != nil {
+		return WithdrawalPending, err
+	}
+	if done {
+		final, err := e.final(ctx, id, head)
+		if err != nil {
+			return WithdrawalPending, err
+		}
+		if final {
+			return WithdrawalApplied, nil
+		}
+		return WithdrawalPending, fmt.Errorf("withdrawal awaiting %d confirmations", e.confirmations)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	last, resend := e.sent[id]
+	gasPrice, err := e.gasPrice(ctx, feeLevel, last, resend)
+	if err != nil {
+		return WithdrawalPending, err
+	}
+	nonce := last.nonce
+	if !resend {
+		nonce, err = e.client.PendingNonce(ctx, e.from)
+		if err != nil {
+			return WithdrawalPending, errors.Wrap(err, "getting nonce")
+		}
+	}
+	hash, err := e.client.SendTransaction(ctx, evm.Tx{
+		From:     e.from,
+		To:       e.contract,
+		Data:     data,
+		Gas:      e.gasLimit,
+		GasPrice: gasPrice,
+		Nonce:    nonce,
+	})
+	if err != nil {
+		// The nonce may have been used by another tx;
+		// take a fresh one next time.
+		delete(e.sent, id)
+		return WithdrawalPending, errors.Wrap(err, "sending withdrawal tx")
+	}
+	e.sent[id] = evmSent{nonce: nonce, gasPrice: gasPrice}
+	return WithdrawalPending, fmt.Errorf("sent withdrawal tx %s with nonce %d and gas price %s, awaiting %d confirmations", hash, nonce, gasPrice, e.confirmations)
+}
+
+// gasPrice is the gas price of a withdrawal at the given fee level:
+// a multiple of the node's suggested price,
+// raised to replace the last tx sent for the withdrawal, if any,
+// and capped at the maximum.
+func (e *evmChain) gasPrice(ctx context.Context, feeLevel int, last evmSent, resend bool) (*big.Int, error) {
+	if feeLevel < 0 {
+		feeLevel = 0
+	}
+	if feeLevel >= len(evmGasPriceSteps) {
+		feeLevel = len(evmGasPriceSteps) - 1
+	}
+	suggested, err := e.client.GasPrice(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting gas price")
+	}
+	price := new(big.Int).Mul(suggested, big.NewInt(evmGasPriceSteps[feeLevel]))
+	price.Div(price, big.NewInt(100))
+	if resend {
+		replace := new(big.Int).Mul(last.gasPrice, big.NewInt(9))
+		replace.Div(replace, big.NewInt(8))
+		replace.Add(replace, big.NewInt(1))
+		if price.Cmp(replace) < 0 {
+			price = replace
+		}
+	}
+	if e.maxGasPrice != nil && price.Cmp(e.maxGasPrice) > 0 {
+		if resend && last.gasPrice.Cmp(e.maxGasPrice) >= 0 {
+			return nil, fmt.Errorf("withdrawal tx already sent at the maximum gas price, %s", e.maxGasPrice)
+		}
+		price = new(big.Int).Set(e.maxGasPrice)
+	}
+	return price, nil
+}
+
+func (e *evmChain) VerifyFinality(ctx context.Context, w *Withdrawal) (bool, error) {
+	id, _, err := e.withdrawCall(w)
+	if err != nil {
+		return false, err
+	}
+	head, err := e.client.BlockNumber(ctx)
+	if err != nil {
+		return false, err
+	}
+	return e.final(ctx, id, head)
+}
+
+// final reports whether the contract had recorded the withdrawal
+// as of the last block with enough confirmations.
+func (e *evmChain) final(ctx context.Context, id evm.Word, head uint64) (bool, error) {
+	if head < e.confirmations {
+		return false, nil
+	}
+	return e.withdrawn(ctx, id, head-e.confirmations)
+}
+
+func (e *evmChain) withdrawn(ctx context.Context, id evm.Word, block uint64) (bool, error) {
+	out, err := e.client.CallContract(ctx, e.contract, evm.Calldata(evmWithdrawnSelector, id), block)
+	if err != nil {
+		return false, errors.Wrap(err, "calling withdrawn")
+	}
+	if len(out) != 32 {
+		return false, fmt.Errorf("withdrawn returned %d bytes, want 32", len(out))
+	}
+	var w evm.Word
+	copy(w[:], out)
+	return w.Uint().Sign() != 0, nil
+}
+
+// VerifyDeposit rescans the block of the deposit, its cursor.
+func (e *evmChain) VerifyDeposit(ctx context.Context, d Deposit) (bool, error) {
+	block, err := strconv.ParseUint(d.Cursor, 10, 64)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing deposit block %q", d.Cursor)
+	}
+	var found bool
+	err = e.deposits(ctx, block, block, func(got Deposit) error {
+		found = found || sameDeposit(got, d)
+		return nil
+	})
+	return found, err
+}
+
+func (e *evmChain) ValidateWithdrawal(w *Withdrawal) error {
+	if len(w.Asset) != len(evm.Address{}) {
+		return fmt.Errorf("export asset is %d bytes, want a %d-byte token address", len(w.Asset), len(evm.Address{}))
+	}
+	if w.Destination != (Destination{}) {
+		return errors.New("withdrawals to a destination other than the exporter are not supported")
+	}
+	_, err := evm.ParseAddress(w.Recipient)
+	return errors.Wrap(err, "parsing exporter address")
+}
+
+// withdrawCall returns the withdrawal's ID in the contract
+// and the calldata of its withdraw call.
+func (e *evmChain) withdrawCall(w *Withdrawal) (evm.Word, []byte, error) {
+	var id evm.Word
+	if len(w.ExportTxID) != len(id) {
+		return id, nil, fmt.Errorf("export txid is %d bytes, want %d", len(w.ExportTxID), len(id))
+	}
+	copy(id[:], w.ExportTxID)
+	err := e.ValidateWithdrawal(w)
+	if err != nil {
+		return id, nil, err
+	}
+	if w.Amount <= 0 {
+		return id, nil, fmt.Errorf("bad withdrawal amount %d", w.Amount)
+	}
+	var token evm.Address
+	copy(token[:], w.Asset)
+	to, _ := evm.ParseAddress(w.Recipient)
+	data := evm.Calldata(evmWithdrawSelector,
+		id,
+		evm.AddressWord(token),
+		evm.AddressWord(to),
+		evm.UintWord(big.NewInt(w.Amount)),
+	)
+	return id, data, nil
+}
+
+func (e *evmChain) FeeLevels() int {
+	return len(evmGasPriceSteps)
+}
@@ -0,0 +1,203 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/evm"
+)
+
+// fakeNode is a JSON-RPC node with just enough of the API for evmChain.
+type fakeNode struct {
+	mu        sync.Mutex
+	head      uint64
+	logs      []map[string]interface{}
+	withdrawn map[string]uint64 // block at which each withdrawal id was recorded
+	nonce     uint64
+	sent      []map[string]string
+}
+
+func (n *fakeNode) addLog(block, index uint64, txHash string, addr evm.Address, data []byte, topics ...evm.Word) {
+	var ts []string
+	for _, t := range topics {
+		ts = append(ts, t.String())
+	}
+	n.logs = append(n.logs, map[string]interface{}{
+		"address":         addr.String(),
+		"topics":          ts,
+		"data":            "0x" + hex.EncodeToString(data),
+		"blockNumber":     fmt.Sprintf("0x%x", block),
+		"transactionHash": txHash,
+		"logIndex":        fmt.Sprintf("0x%x", index),
+		"removed":         false,
+	})
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var r struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var result interface{}
+	switch r.Method {
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", n.head)
+	case "eth_gasPrice":
+		result = "0x64"
+	case "eth_getTransactionCount":
+		result = fmt.Sprintf("0x%x", n.nonce)
+	case "eth_getLogs":
+		var f struct {
+			Topics [][]string `json:"topics"`
+		}
+		json.Unmarshal(r.Params[0], &f)
+		var logs []map[string]interface{}
+		for _, l := range n.logs {
+			if l["topics"].([]string)[0] == f.Topics[0][0] {
+				logs = append(logs, l)
+			}
+		}
+		result = logs
+	case "eth_call":
+		var msg map[string]string
+		var block string
+		json.Unmarshal(r.Params[0], &msg)
+		json.Unmarshal(r.Params[1], &block)
+		var blockNum uint64
+		fmt.Sscanf(block, "0x%x", &blockNum)
+		var out evm.Word
+		if at, ok := n.withdrawn[msg["data"][10:]]; ok && at <= blockNum {
+			out[31] = 1
+		}
+		result = out.String()
+	case "eth_sendTransaction":
+		var msg map[string]string
+		json.Unmarshal(r.Params[0], &msg)
+		n.sent = append(n.sent, msg)
+		n.nonce++
+		result = evm.Word{byte(len(n.sent))}.String()
+	default:
+		http.Error(w, "unknown method "+r.Method, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": result})
+}
+
+func TestEVMChain(t *testing.T) {
+	ctx := context.Background()
+	node := &fakeNode{head: 100, withdrawn: make(map[string]uint64)}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+
+	contract := evm.Address{0xcc}
+	token := evm.Address{0x70}
+	depositor := evm.Address{0xde}
+	cfg := config.Default().EVM
+	cfg.RPCURL = srv.URL
+	cfg.Contract = contract.String()
+	cfg.From = evm.Address{0xf0}.String()
+	e, err := newEVMChain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("deposits", func(t *testing.T) {
+		amount := evm.UintWord(big.NewInt(500))
+		nonceHash := evm.Word{1, 2, 3}
+		// A deposit made by the contract's deposit function.
+		node.addLog(5, 0, "0x"+strings.Repeat("aa", 32), token, amount[:], evm.TransferTopic, evm.AddressWord(depositor), evm.AddressWord(contract))
+		node.addLog(5, 1, "0x"+strings.Repeat("aa", 32), contract, amount[:], evmDepositTopic, nonceHash, evm.AddressWord(token))
+		// A Deposit log with no tokens transferred.
+		node.addLog(6, 0, "0x"+strings.Repeat("bb", 32), contract, amount[:], evmDepositTopic, evm.Word{4, 5, 6}, evm.AddressWord(token))
+
+		var got []Deposit
+		err := e.deposits(ctx, 0, 10, func(d Deposit) error {
+			got = append(got, d)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("got %d deposits, want 1", len(got))
+		}
+		d := got[0]
+		if !bytes.Equal(d.NonceHash, nonceHash[:]) || !bytes.Equal(d.Asset, token[:]) || d.Amount != 500 || d.Cursor != "5" {
+			t.Errorf("got deposit %+v", d)
+		}
+	})
+
+	t.Run("withdrawal", func(t *testing.T) {
+		w := &Withdrawal{
+			ExportTxID: bytes.Repeat([]byte{7}, 32),
+			Asset:      token[:],
+			Amount:     500,
+			Recipient:  depositor.String(),
+		}
+		submit := func(level int, want WithdrawalResult) {
+			t.Helper()
+			got, err := e.SubmitWithdrawal(ctx, w, level)
+			if got != want {
+				t.Fatalf("got result %d (%v), want %d", got, err, want)
+			}
+		}
+
+		submit(0, WithdrawalPending)
+		submit(1, WithdrawalPending)
+		if len(node.sent) != 2 {
+			t.Fatalf("sent %d txs, want 2", len(node.sent))
+		}
+		if node.sent[0]["nonce"] != node.sent[1]["nonce"] {
+			t.Errorf("resubmitted withdrawal with nonce %s, want replacement of nonce %s", node.sent[1]["nonce"], node.sent[0]["nonce"])
+		}
+		if node.sent[0]["gasPrice"] != "0x64" || node.sent[1]["gasPrice"] != "0x96" {
+			t.Errorf("got gas prices %s, %s, want 0x64, 0x96", node.sent[0]["gasPrice"], node.sent[1]["gasPrice"])
+		}
+
+		node.withdrawn[hex.EncodeToString(w.ExportTxID)] = node.head
+		submit(2, WithdrawalPending)
+		if len(node.sent) != 2 {
+			t.Error("resubmitted a withdrawal already recorded by the contract")
+		}
+		final, err := e.VerifyFinality(ctx, w)
+		if err != nil || final {
+			t.Errorf("got final %t (%v) before confirmations, want false", final, err)
+		}
+
+		node.head += uint64(cfg.Confirmations)
+		final, err = e.VerifyFinality(ctx, w)
+		if err != nil || !final {
+			t.Errorf("got final %t (%v) after confirmations, want true", final, err)
+		}
+		submit(0, WithdrawalApplied)
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		err := e.ValidateWithdrawal(&Withdrawal{Asset: token[:], Recipient: "GABC"})
+		if err == nil {
+			t.Error("accepted a non-EVM recipient")
+		}
+		err = new(stellarChain).ValidateWithdrawal(&Withdrawal{Asset: token[:], Recipient: depositor.String()})
+		if err == nil {
+			t.Error("Stellar chain accepted an EVM withdrawal")
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+)
+
+// expirePegInsInterval is how often expirePegIns
+// looks for peg-ins past pegin.intent_ttl.
+const expirePegInsInterval = time.Minute
+
+// expirePegIns runs as a goroutine,
+// expiring the recorded peg-ins whose deposits have not arrived
+// within pegin.intent_ttl
+// every expirePegInsInterval until ctx is canceled.
+func (c *Custodian) expirePegIns(ctx context.Context) {
+	defer log.Print("expirePegIns exiting")
+
+	ticker := time.NewTicker(expirePegInsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := c.sweepPegIns(ctx)
+		if err != nil {
+			log.Printf("expiring peg-ins: %s", err)
+		}
+		if n > 0 {
+			log.Printf("expired %d peg-ins", n)
+		}
+	}
+}
+
+// sweepPegIns expires the recorded peg-ins
+// recorded longer than pegin.intent_ttl ago,
+// returning how many it expired.
+// Peg-ins recorded before the state_events log are left alone.
+func (c *Custodian) sweepPegIns(ctx context.Context) (int, error) {
+	cfg := c.config()
+	if cfg == nil || cfg.PegIn.IntentTTL <= 0 {
+		return 0, nil
+	}
+	cutoff := c.nowMS() - int64(time.Duration(cfg.PegIn.IntentTTL)/time.Millisecond)
+	var nonceHashes [][]byte
+	const q = `SELECT p.nonce_hash FROM pegs p
+		JOIN state_events e ON e.kind='peg-in' AND e.key=p.nonce_hash AND e.from_state=''
+		WHERE p.state=$1 AND e.time_ms < $2`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegInRecorded, cutoff, func(nonceHash []byte) {
+		nonceHashes = append(nonceHashes, nonceHash)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "reading peg-ins to expire")
+	}
+	var n int
+	for _, nonceHash := range nonceHashes {
+		ok, err := c.expirePegIn(ctx, nonceHash)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expirePegIn moves the recorded peg-in with the given nonce hash
+// from pegs to expired_pegs,
+// freeing its row, and logs its expiry,
+// from which its recipient is notified.
+// It reports false, changing nothing,
+// if the peg-in is no longer recorded,
+// as when its deposit arrived meanwhile.
+// A deposit for an expired peg-in is refunded.
+func (c *Custodian) expirePegIn(ctx context.Context, nonceHash []byte) (bool, error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const ins = `INSERT INTO expired_pegs (nonce_hash, recipient_pubkey, nonce_expms, issuance_version, expired_ms)
+		SELECT nonce_hash, recipient_pubkey, nonce_expms, issuance_version, $1 FROM pegs WHERE nonce_hash=$2 AND state=$3`
+	res, err := dbtx.ExecContext(ctx, ins, c.nowMS(), nonceHash, pegInRecorded)
+	if err != nil {
+		return false, errors.Wrapf(err, "expiring peg-in %x", nonceHash)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected expiring peg-in %x", nonceHash)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM pegs WHERE nonce_hash=$1`, nonceHash)
+	if err != nil {
+		return false, errors.Wrapf(err, "removing expired peg-in %x", nonceHash)
+	}
+	err = recordStateEvent(ctx, dbtx, c.nowMS(), "peg-in", nonceHash, pegInRecorded.String(), pegInExpired.String())
+	if err != nil {
+		return false, err
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "committing expiry of peg-in %x", nonceHash)
+	}
+	log.Printf("peg-in %x: %s -> %s", nonceHash, pegInRecorded, pegInExpired)
+	return true, nil
+}
+
+// pegInHasExpired reports whether the peg-in with the given nonce hash has expired.
+func (c *Custodian) pegInHasExpired(ctx context.Context, nonceHash []byte) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM expired_pegs WHERE nonce_hash=$1`, nonceHash).Scan(&n)
+	return n > 0, errors.Wrapf(err, "reading expired peg-in %x", nonceHash)
+}
+
+// writePegInMetrics writes, in the Prometheus text format,
+// the counts of peg-ins recorded, paid, and expired,
+// from which operators compute the expiry rate.
+func (c *Custodian) writePegInMetrics(ctx context.Context, w io.Writer) error {
+	counts := make(map[string]int64)
+	const q = `SELECT to_state, COUNT(*) FROM state_events WHERE kind='peg-in' AND to_state IN ('recorded', 'paid', 'expired') GROUP BY to_state`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, func(state string, n int64) {
+		counts[state] = n
+	})
+	if err != nil {
+		return errors.Wrap(err, "counting peg-in events")
+	}
+	for _, m := range []struct{ state, help string }{
+		{"recorded", "Peg-ins recorded by /prepegin."},
+		{"paid", "Peg-ins whose deposits arrived."},
+		{"expired", "Peg-ins expired by pegin.intent_ttl before their deposits arrived."},
+	} {
+		name := "slidechain_pegins_" + m.state + "_total"
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, m.help, name, name, counts[m.state])
+	}
+	return nil
+}
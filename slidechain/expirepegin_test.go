@@ -0,0 +1,116 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestExpirePegIns(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	cfg.PegIn.IntentTTL = config.Duration(time.Hour)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale, fresh := []byte("stale nonce hash"), []byte("fresh nonce hash")
+		err = c.insertPegIn(ctx, stale, testRecipPubKey, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Minute)
+		err = c.insertPegIn(ctx, fresh, testRecipPubKey, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(31 * time.Minute)
+		n, err := c.sweepPegIns(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("expired %d peg-ins, want 1", n)
+		}
+		n, err = c.sweepPegIns(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("sweeping again expired %d peg-ins, want 0", n)
+		}
+		var count int
+		err = db.QueryRow(`SELECT COUNT(*) FROM pegs WHERE nonce_hash=$1`, stale).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Error("expired peg-in is still in pegs")
+		}
+		for nonceHash, want := range map[string]bool{string(stale): true, string(fresh): false} {
+			expired, err := c.pegInHasExpired(ctx, []byte(nonceHash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expired != want {
+				t.Errorf("%s: got expired %v, want %v", nonceHash, expired, want)
+			}
+		}
+		var name string
+		err = db.QueryRow(`SELECT name FROM events WHERE key=$1 ORDER BY id DESC LIMIT 1`, stale).Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "intent_expired" {
+			t.Errorf("got last event %s, want intent_expired", name)
+		}
+
+		// A late deposit is refunded.
+		reason, err := c.depositRefundReason(ctx, Deposit{NonceHash: stale, TxID: "late"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "expired" {
+			t.Errorf("got refund reason %q for a late deposit, want expired", reason)
+		}
+
+		r, err := ProjectStates(ctx, db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Invalid) != 0 || len(r.Missing) != 0 {
+			t.Errorf("got invalid %q and missing %q, want none", r.Invalid, r.Missing)
+		}
+
+		w := httptest.NewRecorder()
+		c.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		for _, want := range []string{"slidechain_pegins_recorded_total 2\n", "slidechain_pegins_paid_total 0\n", "slidechain_pegins_expired_total 1\n"} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("metrics lack %q:\n%s", want, w.Body)
+			}
+		}
+	})
+}
@@ -2,13 +2,15 @@ package slidechain
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"strconv"
+	"sync"
+	"time"
 
-	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
@@ -17,13 +19,12 @@ import (
 	"github.com/chain/txvm/protocol/txvm/asm"
 	"github.com/chain/txvm/protocol/txvm/op"
 	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/federation"
 	"github.com/interstellar/slingshot/slidechain/stellar"
 	"github.com/interstellar/starlight/worizon/xlm"
-	b "github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
 	"github.com/stellar/go/strkey"
-	"github.com/stellar/go/xdr"
 )
 
 type pegOut struct {
@@ -36,8 +37,32 @@ type pegOut struct {
 	Anchor   []byte      `json:"anchor"`
 	Pubkey   []byte      `json:"pubkey"`
 	State    pegOutState `json:"state,omitempty"`
+
+	// TimeBounds are those of the preauthorized peg-out txs.
+	TimeBounds
+
+	// Destination is the account they pay, if not the exporter's.
+	Destination
+
+	// Nettable means the pre-export tx also preauthorized the settlement tx,
+	// so the export can be netted with others to the same destination.
+	Nettable bool `json:"nettable,omitempty"`
+
+	// ExportEscrow is the watcher that may cancel the export, if any.
+	ExportEscrow
+
+	// IssuanceVersion is the version of the import-issuance program
+	// that issued the exported value.
+	// It is not part of the reference data.
+	IssuanceVersion int `json:"-"`
+
+	// FeeLevel is the fee level at which the export is pegged out.
+	// It is not part of the reference data.
+	FeeLevel int `json:"-"`
 }
 
+// pegOutState is the state of an export,
+// in the pegged_out column of the exports table.
 type pegOutState int
 
 const (
@@ -45,10 +70,167 @@ const (
 	pegOutOK
 	pegOutRetry
 	pegOutFail
+	pegOutRetired  // paid out on Stellar and retired on txvm
+	pegOutRefunded // not paid out, and refunded on txvm
 )
 
 const baseFee = 100
 
+// TimeBounds are the Stellar time bounds of a peg-out tx,
+// in Unix seconds, chosen by the exporter in the pre-export tx
+// so that the peg-out cannot be applied long after it was authorized.
+// Zero means unbounded.
+//
+// MinLedger and MaxLedger bound the peg-out tx by ledger instead,
+// from MinLedger up to but not including MaxLedger,
+// and MinSeqAge is the seconds that must pass
+// after the pre-export tx creates the temp account
+// before the peg-out tx may be applied.
+// A deployment may require them of its exports
+// with pegout.max_ledgers and pegout.min_seq_age.
+type TimeBounds struct {
+	MinTime   int64  `json:"min_time,omitempty"`
+	MaxTime   int64  `json:"max_time,omitempty"`
+	MinLedger uint32 `json:"min_ledger,omitempty"`
+	MaxLedger uint32 `json:"max_ledger,omitempty"`
+	MinSeqAge int64  `json:"min_seq_age,omitempty"`
+}
+
+// check reports whether tb are valid bounds.
+func (tb TimeBounds) check() error {
+	if tb.MinTime < 0 || tb.MaxTime < 0 || (tb.MaxTime > 0 && tb.MaxTime < tb.MinTime) {
+		return fmt.Errorf("bad time bounds %d to %d", tb.MinTime, tb.MaxTime)
+	}
+	if tb.MaxLedger > 0 && tb.MaxLedger <= tb.MinLedger {
+		return fmt.Errorf("bad ledger bounds %d to %d", tb.MinLedger, tb.MaxLedger)
+	}
+	if tb.MinSeqAge < 0 {
+		return fmt.Errorf("bad min sequence age %d", tb.MinSeqAge)
+	}
+	return nil
+}
+
+// preconditioned reports whether tb bound the peg-out tx
+// by more than time.
+func (tb TimeBounds) preconditioned() bool {
+	return tb.MinLedger > 0 || tb.MaxLedger > 0 || tb.MinSeqAge > 0
+}
+
+// ExportEscrow holds an export for a challenge period
+// after the custodian records it,
+// during which the watcher key may cancel it
+// so that it is refunded instead of pegged out.
+// It is chosen by the exporter in the export's reference data.
+type ExportEscrow struct {
+	Watcher     []byte `json:"watcher,omitempty"` // ed25519 pubkey
+	ChallengeMS int64  `json:"challenge_ms,omitempty"`
+
+	// ChallengeUntilMS is when the challenge period ends,
+	// and CanceledMS when the watcher canceled the export, if it has.
+	// They are not part of the reference data.
+	ChallengeUntilMS int64 `json:"-"`
+	CanceledMS       int64 `json:"-"`
+}
+
+// maxChallenge bounds the challenge period of an export escrow.
+const maxChallenge = 30 * 24 * time.Hour
+
+// Destination is the Stellar account a peg-out pays
+// in place of the exporter's own,
+// with the memo the payment must carry,
+// chosen by the exporter in the pre-export tx.
+// Federation is the federation address, name*domain,
+// that the exporter resolved to the account and memo, if any.
+// The temp account is still merged into the exporter's account.
+// Account may be the M-address of a muxed account.
+type Destination struct {
+	Account    string `json:"destination,omitempty"`
+	MemoType   string `json:"memo_type,omitempty"` // text, id, or hash
+	Memo       string `json:"memo,omitempty"`      // a hash memo is base64
+	Federation string `json:"federation,omitempty"`
+}
+
+// check reports whether d is empty or a valid destination.
+func (d Destination) check() error {
+	if d == (Destination{}) {
+		return nil
+	}
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, stellar.BaseAccount(d.Account)); err != nil {
+		return fmt.Errorf("bad destination account %q", d.Account)
+	}
+	if d.Federation != "" && !federation.IsAddress(d.Federation) {
+		return fmt.Errorf("bad federation address %q", d.Federation)
+	}
+	return errors.Wrap(federation.CheckMemo(d.MemoType, d.Memo), "destination")
+}
+
+// memo returns d's memo,
+// or nil if d has none.
+func (d Destination) memo() stellar.Memo {
+	switch d.MemoType {
+	case "text":
+		return stellar.MemoText(d.Memo)
+	case "id":
+		id, _ := strconv.ParseUint(d.Memo, 10, 64)
+		return stellar.MemoID(id)
+	case "hash":
+		var h stellar.MemoHash
+		raw, _ := base64.StdEncoding.DecodeString(d.Memo)
+		copy(h[:], raw)
+		return h
+	}
+	return nil
+}
+
+// payee returns the main-chain account p pays.
+func (p *pegOut) payee() string {
+	if p.Destination.Account != "" {
+		return p.Destination.Account
+	}
+	return p.Exporter
+}
+
+// PegOutTimeBounds returns the time bounds of a peg-out authorized at now
+// that expires after ttl, or no bounds if ttl is zero.
+func PegOutTimeBounds(now time.Time, ttl time.Duration) TimeBounds {
+	if ttl <= 0 {
+		return TimeBounds{}
+	}
+	return TimeBounds{MinTime: now.Unix(), MaxTime: now.Add(ttl).Unix()}
+}
+
+// checkPreconditions reports whether the peg-out tx of p
+// carries the preconditions that pegout.min_seq_age and pegout.max_ledgers require.
+// An export whose peg-out tx does not
+// is moved to the failed state, from which it is refunded on txvm,
+// since the pre-export tx preauthorized the peg-out tx as it is.
+func (c *Custodian) checkPreconditions(ctx context.Context, p *pegOut) (bool, error) {
+	cfg := c.pegOutConfig()
+	var reason string
+	if minAge := int64(time.Duration(cfg.MinSeqAge) / time.Second); p.MinSeqAge < minAge {
+		reason = fmt.Sprintf("min sequence age %ds is below pegout.min_seq_age %s", p.MinSeqAge, time.Duration(cfg.MinSeqAge))
+	} else if n := cfg.MaxLedgers; n > 0 && (p.MaxLedger == 0 || int64(p.MaxLedger-p.MinLedger) > int64(n)) {
+		reason = fmt.Sprintf("ledger bounds %d to %d are wider than pegout.max_ledgers %d", p.MinLedger, p.MaxLedger, n)
+	}
+	if reason == "" {
+		return true, nil
+	}
+	log.Printf("peg-out of export %x: %s", p.TxID, reason)
+	err := c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutFail)
+	if err != nil {
+		return false, err
+	}
+	p.State = pegOutFail
+	return false, nil
+}
+
+// pegOutFees are the per-operation fees of the peg-out txs
+// preauthorized by a pre-export tx, in increasing order.
+// The custodian pegs out at the lowest
+// and moves up a level each time the peg-out is stuck.
+// At most one of them can succeed, since they share a sequence number.
+var pegOutFees = []uint64{baseFee, 10 * baseFee, 100 * baseFee}
+
 const (
 	custodianSigCheckerFmt = `txid x"%x" get 0 checksig verify`
 
@@ -96,10 +278,36 @@ var (
 )
 
 // Runs as a goroutine.
+// With pegout.shards configured,
+// each shard is pegged out by a worker of its own,
+// so a backlog in one asset does not delay the others.
 func (c *Custodian) pegOutFromExports(ctx context.Context, pegouts chan<- pegOut) {
 	defer log.Print("pegOutFromExports exiting")
 	defer close(pegouts)
 
+	shards, err := newPegOutShards(c.pegOutConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(shards) == 0 {
+		c.pegOutWorker(ctx, nil, pegouts)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, sh := range shards {
+		wg.Add(1)
+		go func(sh *pegOutShard) {
+			defer wg.Done()
+			c.pegOutWorker(ctx, sh, pegouts)
+		}(sh)
+	}
+	wg.Wait()
+}
+
+// pegOutWorker pegs out the exports of a shard,
+// or all of them for a nil shard,
+// as new exports are recorded.
+func (c *Custodian) pegOutWorker(ctx context.Context, sh *pegOutShard, pegouts chan<- pegOut) {
 	ch := make(chan struct{})
 	go func() {
 		c.exports.L.Lock()
@@ -109,177 +317,283 @@ func (c *Custodian) pegOutFromExports(ctx context.Context, pegouts chan<- pegOut
 				return
 			}
 			c.exports.Wait()
-			ch <- struct{}{}
+			select {
+			case ch <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
+	// Stuck peg-outs are remediated here too,
+	// since that must not run concurrently with pegOutPending
+	// for the same exports.
+	ticker := time.NewTicker(time.Duration(c.pegOutConfig().CheckInterval))
+	defer ticker.Stop()
+
+	// Exports held back by the shard's rate
+	// are pegged out when it allows.
+	var retry <-chan time.Time
+
 	for {
+		var (
+			ps  []pegOut
+			err error
+		)
 		select {
 		case <-ctx.Done():
 			return
 		case <-ch:
+			ps, err = c.pegOutPending(ctx, sh)
+		case <-retry:
+			ps, err = c.pegOutPending(ctx, sh)
+		case <-ticker.C:
+			ps, err = c.remediateStuck(ctx, sh)
+		}
+		if ctx.Err() != nil {
+			// Work cut short by shutdown is redone on restart.
+			return
 		}
-		const q = `SELECT txid, anchor, pubkey, asset_xdr, amount, seqnum, exporter, temp_addr FROM exports WHERE pegged_out IN ($1, $2)`
-
-		var (
-			txids, anchors, assetXDRs, pubkeys [][]byte
-			amounts, seqnums                   []int64
-			exporters, tempAddrs               []string
-		)
-		err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, func(txid, anchor, pubkey, assetXDR []byte, amount, seqnum int64, exporter, tempAddr string) {
-			txids = append(txids, txid)
-			amounts = append(amounts, amount)
-			assetXDRs = append(assetXDRs, assetXDR)
-			exporters = append(exporters, exporter)
-			tempAddrs = append(tempAddrs, tempAddr)
-			seqnums = append(seqnums, seqnum)
-			anchors = append(anchors, anchor)
-			pubkeys = append(pubkeys, pubkey)
-		})
 		if err != nil {
-			log.Fatalf("reading export rows: %s", err)
+			log.Fatal(err)
 		}
-		for i, txid := range txids {
-			var asset xdr.Asset
-			err = xdr.SafeUnmarshal(assetXDRs[i], &asset)
-			if err != nil {
-				log.Fatalf("unmarshalling asset from XDR %x: %s", assetXDRs[i], err)
-			}
-			var tempID xdr.AccountId
-			err = tempID.SetAddress(tempAddrs[i])
-			if err != nil {
-				log.Fatalf("setting temp address to %s: %s", tempAddrs[i], err)
-			}
-			var exporter xdr.AccountId
-			err = exporter.SetAddress(exporters[i])
-			if err != nil {
-				log.Fatalf("setting exporter address to %s: %s", exporters[i], err)
+		retry = nil
+		if sh.takeHeld() {
+			retry = time.After(sh.wait)
+		}
+		// Send peg-out info to goroutine for successes and non-retriable failures.
+		for _, p := range ps {
+			select {
+			case pegouts <- p:
+			case <-ctx.Done():
+				return
 			}
+		}
+	}
+}
 
-			log.Printf("pegging out export %x: %d of %s to %s", txid, amounts[i], asset.String(), exporters[i])
+// pegOutPending pegs out the recorded exports
+// that have not been pegged out yet or are to be retried.
+// It returns the exports whose peg-outs succeeded or definitely failed,
+// which are ready for the post-peg-out tx.
+// Exports not yet pegged out are screened first;
+// held ones are skipped, and denied ones fail.
+// Groups of screened exports to the same destination may be netted,
+// and the nettings are advanced.
+// Only the exports of sh are pegged out, all of them if it is nil,
+// and no faster than its rate allows.
+// It does nothing while peg-out submission is paused
+// or the custodian account has drifted from the custodian config.
+func (c *Custodian) pegOutPending(ctx context.Context, sh *pegOutShard) ([]pegOut, error) {
+	paused, err := c.paused(ctx, pausePegOut)
+	if err != nil || paused {
+		return nil, err
+	}
+	if c.accountHeld() {
+		return nil, nil
+	}
+	pending, err := c.pendingExports(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ready    []pegOut
+		screened []pegOut
+	)
+	for _, p := range pending {
+		if !sh.has(p.AssetXDR) {
+			continue
+		}
+		ok, err := c.screenPegOut(ctx, &p)
+		if err != nil {
+			return nil, err
+		}
+		if p.State == pegOutFail {
+			ready = append(ready, p)
+		}
+		if ok {
+			screened = append(screened, p)
+		}
+	}
+	netted, err := c.netPegOuts(ctx, screened)
+	if err != nil {
+		return nil, err
+	}
+	done, err := c.advanceNettings(ctx, sh)
+	if err != nil {
+		return nil, err
+	}
+	ready = append(ready, done...)
 
-			peggedOut := pegOutOK
-			err = c.pegOut(ctx, exporter, asset, amounts[i], tempID, xdr.SequenceNumber(seqnums[i]))
-			if err != nil {
-				peggedOut = pegOutFail
-				if herr, ok := errors.Root(err).(*horizon.Error); ok {
-					resultCodes, rerr := herr.ResultCodes()
-					if rerr != nil {
-						log.Fatalf("getting error codes from failed submission of tx %x (with horizon err '%s'): %s", txid, herr, rerr)
-					}
-					if resultCodes.TransactionCode == xdr.TransactionResultCodeTxBadSeq.String() {
-						peggedOut = pegOutRetry
-					}
-				}
-			}
-			result, err := c.DB.ExecContext(ctx, `UPDATE exports SET pegged_out=$1 WHERE txid=$2`, peggedOut, txid)
+	rolledBack, err := c.rolledBack(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Unix(0, c.nowMS()*int64(time.Millisecond))
+	for _, p := range screened {
+		if netted[string(p.TxID)] {
+			continue
+		}
+		w, err := c.withdrawal(ctx, &p)
+		if errors.Root(err) == errAmountRange {
+			// The export's amount has no Stellar equivalent.
+			log.Printf("peg-out of export %x: %s", p.TxID, err)
+			err = c.markFailed(ctx, &p, err)
 			if err != nil {
-				log.Fatalf("updating pegged_out in export table: %s", err)
+				return nil, err
 			}
-			numAffected, err := result.RowsAffected()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.State == pegOutRetry || rolledBack {
+			// An earlier submission may have been applied
+			// with its response lost, as when it timed out,
+			// or, after a rollback, its record lost with the restored db.
+			// Look the peg-out up by hash rather than resubmit it.
+			applied, err := c.verifyFinality(ctx, w)
 			if err != nil {
-				log.Fatalf("checking rows affected by update exports query for txid %x: %s", txid, err)
+				log.Printf("looking up peg-out of export %x: %s", p.TxID, err)
+				continue
 			}
-			if numAffected != 1 {
-				log.Fatalf("got %d rows affected by update exports query for txid %x, want 1", numAffected, txid)
-			}
-			// Send peg-out info to goroutine for successes and non-retriable failures.
-			if peggedOut == pegOutOK || peggedOut == pegOutFail {
-				pegouts <- pegOut{
-					TxID:     txid,
-					AssetXDR: assetXDRs[i],
-					TempAddr: tempAddrs[i],
-					Seqnum:   seqnums[i],
-					Exporter: exporters[i],
-					Amount:   amounts[i],
-					State:    peggedOut,
-					Anchor:   anchors[i],
-					Pubkey:   pubkeys[i],
+			if applied {
+				log.Printf("peg-out of export %x was already applied", p.TxID)
+				err = c.markSubmitted(ctx, &p, WithdrawalApplied, nil)
+				if err != nil {
+					return nil, err
+				}
+				_, err = c.recordPegOutReceipt(ctx, &p)
+				if err != nil {
+					return nil, err
 				}
+				ready = append(ready, p)
+				continue
+			}
+		}
+		if !sh.allow(now) {
+			// The rest wait for the next pass.
+			break
+		}
+		log.Printf("pegging out export %x: %d of asset %x to %s", p.TxID, p.Amount, p.AssetXDR, p.payee())
+
+		result, err := c.submitWithdrawal(ctx, w, p.FeeLevel)
+		if err != nil {
+			log.Printf("peg-out of export %x: %s", p.TxID, err)
+		}
+		err = c.markSubmitted(ctx, &p, result, err)
+		if err != nil {
+			return nil, err
+		}
+		if p.State == pegOutOK {
+			_, err = c.recordPegOutReceipt(ctx, &p)
+			if err != nil {
+				return nil, err
 			}
 		}
+		if p.State == pegOutOK || p.State == pegOutFail {
+			ready = append(ready, p)
+		}
 	}
+	return ready, c.revokeAuthorizations(ctx, sh)
 }
 
-func (c *Custodian) pegOut(ctx context.Context, exporter xdr.AccountId, asset xdr.Asset, amount int64, tempID xdr.AccountId, seqnum xdr.SequenceNumber) error {
-	tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), tempID.Address(), c.network, asset, amount, seqnum)
-	if err != nil {
-		return errors.Wrap(err, "building peg-out tx")
+// pegOutFee is the per-operation fee of a peg-out at the given fee level.
+func pegOutFee(level int) uint64 {
+	if level < 0 {
+		level = 0
 	}
-	_, err = stellar.SignAndSubmitTx(c.hclient, tx, c.seed)
-	return errors.Wrap(err, "submitting peg-out tx")
+	if level >= len(pegOutFees) {
+		level = len(pegOutFees) - 1
+	}
+	return pegOutFees[level]
 }
 
-func buildPegOutTx(custodianAddr, exporterAddr, tempAddr, network string, asset xdr.Asset, amount int64, seqnum xdr.SequenceNumber) (*b.TransactionBuilder, error) {
-	var paymentOp b.PaymentBuilder
-	switch asset.Type {
-	case xdr.AssetTypeAssetTypeNative:
-		lumens := xlm.Amount(amount)
-		paymentOp = b.Payment(
-			b.SourceAccount{AddressOrSeed: custodianAddr},
-			b.Destination{AddressOrSeed: exporterAddr},
-			b.NativeAmount{Amount: lumens.HorizonString()},
-		)
-	case xdr.AssetTypeAssetTypeCreditAlphanum4:
-		paymentOp = b.Payment(
-			b.SourceAccount{AddressOrSeed: custodianAddr},
-			b.Destination{AddressOrSeed: exporterAddr},
-			b.CreditAmount{
-				Code:   string(asset.AlphaNum4.AssetCode[:]),
-				Issuer: asset.AlphaNum4.Issuer.Address(),
-				Amount: strconv.FormatInt(amount, 10),
-			},
-		)
-	case xdr.AssetTypeAssetTypeCreditAlphanum12:
-		paymentOp = b.Payment(
-			b.SourceAccount{AddressOrSeed: custodianAddr},
-			b.Destination{AddressOrSeed: exporterAddr},
-			b.CreditAmount{
-				Code:   string(asset.AlphaNum12.AssetCode[:]),
-				Issuer: asset.AlphaNum12.Issuer.Address(),
-				Amount: strconv.FormatInt(amount, 10),
-			},
-		)
+func buildPegOutTx(custodianAddr, exporterAddr, tempAddr, network string, asset stellar.Asset, amount int64, seqnum stellar.SequenceNumber, fee uint64, bounds TimeBounds, dest Destination) (*stellar.Tx, error) {
+	payee := exporterAddr
+	if dest.Account != "" {
+		payee = dest.Account
 	}
-	mergeAccountOp := b.AccountMerge(
-		b.Destination{AddressOrSeed: exporterAddr},
-	)
-	return b.Transaction(
-		b.Network{Passphrase: network},
-		b.SourceAccount{AddressOrSeed: tempAddr},
-		b.Sequence{Sequence: uint64(seqnum) + 1},
-		b.BaseFee{Amount: baseFee},
-		mergeAccountOp,
-		paymentOp,
-	)
+	tx := &stellar.Tx{
+		Network: network,
+		Source:  tempAddr,
+		SeqNum:  seqnum + 1,
+		BaseFee: fee,
+		Memo:    dest.memo(),
+		Ops: []stellar.Op{
+			stellar.AccountMerge{Destination: exporterAddr},
+			pegOutPayment(custodianAddr, payee, asset, amount),
+		},
+	}
+	if bounds.MinTime != 0 || bounds.MaxTime != 0 {
+		tx.TimeBounds = &stellar.TimeBounds{MinTime: bounds.MinTime, MaxTime: bounds.MaxTime}
+	}
+	if bounds.MinLedger > 0 || bounds.MaxLedger > 0 {
+		tx.LedgerBounds = &stellar.LedgerBounds{MinLedger: bounds.MinLedger, MaxLedger: bounds.MaxLedger}
+	}
+	tx.MinSeqAge = uint64(bounds.MinSeqAge)
+	return tx, nil
 }
 
+// pegOutPayment builds the payment of amount of asset
+// from the custodian to payee.
+// A payment of a wrapped asset from the custodian, its issuer,
+// issues it.
+func pegOutPayment(custodianAddr, payee string, asset stellar.Asset, amount int64) stellar.Payment {
+	// Amounts are in stroops, 10^-7 units, for every asset.
+	return stellar.Payment{
+		Source:      custodianAddr,
+		Destination: payee,
+		Asset:       asset,
+		Amount:      amount,
+	}
+}
+
+// buildSettleTx builds the settlement tx of a nettable export,
+// which merges the temp account into the exporter's
+// without paying out the export,
+// in place of a peg-out tx.
+// Its no-op operation from the custodian's account
+// needs the custodian's signature,
+// which it gives only once it is to pay the export in a netted payment.
+func buildSettleTx(custodianAddr, exporterAddr, tempAddr, network string, seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+	return &stellar.Tx{
+		Network: network,
+		Source:  tempAddr,
+		SeqNum:  seqnum + 1,
+		BaseFee: baseFee,
+		Ops: []stellar.Op{
+			stellar.BumpSequence{Source: custodianAddr, BumpTo: 0},
+			stellar.AccountMerge{Destination: exporterAddr},
+		},
+	}, nil
+}
+
+// tempAccountBalance is the starting balance of a temporary account.
+// It covers the reserve for the account and its preauth signers,
+// the peg-out txs and the settlement tx, at 0.5 lumens each,
+// and the fee of the peg-out at its highest fee level.
+var tempAccountBalance = xlm.Amount(3+len(pegOutFees))*xlm.Lumen/2 + xlm.Lumen
+
 // createTempAccount builds and submits a transaction to the Stellar
 // network that creates a new temporary account. It returns the
 // temporary account keypair and sequence number.
-func createTempAccount(hclient horizon.ClientInterface, kp *keypair.Full) (*keypair.Full, xdr.SequenceNumber, error) {
-	root, err := hclient.Root()
-	if err != nil {
-		return nil, 0, errors.Wrap(err, "getting Horizon root")
-	}
+func createTempAccount(hclient stellar.Client, seqs *stellar.Sequencer, network string, kp *keypair.Full) (*keypair.Full, stellar.SequenceNumber, error) {
 	tempKP, err := keypair.Random()
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "generating random account")
 	}
-	tx, err := b.Transaction(
-		b.Network{Passphrase: root.NetworkPassphrase},
-		b.SourceAccount{AddressOrSeed: kp.Address()},
-		b.AutoSequence{SequenceProvider: hclient},
-		b.BaseFee{Amount: baseFee},
-		b.CreateAccount(
-			b.NativeAmount{Amount: (2 * xlm.Lumen).HorizonString()},
-			b.Destination{AddressOrSeed: tempKP.Address()},
-		),
-	)
-	if err != nil {
-		return nil, 0, errors.Wrap(err, "building temp account creation tx")
-	}
-	_, err = stellar.SignAndSubmitTx(hclient, tx, kp.Seed())
+	_, err = seqs.Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: network,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			BaseFee: baseFee,
+			Ops: []stellar.Op{
+				stellar.CreateAccount{Destination: tempKP.Address(), Amount: int64(tempAccountBalance)},
+			},
+		}, nil
+	}, kp.Seed())
 	if err != nil {
 		return nil, 0, errors.Wrapf(err, "submitting temp account creation tx")
 	}
@@ -293,68 +607,174 @@ func createTempAccount(hclient horizon.ClientInterface, kp *keypair.Full) (*keyp
 // SubmitPreExportTx builds and submits the two pre-export transactions
 // to the Stellar network.
 // The first transaction creates a new temporary account.
-// The second transaction sets the signer on the temporary account
-// to be a preauth transaction, which merges the account and pays
-// out the pegged-out funds.
+// The second transaction sets the signers on the temporary account
+// to be preauth transactions, which merge the account and pay
+// out the pegged-out funds,
+// one for each of the custodian's peg-out fee levels,
+// valid within bounds,
+// and the settlement tx, which lets the custodian net the export.
+// They pay dest, if it is not empty, and otherwise kp's account.
+// A credit asset needs the payee's trustline:
+// if kp's account is the payee and has none,
+// the second transaction adds it;
+// another payee with none is an error.
+// The export tx must carry the same bounds and dest.
 // The function returns the temporary account address and sequence number.
-func SubmitPreExportTx(hclient horizon.ClientInterface, kp *keypair.Full, custodian string, asset xdr.Asset, amount int64) (string, xdr.SequenceNumber, error) {
+func SubmitPreExportTx(hclient stellar.Client, kp *keypair.Full, custodian string, asset stellar.Asset, amount int64, bounds TimeBounds, dest Destination) (string, stellar.SequenceNumber, error) {
+	err := dest.check()
+	if err != nil {
+		return "", 0, err
+	}
+	trustOp, err := payeeTrust(hclient, kp.Address(), asset, dest)
+	if err != nil {
+		return "", 0, err
+	}
 	root, err := hclient.Root()
 	if err != nil {
 		return "", 0, errors.Wrap(err, "getting Horizon root")
 	}
 
-	tempKP, seqnum, err := createTempAccount(hclient, kp)
+	seqs := stellar.NewSequencer(hclient)
+	tempKP, seqnum, err := createTempAccount(hclient, seqs, root.NetworkPassphrase, kp)
 	if err != nil {
 		return "", 0, errors.Wrap(err, "creating temp account")
 	}
 
-	preauthTx, err := buildPegOutTx(custodian, kp.Address(), tempKP.Address(), root.NetworkPassphrase, asset, amount, seqnum)
-	if err != nil {
-		return "", 0, errors.Wrap(err, "building preauth tx")
+	var preauthTxs []*stellar.Tx
+	for _, fee := range pegOutFees {
+		preauthTx, err := buildPegOutTx(custodian, kp.Address(), tempKP.Address(), root.NetworkPassphrase, asset, amount, seqnum, fee, bounds, dest)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "building preauth tx")
+		}
+		preauthTxs = append(preauthTxs, preauthTx)
 	}
-	preauthTxHash, err := preauthTx.Hash()
+	settleTx, err := buildSettleTx(custodian, kp.Address(), tempKP.Address(), root.NetworkPassphrase, seqnum)
 	if err != nil {
-		return "", 0, errors.Wrap(err, "hashing preauth tx")
+		return "", 0, errors.Wrap(err, "building settlement tx")
 	}
-	hashStr, err := strkey.Encode(strkey.VersionByteHashTx, preauthTxHash[:])
-	if err != nil {
-		return "", 0, errors.Wrap(err, "encoding preauth tx hash")
-	}
-
-	tx, err := b.Transaction(
-		b.Network{Passphrase: root.NetworkPassphrase},
-		b.SourceAccount{AddressOrSeed: kp.Address()},
-		b.AutoSequence{SequenceProvider: hclient},
-		b.BaseFee{Amount: baseFee},
-		b.SetOptions(
-			b.SourceAccount{AddressOrSeed: tempKP.Address()},
-			b.MasterWeight(0),
-			b.SetThresholds(1, 1, 1),
-			b.AddSigner(hashStr, 1),
-		),
-	)
-	if err != nil {
-		return "", 0, errors.Wrap(err, "building pre-export tx")
+	var ops []stellar.Op
+	if trustOp != nil {
+		ops = append(ops, trustOp)
 	}
-	_, err = stellar.SignAndSubmitTx(hclient, tx, kp.Seed(), tempKP.Seed())
+	for _, preauthTx := range append(preauthTxs, settleTx) {
+		preauthTxHash, err := preauthTx.Hash()
+		if err != nil {
+			return "", 0, errors.Wrap(err, "hashing preauth tx")
+		}
+		hashStr, err := strkey.Encode(strkey.VersionByteHashTx, preauthTxHash[:])
+		if err != nil {
+			return "", 0, errors.Wrap(err, "encoding preauth tx hash")
+		}
+		ops = append(ops, stellar.SetOptions{
+			Source: tempKP.Address(),
+			Signer: &stellar.AccountSigner{Key: hashStr, Weight: 1},
+		})
+	}
+	zero, one := uint32(0), uint32(1)
+	ops = append(ops, stellar.SetOptions{
+		Source:        tempKP.Address(),
+		MasterWeight:  &zero,
+		LowThreshold:  &one,
+		MedThreshold:  &one,
+		HighThreshold: &one,
+	})
+
+	_, err = seqs.Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: root.NetworkPassphrase,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			BaseFee: baseFee,
+			Ops:     ops,
+		}, nil
+	}, kp.Seed(), tempKP.Seed())
 	if err != nil {
 		return "", 0, errors.Wrap(err, "pre-exporttx")
 	}
 	return tempKP.Address(), seqnum, nil
 }
 
+// payeeTrust checks the trustline of the payee of an export to its asset,
+// returning the change_trust op that adds the exporter's,
+// if the exporter is the payee and has none,
+// and an error if another payee has none.
+// Neither the native asset nor a payee that issues the asset needs one.
+func payeeTrust(hclient stellar.Client, exporter string, asset stellar.Asset, dest Destination) (stellar.Op, error) {
+	if asset.IsNative() {
+		return nil, nil
+	}
+	payee := exporter
+	if dest.Account != "" {
+		payee = dest.Account
+	}
+	if stellar.BaseAccount(payee) == asset.Issuer {
+		return nil, nil
+	}
+	trusted, _, err := stellar.Trustline(context.Background(), hclient, payee, asset)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking payee trustline")
+	}
+	if trusted {
+		return nil, nil
+	}
+	if payee != exporter {
+		return nil, errors.WithDetailf(&scerrors.AssetError{Asset: stellar.AssetKey(asset), Err: scerrors.ErrNoTrustline}, "payee %s", payee)
+	}
+	return stellar.ChangeTrust{Asset: asset, Limit: stellar.MaxTrustLimit}, nil
+}
+
 // BuildExportTx builds a txvm retirement tx for an asset issued
-// onto slidechain. It will retire `amount` of the asset, and the
+// onto slidechain by the given version of the import-issuance program.
+// It will retire `amount` of the asset, and the
 // remaining input will be output back to the original account.
-func BuildExportTx(ctx context.Context, asset xdr.Asset, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum xdr.SequenceNumber) (*bc.Tx, error) {
-	if inputAmt < exportAmt {
-		return nil, fmt.Errorf("cannot have input amount %d less than export amount %d", inputAmt, exportAmt)
+// The tempAddr, seqnum, bounds, and dest are those of the pre-export tx.
+func BuildExportTx(ctx context.Context, asset stellar.Asset, version int, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum stellar.SequenceNumber, bounds TimeBounds, dest Destination) (*bc.Tx, error) {
+	ic := issuanceContracts[version]
+	if ic == nil {
+		return nil, fmt.Errorf("unknown issuance version %d", version)
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	assetID := ic.assetID(assetXDR)
+	return buildExportTx(assetXDR, assetID, exportAmt, inputAmt, tempAddr, anchor, prv, seqnum, bounds, dest, ExportEscrow{}, false)
+}
+
+// BuildEscrowExportTx is BuildExportTx for an export held in escrow:
+// the custodian pegs it out only after the challenge period of escrow,
+// in which its watcher may cancel it.
+// The pre-export tx's bounds should outlast the challenge period,
+// or the peg-out will fail and the export be refunded.
+func BuildEscrowExportTx(ctx context.Context, asset stellar.Asset, version int, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum stellar.SequenceNumber, bounds TimeBounds, dest Destination, escrow ExportEscrow) (*bc.Tx, error) {
+	if len(escrow.Watcher) == 0 {
+		return nil, errors.New("escrow has no watcher")
+	}
+	if err := escrow.check(); err != nil {
+		return nil, err
+	}
+	ic := issuanceContracts[version]
+	if ic == nil {
+		return nil, fmt.Errorf("unknown issuance version %d", version)
 	}
 	assetXDR, err := asset.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
-	assetID := bc.NewHash(txvm.AssetID(importIssuanceSeed[:], assetXDR))
+	return buildExportTx(assetXDR, ic.assetID(assetXDR), exportAmt, inputAmt, tempAddr, anchor, prv, seqnum, bounds, dest, escrow, false)
+}
+
+// buildExportTx builds an export tx for the txvm asset assetID,
+// pegged out as the Stellar asset assetXDR.
+// The exported value is locked in the export contract,
+// or, if wrapped, paid to the custodian's reserve.
+func buildExportTx(assetXDR []byte, assetID bc.Hash, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum stellar.SequenceNumber, bounds TimeBounds, dest Destination, escrow ExportEscrow, wrapped bool) (*bc.Tx, error) {
+	if exportAmt <= 0 {
+		return nil, fmt.Errorf("export amount %d must be positive", exportAmt)
+	}
+	if inputAmt < exportAmt {
+		return nil, fmt.Errorf("cannot have input amount %d less than export amount %d", inputAmt, exportAmt)
+	}
 	var rawSeed [32]byte
 	copy(rawSeed[:], prv)
 	kp, err := keypair.FromRawSeed(rawSeed)
@@ -368,59 +788,102 @@ func BuildExportTx(ctx context.Context, asset xdr.Asset, exportAmt, inputAmt int
 	retireAnchor1 := txvm.VMHash("Split2", anchor)
 	retireAnchor := txvm.VMHash("Split1", retireAnchor1[:])
 	ref := pegOut{
-		AssetXDR: assetXDR,
-		TempAddr: tempAddr,
-		Seqnum:   int64(seqnum),
-		Exporter: kp.Address(),
-		Amount:   exportAmt,
-		Anchor:   retireAnchor[:],
-		Pubkey:   pubkey,
+		AssetXDR:    assetXDR,
+		TempAddr:    tempAddr,
+		Seqnum:      int64(seqnum),
+		Exporter:    kp.Address(),
+		Amount:      exportAmt,
+		Anchor:      retireAnchor[:],
+		Pubkey:      pubkey,
+		TimeBounds:  bounds,
+		Destination: dest,
+		Nettable:    true,
+		ExportEscrow: ExportEscrow{
+			Watcher:     escrow.Watcher,
+			ChallengeMS: escrow.ChallengeMS,
+		},
+	}
+	b, txid, err := unsignedExportProg(&ref, assetID, inputAmt, anchor, 1, []ed25519.PublicKey{pubkey}, wrapped)
+	if err != nil {
+		return nil, err
 	}
+	sigProg := standard.VerifyTxID(txid)
+	sig := ed25519.Sign(prv, append(sigProg, anchor...))
+	signExportProg(b, [][]byte{sig}, sigProg)
+
+	prog2 := b.Build()
+	var runlimit int64
+	tx, err := bc.NewTx(prog2, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	if err != nil {
+		return nil, errors.Wrap(err, "making export tx")
+	}
+	tx.Runlimit = math.MaxInt64 - runlimit
+	return tx, nil
+}
+
+// unsignedExportProg returns a builder holding the program of an export tx
+// with reference data ref, through its finalize,
+// and the ID of the tx.
+// The input is the pay-to-multisig output of inputAmt of assetID
+// with the given anchor, quorum, and pubkeys,
+// which also receive the change.
+func unsignedExportProg(ref *pegOut, assetID bc.Hash, inputAmt int64, anchor []byte, quorum int, pubkeys []ed25519.PublicKey, wrapped bool) (*txvmutil.Builder, [32]byte, error) {
+	exportAmt, pubkey := ref.Amount, ed25519.PublicKey(ref.Pubkey)
 	refdata, err := json.Marshal(ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "marshaling reference data")
+		return nil, [32]byte{}, errors.Wrap(err, "marshaling reference data")
 	}
 	b := new(txvmutil.Builder)
-	b.PushdataBytes(refdata)                                                                                             // con stack: json
-	b.Op(op.Put)                                                                                                         // arg stack: json
-	standard.SpendMultisig(b, 1, []ed25519.PublicKey{pubkey}, inputAmt, assetID, anchor, standard.PayToMultisigSeed1[:]) // arg stack: inputval, sigcheck
-	b.Op(op.Get).Op(op.Get)                                                                                              // con stack: sigcheck, inputval
-	b.PushdataInt64(exportAmt).Op(op.Split)                                                                              // con stack: sigcheck, changeval, retireval
-	b.PushdataInt64(1).Op(op.Roll)                                                                                       // con stack: sigcheck, retireval, changeval
+	b.PushdataBytes(refdata)                                                                              // con stack: json
+	b.Op(op.Put)                                                                                          // arg stack: json
+	standard.SpendMultisig(b, quorum, pubkeys, inputAmt, assetID, anchor, standard.PayToMultisigSeed1[:]) // arg stack: inputval, sigcheck
+	b.Op(op.Get).Op(op.Get)                                                                               // con stack: sigcheck, inputval
+	b.PushdataInt64(exportAmt).Op(op.Split)                                                               // con stack: sigcheck, changeval, retireval
+	b.PushdataInt64(1).Op(op.Roll)                                                                        // con stack: sigcheck, retireval, changeval
 	if inputAmt != exportAmt {
-		b.PushdataBytes(nil).Op(op.Put)                                                    // con stack: sigcheck, retireval, changeval; arg stack: refdata
-		b.Op(op.Put)                                                                       // con stack: sigcheck, retireval; arg stack: refdata, changeval
-		b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkey}
-		b.PushdataInt64(1).Op(op.Put)                                                      // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkey}, 1
-		b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)           // con stack: sigcheck, retireval
+		b.PushdataBytes(nil).Op(op.Put) // con stack: sigcheck, retireval, changeval; arg stack: refdata
+		b.Op(op.Put)                    // con stack: sigcheck, retireval; arg stack: refdata, changeval
+		b.Tuple(func(tup *txvmutil.TupleBuilder) {
+			for _, p := range pubkeys {
+				tup.PushdataBytes(p)
+			}
+		}).Op(op.Put) // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkeys}
+		b.PushdataInt64(int64(quorum)).Op(op.Put)                                // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkeys}, quorum
+		b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call) // con stack: sigcheck, retireval
 	} else {
 		b.Op(op.Drop) // con stack: sigcheck, retireval
 	}
 	// con stack: sigcheck, retireval
-	b.PushdataInt64(0).Op(op.Split).PushdataInt64(1).Op(op.Roll).Op(op.Put)            // con stack: sigcheck, zeroval; arg stack: retireval
-	b.PushdataBytes(refdata).Op(op.Put)                                                // con stack: sigcheck, zeroval; arg stack: retireval, json
-	b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // con stack: sigcheck, zeroval; arg stack: retireval, json, {pubkey}
-	b.PushdataBytes(exportContract1Prog)                                               // con stack: sigchecker, zeroval, exportContract; arg stack: retireval, json, {pubkey}
-	b.Op(op.Contract).Op(op.Call)                                                      // con stack: sigchecker, zeroval
-	b.Op(op.Finalize)                                                                  // con stack: sigchecker
+	if wrapped {
+		b.PushdataInt64(0).Op(op.Split)                                                          // con stack: sigcheck, retireval, zeroval
+		b.PushdataBytes(refdata).Op(op.Put)                                                      // con stack: sigcheck, retireval, zeroval; arg stack: json
+		b.PushdataInt64(1).Op(op.Roll).Op(op.Put)                                                // con stack: sigcheck, zeroval; arg stack: json, retireval
+		b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(custodianPub) }).Op(op.Put) // con stack: sigcheck, zeroval; arg stack: json, retireval, {custodianPub}
+		b.PushdataInt64(1).Op(op.Put)                                                            // con stack: sigcheck, zeroval; arg stack: json, retireval, {custodianPub}, 1
+		b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)                 // con stack: sigcheck, zeroval
+	} else {
+		b.PushdataInt64(0).Op(op.Split).PushdataInt64(1).Op(op.Roll).Op(op.Put)            // con stack: sigcheck, zeroval; arg stack: retireval
+		b.PushdataBytes(refdata).Op(op.Put)                                                // con stack: sigcheck, zeroval; arg stack: retireval, json
+		b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // con stack: sigcheck, zeroval; arg stack: retireval, json, {pubkey}
+		b.PushdataBytes(exportContract1Prog)                                               // con stack: sigchecker, zeroval, exportContract; arg stack: retireval, json, {pubkey}
+		b.Op(op.Contract).Op(op.Call)                                                      // con stack: sigchecker, zeroval
+	}
+	b.Op(op.Finalize) // con stack: sigchecker
 	prog1 := b.Build()
 	vm, err := txvm.Validate(prog1, 3, math.MaxInt64, txvm.StopAfterFinalize)
 	if err != nil {
-		return nil, errors.Wrap(err, "computing transaction ID")
+		return nil, [32]byte{}, errors.Wrap(err, "computing transaction ID")
 	}
-	sigProg := standard.VerifyTxID(vm.TxID)
-	msg := append(sigProg, anchor...)
-	sig := ed25519.Sign(prv, msg)
-	b.PushdataBytes(sig).Op(op.Put)
-	b.PushdataBytes(sigProg).Op(op.Put)
-	b.Op(op.Call)
+	return b, vm.TxID, nil
+}
 
-	prog2 := b.Build()
-	var runlimit int64
-	tx, err := bc.NewTx(prog2, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
-	if err != nil {
-		return nil, errors.Wrap(err, "making export tx")
+// signExportProg completes the program of an export tx in b
+// with a signature of sigProg by each signer of its input, in order,
+// left empty for those not signing.
+func signExportProg(b *txvmutil.Builder, sigs [][]byte, sigProg []byte) {
+	for _, sig := range sigs {
+		b.PushdataBytes(sig).Op(op.Put)
 	}
-	tx.Runlimit = math.MaxInt64 - runlimit
-	return tx, nil
+	b.PushdataBytes(sigProg).Op(op.Put)
+	b.Op(op.Call)
 }
@@ -3,127 +3,331 @@ package slidechain
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
 	"testing"
 	"time"
 
-	"github.com/interstellar/slingshot/slidechain/mockhorizon"
+	"encoding/base64"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
 	"github.com/interstellar/slingshot/slidechain/stellar"
-	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
-	"github.com/stellar/go/xdr"
+	"github.com/stellar/go/network"
+	"reflect"
 )
 
 func TestPegOut(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	testdir, err := ioutil.TempDir("", t.Name())
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(testdir)
-	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer db.Close()
-	hclient := mockhorizon.New()
-	c, err := newCustodian(ctx, db, hclient, DefaultBlockInterval)
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
 	if err != nil {
 		t.Fatal(err)
 	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
 
-	pegouts := make(chan pegOut)
-	go c.pegOutFromExports(ctx, pegouts)
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := newCustodian(ctx, db, srv.Client(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	var lumen xdr.Asset
-	lumen.Type = xdr.AssetTypeAssetTypeNative
-	lumenXDR, err := lumen.MarshalBinary()
-	if err != nil {
-		t.Fatal(err)
-	}
-	amount := 50
-	kp, err := keypair.Random()
-	if err != nil {
-		t.Fatal(err)
-	}
-	err = stellar.FundAccount(kp.Address())
-	if err != nil {
-		t.Fatalf("error funding account %s: %s", kp.Address(), err)
-	}
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
 
-	tempAddr, seqnum, err := SubmitPreExportTx(c.hclient, kp, c.AccountID.Address(), lumen, int64(amount))
-	if err != nil {
-		t.Fatal(err)
-	}
+		lumen := stellar.NativeAsset()
+		lumenXDR, err := lumen.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount := 50
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
 
-	var zero32 [32]byte // anchor and pubkey do not matter to test this functionality
-	_, err = c.DB.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", []byte("test"), amount, lumenXDR, tempAddr, seqnum, kp.Address(), zero32[:], zero32[:])
-	if err != nil && err != context.Canceled {
-		t.Fatal(err)
-	}
+		tempAddr, seqnum, err := SubmitPreExportTx(c.hclient, kp, c.AccountID, lumen, int64(amount), TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	c.exports.Broadcast()
+		var zero32 [32]byte // anchor and pubkey do not matter to test this functionality
+		_, err = c.DB.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", []byte("test"), amount, lumenXDR, tempAddr, seqnum, kp.Address(), zero32[:], zero32[:])
+		if err != nil && err != context.Canceled {
+			t.Fatal(err)
+		}
 
-	ch := make(chan struct{})
+		c.exports.Broadcast()
 
-	go func() {
-		var cursor horizon.Cursor
-		for {
-			err := c.hclient.StreamTransactions(ctx, kp.Address(), &cursor, func(tx horizon.Transaction) {
-				log.Printf("received tx: %s", tx.EnvelopeXdr)
-				var env xdr.TransactionEnvelope
-				err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
-				if err != nil {
-					t.Fatal(err)
-				}
-				if env.Tx.SourceAccount.Address() != tempAddr {
-					log.Println("source accounts don't match, skipping...")
-					return
-				}
-				if len(env.Tx.Operations) != 2 {
-					t.Fatalf("too many operations got %d, want 2", len(env.Tx.Operations))
-				}
-				op := env.Tx.Operations[0]
-				if op.Body.Type != xdr.OperationTypeAccountMerge {
-					t.Fatalf("wrong operation type: got %s, want %s", op.Body.Type, xdr.OperationTypeAccountMerge)
-				}
-				if op.Body.Destination.Address() != kp.Address() {
-					t.Fatalf("wrong account merge destination: got %s, want %s", op.Body.Destination.Address(), kp.Address())
-				}
+		ch := make(chan struct{})
 
-				op = env.Tx.Operations[1]
-				if op.Body.Type != xdr.OperationTypePayment {
-					t.Fatalf("wrong operation type: got %s, want %s", op.Body.Type, xdr.OperationTypePayment)
-				}
-				paymentOp := op.Body.PaymentOp
-				if paymentOp.Destination.Address() != kp.Address() {
-					t.Fatalf("incorrect payment destination got %s, want %s", paymentOp.Destination.Address(), kp.Address())
-				}
-				if paymentOp.Amount != 50 {
-					t.Fatalf("got incorrect payment amount %d, want %d", paymentOp.Amount, 50)
-				}
-				if paymentOp.Asset.Type != xdr.AssetTypeAssetTypeNative {
-					t.Fatalf("got incorrect payment asset %s, want lumens", paymentOp.Asset.String())
+		go func() {
+			var cursor stellar.Cursor
+			for {
+				err := c.hclient.StreamTransactions(ctx, kp.Address(), &cursor, func(tx stellar.Transaction) {
+					log.Printf("received tx: %s", tx.EnvelopeXdr)
+					ptx, err := stellar.DecodeTx(tx.EnvelopeXdr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ptx.Source != tempAddr {
+						log.Println("source accounts don't match, skipping...")
+						return
+					}
+					if len(ptx.Ops) != 2 {
+						t.Fatalf("too many operations got %d, want 2", len(ptx.Ops))
+					}
+					merge, ok := ptx.Ops[0].(stellar.AccountMerge)
+					if !ok {
+						t.Fatalf("wrong operation type: got %T, want stellar.AccountMerge", ptx.Ops[0])
+					}
+					if merge.Destination != kp.Address() {
+						t.Fatalf("wrong account merge destination: got %s, want %s", merge.Destination, kp.Address())
+					}
+
+					paymentOp, ok := ptx.Ops[1].(stellar.Payment)
+					if !ok {
+						t.Fatalf("wrong operation type: got %T, want stellar.Payment", ptx.Ops[1])
+					}
+					if paymentOp.Destination != kp.Address() {
+						t.Fatalf("incorrect payment destination got %s, want %s", paymentOp.Destination, kp.Address())
+					}
+					if paymentOp.Amount != 50 {
+						t.Fatalf("got incorrect payment amount %d, want %d", paymentOp.Amount, 50)
+					}
+					if !paymentOp.Asset.IsNative() {
+						t.Fatalf("got incorrect payment asset %s, want lumens", stellar.AssetKey(paymentOp.Asset))
+					}
+					close(ch)
+				})
+				if err != nil {
+					log.Printf("error streaming from Horizon: %s, retrying in 1s", err)
+					time.Sleep(time.Second)
 				}
-				close(ch)
-			})
-			if err != nil {
-				log.Printf("error streaming from Horizon: %s, retrying in 1s", err)
-				time.Sleep(time.Second)
 			}
+		}()
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("context timed out: no peg-out tx seen")
+		case <-ch:
 		}
-	}()
+		// Wait for peg-out to be written.
+		// Avoids closing the database while the watch peg-outs goroutine still needs it.
+		<-pegouts
+	})
+}
 
-	select {
-	case <-ctx.Done():
-		t.Fatal("context timed out: no peg-out tx seen")
-	case <-ch:
+// TestPegOutTxEnvelopes checks that peg-out and settle txs
+// are built as they were with github.com/stellar/go/build,
+// whose v0 envelopes are the want envelopes below.
+// Exporters have preauthorized the hashes of txs built before,
+// so any change to their encoding strands those exports.
+// txnbuild gives the same txs in v1 envelopes,
+// which for a classic tx are the v0 envelope after the envelope type,
+// and which hash the same.
+func TestPegOutTxEnvelopes(t *testing.T) {
+	kp := func(b byte) *keypair.Full {
+		var seed [32]byte
+		for i := range seed {
+			seed[i] = b
+		}
+		k, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	cust, exp, temp, pay := kp(1), kp(2), kp(3), kp(4)
+	usd := stellar.Asset{Code: "USD", Issuer: cust.Address()}
+	long := stellar.Asset{Code: "LONGASSET12", Issuer: cust.Address()}
+	cases := []struct {
+		name     string
+		asset    stellar.Asset
+		amount   int64
+		fee      uint64
+		bounds   TimeBounds
+		dest     Destination
+		wantHash string
+		wantEnv  string
+	}{
+		{
+			name:     "native",
+			asset:    stellar.NativeAsset(),
+			amount:   12345678,
+			fee:      100,
+			bounds:   TimeBounds{},
+			dest:     Destination{},
+			wantHash: "383afde014fae60a3e23fbcb6224e6d4059e4f69471961d8430454ccbfef4cf3",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAAyAAAAAEAAAABAAAAAAAAAAAAAAACAAAAAAAAAAgAAAAAgTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5QAAAABAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAQAAAACBOXcOqH0XX1ajVGbDTH7My42KkbTuN6Jd9g9bj8mzlAAAAAAAAAAAALxhTgAAAAAAAAABrIc30QAAAED9Zba6W2GaDU4Yz4RretP8ZdcUHB3kM6K/S0zJXGiAmTLh6dLzRE3tw0d7mQ3m+76hpCyX3Jdj88280U2o9mIO",
+		},
+		{
+			name:     "usd-fee2",
+			asset:    usd,
+			amount:   1,
+			fee:      400,
+			bounds:   TimeBounds{},
+			dest:     Destination{},
+			wantHash: "e6618753675e7fdaa70074db57621edfbc194e7602bc02bc0cab29432077d4ae",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAADIAAAAAEAAAABAAAAAAAAAAAAAAACAAAAAAAAAAgAAAAAgTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5QAAAABAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAQAAAACBOXcOqH0XX1ajVGbDTH7My42KkbTuN6Jd9g9bj8mzlAAAAAFVU0QAAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAAAAAAEAAAAAAAAAAayHN9EAAABA367vor8Bk4pGyVgO9fssJhleMehXVB79N9xKQU5d0Hqcp8U/3uZOvoucabiyxjb0fQmsTIHQYFwJSAKGVc+oAQ==",
+		},
+		{
+			name:     "long-bounds",
+			asset:    long,
+			amount:   50000000000,
+			fee:      1000,
+			bounds:   TimeBounds{MinTime: 1500000000, MaxTime: 1500003600},
+			dest:     Destination{},
+			wantHash: "10c178e38139faaea8d1642aa600417ba31bd8e41669591eb0421f248141497d",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAH0AAAAAEAAAABAAAAAQAAAABZaC8AAAAAAFloPRAAAAAAAAAAAgAAAAAAAAAIAAAAAIE5dw6ofRdfVqNUZsNMfszLjYqRtO43ol32D1uPybOUAAAAAQAAAACKiOPddAnxlf1S2y08ul1yymcJvx2UEhvzdIgBtA9vXAAAAAEAAAAAgTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5QAAAACTE9OR0FTU0VUMTIAAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAC6Q7dAAAAAAAAAAAAayHN9EAAABAPig5wrUSuDANuH080YXIm860FjKGG3g1V/vLN2BKvAxhkNrZAlnJOc1jl0Cknr3t4csoKoponMFPmcEPtw7LBA==",
+		},
+		{
+			name:     "dest-text",
+			asset:    usd,
+			amount:   7,
+			fee:      100,
+			bounds:   TimeBounds{},
+			dest:     Destination{Account: pay.Address(), MemoType: "text", Memo: "hello"},
+			wantHash: "1a7f82f27d30e7c7add8abac507b0061d02656568556ceaef49eac97e062f7d7",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAAyAAAAAEAAAABAAAAAAAAAAEAAAAFaGVsbG8AAAAAAAACAAAAAAAAAAgAAAAAgTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5QAAAABAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAQAAAADKk6wXBRhwcdZ7g8f/Dv6BCOjsRTBXXXcmh5Mz29q+fAAAAAFVU0QAAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAAAAAAcAAAAAAAAAAayHN9EAAABA9jCRMuII7X7tM0tjXPyaYCXm95Oka1EubC9aOGsP3OvlIbkzFonP+AsFYW41tgwvCnQTISYBvzUT9vtZWUMyBw==",
+		},
+		{
+			name:     "dest-id",
+			asset:    stellar.NativeAsset(),
+			amount:   7,
+			fee:      100,
+			bounds:   TimeBounds{MinTime: 1},
+			dest:     Destination{Account: pay.Address(), MemoType: "id", Memo: "18446744073709551615"},
+			wantHash: "e3eaf6833fb147be1b6b52bb459ee9784a7066064a8ca865a5a6059b2716169c",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAAyAAAAAEAAAABAAAAAQAAAAAAAAABAAAAAAAAAAAAAAAC//////////8AAAACAAAAAAAAAAgAAAAAgTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5QAAAABAAAAAIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29cAAAAAQAAAADKk6wXBRhwcdZ7g8f/Dv6BCOjsRTBXXXcmh5Mz29q+fAAAAAAAAAAAAAAABwAAAAAAAAABrIc30QAAAEDHuUhJq78w7KoGiKuatd2VMokjgkaJFt1QWccZw+5A/HZpZYsQZNIRXneccNJCDOCEgbqKvHnRrhEW1jnx9xMA",
+		},
+		{
+			name:     "dest-hash",
+			asset:    stellar.NativeAsset(),
+			amount:   7,
+			fee:      100,
+			bounds:   TimeBounds{},
+			dest:     Destination{Account: pay.Address(), MemoType: "hash", Memo: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="},
+			wantHash: "a248043f2096fbe231b134edd7e9c5ca713d9c3cd6d09b58134d6da19410d04a",
+			wantEnv:  "AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAAyAAAAAEAAAABAAAAAAAAAAMAAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHwAAAAIAAAAAAAAACAAAAACBOXcOqH0XX1ajVGbDTH7My42KkbTuN6Jd9g9bj8mzlAAAAAEAAAAAiojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1wAAAABAAAAAMqTrBcFGHBx1nuDx/8O/oEI6OxFMFdddyaHkzPb2r58AAAAAAAAAAAAAAAHAAAAAAAAAAGshzfRAAAAQPduGbG2+8oY52Z/JpcYWAde2ONho5/xqe+wPx/leSbKC/+Wg3JDXeh5U/6m/itXNMPWy6L8jUyeZ+fBFXjdMwI=",
+		},
+	}
+	check := func(name string, tx *stellar.Tx, wantHash, wantEnv string, seeds ...string) {
+		t.Helper()
+		hash, err := stellar.TxHash(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != wantHash {
+			t.Errorf("%s: got hash %s, want %s", name, hash, wantHash)
+		}
+		env, err := tx.Sign(seeds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v0, err := base64.StdEncoding.DecodeString(wantEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1 := base64.StdEncoding.EncodeToString(append([]byte{0, 0, 0, 2}, v0...))
+		if env != v1 {
+			t.Errorf("%s: got envelope %s, want %s", name, env, v1)
+		}
+		// The old envelope still decodes, to the same tx.
+		old, err := stellar.DecodeTx(wantEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.Network = tx.Network
+		if hash, err := stellar.TxHash(old); err != nil || hash != wantHash {
+			t.Errorf("%s: decoded old envelope with hash %s (%v), want %s", name, hash, err, wantHash)
+		}
+		got, err := stellar.DecodeTx(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Signatures, old.Signatures) {
+			t.Errorf("%s: got signatures %x, want %x", name, got.Signatures, old.Signatures)
+		}
+	}
+	for _, c := range cases {
+		tx, err := buildPegOutTx(cust.Address(), exp.Address(), temp.Address(), network.TestNetworkPassphrase, c.asset, c.amount, 4294967296, c.fee, c.bounds, c.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(c.name, tx, c.wantHash, c.wantEnv, temp.Seed())
 	}
-	// Wait for peg-out to be written.
-	// Avoids closing the database while the watch peg-outs goroutine still needs it.
-	<-pegouts
+	tx, err := buildSettleTx(cust.Address(), exp.Address(), temp.Address(), network.PublicNetworkPassphrase, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("settle", tx,
+		"0719ee742e73aeab9ab927482222e79be55716454c76d16ad93429432b0f38cf",
+		"AAAAAO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfRAAAAyAAAAAAAAABkAAAAAAAAAAAAAAACAAAAAQAAAACKiOPddAnxlf1S2y08ul1yymcJvx2UEhvzdIgBtA9vXAAAAAsAAAAAAAAAAAAAAAAAAAAIAAAAAIE5dw6ofRdfVqNUZsNMfszLjYqRtO43ol32D1uPybOUAAAAAAAAAAKshzfRAAAAQI1j5UaCQ+jECfo48RqxICUYzI0FORua/s2TswkAkZNzN2xp7TUlWUtBcSg6D15+kFF4pswDBSUST/efrAVnAQq0D29cAAAAQFHWH8u6dCyGMUX/7ARxpAINY3V0J1lJz/GL0lwVJ7lRKkjQU7nmCf2WCj8R9DcLpkcyXzVPVzRX1YGA5xLLkAE=",
+		temp.Seed(), cust.Seed())
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.PegOut.MinSeqAge = config.Duration(time.Minute)
+		cfg.PegOut.MaxLedgers = 100
+		c := &Custodian{DB: db, cfg: cfg}
+
+		cases := []struct {
+			name   string
+			bounds TimeBounds
+			want   bool
+		}{
+			{"none", TimeBounds{}, false},
+			{"young", TimeBounds{MinLedger: 10, MaxLedger: 20, MinSeqAge: 59}, false},
+			{"no max ledger", TimeBounds{MinLedger: 10, MinSeqAge: 60}, false},
+			{"wide", TimeBounds{MinLedger: 10, MaxLedger: 111, MinSeqAge: 60}, false},
+			{"ok", TimeBounds{MinLedger: 10, MaxLedger: 110, MinSeqAge: 60}, true},
+		}
+		for _, tc := range cases {
+			p := &pegOut{
+				TxID:       []byte(tc.name),
+				AssetXDR:   []byte{1},
+				TempAddr:   "temp",
+				Exporter:   "exporter",
+				Amount:     10,
+				Anchor:     []byte{1},
+				Pubkey:     []byte{2},
+				TimeBounds: tc.bounds,
+			}
+			err = c.insertExport(ctx, p.TxID, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := c.checkPreconditions(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantState := pegOutFail
+			if tc.want {
+				wantState = pegOutNotYet
+			}
+			var state pegOutState
+			err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.want || p.State != wantState || state != wantState {
+				t.Errorf("%s: got %v in state %s (%s in the db), want %v in state %s", tc.name, ok, p.State, state, tc.want, wantState)
+			}
+		}
+	})
 }
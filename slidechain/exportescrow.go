@@ -0,0 +1,156 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+const exportCanceledAlert = "export-canceled"
+
+// check reports whether e is empty or a valid escrow.
+func (e ExportEscrow) check() error {
+	if len(e.Watcher) == 0 && e.ChallengeMS == 0 {
+		return nil
+	}
+	if len(e.Watcher) != ed25519.PublicKeySize {
+		return errors.New("escrow watcher has wrong size")
+	}
+	if e.ChallengeMS <= 0 || time.Duration(e.ChallengeMS)*time.Millisecond > maxChallenge {
+		return fmt.Errorf("escrow challenge period must be positive and at most %s", maxChallenge)
+	}
+	return nil
+}
+
+// checkExportEscrow reports whether the escrowed export p,
+// if it is one, may be pegged out:
+// once its challenge period has passed without a cancellation.
+// A canceled export is moved to the failed state,
+// from which it is refunded on txvm.
+func (c *Custodian) checkExportEscrow(ctx context.Context, p *pegOut) (bool, error) {
+	if len(p.Watcher) == 0 {
+		return true, nil
+	}
+	if p.CanceledMS > 0 {
+		err := c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutFail)
+		if err != nil {
+			return false, err
+		}
+		p.State = pegOutFail
+		return false, nil
+	}
+	return c.nowMS() >= p.ChallengeUntilMS, nil
+}
+
+// CancelExportRequest is the request body of /export/cancel.
+type CancelExportRequest struct {
+	TxID []byte `json:"txid"` // of the export tx
+
+	// Signature is by the export's watcher of SigMsg.
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message signed in an /export/cancel request.
+func (r *CancelExportRequest) SigMsg() []byte {
+	msg := []byte("slidechain export cancel\x00")
+	msg = append(msg, r.TxID...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// CancelExport is the handler for /export/cancel,
+// where the watcher of an escrowed export
+// cancels it within its challenge period,
+// so that it is refunded instead of pegged out.
+// Operators are alerted to each cancellation.
+func (c *Custodian) CancelExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "canceling an export requires POST")
+		return
+	}
+	ctx := req.Context()
+	var r CancelExportRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	ps, err := c.queryExports(ctx, `FROM exports e WHERE e.txid=$1`, r.TxID)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if len(ps) == 0 || len(ps[0].Watcher) == 0 {
+		net.Errorf(w, http.StatusNotFound, "no escrowed export %x", r.TxID)
+		return
+	}
+	p := ps[0]
+	if !ed25519.Verify(p.Watcher, r.SigMsg(), r.Signature) {
+		net.Errorf(w, http.StatusUnauthorized, "bad signature")
+		return
+	}
+	nowMS := c.nowMS()
+	const q = `UPDATE exports SET canceled_ms=$1 WHERE txid=$2 AND pegged_out=$3 AND canceled_ms=0 AND challenge_until_ms > $1`
+	res, err := c.DB.ExecContext(ctx, q, nowMS, r.TxID, pegOutNotYet)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording cancellation: %s", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if p.CanceledMS > 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		net.Errorf(w, http.StatusConflict, "the challenge period of export %x has ended", r.TxID)
+		return
+	}
+	detail := fmt.Sprintf("export %x of %d %s canceled by its watcher", r.TxID, p.Amount, assetName(p.AssetXDR))
+	err = c.alert(ctx, exportCanceledAlert, r.TxID, detail)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if c.exports != nil {
+		c.exports.Broadcast()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// watchChallenges runs as a goroutine,
+// waking the peg-out workers
+// as the challenge periods of escrowed exports end.
+func (c *Custodian) watchChallenges(ctx context.Context) {
+	defer log.Println("watchChallenges exiting")
+
+	ticker := time.NewTicker(exportScanPoll)
+	defer ticker.Stop()
+
+	last := c.nowMS()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		nowMS := c.nowMS()
+		var n int
+		const q = `SELECT COUNT(*) FROM exports WHERE pegged_out=$1 AND challenge_until_ms > $2 AND challenge_until_ms <= $3`
+		err := c.DB.QueryRowContext(ctx, q, pegOutNotYet, last, nowMS).Scan(&n)
+		if err != nil {
+			log.Printf("error checking export challenge periods: %s", err)
+			continue
+		}
+		last = nowMS
+		if n > 0 {
+			c.exports.Broadcast()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestExportEscrow(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Unix(1000, 0)
+		c := &Custodian{DB: db, now: func() time.Time { return now }}
+		assetXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		watcherPub, watcherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		until := c.nowMS() + int64(time.Hour/time.Millisecond)
+		const q = `INSERT INTO exports (txid, exporter, amount, asset_xdr, temp_addr, seqnum, anchor, pubkey, pegged_out, watcher, challenge_ms, challenge_until_ms) VALUES ($1, 'exporter', 20, $2, 'temp', 1, x'01', x'02', $3, $4, $5, $6)`
+		for _, txid := range []string{"held", "late"} {
+			_, err = db.Exec(q, []byte(txid), assetXDR, pegOutNotYet, []byte(watcherPub), int64(time.Hour/time.Millisecond), until)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		export := func(txid string) *pegOut {
+			t.Helper()
+			ps, err := c.queryExports(ctx, `FROM exports e WHERE e.txid=$1`, []byte(txid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ps) != 1 {
+				t.Fatalf("got %d exports %s, want 1", len(ps), txid)
+			}
+			return &ps[0]
+		}
+		cancel := func(txid string, prv ed25519.PrivateKey) int {
+			t.Helper()
+			r := CancelExportRequest{TxID: []byte(txid)}
+			r.Signature = ed25519.Sign(prv, r.SigMsg())
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.CancelExport(w, httptest.NewRequest("POST", "/export/cancel", bytes.NewReader(body)))
+			return w.Code
+		}
+
+		ok, err := c.checkExportEscrow(ctx, export("held"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("pegged out an export within its challenge period")
+		}
+		_, otherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := cancel("held", otherPrv); code != http.StatusUnauthorized {
+			t.Errorf("got status %d canceling with the wrong key, want %d", code, http.StatusUnauthorized)
+		}
+		if code := cancel("held", watcherPrv); code != http.StatusNoContent {
+			t.Fatalf("got status %d canceling, want %d", code, http.StatusNoContent)
+		}
+		alerted, err := c.alerted(ctx, exportCanceledAlert, []byte("held"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for a canceled export")
+		}
+
+		now = now.Add(2 * time.Hour)
+		p := export("held")
+		ok, err = c.checkExportEscrow(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok || p.State != pegOutFail {
+			t.Errorf("got ok %v and state %d for a canceled export, want a failure", ok, p.State)
+		}
+		if code := cancel("late", watcherPrv); code != http.StatusConflict {
+			t.Errorf("got status %d canceling after the challenge period, want %d", code, http.StatusConflict)
+		}
+		ok, err = c.checkExportEscrow(ctx, export("late"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("held an export after its challenge period")
+		}
+	})
+}
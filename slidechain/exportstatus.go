@@ -0,0 +1,169 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// PegOutReceipt is where on Stellar a completed peg-out was applied,
+// with which the exporter can verify the payment independently.
+type PegOutReceipt struct {
+	StellarTxHash string `json:"stellar_tx_hash,omitempty"`
+	Ledger        int32  `json:"ledger,omitempty"`
+
+	// CompletedMS is when the peg-out's ledger closed,
+	// in milliseconds since the epoch.
+	CompletedMS int64 `json:"completed_ms,omitempty"`
+}
+
+// ExportStatus is the response of /export-status.
+type ExportStatus struct {
+	TxID     string `json:"txid"`
+	State    string `json:"state"`
+	Exporter string `json:"exporter"`
+	Asset    string `json:"asset"`
+	Amount   int64  `json:"amount"`
+
+	// Destination is the account paid, if not the exporter's,
+	// with its memo and the federation address it was resolved from.
+	Destination
+
+	// The receipt is present once the peg-out has completed
+	// and has been found on Stellar.
+	PegOutReceipt
+
+	// Held is why the export is held before its peg-out,
+	// if its destination requires a memo it lacks.
+	Held string `json:"held,omitempty"`
+
+	// Error is why Stellar rejected the latest submission of the peg-out,
+	// if it did.
+	// A peg-out in state fail was refunded on txvm for this reason;
+	// one in state retry may yet succeed if the error is retriable.
+	Error *stellar.SubmitError `json:"error,omitempty"`
+}
+
+// ExportStatus is the handler for /export-status,
+// serving the state of the export whose txvm tx ID is in the txid parameter
+// and, once it is pegged out, the receipt of its Stellar payment.
+func (c *Custodian) ExportStatus(w http.ResponseWriter, req *http.Request) {
+	txid, err := hex.DecodeString(req.FormValue("txid"))
+	if err != nil || len(txid) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "txid must be 32 hex-encoded bytes")
+		return
+	}
+	ctx := req.Context()
+	var (
+		p         = pegOut{TxID: txid}
+		rec       PegOutReceipt
+		submitErr string
+	)
+	const q = `SELECT exporter, amount, asset_xdr, temp_addr, seqnum, pegged_out, COALESCE(stellar_tx_hash, ''), COALESCE(ledger, 0), COALESCE(completed_ms, 0), COALESCE(submit_error, ''), destination, memo_type, memo, federation FROM exports WHERE txid=$1`
+	err = c.DB.QueryRowContext(ctx, q, txid).Scan(&p.Exporter, &p.Amount, &p.AssetXDR, &p.TempAddr, &p.Seqnum, &p.State, &rec.StellarTxHash, &rec.Ledger, &rec.CompletedMS, &submitErr, &p.Destination.Account, &p.MemoType, &p.Memo, &p.Federation)
+	if err == sql.ErrNoRows {
+		net.Errorf(w, http.StatusNotFound, "export %x not found", txid)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading export: %s", err)
+		return
+	}
+	if rec.StellarTxHash == "" && (p.State == pegOutOK || p.State == pegOutRetired) {
+		// The lookup when the peg-out completed failed.
+		found, err := c.recordPegOutReceipt(ctx, &p)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if found != nil {
+			rec = *found
+		}
+	}
+	status := ExportStatus{
+		TxID:          hex.EncodeToString(txid),
+		State:         p.State.String(),
+		Exporter:      p.Exporter,
+		Asset:         assetName(p.AssetXDR),
+		Amount:        p.Amount,
+		Destination:   p.Destination,
+		PegOutReceipt: rec,
+	}
+	if p.State == pegOutNotYet {
+		status.Held, err = c.memoHold(ctx, txid)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	if submitErr != "" {
+		status.Error = new(stellar.SubmitError)
+		err = json.Unmarshal([]byte(submitErr), status.Error)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading submit error: %s", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// recordPegOutReceipt looks up the completed peg-out of p on Stellar
+// and records its receipt in the exports table.
+// It returns nil, without an error, if the lookup fails
+// or the custodian is not on Stellar.
+func (c *Custodian) recordPegOutReceipt(ctx context.Context, p *pegOut) (*PegOutReceipt, error) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil, nil
+	}
+	w, err := c.withdrawal(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	tx, err := sc.findPegOut(tctx, w)
+	if err != nil {
+		log.Printf("looking up peg-out tx of export %x: %s", p.TxID, err)
+		return nil, nil
+	}
+	if tx == nil {
+		log.Printf("peg-out tx of export %x not found on Stellar", p.TxID)
+		return nil, nil
+	}
+	rec := &PegOutReceipt{
+		StellarTxHash: tx.Hash,
+		Ledger:        tx.Ledger,
+		CompletedMS:   c.nowMS(),
+	}
+	if !tx.LedgerCloseTime.IsZero() {
+		rec.CompletedMS = tx.LedgerCloseTime.UnixNano() / int64(time.Millisecond)
+	}
+	const q = `UPDATE exports SET stellar_tx_hash=$1, ledger=$2, completed_ms=$3 WHERE txid=$4`
+	_, err = c.DB.ExecContext(ctx, q, rec.StellarTxHash, rec.Ledger, rec.CompletedMS, p.TxID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "recording peg-out tx of export %x", p.TxID)
+	}
+	return rec, nil
+}
+
+// recordSubmitError records why Stellar rejected the latest submission
+// of the peg-out of the export,
+// or clears the record if err is not a rejection.
+func (c *Custodian) recordSubmitError(ctx context.Context, txid []byte, err error) error {
+	v, err := submitErrorValue(err)
+	if err != nil {
+		return err
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE exports SET submit_error=$1 WHERE txid=$2`, v, txid)
+	return errors.Wrapf(err, "recording submit error of export %x", txid)
+}
@@ -0,0 +1,110 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestExportStatus(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := bytes.Repeat([]byte{1}, 32)
+		p := &pegOut{
+			TxID:     txid,
+			AssetXDR: nativeXDR,
+			TempAddr: "temp",
+			Exporter: "exporter",
+			Amount:   10,
+			Anchor:   []byte{},
+			Pubkey:   []byte{},
+		}
+		err = c.insertExport(ctx, txid, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status := func(txid string, wantCode int) ExportStatus {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.ExportStatus(w, httptest.NewRequest("GET", "/export-status?txid="+txid, nil))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d for export %s, want %d: %s", w.Code, txid, wantCode, w.Body)
+			}
+			var got ExportStatus
+			if wantCode == http.StatusOK {
+				err := json.Unmarshal(w.Body.Bytes(), &got)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return got
+		}
+
+		got := status(hex.EncodeToString(txid), http.StatusOK)
+		if got.State != pegOutNotYet.String() || got.Asset != "native" || got.Amount != 10 || got.StellarTxHash != "" {
+			t.Errorf("got status %+v before peg-out", got)
+		}
+		_, err = db.Exec(`INSERT INTO memo_holds (txid, payee, held_ms) VALUES ($1, 'payee', 0)`, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = status(hex.EncodeToString(txid), http.StatusOK)
+		if got.Held != memoHoldReason("payee") {
+			t.Errorf("got held %q for an export held for a memo", got.Held)
+		}
+
+		herr := &stellar.HorizonError{Problem: stellar.Problem{Status: http.StatusBadRequest, Extras: map[string]json.RawMessage{
+			"result_codes": json.RawMessage(`{"transaction": "tx_failed", "operations": ["op_no_trust", "op_success"]}`),
+		}}}
+		err = c.recordSubmitError(ctx, txid, errors.Wrap(herr, "submitting peg-out tx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = status(hex.EncodeToString(txid), http.StatusOK)
+		if got.Error == nil || got.Error.TxCode != "tx_failed" || got.Error.Retriable || got.Error.Message != "destination has no trustline for the asset" {
+			t.Errorf("got error %+v after a rejected peg-out, want one for op_no_trust", got.Error)
+		}
+		err = c.recordSubmitError(ctx, txid, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got = status(hex.EncodeToString(txid), http.StatusOK); got.Error != nil {
+			t.Errorf("got error %+v after a successful submission", got.Error)
+		}
+
+		err = c.movePegOut(ctx, txid, pegOutNotYet, pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`UPDATE exports SET stellar_tx_hash='abc', ledger=7, completed_ms=1000 WHERE txid=$1`, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = status(hex.EncodeToString(txid), http.StatusOK)
+		want := PegOutReceipt{StellarTxHash: "abc", Ledger: 7, CompletedMS: 1000}
+		if got.State != pegOutOK.String() || got.PegOutReceipt != want {
+			t.Errorf("got status %+v after peg-out, want state %s and receipt %+v", got, pegOutOK, want)
+		}
+
+		status(hex.EncodeToString(bytes.Repeat([]byte{2}, 32)), http.StatusNotFound)
+		status("xyz", http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,61 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/interstellar/slingshot/slidechain/federation"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// federationMismatchAlert is the kind of alert raised for an export
+// whose destination is not what its federation address resolves to.
+const federationMismatchAlert = "federation-mismatch"
+
+// ResolveDestination returns the Destination of a peg-out to addr,
+// a Stellar account ID or M-address or a federation address, name*domain,
+// which r resolves to an account and memo.
+func ResolveDestination(ctx context.Context, r *federation.Resolver, addr string) (Destination, error) {
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, stellar.BaseAccount(addr)); err == nil {
+		return Destination{Account: addr}, nil
+	}
+	rec, err := r.Resolve(ctx, addr)
+	if err != nil {
+		return Destination{}, err
+	}
+	return Destination{Account: rec.AccountID, MemoType: rec.MemoType, Memo: rec.Memo, Federation: addr}, nil
+}
+
+// checkFederation resolves the federation address of an export, if any,
+// reporting whether the destination and memo the exporter gave
+// are those of its federation record.
+// An export whose address cannot be resolved is held;
+// one that resolves to something else is moved to the failed state,
+// from which it is refunded on txvm,
+// and operators are alerted.
+func (c *Custodian) checkFederation(ctx context.Context, p *pegOut) (bool, error) {
+	if p.Federation == "" {
+		return true, nil
+	}
+	rec, err := c.federation.Resolve(ctx, p.Federation)
+	if err != nil {
+		log.Printf("holding export %x: %s", p.TxID, err)
+		return false, nil
+	}
+	if rec.AccountID == p.Destination.Account && rec.MemoType == p.MemoType && rec.Memo == p.Memo {
+		return true, nil
+	}
+	detail := fmt.Sprintf("export %x to %s pays %s memo %s %q, but it resolves to %s memo %s %q", p.TxID, p.Federation, p.Destination.Account, p.MemoType, p.Memo, rec.AccountID, rec.MemoType, rec.Memo)
+	err = c.recordAudit(ctx, "pegout.federation-mismatch", "federation", detail)
+	if err != nil {
+		return false, err
+	}
+	err = c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutFail)
+	if err != nil {
+		return false, err
+	}
+	p.State = pegOutFail
+	return false, c.alert(ctx, federationMismatchAlert, p.TxID, detail)
+}
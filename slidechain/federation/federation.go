@@ -0,0 +1,287 @@
+// Package federation resolves Stellar federation addresses,
+// name*domain.com, to account IDs and memos
+// by the federation protocol (SEP-2).
+package federation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/stellar/go/strkey"
+)
+
+// maxResponse bounds the stellar.toml files and federation responses
+// a Resolver reads.
+const maxResponse = 100 << 10
+
+// Record is a federation server's record of an address.
+type Record struct {
+	Address   string `json:"stellar_address"`
+	AccountID string `json:"account_id"`
+
+	// MemoType is "text", "id", or "hash", or empty.
+	// A payment to the address must carry the memo.
+	MemoType string `json:"memo_type,omitempty"`
+	Memo     string `json:"memo,omitempty"` // a hash memo is base64
+}
+
+// UnmarshalJSON implements json.Unmarshaler,
+// accepting a memo as either a string or a number,
+// since servers send id memos both ways.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Address   string          `json:"stellar_address"`
+		AccountID string          `json:"account_id"`
+		MemoType  string          `json:"memo_type"`
+		Memo      json.RawMessage `json:"memo"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*r = Record{Address: raw.Address, AccountID: raw.AccountID, MemoType: raw.MemoType}
+	switch memo := bytes.TrimSpace(raw.Memo); {
+	case len(memo) == 0 || string(memo) == "null":
+	case memo[0] == '"':
+		return json.Unmarshal(memo, &r.Memo)
+	default:
+		var n json.Number
+		err = json.Unmarshal(memo, &n)
+		if err != nil {
+			return errors.Wrap(err, "parsing memo")
+		}
+		r.Memo = n.String()
+	}
+	return nil
+}
+
+// IsAddress reports whether s has the form of a federation address,
+// name*domain.
+func IsAddress(s string) bool {
+	_, _, err := split(s)
+	return err == nil
+}
+
+func split(addr string) (name, domain string, err error) {
+	i := strings.LastIndexByte(addr, '*')
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", fmt.Errorf("%q is not a federation address, name*domain", addr)
+	}
+	name, domain = addr[:i], addr[i+1:]
+	if strings.ContainsAny(domain, "/?#@ ") {
+		return "", "", fmt.Errorf("bad domain %q in federation address", domain)
+	}
+	return name, strings.ToLower(domain), nil
+}
+
+// Resolver resolves federation addresses,
+// caching records and the federation servers of domains for TTL.
+// Its methods may be called concurrently.
+type Resolver struct {
+	// Client makes the requests, to https URLs only,
+	// so that its TLS configuration validates the servers.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// TTL is how long results are cached.
+	// Zero means they are not.
+	TTL time.Duration
+
+	// Now returns the current time.
+	// If nil, time.Now is used.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cached // by lowercased address, or by domain for servers
+}
+
+type cached struct {
+	rec    *Record
+	server string
+	exp    time.Time
+}
+
+// Resolve returns the record of addr
+// from the federation server named by the stellar.toml of its domain.
+// The record's account ID is checked
+// and so is its memo, against its memo type.
+func (r *Resolver) Resolve(ctx context.Context, addr string) (*Record, error) {
+	name, domain, err := split(addr)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(name) + "*" + domain
+	if c, ok := r.lookup(key); ok {
+		return c.rec, nil
+	}
+	server, err := r.server(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing FEDERATION_SERVER of %s", domain)
+	}
+	u.RawQuery = url.Values{"q": {addr}, "type": {"name"}}.Encode()
+	body, err := r.get(ctx, u.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", addr)
+	}
+	rec := new(Record)
+	err = json.Unmarshal(body, rec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing federation record of %s", addr)
+	}
+	err = rec.check()
+	if err != nil {
+		return nil, errors.Wrapf(err, "federation record of %s", addr)
+	}
+	if rec.Address == "" {
+		rec.Address = addr
+	}
+	r.store(key, cached{rec: rec})
+	return rec, nil
+}
+
+func (rec *Record) check() error {
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, rec.AccountID); err != nil {
+		return fmt.Errorf("bad account ID %q", rec.AccountID)
+	}
+	return CheckMemo(rec.MemoType, rec.Memo)
+}
+
+// CheckMemo reports whether memo is valid for memoType,
+// as in a Record.
+func CheckMemo(memoType, memo string) error {
+	switch memoType {
+	case "":
+		if memo != "" {
+			return errors.New("memo without a memo type")
+		}
+	case "text":
+		if len(memo) > 28 {
+			return fmt.Errorf("text memo %q is longer than 28 bytes", memo)
+		}
+	case "id":
+		if _, err := strconv.ParseUint(memo, 10, 64); err != nil {
+			return fmt.Errorf("id memo %q is not a 64-bit unsigned integer", memo)
+		}
+	case "hash":
+		if b, err := base64.StdEncoding.DecodeString(memo); err != nil || len(b) != 32 {
+			return fmt.Errorf("hash memo %q is not 32 base64-encoded bytes", memo)
+		}
+	default:
+		return fmt.Errorf("unknown memo type %q", memoType)
+	}
+	return nil
+}
+
+// server returns the FEDERATION_SERVER of domain's stellar.toml.
+func (r *Resolver) server(ctx context.Context, domain string) (string, error) {
+	if c, ok := r.lookup(domain); ok {
+		return c.server, nil
+	}
+	body, err := r.get(ctx, "https://"+domain+"/.well-known/stellar.toml")
+	if err != nil {
+		return "", errors.Wrapf(err, "getting stellar.toml of %s", domain)
+	}
+	server := tomlString(body, "FEDERATION_SERVER")
+	if server == "" {
+		return "", fmt.Errorf("stellar.toml of %s has no FEDERATION_SERVER", domain)
+	}
+	if !strings.HasPrefix(server, "https://") {
+		return "", fmt.Errorf("FEDERATION_SERVER %q of %s is not https", server, domain)
+	}
+	r.store(domain, cached{server: server})
+	return server, nil
+}
+
+func (r *Resolver) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (r *Resolver) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *Resolver) lookup(key string) (cached, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.cache[key]
+	if !ok || !r.now().Before(c.exp) {
+		return cached{}, false
+	}
+	return c, true
+}
+
+func (r *Resolver) store(key string, c cached) {
+	if r.TTL <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]cached)
+	}
+	c.exp = r.now().Add(r.TTL)
+	r.cache[key] = c
+}
+
+// tomlString returns the value of the top-level string key in a TOML file,
+// or "" if it has none.
+func tomlString(data []byte, key string) string {
+	s := bufio.NewScanner(strings.NewReader(string(data)))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			// Keys after the first table are not top-level.
+			return ""
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 || strings.TrimSpace(line[:i]) != key {
+			continue
+		}
+		v, err := strconv.Unquote(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return ""
+		}
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/strkey"
+)
+
+func TestResolve(t *testing.T) {
+	account, err := strkey.Encode(strkey.VersionByteAccountID, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		fedServer string
+		requests  int
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		switch req.URL.Path {
+		case "/.well-known/stellar.toml":
+			fmt.Fprintf(w, "VERSION = \"2.0.0\"\nFEDERATION_SERVER = %q\n\n[DOCUMENTATION]\nORG_NAME = \"Test\"\n", fedServer)
+		case "/federation":
+			if req.FormValue("type") != "name" {
+				http.Error(w, "bad type", http.StatusBadRequest)
+				return
+			}
+			switch q := req.FormValue("q"); strings.ToLower(q) {
+			case "alice*" + req.Host:
+				json.NewEncoder(w).Encode(map[string]interface{}{"stellar_address": q, "account_id": account, "memo_type": "id", "memo": 42})
+			case "bob*" + req.Host:
+				json.NewEncoder(w).Encode(map[string]interface{}{"stellar_address": q, "account_id": account, "memo_type": "text", "memo": "bob"})
+			case "carol*" + req.Host:
+				json.NewEncoder(w).Encode(map[string]interface{}{"account_id": account, "memo_type": "id", "memo": "not a number"})
+			default:
+				http.Error(w, "not found", http.StatusNotFound)
+			}
+		}
+	}))
+	defer srv.Close()
+	fedServer = srv.URL + "/federation"
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := u.Host
+
+	now := time.Now()
+	r := &Resolver{Client: srv.Client(), TTL: time.Minute, Now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	rec, err := r.Resolve(ctx, "alice*"+domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AccountID != account || rec.MemoType != "id" || rec.Memo != "42" {
+		t.Errorf("got %+v, want %s with id memo 42", rec, account)
+	}
+	rec, err = r.Resolve(ctx, "Bob*"+domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.MemoType != "text" || rec.Memo != "bob" {
+		t.Errorf("got %+v, want text memo bob", rec)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3: stellar.toml once and a record each", requests)
+	}
+
+	// Cached records are not requested again until the TTL passes.
+	_, err = r.Resolve(ctx, "alice*"+domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests after a cached resolution, want 3", requests)
+	}
+	now = now.Add(2 * time.Minute)
+	_, err = r.Resolve(ctx, "alice*"+domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 5 {
+		t.Errorf("got %d requests after the TTL, want 5", requests)
+	}
+
+	for _, addr := range []string{"carol*" + domain, "dave*" + domain, "alice", "alice*", "alice*" + domain + "/x"} {
+		if rec, err := r.Resolve(ctx, addr); err == nil {
+			t.Errorf("resolving %s got %+v, want error", addr, rec)
+		}
+	}
+
+	// The server's certificate must be valid for the client.
+	_, err = new(Resolver).Resolve(ctx, "alice*"+domain)
+	if err == nil {
+		t.Error("resolved with an untrusted certificate")
+	}
+
+	// And the federation server must be https.
+	fedServer = "http://" + domain + "/federation"
+	_, err = (&Resolver{Client: srv.Client()}).Resolve(ctx, "alice*"+domain)
+	if err == nil || !strings.Contains(err.Error(), "not https") {
+		t.Errorf("got error %v from an http FEDERATION_SERVER", err)
+	}
+}
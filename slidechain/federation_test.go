@@ -0,0 +1,171 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/federation"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestPegOutDestination(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	var kps []*keypair.Full
+	for i := 0; i < 3; i++ {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		kps = append(kps, kp)
+	}
+	custKP, exporterKP, destKP := kps[0], kps[1], kps[2]
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := Destination{Account: destKP.Address(), MemoType: "text", Memo: "invoice 7", Federation: "dest*example.com"}
+		amount := int64(xlm.Lumen)
+		tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, TimeBounds{}, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &pegOut{
+			AssetXDR:    nativeXDR,
+			TempAddr:    tempAddr,
+			Seqnum:      int64(seqnum),
+			Exporter:    exporterKP.Address(),
+			Amount:      amount,
+			Destination: dest,
+		}
+		w := p.withdrawal()
+		err = c.chain.ValidateWithdrawal(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before, _ := srv.Balance(destKP.Address(), native)
+		if got, err := c.chain.SubmitWithdrawal(ctx, w, 0); got != WithdrawalApplied {
+			t.Fatalf("got result %d (error %v), want %d", got, err, WithdrawalApplied)
+		}
+		after, _ := srv.Balance(destKP.Address(), native)
+		if after-before != amount {
+			t.Errorf("destination balance rose by %d, want %d", after-before, amount)
+		}
+		txs := srv.AccountTransactions(destKP.Address(), "")
+		if len(txs) == 0 || txs[len(txs)-1].MemoType != "text" || txs[len(txs)-1].Memo != dest.Memo {
+			t.Errorf("peg-out does not carry text memo %q", dest.Memo)
+		}
+
+		for _, bad := range []Destination{
+			{Account: "GABC"},
+			{Account: destKP.Address(), MemoType: "id", Memo: "x"},
+			{Account: destKP.Address(), MemoType: "text", Memo: "a memo longer than twenty-eight bytes"},
+			{Account: destKP.Address(), Federation: "no-domain"},
+			{Memo: "orphan"},
+		} {
+			w.Destination = bad
+			if err := c.chain.ValidateWithdrawal(w); err == nil {
+				t.Errorf("validated a withdrawal to %+v", bad)
+			}
+		}
+	})
+}
+
+func TestCheckFederation(t *testing.T) {
+	ctx := context.Background()
+	records := make(map[string]federation.Record)
+	var fedServer string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/stellar.toml":
+			fmt.Fprintf(w, "FEDERATION_SERVER = %q\n", fedServer)
+		case "/federation":
+			rec, ok := records[req.FormValue("q")]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(rec)
+		}
+	}))
+	defer srv.Close()
+	fedServer = srv.URL + "/federation"
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "alice*" + u.Host
+
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db, cfg: config.Default(), federation: &federation.Resolver{Client: srv.Client()}}
+		dest := Destination{Account: importTestAccountID, MemoType: "id", Memo: "42", Federation: addr}
+		p := &pegOut{TxID: []byte("export"), Amount: 10, Exporter: importTestAccountID, Pubkey: testRecipPubKey, Destination: dest}
+		_, err = db.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey, destination, memo_type, memo, federation) VALUES ($1, $2, x'', '', 0, $3, x'', $4, $5, $6, $7, $8)", p.TxID, p.Amount, p.Exporter, p.Pubkey, dest.Account, dest.MemoType, dest.Memo, dest.Federation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(wantOK bool, wantState pegOutState) {
+			t.Helper()
+			ok, err := c.checkFederation(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state pegOutState
+			err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != wantOK || state != wantState {
+				t.Errorf("checking federation gave %v in state %s, want %v in state %s", ok, state, wantOK, wantState)
+			}
+		}
+
+		// Unresolvable addresses are held.
+		check(false, pegOutNotYet)
+
+		records[addr] = federation.Record{Address: addr, AccountID: importTestAccountID, MemoType: "id", Memo: "42"}
+		check(true, pegOutNotYet)
+
+		// A destination other than the resolution fails.
+		records[addr] = federation.Record{Address: addr, AccountID: importTestAccountID, MemoType: "id", Memo: "43"}
+		check(false, pegOutFail)
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, federationMismatchAlert, p.TxID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d federation-mismatch alerts, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/math/checked"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+// errFeeTooLow is the error for a submitted tx
+// that pays less than the minimum fee.
+var errFeeTooLow = errors.New("fee too low")
+
+// feeSchedule is the fees that txs submitted from outside the custodian pay.
+type feeSchedule struct {
+	asset     []byte
+	collector []byte
+
+	mu          sync.Mutex // protects min and maxBlockTxs, which are reloadable
+	min         int64
+	maxBlockTxs int
+}
+
+// newFeeSchedule returns the schedule of cfg,
+// or nil if it has no fee asset.
+func newFeeSchedule(cfg config.Fees) (*feeSchedule, error) {
+	if cfg.Asset == "" {
+		return nil, nil
+	}
+	asset, err := hex.DecodeString(cfg.Asset)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding fees.asset")
+	}
+	collector, err := hex.DecodeString(cfg.Collector)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding fees.collector")
+	}
+	return &feeSchedule{asset: asset, collector: collector, min: cfg.Min, maxBlockTxs: cfg.MaxBlockTxs}, nil
+}
+
+// strategy returns the least fee a tx must pay
+// and the cap on block txs, zero for none.
+func (f *feeSchedule) strategy() (min int64, maxBlockTxs int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.min, f.maxBlockTxs
+}
+
+// setStrategy sets the least fee and the cap on block txs from cfg,
+// as on reload.
+// The fee asset and collector take effect only on restart.
+func (f *feeSchedule) setStrategy(cfg config.Fees) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.min, f.maxBlockTxs = cfg.Min, cfg.MaxBlockTxs
+}
+
+// paid is the fee tx pays:
+// the total of the fee asset in its outputs
+// locked by the collector alone.
+func (f *feeSchedule) paid(tx *bc.Tx) int64 {
+	var total int64
+	for _, out := range tx.Outputs {
+		m, ok := multisigFromOutput(out)
+		if !ok || m.Quorum != 1 || len(m.Pubkeys) != 1 || !bytes.Equal(m.Pubkeys[0], f.collector) || !bytes.Equal(m.AssetID, f.asset) {
+			continue
+		}
+		sum, ok := checked.AddInt64(total, m.Amount)
+		if !ok {
+			return math.MaxInt64
+		}
+		total = sum
+	}
+	return total
+}
+
+// pooledTx is a tx of the block a-building.
+type pooledTx struct {
+	tx     *bc.Tx
+	fee    int64
+	exempt bool // submitted by the custodian itself
+}
+
+// addPooled adds as many of pool to bb as it can, in order,
+// retrying those that fail while any succeed,
+// so that a tx spending the output of a later one still goes in.
+// It returns the txs added and those left out.
+func addPooled(bb *protocol.BlockBuilder, pool []pooledTx) (added, rest []pooledTx) {
+	for len(pool) > 0 {
+		var left []pooledTx
+		for _, p := range pool {
+			if err := bb.AddTx(bc.NewCommitmentsTx(p.tx)); err != nil {
+				left = append(left, p)
+				continue
+			}
+			added = append(added, p)
+		}
+		if len(left) == len(pool) {
+			break
+		}
+		pool = left
+	}
+	return added, pool
+}
+
+// orderByFee rebuilds the block a-building from s.pool,
+// the custodian's txs first and then the rest highest fee first,
+// up to the schedule's cap on block txs.
+// The txs left out stay in s.pool for the next block.
+// It must be called with s.bbmu held.
+func (s *submitter) orderByFee() error {
+	pool := s.pool
+	sort.SliceStable(pool, func(i, j int) bool {
+		if pool[i].exempt != pool[j].exempt {
+			return pool[i].exempt
+		}
+		return pool[i].fee > pool[j].fee
+	})
+	bb := protocol.NewBlockBuilder()
+	if _, max := s.fees.strategy(); max > 0 {
+		bb.MaxBlockTxs = max
+	}
+	err := bb.Start(s.chain.State(), s.timestampMS)
+	if err != nil {
+		return errors.Wrap(err, "restarting the pending block")
+	}
+	_, s.pool = addPooled(bb, pool)
+	s.bb = bb
+	return nil
+}
+
+// carryOver starts the next block with the txs left out of the last one,
+// dropping any that no longer apply.
+// It must be called with s.bbmu held.
+func (s *submitter) carryOver() {
+	left := s.pool
+	s.pool = nil
+	err := s.startBlock()
+	if err != nil {
+		log.Printf("carrying over %d tx(s) to the next block: %s", len(left), err)
+		return
+	}
+	added, dropped := addPooled(s.bb, left)
+	s.pool = added
+	for _, p := range dropped {
+		log.Printf("dropping tx %x, which no longer applies", p.tx.ID.Bytes())
+	}
+}
+
+// blockFees is the total of the fees paid by the txs of b.
+func (s *submitter) blockFees(b *bc.UnsignedBlock) int64 {
+	var total int64
+	for _, tx := range b.Transactions {
+		sum, ok := checked.AddInt64(total, s.fees.paid(tx))
+		if !ok {
+			return math.MaxInt64
+		}
+		total = sum
+	}
+	return total
+}
+
+// Fees is the handler for /fees,
+// reporting the fees that submitted txs must pay.
+func (s *submitter) Fees(w http.ResponseWriter, req *http.Request) {
+	resp := struct {
+		Asset       string `json:"asset,omitempty"`
+		Collector   string `json:"collector,omitempty"`
+		Min         int64  `json:"min"`
+		MaxBlockTxs int    `json:"max_block_txs,omitempty"`
+	}{}
+	if s.fees != nil {
+		resp.Asset = hex.EncodeToString(s.fees.asset)
+		resp.Collector = hex.EncodeToString(s.fees.collector)
+		resp.Min, resp.MaxBlockTxs = s.fees.strategy()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
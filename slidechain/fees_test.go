@@ -0,0 +1,180 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/asm"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestFees(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		// Blocks are built by hand below.
+		s.blockInterval = time.Hour
+
+		collector, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issueProg := asm.MustAssemble("get 1000 'FEE' issue put")
+		seed := txvm.ContractSeed(issueProg)
+		feeAsset := txvm.AssetID(seed[:], []byte("FEE"))
+		s.fees = &feeSchedule{asset: feeAsset[:], collector: collector, maxBlockTxs: 1}
+
+		// issue makes a tx issuing 1000 of the fee asset to pubkey.
+		var n int64
+		issue := func(pubkey ed25519.PublicKey) *bc.Tx {
+			t.Helper()
+			n++
+			expMS := int64(bc.Millis(time.Now().Add(2*time.Hour))) + n
+			tx, err := newTx(asm.MustAssemble(fmt.Sprintf(
+				"x'%x' %d nonce 0 split '' put put x'%x' contract call {x'%x'} put 1 put x'%x' contract call finalize",
+				chain.InitialBlockHash.Bytes(), expMS, issueProg, []byte(pubkey), standard.PayToMultisigProg1,
+			)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+		build := func() *bc.Block {
+			t.Helper()
+			s.bbmu.Lock()
+			err := s.buildBlock(ctx)
+			s.bbmu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := chain.GetBlock(ctx, chain.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+
+		cheap, dear := issue(other), issue(collector)
+		if got := s.fees.paid(cheap); got != 0 {
+			t.Errorf("tx paying another key pays fee %d, want 0", got)
+		}
+		if got := s.fees.paid(dear); got != 1000 {
+			t.Errorf("tx paying the collector pays fee %d, want 1000", got)
+		}
+		for _, tx := range []*bc.Tx{cheap, dear} {
+			_, err = s.submitPaidTx(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// One tx fits in a block, and the higher fee goes first.
+		if b := build(); len(b.Transactions) != 1 || b.Transactions[0].ID != dear.ID {
+			t.Errorf("first block has %d txs, want only the tx paying the higher fee", len(b.Transactions))
+		}
+		if b := build(); len(b.Transactions) != 1 || b.Transactions[0].ID != cheap.ID {
+			t.Errorf("second block has %d txs, want only the tx left out of the first", len(b.Transactions))
+		}
+
+		// Below the minimum, only the custodian's own txs are accepted.
+		s.fees.min = 1
+		tx := issue(other)
+		if _, err = s.submitPaidTx(ctx, tx); errors.Root(err) != errFeeTooLow {
+			t.Errorf("got error %v submitting a tx paying no fee, want %s", err, errFeeTooLow)
+		}
+		_, err = s.submitTx(ctx, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := build(); len(b.Transactions) != 1 || b.Transactions[0].ID != tx.ID {
+			t.Errorf("got %d txs in the block, want the custodian's tx", len(b.Transactions))
+		}
+	})
+}
+
+func TestReloadFees(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	collector, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Fees.Asset = hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	cfg.Fees.Collector = hex.EncodeToString(collector)
+	cfg.Fees.Min = 10
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := *cfg
+		next.Fees.Min = 50
+		next.Fees.MaxBlockTxs = 2
+		next.Fees.Asset = hex.EncodeToString(bytes.Repeat([]byte{2}, 32))
+		applied, err := c.Reload(ctx, &next, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("got changes %v, want fees.min and fees.max_block_txs", applied)
+		}
+
+		w := httptest.NewRecorder()
+		c.S.Fees(w, httptest.NewRequest("GET", "/fees", nil))
+		var got struct {
+			Asset       string `json:"asset"`
+			Min         int64  `json:"min"`
+			MaxBlockTxs int    `json:"max_block_txs"`
+		}
+		err = json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Asset != cfg.Fees.Asset || got.Min != 50 || got.MaxBlockTxs != 2 {
+			t.Errorf("after reload got fees %+v, want the old asset with min 50 and 2 txs a block", got)
+		}
+
+		// Audit entries are stamped by the custodian's clock.
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE action='config.reload' AND time_ms=$1`, now.UnixNano()/int64(time.Millisecond)).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %d reload audit entries at the custodian's time, want 2", n)
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/gossip"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/store"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+// pendingTTL is how long a follower lists a pending tx
+// that has not appeared in a block.
+const pendingTTL = time.Hour
+
+// Follower keeps a verified copy of the chain of a primary slidechaind,
+// receiving new blocks and pending txs by gossip.
+// Txs submitted to a follower are gossiped on toward the primary.
+type Follower struct {
+	Gossip *gossip.Node
+
+	// If positive, each tx submitted to the follower
+	// must carry a proof of work with this many leading zero bits,
+	// as with antispam.mode "pow" at slidechaind.
+	WorkBits int
+
+	db      *sql.DB
+	chain   *protocol.Chain
+	primary string
+
+	// Protects pending and serializes the application of blocks.
+	mu      sync.Mutex
+	pending map[bc.Hash]time.Time // when each pending tx was received
+}
+
+// NewFollower returns a Follower of the primary slidechaind at the base URL primary,
+// whose initial block must have ID bcid,
+// storing the chain in db.
+// The Follower gossips as the node at the base URL self
+// with the given peers.
+func NewFollower(ctx context.Context, db *sql.DB, primary string, bcid bc.Hash, self string, peers []string) (*Follower, error) {
+	err := setSchema(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting db schema")
+	}
+	primary = strings.TrimRight(primary, "/")
+	initial, err := fetchBlock(ctx, primary, 1)
+	if err != nil {
+		return nil, err
+	}
+	if initial.Hash() != bcid {
+		return nil, fmt.Errorf("primary's initial block is %x, not %x", initial.Hash().Bytes(), bcid.Bytes())
+	}
+
+	// The initial block is determined by its timestamp.
+	err = store.Init(db, bc.FromMillis(initial.TimestampMs))
+	if err != nil {
+		return nil, err
+	}
+	heights := make(chan uint64)
+	bs, err := store.New(db, heights)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing block store")
+	}
+	bs.Markers = blockMarkers
+	stored, err := bs.GetBlock(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Hash() != bcid {
+		return nil, fmt.Errorf("db holds the chain with initial block %x, not %x", stored.Hash().Bytes(), bcid.Bytes())
+	}
+	chain, err := protocol.NewChain(ctx, stored, bs, heights)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing chain")
+	}
+	_, err = chain.Recover(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "recovering chain state")
+	}
+	if st := chain.State(); st.Header == nil {
+		err = st.ApplyBlockHeader(stored.BlockHeader)
+		if err != nil {
+			return nil, errors.Wrap(err, "initializing empty state")
+		}
+	}
+
+	f := &Follower{
+		db:      db,
+		chain:   chain,
+		primary: primary,
+		pending: make(map[bc.Hash]time.Time),
+	}
+	f.Gossip = gossip.New(ctx, self, peers, f.handleGossip)
+	return f, nil
+}
+
+// Height returns the height of the latest verified block.
+func (f *Follower) Height() uint64 {
+	return f.chain.Height()
+}
+
+// CatchUp fetches and verifies the primary's blocks after the latest one,
+// as when the follower starts or has been offline,
+// and checks that the primary's chain extends the follower's.
+// After that, gossip brings new blocks,
+// and gaps are filled from the primary as they are found.
+func (f *Follower) CatchUp(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sync(ctx, 0)
+}
+
+// sync commits the primary's blocks through height to,
+// or through its latest block if to is 0.
+// It must be called with f.mu held.
+func (f *Follower) sync(ctx context.Context, to uint64) error {
+	tip, err := f.chain.GetBlock(ctx, f.chain.Height())
+	if err != nil {
+		return err
+	}
+	return syncFrom(ctx, f.primary, tip, to, func(b *bc.Block) error {
+		return f.commit(ctx, b, true)
+	})
+}
+
+func (f *Follower) handleGossip(ctx context.Context, kind string, data []byte) error {
+	switch kind {
+	case gossip.Block:
+		b := new(bc.Block)
+		err := b.FromBytes(data)
+		if err != nil {
+			return errors.Sub(gossip.ErrInvalid, err)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.apply(ctx, b, false)
+	case gossip.Tx:
+		tx, err := parseRawTx(data)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.pending[tx.ID]; ok {
+			return gossip.ErrStale
+		}
+		f.pending[tx.ID] = time.Now()
+		return nil
+	}
+	return errors.WithDetailf(gossip.ErrInvalid, "unknown kind %s", kind)
+}
+
+// apply verifies b and commits it,
+// first filling any gap before it from the primary.
+// FromPrimary tells whether b came from the primary
+// rather than from gossip.
+// It must be called with f.mu held.
+func (f *Follower) apply(ctx context.Context, b *bc.Block, fromPrimary bool) error {
+	height := f.chain.Height()
+	if b.Height <= height {
+		ours, err := f.chain.GetBlock(ctx, b.Height)
+		if err != nil {
+			return err
+		}
+		if ours.Hash() != b.Hash() {
+			return errors.WithDetailf(gossip.ErrInvalid, "block %d conflicts with the verified one", b.Height)
+		}
+		return gossip.ErrStale
+	}
+	if b.Height > height+1 {
+		err := f.sync(ctx, b.Height-1)
+		if err != nil {
+			// Invalid blocks from the primary are not the gossip peer's fault.
+			return fmt.Errorf("filling gap before block %d: %s", b.Height, err)
+		}
+	}
+	return f.commit(ctx, b, fromPrimary)
+}
+
+// commit verifies that b extends the chain and commits it.
+// Gossiped blocks of an unsigned chain are checked against the primary's.
+// It must be called with f.mu held.
+func (f *Follower) commit(ctx context.Context, b *bc.Block, fromPrimary bool) error {
+	prev, err := f.chain.GetBlock(ctx, b.Height-1)
+	if err != nil {
+		return err
+	}
+	if b.PreviousBlockId == nil || *b.PreviousBlockId != prev.Hash() {
+		return errors.WithDetailf(gossip.ErrInvalid, "block %d does not follow block %d", b.Height, prev.Height)
+	}
+	if prev.NextPredicate.Quorum == 0 && !fromPrimary {
+		theirs, err := fetchBlock(ctx, f.primary, b.Height)
+		if err != nil {
+			return err
+		}
+		if theirs.Hash() != b.Hash() {
+			return errors.WithDetailf(gossip.ErrInvalid, "block %d is not the primary's", b.Height)
+		}
+	}
+	err = txproof.CheckSignatures(b, prev.NextPredicate)
+	if err != nil {
+		return errors.Sub(gossip.ErrInvalid, err)
+	}
+	err = f.chain.CommitBlock(ctx, b)
+	if err != nil {
+		return errors.Sub(gossip.ErrInvalid, err)
+	}
+
+	now := time.Now()
+	for _, tx := range b.Transactions {
+		delete(f.pending, tx.ID)
+	}
+	for id, t := range f.pending {
+		if now.Sub(t) > pendingTTL {
+			delete(f.pending, id)
+		}
+	}
+	return nil
+}
+
+// Get is the handler for the follower's copy of the chain,
+// like that of slidechaind.
+func (f *Follower) Get(w http.ResponseWriter, req *http.Request) {
+	getBlock(w, req, f.chain)
+}
+
+// SyncHeaders is the handler for /sync/headers,
+// letting other followers catch up from this one.
+func (f *Follower) SyncHeaders(w http.ResponseWriter, req *http.Request) {
+	serveSyncHeaders(w, req, f.db, f.chain)
+}
+
+// SyncBlocks is the handler for /sync/blocks.
+func (f *Follower) SyncBlocks(w http.ResponseWriter, req *http.Request) {
+	serveSyncBlocks(w, req, f.db)
+}
+
+// BlockMarkers is the handler for /block-markers.
+func (f *Follower) BlockMarkers(w http.ResponseWriter, req *http.Request) {
+	serveBlockMarkers(w, req, f.db, f.chain)
+}
+
+// Submit is the handler for txs submitted to the follower,
+// which are gossiped toward the primary.
+func (f *Follower) Submit(w http.ResponseWriter, req *http.Request) {
+	bits, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request body: %s", err)
+		return
+	}
+	if f.WorkBits > 0 && !checkWork(w, req, bits, f.WorkBits) {
+		return
+	}
+	tx, err := parseRawTx(bits)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing tx: %s", err)
+		return
+	}
+	f.mu.Lock()
+	f.pending[tx.ID] = time.Now()
+	f.mu.Unlock()
+	f.Gossip.Publish(gossip.Tx, bits)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Mempool is the handler listing the hex IDs of the pending txs
+// the follower has received.
+func (f *Follower) Mempool(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	txids := make([]string, 0, len(f.pending))
+	for id := range f.pending {
+		txids = append(txids, hex.EncodeToString(id.Bytes()))
+	}
+	f.mu.Unlock()
+	sort.Strings(txids)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txids)
+}
+
+// fetchBlock gets the block at the given height from the slidechaind at url.
+// Height 0 means the latest block.
+func fetchBlock(ctx context.Context, url string, height uint64) (*bc.Block, error) {
+	url = fmt.Sprintf("%s/get?height=%d", url, height)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building request")
+	}
+	resp, err := net.PeerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("status code %d from %s", resp.StatusCode, url)
+	}
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading block %d", height)
+	}
+	b := new(bc.Block)
+	err = b.FromBytes(bits)
+	return b, errors.Wrapf(err, "parsing block %d", height)
+}
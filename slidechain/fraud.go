@@ -0,0 +1,218 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+// fraudClaim is a claim, which anyone may submit,
+// that the custodian has done something it should not have.
+// The only kind is "issuance":
+// a slidechain tx issuing an imported asset
+// with no matching deposit on the main chain.
+type fraudClaim struct {
+	Kind     string `json:"kind"`
+	Tx       []byte `json:"tx"`       // the slidechain tx, a serialized bc.RawTx as for /submit
+	Claimant string `json:"claimant"` // optional contact for the operators
+	Detail   string `json:"detail"`
+}
+
+// fraudVerdict is the custodian's response to a fraudClaim.
+type fraudVerdict struct {
+	ID     int64  `json:"id"`
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+}
+
+// SubmitFraudClaim is the handler for fraud claims.
+// The request is a JSON fraudClaim.
+// Every claim is recorded with the custodian's verdict.
+// A valid claim pauses the peg and raises a fraud alert.
+func (c *Custodian) SubmitFraudClaim(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "submitting a fraud claim requires POST")
+		return
+	}
+	ctx := req.Context()
+	var claim fraudClaim
+	err := json.NewDecoder(req.Body).Decode(&claim)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if claim.Kind != "issuance" {
+		net.Errorf(w, http.StatusBadRequest, "unknown fraud claim kind %q", claim.Kind)
+		return
+	}
+	var rawTx bc.RawTx
+	err = proto.Unmarshal(claim.Tx, &rawTx)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing tx: %s", err)
+		return
+	}
+	tx, err := bc.NewTx(rawTx.Program, rawTx.Version, rawTx.Runlimit)
+	if err != nil || !tx.Finalized {
+		net.Errorf(w, http.StatusBadRequest, "tx is not valid")
+		return
+	}
+
+	valid, reason, err := c.checkIssuanceClaim(ctx, tx)
+	if err != nil {
+		net.Errorf(w, http.StatusServiceUnavailable, "checking claim: %s", err)
+		return
+	}
+	v := fraudVerdict{Valid: valid, Reason: reason}
+	const q = `INSERT INTO fraud_claims (time_ms, kind, txid, claimant, detail, valid, reason) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	res, err := c.DB.ExecContext(ctx, q, c.nowMS(), claim.Kind, tx.ID.Bytes(), claim.Claimant, claim.Detail, valid, reason)
+	if err == nil {
+		v.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording claim: %s", err)
+		return
+	}
+	log.Printf("fraud claim %d about tx %x from %q: valid %t, %s", v.ID, tx.ID.Bytes(), claim.Claimant, valid, reason)
+	if valid {
+		err = c.pausePeg(ctx, fmt.Sprintf("fraud claim %d: %s", v.ID, reason), "fraud-claim "+req.RemoteAddr)
+		if err == nil {
+			err = c.alert(ctx, "fraud", tx.ID.Bytes(), fmt.Sprintf("fraud claim %d: %s; peg paused", v.ID, reason))
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkIssuanceClaim checks the claim that tx issued an imported asset
+// with no matching deposit on the main chain.
+// Each issuance must be of a peg-in recorded as imported by tx,
+// whose deposit the main chain still has.
+// Issuances of assets never pegged in cannot be recognized
+// and are ignored.
+func (c *Custodian) checkIssuanceClaim(ctx context.Context, tx *bc.Tx) (bool, string, error) {
+	var witness []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT witness_hash FROM block_txs WHERE txid=$1`, tx.ID.Bytes()).Scan(&witness)
+	if err == sql.ErrNoRows || (err == nil && !bytes.Equal(witness, txproof.WitnessHash(tx).Bytes())) {
+		return false, fmt.Sprintf("tx %x is not on slidechain", tx.ID.Bytes()), nil
+	}
+	if err != nil {
+		return false, "", errors.Wrap(err, "looking up tx")
+	}
+
+	// Map the imported asset IDs, under each issuance version,
+	// to their main-chain assets.
+	imported := make(map[bc.Hash][]byte)
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs WHERE asset_xdr IS NOT NULL`, func(asset []byte) {
+		for _, ic := range issuanceContracts {
+			imported[ic.assetID(asset)] = asset
+		}
+	})
+	if err != nil {
+		return false, "", errors.Wrap(err, "reading pegged-in assets")
+	}
+
+	type importedPegIn struct {
+		Deposit
+		matched bool
+	}
+	var pegIns []*importedPegIn
+	const q = `SELECT nonce_hash, amount, asset_xdr, COALESCE(deposit_txid, ''), COALESCE(deposit_cursor, '') FROM pegs WHERE import_txid=$1 AND state=$2`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, tx.ID.Bytes(), pegInImported, func(nonceHash []byte, amount int64, asset []byte, depositTxID, cursor string) {
+		pegIns = append(pegIns, &importedPegIn{Deposit: Deposit{
+			TxID:      depositTxID,
+			Cursor:    cursor,
+			NonceHash: nonceHash,
+			Asset:     asset,
+			Amount:    amount,
+		}})
+	})
+	if err != nil {
+		return false, "", errors.Wrap(err, "reading peg-ins")
+	}
+
+	var n int
+	retired := make([]bool, len(tx.Retirements))
+	for _, iss := range tx.Issuances {
+		asset, ok := imported[iss.AssetID]
+		if !ok {
+			continue
+		}
+		if migration(tx, iss, asset, retired) {
+			continue
+		}
+		n++
+		var p *importedPegIn
+		for _, candidate := range pegIns {
+			if !candidate.matched && candidate.Amount == iss.Amount && bytes.Equal(candidate.Asset, asset) {
+				p = candidate
+				break
+			}
+		}
+		if p == nil {
+			legacy, err := c.legacyImport(ctx, asset, iss.Amount)
+			if err != nil {
+				return false, "", err
+			}
+			if legacy {
+				return false, fmt.Sprintf("issuance of %d of asset %x may be a peg-in imported before import txs were recorded", iss.Amount, asset), nil
+			}
+			return true, fmt.Sprintf("issuance of %d of asset %x matches no peg-in", iss.Amount, asset), nil
+		}
+		p.matched = true
+		if p.TxID == "" {
+			return false, fmt.Sprintf("peg-in %x was deposited before deposit txs were recorded", p.NonceHash), nil
+		}
+		ok, err := c.chain.VerifyDeposit(ctx, p.Deposit)
+		if err != nil {
+			return false, "", errors.Wrapf(err, "verifying deposit of peg-in %x", p.NonceHash)
+		}
+		if !ok {
+			return true, fmt.Sprintf("main-chain tx %s has no deposit for peg-in %x", p.TxID, p.NonceHash), nil
+		}
+	}
+	if n == 0 {
+		return false, "tx issues no imported asset", nil
+	}
+	return false, fmt.Sprintf("all %d import issuances match deposited peg-ins", n), nil
+}
+
+// migration reports whether iss, of an imported asset pegging asset,
+// migrates value retired in tx from the previous issuance version,
+// marking the retirement it matches in retired.
+func migration(tx *bc.Tx, iss bc.Issuance, asset []byte, retired []bool) bool {
+	prev := issuanceContracts[issuanceVersion(iss.AssetID, asset)-1]
+	if prev == nil {
+		return false
+	}
+	for i, r := range tx.Retirements {
+		if !retired[i] && r.AssetID == prev.assetID(asset) && r.Amount == iss.Amount {
+			retired[i] = true
+			return true
+		}
+	}
+	return false
+}
+
+// legacyImport reports whether there is an imported peg-in
+// of the given amount of asset with no recorded import tx.
+func (c *Custodian) legacyImport(ctx context.Context, asset []byte, amount int64) (bool, error) {
+	var n int
+	const q = `SELECT COUNT(*) FROM pegs WHERE import_txid IS NULL AND state=$1 AND asset_xdr=$2 AND amount=$3`
+	err := c.DB.QueryRowContext(ctx, q, pegInImported, asset, amount).Scan(&n)
+	return n > 0, errors.Wrap(err, "checking for legacy imports")
+}
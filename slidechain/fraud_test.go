@@ -0,0 +1,208 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// depositChain is a Stellar chain whose deposits are verified
+// against a set of main-chain txids.
+type depositChain struct {
+	*stellarChain
+	deposits map[string]bool
+}
+
+func (d *depositChain) VerifyDeposit(_ context.Context, dep Deposit) (bool, error) {
+	return d.deposits[dep.TxID], nil
+}
+
+func TestFraudClaim(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		mainChain := &depositChain{stellarChain: new(stellarChain), deposits: map[string]bool{"deposit": true}}
+		c := &Custodian{
+			imports:       sync.NewCond(new(sync.Mutex)),
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			chain:         mainChain,
+			cfg:           config.Default(),
+		}
+		assetXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// pegIn records a deposit in the given main-chain tx for a new peg-in
+		// and imports it, returning its nonce hash.
+		// Each deposit is a different op.
+		var op int
+		pegIn := func(depositTxID string) []byte {
+			t.Helper()
+			op++
+			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+			prepegTx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), assetXDR, testRecipPubKey, 10, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.submitAndWait(ctx, prepegTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.recordDeposit(ctx, Deposit{TxID: depositTxID, OpIndex: op, NonceHash: nonceHash[:], Asset: assetXDR, Amount: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.importPending(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nonceHash[:]
+		}
+		// findTx finds the tx with the given ID on the chain.
+		findTx := func(txid []byte) *bc.Tx {
+			t.Helper()
+			for h := uint64(1); h <= chain.Height(); h++ {
+				b, err := chain.GetBlock(ctx, h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, tx := range b.Transactions {
+					if bytes.Equal(tx.ID.Bytes(), txid) {
+						return tx
+					}
+				}
+			}
+			t.Fatalf("tx %x not found", txid)
+			return nil
+		}
+		// importTx returns the import tx of the peg-in.
+		importTx := func(nonceHash []byte) *bc.Tx {
+			t.Helper()
+			var txid []byte
+			err := db.QueryRow(`SELECT import_txid FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return findTx(txid)
+		}
+		claim := func(tx *bc.Tx) fraudVerdict {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := proto.Marshal(&tx.RawTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(fraudClaim{Kind: "issuance", Tx: raw, Claimant: "observer"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			c.SubmitFraudClaim(rec, httptest.NewRequest("POST", "/fraud", bytes.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			var v fraudVerdict
+			err = json.Unmarshal(rec.Body.Bytes(), &v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+		checkPaused := func(want bool) {
+			t.Helper()
+			paused, err := c.pegPaused(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paused != want {
+				t.Fatalf("got paused %t, want %t", paused, want)
+			}
+		}
+
+		good := pegIn("deposit")
+		if v := claim(importTx(good)); v.Valid {
+			t.Errorf("claim against a deposited peg-in found valid: %s", v.Reason)
+		}
+		unsubmitted, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), assetXDR, testRecipPubKey, 10, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := claim(unsubmitted); v.Valid {
+			t.Errorf("claim against a tx not on slidechain found valid: %s", v.Reason)
+		}
+		checkPaused(false)
+
+		bad := pegIn("vanished")
+		if v := claim(importTx(bad)); !v.Valid {
+			t.Errorf("claim against a peg-in with no deposit found invalid: %s", v.Reason)
+		}
+		checkPaused(true)
+		alerted, err := c.alerted(ctx, "fraud", importTx(bad).ID.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no fraud alert for a valid claim")
+		}
+
+		// While paused, deposits are recorded but not imported,
+		// and no new peg-ins are accepted.
+		paid := pegIn("deposit")
+		var state pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, paid).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegInPaid {
+			t.Errorf("got peg-in state %s while paused, want %s", state, pegInPaid)
+		}
+		rec := httptest.NewRecorder()
+		c.DoPrePegIn(rec, httptest.NewRequest("POST", "/prepegin", bytes.NewReader([]byte("{}"))))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("pre-peg-in while paused: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+
+		rec = httptest.NewRecorder()
+		c.ResumePeg(rec, httptest.NewRequest("POST", "/admin/resume", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("resuming: got status %d", rec.Code)
+		}
+		checkPaused(false)
+
+		var claims int
+		err = db.QueryRow(`SELECT COUNT(*) FROM fraud_claims`).Scan(&claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims != 3 {
+			t.Errorf("got %d recorded claims, want 3", claims)
+		}
+	})
+}
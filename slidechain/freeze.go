@@ -0,0 +1,182 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// Freezing a balance (see clawback.go) mirrors an issuer's revocation
+// of an AUTH_REVOCABLE trustline.
+// Beyond refusing txs that spend it at /submit,
+// which binds only the txs the custodian builds blocks from,
+// the delegated outputs of the balance,
+// which imports under issuance contract version 3 pay to
+// and the custodian can spend,
+// are escrowed:
+// moved to outputs the custodian alone can spend,
+// and moved back when the balance is unfrozen.
+// An admin can freeze only value pegged in
+// from a Stellar asset whose issuer has set AUTH_REVOCABLE.
+
+// errNotRevocable is the error for freezing a balance
+// of an asset that is not revocable on the main chain.
+var errNotRevocable = errors.New("asset is not revocable")
+
+// peggedAsset returns the main-chain asset
+// pegged by the imported txvm asset assetID,
+// or nil if there is none.
+func (c *Custodian) peggedAsset(ctx context.Context, assetID []byte) ([]byte, error) {
+	var found []byte
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs WHERE asset_xdr IS NOT NULL`, func(assetXDR []byte) {
+		if found == nil && issuanceVersion(bc.HashFromBytes(assetID), assetXDR) != 0 {
+			found = assetXDR
+		}
+	})
+	return found, errors.Wrap(err, "reading pegged-in assets")
+}
+
+// checkRevocable returns errNotRevocable
+// unless assetID pegs a Stellar credit asset
+// whose issuer has set AUTH_REVOCABLE.
+func (c *Custodian) checkRevocable(ctx context.Context, assetID []byte) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return errors.WithDetail(errNotRevocable, "freezing requires Stellar as the main chain")
+	}
+	assetXDR, err := c.peggedAsset(ctx, assetID)
+	if err != nil {
+		return err
+	}
+	if assetXDR == nil {
+		return errors.WithDetailf(errNotRevocable, "%x is not a pegged-in asset", assetID)
+	}
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling pegged asset")
+	}
+	if asset.IsNative() {
+		return errors.WithDetail(errNotRevocable, "lumens are not revocable")
+	}
+	code, issuer := asset.Code, asset.Issuer
+	flags, err := stellar.AccountFlags(ctx, sc.hclient, issuer)
+	if err != nil {
+		return errors.Wrapf(err, "getting flags of issuer %s", issuer)
+	}
+	if !flags.AuthRevocable {
+		return errors.WithDetailf(errNotRevocable, "issuer %s of %s has not set AUTH_REVOCABLE", issuer, code)
+	}
+	return nil
+}
+
+// escrow moves the delegated outputs of assetID held by pubkey
+// to an output the custodian alone can spend,
+// returning the amount escrowed.
+func (c *Custodian) escrow(ctx context.Context, pubkey, assetID []byte) (int64, error) {
+	signers := c.delegatedSigners(pubkey)
+	locked := bytes.Join([][]byte{signers[0], signers[1]}, nil)
+	sel, err := c.selectOutputs(ctx, locked, assetID, math.MaxInt64)
+	if err != nil || sel.Total == 0 {
+		return 0, err
+	}
+	custPub := signers[1]
+	tx, err := buildTransferTx(bc.HashFromBytes(assetID), sel.Outputs, sel.Total, []ed25519.PublicKey{custPub}, signers, c.privkey)
+	if err != nil {
+		return 0, errors.Wrap(err, "building escrow tx")
+	}
+	err = c.submitAndWait(ctx, tx)
+	if err != nil {
+		return 0, errors.Wrap(err, "submitting escrow tx")
+	}
+	anchor := txresult.New(tx).Outputs[0].Value.Anchor
+	const q = `INSERT INTO escrows (pubkey, txvm_asset, amount, anchor, txid, escrowed_ms) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = c.DB.ExecContext(ctx, q, pubkey, assetID, sel.Total, anchor, tx.ID.Bytes(), c.nowMS())
+	if err != nil {
+		return 0, errors.Wrap(err, "recording escrow")
+	}
+	return sel.Total, nil
+}
+
+// release pays the unreleased escrows of assetID held for pubkey
+// back to delegated outputs of pubkey,
+// returning the amount released.
+func (c *Custodian) release(ctx context.Context, pubkey, assetID []byte) (int64, error) {
+	type escrow struct {
+		id     int64
+		amount int64
+		anchor []byte
+	}
+	var escrows []escrow
+	const q = `SELECT id, amount, anchor FROM escrows WHERE pubkey=$1 AND txvm_asset=$2 AND released_ms IS NULL`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pubkey, assetID, func(id, amount int64, anchor []byte) {
+		escrows = append(escrows, escrow{id: id, amount: amount, anchor: anchor})
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "reading escrows")
+	}
+	var released int64
+	for _, e := range escrows {
+		in := []AccountOutput{{Anchor: e.anchor, Amount: e.amount}}
+		tx, err := buildTransferTx(bc.HashFromBytes(assetID), in, e.amount, c.delegatedSigners(pubkey), nil, c.privkey)
+		if err != nil {
+			return released, errors.Wrapf(err, "building release tx for escrow %d", e.id)
+		}
+		err = c.submitAndWait(ctx, tx)
+		if err != nil {
+			return released, errors.Wrapf(err, "submitting release tx for escrow %d", e.id)
+		}
+		_, err = c.DB.ExecContext(ctx, `UPDATE escrows SET released_ms=$1, release_txid=$2 WHERE id=$3`, c.nowMS(), tx.ID.Bytes(), e.id)
+		if err != nil {
+			return released, errors.Wrapf(err, "recording release of escrow %d", e.id)
+		}
+		released += e.amount
+	}
+	return released, nil
+}
+
+// freezeBalance freezes and escrows the balance of assetID held by pubkey
+// on an admin's request,
+// returning the amount escrowed.
+func (c *Custodian) freezeBalance(ctx context.Context, pubkey, assetID []byte, reason, source string) (int64, error) {
+	err := c.checkRevocable(ctx, assetID)
+	if err != nil {
+		return 0, err
+	}
+	err = c.freeze(ctx, pubkey, assetID, reason, 0)
+	if err != nil {
+		return 0, err
+	}
+	escrowed, err := c.escrow(ctx, pubkey, assetID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "escrowing asset %x of %x", assetID, pubkey)
+	}
+	detail := fmt.Sprintf("asset %x of %x, %d escrowed: %s", assetID, pubkey, escrowed, reason)
+	return escrowed, c.recordAudit(ctx, "balance.freeze", source, detail)
+}
+
+// unfreezeBalance unfreezes the balance of assetID held by pubkey
+// and releases its escrows,
+// reporting whether it was frozen.
+func (c *Custodian) unfreezeBalance(ctx context.Context, pubkey, assetID []byte, source string) (bool, error) {
+	res, err := c.DB.ExecContext(ctx, `DELETE FROM frozen WHERE pubkey=$1 AND txvm_asset=$2`, pubkey, assetID)
+	if err != nil {
+		return false, errors.Wrap(err, "unfreezing balance")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, errors.Wrap(err, "unfreezing balance")
+	}
+	released, err := c.release(ctx, pubkey, assetID)
+	if err != nil {
+		return true, errors.Wrapf(err, "releasing escrows of asset %x of %x", assetID, pubkey)
+	}
+	detail := fmt.Sprintf("asset %x of %x, %d released", assetID, pubkey, released)
+	return true, c.recordAudit(ctx, "balance.unfreeze", source, detail)
+}
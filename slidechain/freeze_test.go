@@ -0,0 +1,173 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestFreeze(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	issuerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(issuerKP.Address(), horizonmock.FriendbotAmount)
+	_, err = stellar.NewSequencer(srv.Client()).Submit(issuerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: srv.Passphrase,
+			Source:  issuerKP.Address(),
+			SeqNum:  seqnum,
+			Ops:     []stellar.Op{stellar.SetOptions{SetFlags: stellar.AuthRevocable}},
+		}, nil
+	}, issuerKP.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd, err := stellar.NewAsset("USD", issuerKP.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usdXDR, err := usd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		accountID := custKP.Address()
+		c := &Custodian{
+			imports:       sync.NewCond(new(sync.Mutex)),
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			AccountID:     accountID,
+			chain:         newStellarChain(srv.Client(), accountID, custKP.Seed(), srv.Passphrase),
+			cfg:           config.Default(),
+		}
+
+		ic := issuanceContracts[3]
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i, assetXDR := range [][]byte{usdXDR, nativeXDR} {
+			importTestPeg(ctx, t, c, ic, assetXDR, alicePub, 100, expMS+int64(i))
+			const q = `INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state, issuance_version) VALUES ($1, 100, $2, $3, $4, $5, 3)`
+			_, err = db.Exec(q, []byte(fmt.Sprintf("nonce %d", i)), assetXDR, alicePub, expMS+int64(i), pegInImported)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		index := func() {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		held := func(lock []byte, assetID bc.Hash) int64 {
+			t.Helper()
+			var n int64
+			const q = `SELECT COALESCE(SUM(amount), 0) FROM utxos WHERE pubkeys=$1 AND txvm_asset=$2 AND spent_height IS NULL`
+			err := db.QueryRow(q, lock, assetID.Bytes()).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		delegatedLock := append(append([]byte{}, alicePub...), custodianPub...)
+		do := func(req *http.Request, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.Frozen(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("%s /admin/frozen: got status %d, want %d: %s", req.Method, w.Code, wantCode, w.Body)
+			}
+			return w
+		}
+		freeze := func(assetID bc.Hash, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			body := fmt.Sprintf(`{"pubkey": "%x", "asset_id": "%x", "reason": "test"}`, alicePub, assetID.Bytes())
+			return do(httptest.NewRequest("POST", "/admin/frozen", strings.NewReader(body)), wantCode)
+		}
+		index()
+
+		// Lumens are not revocable, so cannot be frozen.
+		freeze(ic.assetID(nativeXDR), http.StatusConflict)
+
+		// Freezing revocable USD escrows alice's delegated outputs.
+		usdID := ic.assetID(usdXDR)
+		var f frozenBalance
+		err = json.NewDecoder(freeze(usdID, http.StatusOK).Body).Decode(&f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Escrowed != 100 {
+			t.Errorf("got %d escrowed, want 100", f.Escrowed)
+		}
+		index()
+		if got := held(delegatedLock, usdID); got != 0 {
+			t.Errorf("alice holds %d USD while frozen, want 0", got)
+		}
+		if got := held(custodianPub, usdID); got != 100 {
+			t.Errorf("the custodian holds %d USD in escrow, want 100", got)
+		}
+		var list []frozenBalance
+		err = json.NewDecoder(do(httptest.NewRequest("GET", "/admin/frozen", nil), http.StatusOK).Body).Decode(&list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Pubkey != hex.EncodeToString(alicePub) || list[0].Escrowed != 100 {
+			t.Errorf("got frozen balances %+v, want alice's escrowed 100", list)
+		}
+
+		// Unfreezing pays the escrow back.
+		unfreeze := fmt.Sprintf("/admin/frozen?pubkey=%x&asset_id=%x", alicePub, usdID.Bytes())
+		do(httptest.NewRequest("DELETE", unfreeze, nil), http.StatusNoContent)
+		do(httptest.NewRequest("DELETE", unfreeze, nil), http.StatusNotFound)
+		index()
+		if got := held(delegatedLock, usdID); got != 100 {
+			t.Errorf("alice holds %d USD after unfreezing, want 100", got)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE action IN ('balance.freeze', 'balance.unfreeze')`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %d freeze audit entries, want 2", n)
+		}
+	})
+}
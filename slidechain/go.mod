@@ -1,26 +1,23 @@
 module slingshot/slidechain
 
+go 1.24.0
+
 require (
-	github.com/agl/ed25519 v0.0.0-20170116200512-5312a6153412 // indirect
 	github.com/bobg/multichan v1.0.1
 	github.com/bobg/sqlutil v0.0.0-20180406050615-9797d815c1b0
 	github.com/chain/txvm v0.0.0-20190125064935-7c38bfeddf11
-	github.com/davecgh/go-spew v1.1.1
-	github.com/go-errors/errors v1.0.1 // indirect
+	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc
 	github.com/golang/protobuf v1.2.0
 	github.com/interstellar/starlight v0.1.0-alpha
-	github.com/lib/pq v1.0.0 // indirect
-	github.com/manucorporat/sse v0.0.0-20160126180136-ee05b128a739 // indirect
 	github.com/mattn/go-sqlite3 v1.10.0
-	github.com/pkg/errors v0.8.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/segmentio/go-loggly v0.5.0 // indirect
-	github.com/sirupsen/logrus v1.0.6-0.20180720114135-a1f2e46d9209 // indirect
-	github.com/stellar/go v0.0.0-20181029194640-da269347d7dc
-	github.com/stellar/go-xdr v0.0.0-20180917104419-0bc96f33a18e // indirect
-	github.com/stretchr/objx v0.1.1 // indirect
-	github.com/stretchr/testify v1.2.2 // indirect
+	github.com/pkg/errors v0.9.1
+	github.com/stellar/go v0.0.0-20251210100531-aab2ea4aca88
+)
+
+require (
+	github.com/klauspost/compress v1.17.6 // indirect
+	github.com/stellar/go-xdr v0.0.0-20231122183749-b53fb00bcac2 // indirect
 	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc // indirect
+	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4 // indirect
-	golang.org/x/sys v0.0.0-20190102155601-82a175fd1598 // indirect
 )
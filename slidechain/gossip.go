@@ -0,0 +1,97 @@
+package slidechain
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/gossip"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// Gossip is the handler for /gossip,
+// used for exchanging blocks and txs with follower nodes
+// when gossip is configured.
+func (c *Custodian) Gossip(w http.ResponseWriter, req *http.Request) {
+	if c.S.gossip == nil {
+		net.Errorf(w, http.StatusNotFound, "gossip is not configured")
+		return
+	}
+	c.S.gossip.ServeHTTP(w, req)
+}
+
+// gossipBlocks publishes each new block to the gossip network.
+// Runs as a goroutine.
+func (s *submitter) gossipBlocks(ctx context.Context) {
+	defer log.Print("gossipBlocks exiting")
+
+	r := s.w.Reader()
+	defer r.Dispose()
+	for {
+		got, ok := r.Read(ctx)
+		if !ok {
+			return
+		}
+		b := got.(*bc.Block)
+		bits, err := b.Bytes()
+		if err != nil {
+			log.Printf("serializing block %d for gossip: %s", b.Height, err)
+			continue
+		}
+		s.gossip.Publish(gossip.Block, bits)
+	}
+}
+
+// handleGossip handles a gossip message at the node producing blocks.
+// A tx is added to the block a-building.
+// A block can only be one this node committed.
+func (s *submitter) handleGossip(ctx context.Context, kind string, data []byte) error {
+	switch kind {
+	case gossip.Tx:
+		tx, err := parseRawTx(data)
+		if err != nil {
+			return err
+		}
+		_, err = s.submitPaidTx(ctx, tx)
+		return errors.Sub(gossip.ErrInvalid, err)
+	case gossip.Block:
+		b := new(bc.Block)
+		err := b.FromBytes(data)
+		if err != nil {
+			return errors.Sub(gossip.ErrInvalid, err)
+		}
+		if b.Height > s.chain.Height() {
+			return errors.WithDetailf(gossip.ErrInvalid, "block %d is beyond the tip", b.Height)
+		}
+		ours, err := s.chain.GetBlock(ctx, b.Height)
+		if err != nil {
+			return err
+		}
+		if ours.Hash() != b.Hash() {
+			return errors.WithDetailf(gossip.ErrInvalid, "block %d conflicts with the committed one", b.Height)
+		}
+		return gossip.ErrStale
+	}
+	return errors.WithDetailf(gossip.ErrInvalid, "unknown kind %s", kind)
+}
+
+// parseRawTx parses a serialized bc.RawTx,
+// as submitted to /submit and gossiped.
+func parseRawTx(bits []byte) (*bc.Tx, error) {
+	var rawTx bc.RawTx
+	err := proto.Unmarshal(bits, &rawTx)
+	if err != nil {
+		return nil, errors.Sub(gossip.ErrInvalid, err)
+	}
+	tx, err := bc.NewTx(rawTx.Program, rawTx.Version, rawTx.Runlimit)
+	if err != nil {
+		return nil, errors.Sub(gossip.ErrInvalid, err)
+	}
+	if !tx.Finalized {
+		return nil, errors.WithDetail(gossip.ErrInvalid, "tx is not finalized")
+	}
+	return tx, nil
+}
@@ -0,0 +1,346 @@
+// Package gossip spreads slidechain blocks and txs among nodes
+// by flooding over HTTP:
+// each node posts a message it has not seen before
+// to all its peers except the one it came from.
+//
+// A peer gains score for each new valid message it sends
+// and loses more for each invalid one,
+// and is ignored for a while when its score falls too low.
+// A peer that cannot be reached is retried with exponential backoff;
+// messages for it in the meantime are dropped,
+// so receivers must be able to fill gaps some other way.
+//
+// The sender of a message is the URL it claims,
+// so scores limit careless peers, not impersonation.
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// Message kinds.
+const (
+	Block = "block" // a serialized bc.Block
+	Tx    = "tx"    // a serialized bc.RawTx
+)
+
+var (
+	// ErrStale is returned by a Handler for a valid message
+	// that is not new to the node, such as an already-committed block.
+	// The message is not relayed and its sender keeps its score.
+	ErrStale = errors.New("stale message")
+
+	// ErrInvalid is the root of the errors a Handler returns
+	// for invalid messages, which cost their senders score.
+	// Other errors are taken to be the node's own problem,
+	// and the message may be handled again if it is resent.
+	ErrInvalid = errors.New("invalid message")
+)
+
+const (
+	maxSeen      = 10000 // message IDs remembered, to drop duplicates
+	maxPeers     = 50
+	queueLen     = 100 // messages queued for each peer
+	maxScore     = 100
+	invalidScore = 5 // lost for an invalid message
+	banScore     = -20
+	banDuration  = 10 * time.Minute
+	minBackoff   = time.Second
+	maxBackoff   = 5 * time.Minute
+	sendTimeout  = 10 * time.Second
+)
+
+// Message is the request body of POST /gossip.
+type Message struct {
+	Kind string `json:"kind"`
+	From string `json:"from"` // base URL of the sending node
+	Data []byte `json:"data"`
+}
+
+// Handler processes the data of a message of the given kind,
+// returning nil if it is new and valid.
+type Handler func(ctx context.Context, kind string, data []byte) error
+
+// PeerStatus describes a peer, as reported by GET /gossip.
+type PeerStatus struct {
+	URL     string    `json:"url"`
+	Score   int       `json:"score"`
+	Up      bool      `json:"up"`
+	RetryAt time.Time `json:"retry_at,omitempty"` // when messages are next sent, if down or banned
+	Banned  bool      `json:"banned"`
+}
+
+type peer struct {
+	url         string
+	queue       chan Message
+	score       int
+	up          bool
+	backoff     time.Duration
+	retryAt     time.Time // while down, sends are skipped until then
+	bannedUntil time.Time
+}
+
+// skip reports whether messages to p are dropped at time now.
+func (p *peer) skip(now time.Time) bool {
+	return now.Before(p.retryAt) || now.Before(p.bannedUntil)
+}
+
+// Node is a participant in the gossip network.
+type Node struct {
+	ctx     context.Context
+	self    string
+	handler Handler
+
+	mu        sync.Mutex
+	peers     map[string]*peer
+	seen      map[[32]byte]bool
+	seenOrder [][32]byte
+}
+
+// New returns a gossip node that advertises itself at the base URL self,
+// serving POST /gossip there,
+// and passes the messages it receives to h.
+// It gossips with the given peers
+// and any others that send it messages,
+// until ctx is canceled.
+func New(ctx context.Context, self string, peers []string, h Handler) *Node {
+	n := &Node{
+		ctx:     ctx,
+		self:    strings.TrimRight(self, "/"),
+		handler: h,
+		peers:   make(map[string]*peer),
+		seen:    make(map[[32]byte]bool),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, url := range peers {
+		n.peer(url)
+	}
+	return n
+}
+
+// peer returns the peer with the given URL,
+// adding it if there is room.
+// It returns nil for n itself and when there is no room.
+// It must be called with n.mu held.
+func (n *Node) peer(url string) *peer {
+	url = strings.TrimRight(url, "/")
+	if url == "" || url == n.self {
+		return nil
+	}
+	if p, ok := n.peers[url]; ok {
+		return p
+	}
+	if len(n.peers) >= maxPeers {
+		return nil
+	}
+	p := &peer{url: url, queue: make(chan Message, queueLen), up: true}
+	n.peers[url] = p
+	go n.send(p)
+	return p
+}
+
+// Publish sends a message originating at this node to all peers.
+func (n *Node) Publish(kind string, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, seen := n.markSeen(kind, data); seen {
+		return
+	}
+	n.relay(Message{Kind: kind, From: n.self, Data: data}, "")
+}
+
+// relay queues msg for each peer but the one with URL except.
+// It must be called with n.mu held.
+func (n *Node) relay(msg Message, except string) {
+	now := time.Now()
+	for url, p := range n.peers {
+		if url == except || p.skip(now) {
+			continue
+		}
+		select {
+		case p.queue <- msg:
+		default:
+			log.Printf("gossip queue for %s is full, dropping %s", url, msg.Kind)
+		}
+	}
+}
+
+// markSeen records a message,
+// returning its ID and whether it was already seen.
+// It must be called with n.mu held.
+func (n *Node) markSeen(kind string, data []byte) ([32]byte, bool) {
+	id := sha3.Sum256(append([]byte(kind+"\x00"), data...))
+	if n.seen[id] {
+		return id, true
+	}
+	n.seen[id] = true
+	n.seenOrder = append(n.seenOrder, id)
+	if len(n.seenOrder) > maxSeen {
+		delete(n.seen, n.seenOrder[0])
+		n.seenOrder = n.seenOrder[1:]
+	}
+	return id, false
+}
+
+// send posts the messages queued for p to it
+// until n's context is canceled.
+// Runs as a goroutine.
+func (n *Node) send(p *peer) {
+	for {
+		var msg Message
+		select {
+		case <-n.ctx.Done():
+			return
+		case msg = <-p.queue:
+		}
+		msg.From = n.self
+		err := post(n.ctx, p.url, msg)
+
+		n.mu.Lock()
+		if err != nil {
+			p.backoff *= 2
+			if p.backoff < minBackoff {
+				p.backoff = minBackoff
+			}
+			if p.backoff > maxBackoff {
+				p.backoff = maxBackoff
+			}
+			p.retryAt = time.Now().Add(p.backoff)
+			if p.up {
+				log.Printf("gossip peer %s is down: %s", p.url, err)
+			}
+			p.up = false
+		} else {
+			if !p.up {
+				log.Printf("gossip peer %s is back up", p.url)
+			}
+			p.up, p.backoff = true, 0
+		}
+		n.mu.Unlock()
+	}
+}
+
+func post(ctx context.Context, url string, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "encoding message")
+	}
+	req, err := http.NewRequest("POST", url+"/gossip", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := net.PeerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// A peer rejecting a message is still up.
+	if resp.StatusCode/100 == 5 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP handles POST /gossip, receiving a message,
+// and GET /gossip, reporting the status of each peer.
+func (n *Node) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Peers())
+		return
+	}
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "gossip requires GET or POST")
+		return
+	}
+	var msg Message
+	err := json.NewDecoder(req.Body).Decode(&msg)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing message: %s", err)
+		return
+	}
+	if msg.Kind != Block && msg.Kind != Tx {
+		net.Errorf(w, http.StatusBadRequest, "unknown message kind %q", msg.Kind)
+		return
+	}
+
+	n.mu.Lock()
+	p := n.peer(msg.From)
+	if p != nil && time.Now().Before(p.bannedUntil) {
+		n.mu.Unlock()
+		net.Errorf(w, http.StatusForbidden, "peer %s is banned", p.url)
+		return
+	}
+	id, seen := n.markSeen(msg.Kind, msg.Data)
+	n.mu.Unlock()
+	if seen {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = n.handler(req.Context(), msg.Kind, msg.Data)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case err == nil:
+		if p != nil && p.score < maxScore {
+			p.score++
+		}
+		n.relay(msg, msg.From)
+	case errors.Root(err) == ErrStale:
+	case errors.Root(err) == ErrInvalid:
+		if p != nil {
+			p.score -= invalidScore
+			if p.score <= banScore {
+				log.Printf("banning gossip peer %s for %s", p.url, banDuration)
+				p.score = 0
+				p.bannedUntil = time.Now().Add(banDuration)
+			}
+		}
+		net.Errorf(w, http.StatusBadRequest, "%s from %s: %s", msg.Kind, msg.From, err)
+		return
+	default:
+		delete(n.seen, id)
+		net.Errorf(w, http.StatusServiceUnavailable, "handling %s from %s: %s", msg.Kind, msg.From, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Peers reports the status of each peer, in URL order.
+func (n *Node) Peers() []PeerStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	var out []PeerStatus
+	for _, p := range n.peers {
+		s := PeerStatus{URL: p.url, Score: p.score, Up: p.up, Banned: now.Before(p.bannedUntil)}
+		if p.skip(now) {
+			s.RetryAt = p.retryAt
+			if p.bannedUntil.After(s.RetryAt) {
+				s.RetryAt = p.bannedUntil
+			}
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
@@ -0,0 +1,190 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/gossip"
+)
+
+func TestGossip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, srv *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{S: s, DB: db}
+
+		// The servers are started before the nodes they serve
+		// so that each node knows the other's URL.
+		var (
+			primaryMux  = http.NewServeMux()
+			followerMux = http.NewServeMux()
+			primarySrv  = httptest.NewServer(primaryMux)
+			followerSrv = httptest.NewServer(followerMux)
+		)
+		defer primarySrv.Close()
+		defer followerSrv.Close()
+
+		s.gossip = gossip.New(ctx, primarySrv.URL, []string{followerSrv.URL}, s.handleGossip)
+		primaryMux.HandleFunc("/get", s.Get)
+		primaryMux.HandleFunc("/sync/headers", c.SyncHeaders)
+		primaryMux.HandleFunc("/sync/blocks", c.SyncBlocks)
+		primaryMux.Handle("/gossip", s.gossip)
+		gossipCtx, stopGossip := context.WithCancel(ctx)
+		defer stopGossip()
+		go s.gossipBlocks(gossipCtx)
+		// Let gossipBlocks start reading blocks.
+		time.Sleep(100 * time.Millisecond)
+
+		f, err := ioutil.TempFile("", "follower")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		fdb, err := sql.Open("sqlite3", f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fdb.Close()
+		follower, err := NewFollower(ctx, fdb, primarySrv.URL, s.initialBlock.Hash(), followerSrv.URL, []string{primarySrv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		followerMux.HandleFunc("/get", follower.Get)
+		followerMux.HandleFunc("/submit", follower.Submit)
+		followerMux.HandleFunc("/mempool", follower.Mempool)
+		followerMux.Handle("/gossip", follower.Gossip)
+
+		var expMS int64
+		newTx := func() *bc.Tx {
+			expMS++
+			tx, err := buildPrePegInTx(issuanceContracts[1], s.initialBlock.Hash().Bytes(), nil, testRecipPubKey, 1, int64(bc.Millis(time.Now().Add(time.Hour)))+expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+		// waitFor waits for the follower to reach the given height
+		// and checks that its block there is the primary's.
+		waitFor := func(height uint64) {
+			t.Helper()
+			select {
+			case <-follower.chain.BlockWaiter(height):
+			case <-ctx.Done():
+				t.Fatalf("follower at height %d, want %d", follower.Height(), height)
+			}
+			theirs, err := follower.chain.GetBlock(ctx, height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ours, err := chain.GetBlock(ctx, height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if theirs.Hash() != ours.Hash() {
+				t.Fatalf("follower's block %d differs from the primary's", height)
+			}
+		}
+		post := func(msg gossip.Message) int {
+			t.Helper()
+			body, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post(followerSrv.URL+"/gossip", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// New blocks reach the follower by gossip.
+		_, err = s.submitTx(ctx, newTx())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(chain.Height())
+
+		// A block after a gap is applied once the gap is filled from the primary.
+		stopGossip()
+		for i := 0; i < 2; i++ {
+			_, err = s.submitTx(ctx, newTx())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		latest, err := chain.GetBlock(ctx, chain.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		bits, err := latest.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := post(gossip.Message{Kind: gossip.Block, From: "http://peer.invalid", Data: bits})
+		if code != http.StatusNoContent {
+			t.Fatalf("status code %d gossiping block %d", code, latest.Height)
+		}
+		waitFor(latest.Height)
+
+		// A tx submitted to the follower reaches the primary.
+		tx := newTx()
+		txbits, err := proto.Marshal(&tx.RawTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(followerSrv.URL+"/submit", "application/octet-stream", bytes.NewReader(txbits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("status code %d from POST /submit", resp.StatusCode)
+		}
+		select {
+		case <-chain.BlockWaiter(latest.Height + 1):
+		case <-ctx.Done():
+			t.Fatal("tx submitted to the follower was not committed")
+		}
+		b, err := chain.GetBlock(ctx, latest.Height+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b.Transactions) != 1 || b.Transactions[0].ID != tx.ID {
+			t.Errorf("block %d does not contain the tx submitted to the follower", b.Height)
+		}
+
+		// A peer sending invalid messages is banned.
+		for i := 0; ; i++ {
+			code := post(gossip.Message{Kind: gossip.Block, From: "http://bad.invalid", Data: []byte{byte(i)}})
+			if code == http.StatusForbidden {
+				break
+			}
+			if code != http.StatusBadRequest {
+				t.Fatalf("status code %d for invalid message %d", code, i)
+			}
+			if i > 10 {
+				t.Fatal("peer sending invalid messages is not banned")
+			}
+		}
+		for _, p := range follower.Gossip.Peers() {
+			if (p.URL == "http://bad.invalid") != p.Banned {
+				t.Errorf("peer %s banned: %v", p.URL, p.Banned)
+			}
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package slidechain
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// adminAction is a proposed admin action, as listed by /admin/actions.
+type adminAction struct {
+	ID        int64  `json:"id"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Body      string `json:"body"`
+	CreatedMS int64  `json:"created_ms"`
+	ExpiresMS int64  `json:"expires_ms"`
+	Proposer  string `json:"proposer"`
+
+	// Digest is what the approving operator signs,
+	// the hex ActionDigest of the action.
+	Digest string `json:"digest"`
+}
+
+// ActionDigest returns the message an operator signs
+// to propose or approve the admin request with the given method,
+// URI (path and query), and body,
+// first proposed at timeMS.
+func ActionDigest(method, uri string, body []byte, timeMS int64) []byte {
+	bodyHash := sha3.Sum256(body)
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(timeMS))
+	msg := []byte("slidechain admin action\x00")
+	for _, s := range []string{method, uri} {
+		msg = append(msg, s...)
+		msg = append(msg, 0)
+	}
+	msg = append(msg, bodyHash[:]...)
+	msg = append(msg, timeBytes[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// operatorKey returns the public key of the named operator,
+// or nil if there is none.
+func operatorKey(cfg config.Governance, name string) ed25519.PublicKey {
+	for _, op := range cfg.Operators {
+		n, key := config.SplitNamed(op)
+		if n != name || name == "" {
+			continue
+		}
+		b, err := hex.DecodeString(key)
+		if err == nil && len(b) == ed25519.PublicKeySize {
+			return b
+		}
+	}
+	return nil
+}
+
+// TwoPerson wraps a destructive admin handler
+// so that, when governance.operators is set,
+// a request other than GET or HEAD runs only once two operators have signed it.
+//
+// The first operator's request,
+// with X-Operator, X-Action-Time (ms), and X-Signature (base64, of ActionDigest) headers,
+// is recorded as a pending action and answered 202 Accepted with its ID.
+// A different operator approves by repeating the request
+// with its own X-Operator and X-Signature and the action's ID in X-Action-ID
+// before governance.ttl passes;
+// only then does the handler run,
+// seeing both operators' names as the request's RemoteAddr.
+func (c *Custodian) TwoPerson(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := c.config()
+		if cfg == nil || len(cfg.Governance.Operators) == 0 || req.Method == http.MethodGet || req.Method == http.MethodHead {
+			h.ServeHTTP(w, req)
+			return
+		}
+		ctx := req.Context()
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+			return
+		}
+		name := req.Header.Get("X-Operator")
+		pubkey := operatorKey(cfg.Governance, name)
+		if pubkey == nil {
+			net.Errorf(w, http.StatusForbidden, "this action requires two operator signatures; unknown operator %q", name)
+			return
+		}
+		sig, err := base64.StdEncoding.DecodeString(req.Header.Get("X-Signature"))
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "X-Signature is not base64: %s", err)
+			return
+		}
+		uri := req.URL.RequestURI()
+
+		idStr := req.Header.Get("X-Action-ID")
+		if idStr == "" {
+			timeMS, err := strconv.ParseInt(req.Header.Get("X-Action-Time"), 10, 64)
+			if err != nil {
+				net.Errorf(w, http.StatusBadRequest, "X-Action-Time must be a time in milliseconds")
+				return
+			}
+			if !c.checkRequestTime(w, "X-Action-Time", timeMS) {
+				return
+			}
+			digest := ActionDigest(req.Method, uri, body, timeMS)
+			if !ed25519.Verify(pubkey, digest, sig) {
+				net.Errorf(w, http.StatusUnauthorized, "bad signature")
+				return
+			}
+			expiresMS := c.nowMS() + int64(time.Duration(cfg.Governance.TTL)/time.Millisecond)
+			const q = `INSERT INTO admin_actions (method, uri, body, created_ms, expires_ms, proposer) VALUES ($1, $2, $3, $4, $5, $6)`
+			res, err := c.DB.ExecContext(ctx, q, req.Method, uri, body, timeMS, expiresMS, name)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "recording action: %s", err)
+				return
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "recording action: %s", err)
+				return
+			}
+			err = c.recordAudit(ctx, "governance.propose", "operator "+name, fmt.Sprintf("action %d: %s %s", id, req.Method, uri))
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(adminAction{
+				ID:        id,
+				Method:    req.Method,
+				URI:       uri,
+				Body:      string(body),
+				CreatedMS: timeMS,
+				ExpiresMS: expiresMS,
+				Proposer:  name,
+				Digest:    hex.EncodeToString(digest),
+			})
+			return
+		}
+
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "X-Action-ID must be an action ID")
+			return
+		}
+		var (
+			a          adminAction
+			storedBody []byte
+			executedMS sql.NullInt64
+		)
+		const q = `SELECT method, uri, body, created_ms, expires_ms, proposer, executed_ms FROM admin_actions WHERE id=$1`
+		err = c.DB.QueryRowContext(ctx, q, id).Scan(&a.Method, &a.URI, &storedBody, &a.CreatedMS, &a.ExpiresMS, &a.Proposer, &executedMS)
+		if err == sql.ErrNoRows {
+			net.Errorf(w, http.StatusNotFound, "no action %d", id)
+			return
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "looking up action %d: %s", id, err)
+			return
+		}
+		switch {
+		case executedMS.Valid:
+			net.Errorf(w, http.StatusConflict, "action %d has already run", id)
+			return
+		case c.nowMS() > a.ExpiresMS:
+			net.Errorf(w, http.StatusGone, "action %d expired unapproved", id)
+			return
+		case name == a.Proposer:
+			net.Errorf(w, http.StatusForbidden, "action %d must be approved by an operator other than %s", id, name)
+			return
+		case req.Method != a.Method || uri != a.URI || !bytes.Equal(body, storedBody):
+			net.Errorf(w, http.StatusBadRequest, "request is not action %d, %s %s", id, a.Method, a.URI)
+			return
+		}
+		if !ed25519.Verify(pubkey, ActionDigest(a.Method, a.URI, storedBody, a.CreatedMS), sig) {
+			net.Errorf(w, http.StatusUnauthorized, "bad signature")
+			return
+		}
+		res, err := c.DB.ExecContext(ctx, `UPDATE admin_actions SET approver=$1, executed_ms=$2 WHERE id=$3 AND executed_ms IS NULL`, name, c.nowMS(), id)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "approving action %d: %s", id, err)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			net.Errorf(w, http.StatusConflict, "action %d has already run", id)
+			return
+		}
+		err = c.recordAudit(ctx, "governance.approve", "operator "+name, fmt.Sprintf("action %d: %s %s, proposed by %s", id, a.Method, a.URI, a.Proposer))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		approved := new(http.Request)
+		*approved = *req
+		approved.Body = ioutil.NopCloser(bytes.NewReader(body))
+		approved.RemoteAddr = fmt.Sprintf("operators %s+%s (action %d)", a.Proposer, name, id)
+		h.ServeHTTP(w, approved)
+	})
+}
+
+// AdminActions is the admin handler listing the proposed actions
+// awaiting a second signature.
+func (c *Custodian) AdminActions(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		net.Errorf(w, http.StatusMethodNotAllowed, "actions are listed with GET")
+		return
+	}
+	actions := []adminAction{}
+	const q = `SELECT id, method, uri, body, created_ms, expires_ms, proposer FROM admin_actions
+		WHERE executed_ms IS NULL AND expires_ms >= $1 ORDER BY id`
+	err := sqlutil.ForQueryRows(req.Context(), c.DB, q, c.nowMS(), func(id int64, method, uri string, body []byte, createdMS, expiresMS int64, proposer string) {
+		actions = append(actions, adminAction{
+			ID:        id,
+			Method:    method,
+			URI:       uri,
+			Body:      string(body),
+			CreatedMS: createdMS,
+			ExpiresMS: expiresMS,
+			Proposer:  proposer,
+			Digest:    hex.EncodeToString(ActionDigest(method, uri, body, createdMS)),
+		})
+	})
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading actions: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
@@ -0,0 +1,131 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+func TestTwoPerson(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make(map[string]ed25519.PrivateKey)
+		cfg := config.Default()
+		cfg.Admin.PauseFile = ""
+		for _, name := range []string{"alice", "bob"} {
+			pub, prv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys[name] = prv
+			cfg.Governance.Operators = append(cfg.Governance.Operators, name+"="+hex.EncodeToString(pub))
+		}
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, cfg: cfg, now: func() time.Time { return now }}
+		h := c.TwoPerson(http.HandlerFunc(c.Pause))
+
+		do := func(operator, target, body string, timeMS, id int64, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest("POST", target, strings.NewReader(body))
+			req.Header.Set("X-Operator", operator)
+			if prv, ok := keys[operator]; ok {
+				sig := ed25519.Sign(prv, ActionDigest("POST", target, []byte(body), timeMS))
+				req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(sig))
+			}
+			if id == 0 {
+				req.Header.Set("X-Action-Time", strconv.FormatInt(timeMS, 10))
+			} else {
+				req.Header.Set("X-Action-ID", strconv.FormatInt(id, 10))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from %s by %s, want %d: %s", w.Code, target, operator, wantCode, w.Body)
+			}
+			return w
+		}
+		pending := func() []adminAction {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.AdminActions(w, httptest.NewRequest("GET", "/admin/actions", nil))
+			var actions []adminAction
+			err := json.NewDecoder(w.Body).Decode(&actions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return actions
+		}
+		pausedOut := func() bool {
+			t.Helper()
+			paused, err := c.paused(ctx, pausePegOut)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return paused
+		}
+
+		const target = "/admin/pause?scope=pegout&reason=incident"
+		do("mallory", target, "", c.nowMS(), 0, http.StatusForbidden)
+
+		var proposed adminAction
+		err = json.NewDecoder(do("alice", target, "", c.nowMS(), 0, http.StatusAccepted).Body).Decode(&proposed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pausedOut() {
+			t.Fatal("action ran with one signature")
+		}
+		if p := pending(); len(p) != 1 || p[0].ID != proposed.ID || p[0].Digest != proposed.Digest {
+			t.Errorf("got pending actions %+v, want %+v", p, proposed)
+		}
+
+		do("alice", target, "", proposed.CreatedMS, proposed.ID, http.StatusForbidden)
+		do("bob", "/admin/pause?reason=incident", "", proposed.CreatedMS, proposed.ID, http.StatusBadRequest)
+		do("bob", target, "", proposed.CreatedMS, proposed.ID, http.StatusNoContent)
+		if !pausedOut() {
+			t.Error("approved action did not run")
+		}
+		do("bob", target, "", proposed.CreatedMS, proposed.ID, http.StatusConflict)
+		if p := pending(); len(p) != 0 {
+			t.Errorf("got %d pending actions after approval, want 0", len(p))
+		}
+		var source string
+		err = db.QueryRow(`SELECT source FROM audit_log WHERE action='pause.pegout'`).Scan(&source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(source, "alice+bob") {
+			t.Errorf("pause audited with source %q, want both operators", source)
+		}
+
+		// An action not approved in time expires.
+		err = json.NewDecoder(do("bob", "/admin/resume", "", c.nowMS(), 0, http.StatusAccepted).Body).Decode(&proposed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Duration(cfg.Governance.TTL) + time.Second)
+		if p := pending(); len(p) != 0 {
+			t.Errorf("got %d pending actions after expiry, want 0", len(p))
+		}
+		h = c.TwoPerson(http.HandlerFunc(c.ResumePeg))
+		do("alice", "/admin/resume", "", proposed.CreatedMS, proposed.ID, http.StatusGone)
+		if !pausedOut() {
+			t.Error("expired action ran")
+		}
+	})
+}
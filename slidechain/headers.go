@@ -0,0 +1,305 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// headerMsg is one line of the Headers stream.
+type headerMsg struct {
+	Block []byte `json:"block,omitempty"` // block with no transactions, as in txproof.Proof
+
+	// Rollback, on a line with no block,
+	// is the height of the latest block still on the chain
+	// when a block the subscriber has seen is not:
+	// the blocks above it are invalidated,
+	// and the stream resumes after it.
+	Rollback uint64 `json:"rollback,omitempty"`
+
+	// With a filter, the block's txs that match it,
+	// each serialized as for /submit.
+	Txs [][]byte `json:"txs,omitempty"`
+}
+
+// Headers streams the header and signatures of each block
+// from the height in the from parameter (default 1),
+// as newline-delimited JSON objects,
+// first those already on the chain and then each new one as it is committed.
+// Each header's NextPredicate is the validator set for the block after it.
+// With any of the filter parameters (see parseTxFilter),
+// each header comes with the block's txs that match the filter,
+// and the earlier blocks are read whole from the block store.
+// If the block before from is not on the chain,
+// or is not the one with the hex ID in the prev parameter,
+// and a recorded rollback explains why,
+// the stream begins with a rollback line.
+// The stream lasts until the client disconnects.
+func (c *Custodian) Headers(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	from := uint64(1)
+	if s := req.FormValue("from"); s != "" {
+		var err error
+		from, err = strconv.ParseUint(s, 10, 64)
+		if err != nil || from == 0 {
+			net.Errorf(w, http.StatusBadRequest, "from must be a positive height")
+			return
+		}
+	}
+	filter, err := parseTxFilter(req)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	var prev []byte
+	if s := req.FormValue("prev"); s != "" {
+		prev, err = hex.DecodeString(s)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "prev must be a hex block ID")
+			return
+		}
+	}
+	var (
+		rollbackTo uint64
+		rolledBack bool
+	)
+	if from > 1 {
+		rollbackTo, rolledBack, err = c.rollbackFor(ctx, from-1, prev)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+
+	// Get the reader before looking at the stored headers
+	// so that no block falls between the two.
+	r := c.S.w.Reader()
+	defer r.Dispose()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	if rolledBack {
+		err = enc.Encode(headerMsg{Rollback: rollbackTo})
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		from = rollbackTo + 1
+	}
+	next := from
+	send := func(bits []byte, b *bc.Block) error {
+		msg := headerMsg{Block: bits}
+		if filter != nil {
+			txs, err := c.filterTxs(b, filter)
+			if err != nil {
+				return err
+			}
+			msg.Txs = txs
+		}
+		err := enc.Encode(msg)
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		next++
+		return nil
+	}
+
+	if filter == nil {
+		const q = `SELECT height, bits FROM block_headers WHERE height >= $1 ORDER BY height`
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, from, func(height uint64, bits []byte) error {
+			if height != next {
+				return errors.New("stop at gap")
+			}
+			return send(bits, nil)
+		})
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+	}
+
+	// Blocks not yet indexed are still in the block store.
+	err = c.sendBlocks(ctx, &next, c.S.chain.Height(), send)
+	if err != nil {
+		return
+	}
+	for {
+		x, ok := r.Read(ctx)
+		if !ok {
+			return
+		}
+		b := x.(*bc.Block)
+		if b.Height < next {
+			continue
+		}
+		err = c.sendBlocks(ctx, &next, b.Height-1, send)
+		if err != nil {
+			return
+		}
+		bits, err := headerBytes(b)
+		if err != nil {
+			return
+		}
+		err = send(bits, b)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendBlocks sends the headers of the stored blocks
+// from *next through height.
+func (c *Custodian) sendBlocks(ctx context.Context, next *uint64, height uint64, send func([]byte, *bc.Block) error) error {
+	for *next <= height {
+		b, err := c.S.chain.GetBlock(ctx, *next)
+		if err != nil {
+			return errors.Wrapf(err, "getting block %d", *next)
+		}
+		bits, err := headerBytes(b)
+		if err != nil {
+			return err
+		}
+		err = send(bits, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A txFilter selects the txs of a block sent with its header.
+// A tx matches if it matches any of the criteria.
+type txFilter struct {
+	pubkeys map[string]bool // locking its inputs or outputs, alone or with others
+	assets  map[string]bool // in its inputs, outputs, issuances, or retirements
+	imports bool            // importing a peg-in
+	exports bool            // exporting value to the main chain
+}
+
+// parseTxFilter parses the filter of req
+// from its pubkey and asset parameters, each hex and repeatable,
+// and its kind parameters, import or export.
+// It returns nil if req has none.
+func parseTxFilter(req *http.Request) (*txFilter, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	f := &txFilter{pubkeys: make(map[string]bool), assets: make(map[string]bool)}
+	for _, s := range req.Form["pubkey"] {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("pubkey %q is not a hex ed25519 public key", s)
+		}
+		f.pubkeys[string(b)] = true
+	}
+	for _, s := range req.Form["asset"] {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("asset %q is not a hex txvm asset ID", s)
+		}
+		f.assets[string(b)] = true
+	}
+	for _, s := range req.Form["kind"] {
+		switch s {
+		case "import":
+			f.imports = true
+		case "export":
+			f.exports = true
+		default:
+			return nil, fmt.Errorf("kind %q must be import or export", s)
+		}
+	}
+	if len(f.pubkeys) == 0 && len(f.assets) == 0 && !f.imports && !f.exports {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// filterTxs returns the txs of b that match f,
+// each serialized as for /submit.
+func (c *Custodian) filterTxs(b *bc.Block, f *txFilter) ([][]byte, error) {
+	var txs [][]byte
+	for _, tx := range b.Transactions {
+		if !c.matchTx(tx, f) {
+			continue
+		}
+		bits, err := proto.Marshal(&tx.RawTx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "serializing tx %x", tx.ID.Bytes())
+		}
+		txs = append(txs, bits)
+	}
+	return txs, nil
+}
+
+func (c *Custodian) matchTx(tx *bc.Tx, f *txFilter) bool {
+	contracts := append([]bc.Output(nil), tx.Outputs...)
+	for _, in := range tx.Inputs {
+		contracts = append(contracts, bc.Output(in))
+	}
+	for _, out := range contracts {
+		m, ok := multisigFromOutput(out)
+		if !ok {
+			continue
+		}
+		if f.assets[string(m.AssetID)] {
+			return true
+		}
+		for _, p := range m.Pubkeys {
+			if f.pubkeys[string(p)] {
+				return true
+			}
+		}
+	}
+	for _, iss := range tx.Issuances {
+		if f.assets[string(iss.AssetID.Bytes())] {
+			return true
+		}
+	}
+	for _, r := range tx.Retirements {
+		if f.assets[string(r.AssetID.Bytes())] {
+			return true
+		}
+	}
+	if f.imports && importTx(tx) {
+		return true
+	}
+	if f.exports {
+		if p, err := exportFromLog(tx.Log, c.chain); err == nil && p != nil {
+			return true
+		}
+		if p, _, err := wrapExportFromTx(tx, c.chain); err == nil && p != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// importTx reports whether tx imports a peg-in,
+// consuming the uniqueness token of a version of the import-issuance program.
+func importTx(tx *bc.Tx) bool {
+	for _, in := range tx.Inputs {
+		for _, ic := range issuanceContracts {
+			if in.Seed.Byte32() == ic.createTokenSeed {
+				return true
+			}
+		}
+	}
+	return false
+}
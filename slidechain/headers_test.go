@@ -0,0 +1,184 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/lightclient"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestHeaderSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{S: s, DB: db, InitBlockHash: chain.InitialBlockHash}
+		var txs []*bc.Tx
+		submit := func() {
+			t.Helper()
+			expMS := int64(bc.Millis(time.Now().Add(time.Duration(len(txs)+1) * time.Minute)))
+			tx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), nil, testRecipPubKey, 1, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.submitAndWait(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, tx)
+		}
+		waitForTip := func(lc *lightclient.Client, height uint64) {
+			t.Helper()
+			for lc.Tip().Height < height {
+				if ctx.Err() != nil {
+					t.Fatalf("light client tip at %d, want %d", lc.Tip().Height, height)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		// Blocks 2 through 4 are indexed; block 5 is only in the block store.
+		for i := 0; i < 3; i++ {
+			submit()
+		}
+		_, err := c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit()
+
+		server := httptest.NewServer(http.HandlerFunc(c.Headers))
+		defer server.Close()
+		initial, err := chain.GetBlock(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := lightclient.New(initial.BlockHeader)
+		syncCtx, cancelSync := context.WithCancel(ctx)
+		synced := make(chan error)
+		go func() { synced <- lc.Sync(syncCtx, server.URL) }()
+
+		waitForTip(lc, 5)
+		submit()
+		waitForTip(lc, 6)
+		cancelSync()
+		if err := <-synced; err != context.Canceled {
+			t.Errorf("got sync error %v, want %v", err, context.Canceled)
+		}
+
+		_, err = c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := c.txProof(ctx, txs[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := lc.VerifyProof(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Height != 2 {
+			t.Errorf("got proof for block %d, want 2", h.Height)
+		}
+
+		tip := lc.Tip()
+		err = lc.Apply(&bc.Block{UnsignedBlock: &bc.UnsignedBlock{BlockHeader: &bc.BlockHeader{
+			Height:          tip.Height + 1,
+			PreviousBlockId: &bc.Hash{},
+			TimestampMs:     tip.TimestampMs + 1,
+			NextPredicate:   tip.NextPredicate,
+		}}})
+		if errors.Root(err) != lightclient.ErrHeader {
+			t.Errorf("applying a header off the chain got error %v, want %v", err, lightclient.ErrHeader)
+		}
+	})
+}
+
+func TestHeaderFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{S: s, DB: db, privkey: custodianPrv, InitBlockHash: chain.InitialBlockHash}
+		alice, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assetXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		// Blocks 2 through 5: a pre-peg-in and an import for each.
+		aliceImport := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, alice, 10, expMS)
+		bobImport := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, bob, 5, expMS+1)
+
+		server := httptest.NewServer(http.HandlerFunc(c.Headers))
+		defer server.Close()
+		stream := func(query string) []bc.Hash {
+			t.Helper()
+			reqCtx, cancelReq := context.WithCancel(ctx)
+			defer cancelReq()
+			req, err := http.NewRequest("GET", server.URL+"?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req.WithContext(reqCtx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status code %d for %s", resp.StatusCode, query)
+			}
+			var txids []bc.Hash
+			dec := json.NewDecoder(resp.Body)
+			for i := 0; i < 5; i++ {
+				var msg headerMsg
+				err := dec.Decode(&msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, bits := range msg.Txs {
+					tx, err := parseRawTx(bits)
+					if err != nil {
+						t.Fatal(err)
+					}
+					txids = append(txids, tx.ID)
+				}
+			}
+			return txids
+		}
+
+		if got := stream("pubkey=" + hex.EncodeToString(alice)); len(got) != 1 || got[0] != aliceImport.ID {
+			t.Errorf("got txs %x for alice's pubkey, want only her import", got)
+		}
+		if got := stream("kind=import"); len(got) != 2 || got[0] != aliceImport.ID || got[1] != bobImport.ID {
+			t.Errorf("got txs %x for imports, want both imports", got)
+		}
+		if got := stream("asset=" + hex.EncodeToString(bobImport.Issuances[0].AssetID.Bytes())); len(got) != 2 {
+			t.Errorf("got %d txs for the imported asset, want 2", len(got))
+		}
+		if got := stream(""); len(got) != 0 {
+			t.Errorf("got %d txs with no filter, want none", len(got))
+		}
+	})
+}
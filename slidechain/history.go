@@ -0,0 +1,223 @@
+package slidechain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// ImportRecord is one peg-in in a /accounts/{pubkey}/imports page.
+type ImportRecord struct {
+	NonceHash   string `json:"nonce_hash"`
+	State       string `json:"state"`
+	Asset       string `json:"asset,omitempty"` // empty until the deposit is seen
+	Amount      int64  `json:"amount,omitempty"`
+	DepositTxID string `json:"deposit_txid,omitempty"`
+	ImportTxID  string `json:"import_txid,omitempty"`
+	CreatedMS   int64  `json:"created_ms,omitempty"`
+}
+
+// ExportRecord is one export in a /accounts/{pubkey}/exports page.
+type ExportRecord struct {
+	ExportStatus
+	CreatedMS int64 `json:"created_ms,omitempty"`
+}
+
+// HistoryPage is the response of /accounts/{pubkey}/imports and /exports.
+// NextCursor, if present, is the cursor parameter for the next page.
+type HistoryPage struct {
+	Records    interface{} `json:"records"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// historyFilter is the WHERE clause of a history query,
+// built from the request's parameters, and its args.
+type historyFilter struct {
+	where []string
+	args  []interface{}
+}
+
+func (f *historyFilter) add(cond string, arg interface{}) {
+	f.args = append(f.args, arg)
+	f.where = append(f.where, fmt.Sprintf(cond, len(f.args)))
+}
+
+// AccountHistory is the handler for /accounts/{pubkey}/imports and /accounts/{pubkey}/exports,
+// serving the peg-ins to, or exports from, the hex txvm pubkey, newest first.
+// They may be filtered by the state parameter (a state name),
+// the asset parameter (native or CODE:ISSUER),
+// and the from_ms and to_ms parameters,
+// bounding when each was first recorded, from inclusive and to exclusive.
+// At most the limit parameter are served (default 50, at most 200),
+// with a cursor for the next page.
+// It passes /accounts/{pubkey}/balances and /outputs to accountView
+// and /accounts/{pubkey}/anchor to anchorLookup.
+func (c *Custodian) AccountHistory(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/accounts"), "/"), "/")
+	if len(parts) != 2 || (parts[1] != "imports" && parts[1] != "exports" && parts[1] != "balances" && parts[1] != "outputs" && parts[1] != "anchor") {
+		net.Errorf(w, http.StatusNotFound, "want /accounts/{pubkey}/ followed by imports, exports, balances, outputs, or anchor")
+		return
+	}
+	pubkey, err := hex.DecodeString(parts[0])
+	if err != nil || len(pubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "pubkey must be %d hex-encoded bytes", ed25519.PublicKeySize)
+		return
+	}
+	if parts[1] == "anchor" {
+		c.anchorLookup(w, req, pubkey)
+		return
+	}
+	if parts[1] == "balances" || parts[1] == "outputs" {
+		c.accountView(w, req, pubkey, parts[1])
+		return
+	}
+	imports := parts[1] == "imports"
+
+	var f historyFilter
+	if imports {
+		f.add("r.recipient_pubkey=$%d", pubkey)
+	} else {
+		f.add("r.pubkey=$%d", pubkey)
+	}
+	if s := req.FormValue("state"); s != "" {
+		names := pegOutStateNames
+		if imports {
+			names = pegInStateNames
+		}
+		state := -1
+		for i, name := range names {
+			if name == s {
+				state = i
+			}
+		}
+		if state < 0 {
+			net.Errorf(w, http.StatusBadRequest, "state must be one of %s", strings.Join(names, ", "))
+			return
+		}
+		if imports {
+			f.add("r.state=$%d", state)
+		} else {
+			f.add("r.pegged_out=$%d", state)
+		}
+	}
+	if s := req.FormValue("asset"); s != "" {
+		asset, err := stellar.ParseAssetKey(s)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		f.add("r.asset_xdr=$%d", assetXDR)
+	}
+	for _, p := range []struct{ param, cond string }{
+		{"from_ms", "e.time_ms >= $%d"},
+		{"to_ms", "e.time_ms < $%d"},
+		{"cursor", "r.rowid < $%d"},
+	} {
+		s := req.FormValue(p.param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s must be an integer", p.param)
+			return
+		}
+		f.add(p.cond, n)
+	}
+	limit := defaultHistoryLimit
+	if s := req.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			net.Errorf(w, http.StatusBadRequest, "limit must be between 1 and %d", maxHistoryLimit)
+			return
+		}
+	}
+	// One more than the limit tells whether there is a next page.
+	f.args = append(f.args, limit+1)
+	where := strings.Join(f.where, " AND ")
+
+	var (
+		page   HistoryPage
+		rowids []int64
+		ctx    = req.Context()
+	)
+	if imports {
+		q := `SELECT r.rowid, r.nonce_hash, r.state, COALESCE(r.asset_xdr, x''), COALESCE(r.amount, 0), COALESCE(r.deposit_txid, ''), COALESCE(r.import_txid, x''), COALESCE(e.time_ms, 0)
+			FROM pegs r LEFT JOIN state_events e ON e.kind='peg-in' AND e.key=r.nonce_hash AND e.from_state=''
+			WHERE ` + where + fmt.Sprintf(` ORDER BY r.rowid DESC LIMIT $%d`, len(f.args))
+		recs := []ImportRecord{}
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, append(f.args, func(rowid int64, nonceHash []byte, state pegInState, assetXDR []byte, amount int64, depositTxID string, importTxID []byte, createdMS int64) {
+			rowids = append(rowids, rowid)
+			r := ImportRecord{
+				NonceHash:   hex.EncodeToString(nonceHash),
+				State:       state.String(),
+				Amount:      amount,
+				DepositTxID: depositTxID,
+				ImportTxID:  hex.EncodeToString(importTxID),
+				CreatedMS:   createdMS,
+			}
+			if len(assetXDR) > 0 {
+				r.Asset = assetName(assetXDR)
+			}
+			recs = append(recs, r)
+		})...)
+		if len(recs) > limit {
+			recs = recs[:limit]
+		}
+		page.Records = recs
+	} else {
+		q := `SELECT r.rowid, r.txid, r.pegged_out, r.exporter, r.asset_xdr, r.amount, COALESCE(r.stellar_tx_hash, ''), COALESCE(r.ledger, 0), COALESCE(r.completed_ms, 0), COALESCE(e.time_ms, 0)
+			FROM exports r LEFT JOIN state_events e ON e.kind='export' AND e.key=r.txid AND e.from_state=''
+			WHERE ` + where + fmt.Sprintf(` ORDER BY r.rowid DESC LIMIT $%d`, len(f.args))
+		recs := []ExportRecord{}
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, append(f.args, func(rowid int64, txid []byte, state pegOutState, exporter string, assetXDR []byte, amount int64, txHash string, ledger int32, completedMS, createdMS int64) {
+			rowids = append(rowids, rowid)
+			recs = append(recs, ExportRecord{
+				ExportStatus: ExportStatus{
+					TxID:     hex.EncodeToString(txid),
+					State:    state.String(),
+					Exporter: exporter,
+					Asset:    assetName(assetXDR),
+					Amount:   amount,
+					PegOutReceipt: PegOutReceipt{
+						StellarTxHash: txHash,
+						Ledger:        ledger,
+						CompletedMS:   completedMS,
+					},
+				},
+				CreatedMS: createdMS,
+			})
+		})...)
+		if len(recs) > limit {
+			recs = recs[:limit]
+		}
+		page.Records = recs
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading %s: %s", parts[1], err)
+		return
+	}
+	if len(rowids) > limit {
+		page.NextCursor = strconv.FormatInt(rowids[limit-1], 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
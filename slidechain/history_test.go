@@ -0,0 +1,115 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestAccountHistory(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, now: func() time.Time { return now }}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey := bytes.Repeat([]byte{7}, 32)
+		other := bytes.Repeat([]byte{8}, 32)
+		for i, pk := range [][]byte{pubkey, pubkey, other, pubkey} {
+			txid := bytes.Repeat([]byte{byte(i + 1)}, 32)
+			err = c.insertExport(ctx, txid, &pegOut{
+				TxID:     txid,
+				AssetXDR: nativeXDR,
+				TempAddr: "temp",
+				Exporter: "exporter",
+				Amount:   int64(10 + i),
+				Anchor:   []byte{},
+				Pubkey:   pk,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Minute)
+		}
+		err = c.movePegOut(ctx, bytes.Repeat([]byte{1}, 32), pegOutNotYet, pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.insertPegIn(ctx, []byte("nonce"), pubkey, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// get serves path and, if it succeeds, decodes its records into recs.
+		get := func(path string, wantCode int, recs interface{}) (nextCursor string) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.AccountHistory(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d for %s, want %d: %s", w.Code, path, wantCode, w.Body)
+			}
+			if wantCode != http.StatusOK {
+				return ""
+			}
+			page := HistoryPage{Records: recs}
+			err := json.Unmarshal(w.Body.Bytes(), &page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return page.NextCursor
+		}
+		amounts := func(path string) ([]int64, string) {
+			t.Helper()
+			var recs []ExportRecord
+			cursor := get(path, http.StatusOK, &recs)
+			var got []int64
+			for _, r := range recs {
+				got = append(got, r.Amount)
+			}
+			return got, cursor
+		}
+		exports := "/accounts/" + hex.EncodeToString(pubkey) + "/exports"
+
+		got, cursor := amounts(exports + "?limit=2")
+		if fmt.Sprint(got) != "[13 11]" || cursor == "" {
+			t.Errorf("first page: got amounts %v and cursor %q, want [13 11] and a cursor", got, cursor)
+		}
+		got, cursor = amounts(exports + "?limit=2&cursor=" + cursor)
+		if fmt.Sprint(got) != "[10]" || cursor != "" {
+			t.Errorf("second page: got amounts %v and cursor %q, want [10] and none", got, cursor)
+		}
+		if got, _ := amounts(exports + "?state=ok"); fmt.Sprint(got) != "[10]" {
+			t.Errorf("ok exports: got amounts %v, want [10]", got)
+		}
+		from := now.Add(-2*time.Minute).UnixNano() / int64(time.Millisecond)
+		if got, _ := amounts(fmt.Sprintf("%s?from_ms=%d", exports, from)); fmt.Sprint(got) != "[13]" {
+			t.Errorf("exports from %d: got amounts %v, want [13]", from, got)
+		}
+		if got, _ := amounts(exports + "?asset=USD:GBSTRH4QOTWNSVA6E4HFERETX4ZLSR3CIUBLK7AXYII277PFJC4BBYOG"); len(got) != 0 {
+			t.Errorf("USD exports: got amounts %v, want none", got)
+		}
+		var imports []ImportRecord
+		get("/accounts/"+hex.EncodeToString(pubkey)+"/imports", http.StatusOK, &imports)
+		if len(imports) != 1 || imports[0].State != "recorded" {
+			t.Errorf("got imports %+v, want one recorded", imports)
+		}
+		get(exports+"?state=bogus", http.StatusBadRequest, nil)
+		get("/accounts/abcd/exports", http.StatusBadRequest, nil)
+		get("/accounts/"+hex.EncodeToString(pubkey)+"/payments", http.StatusNotFound, nil)
+	})
+}
@@ -0,0 +1,175 @@
+package horizonmock
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// Endpoint identifies a group of Horizon API routes
+// for fault injection.
+type Endpoint string
+
+// Endpoints served by Server.
+const (
+	EndpointAny          Endpoint = "" // matches every endpoint in Inject
+	EndpointRoot         Endpoint = "root"
+	EndpointFeeStats     Endpoint = "fee_stats"
+	EndpointFriendbot    Endpoint = "friendbot"
+	EndpointSubmit       Endpoint = "submit"       // POST /transactions
+	EndpointSubmitAsync  Endpoint = "submit_async" // POST /transactions_async
+	EndpointTransaction  Endpoint = "transaction"  // GET /transactions/{hash}
+	EndpointAccount      Endpoint = "account"      // GET /accounts/{addr}
+	EndpointTransactions Endpoint = "transactions" // GET /accounts/{addr}/transactions
+	EndpointPayments     Endpoint = "payments"     // GET /accounts/{addr}/payments
+	EndpointAssets       Endpoint = "assets"       // GET /assets
+	EndpointOperations   Endpoint = "operations"   // GET /transactions/{hash}/operations
+)
+
+// Fault is a kind of injected failure.
+type Fault int
+
+// Faults that can be injected.
+const (
+	// RateLimited responds with 429 Too Many Requests.
+	RateLimited Fault = iota + 1
+
+	// BadSeq rejects a submitted transaction with tx_bad_seq
+	// without applying it.
+	// It is injected at EndpointSubmit
+	// and applies to txs submitted to either submission endpoint
+	// (and to direct calls to Apply).
+	BadSeq
+
+	// Timeout responds with 504 Gateway Timeout,
+	// as Horizon does when a submitted transaction
+	// is not included in a ledger in time.
+	Timeout
+
+	// Hang holds the request open until the client gives up
+	// or the server is closed.
+	Hang
+
+	// ServerError responds with 500 Internal Server Error.
+	ServerError
+)
+
+type fault struct {
+	ep    Endpoint
+	kind  Fault
+	count int // remaining occurrences; negative means unlimited
+}
+
+// Inject arranges for the next count requests to ep to fail with f.
+// A count of zero or less makes the fault persist until ClearFaults.
+// Faults are consumed in the order they were injected.
+func (s *Server) Inject(ep Endpoint, f Fault, count int) {
+	if count <= 0 {
+		count = -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{ep: ep, kind: f, count: count})
+}
+
+// ClearFaults removes all pending injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// take finds and consumes the first pending fault
+// matching ep and, if kinds is non-empty, one of kinds,
+// returning its kind or zero if there is none.
+func (s *Server) take(ep Endpoint, kinds ...Fault) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if f.ep != EndpointAny && f.ep != ep {
+			continue
+		}
+		if len(kinds) > 0 && !containsFault(kinds, f.kind) {
+			continue
+		}
+		if f.count > 0 {
+			f.count--
+			if f.count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f.kind
+	}
+	return 0
+}
+
+func containsFault(kinds []Fault, k Fault) bool {
+	for _, kk := range kinds {
+		if kk == k {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFault writes the response for a pending fault on ep, if any,
+// and reports whether it did.
+// BadSeq faults are left for Apply.
+func (s *Server) injectFault(ep Endpoint, w http.ResponseWriter, req *http.Request) bool {
+	switch s.take(ep, RateLimited, Timeout, Hang, ServerError) {
+	case RateLimited:
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate Limit Exceeded", nil)
+	case Timeout:
+		writeProblem(w, http.StatusGatewayTimeout, "timeout", "Timeout", nil)
+	case Hang:
+		s.hang(req)
+		writeProblem(w, http.StatusGatewayTimeout, "timeout", "Timeout", nil)
+	case ServerError:
+		writeProblem(w, http.StatusInternalServerError, "server_error", "Internal Server Error", nil)
+	default:
+		return false
+	}
+	return true
+}
+
+// hang blocks until req's context is done or s is closed.
+func (s *Server) hang(req *http.Request) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			closed := s.ledger < 0
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+		}
+	}
+}
+
+// IsFault reports whether err is a Horizon error
+// with the HTTP status that f produces.
+func IsFault(err error, f Fault) bool {
+	herr, ok := err.(*stellar.HorizonError)
+	if !ok {
+		return false
+	}
+	switch f {
+	case RateLimited:
+		return herr.Problem.Status == http.StatusTooManyRequests
+	case Timeout, Hang:
+		return herr.Problem.Status == http.StatusGatewayTimeout
+	case ServerError:
+		return herr.Problem.Status == http.StatusInternalServerError
+	case BadSeq:
+		codes, err := herr.ResultCodes()
+		return err == nil && codes.TransactionCode == "tx_bad_seq"
+	}
+	return false
+}
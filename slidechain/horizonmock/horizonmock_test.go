@@ -0,0 +1,195 @@
+package horizonmock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestPaymentStream(t *testing.T) {
+	s := New()
+	defer s.Close()
+	hclient := s.Client()
+
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Fund(from.Address(), FriendbotAmount)
+	s.Fund(to.Address(), FriendbotAmount)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	got := make(chan stellar.Operation, 1)
+	go hclient.StreamPayments(ctx, to.Address(), nil, func(p stellar.Operation) {
+		got <- p
+	})
+
+	submit := func() error {
+		seqnum, err := hclient.SequenceForAccount(from.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := &stellar.Tx{
+			Network: s.Passphrase,
+			Source:  from.Address(),
+			SeqNum:  seqnum + 1,
+			Ops:     []stellar.Op{stellar.Payment{Destination: to.Address(), Amount: 10 * 10000000}},
+		}
+		envXDR, err := tx.Sign(from.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = hclient.SubmitTransaction(envXDR)
+		return err
+	}
+
+	s.Inject(EndpointSubmit, BadSeq, 1)
+	if err := submit(); !IsFault(err, BadSeq) {
+		t.Fatalf("got error %v, want tx_bad_seq", err)
+	}
+	s.Inject(EndpointSubmit, RateLimited, 1)
+	if err := submit(); !IsFault(err, RateLimited) {
+		t.Fatalf("got error %v, want rate limit", err)
+	}
+	if err := submit(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-got:
+		if p.From != from.Address() || p.Amount != "10.0000000" || p.AssetType != "native" {
+			t.Errorf("got payment %+v", p)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for payment")
+	}
+
+	bal, _ := s.Balance(to.Address(), stellar.NativeAsset())
+	if want := int64(FriendbotAmount + 10*10000000); bal != want {
+		t.Errorf("got balance %d, want %d", bal, want)
+	}
+	bal, _ = s.Balance(from.Address(), stellar.NativeAsset())
+	if want := int64(FriendbotAmount - 10*10000000 - 100); bal != want {
+		t.Errorf("got sender balance %d, want %d", bal, want)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	s := New()
+	defer s.Close()
+	now := time.Unix(1500000000, 0)
+	s.Now = func() time.Time { return now }
+
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Fund(from.Address(), FriendbotAmount)
+	seqnum, err := s.Client().SequenceForAccount(from.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	minSeq, highSeq := seqnum, seqnum+10
+	apply := func(tx *stellar.Tx) string {
+		t.Helper()
+		tx.Network = s.Passphrase
+		tx.Source = from.Address()
+		tx.Ops = []stellar.Op{stellar.BumpSequence{}}
+		env, err := tx.Sign(from.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, codes := s.Apply(env); codes != nil {
+			return codes.TransactionCode
+		}
+		return ""
+	}
+	cases := []struct {
+		name string
+		tx   *stellar.Tx
+		want string
+	}{
+		{"early", &stellar.Tx{SeqNum: seqnum + 1, LedgerBounds: &stellar.LedgerBounds{MinLedger: 100}}, "tx_too_early"},
+		{"late", &stellar.Tx{SeqNum: seqnum + 1, LedgerBounds: &stellar.LedgerBounds{MaxLedger: 1}}, "tx_too_late"},
+		{"in bounds", &stellar.Tx{SeqNum: seqnum + 1, LedgerBounds: &stellar.LedgerBounds{MinLedger: 1, MaxLedger: 100}}, ""},
+		{"young", &stellar.Tx{SeqNum: seqnum + 2, MinSeqAge: 60}, "tx_bad_minseq_age_or_gap"},
+		{"gap", &stellar.Tx{SeqNum: seqnum + 2, MinSeqLedgerGap: 5}, "tx_bad_minseq_age_or_gap"},
+		{"skip", &stellar.Tx{SeqNum: seqnum + 3}, "tx_bad_seq"},
+		{"min seq", &stellar.Tx{SeqNum: seqnum + 3, MinSeqNum: &minSeq}, ""},
+		{"below min seq", &stellar.Tx{SeqNum: seqnum + 4, MinSeqNum: &highSeq}, "tx_bad_seq"},
+	}
+	for _, c := range cases {
+		if got := apply(c.tx); got != c.want {
+			t.Errorf("%s: got result %q, want %q", c.name, got, c.want)
+		}
+	}
+	now = now.Add(time.Minute)
+	if got := apply(&stellar.Tx{SeqNum: seqnum + 4, MinSeqAge: 60}); got != "" {
+		t.Errorf("aged: got result %q, want success", got)
+	}
+}
+
+func TestFeeBump(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Fund(from.Address(), FriendbotAmount)
+	s.Fund(payer.Address(), FriendbotAmount)
+	seqnum, err := s.Client().SequenceForAccount(from.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &stellar.Tx{
+		Network: s.Passphrase,
+		Source:  from.Address(),
+		SeqNum:  seqnum + 1,
+		Ops:     []stellar.Op{stellar.BumpSequence{}},
+	}
+	innerEnv, err := inner.Sign(from.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := stellar.DecodeTx(innerEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.Network = s.Passphrase
+	fb := &stellar.FeeBump{FeeSource: payer.Address(), BaseFee: 1000, Inner: signed}
+	env, err := fb.Sign(payer.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Client().SubmitTransaction(env); err != nil {
+		t.Fatal(err)
+	}
+
+	if bal, _ := s.Balance(from.Address(), stellar.NativeAsset()); bal != FriendbotAmount {
+		t.Errorf("got source balance %d, want %d", bal, int64(FriendbotAmount))
+	}
+	if bal, _ := s.Balance(payer.Address(), stellar.NativeAsset()); bal != FriendbotAmount-2000 {
+		t.Errorf("got fee source balance %d, want %d", bal, int64(FriendbotAmount-2000))
+	}
+	innerHash, err := stellar.TxHash(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Client().LoadTransaction(innerHash); err != nil {
+		t.Errorf("loading fee bump by its inner hash: %s", err)
+	}
+}
@@ -0,0 +1,921 @@
+package horizonmock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+const nativeKey = "native"
+
+type account struct {
+	seq       int64
+	seqTime   int64 // the Unix time and ledger at which seq last changed
+	seqLedger int32
+	balances  map[string]int64 // keyed by assetKey; presence of a credit key means a trustline
+	data      map[string][]byte
+
+	authRequired  bool // as an issuer, AUTH_REQUIRED
+	authRevocable bool
+	clawback      bool            // AUTH_CLAWBACK_ENABLED
+	unauthorized  map[string]bool // trustlines not authorized by their issuers, by assetKey
+
+	// Signers and thresholds are recorded but not enforced.
+	masterWeight int32
+	signers      map[string]int32 // other than the master key, by address
+	thresholds   [3]byte          // low, medium, high
+}
+
+func (a *account) clone() *account {
+	b := &account{
+		seq:       a.seq,
+		seqTime:   a.seqTime,
+		seqLedger: a.seqLedger,
+		balances:  make(map[string]int64, len(a.balances)),
+		data:      make(map[string][]byte, len(a.data)),
+
+		authRequired:  a.authRequired,
+		authRevocable: a.authRevocable,
+		clawback:      a.clawback,
+		unauthorized:  make(map[string]bool, len(a.unauthorized)),
+
+		masterWeight: a.masterWeight,
+		signers:      make(map[string]int32, len(a.signers)),
+		thresholds:   a.thresholds,
+	}
+	for k, v := range a.signers {
+		b.signers[k] = v
+	}
+	for k, v := range a.balances {
+		b.balances[k] = v
+	}
+	for k, v := range a.unauthorized {
+		b.unauthorized[k] = v
+	}
+	for k, v := range a.data {
+		b.data[k] = v
+	}
+	return b
+}
+
+func (a *account) resource(addr string) stellar.Account {
+	var res stellar.Account
+	res.ID = addr
+	res.AccountID = addr
+	res.PT = addr
+	res.Sequence = strconv.FormatInt(a.seq, 10)
+	res.Signers = []stellar.Signer{{PublicKey: addr, Key: addr, Weight: a.masterWeight, Type: "ed25519_public_key"}}
+	for k, w := range a.signers {
+		res.Signers = append(res.Signers, stellar.Signer{PublicKey: k, Key: k, Weight: w, Type: "ed25519_public_key"})
+	}
+	res.Thresholds = stellar.AccountThresholds{LowThreshold: a.thresholds[0], MedThreshold: a.thresholds[1], HighThreshold: a.thresholds[2]}
+	res.Flags = stellar.IssuerFlags{AuthRequired: a.authRequired, AuthRevocable: a.authRevocable, Clawback: a.clawback}
+	for k, v := range a.balances {
+		var bal stellar.Balance
+		bal.Balance = formatAmount(v)
+		bal.AssetType, bal.AssetCode, bal.AssetIssuer = assetResource(k)
+		if k != nativeKey {
+			authorized := !a.unauthorized[k]
+			bal.IsAuthorized = &authorized
+		}
+		res.Balances = append(res.Balances, bal)
+	}
+	res.Data = make(map[string]string)
+	for k, v := range a.data {
+		res.Data[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return res
+}
+
+type txRecord struct {
+	stellar.Transaction
+	innerHash    string // the hash of the inner tx of a fee bump
+	paging       int64
+	payments     []payment
+	operations   []interface{} // the Horizon records of its ops, in order
+	participants map[string]bool
+}
+
+// payment is the Horizon record of a payment-like op:
+// a create_account, payment, or account_merge.
+type payment struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	PagingToken     string `json:"paging_token"`
+	SourceAccount   string `json:"source_account"`
+	TransactionHash string `json:"transaction_hash"`
+
+	// create_account and account_merge field
+	Account string `json:"account,omitempty"`
+
+	// create_account fields
+	Funder          string `json:"funder,omitempty"`
+	StartingBalance string `json:"starting_balance,omitempty"`
+
+	// account_merge field
+	Into string `json:"into,omitempty"`
+
+	// payment fields, and the amount of an account_merge.
+	// From and To are base accounts;
+	// a muxed recipient is also given by its M-address.
+	From        string `json:"from,omitempty"`
+	To          string `json:"to,omitempty"`
+	ToMuxed     string `json:"to_muxed,omitempty"`
+	AssetType   string `json:"asset_type,omitempty"`
+	AssetCode   string `json:"asset_code,omitempty"`
+	AssetIssuer string `json:"asset_issuer,omitempty"`
+	Amount      string `json:"amount,omitempty"`
+}
+
+// operation is the Horizon record of an op that is not payment-like,
+// with the fields of those types slidechain reads.
+type operation struct {
+	ID              string `json:"id"`
+	PagingToken     string `json:"paging_token"`
+	SourceAccount   string `json:"source_account"`
+	Type            string `json:"type"`
+	TransactionHash string `json:"transaction_hash"`
+
+	// change_trust fields
+	AssetType   string `json:"asset_type,omitempty"`
+	AssetCode   string `json:"asset_code,omitempty"`
+	AssetIssuer string `json:"asset_issuer,omitempty"`
+	Limit       string `json:"limit,omitempty"`
+	Trustor     string `json:"trustor,omitempty"`
+
+	// set_options fields
+	SignerKey       string `json:"signer_key,omitempty"`
+	SignerWeight    *int   `json:"signer_weight,omitempty"`
+	MasterKeyWeight *int   `json:"master_key_weight,omitempty"`
+	LowThreshold    *int   `json:"low_threshold,omitempty"`
+	MedThreshold    *int   `json:"med_threshold,omitempty"`
+	HighThreshold   *int   `json:"high_threshold,omitempty"`
+}
+
+var opTypes = map[xdr.OperationType]string{
+	xdr.OperationTypeCreateAccount:            "create_account",
+	xdr.OperationTypePayment:                  "payment",
+	xdr.OperationTypePathPaymentStrictReceive: "path_payment_strict_receive",
+	xdr.OperationTypeManageSellOffer:          "manage_sell_offer",
+	xdr.OperationTypeCreatePassiveSellOffer:   "create_passive_sell_offer",
+	xdr.OperationTypeSetOptions:               "set_options",
+	xdr.OperationTypeChangeTrust:              "change_trust",
+	xdr.OperationTypeAllowTrust:               "allow_trust",
+	xdr.OperationTypeAccountMerge:             "account_merge",
+	xdr.OperationTypeInflation:                "inflation",
+	xdr.OperationTypeManageData:               "manage_data",
+	xdr.OperationTypeBumpSequence:             "bump_sequence",
+	xdr.OperationTypeManageBuyOffer:           "manage_buy_offer",
+	xdr.OperationTypePathPaymentStrictSend:    "path_payment_strict_send",
+}
+
+// opRecord is the Horizon record of an op from source
+// that is not payment-like.
+func opRecord(source string, body xdr.OperationBody) operation {
+	op := operation{SourceAccount: source, Type: opTypes[body.Type]}
+	weight := func(w *xdr.Uint32) *int {
+		if w == nil {
+			return nil
+		}
+		n := int(*w)
+		return &n
+	}
+	switch body.Type {
+	case xdr.OperationTypeChangeTrust:
+		trust := body.MustChangeTrustOp()
+		op.AssetType, op.AssetCode, op.AssetIssuer = assetResource(assetKey(trust.Line.ToAsset()))
+		op.Limit = formatAmount(int64(trust.Limit))
+		op.Trustor = source
+	case xdr.OperationTypeSetOptions:
+		opts := body.MustSetOptionsOp()
+		if opts.Signer != nil {
+			op.SignerKey = opts.Signer.Key.Address()
+			op.SignerWeight = weight(&opts.Signer.Weight)
+		}
+		op.MasterKeyWeight = weight(opts.MasterWeight)
+		op.LowThreshold = weight(opts.LowThreshold)
+		op.MedThreshold = weight(opts.MedThreshold)
+		op.HighThreshold = weight(opts.HighThreshold)
+	}
+	return op
+}
+
+// futureEnvelopeType begins the envelopes of FutureEnvelope.
+// No envelope type of the XDR has it.
+var futureEnvelopeType = []byte{0x7f, 0xff, 0xff, 0xff}
+
+// FutureEnvelope returns the base64 envelope envXDR
+// under an envelope type that the vendored xdr package does not know,
+// as a tx of a later protocol would be,
+// so that tests can check how such txs are handled
+// by code that can only read their Horizon records.
+// The server applies it as envXDR,
+// and records it in the form given.
+func FutureEnvelope(envXDR string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(envXDR)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(append(append([]byte{}, futureEnvelopeType...), raw...)), nil
+}
+
+// decodeEnvelope decodes a base64 envelope,
+// including one from FutureEnvelope.
+func decodeEnvelope(envXDR string) (xdr.TransactionEnvelope, error) {
+	var env xdr.TransactionEnvelope
+	raw, err := base64.StdEncoding.DecodeString(envXDR)
+	if err != nil {
+		return env, err
+	}
+	raw = bytes.TrimPrefix(raw, futureEnvelopeType)
+	err = env.UnmarshalBinary(raw)
+	return env, err
+}
+
+// invokeHostFunction is the Horizon record of an invoke_host_function operation,
+// with the fields slidechain reads.
+type invokeHostFunction struct {
+	ID                  string               `json:"id"`
+	PagingToken         string               `json:"paging_token"`
+	SourceAccount       string               `json:"source_account"`
+	Type                string               `json:"type"`
+	TransactionHash     string               `json:"transaction_hash"`
+	Function            string               `json:"function"`
+	AssetBalanceChanges []assetBalanceChange `json:"asset_balance_changes"`
+}
+
+type assetBalanceChange struct {
+	AssetType   string `json:"asset_type"`
+	AssetCode   string `json:"asset_code,omitempty"`
+	AssetIssuer string `json:"asset_issuer,omitempty"`
+	Type        string `json:"type"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      string `json:"amount"`
+}
+
+func (tx *txRecord) records(addr string, payments bool, cursor int64) []interface{} {
+	if !tx.participants[addr] {
+		return nil
+	}
+	if !payments {
+		if tx.paging <= cursor {
+			return nil
+		}
+		return []interface{}{tx.Transaction}
+	}
+	var out []interface{}
+	for _, p := range tx.payments {
+		pt, _ := strconv.ParseInt(p.PagingToken, 10, 64)
+		if pt > cursor && (p.From == addr || p.To == addr || p.Account == addr || p.Funder == addr || p.Into == addr) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Fund creates (or tops up) the account addr with the given number of stroops.
+func (s *Server) Fund(addr string, stroops int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.accounts[addr]; ok {
+		a.balances[nativeKey] += stroops
+		return
+	}
+	s.createAccount(addr, stroops)
+}
+
+// Clawback burns amount stroops of the credit asset held by addr,
+// as a clawback operation by its issuer would.
+// The stellar package does not build that operation,
+// so tests call this instead.
+// It reports an error if the issuer has not enabled clawback
+// or addr holds less than amount.
+func (s *Server) Clawback(addr string, asset stellar.Asset, amount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	iss, ok := s.accounts[asset.Issuer]
+	if !ok || !iss.clawback {
+		return errors.New("issuer has not enabled clawback")
+	}
+	key := stellarAssetKey(asset)
+	a, ok := s.accounts[addr]
+	if !ok || a.balances[key] < amount {
+		return errors.New("balance less than clawback amount")
+	}
+	a.balances[key] -= amount
+	return nil
+}
+
+// ContractTransfer moves amount stroops of asset from from to to
+// in a new ledger,
+// as a Soroban tx from source with the given hash memo
+// calling the transfer function of the asset's contract would.
+// A from that is not an account, such as a C... contract address,
+// is not debited.
+// The stellar package does not build Soroban txs,
+// so tests call this instead.
+// The tx has no envelope XDR:
+// its transfer is reported only in the asset_balance_changes
+// of its operation.
+func (s *Server) ContractTransfer(source, from, to string, asset stellar.Asset, amount int64, memo [32]byte) (stellar.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := stellarAssetKey(asset)
+	dest, ok := s.accounts[to]
+	if !ok {
+		return stellar.Transaction{}, errors.New("no destination account")
+	}
+	if _, ok := dest.balances[key]; !ok {
+		return stellar.Transaction{}, errors.New("destination does not trust the asset")
+	}
+	if a, ok := s.accounts[from]; ok {
+		if a.balances[key] < amount {
+			return stellar.Transaction{}, errors.New("balance less than transfer amount")
+		}
+		a.balances[key] -= amount
+	}
+	dest.balances[key] += amount
+
+	s.ledger++
+	rec := &txRecord{
+		paging:       int64(s.ledger)<<32 | 1<<12,
+		participants: map[string]bool{source: true, from: true, to: true},
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("contract transfer %d %s %s %s %d", s.ledger, from, to, key, amount)))
+	rec.ID = hex.EncodeToString(hash[:])
+	rec.Hash = rec.ID
+	rec.PT = strconv.FormatInt(rec.paging, 10)
+	rec.Ledger = s.ledger
+	rec.LedgerCloseTime = s.now()
+	rec.Account = source
+	rec.OperationCount = 1
+	rec.MemoType, rec.Memo = "hash", base64.StdEncoding.EncodeToString(memo[:])
+	change := assetBalanceChange{
+		Type:   "transfer",
+		From:   from,
+		To:     to,
+		Amount: formatAmount(amount),
+	}
+	change.AssetType, change.AssetCode, change.AssetIssuer = assetResource(key)
+	id := strconv.FormatInt(rec.paging+1, 10)
+	rec.operations = []interface{}{invokeHostFunction{
+		ID:                  id,
+		PagingToken:         id,
+		SourceAccount:       source,
+		Type:                "invoke_host_function",
+		TransactionHash:     rec.Hash,
+		Function:            "HostFunctionTypeHostFunctionTypeInvokeContract",
+		AssetBalanceChanges: []assetBalanceChange{change},
+	}}
+	s.txs = append(s.txs, rec)
+	s.changed.Broadcast()
+	return rec.Transaction, nil
+}
+
+// supply is the total held of the credit asset with the given key
+// in authorized and unauthorized trustlines.
+func (s *Server) supply(key string) (authorized, unauthorized int64, holders int) {
+	for _, a := range s.accounts {
+		bal, ok := a.balances[key]
+		if !ok {
+			continue
+		}
+		if a.unauthorized[key] {
+			unauthorized += bal
+		} else {
+			authorized += bal
+		}
+		holders++
+	}
+	return authorized, unauthorized, holders
+}
+
+// Balance returns the balance in stroops of the given asset held by addr,
+// and whether the account exists and holds (or trusts) the asset.
+func (s *Server) Balance(addr string, asset stellar.Asset) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[addr]
+	if !ok {
+		return 0, false
+	}
+	bal, ok := a.balances[stellarAssetKey(asset)]
+	return bal, ok
+}
+
+// Transactions returns all transactions applied so far, in order.
+func (s *Server) Transactions() []stellar.Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []stellar.Transaction
+	for _, tx := range s.txs {
+		out = append(out, tx.Transaction)
+	}
+	return out
+}
+
+// AccountTransactions returns the transactions involving addr
+// after the given paging token, in order,
+// as the account's transaction stream would deliver them.
+func (s *Server) AccountTransactions(addr, cursor string) []stellar.Transaction {
+	pt, _ := strconv.ParseInt(cursor, 10, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []stellar.Transaction
+	for _, tx := range s.txs {
+		for _, r := range tx.records(addr, false, pt) {
+			out = append(out, r.(stellar.Transaction))
+		}
+	}
+	return out
+}
+
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// createAccount must be called with s.mu held.
+func (s *Server) createAccount(addr string, stroops int64) {
+	s.accounts[addr] = &account{
+		seq:       int64(s.ledger) << 32,
+		seqTime:   s.now().Unix(),
+		seqLedger: s.ledger,
+		balances:  map[string]int64{nativeKey: stroops},
+		data:      make(map[string][]byte),
+
+		unauthorized: make(map[string]bool),
+		masterWeight: 1,
+		signers:      make(map[string]int32),
+	}
+}
+
+// Apply applies the tx with the base64 envelope envXDR
+// to the ledger as if submitted,
+// closing a new ledger containing it.
+// Its preconditions are enforced, and the fee of a fee bump is charged
+// to the fee source, but signatures are not checked.
+// A tx is recorded by its hash;
+// that of a fee bump's inner tx also finds it.
+// On failure it returns the Horizon result codes;
+// as on the real network, a tx_failed transaction
+// still consumes its sequence number and fee.
+func (s *Server) Apply(envXDR string) (*stellar.Transaction, *stellar.TransactionResultCodes) {
+	env, err := decodeEnvelope(envXDR)
+	if err != nil {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_malformed"}
+	}
+	rec, codes := s.apply(env, envXDR)
+	if codes != nil {
+		return nil, codes
+	}
+	return &rec.Transaction, nil
+}
+
+// apply is Apply for the decoded envelope env.
+func (s *Server) apply(env xdr.TransactionEnvelope, envXDR string) (*txRecord, *stellar.TransactionResultCodes) {
+	if s.take(EndpointSubmit, BadSeq) != 0 {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_bad_seq"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().Unix()
+	if tb := env.TimeBounds(); tb != nil {
+		if now < int64(tb.MinTime) {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_too_early"}
+		}
+		if tb.MaxTime != 0 && now > int64(tb.MaxTime) {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_too_late"}
+		}
+	}
+	// The tx would be in the next ledger.
+	if lb := env.LedgerBounds(); lb != nil {
+		if s.ledger+1 < int32(lb.MinLedger) {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_too_early"}
+		}
+		if lb.MaxLedger != 0 && s.ledger+1 >= int32(lb.MaxLedger) {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_too_late"}
+		}
+	}
+	source := env.SourceAccount().ToAccountId().Address()
+	src, ok := s.accounts[source]
+	if !ok {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_no_account"}
+	}
+	seq := env.SeqNum()
+	if min := env.MinSeqNum(); min != nil {
+		if src.seq < int64(*min) || src.seq >= seq {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_bad_seq"}
+		}
+	} else if seq != src.seq+1 {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_bad_seq"}
+	}
+	if age := env.MinSeqAge(); age != nil && now < src.seqTime+int64(*age) {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_bad_minseq_age_or_gap"}
+	}
+	if gap := env.MinSeqLedgerGap(); gap != nil && s.ledger+1 < src.seqLedger+int32(*gap) {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_bad_minseq_age_or_gap"}
+	}
+	payer, fee := src, envelopeFee(env)
+	if env.IsFeeBump() {
+		payer, ok = s.accounts[env.FeeBumpAccount().ToAccountId().Address()]
+		if !ok {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_no_account"}
+		}
+	}
+	if payer.balances[nativeKey] < fee {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_insufficient_balance"}
+	}
+	hash, err := network.HashTransactionInEnvelope(env, s.Passphrase)
+	if err != nil {
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_internal_error"}
+	}
+	txHash := hex.EncodeToString(hash[:])
+	var innerHash string
+	if env.IsFeeBump() {
+		inner := xdr.TransactionEnvelope{Type: xdr.EnvelopeTypeEnvelopeTypeTx, V1: env.FeeBump.Tx.InnerTx.V1}
+		hash, err := network.HashTransactionInEnvelope(inner, s.Passphrase)
+		if err != nil {
+			return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_internal_error"}
+		}
+		innerHash = hex.EncodeToString(hash[:])
+	}
+	src.seq = seq
+	src.seqTime, src.seqLedger = now, s.ledger+1
+	payer.balances[nativeKey] -= fee
+
+	// Apply operations to a copy of the affected accounts,
+	// committing only if all succeed.
+	staged := make(map[string]*account)
+	get := func(addr string) *account {
+		if a, ok := staged[addr]; ok {
+			return a
+		}
+		a, ok := s.accounts[addr]
+		if !ok {
+			return nil
+		}
+		a = a.clone()
+		staged[addr] = a
+		return a
+	}
+
+	s.ledger++
+	rec := &txRecord{
+		// Horizon's paging tokens are TOIDs:
+		// the ledger, then the tx's order in it (from 1),
+		// then the operation's (from 1, or 0 for the tx itself).
+		paging:       int64(s.ledger)<<32 | 1<<12,
+		participants: map[string]bool{source: true},
+	}
+	var (
+		opCodes []string
+		failed  bool
+	)
+	for i, op := range env.Operations() {
+		opSource := source
+		if op.SourceAccount != nil {
+			opSource = op.SourceAccount.ToAccountId().Address()
+		}
+		rec.participants[opSource] = true
+		code, payment := s.applyOp(opSource, op.Body, get, staged)
+		opCodes = append(opCodes, code)
+		if code != "op_success" {
+			failed = true
+			continue
+		}
+		id := strconv.FormatInt(rec.paging+int64(i)+1, 10)
+		if payment == nil {
+			op := opRecord(opSource, op.Body)
+			op.ID, op.PagingToken, op.TransactionHash = id, id, txHash
+			rec.operations = append(rec.operations, op)
+			continue
+		}
+		payment.ID = id
+		payment.PagingToken = payment.ID
+		payment.SourceAccount = opSource
+		payment.TransactionHash = txHash
+		for _, p := range []string{payment.From, payment.To, payment.Account, payment.Funder, payment.Into} {
+			if p != "" {
+				rec.participants[p] = true
+			}
+		}
+		rec.payments = append(rec.payments, *payment)
+		rec.operations = append(rec.operations, *payment)
+	}
+	if failed {
+		s.ledger--
+		return nil, &stellar.TransactionResultCodes{TransactionCode: "tx_failed", OperationCodes: opCodes}
+	}
+	for addr, a := range staged {
+		if a.seq < 0 {
+			delete(s.accounts, addr)
+			continue
+		}
+		s.accounts[addr] = a
+	}
+
+	result := xdr.TransactionResult{
+		FeeCharged: xdr.Int64(fee),
+		Result: xdr.TransactionResultResult{
+			Code:    xdr.TransactionResultCodeTxSuccess,
+			Results: &[]xdr.OperationResult{},
+		},
+	}
+	resultXDR, _ := xdr.MarshalBase64(result)
+
+	rec.ID = txHash
+	rec.Hash = rec.ID
+	rec.innerHash = innerHash
+	rec.PT = strconv.FormatInt(rec.paging, 10)
+	rec.Ledger = s.ledger
+	rec.LedgerCloseTime = s.now()
+	rec.Account = source
+	rec.AccountSequence = strconv.FormatInt(seq, 10)
+	rec.FeePaid = int32(fee)
+	rec.OperationCount = int32(len(env.Operations()))
+	rec.EnvelopeXdr = envXDR
+	rec.ResultXdr = resultXDR
+	rec.MemoType, rec.Memo = memoFields(env.Memo())
+	s.txs = append(s.txs, rec)
+	s.changed.Broadcast()
+	return rec, nil
+}
+
+// applyOp applies one operation to staged accounts,
+// returning a Horizon operation result code
+// and, for payment-like operations, the payment record.
+func (s *Server) applyOp(source string, body xdr.OperationBody, get func(string) *account, staged map[string]*account) (string, *payment) {
+	src := get(source)
+	if src == nil {
+		return "op_no_source_account", nil
+	}
+	switch body.Type {
+	case xdr.OperationTypeCreateAccount:
+		op := body.MustCreateAccountOp()
+		dest := op.Destination.Address()
+		if get(dest) != nil {
+			return "op_already_exists", nil
+		}
+		if src.balances[nativeKey] < int64(op.StartingBalance) {
+			return "op_underfunded", nil
+		}
+		src.balances[nativeKey] -= int64(op.StartingBalance)
+		staged[dest] = &account{
+			seq:       int64(s.ledger) << 32,
+			seqTime:   s.now().Unix(),
+			seqLedger: s.ledger,
+			balances:  map[string]int64{nativeKey: int64(op.StartingBalance)},
+			data:      make(map[string][]byte),
+
+			unauthorized: make(map[string]bool),
+			masterWeight: 1,
+			signers:      make(map[string]int32),
+		}
+		p := &payment{
+			Type:            "create_account",
+			Account:         dest,
+			Funder:          source,
+			StartingBalance: formatAmount(int64(op.StartingBalance)),
+		}
+		return "op_success", p
+
+	case xdr.OperationTypePayment:
+		op := body.MustPaymentOp()
+		dest := op.Destination.ToAccountId().Address()
+		dst := get(dest)
+		if dst == nil {
+			return "op_no_destination", nil
+		}
+		key := assetKey(op.Asset)
+		issuer := assetIssuer(op.Asset)
+		amt := int64(op.Amount)
+		if source != issuer {
+			bal, ok := src.balances[key]
+			if !ok {
+				return "op_src_no_trust", nil
+			}
+			if bal < amt {
+				return "op_underfunded", nil
+			}
+		}
+		if dest != issuer {
+			if _, ok := dst.balances[key]; !ok {
+				return "op_no_trust", nil
+			}
+			if dst.unauthorized[key] {
+				return "op_not_authorized", nil
+			}
+		}
+		if source != issuer && src.unauthorized[key] {
+			return "op_src_not_authorized", nil
+		}
+		if source != issuer {
+			src.balances[key] -= amt
+		}
+		if dest != issuer {
+			dst.balances[key] += amt
+		}
+		p := &payment{
+			Type:   "payment",
+			From:   source,
+			To:     dest,
+			Amount: formatAmount(amt),
+		}
+		if op.Destination.Type == xdr.CryptoKeyTypeKeyTypeMuxedEd25519 {
+			p.ToMuxed = op.Destination.Address()
+		}
+		p.AssetType, p.AssetCode, p.AssetIssuer = assetResource(key)
+		return "op_success", p
+
+	case xdr.OperationTypeAccountMerge:
+		destID := body.MustDestination()
+		dest := destID.ToAccountId().Address()
+		dst := get(dest)
+		if dst == nil {
+			return "op_no_account", nil
+		}
+		for k, v := range src.balances {
+			if k != nativeKey && v != 0 {
+				return "op_has_sub_entries", nil
+			}
+		}
+		amt := src.balances[nativeKey]
+		dst.balances[nativeKey] += amt
+		src.seq = -1 // marks the account for deletion
+		p := &payment{
+			Type:    "account_merge",
+			Account: source,
+			Into:    dest,
+			Amount:  formatAmount(amt),
+		}
+		return "op_success", p
+
+	case xdr.OperationTypeChangeTrust:
+		op := body.MustChangeTrustOp()
+		key := assetKey(op.Line.ToAsset())
+		if op.Limit == 0 {
+			if src.balances[key] != 0 {
+				return "op_invalid_limit", nil
+			}
+			delete(src.balances, key)
+			delete(src.unauthorized, key)
+		} else if _, ok := src.balances[key]; !ok {
+			src.balances[key] = 0
+			if iss := get(assetIssuer(op.Line.ToAsset())); iss != nil && iss.authRequired {
+				src.unauthorized[key] = true
+			}
+		}
+		return "op_success", nil
+
+	case xdr.OperationTypeAllowTrust:
+		op := body.MustAllowTrustOp()
+		var issuer xdr.AccountId
+		if err := issuer.SetAddress(source); err != nil {
+			return "op_malformed", nil
+		}
+		key := assetKey(op.Asset.ToAsset(issuer))
+		trustor := get(op.Trustor.Address())
+		if trustor == nil {
+			return "op_no_trust_line", nil
+		}
+		if _, ok := trustor.balances[key]; !ok {
+			return "op_no_trust_line", nil
+		}
+		if !src.authRequired {
+			return "op_trust_not_required", nil
+		}
+		if op.Authorize&xdr.Uint32(xdr.TrustLineFlagsAuthorizedFlag) != 0 {
+			delete(trustor.unauthorized, key)
+		} else {
+			trustor.unauthorized[key] = true
+		}
+		return "op_success", nil
+
+	case xdr.OperationTypeManageData:
+		op := body.MustManageDataOp()
+		if op.DataValue == nil {
+			delete(src.data, string(op.DataName))
+		} else {
+			src.data[string(op.DataName)] = []byte(*op.DataValue)
+		}
+		return "op_success", nil
+
+	case xdr.OperationTypeSetOptions:
+		op := body.MustSetOptionsOp()
+		for _, f := range []struct {
+			flag xdr.Uint32
+			dst  *bool
+		}{
+			{xdr.Uint32(xdr.AccountFlagsAuthRequiredFlag), &src.authRequired},
+			{xdr.Uint32(xdr.AccountFlagsAuthRevocableFlag), &src.authRevocable},
+			{xdr.Uint32(xdr.AccountFlagsAuthClawbackEnabledFlag), &src.clawback},
+		} {
+			if op.SetFlags != nil && *op.SetFlags&f.flag != 0 {
+				*f.dst = true
+			}
+			if op.ClearFlags != nil && *op.ClearFlags&f.flag != 0 {
+				*f.dst = false
+			}
+		}
+		if src.clawback && !src.authRevocable {
+			return "op_auth_revocable_required", nil
+		}
+		if op.MasterWeight != nil {
+			src.masterWeight = int32(*op.MasterWeight)
+		}
+		for i, t := range []*xdr.Uint32{op.LowThreshold, op.MedThreshold, op.HighThreshold} {
+			if t != nil {
+				src.thresholds[i] = byte(*t)
+			}
+		}
+		if op.Signer != nil {
+			key := op.Signer.Key.Address()
+			if op.Signer.Weight == 0 {
+				delete(src.signers, key)
+			} else {
+				src.signers[key] = int32(op.Signer.Weight)
+			}
+		}
+		return "op_success", nil
+
+	case xdr.OperationTypeBumpSequence:
+		return "op_success", nil
+	}
+	return "op_not_supported", nil
+}
+
+// envelopeFee returns the fee of the tx of env,
+// or, for a fee bump, its own fee, which replaces that of its inner tx.
+func envelopeFee(env xdr.TransactionEnvelope) int64 {
+	if env.IsFeeBump() {
+		return env.FeeBumpFee()
+	}
+	return int64(env.Fee())
+}
+
+func assetKey(asset xdr.Asset) string {
+	var typ, code, issuer string
+	if err := asset.Extract(&typ, &code, &issuer); err != nil || asset.Type == xdr.AssetTypeAssetTypeNative {
+		return nativeKey
+	}
+	return typ + ":" + code + ":" + issuer
+}
+
+func assetIssuer(asset xdr.Asset) string {
+	var typ, code, issuer string
+	asset.Extract(&typ, &code, &issuer)
+	return issuer
+}
+
+// stellarAssetKey is assetKey for a stellar.Asset.
+func stellarAssetKey(asset stellar.Asset) string {
+	switch {
+	case asset.IsNative():
+		return nativeKey
+	case len(asset.Code) <= 4:
+		return "credit_alphanum4:" + asset.Code + ":" + asset.Issuer
+	}
+	return "credit_alphanum12:" + asset.Code + ":" + asset.Issuer
+}
+
+// assetResource returns the Horizon asset type, code, and issuer
+// of the asset with the given key.
+func assetResource(key string) (typ, code, issuer string) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 3 {
+		return nativeKey, "", ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+func memoFields(memo xdr.Memo) (string, string) {
+	switch memo.Type {
+	case xdr.MemoTypeMemoText:
+		return "text", memo.MustText()
+	case xdr.MemoTypeMemoId:
+		return "id", strconv.FormatUint(uint64(memo.MustId()), 10)
+	case xdr.MemoTypeMemoHash:
+		h := memo.MustHash()
+		return "hash", base64.StdEncoding.EncodeToString(h[:])
+	case xdr.MemoTypeMemoReturn:
+		h := memo.MustRetHash()
+		return "return", base64.StdEncoding.EncodeToString(h[:])
+	}
+	return "none", ""
+}
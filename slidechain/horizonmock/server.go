@@ -0,0 +1,486 @@
+// Package horizonmock is an in-memory Horizon server for hermetic tests.
+//
+// It implements the subset of the Horizon HTTP API that slidechain uses
+// (root, accounts, synchronous and asynchronous transaction submission and lookup, transaction
+// operations, transaction and payment streams, fee stats, and friendbot)
+// against a simple ledger model,
+// so that a real stellar.HorizonClient can be pointed at it.
+// Submitted txs may be fee bumps, or be of a later protocol; see FutureEnvelope.
+// Failures such as rate limiting, tx_bad_seq, and timeouts
+// can be injected with Server.Inject.
+package horizonmock
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/amount"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+// FriendbotAmount is the number of stroops the friendbot endpoint
+// gives each new account.
+const FriendbotAmount = 10000 * 10000000
+
+// keepalive is how often idle streams send an SSE comment.
+const keepalive = 100 * time.Millisecond
+
+// Server is a mock Horizon server.
+type Server struct {
+	// Passphrase is the network passphrase reported by the root endpoint
+	// and used to hash transactions.
+	Passphrase string
+
+	// Protocol is the protocol version reported by the root endpoint.
+	// If zero, it is 10.
+	Protocol int32
+
+	// Now is the close time of the next ledger,
+	// against which transaction time bounds are checked.
+	// If nil, it is the wall clock.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	changed  *sync.Cond // broadcast (with mu held) when txs changes
+	ledger   int32
+	accounts map[string]*account
+	txs      []*txRecord
+	faults   []*fault
+
+	srv *httptest.Server
+}
+
+// New starts a new mock Horizon server on the test network.
+// The caller must call Close when done with it.
+func New() *Server {
+	s := &Server{
+		Passphrase: network.TestNetworkPassphrase,
+		ledger:     1,
+		accounts:   make(map[string]*account),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// URL is the base URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns a Horizon client connected to s.
+func (s *Server) Client() *stellar.HorizonClient {
+	return &stellar.HorizonClient{
+		URL:  s.srv.URL,
+		HTTP: new(http.Client),
+	}
+}
+
+// Close shuts down the server,
+// terminating any open streams.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.ledger = -1
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	var (
+		ep      Endpoint
+		handler func(http.ResponseWriter, *http.Request)
+	)
+	switch {
+	case path == "":
+		ep, handler = EndpointRoot, s.serveRoot
+	case path == "fee_stats":
+		ep, handler = EndpointFeeStats, s.serveFeeStats
+	case path == "friendbot":
+		ep, handler = EndpointFriendbot, s.serveFriendbot
+	case path == "transactions" && req.Method == http.MethodPost:
+		ep, handler = EndpointSubmit, s.serveSubmit
+	case path == "transactions_async" && req.Method == http.MethodPost:
+		ep, handler = EndpointSubmitAsync, s.serveSubmitAsync
+	case path == "assets":
+		ep, handler = EndpointAssets, s.serveAssets
+	case len(parts) == 2 && parts[0] == "transactions":
+		ep, handler = EndpointTransaction, func(w http.ResponseWriter, req *http.Request) { s.serveTransaction(w, parts[1]) }
+	case len(parts) == 3 && parts[0] == "transactions" && parts[2] == "operations":
+		ep, handler = EndpointOperations, func(w http.ResponseWriter, req *http.Request) { s.serveOperations(w, parts[1]) }
+	case len(parts) == 2 && parts[0] == "accounts":
+		ep, handler = EndpointAccount, func(w http.ResponseWriter, req *http.Request) { s.serveAccount(w, parts[1]) }
+	case len(parts) == 3 && parts[0] == "accounts" && parts[2] == "transactions":
+		ep, handler = EndpointTransactions, func(w http.ResponseWriter, req *http.Request) { s.serveStream(w, req, parts[1], false) }
+	case len(parts) == 3 && parts[0] == "accounts" && parts[2] == "payments":
+		ep, handler = EndpointPayments, func(w http.ResponseWriter, req *http.Request) { s.serveStream(w, req, parts[1], true) }
+	default:
+		writeProblem(w, http.StatusNotFound, "not_found", "Resource Missing", nil)
+		return
+	}
+	if s.injectFault(ep, w, req) {
+		return
+	}
+	handler(w, req)
+}
+
+func (s *Server) serveRoot(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	root := stellar.Root{
+		HorizonVersion:    "horizonmock",
+		HorizonSequence:   s.ledger,
+		CoreSequence:      s.ledger,
+		NetworkPassphrase: s.Passphrase,
+		ProtocolVersion:   s.Protocol,
+	}
+	s.mu.Unlock()
+	if root.ProtocolVersion == 0 {
+		root.ProtocolVersion = 10
+	}
+	writeJSON(w, http.StatusOK, root)
+}
+
+// FeeStats is the response to GET /fee_stats.
+type FeeStats struct {
+	LastLedger          string `json:"last_ledger"`
+	LastLedgerBaseFee   string `json:"last_ledger_base_fee"`
+	LedgerCapacityUsage string `json:"ledger_capacity_usage"`
+	MinAcceptedFee      string `json:"min_accepted_fee"`
+	ModeAcceptedFee     string `json:"mode_accepted_fee"`
+	P10AcceptedFee      string `json:"p10_accepted_fee"`
+	P50AcceptedFee      string `json:"p50_accepted_fee"`
+	P90AcceptedFee      string `json:"p90_accepted_fee"`
+	P99AcceptedFee      string `json:"p99_accepted_fee"`
+}
+
+func (s *Server) serveFeeStats(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	ledger := s.ledger
+	s.mu.Unlock()
+	const fee = "100"
+	writeJSON(w, http.StatusOK, FeeStats{
+		LastLedger:          strconv.Itoa(int(ledger)),
+		LastLedgerBaseFee:   fee,
+		LedgerCapacityUsage: "0.01",
+		MinAcceptedFee:      fee,
+		ModeAcceptedFee:     fee,
+		P10AcceptedFee:      fee,
+		P50AcceptedFee:      fee,
+		P90AcceptedFee:      fee,
+		P99AcceptedFee:      fee,
+	})
+}
+
+func (s *Server) serveFriendbot(w http.ResponseWriter, req *http.Request) {
+	addr := req.FormValue("addr")
+	var id xdr.AccountId
+	if err := id.SetAddress(addr); err != nil {
+		writeProblem(w, http.StatusBadRequest, "bad_request", "Bad Request", nil)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[addr]; ok {
+		writeProblem(w, http.StatusBadRequest, "bad_request", "account already funded", nil)
+		return
+	}
+	s.createAccount(addr, FriendbotAmount)
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) serveAccount(w http.ResponseWriter, addr string) {
+	s.mu.Lock()
+	a, ok := s.accounts[addr]
+	var resp stellar.Account
+	if ok {
+		resp = a.resource(addr)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "not_found", "Resource Missing", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveAssets serves the asset with the asset_code and asset_issuer
+// of the query, if any account trusts it.
+func (s *Server) serveAssets(w http.ResponseWriter, req *http.Request) {
+	code, issuer := req.URL.Query().Get("asset_code"), req.URL.Query().Get("asset_issuer")
+	typ := "credit_alphanum4"
+	if len(code) > 4 {
+		typ = "credit_alphanum12"
+	}
+	s.mu.Lock()
+	authorized, unauthorized, holders := s.supply(typ + ":" + code + ":" + issuer)
+	s.mu.Unlock()
+	type balances struct {
+		Authorized   string `json:"authorized"`
+		Unauthorized string `json:"unauthorized"`
+	}
+	type record struct {
+		AssetType   string   `json:"asset_type"`
+		AssetCode   string   `json:"asset_code"`
+		AssetIssuer string   `json:"asset_issuer"`
+		Amount      string   `json:"amount"`
+		NumAccounts int      `json:"num_accounts"`
+		Balances    balances `json:"balances"`
+	}
+	var page struct {
+		Embedded struct {
+			Records []record `json:"records"`
+		} `json:"_embedded"`
+	}
+	page.Embedded.Records = []record{}
+	if holders > 0 {
+		page.Embedded.Records = append(page.Embedded.Records, record{
+			AssetType:   typ,
+			AssetCode:   code,
+			AssetIssuer: issuer,
+			Amount:      formatAmount(authorized),
+			NumAccounts: holders,
+			Balances:    balances{Authorized: formatAmount(authorized), Unauthorized: formatAmount(unauthorized)},
+		})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) serveTransaction(w http.ResponseWriter, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range s.txs {
+		if tx.Hash == hash || tx.innerHash == hash {
+			writeJSON(w, http.StatusOK, tx.Transaction)
+			return
+		}
+	}
+	writeProblem(w, http.StatusNotFound, "not_found", "Resource Missing", nil)
+}
+
+// serveOperations serves the operations of a tx.
+func (s *Server) serveOperations(w http.ResponseWriter, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range s.txs {
+		if tx.Hash != hash && tx.innerHash != hash {
+			continue
+		}
+		var page struct {
+			Embedded struct {
+				Records []interface{} `json:"records"`
+			} `json:"_embedded"`
+		}
+		page.Embedded.Records = []interface{}{}
+		page.Embedded.Records = append(page.Embedded.Records, tx.operations...)
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	writeProblem(w, http.StatusNotFound, "not_found", "Resource Missing", nil)
+}
+
+func (s *Server) serveSubmit(w http.ResponseWriter, req *http.Request) {
+	txstr := req.FormValue("tx")
+	env, err := decodeEnvelope(txstr)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "transaction_malformed", "Transaction Malformed", map[string]interface{}{
+			"envelope_xdr": txstr,
+		})
+		return
+	}
+	rec, codes := s.apply(env, txstr)
+	if codes != nil {
+		writeProblem(w, http.StatusBadRequest, "transaction_failed", "Transaction Failed", map[string]interface{}{
+			"envelope_xdr": txstr,
+			"result_codes": codes,
+			"result_xdr":   failureResultXDR(env, codes.TransactionCode),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, stellar.TransactionSuccess{
+		Hash:   rec.Hash,
+		Ledger: rec.Ledger,
+		Env:    rec.EnvelopeXdr,
+		Result: rec.ResultXdr,
+	})
+}
+
+// serveSubmitAsync serves POST /transactions_async.
+// Unlike Horizon, it applies the tx before responding,
+// so a PENDING tx is already in a ledger.
+func (s *Server) serveSubmitAsync(w http.ResponseWriter, req *http.Request) {
+	txstr := req.FormValue("tx")
+	env, err := decodeEnvelope(txstr)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "transaction_malformed", "Transaction Malformed", map[string]interface{}{
+			"envelope_xdr": txstr,
+		})
+		return
+	}
+	hash, err := network.HashTransactionInEnvelope(env, s.Passphrase)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "transaction_malformed", "Transaction Malformed", nil)
+		return
+	}
+	resp := map[string]string{"hash": hex.EncodeToString(hash[:])}
+	if _, codes := s.apply(env, txstr); codes != nil {
+		resp["tx_status"] = "ERROR"
+		resp["error_result_xdr"] = failureResultXDR(env, codes.TransactionCode)
+		writeJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+	resp["tx_status"] = "PENDING"
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// serveStream serves the transactions (or payments) involving addr
+// after the cursor in the request,
+// as a server-sent event stream that stays open for new ones
+// if the client asked for text/event-stream.
+func (s *Server) serveStream(w http.ResponseWriter, req *http.Request, addr string, payments bool) {
+	cursor, _ := strconv.ParseInt(req.FormValue("cursor"), 10, 64)
+	streaming := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+
+	ctx := req.Context()
+	go func() {
+		// Wake the loop below periodically to send keepalives,
+		// which also let the client notice when its own context is canceled,
+		// and when the client goes away.
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.mu.Lock()
+				s.changed.Broadcast()
+				s.mu.Unlock()
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.changed.Broadcast()
+				s.mu.Unlock()
+			}
+		}
+	}()
+
+	if streaming {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	next := 0
+	for {
+		var records []interface{}
+		collect := func() {
+			for ; next < len(s.txs); next++ {
+				records = append(records, s.txs[next].records(addr, payments, cursor)...)
+			}
+		}
+		s.mu.Lock()
+		collect()
+		if len(records) == 0 && streaming && ctx.Err() == nil && s.ledger >= 0 {
+			s.changed.Wait()
+			collect()
+		}
+		closed := s.ledger < 0
+		s.mu.Unlock()
+
+		if !streaming {
+			var page struct {
+				Embedded struct {
+					Records []interface{} `json:"records"`
+				} `json:"_embedded"`
+			}
+			page.Embedded.Records = records
+			writeJSON(w, http.StatusOK, page)
+			return
+		}
+		if ctx.Err() != nil || closed {
+			return
+		}
+		if len(records) == 0 {
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		for _, r := range records {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", recordPagingToken(r), data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+var txResultCodes = map[string]xdr.TransactionResultCode{
+	"tx_failed":                xdr.TransactionResultCodeTxFailed,
+	"tx_bad_seq":               xdr.TransactionResultCodeTxBadSeq,
+	"tx_no_account":            xdr.TransactionResultCodeTxNoAccount,
+	"tx_insufficient_balance":  xdr.TransactionResultCodeTxInsufficientBalance,
+	"tx_too_early":             xdr.TransactionResultCodeTxTooEarly,
+	"tx_too_late":              xdr.TransactionResultCodeTxTooLate,
+	"tx_bad_minseq_age_or_gap": xdr.TransactionResultCodeTxBadMinSeqAgeOrGap,
+}
+
+func failureResultXDR(env xdr.TransactionEnvelope, code string) string {
+	res := xdr.TransactionResult{FeeCharged: xdr.Int64(envelopeFee(env))}
+	c, ok := txResultCodes[code]
+	if !ok {
+		c = xdr.TransactionResultCodeTxInternalError
+	}
+	res.Result.Code = c
+	if res.Result.Code == xdr.TransactionResultCodeTxFailed {
+		res.Result.Results = &[]xdr.OperationResult{}
+	}
+	s, _ := xdr.MarshalBase64(res)
+	return s
+}
+
+func recordPagingToken(r interface{}) string {
+	switch r := r.(type) {
+	case stellar.Transaction:
+		return r.PT
+	case payment:
+		return r.PagingToken
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeProblem writes a Horizon-style problem+json error,
+// which stellar.HorizonClient decodes into a *stellar.HorizonError.
+func writeProblem(w http.ResponseWriter, code int, typ, title string, extras map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "https://stellar.org/horizon-errors/" + typ,
+		"title":  title,
+		"status": code,
+		"extras": extras,
+	})
+}
+
+func formatAmount(stroops int64) string {
+	return amount.String(xdr.Int64(stroops))
+}
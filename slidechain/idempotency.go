@@ -0,0 +1,148 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// idempotencyRetention is how long the response to a request
+// with an Idempotency-Key is kept for replay.
+const idempotencyRetention = 24 * time.Hour
+
+// Idempotent wraps a public write handler
+// so that a request other than GET or HEAD carrying an Idempotency-Key header
+// runs at most once per key and path.
+// A retry with the same key gets the first request's response,
+// a request reusing the key for a different method, URI, or body is rejected,
+// and one arriving while the first is still being handled gets 409 Conflict.
+// Responses of 429 and 503, which mean the request was not handled,
+// are not kept, so the request may be retried with the same key.
+func (c *Custodian) Idempotent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" || req.Method == http.MethodGet || req.Method == http.MethodHead {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if len(key) > 255 {
+			net.Errorf(w, http.StatusBadRequest, "Idempotency-Key is longer than 255 bytes")
+			return
+		}
+		ctx := req.Context()
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+			return
+		}
+		reqHash := requestHash(req.Method, req.URL.RequestURI(), body)
+		path := req.URL.Path
+
+		_, err = c.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_ms < $1`, c.nowMS()-int64(idempotencyRetention/time.Millisecond))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "expiring idempotency keys: %s", err)
+			return
+		}
+		const insertQ = `INSERT OR IGNORE INTO idempotency_keys (path, key, request_hash, created_ms) VALUES ($1, $2, $3, $4)`
+		res, err := c.DB.ExecContext(ctx, insertQ, path, key, reqHash, c.nowMS())
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "recording idempotency key: %s", err)
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "recording idempotency key: %s", err)
+			return
+		}
+		if n == 0 {
+			var (
+				storedHash  []byte
+				status      int
+				contentType string
+				storedBody  []byte
+			)
+			const q = `SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE path=$1 AND key=$2`
+			err = c.DB.QueryRowContext(ctx, q, path, key).Scan(&storedHash, &status, &contentType, &storedBody)
+			if err == sql.ErrNoRows {
+				net.Errorf(w, http.StatusConflict, "request with Idempotency-Key %q expired while in progress; retry", key)
+				return
+			}
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "looking up idempotency key: %s", err)
+				return
+			}
+			switch {
+			case !bytes.Equal(storedHash, reqHash):
+				net.Errorf(w, http.StatusUnprocessableEntity, "Idempotency-Key %q was used for a different request", key)
+			case status == 0:
+				net.Errorf(w, http.StatusConflict, "a request with Idempotency-Key %q is in progress", key)
+			default:
+				if contentType != "" {
+					w.Header().Set("Content-Type", contentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(status)
+				w.Write(storedBody)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(rec, req)
+
+		// The response is kept even if the client has gone away,
+		// since that is when it is most likely to retry.
+		bg := context.Background()
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			_, err = c.DB.ExecContext(bg, `DELETE FROM idempotency_keys WHERE path=$1 AND key=$2`, path, key)
+		} else {
+			const q = `UPDATE idempotency_keys SET status=$1, content_type=$2, body=$3 WHERE path=$4 AND key=$5`
+			_, err = c.DB.ExecContext(bg, q, status, rec.Header().Get("Content-Type"), rec.body.Bytes(), path, key)
+		}
+		if err != nil {
+			log.Printf("recording response for Idempotency-Key %q: %s", key, err)
+		}
+	})
+}
+
+func requestHash(method, uri string, body []byte) []byte {
+	bodyHash := sha3.Sum256(body)
+	msg := append([]byte(method+"\x00"+uri+"\x00"), bodyHash[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// responseRecorder passes a response through
+// while keeping a copy of its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,96 @@
+package slidechain
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, now: func() time.Time { return now }}
+
+		var (
+			calls   int
+			status  = http.StatusOK
+			started = make(chan struct{})
+			release chan struct{}
+		)
+		h := c.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if release != nil {
+				close(started)
+				<-release
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "call %d", calls)
+		}))
+		do := func(key, body string, wantCode int, wantBody string) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest("POST", "/submit?wait=1", strings.NewReader(body))
+			if key != "" {
+				req.Header.Set("Idempotency-Key", key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("status code %d for key %q, want %d: %s", w.Code, key, wantCode, w.Body)
+			}
+			if wantBody != "" && w.Body.String() != wantBody {
+				t.Errorf("got body %q for key %q, want %q", w.Body, key, wantBody)
+			}
+			return w
+		}
+
+		do("", "tx", http.StatusOK, "call 1")
+		do("", "tx", http.StatusOK, "call 2")
+		do("a", "tx", http.StatusOK, "call 3")
+		w := do("a", "tx", http.StatusOK, "call 3")
+		if w.Header().Get("Idempotent-Replayed") != "true" || w.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("got replay headers %v", w.Header())
+		}
+		do("a", "other tx", http.StatusUnprocessableEntity, "")
+		if calls != 3 {
+			t.Errorf("handler ran %d times, want 3", calls)
+		}
+
+		// Errors are replayed too, except those meaning the request was not handled.
+		status = http.StatusBadRequest
+		do("b", "tx", http.StatusBadRequest, "call 4")
+		do("b", "tx", http.StatusBadRequest, "call 4")
+		status = http.StatusServiceUnavailable
+		do("c", "tx", http.StatusServiceUnavailable, "call 5")
+		status = http.StatusOK
+		do("c", "tx", http.StatusOK, "call 6")
+
+		// A retry while the first request is in progress conflicts.
+		release = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			req := httptest.NewRequest("POST", "/submit?wait=1", strings.NewReader("tx"))
+			req.Header.Set("Idempotency-Key", "d")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		<-started
+		do("d", "tx", http.StatusConflict, "")
+		close(release)
+		<-done
+		release = nil
+		do("d", "tx", http.StatusOK, "call 7")
+
+		// Keys expire.
+		now = now.Add(idempotencyRetention + time.Second)
+		do("a", "tx", http.StatusOK, "call 8")
+	})
+}
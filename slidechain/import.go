@@ -3,11 +3,12 @@ package slidechain
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"math"
 
-	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
@@ -17,14 +18,25 @@ import (
 	"github.com/chain/txvm/protocol/txvm/asm"
 )
 
-// buildImportTx builds the import transaction.
+// buildImportTx builds the import transaction,
+// issuing the peg-in with ic,
+// with ref, from depositRef, as the reference data of the payment.
+// Everything in it is derived from the peg-in and its deposit,
+// and ed25519 signatures are deterministic,
+// so the same peg-in always gets the same import tx.
 func (c *Custodian) buildImportTx(
+	ic *issuanceContract,
 	amount, expMS int64,
-	assetXDR, recipPubkey []byte,
+	assetXDR, recipPubkey, ref []byte,
 ) ([]byte, error) {
+	refdata := "''"
+	if len(ref) > 0 {
+		refdata = fmt.Sprintf("x'%x'", ref)
+	}
+
 	// Input plain-data consume token contract and put it on the arg stack.
 	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "{'C', x'%x', x'%x',", createTokenSeed[:], consumeTokenProg)
+	fmt.Fprintf(buf, "{'C', x'%x', x'%x',", ic.createTokenSeed[:], ic.consumeTokenProg)
 	fmt.Fprintf(buf, " {'Z', %d}, {'T', {x'%x'}},", int64(1), recipPubkey)
 	// For a slight optimization, the anchor for that contract's value is
 	// split from the value generated by the `nonce` instruction. Reconstructing
@@ -33,11 +45,14 @@ func (c *Custodian) buildImportTx(
 	snapshotNonceHash := txvm.VMHash("Split2", nonceHash[:])
 	fmt.Fprintf(buf, " {'V', %d, x'%x', x'%x'},", 0, zeroSeed[:], snapshotNonceHash[:])
 	fmt.Fprintf(buf, " {'Z', %d}, {'S', x'%x'}}", amount, assetXDR)
-	fmt.Fprintf(buf, " input put\n")                                       // arg stack: consumeTokenContract
-	fmt.Fprintf(buf, "x'%x' contract call\n", importIssuanceProg)          // arg stack: sigchecker, issuedval, {recip}, quorum
+	fmt.Fprintf(buf, " input put\n") // arg stack: consumeTokenContract
+	if ic.selector {
+		fmt.Fprintf(buf, "0 put\n") // arg stack: consumeTokenContract, 0
+	}
+	fmt.Fprintf(buf, "x'%x' contract call\n", ic.prog)                     // arg stack: sigchecker, issuedval, {recip}, quorum
 	fmt.Fprintf(buf, "get get get splitzero\n")                            // con stack: quorum, {recip}, issuedval, zeroval; arg stack: sigchecker
 	fmt.Fprintf(buf, "3 bury\n")                                           // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker
-	fmt.Fprintf(buf, "'' put\n")                                           // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker, refdata
+	fmt.Fprintf(buf, "%s put\n", refdata)                                  // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker, refdata
 	fmt.Fprintf(buf, "put put put\n")                                      // con stack: zeroval; arg stack: sigchecker, refdata, issuedval, {recip}, quorum
 	fmt.Fprintf(buf, "x'%x' contract call\n", standard.PayToMultisigProg1) // con stack: zeroval; arg stack: sigchecker
 	fmt.Fprintf(buf, "finalize\n")
@@ -84,45 +99,88 @@ func (c *Custodian) importFromPegIns(ctx context.Context, ready chan struct{}) {
 		case <-ch:
 		}
 
-		var (
-			amounts, expMSs                []int64
-			nonceHashes, assetXDRs, recips [][]byte
-		)
-		const q = `SELECT nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms FROM pegs WHERE imported=0 AND stellar_tx=1`
-		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64) {
-			nonceHashes = append(nonceHashes, nonceHash)
-			amounts = append(amounts, amount)
-			assetXDRs = append(assetXDRs, assetXDR)
-			recips = append(recips, recip)
-			expMSs = append(expMSs, expMS)
-		})
+		err := c.importPending(ctx)
 		if err == context.Canceled {
 			return
 		}
 		if err != nil {
-			log.Fatalf("querying pegs: %s", err)
+			log.Fatal(err)
 		}
-		for i, nonceHash := range nonceHashes {
-			var (
-				amount   = amounts[i]
-				assetXDR = assetXDRs[i]
-				recip    = recips[i]
-				expMS    = expMSs[i]
-			)
-			err = c.doImport(ctx, nonceHash, amount, assetXDR, recip, expMS)
-			if err != nil {
-				if err == context.Canceled {
-					return
-				}
-				log.Fatal(err)
-			}
+	}
+}
+
+// importPending imports the pegs seen on Stellar
+// that have not been imported yet,
+// unless peg-in issuance is paused.
+// Peg-ins held by screening, their asset's cap, or KYC limits are skipped.
+func (c *Custodian) importPending(ctx context.Context) error {
+	paused, err := c.paused(ctx, pausePegIn)
+	if err != nil || paused {
+		return err
+	}
+	pending, err := c.pendingImports(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for i := range pending {
+		p := &pending[i]
+		ok, err := c.screenPegIn(ctx, p.NonceHash, p.Amount, p.AssetXDR, p.Recipient, p.DepositTxID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		ok, err = c.checkPegCap(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		ok, err = c.checkKYC(ctx, "import", p.Recipient, p.AssetXDR, p.Amount, p.NonceHash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		ic := issuanceContracts[p.IssuanceVersion]
+		if ic == nil {
+			return fmt.Errorf("peg-in %x has unknown issuance version %d", p.NonceHash, p.IssuanceVersion)
+		}
+		err = c.doImport(ctx, ic, p)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (c *Custodian) doImport(ctx context.Context, nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64) error {
-	log.Printf("doing import from tx with hash %x: %d of asset %x for recipient %x with expiration %d", nonceHash, amount, assetXDR, recip, expMS)
-	importTxBytes, err := c.buildImportTx(amount, expMS, assetXDR, recip)
+// doImport issues the peg-in with the given nonce hash,
+// or releases it from the reserve if it is of a wrapped asset,
+// and marks it imported.
+// An import tx already on the chain,
+// submitted before a crash or by another replica,
+// is not submitted again.
+func (c *Custodian) doImport(ctx context.Context, ic *issuanceContract, p *pegIn) error {
+	var (
+		nonceHash = p.NonceHash
+		amount    = p.Amount
+		assetXDR  = p.AssetXDR
+		recip     = p.Recipient
+		expMS     = p.ExpMS
+	)
+	w, err := c.wrappedAssetByXDR(ctx, assetXDR)
+	if err != nil {
+		return err
+	}
+	if w != nil {
+		return c.doRelease(ctx, ic, w, nonceHash, amount, assetXDR, recip, expMS)
+	}
+	log.Printf("doing import from tx with hash %x: %d of asset %x for recipient %x with expiration %d, issuance version %d", nonceHash, amount, assetXDR, recip, expMS, ic.version)
+	ref := depositRef(p.DepositTxID, p.DepositOp, amount, recip)
+	importTxBytes, err := c.buildImportTx(ic, amount, expMS, assetXDR, recip, ref)
 	if err != nil {
 		return errors.Wrap(err, "building import tx")
 	}
@@ -132,12 +190,55 @@ func (c *Custodian) doImport(ctx context.Context, nonceHash []byte, amount int64
 		return errors.Wrap(err, "computing transaction ID")
 	}
 	importTx.Runlimit = math.MaxInt64 - runlimit
-	_, err = c.S.submitTx(ctx, importTx)
+	onChain, err := c.txOnChain(ctx, importTx.ID)
 	if err != nil {
-		return errors.Wrap(err, "submitting import tx")
+		return err
+	}
+	if onChain {
+		log.Printf("import tx %x of peg-in %x is already on the chain", importTx.ID.Bytes(), nonceHash)
+	} else {
+		_, err = c.S.submitTx(ctx, importTx)
+		if err != nil {
+			return errors.Wrap(err, "submitting import tx")
+		}
 	}
 	txresult := txresult.New(importTx)
 	log.Printf("assetID %x amount %d anchor %x\n", txresult.Issuances[0].Value.AssetID.Bytes(), txresult.Issuances[0].Value.Amount, txresult.Issuances[0].Value.Anchor)
-	_, err = c.DB.ExecContext(ctx, `UPDATE pegs SET imported=1 WHERE nonce_hash = $1`, nonceHash)
-	return errors.Wrapf(err, "setting imported=1 for tx with hash %x", nonceHash)
+	ok, err := c.transitionPegIn(ctx, nonceHash, pegInPaid, pegInImported, setImportTxID(ctx, nonceHash, importTx.ID))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("peg-in %x is no longer in state %s", nonceHash, pegInPaid)
+	}
+	return nil
+}
+
+// setImportTxID records the txid of a peg-in's import tx,
+// for checking fraud claims against.
+func setImportTxID(ctx context.Context, nonceHash []byte, txid bc.Hash) func(*sql.Tx) error {
+	return func(dbtx *sql.Tx) error {
+		_, err := dbtx.ExecContext(ctx, `UPDATE pegs SET import_txid=$1 WHERE nonce_hash=$2`, txid.Bytes(), nonceHash)
+		return errors.Wrapf(err, "recording import tx of peg-in %x", nonceHash)
+	}
+}
+
+// depositRef is the reference data of the import tx of a peg-in,
+// committing it to the deposit that paid it:
+// the deposit's tx and the index of its payment in it,
+// the amount, and the recipient.
+// A peg-in with no recorded deposit tx has none.
+func depositRef(depositTxID string, opIndex int, amount int64, recip []byte) []byte {
+	if depositTxID == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(depositTxID)))])
+	buf.WriteString(depositTxID)
+	buf.Write(n[:binary.PutVarint(n[:], int64(opIndex))])
+	buf.Write(n[:binary.PutVarint(n[:], amount)])
+	buf.Write(recip)
+	h := txvm.VMHash("SlidechainDeposit", buf.Bytes())
+	return h[:]
 }
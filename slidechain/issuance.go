@@ -0,0 +1,232 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/asm"
+	"github.com/chain/txvm/protocol/txvm/op"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// importIssuanceFmt2 is version 2 of the import-issuance program.
+// It expects a selector on top of the arg stack.
+// With a zero selector it imports a peg-in as version 1 does,
+// expecting the arg stack: consumeTokenContract, 0
+// With a nonzero selector it migrates value issued by version 1,
+// expecting the arg stack: asset, oldval, 1
+// It checks that oldval is of the version 1 asset pegging asset,
+// retires it, and puts the same amount of the version 2 asset on the arg stack.
+// Anyone holding version 1 value can migrate it this way.
+const importIssuanceFmt2 = `
+	                                                    #  con stack                                       arg stack                                log
+	                                                    #  ---------                                       ---------                                ---
+	                                                    #                                                  ..., selector
+	get                                                 #  selector
+	jumpif:$migrate                                     #                                                  consumeTokenContract
+	get call                                            #                                                  asset, amount, zeroval, {recip}, quorum
+	get get get get get                                 #  quorum, {recip}, zeroval, amount, asset
+	[txid x"%x" get 0 checksig verify] contract put     #  quorum, {recip}, zeroval, amount, asset         sigchecker
+	issue put put put                                   #                                                  sigchecker, issuedval, {recip}, quorum   {"A", vm.caller, issuedval.amount, issuedval.assetid, issuedval.anchor}
+	jump:$end
+$migrate
+	                                                    #                                                  asset, oldval
+	get get                                             #  oldval, asset
+	dup x"%x" swap cat 'AssetID' vmhash                 #  oldval, asset, v1assetid
+	2 roll assetid                                      #  asset, v1assetid, oldval, oldval.assetid
+	2 roll eq verify                                    #  asset, oldval
+	amount swap 0 split                                 #  asset, amount, oldval, zeroval
+	swap retire                                         #  asset, amount, zeroval                                                                   {"X", vm.caller, oldval.amount, oldval.assetid, oldval.anchor}
+	2 roll 2 roll swap                                  #  zeroval, amount, asset
+	issue put                                           #                                                  issuedval                                {"A", vm.caller, issuedval.amount, issuedval.assetid, issuedval.anchor}
+$end
+`
+
+var (
+	importIssuanceSrc2  = fmt.Sprintf(importIssuanceFmt2, custodianPub, importIssuanceSeed)
+	importIssuanceProg2 = asm.MustAssemble(importIssuanceSrc2)
+	importIssuanceSeed2 = txvm.ContractSeed(importIssuanceProg2)
+	consumeTokenSrc2    = fmt.Sprintf(consumeTokenFmt, importIssuanceSeed2)
+	consumeTokenProg2   = asm.MustAssemble(consumeTokenSrc2)
+	createTokenSrc2     = fmt.Sprintf(createTokenFmt, consumeTokenSrc2)
+	createTokenProg2    = asm.MustAssemble(createTokenSrc2)
+	createTokenSeed2    = txvm.ContractSeed(createTokenProg2)
+)
+
+// importIssuanceFmt3 is version 3 of the import-issuance program,
+// the freeze-capable one.
+// It is version 2 but for the output an import pays:
+// that is locked with quorum 1 by the recipient's pubkey and the custodian's,
+// a delegated output as in consolidation,
+// so that the custodian can claw the value back
+// if the issuer of the pegged asset claws back its Stellar deposit.
+// With a nonzero selector it migrates value issued by version 2.
+const importIssuanceFmt3 = `
+	                                                    #  con stack                                       arg stack                                log
+	                                                    #  ---------                                       ---------                                ---
+	                                                    #                                                  ..., selector
+	get                                                 #  selector
+	jumpif:$migrate                                     #                                                  consumeTokenContract
+	get call                                            #                                                  asset, amount, zeroval, {recip}, quorum
+	get get get get get                                 #  quorum, {recip}, zeroval, amount, asset
+	[txid x"%x" get 0 checksig verify] contract put     #  quorum, {recip}, zeroval, amount, asset         sigchecker
+	issue put                                           #  quorum, {recip}                                 sigchecker, issuedval                    {"A", vm.caller, issuedval.amount, issuedval.assetid, issuedval.anchor}
+	untuple x"%x" swap 1 add tuple                      #  quorum, {recip, custodian}
+	put put                                             #                                                  sigchecker, issuedval, {recip, custodian}, quorum
+	jump:$end
+$migrate
+	                                                    #                                                  asset, oldval
+	get get                                             #  oldval, asset
+	dup x"%x" swap cat 'AssetID' vmhash                 #  oldval, asset, v2assetid
+	2 roll assetid                                      #  asset, v2assetid, oldval, oldval.assetid
+	2 roll eq verify                                    #  asset, oldval
+	amount swap 0 split                                 #  asset, amount, oldval, zeroval
+	swap retire                                         #  asset, amount, zeroval                                                                   {"X", vm.caller, oldval.amount, oldval.assetid, oldval.anchor}
+	2 roll 2 roll swap                                  #  zeroval, amount, asset
+	issue put                                           #                                                  issuedval                                {"A", vm.caller, issuedval.amount, issuedval.assetid, issuedval.anchor}
+$end
+`
+
+var (
+	importIssuanceSrc3  = fmt.Sprintf(importIssuanceFmt3, custodianPub, custodianPub, importIssuanceSeed2)
+	importIssuanceProg3 = asm.MustAssemble(importIssuanceSrc3)
+	importIssuanceSeed3 = txvm.ContractSeed(importIssuanceProg3)
+	consumeTokenSrc3    = fmt.Sprintf(consumeTokenFmt, importIssuanceSeed3)
+	consumeTokenProg3   = asm.MustAssemble(consumeTokenSrc3)
+	createTokenSrc3     = fmt.Sprintf(createTokenFmt, consumeTokenSrc3)
+	createTokenProg3    = asm.MustAssemble(createTokenSrc3)
+	createTokenSeed3    = txvm.ContractSeed(createTokenProg3)
+)
+
+// An issuanceContract is a version of the import-issuance program,
+// with the uniqueness-token programs of the peg-ins it imports.
+// The ID of an imported asset depends on the version that issued it.
+type issuanceContract struct {
+	version          int
+	prog             []byte
+	seed             [32]byte
+	createTokenProg  []byte
+	createTokenSeed  [32]byte
+	consumeTokenProg []byte
+
+	// selector is whether an import passes the program a zero selector.
+	selector bool
+
+	// delegated is whether imports pay the recipient a delegated output,
+	// which the custodian can also spend.
+	delegated bool
+}
+
+// issuanceContracts are the versions of the import-issuance program.
+// Each version after the first can migrate value from the one before it.
+var issuanceContracts = map[int]*issuanceContract{
+	1: {
+		version:          1,
+		prog:             importIssuanceProg,
+		seed:             importIssuanceSeed,
+		createTokenProg:  createTokenProg,
+		createTokenSeed:  createTokenSeed,
+		consumeTokenProg: consumeTokenProg,
+	},
+	2: {
+		version:          2,
+		prog:             importIssuanceProg2,
+		seed:             importIssuanceSeed2,
+		createTokenProg:  createTokenProg2,
+		createTokenSeed:  createTokenSeed2,
+		consumeTokenProg: consumeTokenProg2,
+		selector:         true,
+	},
+	3: {
+		version:          3,
+		prog:             importIssuanceProg3,
+		seed:             importIssuanceSeed3,
+		createTokenProg:  createTokenProg3,
+		createTokenSeed:  createTokenSeed3,
+		consumeTokenProg: consumeTokenProg3,
+		selector:         true,
+		delegated:        true,
+	},
+}
+
+// LatestIssuanceVersion is the newest version of the import-issuance program.
+const LatestIssuanceVersion = 3
+
+// assetID returns the ID of the txvm asset ic issues
+// pegging the main-chain asset assetXDR.
+func (ic *issuanceContract) assetID(assetXDR []byte) bc.Hash {
+	return bc.NewHash(txvm.AssetID(ic.seed[:], assetXDR))
+}
+
+// issuanceVersion returns the version of the import-issuance program
+// whose asset pegging assetXDR has ID assetID,
+// or 0 if there is none.
+func issuanceVersion(assetID bc.Hash, assetXDR []byte) int {
+	for v, ic := range issuanceContracts {
+		if ic.assetID(assetXDR) == assetID {
+			return v
+		}
+	}
+	return 0
+}
+
+// issuance returns the import-issuance program for new peg-ins,
+// chosen by custodian.issuance_version.
+func (c *Custodian) issuance() *issuanceContract {
+	if cfg := c.config(); cfg != nil && cfg.Custodian.IssuanceVersion != 0 {
+		return issuanceContracts[int(cfg.Custodian.IssuanceVersion)]
+	}
+	return issuanceContracts[1]
+}
+
+// BuildMigrateTx builds a txvm tx migrating an output of prv's holder,
+// with the given amount and anchor,
+// from the asset pegging asset under the version of the import-issuance program
+// before the given one
+// to the same amount of the asset under the given version,
+// paid to the same key.
+func BuildMigrateTx(ctx context.Context, asset stellar.Asset, version int, amount int64, anchor []byte, prv ed25519.PrivateKey) (*bc.Tx, error) {
+	ic, prev := issuanceContracts[version], issuanceContracts[version-1]
+	if ic == nil || prev == nil {
+		return nil, fmt.Errorf("cannot migrate to issuance version %d", version)
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	pubkey := prv.Public().(ed25519.PublicKey)
+
+	b := new(txvmutil.Builder)
+	b.PushdataBytes(nil).Op(op.Put)                                                                                                   // arg stack: refdata
+	standard.SpendMultisig(b, 1, []ed25519.PublicKey{pubkey}, amount, prev.assetID(assetXDR), anchor, standard.PayToMultisigSeed1[:]) // arg stack: oldval, sigcheck
+	b.Op(op.Get).Op(op.Get)                                                                                                           // con stack: sigcheck, oldval
+	b.PushdataInt64(0).Op(op.Split).PushdataInt64(1).Op(op.Roll)                                                                      // con stack: sigcheck, zeroval, oldval
+	b.PushdataBytes(assetXDR).Op(op.Put)                                                                                              // arg stack: asset
+	b.Op(op.Put)                                                                                                                      // arg stack: asset, oldval
+	b.PushdataInt64(1).Op(op.Put)                                                                                                     // arg stack: asset, oldval, 1
+	b.PushdataBytes(ic.prog).Op(op.Contract).Op(op.Call)                                                                              // arg stack: newval
+	b.Op(op.Get)                                                                                                                      // con stack: sigcheck, zeroval, newval
+	b.PushdataBytes(nil).Op(op.Put)                                                                                                   // arg stack: refdata
+	b.Op(op.Put)                                                                                                                      // arg stack: refdata, newval
+	b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put)                                                // arg stack: refdata, newval, {pubkey}
+	b.PushdataInt64(1).Op(op.Put)                                                                                                     // arg stack: refdata, newval, {pubkey}, 1
+	b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)                                                          // con stack: sigcheck, zeroval
+	b.Op(op.Finalize)                                                                                                                 // con stack: sigcheck
+	prog1 := b.Build()
+	vm, err := txvm.Validate(prog1, 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	sigProg := standard.VerifyTxID(vm.TxID)
+	b.PushdataBytes(ed25519.Sign(prv, append(sigProg, anchor...))).Op(op.Put)
+	b.PushdataBytes(sigProg).Op(op.Put)
+	b.Op(op.Call)
+	return newTx(b.Build())
+}
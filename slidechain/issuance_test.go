@@ -0,0 +1,218 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		v1Import := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		importTestPeg(ctx, t, c, issuanceContracts[2], assetXDR, pub, 5, expMS+1)
+
+		// The imported output's anchor is that of the issued value after a zeroval is split off.
+		anchor := txvm.VMHash("Split1", v1Import.Issuances[0].Anchor)
+		migrateTx, err := BuildMigrateTx(ctx, native, 2, 10, anchor[:], prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, migrateTx)
+		if len(migrateTx.Issuances) != 1 || migrateTx.Issuances[0].AssetID != issuanceContracts[2].assetID(assetXDR) || migrateTx.Issuances[0].Amount != 10 {
+			t.Errorf("got migration issuances %+v, want 10 of the version 2 asset", migrateTx.Issuances)
+		}
+		if len(migrateTx.Retirements) != 1 || migrateTx.Retirements[0].AssetID != issuanceContracts[1].assetID(assetXDR) || migrateTx.Retirements[0].Amount != 10 {
+			t.Errorf("got migration retirements %+v, want 10 of the version 1 asset", migrateTx.Retirements)
+		}
+		retired := make([]bool, len(migrateTx.Retirements))
+		if !migration(migrateTx, migrateTx.Issuances[0], assetXDR, retired) {
+			t.Error("migration issuance not recognized as one")
+		}
+		if migration(v1Import, v1Import.Issuances[0], assetXDR, make([]bool, len(v1Import.Retirements))) {
+			t.Error("import issuance recognized as a migration")
+		}
+
+		// There is no version 4 to migrate to.
+		_, err = BuildMigrateTx(ctx, native, 4, 10, migrateTx.Issuances[0].Anchor, prv)
+		if err == nil {
+			t.Error("built a migration to an unknown version")
+		}
+
+		exportTx, err := BuildExportTx(ctx, native, 2, 10, 10, importTestAccountID, migrateTx.Issuances[0].Anchor, prv, 1, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := exportIssuanceVersion(exportTx, assetXDR); got != 2 {
+			t.Errorf("got issuance version %d of export of migrated value, want 2", got)
+		}
+	})
+}
+
+func submitTestTx(ctx context.Context, t *testing.T, c *Custodian, tx *bc.Tx) {
+	t.Helper()
+	r, err := c.S.submitTx(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.S.waitOnTx(ctx, tx.ID, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// importTestPeg pegs in amount of assetXDR for recip under ic
+// and returns the import tx.
+func importTestPeg(ctx context.Context, t *testing.T, c *Custodian, ic *issuanceContract, assetXDR, recip []byte, amount, expMS int64) *bc.Tx {
+	t.Helper()
+	prepegTx, err := buildPrePegInTx(ic, c.InitBlockHash.Bytes(), assetXDR, recip, amount, expMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitTestTx(ctx, t, c, prepegTx)
+	prog, err := c.buildImportTx(ic, amount, expMS, assetXDR, recip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runlimit int64
+	importTx, err := bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	importTx.Runlimit = math.MaxInt64 - runlimit
+	submitTestTx(ctx, t, c, importTx)
+	if got, want := importTx.Issuances[0].AssetID, ic.assetID(assetXDR); got != want {
+		t.Fatalf("version %d import issued asset %x, want %x", ic.version, got.Bytes(), want.Bytes())
+	}
+	return importTx
+}
+
+func TestImportOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	assetXDR, err := stellar.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recip, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			cfg:           config.Default(),
+		}
+		ic := issuanceContracts[LatestIssuanceVersion]
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		prepegTx, err := buildPrePegInTx(ic, c.InitBlockHash.Bytes(), assetXDR, recip, 100, expMS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, prepegTx)
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+		const q = `INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state, deposit_txid, deposit_op, issuance_version) VALUES ($1, 100, $2, $3, $4, $5, 'deposit', 2, $6)`
+		_, err = db.Exec(q, nonceHash[:], assetXDR, recip, expMS, pegInPaid, ic.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The import tx is a function of the peg-in and its deposit.
+		ref := depositRef("deposit", 2, 100, recip)
+		tx1, err := c.buildImportTx(ic, 100, expMS, assetXDR, recip, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx2, err := c.buildImportTx(ic, 100, expMS, assetXDR, recip, depositRef("deposit", 2, 100, recip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx1, tx2) {
+			t.Error("built two different import txs for one peg-in")
+		}
+		other, err := c.buildImportTx(ic, 100, expMS, assetXDR, recip, depositRef("deposit", 3, 100, recip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(tx1, other) {
+			t.Error("built the same import tx for another payment of the deposit")
+		}
+
+		importTxID := func() []byte {
+			t.Helper()
+			var txid []byte
+			err := db.QueryRow(`SELECT import_txid FROM pegs WHERE nonce_hash=$1 AND state=$2`, nonceHash[:], pegInImported).Scan(&txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return txid
+		}
+		err = c.importPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := importTxID()
+		for {
+			onChain, err := c.txOnChain(ctx, bc.HashFromBytes(first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if onChain {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("import tx not committed")
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		// A crash after the import tx was submitted
+		// but before the peg-in was marked imported
+		// leaves it paid, and importing it again does not resubmit.
+		_, err = db.Exec(`UPDATE pegs SET state=$1 WHERE nonce_hash=$2`, pegInPaid, nonceHash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.importPending(ctx)
+		if err != nil {
+			t.Fatalf("importing again after a crash: %s", err)
+		}
+		if again := importTxID(); !bytes.Equal(again, first) {
+			t.Errorf("got import tx %x after a crash, want %x", again, first)
+		}
+	})
+}
@@ -0,0 +1,368 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/op"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// In issuer mode the custodian manages its account
+// as the issuer of the wrapped assets:
+// it keeps the account's flags as configured,
+// authorizes the trustlines that wrapped peg-outs pay,
+// and reconciles the Stellar supply of each wrapped asset
+// with the slidechain reserve backing it.
+// Supply the issuer claws back on Stellar
+// is burned from the reserve in turn.
+
+// Alert kinds raised in issuer mode, and on clawbacks of pegged assets.
+const (
+	supplyMismatchAlert = "supply-mismatch"
+	clawbackAlert       = "clawback"
+)
+
+// setIssuerFlags sets the flags of the custodian account to those of cfg.
+// It does nothing if they are already set.
+func (s *stellarChain) setIssuerFlags(ctx context.Context, cfg config.Issuer) error {
+	addr := s.account
+	current, err := stellar.AccountFlags(ctx, s.hclient, addr)
+	if err != nil {
+		return errors.Wrap(err, "getting custodian account flags")
+	}
+	var opts stellar.SetOptions
+	setFlag := func(flag uint32, on bool) {
+		if on {
+			opts.SetFlags |= flag
+		} else {
+			opts.ClearFlags |= flag
+		}
+	}
+	if current.AuthRequired != cfg.AuthRequired {
+		setFlag(stellar.AuthRequired, cfg.AuthRequired)
+	}
+	if current.Clawback != cfg.Clawback {
+		setFlag(stellar.AuthClawbackEnabled, cfg.Clawback)
+	}
+	if current.AuthRevocable != cfg.AuthRevocable {
+		setFlag(stellar.AuthRevocable, cfg.AuthRevocable)
+	}
+	if opts.SetFlags == 0 && opts.ClearFlags == 0 {
+		return nil
+	}
+	_, err = s.seqs.SubmitContext(ctx, addr, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: s.network,
+			Source:  addr,
+			SeqNum:  seqnum,
+			Ops:     []stellar.Op{opts},
+		}, nil
+	}, s.seed)
+	if err != nil {
+		return errors.Wrap(err, "setting custodian account flags")
+	}
+	log.Printf("set custodian account flags: auth_required %t, auth_revocable %t, auth_clawback_enabled %t", cfg.AuthRequired, cfg.AuthRevocable, cfg.Clawback)
+	return nil
+}
+
+// trustlineRequest is the body of a POST to /admin/trustlines.
+type trustlineRequest struct {
+	Account   string `json:"account"`
+	Code      string `json:"code"` // of a wrapped asset
+	Authorize bool   `json:"authorize"`
+}
+
+// Trustlines is the admin handler that, in issuer mode,
+// authorizes or revokes a trustline to a wrapped asset,
+// as to freeze a holder's balance.
+func (c *Custodian) Trustlines(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "changing a trustline requires POST")
+		return
+	}
+	sc, ok := c.chain.(*stellarChain)
+	if cfg := c.config(); !ok || cfg == nil || !cfg.Issuer.Enabled {
+		net.Errorf(w, http.StatusNotFound, "issuer mode is not enabled")
+		return
+	}
+	var r trustlineRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	ctx := req.Context()
+	var n int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM wrapped_assets WHERE code=$1`, r.Code).Scan(&n)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading wrapped assets: %s", err)
+		return
+	}
+	if n == 0 {
+		net.Errorf(w, http.StatusBadRequest, "%s is not a wrapped asset", r.Code)
+		return
+	}
+	err = sc.allowTrust(ctx, r.Account, r.Code, r.Authorize)
+	if err != nil {
+		net.Errorf(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	action := "trustline.revoke"
+	if r.Authorize {
+		action = "trustline.authorize"
+	}
+	err = c.recordAudit(ctx, action, "admin-api "+req.RemoteAddr, fmt.Sprintf("%s to %s", r.Account, r.Code))
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Custodian) reconcileSupply(ctx context.Context, sc *stellarChain, interval time.Duration) {
+	defer log.Print("reconcileSupply exiting")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.checkSupply(ctx, sc)
+		if err != nil {
+			log.Printf("reconciling wrapped asset supply: %s", err)
+		}
+	}
+}
+
+// checkSupply compares the Stellar supply of each wrapped asset
+// with the supply the custodian expects,
+// recording each check in supply_checks.
+// The expected supply is the outstanding supply,
+// plus peg-outs applied but not yet posted,
+// less peg-ins and deposit refunds not yet imported or paid,
+// whose Stellar payments have burned or will issue the asset.
+//
+// A deficit in two checks running is supply the issuer clawed back,
+// and the lesser of the two is burned from the reserve.
+// (Requiring two rides out a peg-in or peg-out
+// caught between Stellar and the db.)
+// A surplus is unbacked by the reserve
+// and raises an alert.
+func (c *Custodian) checkSupply(ctx context.Context, sc *stellarChain) error {
+	assets, err := c.wrappedAssets(ctx)
+	if err != nil {
+		return err
+	}
+	issuer := sc.account
+	for i := range assets {
+		w := &assets[i]
+		supply, err := stellar.AssetSupply(ctx, sc.hclient, w.Code, issuer)
+		if err != nil {
+			return err
+		}
+		expected, err := c.expectedSupply(ctx, w, issuer)
+		if err != nil {
+			return err
+		}
+		nowMS := c.nowMS()
+		var prevSupply, prevExpected sql.NullInt64
+		const prevQ = `SELECT stellar, expected FROM supply_checks WHERE code=$1 ORDER BY time_ms DESC LIMIT 1`
+		err = c.DB.QueryRowContext(ctx, prevQ, w.Code).Scan(&prevSupply, &prevExpected)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.Wrapf(err, "reading last supply check of %s", w.Code)
+		}
+		_, err = c.DB.ExecContext(ctx, `INSERT INTO supply_checks (code, time_ms, stellar, expected) VALUES ($1, $2, $3, $4)`, w.Code, nowMS, supply, expected)
+		if err != nil {
+			return errors.Wrapf(err, "recording supply check of %s", w.Code)
+		}
+		switch {
+		case supply > expected:
+			key := []byte(fmt.Sprintf("%s/%d", w.Code, supply-expected))
+			alerted, err := c.alerted(ctx, supplyMismatchAlert, key)
+			if err != nil {
+				return err
+			}
+			if !alerted {
+				err = c.alert(ctx, supplyMismatchAlert, key, fmt.Sprintf("Stellar supply %d of wrapped asset %s exceeds the %d the reserve backs", supply, w.Code, expected))
+				if err != nil {
+					return err
+				}
+			}
+		case supply < expected && prevSupply.Valid && prevSupply.Int64 < prevExpected.Int64:
+			deficit := expected - supply
+			if d := prevExpected.Int64 - prevSupply.Int64; d < deficit {
+				deficit = d
+			}
+			// Only whole txvm units are burned;
+			// a deficit of less than one is left.
+			perUnit, err := stroopsPerUnit(w.Decimals)
+			if err != nil {
+				return err
+			}
+			if deficit < perUnit {
+				continue
+			}
+			err = c.burnReserve(ctx, w, deficit/perUnit)
+			if err != nil {
+				return errors.Wrapf(err, "burning %d of %s", deficit/perUnit, w.Code)
+			}
+		}
+	}
+	return nil
+}
+
+// expectedSupply is the Stellar supply of w the custodian expects, in stroops.
+func (c *Custodian) expectedSupply(ctx context.Context, w *wrappedAsset, issuer string) (int64, error) {
+	asset, err := stellar.NewAsset(w.Code, issuer)
+	if err != nil {
+		return 0, err
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		return 0, errors.Wrap(err, "marshaling asset")
+	}
+	// The outstanding supply and the reserve are in txvm units,
+	// and peg-ins and refunds in stroops.
+	const unitsQ = `SELECT
+		(SELECT outstanding FROM wrapped_assets WHERE code=$1)
+		+ (SELECT COALESCE(SUM(r.amount), 0) FROM reserve r JOIN exports e ON e.txid=r.export_txid WHERE r.txvm_asset=$2 AND e.pegged_out=$3)`
+	var units int64
+	err = c.DB.QueryRowContext(ctx, unitsQ, w.Code, w.TxvmAsset, pegOutOK).Scan(&units)
+	if err != nil {
+		return 0, errors.Wrapf(err, "computing expected supply of %s", w.Code)
+	}
+	issued, err := ToStellarAmount(units, w.Decimals)
+	if err != nil {
+		return 0, errors.Wrapf(err, "converting expected supply of %s", w.Code)
+	}
+	const pendingQ = `SELECT
+		(SELECT COALESCE(SUM(amount), 0) FROM pegs WHERE asset_xdr=$1 AND state=$2)
+		+ (SELECT COALESCE(SUM(amount), 0) FROM deposit_refunds WHERE asset_xdr=$1 AND state!=$3)`
+	var pending int64
+	err = c.DB.QueryRowContext(ctx, pendingQ, assetXDR, pegInPaid, refundPaid).Scan(&pending)
+	return issued - pending, errors.Wrapf(err, "computing expected supply of %s", w.Code)
+}
+
+// burnReserve retires amount of the reserve backing w,
+// for Stellar supply clawed back by the issuer,
+// keeping the reserve invariant.
+func (c *Custodian) burnReserve(ctx context.Context, w *wrappedAsset, amount int64) error {
+	var (
+		inputs []*reserveOutput
+		total  int64
+	)
+	const q = `SELECT anchor, amount FROM reserve WHERE txvm_asset=$1 AND export_txid IS NULL ORDER BY amount DESC`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, w.TxvmAsset, func(anchor []byte, amt int64) {
+		if total < amount {
+			inputs = append(inputs, &reserveOutput{Anchor: anchor, TxvmAsset: w.TxvmAsset, Amount: amt})
+			total += amt
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading reserve")
+	}
+	if total < amount {
+		// Only supply the reserve backs can be clawed back.
+		amount = total
+	}
+	if amount == 0 {
+		return nil
+	}
+	tx, err := c.buildBurnTx(inputs, amount)
+	if err != nil {
+		return errors.Wrap(err, "building burn tx")
+	}
+	var change *reserveOutput
+	for _, out := range tx.Outputs {
+		if r, _ := reserveFromOutput(tx, out); r != nil {
+			change = r
+		}
+	}
+	err = c.submitAndWait(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "submitting burn tx")
+	}
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	for _, r := range inputs {
+		_, err = dbtx.ExecContext(ctx, `DELETE FROM reserve WHERE anchor=$1`, r.Anchor)
+		if err != nil {
+			return errors.Wrap(err, "deleting spent reserve output")
+		}
+	}
+	if change != nil {
+		err = insertReserve(ctx, dbtx, change, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.changeOutstanding(ctx, dbtx, w, -amount)
+	if err != nil {
+		return err
+	}
+	nowMS := c.nowMS()
+	_, err = dbtx.ExecContext(ctx, `INSERT INTO wrapped_burns (code, amount, txid, time_ms) VALUES ($1, $2, $3, $4)`, w.Code, amount, tx.ID.Bytes(), nowMS)
+	if err != nil {
+		return errors.Wrap(err, "recording burn")
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing burn")
+	}
+	log.Printf("burned %d of txvm asset %x (Stellar %s) clawed back on Stellar, in tx %x", amount, w.TxvmAsset, w.Code, tx.ID.Bytes())
+	return c.alert(ctx, clawbackAlert, tx.ID.Bytes(), fmt.Sprintf("%d of wrapped asset %s was clawed back on Stellar and burned from the reserve in tx %x", amount, w.Code, tx.ID.Bytes()))
+}
+
+// buildBurnTx builds the tx retiring amount from the reserve inputs,
+// with any change back to the reserve.
+func (c *Custodian) buildBurnTx(inputs []*reserveOutput, amount int64) (*bc.Tx, error) {
+	b := new(txvmutil.Builder)
+	for i, r := range inputs {
+		spendReserve(b, r) // con stack: sigcheck..., [value,] sigcheck, value
+		if i > 0 {
+			b.PushdataInt64(2).Op(op.Roll).Op(op.Merge) // con stack: sigcheck..., sigcheck, value
+		}
+	}
+	b.PushdataInt64(0).Op(op.Split)      // con stack: sigcheck..., value, zeroval
+	b.PushdataInt64(1).Op(op.Roll)       // con stack: sigcheck..., zeroval, value
+	b.PushdataInt64(amount).Op(op.Split) // con stack: sigcheck..., zeroval, change, value
+	b.Op(op.Retire)                      // con stack: sigcheck..., zeroval, change
+	var total int64
+	for _, r := range inputs {
+		total += r.Amount
+	}
+	if total > amount {
+		payTo(b, custodianPub) // con stack: sigcheck..., zeroval
+	} else {
+		b.Op(op.Drop)
+	}
+	b.Op(op.Finalize) // con stack: sigcheck...
+	vm, err := txvm.Validate(b.Build(), 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	for i := len(inputs) - 1; i >= 0; i-- {
+		c.signReserve(b, vm.TxID, inputs[i])
+	}
+	return newTx(b.Build())
+}
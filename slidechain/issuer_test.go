@@ -0,0 +1,208 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/asm"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestIssuerMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	holderKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(holderKP.Address(), horizonmock.FriendbotAmount)
+	submit := func(kp *keypair.Full, op stellar.Op) {
+		t.Helper()
+		_, err := stellar.NewSequencer(srv.Client()).Submit(kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  kp.Address(),
+				SeqNum:  seqnum,
+				Ops:     []stellar.Op{op},
+			}, nil
+		}, kp.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 100 * time.Millisecond
+		accountID := custKP.Address()
+		now := time.Now()
+		sc := newStellarChain(srv.Client(), accountID, custKP.Seed(), srv.Passphrase)
+		c := &Custodian{
+			imports:       sync.NewCond(new(sync.Mutex)),
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			AccountID:     accountID,
+			chain:         sc,
+			cfg:           config.Default(),
+			now:           func() time.Time { return now },
+		}
+		c.cfg.Issuer = config.Issuer{Enabled: true, AuthRequired: true, AuthRevocable: true, Clawback: true}
+
+		err = sc.setIssuerFlags(ctx, c.cfg.Issuer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, err := stellar.AccountFlags(ctx, srv.Client(), custKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (stellar.IssuerFlags{AuthRequired: true, AuthRevocable: true, Clawback: true}); flags != want {
+			t.Errorf("got custodian flags %+v, want %+v", flags, want)
+		}
+
+		// The reserve holds 600 of a slidechain-native asset,
+		// backing 600 of the wrapped asset held on Stellar.
+		issueProg := asm.MustAssemble("get 600 'NAT' issue put")
+		seed := txvm.ContractSeed(issueProg)
+		assetID := bc.NewHash(txvm.AssetID(seed[:], []byte("NAT")))
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		issueTx, err := newTx(asm.MustAssemble(fmt.Sprintf(
+			"x'%x' %d nonce 0 split '' put put x'%x' contract call {x'%x'} put 1 put x'%x' contract call finalize",
+			c.InitBlockHash.Bytes(), expMS, issueProg, []byte(custodianPub), standard.PayToMultisigProg1,
+		)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.submitAndWait(ctx, issueTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &wrappedAsset{Code: "NAT", TxvmAsset: assetID.Bytes(), Decimals: 7}
+		err = c.registerWrappedAsset(ctx, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbtx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertReserve(ctx, dbtx, &reserveOutput{Anchor: txresult.New(issueTx).Outputs[0].Value.Anchor, TxvmAsset: assetID.Bytes(), Amount: 600}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.changeOutstanding(ctx, dbtx, w, 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dbtx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(holderKP, stellar.ChangeTrust{Asset: stellar.Asset{Code: "NAT", Issuer: custKP.Address()}, Limit: stellar.MaxTrustLimit})
+		err = sc.allowTrust(ctx, holderKP.Address(), "NAT", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(custKP, stellar.Payment{
+			Destination: holderKP.Address(),
+			Asset:       stellar.Asset{Code: "NAT", Issuer: custKP.Address()},
+			Amount:      600,
+		})
+
+		check := func() {
+			t.Helper()
+			now = now.Add(time.Minute)
+			err := c.checkSupply(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		outstanding := func() int64 {
+			t.Helper()
+			var n int64
+			err := db.QueryRow(`SELECT outstanding FROM wrapped_assets WHERE code='NAT'`).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		count := func(q string) int {
+			t.Helper()
+			var n int
+			err := db.QueryRow(q).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		check()
+		if n := count(`SELECT COUNT(*) FROM alerts`); n != 0 {
+			t.Errorf("got %d alerts for a reconciled supply, want none", n)
+		}
+
+		// A clawback is burned from the reserve
+		// once two checks find it.
+		nat, err := stellar.NewAsset("NAT", custKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = srv.Clawback(holderKP.Address(), nat, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+		if got := outstanding(); got != 600 {
+			t.Errorf("after one check, got outstanding supply %d, want 600", got)
+		}
+		check()
+		if got := outstanding(); got != 400 {
+			t.Errorf("after two checks, got outstanding supply %d, want 400", got)
+		}
+		if n := count(`SELECT COALESCE(SUM(amount), 0) FROM wrapped_burns WHERE code='NAT'`); n != 200 {
+			t.Errorf("got %d burned, want 200", n)
+		}
+		if n := count(`SELECT COUNT(*) FROM alerts WHERE kind='clawback'`); n != 1 {
+			t.Errorf("got %d clawback alerts, want 1", n)
+		}
+		check()
+		if got := outstanding(); got != 400 {
+			t.Errorf("after a reconciled check, got outstanding supply %d, want 400", got)
+		}
+
+		// Supply issued outside a peg-out is unbacked.
+		submit(custKP, stellar.Payment{
+			Destination: holderKP.Address(),
+			Asset:       stellar.Asset{Code: "NAT", Issuer: custKP.Address()},
+			Amount:      50,
+		})
+		check()
+		check()
+		if n := count(`SELECT COUNT(*) FROM alerts WHERE kind='supply-mismatch'`); n != 1 {
+			t.Errorf("got %d supply-mismatch alerts, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package slidechain
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+const kycLimitAlert = "kyc-limit"
+
+// KYCAccount is the request body of a POST to /kyc/accounts
+// and the response to a GET.
+type KYCAccount struct {
+	Pubkey []byte `json:"pubkey"`
+	Tier   string `json:"tier"`
+
+	// Reference is the KYC system's own identifier for the customer.
+	Reference string `json:"reference"`
+
+	UpdatedMS int64 `json:"updated_ms,omitempty"`
+
+	// Customer is the information registered for pubkey through SEP-12,
+	// for the KYC system to review.
+	// It is ignored in a POST.
+	Customer map[string]string `json:"customer,omitempty"`
+}
+
+// KYCAccounts is the handler for /kyc/accounts,
+// through which the external KYC system
+// looks up (GET, with a hex pubkey parameter)
+// and assigns (POST a KYCAccount) the tiers of slidechain pubkeys.
+// It authenticates with kyc.api_key as a bearer token.
+func (c *Custodian) KYCAccounts(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if cfg == nil || len(cfg.KYC.Tiers) == 0 {
+		net.Errorf(w, http.StatusNotFound, "KYC tiers are not configured")
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(cfg.KYC.APIKey)) != 1 {
+		net.Errorf(w, http.StatusForbidden, "missing or wrong bearer key")
+		return
+	}
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		pubkey, err := hex.DecodeString(req.FormValue("pubkey"))
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			net.Errorf(w, http.StatusBadRequest, "pubkey must be a hex %d-byte ed25519 public key", ed25519.PublicKeySize)
+			return
+		}
+		a := KYCAccount{Pubkey: pubkey}
+		const q = `SELECT tier, reference, updated_ms FROM accounts WHERE pubkey=$1`
+		err = c.DB.QueryRowContext(ctx, q, pubkey).Scan(&a.Tier, &a.Reference, &a.UpdatedMS)
+		if err != nil && err != sql.ErrNoRows {
+			net.Errorf(w, http.StatusInternalServerError, "looking up account: %s", err)
+			return
+		}
+		a.Tier = kycTier(cfg.KYC, a.Tier)
+		if len(cfg.SEP12.Clients) > 0 {
+			_, a.Customer, err = c.sep12Fields(ctx, cfg.SEP12, pubkey)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+
+	case http.MethodPost:
+		var a KYCAccount
+		err := json.NewDecoder(req.Body).Decode(&a)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+			return
+		}
+		if len(a.Pubkey) != ed25519.PublicKeySize {
+			net.Errorf(w, http.StatusBadRequest, "pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+			return
+		}
+		if kycTier(cfg.KYC, a.Tier) != a.Tier {
+			net.Errorf(w, http.StatusBadRequest, "unknown tier %q", a.Tier)
+			return
+		}
+		err = c.setKYCTier(ctx, cfg.KYC, a.Pubkey, a.Tier, a.Reference, "kyc-api "+req.RemoteAddr)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "KYC accounts support GET and POST")
+	}
+}
+
+// setKYCTier assigns pubkey the given tier,
+// with the KYC system's reference for the customer,
+// auditing the change as made by source.
+func (c *Custodian) setKYCTier(ctx context.Context, cfg config.KYC, pubkey []byte, tier, reference, source string) error {
+	var old string
+	err := c.DB.QueryRowContext(ctx, `SELECT tier FROM accounts WHERE pubkey=$1`, pubkey).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrapf(err, "looking up account %x", pubkey)
+	}
+	const q = `INSERT INTO accounts (pubkey, tier, reference, updated_ms) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (pubkey) DO UPDATE SET tier=excluded.tier, reference=excluded.reference, updated_ms=excluded.updated_ms`
+	_, err = c.DB.ExecContext(ctx, q, pubkey, tier, reference, c.nowMS())
+	if err != nil {
+		return errors.Wrapf(err, "recording account %x", pubkey)
+	}
+	detail := fmt.Sprintf("%x: %s -> %s (%s)", pubkey, kycTier(cfg, old), tier, reference)
+	err = c.recordAudit(ctx, "kyc.tier", source, detail)
+	if err != nil {
+		return err
+	}
+	// Pegs held by the old tier's limits may now proceed.
+	if c.imports != nil {
+		c.imports.Broadcast()
+	}
+	if c.exports != nil {
+		c.exports.Broadcast()
+	}
+	return nil
+}
+
+// kycTier returns tier if it is in kyc.tiers,
+// and otherwise the first tier.
+func kycTier(cfg config.KYC, tier string) string {
+	for _, t := range cfg.Tiers {
+		if t == tier {
+			return tier
+		}
+	}
+	return cfg.Tiers[0]
+}
+
+// checkKYC reports whether an import (of a peg-in) or export,
+// identified by key, of the given amount for pubkey
+// is within the limits of pubkey's tier,
+// counting it toward them if so.
+// A limit on ValueAsset counts the value of every asset
+// as priced by the oracle when it was used;
+// a peg that cannot be priced is held by it.
+// The first time a peg is held for exceeding a limit,
+// operators are alerted.
+func (c *Custodian) checkKYC(ctx context.Context, direction string, pubkey, assetXDR []byte, amount int64, key []byte) (bool, error) {
+	cfg := c.config()
+	if cfg == nil || len(cfg.KYC.Tiers) == 0 {
+		return true, nil
+	}
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kyc_usage WHERE direction=$1 AND key=$2`, direction, key).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "looking up KYC usage of %s %x", direction, key)
+	}
+	if n > 0 {
+		return true, nil
+	}
+	var tier string
+	err = c.DB.QueryRowContext(ctx, `SELECT tier FROM accounts WHERE pubkey=$1`, pubkey).Scan(&tier)
+	if err != nil && err != sql.ErrNoRows {
+		return false, errors.Wrapf(err, "looking up tier of %x", pubkey)
+	}
+	tier = kycTier(cfg.KYC, tier)
+
+	asset := assetName(assetXDR)
+	var (
+		value    sql.NullInt64
+		priceErr error
+	)
+	if cfg.Oracle.Currency != "" {
+		value.Int64, priceErr = c.pegValue(ctx, assetXDR, amount)
+		value.Valid = priceErr == nil
+	}
+	hold := func(detail string) (bool, error) {
+		alerted, err := c.alerted(ctx, kycLimitAlert, key)
+		if err != nil || alerted {
+			return false, err
+		}
+		return false, c.alert(ctx, kycLimitAlert, key, detail)
+	}
+	now := time.Unix(0, c.nowMS()*int64(time.Millisecond)).UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range cfg.KYC.Limits {
+		l, err := config.ParseKYCLimit(s)
+		if err != nil || l.Tier != tier || l.Direction != direction || (l.Asset != asset && l.Asset != config.ValueAsset) {
+			continue
+		}
+		used, q := amount, `SELECT COALESCE(SUM(amount), 0) FROM kyc_usage WHERE pubkey=$1 AND direction=$2 AND time_ms >= $3 AND asset_xdr=$4`
+		if l.Asset == config.ValueAsset {
+			if !value.Valid {
+				return hold(fmt.Sprintf("%s %x of %d %s for %x held: tier %s has a value limit and it cannot be priced: %s", direction, key, amount, asset, pubkey, tier, priceErr))
+			}
+			used, q = value.Int64, `SELECT COALESCE(SUM(value), 0) FROM kyc_usage WHERE pubkey=$1 AND direction=$2 AND time_ms >= $3`
+		}
+		for _, w := range []struct {
+			name  string
+			limit int64
+			since time.Time
+		}{{"daily", l.Daily, day}, {"monthly", l.Monthly, month}} {
+			if w.limit < 0 {
+				continue
+			}
+			args := []interface{}{pubkey, direction, w.since.UnixNano() / int64(time.Millisecond)}
+			if l.Asset != config.ValueAsset {
+				args = append(args, assetXDR)
+			}
+			var total int64
+			err = c.DB.QueryRowContext(ctx, q, args...).Scan(&total)
+			if err != nil {
+				return false, errors.Wrapf(err, "totaling %s usage of %x", direction, pubkey)
+			}
+			if total+used <= w.limit {
+				continue
+			}
+			return hold(fmt.Sprintf("%s %x of %d %s for %x held: tier %s %s %s limit %d, %d used", direction, key, amount, asset, pubkey, tier, w.name, l.Asset, w.limit, total))
+		}
+	}
+	const q = `INSERT INTO kyc_usage (direction, key, pubkey, asset_xdr, amount, value, time_ms) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = c.DB.ExecContext(ctx, q, direction, key, pubkey, assetXDR, amount, value, c.nowMS())
+	return err == nil, errors.Wrapf(err, "recording KYC usage of %s %x", direction, key)
+}
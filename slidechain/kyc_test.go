@@ -0,0 +1,185 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/screening"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestKYC(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		screener := &testScreener{results: make(map[string]screening.Result)}
+		cfg := config.Default()
+		cfg.KYC.Tiers = []string{"basic", "full"}
+		cfg.KYC.Limits = []string{"basic:export:native=100,150", "basic:import:native=,50"}
+		cfg.KYC.APIKey = "kyckey"
+		now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, screener: screener, cfg: cfg, now: func() time.Time { return now }}
+
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		export := func(b byte, amount int64) *pegOut {
+			t.Helper()
+			p := &pegOut{TxID: bytes.Repeat([]byte{b}, 32), AssetXDR: lumenXDR, Amount: amount, Exporter: importTestAccountID, Pubkey: pub}
+			_, err := db.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, '', 0, $4, x'', $5)", p.TxID, p.Amount, p.AssetXDR, p.Exporter, p.Pubkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			screener.results[hex.EncodeToString(p.TxID)] = screening.Result{Decision: screening.Approve}
+			return p
+		}
+		check := func(p *pegOut, want bool) {
+			t.Helper()
+			ok, err := c.screenPegOut(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("screening export %x of %d gave %v, want %v", p.TxID[:1], p.Amount, ok, want)
+			}
+		}
+		do := func(method, target, key string, body []byte, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest(method, target, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+key)
+			w := httptest.NewRecorder()
+			c.KYCAccounts(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from %s %s, want %d: %s", w.Code, method, target, wantCode, w.Body)
+			}
+			return w
+		}
+
+		a, b := export(1, 60), export(2, 60)
+		check(a, true)
+		check(b, false) // over the daily limit
+		check(b, false)
+		check(a, true) // counted once
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, kycLimitAlert, b.TxID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d %s alerts, want 1", n, kycLimitAlert)
+		}
+
+		now = now.Add(24 * time.Hour)
+		check(b, true)
+		cc := export(3, 60)
+		check(cc, false) // over the monthly limit
+
+		// Limits are per direction.
+		ok, err := c.checkKYC(ctx, "import", pub, lumenXDR, 60, bytes.Repeat([]byte{4}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("import over the monthly limit was allowed")
+		}
+
+		body, err := json.Marshal(KYCAccount{Pubkey: pub, Tier: "full", Reference: "cust-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		do("POST", "/kyc/accounts", "wrong", body, http.StatusForbidden)
+		bad, err := json.Marshal(KYCAccount{Pubkey: pub, Tier: "platinum"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		do("POST", "/kyc/accounts", "kyckey", bad, http.StatusBadRequest)
+		do("POST", "/kyc/accounts", "kyckey", body, http.StatusNoContent)
+		check(cc, true)
+
+		var got KYCAccount
+		err = json.NewDecoder(do("GET", "/kyc/accounts?pubkey="+hex.EncodeToString(pub), "kyckey", nil, http.StatusOK).Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Tier != "full" || got.Reference != "cust-1" {
+			t.Errorf("got account %+v, want tier full with reference cust-1", got)
+		}
+		err = db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE action='kyc.tier'`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d kyc.tier audit entries, want 1", n)
+		}
+	})
+}
+
+func TestKYCValueLimit(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.Oracle.Currency = "USD:GBSTRH4QOTWNSVA6E4HFERETX4ZLSR3CIUBLK7AXYII277PFJC4BBYOG"
+		cfg.Oracle.Source = "static"
+		cfg.Oracle.Rates = []string{"native=1/4"}
+		cfg.KYC.Tiers = []string{"basic"}
+		cfg.KYC.Limits = []string{"basic:import:value=100,"}
+		now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, cfg: cfg, now: func() time.Time { return now }}
+
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(b byte, assetXDR []byte, amount int64, want bool) {
+			t.Helper()
+			ok, err := c.checkKYC(ctx, "import", pub, assetXDR, amount, bytes.Repeat([]byte{b}, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("import %d of %d %s gave %v, want %v", b, amount, assetName(assetXDR), ok, want)
+			}
+		}
+		check(1, lumenXDR, 300, true)  // worth 75
+		check(2, lumenXDR, 120, false) // worth 30, over the daily limit
+		check(3, lumenXDR, 100, true)  // worth 25
+
+		// An asset with no rate cannot be counted against the limit.
+		other, err := stellar.ParseAssetKey("EUR:GBSTRH4QOTWNSVA6E4HFERETX4ZLSR3CIUBLK7AXYII277PFJC4BBYOG")
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherXDR, err := other.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(24 * time.Hour)
+		check(4, otherXDR, 1, false)
+		check(5, lumenXDR, 120, true)
+	})
+}
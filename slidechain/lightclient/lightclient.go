@@ -0,0 +1,181 @@
+// Package lightclient follows the slidechain header chain
+// without downloading transactions,
+// so that a wallet can check inclusion proofs of its imports and exports
+// trusting only the initial block.
+//
+// Each block header names the validator set, its NextPredicate,
+// that must sign the block after it,
+// so a client that verifies every header in order
+// also follows every change of the validator set.
+package lightclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+// ErrHeader means a header does not extend the client's chain.
+var ErrHeader = errors.New("header does not extend the chain")
+
+// Client is a header chain verified from a trusted initial block.
+type Client struct {
+	mu      sync.Mutex
+	tip     *bc.BlockHeader
+	headers []*bc.BlockHeader // by height-1
+	hashes  []bc.Hash         // block IDs by height-1
+}
+
+// New returns a Client that trusts the given initial block.
+func New(initial *bc.BlockHeader) *Client {
+	return &Client{
+		tip:     initial,
+		headers: []*bc.BlockHeader{initial},
+		hashes:  []bc.Hash{initial.Hash()},
+	}
+}
+
+// Tip returns the latest verified header.
+func (c *Client) Tip() *bc.BlockHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip
+}
+
+// Apply verifies that b extends the chain,
+// signed by the validator set of the current tip,
+// and makes it the new tip.
+// A header at or below the tip that matches the verified one is ignored.
+func (c *Client) Apply(b *bc.Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b.BlockHeader == nil {
+		return errors.WithDetail(ErrHeader, "missing header")
+	}
+	if b.Height <= c.tip.Height {
+		if b.Hash() != c.hashes[b.Height-1] {
+			return errors.WithDetailf(ErrHeader, "conflicting block at height %d", b.Height)
+		}
+		return nil
+	}
+	if b.Height != c.tip.Height+1 {
+		return errors.WithDetailf(ErrHeader, "height %d after tip %d", b.Height, c.tip.Height)
+	}
+	if b.PreviousBlockId == nil || *b.PreviousBlockId != c.hashes[len(c.hashes)-1] {
+		return errors.WithDetailf(ErrHeader, "block %d does not follow the tip", b.Height)
+	}
+	if b.TimestampMs <= c.tip.TimestampMs {
+		return errors.WithDetailf(ErrHeader, "block %d timestamp does not increase", b.Height)
+	}
+	if b.NextPredicate == nil {
+		return errors.WithDetailf(ErrHeader, "block %d has no next predicate", b.Height)
+	}
+	err := txproof.CheckSignatures(b, c.tip.NextPredicate)
+	if err != nil {
+		return errors.Wrapf(err, "block %d", b.Height)
+	}
+	c.tip = b.BlockHeader
+	c.headers = append(c.headers, b.BlockHeader)
+	c.hashes = append(c.hashes, b.Hash())
+	return nil
+}
+
+// Rollback discards the verified headers above height,
+// as the server does when a rollback invalidates them,
+// making the header at height the tip.
+func (c *Client) Rollback(height uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height == 0 || height > c.tip.Height {
+		return fmt.Errorf("cannot roll back to height %d from tip %d", height, c.tip.Height)
+	}
+	c.headers = c.headers[:height]
+	c.hashes = c.hashes[:height]
+	c.tip = c.headers[height-1]
+	return nil
+}
+
+// VerifyProof checks an inclusion proof
+// against the verified header at its height,
+// returning that header.
+// The header must already have been applied.
+func (c *Client) VerifyProof(p *txproof.Proof) (*bc.BlockHeader, error) {
+	b, err := txproof.Verify(p)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b.Height == 0 || b.Height > uint64(len(c.hashes)) {
+		return nil, fmt.Errorf("proof is for block %d, beyond tip %d", b.Height, c.tip.Height)
+	}
+	if b.Hash() != c.hashes[b.Height-1] {
+		return nil, errors.WithDetailf(ErrHeader, "proof is for an unverified block at height %d", b.Height)
+	}
+	return b.BlockHeader, nil
+}
+
+// Sync applies the headers streamed by the slidechain server at url
+// after the tip,
+// rolling back first if the server says the tip is no longer on its chain.
+// It returns when the stream ends, ctx is canceled,
+// or a header fails verification.
+func (c *Client) Sync(ctx context.Context, url string) error {
+	tip := c.Tip()
+	tipID := tip.Hash()
+	url = fmt.Sprintf("%s/headers?from=%d&prev=%x", strings.TrimRight(url, "/"), tip.Height+1, tipID.Bytes())
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "requesting %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status code %d from %s", resp.StatusCode, url)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var msg struct {
+			Block    []byte `json:"block"`
+			Rollback uint64 `json:"rollback"`
+		}
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			return errors.Wrap(err, "parsing header")
+		}
+		if msg.Block == nil {
+			err = c.Rollback(msg.Rollback)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		b := new(bc.Block)
+		err = b.FromBytes(msg.Block)
+		if err != nil {
+			return errors.Wrap(err, "parsing block")
+		}
+		err = c.Apply(b)
+		if err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Wrap(scanner.Err(), "reading headers")
+}
@@ -0,0 +1,24 @@
+package slidechain
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// debugLogging is nonzero when the log level is "debug".
+var debugLogging int32
+
+func setLogLevel(level string) {
+	var v int32
+	if level == "debug" {
+		v = 1
+	}
+	atomic.StoreInt32(&debugLogging, v)
+}
+
+// debugf logs only when the log level is "debug".
+func debugf(format string, args ...interface{}) {
+	if atomic.LoadInt32(&debugLogging) != 0 {
+		log.Printf(format, args...)
+	}
+}
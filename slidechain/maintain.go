@@ -0,0 +1,229 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+)
+
+// A hotQuery is a query the custodian runs often
+// that must not slow down as history grows,
+// with the index that serves it.
+type hotQuery struct {
+	name  string
+	q     string
+	args  []interface{}
+	index string // name of the index, or empty if the primary key serves
+	def   string // its definition
+}
+
+// hotQueries are the queries Maintain reports plans for.
+// Their shapes follow the queries of pegOutPending, importPending,
+// watchPegIns, and selectOutputs.
+var hotQueries = []hotQuery{
+	{
+		name:  "pending exports",
+		q:     `SELECT txid FROM exports WHERE pegged_out IN ($1, $2)`,
+		args:  []interface{}{pegOutNotYet, pegOutRetry},
+		index: "exports_pegged_out",
+		def:   `CREATE INDEX IF NOT EXISTS exports_pegged_out ON exports (pegged_out)`,
+	},
+	{
+		name:  "peg-ins to import",
+		q:     `SELECT nonce_hash FROM pegs WHERE state=$1`,
+		args:  []interface{}{pegInPaid},
+		index: "pegs_state",
+		def:   `CREATE INDEX IF NOT EXISTS pegs_state ON pegs (state)`,
+	},
+	{
+		name: "deposit cursor",
+		q:    `SELECT cursor FROM custodian WHERE seed=$1`,
+		args: []interface{}{""},
+	},
+	{
+		name: "unspent outputs by pubkey",
+		q: `SELECT output_id, anchor, amount FROM utxos
+			WHERE pubkeys=$1 AND quorum=1 AND txvm_asset=$2 AND spent_height IS NULL AND anchor IS NOT NULL
+			ORDER BY amount DESC, output_id`,
+		args:  []interface{}{[]byte{}, []byte{}},
+		index: "utxos_unspent_by_pubkey",
+		def:   `CREATE INDEX IF NOT EXISTS utxos_unspent_by_pubkey ON utxos (pubkeys, txvm_asset, amount DESC, output_id) WHERE spent_height IS NULL`,
+	},
+}
+
+// MaintainOptions says what Maintain changes besides reporting.
+type MaintainOptions struct {
+	Fix    bool // create missing indexes, rebuild existing ones, and analyze
+	Vacuum bool // compact the db; slidechaind should be stopped
+}
+
+// MaintenanceReport is the result of Maintain.
+type MaintenanceReport struct {
+	Tables  []TableGrowth `json:"tables"`
+	Queries []QueryPlan   `json:"queries"`
+
+	PageSize   int64 `json:"page_size"`
+	Pages      int64 `json:"pages"`
+	FreePages  int64 `json:"free_pages"` // reclaimed by a vacuum
+	Vacuumed   bool  `json:"vacuumed,omitempty"`
+	PagesAfter int64 `json:"pages_after,omitempty"` // after the vacuum
+}
+
+// TableGrowth is the size of a table
+// and its growth since the last run of Maintain.
+type TableGrowth struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Growth int64  `json:"growth"`            // rows since the last run
+	LastMS int64  `json:"last_ms,omitempty"` // time of the last run, if any
+}
+
+// QueryPlan is SQLite's plan for a hot query.
+type QueryPlan struct {
+	Name     string   `json:"name"`
+	Index    string   `json:"index,omitempty"` // the index that should serve it
+	Missing  bool     `json:"missing,omitempty"`
+	Created  bool     `json:"created,omitempty"`
+	FullScan bool     `json:"full_scan,omitempty"`
+	Plan     []string `json:"plan"`
+}
+
+// Maintain analyzes the db for an operator:
+// the growth of each table since the last run,
+// the free pages a vacuum would reclaim,
+// and the plan of each hot query
+// with whether its index is missing.
+// With opts.Fix it first creates the missing indexes,
+// rebuilds the rest, and updates the planner's statistics;
+// with opts.Vacuum it compacts the db last.
+func Maintain(ctx context.Context, db *sql.DB, opts MaintainOptions, now time.Time) (*MaintenanceReport, error) {
+	err := setSchema(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting db schema")
+	}
+	r := new(MaintenanceReport)
+
+	indexes := make(map[string]bool)
+	err = sqlutil.ForQueryRows(ctx, db, `SELECT name FROM sqlite_master WHERE type='index'`, func(name string) {
+		indexes[name] = true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing indexes")
+	}
+	for _, hq := range hotQueries {
+		p := QueryPlan{Name: hq.name, Index: hq.index}
+		if hq.index != "" && !indexes[hq.index] {
+			p.Missing = true
+		}
+		if opts.Fix && hq.index != "" {
+			if p.Missing {
+				_, err = db.ExecContext(ctx, hq.def)
+				p.Missing, p.Created = false, true
+			} else {
+				_, err = db.ExecContext(ctx, `REINDEX `+hq.index)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "building index %s", hq.index)
+			}
+		}
+		r.Queries = append(r.Queries, p)
+	}
+	if opts.Fix {
+		_, err = db.ExecContext(ctx, `ANALYZE`)
+		if err != nil {
+			return nil, errors.Wrap(err, "analyzing")
+		}
+	}
+	for i, hq := range hotQueries {
+		plan, err := queryPlan(ctx, db, hq.q, hq.args...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "planning %s", hq.name)
+		}
+		r.Queries[i].Plan = plan
+		for _, step := range plan {
+			if strings.HasPrefix(step, "SCAN TABLE") && !strings.Contains(step, " USING ") {
+				r.Queries[i].FullScan = true
+			}
+		}
+	}
+
+	r.Tables, err = tableGrowth(ctx, db, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range []struct {
+		name string
+		dst  *int64
+	}{{"page_size", &r.PageSize}, {"page_count", &r.Pages}, {"freelist_count", &r.FreePages}} {
+		err = db.QueryRowContext(ctx, `PRAGMA `+pragma.name).Scan(pragma.dst)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", pragma.name)
+		}
+	}
+
+	if opts.Vacuum {
+		_, err = db.ExecContext(ctx, `VACUUM`)
+		if err != nil {
+			return nil, errors.Wrap(err, "vacuuming")
+		}
+		r.Vacuumed = true
+		err = db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&r.PagesAfter)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading page_count")
+		}
+	}
+	return r, nil
+}
+
+// queryPlan returns the steps of SQLite's plan for q.
+func queryPlan(ctx context.Context, db *sql.DB, q string, args ...interface{}) ([]string, error) {
+	var plan []string
+	err := sqlutil.ForQueryRows(ctx, db, `EXPLAIN QUERY PLAN `+q, append(args, func(id, parent, notused int64, detail string) {
+		plan = append(plan, detail)
+	})...)
+	return plan, err
+}
+
+// tableGrowth counts the rows of each table,
+// compares each count with the one recorded by the last run,
+// and records the new counts.
+func tableGrowth(ctx context.Context, db *sql.DB, now time.Time) ([]TableGrowth, error) {
+	var names []string
+	const q = `SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+	err := sqlutil.ForQueryRows(ctx, db, q, func(name string) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tables")
+	}
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	var tables []TableGrowth
+	for _, name := range names {
+		t := TableGrowth{Name: name}
+		// Table names come from sqlite_master, not from the caller.
+		err = db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, name)).Scan(&t.Rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting rows of %s", name)
+		}
+		var last int64
+		const lastQ = `SELECT time_ms, rows FROM table_stats WHERE name=$1 ORDER BY time_ms DESC LIMIT 1`
+		err = db.QueryRowContext(ctx, lastQ, name).Scan(&t.LastMS, &last)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "reading last row count of %s", name)
+		}
+		t.Growth = t.Rows - last
+		tables = append(tables, t)
+	}
+	for _, t := range tables {
+		_, err = db.ExecContext(ctx, `INSERT OR REPLACE INTO table_stats (name, time_ms, rows) VALUES ($1, $2, $3)`, t.Name, nowMS, t.Rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recording row count of %s", t.Name)
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,66 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestMaintain(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		r, err := Maintain(ctx, db, MaintainOptions{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range r.Queries {
+			if q.Index != "" && (!q.Missing || !q.FullScan) {
+				t.Errorf("before -fix, query %q has plan %q, want a full scan for want of %s", q.Name, q.Plan, q.Index)
+			}
+			if q.Index == "" && (q.Missing || q.FullScan) {
+				t.Errorf("query %q has plan %q, want it served by the primary key", q.Name, q.Plan)
+			}
+		}
+
+		const q = `INSERT INTO exports (txid, exporter, amount, asset_xdr, temp_addr, seqnum, anchor, pubkey) VALUES ($1, '', 1, x'', '', 1, x'', x'')`
+		for _, txid := range []string{"a", "b"} {
+			_, err = db.Exec(q, txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err = Maintain(ctx, db, MaintainOptions{Fix: true, Vacuum: true}, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range r.Queries {
+			// With the planner's statistics,
+			// a scan may still be best for so few rows.
+			if q.Index != "" && (!q.Created || q.Missing) {
+				t.Errorf("with -fix, query %q is missing %s", q.Name, q.Index)
+			}
+		}
+		for _, tbl := range r.Tables {
+			if tbl.Name == "exports" && (tbl.Rows != 2 || tbl.Growth != 2 || tbl.LastMS != int64(bc.Millis(now))) {
+				t.Errorf("got exports growth %+v, want 2 rows since the first run", tbl)
+			}
+		}
+		if !r.Vacuumed {
+			t.Error("db not vacuumed")
+		}
+
+		r, err = Maintain(ctx, db, MaintainOptions{}, now.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range r.Queries {
+			if q.Missing || q.Created {
+				t.Errorf("after -fix, query %q reports index %s missing or created", q.Name, q.Index)
+			}
+		}
+	})
+}
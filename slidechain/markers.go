@@ -0,0 +1,218 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// A blockMarker flags a kind of peg activity in a block,
+// recorded for each block in the block_markers table
+// so the blocks without it can be skipped.
+type blockMarker uint64
+
+const (
+	// markIssuance is an issuance, as by an import.
+	markIssuance blockMarker = 1 << iota
+
+	// markRetirement is a retirement, as by a post-peg-out tx.
+	markRetirement
+
+	// markExport is a possible export:
+	// a log entry with the export contract's seed,
+	// or a payment to the reserve.
+	markExport
+)
+
+var blockMarkerNames = []struct {
+	m    blockMarker
+	name string
+}{
+	{markIssuance, "issuance"},
+	{markRetirement, "retirement"},
+	{markExport, "export"},
+}
+
+// maxMarkerRange is the most heights /block-markers reports on at once.
+const maxMarkerRange = 10000
+
+// blockMarkers is the set of markers of the txs in b,
+// for store.BlockStore.Markers.
+func blockMarkers(b *bc.Block) uint64 {
+	var m blockMarker
+	for _, tx := range b.Transactions {
+		m |= txMarkers(tx)
+	}
+	return uint64(m)
+}
+
+func txMarkers(tx *bc.Tx) blockMarker {
+	var m blockMarker
+	if len(tx.Issuances) > 0 {
+		m |= markIssuance
+	}
+	if len(tx.Retirements) > 0 {
+		m |= markRetirement
+	}
+	for _, item := range tx.Log {
+		if logCode(item) != txvm.LogCode {
+			continue
+		}
+		if seed, ok := logBytes(item, 1); ok && bytes.Equal(seed, exportContract1Seed[:]) {
+			m |= markExport
+		}
+	}
+	for _, out := range tx.Outputs {
+		if r, _ := reserveFromOutput(tx, out); r != nil {
+			m |= markExport
+		}
+	}
+	return m
+}
+
+func (m blockMarker) names() []string {
+	names := []string{}
+	for _, n := range blockMarkerNames {
+		if m&n.m != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// blockMarkersResp is the response to /block-markers.
+type blockMarkersResp struct {
+	Height uint64         `json:"height"` // of the server's latest block
+	Blocks []markedHeight `json:"blocks"`
+}
+
+// A markedHeight is a block with peg activity,
+// or with no recorded markers, in a /block-markers response.
+type markedHeight struct {
+	Height  uint64   `json:"height"`
+	Markers []string `json:"markers,omitempty"`
+	Unknown bool     `json:"unknown,omitempty"`
+}
+
+// BlockMarkers is the handler for /block-markers.
+func (c *Custodian) BlockMarkers(w http.ResponseWriter, req *http.Request) {
+	serveBlockMarkers(w, req, c.DB, c.S.chain)
+}
+
+// serveBlockMarkers responds with the blocks
+// at heights from (default 1) through to (default the latest),
+// at most maxMarkerRange of them,
+// that have any of the markers named in marker parameters (default any marker),
+// and those saved before markers were recorded, flagged unknown.
+// Others have no peg activity and need not be read.
+func serveBlockMarkers(w http.ResponseWriter, req *http.Request, db *sql.DB, chain *protocol.Chain) {
+	ctx := req.Context()
+	height := chain.Height()
+	from, to := uint64(1), height
+	for _, p := range []struct {
+		name string
+		v    *uint64
+	}{{"from", &from}, {"to", &to}} {
+		s := req.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v == 0 {
+			net.Errorf(w, http.StatusBadRequest, "%s must be a positive height", p.name)
+			return
+		}
+		*p.v = v
+	}
+	if to > height {
+		to = height
+	}
+	if to >= from+maxMarkerRange {
+		to = from + maxMarkerRange - 1
+	}
+	var mask blockMarker
+	for _, s := range req.Form["marker"] {
+		found := false
+		for _, n := range blockMarkerNames {
+			if n.name == s {
+				mask |= n.m
+				found = true
+			}
+		}
+		if !found {
+			net.Errorf(w, http.StatusBadRequest, "unknown marker %q", s)
+			return
+		}
+	}
+	if mask == 0 {
+		mask = ^blockMarker(0)
+	}
+
+	resp := blockMarkersResp{Height: height, Blocks: []markedHeight{}}
+	if from <= to {
+		recorded := make(map[uint64]blockMarker)
+		const q = `SELECT height, markers FROM block_markers WHERE height >= $1 AND height <= $2`
+		err := sqlutil.ForQueryRows(ctx, db, q, from, to, func(height uint64, m int64) {
+			recorded[height] = blockMarker(m)
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "getting block markers: %s", err)
+			return
+		}
+		for h := from; h <= to; h++ {
+			m, ok := recorded[h]
+			if !ok {
+				resp.Blocks = append(resp.Blocks, markedHeight{Height: h, Unknown: true})
+				continue
+			}
+			if m&mask != 0 {
+				resp.Blocks = append(resp.Blocks, markedHeight{Height: h, Markers: m.names()})
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// A pinBlock is a block to catch a pin up on,
+// with a nil block if it is to be skipped.
+type pinBlock struct {
+	height uint64
+	block  *bc.Block
+}
+
+// pinBlocks reads the blocks after height from the db, in order,
+// for catching up a pin that needs only those with a marker in mask,
+// or every block if mask is 0.
+// Those recorded without one are skipped, unread.
+func pinBlocks(ctx context.Context, db *sql.DB, height uint64, mask blockMarker) ([]pinBlock, error) {
+	const q = `
+		SELECT b.height, CASE WHEN $1 = 0 OR m.markers IS NULL OR m.markers & $1 != 0 THEN b.bits END
+		FROM blocks b LEFT JOIN block_markers m ON m.height = b.height
+		WHERE b.height > $2 ORDER BY b.height
+	`
+	var pbs []pinBlock
+	err := sqlutil.ForQueryRows(ctx, db, q, int64(mask), height, func(height uint64, bits []byte) error {
+		pb := pinBlock{height: height}
+		if bits != nil {
+			pb.block = new(bc.Block)
+			err := pb.block.FromBytes(bits)
+			if err != nil {
+				return errors.Wrapf(err, "unmarshaling block %d", height)
+			}
+		}
+		pbs = append(pbs, pb)
+		return nil
+	})
+	return pbs, err
+}
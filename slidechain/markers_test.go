@@ -0,0 +1,96 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestBlockMarkers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		// Block 2 has the pre-peg-in, 3 the import, and 4 the export.
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		importTx := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		anchor := txvm.VMHash("Split1", importTx.Issuances[0].Anchor)
+		exportTx, err := BuildExportTx(ctx, native, 1, 10, 10, importTestAccountID, anchor[:], prv, 1, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, exportTx)
+
+		markers := func(query string) []markedHeight {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.BlockMarkers(w, httptest.NewRequest("GET", "/block-markers?"+query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code %d for %q: %s", w.Code, query, w.Body)
+			}
+			var resp blockMarkersResp
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.Blocks
+		}
+		want := []markedHeight{
+			{Height: 3, Markers: []string{"issuance"}},
+			{Height: 4, Markers: []string{"export"}},
+		}
+		if got := markers(""); !reflect.DeepEqual(got, want) {
+			t.Errorf("got markers %+v, want %+v", got, want)
+		}
+		if got := markers("marker=export&from=2"); !reflect.DeepEqual(got, want[1:]) {
+			t.Errorf("got export markers %+v, want %+v", got, want[1:])
+		}
+		if got := markers("to=3&marker=retirement"); len(got) != 0 {
+			t.Errorf("got retirement markers %+v, want none", got)
+		}
+		w := httptest.NewRecorder()
+		c.BlockMarkers(w, httptest.NewRequest("GET", "/block-markers?marker=bogus", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status code %d for an unknown marker, want %d", w.Code, http.StatusBadRequest)
+		}
+
+		var seen []uint64
+		height, err := c.catchUpPin(ctx, "test", markExport, func(_ context.Context, b *bc.Block) error {
+			seen = append(seen, b.Height)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != 4 || !reflect.DeepEqual(seen, []uint64{4}) {
+			t.Errorf("export pin reached %d having seen blocks %v, want 4 having seen only block 4", height, seen)
+		}
+	})
+}
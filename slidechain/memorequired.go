@@ -0,0 +1,74 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// memoRequiredAlert is the kind of alert raised for an export
+// to an account that requires a memo, per SEP-29,
+// when the export gives none.
+const memoRequiredAlert = "memo-required"
+
+// checkMemoRequired reports whether the export may be pegged out
+// without a memo to its payee.
+// A payment without a memo to an account that requires one,
+// such as an exchange's shared deposit account,
+// would arrive with nothing to say whose it is,
+// and the peg-out tx cannot gain a memo
+// since the pre-export tx preauthorized it by hash.
+// So an export with no memo to such an account is held,
+// in the memo_holds table, until the account no longer requires one;
+// its /export-status says why,
+// and operators are alerted the first time.
+func (c *Custodian) checkMemoRequired(ctx context.Context, p *pegOut) (bool, error) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok || p.MemoType != "" {
+		return true, nil
+	}
+	payee := p.payee()
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	required, err := stellar.MemoRequired(tctx, sc.hclient, payee)
+	if err != nil {
+		// Horizon is unavailable; try again next pass.
+		log.Printf("checking memo requirement of %s for export %x: %s", payee, p.TxID, err)
+		return false, nil
+	}
+	if !required {
+		_, err = c.DB.ExecContext(ctx, `DELETE FROM memo_holds WHERE txid=$1`, p.TxID)
+		return true, errors.Wrapf(err, "releasing memo hold of export %x", p.TxID)
+	}
+	_, err = c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO memo_holds (txid, payee, held_ms) VALUES ($1, $2, $3)`, p.TxID, payee, c.nowMS())
+	if err != nil {
+		return false, errors.Wrapf(err, "holding export %x for a memo", p.TxID)
+	}
+	alerted, err := c.alerted(ctx, memoRequiredAlert, p.TxID)
+	if err != nil || alerted {
+		return false, err
+	}
+	return false, c.alert(ctx, memoRequiredAlert, p.TxID, fmt.Sprintf("export %x held: %s", p.TxID, memoHoldReason(payee)))
+}
+
+// memoHold returns why the export with the given ID is held
+// by checkMemoRequired, or "" if it is not.
+func (c *Custodian) memoHold(ctx context.Context, txid []byte) (string, error) {
+	var payee string
+	err := c.DB.QueryRowContext(ctx, `SELECT payee FROM memo_holds WHERE txid=$1`, txid).Scan(&payee)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "reading memo hold of export %x", txid)
+	}
+	return memoHoldReason(payee), nil
+}
+
+func memoHoldReason(payee string) string {
+	return fmt.Sprintf("destination %s requires a memo (SEP-29), and the export has none", payee)
+}
@@ -0,0 +1,107 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestCheckMemoRequired(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exchange, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exchange.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := newCustodian(ctx, db, srv.Client(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		setData := func(op stellar.ManageData) {
+			t.Helper()
+			_, err := stellar.NewSequencer(srv.Client()).Submit(exchange.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+				return &stellar.Tx{
+					Network: sc.network,
+					Source:  exchange.Address(),
+					SeqNum:  seqnum,
+					Ops:     []stellar.Op{op},
+				}, nil
+			}, exchange.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		check := func(p *pegOut) bool {
+			t.Helper()
+			ok, err := c.checkMemoRequired(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok
+		}
+
+		bare := &pegOut{TxID: bytes.Repeat([]byte{1}, 32), Exporter: exchange.Address()}
+		withMemo := &pegOut{TxID: bytes.Repeat([]byte{2}, 32), Exporter: custKP.Address(), Destination: Destination{Account: exchange.Address(), MemoType: "id", Memo: "7"}}
+		if !check(bare) {
+			t.Fatal("held an export to an account that requires no memo")
+		}
+
+		setData(stellar.ManageData{Name: "config.memo_required", Value: []byte("1")})
+		if !check(withMemo) {
+			t.Error("held an export with a memo")
+		}
+		for i := 0; i < 2; i++ {
+			if check(bare) {
+				t.Fatal("did not hold an export with no memo to an account that requires one")
+			}
+		}
+		reason, err := c.memoHold(ctx, bare.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != memoHoldReason(exchange.Address()) {
+			t.Errorf("got hold reason %q", reason)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, memoRequiredAlert).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d %s alerts, want 1", n, memoRequiredAlert)
+		}
+
+		setData(stellar.ManageData{Name: "config.memo_required"})
+		if !check(bare) {
+			t.Error("still held the export after the account dropped its memo requirement")
+		}
+		reason, err = c.memoHold(ctx, bare.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" {
+			t.Errorf("got hold reason %q after release", reason)
+		}
+	})
+}
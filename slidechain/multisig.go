@@ -0,0 +1,220 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+// accountCheckInterval is how often watchAccountConfig
+// checks the custodian account against the custodian config.
+const accountCheckInterval = 10 * time.Minute
+
+// SetupMultisig sets the signers and thresholds of the custodian account
+// to those of cfg.Custodian, in one Stellar tx signed by the custodian key,
+// then checks the account on-chain.
+// It returns the changes it made, none if the account already matched.
+// The custodian key must keep at least the medium threshold,
+// which the custodian's own payments need.
+func SetupMultisig(ctx context.Context, db *sql.DB, cfg *config.Config) ([]string, error) {
+	return setupMultisig(ctx, db, horizonClient(cfg.Horizon), cfg)
+}
+
+func setupMultisig(ctx context.Context, db *sql.DB, hclient stellar.Client, cfg *config.Config) ([]string, error) {
+	seed := cfg.Custodian.Seed
+	var stored string
+	err := db.QueryRowContext(ctx, "SELECT seed FROM custodian").Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "reading seed from db")
+	}
+	switch {
+	case seed == "" && stored == "":
+		return nil, errors.New("no custodian seed in the config or the db")
+	case seed == "":
+		seed = stored
+	case stored != "" && stored != seed:
+		return nil, errors.New("configured custodian seed does not match seed in db")
+	}
+	kp, err := keypair.Parse(seed)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing keypair from seed")
+	}
+	root, err := hclient.Root()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting horizon client root")
+	}
+	sc := newStellarChain(hclient, kp.Address(), seed, root.NetworkPassphrase)
+
+	acct, err := stellar.WithContext(ctx, hclient).LoadAccount(kp.Address())
+	if err != nil {
+		return nil, errors.Wrap(err, "loading custodian account")
+	}
+	ops, changes, err := multisigOps(acct, kp.Address(), cfg.Custodian)
+	if err != nil || len(ops) == 0 {
+		return nil, err
+	}
+	_, err = sc.seqs.SubmitContext(ctx, kp.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: sc.network,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			Ops:     ops,
+		}, nil
+	}, seed)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting custodian account signers")
+	}
+	return changes, sc.checkAccount(ctx, cfg.Custodian)
+}
+
+// multisigOps returns the set-options ops,
+// and a description of each,
+// that change the signers and thresholds of acct,
+// the custodian account at addr, to those of cfg.
+// Signers are added and reweighted before any are removed,
+// and thresholds are set last.
+func multisigOps(acct stellar.Account, addr string, cfg config.Custodian) ([]stellar.Op, []string, error) {
+	want := expectedSigners(cfg, addr)
+	thresholds := cfg.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = []int64{0, 0, 0}
+	}
+	if w := int64(want[addr]); w < 1 || w < thresholds[1] {
+		return nil, nil, fmt.Errorf("custodian key %s would have weight %d, below 1 or the medium threshold %d its payments need", addr, w, thresholds[1])
+	}
+	got := make(map[string]int32)
+	for _, signer := range acct.Signers {
+		if signer.Weight > 0 {
+			got[signer.Key] = signer.Weight
+		}
+	}
+
+	var (
+		ops     []stellar.Op
+		changes []string
+	)
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w := want[key]
+		if got[key] == w {
+			continue
+		}
+		if key == addr {
+			ops = append(ops, stellar.SetOptions{MasterWeight: weight(w)})
+			changes = append(changes, fmt.Sprintf("set master weight to %d", w))
+		} else {
+			ops = append(ops, stellar.SetOptions{Signer: &stellar.AccountSigner{Key: key, Weight: uint32(w)}})
+			changes = append(changes, fmt.Sprintf("set signer %s weight to %d", key, w))
+		}
+	}
+	keys = keys[:0]
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == addr {
+			ops = append(ops, stellar.SetOptions{MasterWeight: weight(0)})
+		} else {
+			ops = append(ops, stellar.SetOptions{Signer: &stellar.AccountSigner{Key: key}})
+		}
+		changes = append(changes, fmt.Sprintf("remove signer %s", key))
+	}
+	th := acct.Thresholds
+	if int64(th.LowThreshold) != thresholds[0] || int64(th.MedThreshold) != thresholds[1] || int64(th.HighThreshold) != thresholds[2] {
+		ops = append(ops, stellar.SetOptions{
+			LowThreshold:  weight(int32(thresholds[0])),
+			MedThreshold:  weight(int32(thresholds[1])),
+			HighThreshold: weight(int32(thresholds[2])),
+		})
+		changes = append(changes, fmt.Sprintf("set thresholds to %d/%d/%d", thresholds[0], thresholds[1], thresholds[2]))
+	}
+	return ops, changes, nil
+}
+
+// weight returns a pointer to w, for the weights and thresholds of SetOptions.
+func weight(w int32) *uint32 {
+	u := uint32(w)
+	return &u
+}
+
+// watchAccountConfig runs as a goroutine,
+// checking the custodian account against the custodian config
+// every accountCheckInterval until ctx is canceled.
+func (c *Custodian) watchAccountConfig(ctx context.Context, sc *stellarChain) {
+	defer log.Print("watchAccountConfig exiting")
+
+	ticker := time.NewTicker(accountCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.checkAccountConfig(ctx, sc)
+		if err != nil {
+			log.Printf("checking custodian account: %s", err)
+		}
+	}
+}
+
+// checkAccountConfig records whether the custodian account
+// has drifted from the signers and thresholds of the custodian config.
+// While it has, custodian payments are held; see accountHeld.
+// The first time each drift is seen it raises an accountGuardAlert.
+func (c *Custodian) checkAccountConfig(ctx context.Context, sc *stellarChain) error {
+	cfg := c.config()
+	if cfg == nil {
+		return nil
+	}
+	err := sc.checkAccount(ctx, cfg.Custodian)
+	if errors.Root(err) != errAccountMismatch {
+		if err == nil && sc.accountDrift() != "" {
+			log.Print("custodian account matches config again; resuming peg-outs")
+			sc.drift.Store("")
+		}
+		return err
+	}
+	detail := err.Error()
+	if sc.accountDrift() == detail {
+		return nil
+	}
+	sc.drift.Store(detail)
+	key := []byte(detail)
+	alerted, err := c.alerted(ctx, accountGuardAlert, key)
+	if err != nil || alerted {
+		return err
+	}
+	return c.alert(ctx, accountGuardAlert, key, detail+"; holding peg-outs")
+}
+
+// accountHeld reports whether the custodian account
+// has drifted from the custodian config,
+// holding the payments the custodian signs.
+// Every pass that submits one checks it first.
+func (c *Custodian) accountHeld() bool {
+	sc, ok := c.chain.(*stellarChain)
+	return ok && sc.accountDrift() != ""
+}
+
+// accountDrift returns how the custodian account
+// last differed from the custodian config, or "" if it did not.
+func (s *stellarChain) accountDrift() string {
+	d, _ := s.drift.Load().(string)
+	return d
+}
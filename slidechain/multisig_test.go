@@ -0,0 +1,253 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestSetupMultisig(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	coldKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := newCustodian(ctx, db, srv.Client(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+
+		multisig := *cfg
+		multisig.Custodian.Signers = []string{custKP.Address() + "=2", coldKP.Address() + "=2"}
+		multisig.Custodian.Thresholds = []int64{1, 2, 3}
+		bad := multisig
+		bad.Custodian.Thresholds = []int64{1, 3, 3}
+		_, err = setupMultisig(ctx, db, srv.Client(), &bad)
+		if err == nil {
+			t.Error("got no error leaving the custodian key below the medium threshold")
+		}
+
+		changes, err := setupMultisig(ctx, db, srv.Client(), &multisig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 3 {
+			t.Errorf("got changes %q, want the master weight, a signer, and the thresholds", changes)
+		}
+		changes, err = setupMultisig(ctx, db, srv.Client(), &multisig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("got changes %q setting up again, want none", changes)
+		}
+
+		// The running custodian, still configured with its key alone,
+		// holds peg-outs until its config matches the account.
+		err = c.checkAccountConfig(ctx, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc.accountDrift() == "" {
+			t.Fatal("got no drift from the default config")
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, accountGuardAlert).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d %s alerts, want 1", n, accountGuardAlert)
+		}
+		pending, err := c.pegOutPending(ctx, nil)
+		if err != nil || pending != nil {
+			t.Errorf("got peg-outs %v, error %v, with a drifted account; want none", pending, err)
+		}
+
+		c.cfg = &multisig
+		err = c.checkAccountConfig(ctx, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := sc.accountDrift(); d != "" {
+			t.Errorf("got drift %q after matching the config", d)
+		}
+	})
+}
+
+func TestAccountDriftHoldsPayments(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	var kps []*keypair.Full
+	for i := 0; i < 3; i++ {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		kps = append(kps, kp)
+	}
+	custKP, exporterKP, payeeKP := kps[0], kps[1], kps[2]
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.NetMin = 2
+	now := time.Now()
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const amount = int64(xlm.Lumen)
+		var n byte
+		export := func(nettable bool) pegOut {
+			t.Helper()
+			dest := Destination{Account: payeeKP.Address()}
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, TimeBounds{}, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+			p := pegOut{
+				TxID:        bytes.Repeat([]byte{n}, 32),
+				AssetXDR:    nativeXDR,
+				TempAddr:    tempAddr,
+				Seqnum:      int64(seqnum),
+				Exporter:    exporterKP.Address(),
+				Amount:      amount,
+				Anchor:      []byte{n},
+				Pubkey:      testRecipPubKey,
+				Destination: dest,
+				Nettable:    nettable,
+			}
+			err = c.insertExport(ctx, p.TxID, &p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+
+		// A stuck peg-out, a netting, an exit payout, and a deposit refund,
+		// all waiting to be paid.
+		stuck := export(false)
+		err = c.movePegOut(ctx, stuck.TxID, pegOutNotYet, pegOutRetry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		netted, err := c.netPegOuts(ctx, []pegOut{export(true), export(true)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(netted) != 2 {
+			t.Fatalf("netted %d exports, want 2", len(netted))
+		}
+		for _, ins := range []struct {
+			q    string
+			args []interface{}
+		}{
+			{`INSERT INTO wind_down (height, cursor, skipped, started_ms) VALUES (1, '', 0, 0)`, nil},
+			{`INSERT INTO exit_addresses (pubkey, address, time_ms) VALUES ($1, $2, 0)`, []interface{}{testRecipPubKey, payeeKP.Address()}},
+			{`INSERT INTO exit_payouts (pubkey, asset_xdr, amount, state) VALUES ($1, $2, $3, $4)`, []interface{}{testRecipPubKey, nativeXDR, amount, exitWaiting}},
+			{`INSERT INTO deposit_refunds (deposit_txid, op_index, asset_xdr, nonce_hash, sender, amount, reason, deposit_cursor, state) VALUES ('deposit', 0, $1, x'', $2, $3, 'test', '', $4)`, []interface{}{nativeXDR, payeeKP.Address(), amount, refundWaiting}},
+		} {
+			_, err = db.Exec(ins.q, ins.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		now = now.Add(time.Duration(cfg.PegOut.StuckAfter) + time.Second)
+
+		pay := func() int {
+			t.Helper()
+			txs := len(srv.Transactions())
+			for _, f := range []func(context.Context, *pegOutShard) ([]pegOut, error){c.pegOutPending, c.remediateStuck, c.advanceNettings} {
+				_, err := f(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := c.payExitsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.payRefundsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(srv.Transactions()) - txs
+		}
+
+		sc.drift.Store("custodian account thresholds differ")
+		if got := pay(); got != 0 {
+			t.Errorf("submitted %d txs with a drifted account, want none", got)
+		}
+
+		// Once the account matches again, everything is paid,
+		// the netting over a few passes.
+		sc.drift.Store("")
+		for i := 0; i < 3; i++ {
+			pay()
+		}
+		var state pegOutState
+		err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, stuck.TxID).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutOK {
+			t.Errorf("stuck export is in state %s, want ok", state)
+		}
+		var nettingState nettingState
+		err = db.QueryRow(`SELECT state FROM nettings`).Scan(&nettingState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nettingState != nettingDone {
+			t.Errorf("netting is in state %d, want %d", nettingState, nettingDone)
+		}
+		var exitState, refundState int
+		err = db.QueryRow(`SELECT state FROM exit_payouts`).Scan(&exitState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow(`SELECT state FROM deposit_refunds`).Scan(&refundState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exitState != exitPaid || refundState != refundPaid {
+			t.Errorf("got exit payout state %d and deposit refund state %d, want both paid", exitState, refundState)
+		}
+	})
+}
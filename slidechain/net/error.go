@@ -1,13 +1,64 @@
 package net
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 )
 
-// Errorf replies to an HTTP request with the specified error, also logging it to stderr.
+// ProblemContentType is the media type of a Problem.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an error response in the form of RFC 7807.
+type Problem struct {
+	Type   string `json:"type,omitempty"` // a URI reference; empty means about:blank
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// InvalidParams are the request fields that failed validation.
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// InvalidParam is a request field that failed validation, and why.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Errorf replies to an HTTP request with the specified error as a Problem, also logging it to stderr.
 func Errorf(w http.ResponseWriter, code int, msgfmt string, args ...interface{}) {
-	http.Error(w, fmt.Sprintf(msgfmt, args...), code)
-	log.Printf(msgfmt, args...)
+	msg := fmt.Sprintf(msgfmt, args...)
+	WriteProblem(w, Problem{Status: code, Detail: msg})
+	log.Print(msg)
+}
+
+// WriteProblem replies to an HTTP request with p,
+// whose Title defaults to the text of its Status.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ProblemContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(p)
+}
+
+// ProblemDetail returns the detail of the Problem in an error response body,
+// or the body itself if it is not one.
+func ProblemDetail(body []byte) string {
+	var p Problem
+	if json.Unmarshal(body, &p) != nil || p.Status == 0 {
+		return string(body)
+	}
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Detail
 }
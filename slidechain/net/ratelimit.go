@@ -0,0 +1,104 @@
+package net
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets bounds the number of per-client buckets
+// kept before idle ones are discarded.
+const maxIdleBuckets = 10000
+
+// Limiter is HTTP middleware limiting the rate of requests
+// from each client IP address with a token bucket.
+// Its limits may be changed while it is in use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second; zero means unlimited
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate requests per second
+// per client, with bursts of up to burst requests.
+// A rate of zero disables limiting.
+func NewLimiter(rate float64, burst int64) *Limiter {
+	l := &Limiter{buckets: make(map[string]*bucket)}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// SetLimit changes the limits of l.
+func (l *Limiter) SetLimit(rate float64, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+// Allow reports whether a request from the given client
+// at the given time is within the limit,
+// consuming a token if so.
+func (l *Limiter) Allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune discards buckets that have refilled completely,
+// since they are equivalent to new ones.
+func (l *Limiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Wrap returns a handler that applies l to requests before passing them to h.
+func (l *Limiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := ClientIP(req)
+		if !l.Allow(client, time.Now()) {
+			Errorf(w, http.StatusTooManyRequests, "rate limit exceeded for %s", client)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// ClientIP returns the IP address of the client that sent req.
+func ClientIP(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return client
+}
@@ -0,0 +1,180 @@
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// PeerClient is the HTTP client with which slidechain nodes reach one another:
+// the custodian its validators,
+// and followers, validators, and gossip peers their sources.
+// A node with peer TLS settings replaces it with a TLSClient.
+var PeerClient = http.DefaultClient
+
+// TLSClient returns an HTTP client that uses the given TLS config.
+func TLSClient(cfg *tls.Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return &http.Client{Transport: t}
+}
+
+// ServerTLS returns a TLS config for a listener
+// serving the PEM certificate chain and key in certFile and keyFile.
+// If clientCAFile is not empty,
+// clients must present a certificate signed by one of the PEM CAs in it.
+// Each file is read again when it changes,
+// so that renewed certificates take effect without a restart.
+func ServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert := &certFiles{certFile: certFile, keyFile: keyFile}
+	_, err := cert.get()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get()
+		},
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	cas := &caBundle{file: clientCAFile}
+	_, err = cas.get()
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			return nil, err
+		}
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		return c, nil
+	}
+	return cfg, nil
+}
+
+// ClientTLS returns a TLS config for reaching servers
+// whose certificates are signed by one of the PEM CAs in caFile,
+// or by a system CA if caFile is empty.
+// If certFile and keyFile are not empty,
+// it presents the certificate in them to servers that ask for one,
+// reading the files again when they change.
+func ClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := (&caBundle{file: caFile}).get()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert := &certFiles{certFile: certFile, keyFile: keyFile}
+		_, err := cert.get()
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+	return cfg, nil
+}
+
+// certFiles is a certificate and its key in PEM files,
+// loaded again when either file's modification time changes.
+type certFiles struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	mod  [2]time.Time
+	cert *tls.Certificate
+}
+
+func (f *certFiles) get() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mod, err := modTimes(f.certFile, f.keyFile)
+	if err == nil && f.cert != nil && mod == f.mod {
+		return f.cert, nil
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	}
+	if err != nil {
+		if f.cert != nil {
+			// A renewal may be half written; keep the old certificate until it is done.
+			log.Printf("reloading TLS certificate %s: %s", f.certFile, err)
+			return f.cert, nil
+		}
+		return nil, errors.Wrapf(err, "loading TLS certificate %s", f.certFile)
+	}
+	if f.cert != nil {
+		log.Printf("reloaded TLS certificate %s", f.certFile)
+	}
+	f.cert, f.mod = &cert, mod
+	return f.cert, nil
+}
+
+// caBundle is a bundle of PEM CA certificates in a file,
+// loaded again when its modification time changes.
+type caBundle struct {
+	file string
+
+	mu   sync.Mutex
+	mod  time.Time
+	pool *x509.CertPool
+}
+
+func (f *caBundle) get() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mod, err := modTimes(f.file)
+	if err == nil && f.pool != nil && mod[0] == f.mod {
+		return f.pool, nil
+	}
+	var pem []byte
+	if err == nil {
+		pem, err = ioutil.ReadFile(f.file)
+	}
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no PEM certificates in %s", f.file)
+	}
+	if err != nil {
+		if f.pool != nil {
+			log.Printf("reloading CA certificates %s: %s", f.file, err)
+			return f.pool, nil
+		}
+		return nil, errors.Wrapf(err, "loading CA certificates %s", f.file)
+	}
+	f.pool, f.mod = pool, mod[0]
+	return f.pool, nil
+}
+
+func modTimes(files ...string) ([2]time.Time, error) {
+	var mod [2]time.Time
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return mod, err
+		}
+		mod[i] = info.ModTime()
+	}
+	return mod, nil
+}
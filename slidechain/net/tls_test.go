@@ -0,0 +1,147 @@
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, caKey := testCert(t, "ca", nil, nil, path("ca.pem"), "")
+	testCert(t, "server-1", ca, caKey, path("server.pem"), path("server.key"))
+	testCert(t, "client", ca, caKey, path("client.pem"), path("client.key"))
+
+	serverCfg, err := ServerTLS(path("server.pem"), path("server.key"), path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = serverCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	// get returns the common name of the server's certificate.
+	get := func(client *http.Client) (string, error) {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	anon, err := ClientTLS(path("ca.pem"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(TLSClient(anon)); err == nil {
+		t.Error("server accepted a client without a certificate")
+	}
+	clientCfg, err := ClientTLS(path("ca.pem"), path("client.pem"), path("client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := TLSClient(clientCfg)
+	if name, err := get(client); err != nil || name != "server-1" {
+		t.Fatalf("got server certificate %q, %v; want server-1", name, err)
+	}
+
+	// Renew the server's certificate.
+	later := time.Now().Add(time.Minute)
+	testCert(t, "server-2", ca, caKey, path("server.pem"), path("server.key"))
+	for _, name := range []string{"server.pem", "server.key"} {
+		err = os.Chtimes(path(name), later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.CloseIdleConnections()
+	if name, err := get(client); err != nil || name != "server-2" {
+		t.Errorf("after renewal got server certificate %q, %v; want server-2", name, err)
+	}
+
+	// A half-written renewal leaves the old certificate in place.
+	err = ioutil.WriteFile(path("server.key"), []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	err = os.Chtimes(path("server.key"), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.CloseIdleConnections()
+	if name, err := get(client); err != nil || name != "server-2" {
+		t.Errorf("after a bad renewal got server certificate %q, %v; want server-2", name, err)
+	}
+}
+
+// testCert writes a certificate for name, signed by parent,
+// or self-signed if parent is nil, to certFile,
+// and its key to keyFile if that is not empty.
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
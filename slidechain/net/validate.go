@@ -0,0 +1,227 @@
+package net
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stellar/go/strkey"
+)
+
+// maxJSONBody bounds the request bodies Validate reads.
+const maxJSONBody = 1 << 20
+
+// A Check reports what is wrong with the value of a request field,
+// as a reason such as "must be a Stellar account ID",
+// or "" if nothing is.
+// The value is that of a query parameter,
+// or of a member of a JSON body:
+// the contents of a string or the text of a number.
+// It is empty if the field is absent.
+type Check func(v string) string
+
+// Schema gives the checks of a request's fields by name.
+type Schema struct {
+	Query map[string]Check // query parameters
+	Body  map[string]Check // members of a JSON object body
+}
+
+// Validate wraps h, checking each request against the Schema
+// for its method and path in schemas, e.g. "POST /prepegin".
+// A path ending in a slash matches every path with that prefix.
+// A request with invalid fields gets a Problem listing them
+// instead of being passed to h.
+func Validate(schemas map[string]Schema, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s, ok := schemaFor(schemas, req)
+		if !ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+		var invalid []InvalidParam
+		q := req.URL.Query()
+		for _, name := range checkNames(s.Query) {
+			if reason := s.Query[name](q.Get(name)); reason != "" {
+				invalid = append(invalid, InvalidParam{Name: name, Reason: reason})
+			}
+		}
+		if len(s.Body) > 0 {
+			data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxJSONBody+1))
+			if err != nil {
+				Errorf(w, http.StatusBadRequest, "reading request: %s", err)
+				return
+			}
+			if len(data) > maxJSONBody {
+				Errorf(w, http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", maxJSONBody)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(data))
+			var members map[string]json.RawMessage
+			err = json.Unmarshal(data, &members)
+			if err != nil {
+				Errorf(w, http.StatusBadRequest, "request body is not a JSON object: %s", err)
+				return
+			}
+			for _, name := range checkNames(s.Body) {
+				reason := "must be a string or number"
+				if v, ok := jsonScalar(members[name]); ok {
+					reason = s.Body[name](v)
+				}
+				if reason != "" {
+					invalid = append(invalid, InvalidParam{Name: name, Reason: reason})
+				}
+			}
+		}
+		if len(invalid) > 0 {
+			reasons := make([]string, 0, len(invalid))
+			for _, p := range invalid {
+				reasons = append(reasons, p.Name+" "+p.Reason)
+			}
+			detail := "invalid request: " + strings.Join(reasons, "; ")
+			WriteProblem(w, Problem{Status: http.StatusBadRequest, Detail: detail, InvalidParams: invalid})
+			log.Print(detail)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func schemaFor(schemas map[string]Schema, req *http.Request) (Schema, bool) {
+	key := req.Method + " " + req.URL.Path
+	if s, ok := schemas[key]; ok {
+		return s, true
+	}
+	var (
+		best  Schema
+		found string
+	)
+	for k, s := range schemas {
+		if strings.HasSuffix(k, "/") && strings.HasPrefix(key, k) && len(k) > len(found) {
+			best, found = s, k
+		}
+	}
+	return best, found != ""
+}
+
+func checkNames(checks map[string]Check) []string {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonScalar returns the value of a JSON string or number for a Check,
+// or "" for an absent or null one.
+// It reports false for any other JSON value.
+func jsonScalar(raw json.RawMessage) (string, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", true
+	}
+	switch c := raw[0]; {
+	case c == '"':
+		var s string
+		return s, json.Unmarshal(raw, &s) == nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		return string(raw), true
+	}
+	return "", false
+}
+
+// Optional returns a Check accepting an absent field,
+// and checking any other with c.
+func Optional(c Check) Check {
+	return func(v string) string {
+		if v == "" {
+			return ""
+		}
+		return c(v)
+	}
+}
+
+// Int returns a Check for a decimal integer from min to max.
+func Int(min, max int64) Check {
+	return func(v string) string {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && n >= min && n <= max {
+			return ""
+		}
+		if max == math.MaxInt64 {
+			return fmt.Sprintf("must be an integer of at least %d", min)
+		}
+		return fmt.Sprintf("must be an integer from %d to %d", min, max)
+	}
+}
+
+// Base64 returns a Check for n bytes in standard base64,
+// the JSON encoding of a []byte,
+// or for any nonempty bytes if n is zero.
+func Base64(n int) Check {
+	return func(v string) string {
+		b, err := base64.StdEncoding.DecodeString(v)
+		switch {
+		case err != nil || len(b) == 0:
+			return "must be base64-encoded bytes"
+		case n > 0 && len(b) != n:
+			return fmt.Sprintf("must be %d base64-encoded bytes", n)
+		}
+		return ""
+	}
+}
+
+// Hex returns a Check for n hex-encoded bytes.
+func Hex(n int) Check {
+	return func(v string) string {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != n {
+			return fmt.Sprintf("must be %d hex-encoded bytes", n)
+		}
+		return ""
+	}
+}
+
+// StellarAccount is a Check for a Stellar account ID, G....
+func StellarAccount(v string) string {
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, v); err != nil {
+		return "must be a Stellar account ID"
+	}
+	return ""
+}
+
+// AssetCode is a Check for a Stellar asset code:
+// 1 to 12 ASCII letters and digits.
+func AssetCode(v string) string {
+	if len(v) < 1 || len(v) > 12 {
+		return "must be 1 to 12 letters and digits"
+	}
+	for _, c := range v {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return "must be 1 to 12 letters and digits"
+		}
+	}
+	return ""
+}
+
+// Asset is a Check for a Stellar asset, "native" or "CODE:ISSUER".
+func Asset(v string) string {
+	if v == "native" {
+		return ""
+	}
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 || AssetCode(parts[0]) != "" || StellarAccount(parts[1]) != "" {
+		return `must be "native" or CODE:ISSUER, with a Stellar asset code and account ID`
+	}
+	return ""
+}
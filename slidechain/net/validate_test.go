@@ -0,0 +1,96 @@
+package net
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stellar/go/strkey"
+)
+
+func TestValidate(t *testing.T) {
+	account, err := strkey.Encode(strkey.VersionByteAccountID, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := map[string]Schema{
+		"POST /pay": {Body: map[string]Check{
+			"amount":      Int(1, math.MaxInt64),
+			"destination": StellarAccount,
+			"memo":        Optional(Base64(32)),
+		}},
+		"GET /accounts/": {Query: map[string]Check{
+			"asset": Optional(Asset),
+			"limit": Optional(Int(1, 200)),
+		}},
+	}
+	var gotBody string
+	h := Validate(schemas, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		method, target, body string
+		wantCode             int
+		wantInvalid          []string
+	}{
+		{method: "POST", target: "/pay", body: `{"amount": 10, "destination": "` + account + `"}`, wantCode: http.StatusNoContent},
+		{method: "POST", target: "/pay", body: `{"amount": 0, "destination": "GABC", "memo": "c2hvcnQ="}`, wantCode: http.StatusBadRequest, wantInvalid: []string{"amount", "destination", "memo"}},
+		{method: "POST", target: "/pay", body: `{"amount": {}, "destination": "` + account + `"}`, wantCode: http.StatusBadRequest, wantInvalid: []string{"amount"}},
+		{method: "POST", target: "/pay", body: `[1, 2]`, wantCode: http.StatusBadRequest},
+		{method: "POST", target: "/pay", body: ``, wantCode: http.StatusBadRequest},
+		{method: "GET", target: "/pay", wantCode: http.StatusNoContent}, // no schema
+		{method: "GET", target: "/accounts/ab/imports?asset=USD:" + account + "&limit=10", wantCode: http.StatusNoContent},
+		{method: "GET", target: "/accounts/ab/imports", wantCode: http.StatusNoContent},
+		{method: "GET", target: "/accounts/ab/imports?asset=US$:" + account + "&limit=201", wantCode: http.StatusBadRequest, wantInvalid: []string{"asset", "limit"}},
+	}
+	for _, c := range cases {
+		gotBody = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.target, strings.NewReader(c.body)))
+		if w.Code != c.wantCode {
+			t.Errorf("%s %s %s: status code %d, want %d: %s", c.method, c.target, c.body, w.Code, c.wantCode, w.Body)
+			continue
+		}
+		if w.Code == http.StatusNoContent {
+			if gotBody != c.body {
+				t.Errorf("%s %s: handler got body %q, want %q", c.method, c.target, gotBody, c.body)
+			}
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ProblemContentType {
+			t.Errorf("%s %s %s: content type %q, want %s", c.method, c.target, c.body, ct, ProblemContentType)
+		}
+		var p Problem
+		err := json.Unmarshal(w.Body.Bytes(), &p)
+		if err != nil {
+			t.Errorf("%s %s %s: parsing problem: %s", c.method, c.target, c.body, err)
+			continue
+		}
+		var invalid []string
+		for _, ip := range p.InvalidParams {
+			invalid = append(invalid, ip.Name)
+		}
+		if p.Status != c.wantCode || p.Title != http.StatusText(c.wantCode) || p.Detail == "" || !reflect.DeepEqual(invalid, c.wantInvalid) {
+			t.Errorf("%s %s %s: got problem %+v, want invalid params %v", c.method, c.target, c.body, p, c.wantInvalid)
+		}
+	}
+}
+
+func TestProblemDetail(t *testing.T) {
+	w := httptest.NewRecorder()
+	Errorf(w, http.StatusNotFound, "no such %s", "thing")
+	if got := ProblemDetail(w.Body.Bytes()); got != "no such thing" {
+		t.Errorf("got detail %q, want %q", got, "no such thing")
+	}
+	if got := ProblemDetail([]byte("plain text\n")); got != "plain text\n" {
+		t.Errorf("got detail %q of a plain body", got)
+	}
+}
@@ -0,0 +1,489 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// A netting pays the total of several exports
+// of the same asset to the same account and memo
+// in a single payment from the custodian,
+// in place of their peg-out txs.
+// It first settles each export:
+// it submits the export's settlement tx,
+// which merges the temp account into the exporter's,
+// so that the export's own peg-out can no longer be applied.
+// Then it pays the total of the settled exports.
+// The netted exports are recorded in the netted_exports table.
+type netting struct {
+	ID int64
+	netKey
+	MaxTime int64 // the earliest max time of its exports, or zero
+	State   nettingState
+	Amount  int64 // the total, once paying
+	Seqnum  int64 // of the payment tx, once built
+}
+
+// netKey identifies the exports that can be netted together.
+type netKey struct {
+	AssetXDR string
+	Payee    string
+	MemoType string
+	Memo     string
+}
+
+// nettingState is the state of a netting, in the nettings table.
+type nettingState int
+
+const (
+	nettingSettling nettingState = iota
+	nettingPaying
+	nettingDone
+)
+
+// nettingMinTTL is the least time that must be left
+// before the max time of an export for it to be netted,
+// since settling and paying take a few submissions.
+const nettingMinTTL = time.Minute
+
+// netPegOuts records a netting of each group of at least pegout.net_min
+// nettable exports in ps with the same netKey,
+// returning the txids of the exports netted.
+// The exports in ps have been screened.
+func (c *Custodian) netPegOuts(ctx context.Context, ps []pegOut) (map[string]bool, error) {
+	netMin := c.pegOutConfig().NetMin
+	if _, ok := c.chain.(*stellarChain); !ok || netMin < 2 {
+		return nil, nil
+	}
+	now := c.nowMS() / 1000
+	var (
+		keys   []netKey
+		groups = make(map[netKey][]pegOut)
+		totals = make(map[netKey]int64)
+	)
+	for _, p := range ps {
+		// A retried export has been submitted, and is left to finish by itself.
+		// One submitted just before a crash is still not yet pegged out,
+		// but its settlement then finds its peg-out, if that was applied.
+		if !p.Nettable || p.State != pegOutNotYet || p.MinTime > now {
+			continue
+		}
+		if p.MaxTime > 0 && p.MaxTime < now+int64(nettingMinTTL/time.Second) {
+			continue
+		}
+		// The netted payment is the custodian's own tx,
+		// bounded only by time, so it cannot keep an export's other preconditions.
+		if p.preconditioned() {
+			continue
+		}
+		// A netted payment totals its exports' amounts as Stellar amounts.
+		decimals, err := c.assetDecimals(ctx, p.AssetXDR)
+		if err != nil {
+			return nil, err
+		}
+		if decimals != StellarDecimals {
+			continue
+		}
+		k := netKey{AssetXDR: string(p.AssetXDR), Payee: p.payee(), MemoType: p.MemoType, Memo: p.Memo}
+		if p.Amount > math.MaxInt64-totals[k] {
+			continue
+		}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], p)
+		totals[k] += p.Amount
+	}
+	netted := make(map[string]bool)
+	for _, k := range keys {
+		g := groups[k]
+		if len(g) < netMin {
+			continue
+		}
+		err := c.recordNetting(ctx, k, g)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("netting %d exports of asset %x to %s: %d in total", len(g), k.AssetXDR, k.Payee, totals[k])
+		for _, p := range g {
+			netted[string(p.TxID)] = true
+		}
+	}
+	return netted, nil
+}
+
+func (c *Custodian) recordNetting(ctx context.Context, k netKey, ps []pegOut) error {
+	var maxTime int64
+	for _, p := range ps {
+		if p.MaxTime > 0 && (maxTime == 0 || p.MaxTime < maxTime) {
+			maxTime = p.MaxTime
+		}
+	}
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	const q = `INSERT INTO nettings (asset_xdr, payee, memo_type, memo, max_time, created_ms) VALUES ($1, $2, $3, $4, $5, $6)`
+	res, err := dbtx.ExecContext(ctx, q, []byte(k.AssetXDR), k.Payee, k.MemoType, k.Memo, maxTime, c.nowMS())
+	if err != nil {
+		return errors.Wrap(err, "recording netting")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "getting netting id")
+	}
+	for _, p := range ps {
+		_, err = dbtx.ExecContext(ctx, `INSERT INTO netted_exports (txid, netting) VALUES ($1, $2)`, p.TxID, id)
+		if err != nil {
+			return errors.Wrapf(err, "recording netted export %x", p.TxID)
+		}
+	}
+	return errors.Wrap(dbtx.Commit(), "committing netting")
+}
+
+// advanceNettings settles and pays the unfinished nettings.
+// Like pegOutPending,
+// it returns the exports whose netted payments succeeded or definitely failed,
+// and any whose own peg-outs turn out to have been applied,
+// which are ready for the post-peg-out tx.
+// Only the nettings of the assets of sh are advanced, all of them if it is nil.
+// None is while the custodian account has drifted from the custodian config.
+func (c *Custodian) advanceNettings(ctx context.Context, sh *pegOutShard) ([]pegOut, error) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok || c.accountHeld() {
+		return nil, nil
+	}
+	var ns []netting
+	const q = `SELECT id, asset_xdr, payee, memo_type, memo, max_time, state, amount, seqnum FROM nettings WHERE state != $1`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, nettingDone, func(id int64, assetXDR []byte, payee, memoType, memo string, maxTime, state, amount, seqnum int64) {
+		if !sh.has(assetXDR) {
+			return
+		}
+		ns = append(ns, netting{
+			ID:      id,
+			netKey:  netKey{AssetXDR: string(assetXDR), Payee: payee, MemoType: memoType, Memo: memo},
+			MaxTime: maxTime,
+			State:   nettingState(state),
+			Amount:  amount,
+			Seqnum:  seqnum,
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading nettings")
+	}
+	var ready []pegOut
+	for i := range ns {
+		ps, err := c.advanceNetting(ctx, sc, &ns[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "netting %d", ns[i].ID)
+		}
+		ready = append(ready, ps...)
+	}
+	return ready, nil
+}
+
+func (c *Custodian) advanceNetting(ctx context.Context, sc *stellarChain, n *netting) ([]pegOut, error) {
+	ps, err := c.queryExports(ctx, `FROM exports e JOIN netted_exports n ON n.txid = e.txid WHERE n.netting = $1`, n.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading netted exports")
+	}
+	settled := make(map[string]bool)
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT txid, settled FROM netted_exports WHERE netting = $1`, n.ID, func(txid []byte, s bool) {
+		settled[string(txid)] = s
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading settlements of netted exports")
+	}
+
+	var ready []pegOut
+	if n.State == nettingSettling {
+		var (
+			remaining []pegOut
+			pending   bool
+		)
+		for _, p := range ps {
+			if settled[string(p.TxID)] {
+				remaining = append(remaining, p)
+				continue
+			}
+			res, err := sc.settle(ctx, p.withdrawal())
+			switch res {
+			case settleApplied:
+				_, err = c.DB.ExecContext(ctx, `UPDATE netted_exports SET settled=1 WHERE txid=$1`, p.TxID)
+				if err != nil {
+					return nil, errors.Wrapf(err, "recording settlement of export %x", p.TxID)
+				}
+				remaining = append(remaining, p)
+
+			case settlePaidAlone:
+				log.Printf("peg-out of netted export %x was applied before its settlement", p.TxID)
+				err = c.unnet(ctx, p.TxID)
+				if err != nil {
+					return nil, err
+				}
+				err = c.movePegOut(ctx, p.TxID, p.State, pegOutOK)
+				if err != nil {
+					return nil, err
+				}
+				_, err = c.recordPegOutReceipt(ctx, &p)
+				if err != nil {
+					return nil, err
+				}
+				p.State = pegOutOK
+				ready = append(ready, p)
+
+			case settleUnauthorized:
+				// It is pegged out by itself instead.
+				log.Printf("cannot settle netted export %x: %s", p.TxID, err)
+				err = c.unnet(ctx, p.TxID)
+				if err != nil {
+					return nil, err
+				}
+
+			default:
+				log.Printf("settling netted export %x: %s", p.TxID, err)
+				pending = true
+				remaining = append(remaining, p)
+			}
+		}
+		if pending {
+			return ready, nil
+		}
+		for _, p := range remaining {
+			n.Amount += p.Amount
+		}
+		n.State = nettingPaying
+		if len(remaining) == 0 {
+			n.State = nettingDone
+		}
+		_, err = c.DB.ExecContext(ctx, `UPDATE nettings SET state=$1, amount=$2 WHERE id=$3`, n.State, n.Amount, n.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "recording settled netting")
+		}
+		ps = remaining
+	}
+	if n.State != nettingPaying {
+		return ready, nil
+	}
+
+	result, rec, payErr := c.payNetting(ctx, sc, n)
+	if result == WithdrawalPending {
+		log.Printf("netted payment %d: %s", n.ID, payErr)
+		return ready, nil
+	}
+	peggedOut := pegOutOK
+	if result == WithdrawalRejected {
+		log.Printf("netted payment %d failed, refunding its %d exports: %s", n.ID, len(ps), payErr)
+		peggedOut = pegOutFail
+	}
+	for _, p := range ps {
+		err := c.recordSubmitError(ctx, p.TxID, payErr)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := c.transitionPegOut(ctx, p.TxID, p.State, peggedOut, func(dbtx *sql.Tx) error {
+			if rec == nil {
+				return nil
+			}
+			const q = `UPDATE exports SET stellar_tx_hash=$1, ledger=$2, completed_ms=$3 WHERE txid=$4`
+			_, err := dbtx.ExecContext(ctx, q, rec.StellarTxHash, rec.Ledger, rec.CompletedMS, p.TxID)
+			return errors.Wrapf(err, "recording netted payment of export %x", p.TxID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("netted export %x is no longer in state %s", p.TxID, p.State)
+		}
+		p.State = peggedOut
+		ready = append(ready, p)
+	}
+	var hash interface{}
+	if rec != nil {
+		hash = rec.StellarTxHash
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE nettings SET state=$1, stellar_tx_hash=$2 WHERE id=$3`, nettingDone, hash, n.ID)
+	return ready, errors.Wrap(err, "recording netted payment")
+}
+
+// unnet removes an export from its netting.
+func (c *Custodian) unnet(ctx context.Context, txid []byte) error {
+	_, err := c.DB.ExecContext(ctx, `DELETE FROM netted_exports WHERE txid=$1`, txid)
+	return errors.Wrapf(err, "removing export %x from its netting", txid)
+}
+
+// payNetting submits the payment of netting n
+// from the custodian account through its shared sequencer,
+// building it with the account's next sequence number
+// unless an earlier build may still be applied.
+// It returns the receipt of the payment if it was applied.
+// It is pending while the signing policy holds it.
+func (c *Custodian) payNetting(ctx context.Context, sc *stellarChain, n *netting) (WithdrawalResult, *PegOutReceipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	custodian := sc.account
+	if n.Seqnum != 0 {
+		// An earlier submission may have been applied,
+		// or still may be until the custodian account's sequence number passes it.
+		// The sequence number is read first,
+		// so that a build it has passed is in the account's history if applied.
+		tx, err := sc.nettingTx(n)
+		if err != nil {
+			return WithdrawalRejected, nil, err
+		}
+		seqnum, err := stellar.WithContext(ctx, sc.hclient).SequenceForAccount(custodian)
+		if err != nil {
+			return WithdrawalPending, nil, errors.Wrap(err, "getting custodian sequence number")
+		}
+		applied, err := sc.loadTx(ctx, tx)
+		if err != nil {
+			return WithdrawalPending, nil, err
+		}
+		if applied != nil {
+			return WithdrawalApplied, receipt(applied.Hash, applied.Ledger, applied.LedgerCloseTime, c.nowMS()), nil
+		}
+		if int64(seqnum) >= n.Seqnum {
+			n.Seqnum = 0
+		}
+	}
+	sg := n.signing()
+	ok, err := c.checkSigningPolicy(ctx, sg)
+	if err != nil {
+		return WithdrawalPending, nil, err
+	}
+	if !ok {
+		return WithdrawalPending, nil, fmt.Errorf("held by the signing policy as %x", sg.ID)
+	}
+	var (
+		tx       *stellar.Tx
+		buildErr error
+	)
+	earlier := n.Seqnum
+	succ, err := sc.seqs.SubmitContext(ctx, custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		if earlier != 0 && int64(seqnum) != earlier {
+			// Only the earlier build may be resubmitted
+			// until the account's sequence number passes it.
+			return nil, fmt.Errorf("custodian sequence number %d is not that of the earlier build, %d", seqnum, earlier)
+		}
+		if int64(seqnum) != n.Seqnum {
+			n.Seqnum = int64(seqnum)
+			_, err := c.DB.ExecContext(ctx, `UPDATE nettings SET seqnum=$1 WHERE id=$2`, n.Seqnum, n.ID)
+			if err != nil {
+				return nil, errors.Wrap(err, "recording netted payment sequence number")
+			}
+		}
+		tx, buildErr = sc.nettingTx(n)
+		return tx, buildErr
+	}, sc.seed)
+	if buildErr != nil {
+		return WithdrawalRejected, nil, buildErr
+	}
+	if err == nil {
+		return WithdrawalApplied, receipt(succ.Hash, succ.Ledger, time.Time{}, c.nowMS()), nil
+	}
+	switch resultCode(err) {
+	case "tx_too_late":
+		// Only an earlier submission can still have been applied.
+		applied, ferr := sc.loadTx(ctx, tx)
+		if ferr != nil {
+			return WithdrawalPending, nil, ferr
+		}
+		if applied != nil {
+			return WithdrawalApplied, receipt(applied.Hash, applied.Ledger, applied.LedgerCloseTime, c.nowMS()), nil
+		}
+		return WithdrawalRejected, nil, errors.Wrap(err, "netted payment expired")
+	case "tx_failed":
+		// The failed tx used its sequence number.
+		return WithdrawalRejected, nil, errors.Wrap(err, "submitting netted payment")
+	}
+	return WithdrawalPending, nil, errors.Wrap(err, "submitting netted payment")
+}
+
+func receipt(hash string, ledger int32, closed time.Time, nowMS int64) *PegOutReceipt {
+	rec := &PegOutReceipt{StellarTxHash: hash, Ledger: ledger, CompletedMS: nowMS}
+	if !closed.IsZero() {
+		rec.CompletedMS = closed.UnixNano() / int64(time.Millisecond)
+	}
+	return rec
+}
+
+// nettingTx builds the payment tx of netting n.
+func (s *stellarChain) nettingTx(n *netting) (*stellar.Tx, error) {
+	asset, err := stellar.DecodeAsset([]byte(n.AssetXDR))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling asset from XDR %x", n.AssetXDR)
+	}
+	tx := &stellar.Tx{
+		Network: s.network,
+		Source:  s.account,
+		SeqNum:  stellar.SequenceNumber(n.Seqnum),
+		BaseFee: baseFee,
+		Memo:    Destination{MemoType: n.MemoType, Memo: n.Memo}.memo(),
+		Ops:     []stellar.Op{pegOutPayment(s.account, n.Payee, asset, n.Amount)},
+	}
+	if n.MaxTime > 0 {
+		tx.TimeBounds = &stellar.TimeBounds{MaxTime: n.MaxTime}
+	}
+	return tx, nil
+}
+
+// settleResult is the outcome of submitting a settlement tx.
+type settleResult int
+
+const (
+	settlePending settleResult = iota
+	settleApplied
+
+	// settlePaidAlone means the export's own peg-out was applied instead.
+	settlePaidAlone
+
+	// settleUnauthorized means the pre-export tx
+	// did not preauthorize this settlement tx.
+	settleUnauthorized
+)
+
+// settle submits the settlement tx of withdrawal w.
+func (s *stellarChain) settle(ctx context.Context, w *Withdrawal) (settleResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	tx, err := buildSettleTx(s.account, w.Recipient, w.TempAddr, s.network, stellar.SequenceNumber(w.Seqnum))
+	if err != nil {
+		return settleUnauthorized, errors.Wrap(err, "building settlement tx")
+	}
+	_, err = stellar.SignAndSubmitTx(stellar.WithContext(ctx, s.hclient), tx, s.seed)
+	if err == nil {
+		return settleApplied, nil
+	}
+	switch resultCode(err) {
+	case "tx_bad_auth":
+		return settleUnauthorized, err
+	case "tx_no_account", "tx_bad_seq":
+		// The temp account's sequence number is used,
+		// by an earlier submission of the settlement tx
+		// or by the export's own peg-out.
+		applied, ferr := s.loadTx(ctx, tx)
+		if ferr != nil {
+			return settlePending, ferr
+		}
+		if applied != nil {
+			return settleApplied, nil
+		}
+		pegOutTx, ferr := s.findPegOut(ctx, w)
+		if ferr != nil {
+			return settlePending, ferr
+		}
+		if pegOutTx != nil {
+			return settlePaidAlone, nil
+		}
+	}
+	return settlePending, errors.Wrap(err, "submitting settlement tx")
+}
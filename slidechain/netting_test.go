@@ -0,0 +1,329 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestNetting(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	var kps []*keypair.Full
+	for i := 0; i < 5; i++ {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		kps = append(kps, kp)
+	}
+	custKP, exchKP, walletKP, exporters := kps[0], kps[1], kps[2], kps[3:]
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.NetMin = 2
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n byte
+		export := func(exporter *keypair.Full, amount int64, dest Destination, nettable bool) *pegOut {
+			t.Helper()
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporter, custKP.Address(), native, amount, TimeBounds{}, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+			p := &pegOut{
+				TxID:        bytes.Repeat([]byte{n}, 32),
+				AssetXDR:    nativeXDR,
+				TempAddr:    tempAddr,
+				Seqnum:      int64(seqnum),
+				Exporter:    exporter.Address(),
+				Amount:      amount,
+				Anchor:      []byte{n},
+				Pubkey:      testRecipPubKey,
+				Destination: dest,
+				Nettable:    nettable,
+			}
+			err = c.insertExport(ctx, p.TxID, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		exch := Destination{Account: exchKP.Address(), MemoType: "id", Memo: "7"}
+		wallet := Destination{Account: walletKP.Address()}
+		const amount = int64(xlm.Lumen)
+
+		netted := []*pegOut{
+			export(exporters[0], amount, exch, true),
+			export(exporters[1], 2*amount, exch, true),
+			export(exporters[0], 3*amount, exch, true),
+		}
+		alone := export(exporters[1], 4*amount, exch, false)
+		other := export(exporters[0], 5*amount, Destination{Account: exchKP.Address(), MemoType: "id", Memo: "8"}, true)
+
+		// The peg-out of one export to the wallet was applied
+		// before a crash left it not yet pegged out.
+		paid := export(exporters[0], amount, wallet, true)
+		unpaid := export(exporters[1], 2*amount, wallet, true)
+		if got, err := c.chain.SubmitWithdrawal(ctx, paid.withdrawal(), 0); got != WithdrawalApplied {
+			t.Fatalf("got result %d (error %v), want %d", got, err, WithdrawalApplied)
+		}
+
+		exchBefore, _ := srv.Balance(exchKP.Address(), native)
+		walletBefore, _ := srv.Balance(walletKP.Address(), native)
+		txsBefore := len(srv.AccountTransactions(exchKP.Address(), ""))
+		ready, err := c.pegOutPending(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 7 {
+			t.Errorf("got %d exports ready for the post-peg-out tx, want 7", len(ready))
+		}
+		for _, p := range append(netted, alone, other, paid, unpaid) {
+			var state pegOutState
+			err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != pegOutOK {
+				t.Errorf("export %x is in state %s, want ok", p.TxID[:1], state)
+			}
+		}
+
+		exchAfter, _ := srv.Balance(exchKP.Address(), native)
+		if got, want := exchAfter-exchBefore, 15*amount; got != want {
+			t.Errorf("exchange balance rose by %d, want %d", got, want)
+		}
+		// One netted payment, and one each for the others.
+		if got := len(srv.AccountTransactions(exchKP.Address(), "")) - txsBefore; got != 3 {
+			t.Errorf("exchange got %d txs, want 3", got)
+		}
+		walletAfter, _ := srv.Balance(walletKP.Address(), native)
+		if got, want := walletAfter-walletBefore, 2*amount; got != want {
+			t.Errorf("wallet balance rose by %d after the earlier peg-out, want %d", got, want)
+		}
+
+		// The netted exports' temp accounts are merged,
+		// and each records the netted payment.
+		var hash string
+		err = db.QueryRow(`SELECT stellar_tx_hash FROM nettings WHERE payee=$1 AND memo=$2 AND state=$3`, exchKP.Address(), "7", nettingDone).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range netted {
+			if _, ok := srv.Balance(p.TempAddr, native); ok {
+				t.Errorf("temp account of netted export %x is not merged", p.TxID[:1])
+			}
+			var got string
+			err = db.QueryRow(`SELECT stellar_tx_hash FROM exports WHERE txid=$1`, p.TxID).Scan(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != hash {
+				t.Errorf("export %x records peg-out tx %s, want netted payment %s", p.TxID[:1], got, hash)
+			}
+		}
+		var left int
+		err = db.QueryRow(`SELECT COUNT(*) FROM netted_exports WHERE txid=$1`, paid.TxID).Scan(&left)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left != 0 {
+			t.Error("export pegged out before its settlement is still netted")
+		}
+	})
+}
+
+func TestNettingSequenced(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payeeKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(payeeKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqnum := func() int64 {
+			t.Helper()
+			seqnum, err := srv.Client().SequenceForAccount(custKP.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int64(seqnum)
+		}
+		n := &netting{
+			netKey: netKey{AssetXDR: string(nativeXDR), Payee: payeeKP.Address()},
+			Amount: int64(xlm.Lumen),
+		}
+
+		// An earlier build the account has not passed is not replaced.
+		n.Seqnum = seqnum() + 2
+		if got, _, err := c.payNetting(ctx, sc, n); got != WithdrawalPending {
+			t.Errorf("got result %d (error %v) with an earlier build pending, want %d", got, err, WithdrawalPending)
+		}
+
+		// A fresh build is rebuilt by the shared sequencer after tx_bad_seq.
+		n.Seqnum = 0
+		srv.Inject(horizonmock.EndpointSubmit, horizonmock.BadSeq, 1)
+		got, rec, err := c.payNetting(ctx, sc, n)
+		if got != WithdrawalApplied || rec == nil {
+			t.Fatalf("got result %d (error %v), want %d", got, err, WithdrawalApplied)
+		}
+		if n.Seqnum != seqnum() {
+			t.Errorf("netted payment built with sequence number %d, want the applied %d", n.Seqnum, seqnum())
+		}
+
+		// Submitting it again finds it applied.
+		got, again, err := c.payNetting(ctx, sc, n)
+		if got != WithdrawalApplied || again == nil || again.StellarTxHash != rec.StellarTxHash {
+			t.Errorf("got result %d %+v (error %v) resubmitting, want %d with tx %s", got, again, err, WithdrawalApplied, rec.StellarTxHash)
+		}
+	})
+}
+
+func TestNettingSigningPolicy(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payeeKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(payeeKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const amount = int64(xlm.Lumen)
+
+		// Each export passes the policy by itself,
+		// but their netted payment does not.
+		w := httptest.NewRecorder()
+		c.SigningPolicy(w, httptest.NewRequest("POST", "/admin/signing-policy", strings.NewReader("large: amount > 20000000")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d setting the policy: %s", w.Code, w.Body)
+		}
+		for i := byte(1); i <= 3; i++ {
+			p := &pegOut{TxID: bytes.Repeat([]byte{i}, 32), AssetXDR: nativeXDR, Amount: amount, Destination: Destination{Account: payeeKP.Address()}}
+			ok, err := c.checkSigningPolicy(ctx, p.signing())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("export %d held by the signing policy", i)
+			}
+		}
+		n := &netting{
+			ID:     1,
+			netKey: netKey{AssetXDR: string(nativeXDR), Payee: payeeKP.Address()},
+			Amount: 3 * amount,
+		}
+		// The exports it pays are in the day's totals already.
+		f, err := c.policyFacts(ctx, n.signing())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.DailyTotal != 3*amount || f.DailyCount != 3 {
+			t.Errorf("got daily total %d of %d payments for the netting, want %d of 3", f.DailyTotal, f.DailyCount, 3*amount)
+		}
+
+		txs := len(srv.Transactions())
+		if got, _, err := c.payNetting(ctx, sc, n); got != WithdrawalPending {
+			t.Fatalf("got result %d (error %v) paying a held netting, want %d", got, err, WithdrawalPending)
+		}
+		if len(srv.Transactions()) != txs || n.Seqnum != 0 {
+			t.Fatal("held netted payment was submitted")
+		}
+
+		w = httptest.NewRecorder()
+		c.PolicyHolds(w, httptest.NewRequest("GET", "/admin/signing-policy/holds", nil))
+		var holds []policyHold
+		err = json.NewDecoder(w.Body).Decode(&holds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := n.signing().ID
+		if len(holds) != 1 || holds[0].Kind != "netting" || holds[0].TxID != hex.EncodeToString(id) || holds[0].Amount != 3*amount {
+			t.Fatalf("got holds %+v, want the netting of %d", holds, 3*amount)
+		}
+		w = httptest.NewRecorder()
+		c.PolicyHolds(w, httptest.NewRequest("POST", "/admin/signing-policy/holds?txid="+holds[0].TxID, nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d approving the netting: %s", w.Code, w.Body)
+		}
+
+		if got, rec, err := c.payNetting(ctx, sc, n); got != WithdrawalApplied || rec == nil {
+			t.Errorf("got result %d (error %v) paying an approved netting, want %d", got, err, WithdrawalApplied)
+		}
+	})
+}
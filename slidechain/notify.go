@@ -0,0 +1,355 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/notify"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+const notifyInterval = 5 * time.Second
+
+// Built-in templates, for the events users most likely care about.
+// The templates see a notifyData.
+var (
+	notifySubjects = map[string]string{
+		"peg-in.paid":     "Deposit received",
+		"peg-in.imported": "Deposit pegged in",
+		"peg-in.expired":  "Deposit window closed",
+		"export.not-yet":  "Withdrawal requested",
+		"export.ok":       "Withdrawal complete",
+		"export.fail":     "Withdrawal failed",
+		"export.refunded": "Withdrawal refunded",
+	}
+	notifyBodies = map[string]string{
+		"peg-in.paid":     "Your deposit of {{.Amount}} {{.Asset}} has arrived and will be pegged in shortly.\n\nPeg-in {{.Key}}\n",
+		"peg-in.imported": "Your deposit of {{.Amount}} {{.Asset}} has been imported to the slidechain.\n\nPeg-in {{.Key}}\n",
+		"peg-in.expired":  "No deposit arrived for your peg-in in time, so it has expired. A deposit sent for it now will be refunded.\n\nPeg-in {{.Key}}\n",
+		"export.not-yet":  "Your withdrawal of {{.Amount}} {{.Asset}} is being pegged out.\n\nExport {{.Key}}\n",
+		"export.ok":       "Your withdrawal of {{.Amount}} {{.Asset}} has been paid.\n\nExport {{.Key}}\n",
+		"export.fail":     "Your withdrawal of {{.Amount}} {{.Asset}} could not be paid and will be refunded.\n\nExport {{.Key}}\n",
+		"export.refunded": "Your withdrawal of {{.Amount}} {{.Asset}} has been refunded on the slidechain.\n\nExport {{.Key}}\n",
+	}
+)
+
+// NotifyRequest is the request body of /notifications.
+type NotifyRequest struct {
+	Pubkey  []byte `json:"pubkey"`
+	Channel string `json:"channel"`
+
+	// Address is where to send messages on the channel,
+	// e.g. an email address or phone number.
+	// Empty opts out of the channel.
+	Address string `json:"address"`
+
+	// Events limits messages to the given events, e.g. peg-in.imported.
+	// Empty means all events with templates.
+	Events []string `json:"events"`
+
+	// TimeMS is when the request was made.
+	// A request older than the last one for the same pubkey and channel is refused.
+	TimeMS int64 `json:"time_ms"`
+
+	// Signature is by Pubkey of SigMsg.
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message signed in a /notifications request.
+func (r *NotifyRequest) SigMsg() []byte {
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(r.TimeMS))
+	msg := []byte("slidechain notify\x00")
+	msg = append(msg, r.Pubkey...)
+	for _, s := range []string{r.Channel, r.Address, strings.Join(r.Events, ",")} {
+		msg = append(msg, s...)
+		msg = append(msg, 0)
+	}
+	msg = append(msg, timeBytes[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// notifyData is what the notification templates see.
+type notifyData struct {
+	Event  string // e.g. peg-in.imported
+	Key    string // hex nonce hash of a peg-in, or txvm tx ID of an export
+	Amount int64
+	Asset  string
+	TimeMS int64
+}
+
+// notifyEvents are the names of the events users may subscribe to.
+func notifyEvents() map[string]bool {
+	events := make(map[string]bool)
+	for _, s := range pegInStateNames {
+		events["peg-in."+s] = true
+	}
+	for _, s := range pegOutStateNames {
+		events["export."+s] = true
+	}
+	return events
+}
+
+// Notifications is the handler for /notifications,
+// where a user opts in to or out of messages on one channel
+// about its peg-ins and peg-outs.
+func (c *Custodian) Notifications(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if cfg == nil {
+		net.Errorf(w, http.StatusNotFound, "notifications are not configured")
+		return
+	}
+	notifiers := newNotifiers(cfg.Notify)
+	if len(notifiers) == 0 {
+		net.Errorf(w, http.StatusNotFound, "notifications are not configured")
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var p NotifyRequest
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(p.Pubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	if _, ok := notifiers[p.Channel]; !ok {
+		net.Errorf(w, http.StatusBadRequest, "unknown channel %q", p.Channel)
+		return
+	}
+	if p.Channel == "email" && p.Address != "" {
+		if a, err := mail.ParseAddress(p.Address); err != nil || a.Address != p.Address {
+			net.Errorf(w, http.StatusBadRequest, "address %q is not an email address", p.Address)
+			return
+		}
+	}
+	if strings.ContainsAny(p.Address, "\r\n") {
+		net.Errorf(w, http.StatusBadRequest, "address must be one line")
+		return
+	}
+	known := notifyEvents()
+	for _, e := range p.Events {
+		if !known[e] {
+			net.Errorf(w, http.StatusBadRequest, "unknown event %q", e)
+			return
+		}
+	}
+	if !c.checkRequestTime(w, "time_ms", p.TimeMS) {
+		return
+	}
+	if !ed25519.Verify(p.Pubkey, p.SigMsg(), p.Signature) {
+		net.Errorf(w, http.StatusUnauthorized, "bad signature")
+		return
+	}
+
+	// Opting out keeps the row, with an empty address,
+	// so that replaying an older opt-in is refused.
+	const q = `INSERT INTO notify_subscriptions (pubkey, channel, address, events, time_ms) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (pubkey, channel) DO UPDATE SET address=excluded.address, events=excluded.events, time_ms=excluded.time_ms
+		WHERE excluded.time_ms > notify_subscriptions.time_ms`
+	res, err := c.DB.ExecContext(req.Context(), q, p.Pubkey, p.Channel, p.Address, strings.Join(p.Events, ","), p.TimeMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording subscription: %s", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		net.Errorf(w, http.StatusConflict, "a newer request for this channel has been made")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newNotifiers returns the configured notifiers by channel name.
+func newNotifiers(cfg config.Notify) map[string]notify.Notifier {
+	notifiers := make(map[string]notify.Notifier)
+	if cfg.SMTPAddr != "" {
+		notifiers["email"] = &notify.SMTP{
+			Addr:     cfg.SMTPAddr,
+			From:     cfg.SMTPFrom,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		}
+	}
+	for _, wh := range cfg.Webhooks {
+		name, url := config.SplitNamed(wh)
+		notifiers[name] = &notify.Webhook{URL: url}
+	}
+	return notifiers
+}
+
+// notifyUsers sends notifications of new state events.
+// Runs as a goroutine.
+func (c *Custodian) notifyUsers(ctx context.Context) {
+	defer log.Print("notifyUsers exiting")
+
+	ticker := time.NewTicker(notifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.notifyPending(ctx)
+		if err != nil {
+			log.Printf("notifying users: %s", err)
+		}
+	}
+}
+
+// notifyPending sends notifications of the state events
+// after the one in notify_cursor, advancing it.
+// The cursor starts at the latest event,
+// so that turning on notifications does not report the past,
+// and advances whether or not any channels are configured.
+// A message that cannot be delivered is logged and not retried.
+func (c *Custodian) notifyPending(ctx context.Context) error {
+	var last int64
+	err := c.DB.QueryRowContext(ctx, `SELECT last_event FROM notify_cursor`).Scan(&last)
+	if err == sql.ErrNoRows {
+		_, err = c.DB.ExecContext(ctx, `INSERT INTO notify_cursor (last_event) SELECT COALESCE(MAX(id), 0) FROM state_events`)
+		return errors.Wrap(err, "initializing notify cursor")
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading notify cursor")
+	}
+
+	type event struct {
+		id, timeMS int64
+		kind, to   string
+		key        []byte
+	}
+	var events []event
+	const q = `SELECT id, time_ms, kind, key, to_state FROM state_events WHERE id > $1 ORDER BY id`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, last, func(id, timeMS int64, kind string, key []byte, to string) {
+		events = append(events, event{id: id, timeMS: timeMS, kind: kind, to: to, key: key})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading state events")
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	var (
+		notifiers map[string]notify.Notifier
+		tmpl      *notify.Templates
+	)
+	if cfg := c.config(); cfg != nil {
+		notifiers = newNotifiers(cfg.Notify)
+		if len(notifiers) > 0 {
+			tmpl, err = notify.NewTemplates(notifySubjects, notifyBodies)
+			if err != nil {
+				return err
+			}
+			if cfg.Notify.TemplateDir != "" {
+				err = tmpl.Override(cfg.Notify.TemplateDir)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, e := range events {
+		if tmpl != nil {
+			err = c.notifyEvent(ctx, notifiers, tmpl, e.kind+"."+e.to, e.kind, e.key, e.timeMS)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = c.DB.ExecContext(ctx, `UPDATE notify_cursor SET last_event=$1`, e.id)
+		if err != nil {
+			return errors.Wrap(err, "advancing notify cursor")
+		}
+	}
+	return nil
+}
+
+// notifyEvent sends the message for event
+// about the peg-in or export with the given key
+// to each of its user's subscriptions that includes the event.
+func (c *Custodian) notifyEvent(ctx context.Context, notifiers map[string]notify.Notifier, tmpl *notify.Templates, event, kind string, key []byte, timeMS int64) error {
+	var q string
+	switch kind {
+	case "peg-in":
+		// An expired peg-in has moved to expired_pegs.
+		q = `SELECT recipient_pubkey, COALESCE(amount, 0), COALESCE(asset_xdr, x'') FROM pegs WHERE nonce_hash=$1
+			UNION ALL SELECT recipient_pubkey, 0, x'' FROM expired_pegs WHERE nonce_hash=$1 LIMIT 1`
+	case "export":
+		q = `SELECT pubkey, amount, asset_xdr FROM exports WHERE txid=$1`
+	default:
+		return nil
+	}
+	var (
+		pubkey, assetXDR []byte
+		data             = notifyData{Event: event, Key: hex.EncodeToString(key), TimeMS: timeMS}
+	)
+	err := c.DB.QueryRowContext(ctx, q, key).Scan(&pubkey, &data.Amount, &assetXDR)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading %s %x", kind, key)
+	}
+	data.Asset = assetName(assetXDR)
+
+	subject, body, ok, err := tmpl.Render(event, data)
+	if err != nil || !ok {
+		return err
+	}
+	var msgs []notify.Message
+	const subsQ = `SELECT channel, address, events FROM notify_subscriptions WHERE pubkey=$1 AND address != ''`
+	err = sqlutil.ForQueryRows(ctx, c.DB, subsQ, pubkey, func(channel, address, events string) {
+		if events != "" && !strings.Contains(","+events+",", ","+event+",") {
+			return
+		}
+		msgs = append(msgs, notify.Message{Channel: channel, To: address, Event: event, Subject: subject, Body: body})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading subscriptions")
+	}
+	for _, m := range msgs {
+		n, ok := notifiers[m.Channel]
+		if !ok {
+			continue
+		}
+		err = n.Notify(ctx, m)
+		if err != nil {
+			log.Printf("notifying %s %x of %s by %s: %s", kind, key, event, m.Channel, err)
+		}
+	}
+	return nil
+}
+
+// assetName is the asset's canonical Stellar string form,
+// or its hex encoding if it is not a Stellar asset,
+// as on an EVM chain.
+func assetName(assetXDR []byte) string {
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return hex.EncodeToString(assetXDR)
+	}
+	return stellar.AssetKey(asset)
+}
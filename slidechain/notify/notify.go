@@ -0,0 +1,173 @@
+// Package notify delivers messages to users
+// over pluggable channels such as email, SMS gateways, and push services.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Message is a notification to one user.
+type Message struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"`    // the user's address on the channel
+	Event   string `json:"event"` // what the message is about, e.g. peg-in.imported
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages over one channel.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// SMTP delivers messages as email through an SMTP server.
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	Username string // if set, used with Password for PLAIN auth
+	Password string
+}
+
+// Notify sends m to the email address m.To.
+// The SMTP exchange does not observe ctx.
+func (s *SMTP) Notify(ctx context.Context, m Message) error {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return errors.New("newline in email header")
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s", s.From, m.To, m.Subject, m.Body)
+	err := smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, []byte(msg))
+	return errors.Wrapf(err, "sending email to %s", m.To)
+}
+
+// Webhook delivers messages by POSTing them as JSON to a gateway,
+// which passes them on, e.g. by SMS or push notification.
+type Webhook struct {
+	URL string
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Notify posts m to the gateway.
+func (wh *Webhook) Notify(ctx context.Context, m Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "encoding message")
+	}
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "posting to %s", wh.URL)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s from %s", resp.Status, wh.URL)
+	}
+	return nil
+}
+
+// Templates renders the subject and body of the message for each event
+// from text/template templates.
+type Templates struct {
+	subjects, bodies map[string]*template.Template
+}
+
+// NewTemplates parses the subject and body templates,
+// each keyed by event.
+func NewTemplates(subjects, bodies map[string]string) (*Templates, error) {
+	t := &Templates{
+		subjects: make(map[string]*template.Template),
+		bodies:   make(map[string]*template.Template),
+	}
+	for _, x := range []struct {
+		src map[string]string
+		dst map[string]*template.Template
+	}{{subjects, t.subjects}, {bodies, t.bodies}} {
+		for event, text := range x.src {
+			tmpl, err := template.New(event).Parse(text)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing template for %s", event)
+			}
+			x.dst[event] = tmpl
+		}
+	}
+	return t, nil
+}
+
+// Override replaces t's templates with any in dir,
+// named EVENT.subject and EVENT.body.
+func (t *Templates) Override(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return errors.Wrap(err, "reading template dir")
+	}
+	for _, x := range []struct {
+		ext string
+		dst map[string]*template.Template
+	}{{".subject", t.subjects}, {".body", t.bodies}} {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+x.ext))
+		if err != nil {
+			return errors.Wrapf(err, "listing %s templates", x.ext)
+		}
+		for _, path := range paths {
+			text, err := ioutil.ReadFile(path)
+			if err != nil {
+				return errors.Wrap(err, "reading template")
+			}
+			event := strings.TrimSuffix(filepath.Base(path), x.ext)
+			tmpl, err := template.New(event).Parse(string(text))
+			if err != nil {
+				return errors.Wrapf(err, "parsing %s", path)
+			}
+			x.dst[event] = tmpl
+		}
+	}
+	return nil
+}
+
+// Render returns the subject and body for event with the given data.
+// It reports false if there is no body template for event;
+// the subject may be empty.
+func (t *Templates) Render(event string, data interface{}) (subject, body string, ok bool, err error) {
+	bodyTmpl, ok := t.bodies[event]
+	if !ok {
+		return "", "", false, nil
+	}
+	buf := new(bytes.Buffer)
+	if subjTmpl, ok := t.subjects[event]; ok {
+		err = subjTmpl.Execute(buf, data)
+		if err != nil {
+			return "", "", false, errors.Wrapf(err, "rendering subject of %s", event)
+		}
+		subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	err = bodyTmpl.Execute(buf, data)
+	if err != nil {
+		return "", "", false, errors.Wrapf(err, "rendering body of %s", event)
+	}
+	return subject, buf.String(), true, nil
+}
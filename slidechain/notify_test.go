@@ -0,0 +1,162 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/notify"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestNotify(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	var (
+		mu   sync.Mutex
+		msgs []notify.Message
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var m notify.Message
+		err := json.NewDecoder(req.Body).Decode(&m)
+		if err != nil {
+			t.Errorf("decoding message: %s", err)
+		}
+		mu.Lock()
+		msgs = append(msgs, m)
+		mu.Unlock()
+	}))
+	defer gateway.Close()
+	received := func() []notify.Message {
+		mu.Lock()
+		defer mu.Unlock()
+		got := msgs
+		msgs = nil
+		return got
+	}
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Notify.Webhooks = []string{"sms=" + gateway.URL}
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribe := func(address string, timeMS int64, signer ed25519.PrivateKey, wantCode int) {
+			t.Helper()
+			r := NotifyRequest{Pubkey: pub, Channel: "sms", Address: address, TimeMS: timeMS}
+			r.Signature = ed25519.Sign(signer, r.SigMsg())
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.Notifications(w, httptest.NewRequest("POST", "/notifications", bytes.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from /notifications, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+		pegIn := func(nonce byte) []byte {
+			t.Helper()
+			nonceHash := bytes.Repeat([]byte{nonce}, 32)
+			err := c.insertPegIn(ctx, nonceHash, pub, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assetXDR, err := stellar.NativeAsset().MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec(`UPDATE pegs SET amount=50, asset_xdr=$1 WHERE nonce_hash=$2`, assetXDR, nonceHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.transitionPegIn(ctx, nonceHash, pegInRecorded, pegInPaid); err != nil {
+				t.Fatal(err)
+			}
+			return nonceHash
+		}
+
+		// Events before the first pass are not reported.
+		pegIn(1)
+		err = c.notifyPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, otherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribe("+15555550100", c.nowMS(), otherPrv, http.StatusUnauthorized)
+		subscribe("+15555550100", c.nowMS()-int64(time.Hour/time.Millisecond), prv, http.StatusBadRequest)
+		subscribe("+15555550100", c.nowMS(), prv, http.StatusNoContent)
+
+		nonceHash := pegIn(2)
+		if _, err = c.transitionPegIn(ctx, nonceHash, pegInPaid, pegInImported); err != nil {
+			t.Fatal(err)
+		}
+		err = c.notifyPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := received()
+		if len(got) != 2 {
+			t.Fatalf("got %d messages, want 2 (paid and imported): %+v", len(got), got)
+		}
+		for i, event := range []string{"peg-in.paid", "peg-in.imported"} {
+			m := got[i]
+			if m.Event != event || m.Channel != "sms" || m.To != "+15555550100" {
+				t.Errorf("message %d is %s on %s to %s, want %s on sms to +15555550100", i, m.Event, m.Channel, m.To, event)
+			}
+			if !strings.Contains(m.Body, "50 native") {
+				t.Errorf("message %d body %q does not give the amount", i, m.Body)
+			}
+		}
+
+		// Opt out, then try replaying the opt-in.
+		optInMS := c.nowMS()
+		now = now.Add(time.Second)
+		subscribe("", c.nowMS(), prv, http.StatusNoContent)
+		subscribe("+15555550100", optInMS, prv, http.StatusConflict)
+		pegIn(3)
+		err = c.notifyPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := received(); len(got) != 0 {
+			t.Errorf("got %d messages after opting out, want 0", len(got))
+		}
+	})
+}
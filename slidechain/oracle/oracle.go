@@ -0,0 +1,171 @@
+// Package oracle prices assets in a reference currency,
+// so that limits and reports can be given in it
+// rather than in the units of each asset.
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// ErrNoPrice means an oracle has no price for an asset.
+var ErrNoPrice = errors.New("no price")
+
+// An Oracle prices assets in its reference currency.
+// A price is the amount of the reference currency
+// that one unit of the asset is worth.
+// Every Stellar amount has 7 decimal places,
+// so a price converts stroops of the asset
+// to stroops of the reference currency too.
+type Oracle interface {
+	Price(ctx context.Context, asset stellar.Asset) (*big.Rat, error)
+}
+
+// Value is the worth of amount of asset in o's reference currency,
+// rounded down.
+func Value(ctx context.Context, o Oracle, asset stellar.Asset, amount int64) (int64, error) {
+	price, err := o.Price(ctx, asset)
+	if err != nil {
+		return 0, err
+	}
+	v := new(big.Rat).Mul(price, new(big.Rat).SetInt64(amount))
+	n := new(big.Int).Quo(v.Num(), v.Denom())
+	if !n.IsInt64() {
+		return 0, fmt.Errorf("value of %d %s is out of range", amount, stellar.AssetKey(asset))
+	}
+	return n.Int64(), nil
+}
+
+// Static prices assets at fixed rates,
+// keyed by their stellar.AssetKey.
+type Static map[string]*big.Rat
+
+// ParseRates parses entries of oracle.rates,
+// in the form "ASSET=PRICE"
+// with ASSET as in assets.allowlist
+// and PRICE a decimal or fraction, such as 0.25 or 1/4.
+func ParseRates(entries []string) (Static, error) {
+	s := make(Static)
+	for _, e := range entries {
+		var key, price string
+		if i := strings.LastIndex(e, "="); i >= 0 {
+			key, price = e[:i], e[i+1:]
+		}
+		asset, err := stellar.ParseAssetKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", e, err)
+		}
+		r, ok := new(big.Rat).SetString(price)
+		if !ok || r.Sign() < 0 {
+			return nil, fmt.Errorf("%q: price %q is not a nonnegative decimal or fraction", e, price)
+		}
+		s[stellar.AssetKey(asset)] = r
+	}
+	return s, nil
+}
+
+// Price implements Oracle.
+func (s Static) Price(_ context.Context, asset stellar.Asset) (*big.Rat, error) {
+	if r, ok := s[stellar.AssetKey(asset)]; ok {
+		return r, nil
+	}
+	return nil, errors.WithDetailf(ErrNoPrice, "no rate for %s", stellar.AssetKey(asset))
+}
+
+// OrderBooks loads Stellar DEX order books,
+// as stellar.Client does.
+type OrderBooks interface {
+	LoadOrderBook(selling, buying stellar.Asset, limit int) (stellar.OrderBookSummary, error)
+}
+
+// DEX prices assets at the mid-price of their Stellar DEX order books
+// against the reference currency:
+// halfway between the best bid and the best ask.
+// An asset whose book is missing either side has no price.
+// The reference currency is worth 1.
+type DEX struct {
+	Client    OrderBooks
+	Reference stellar.Asset
+
+	// TTL is how long a price is reused before its book is loaded again.
+	TTL time.Duration
+	Now func() time.Time // nil means time.Now
+
+	mu    sync.Mutex
+	cache map[string]dexPrice
+}
+
+type dexPrice struct {
+	price *big.Rat
+	at    time.Time
+}
+
+// Price implements Oracle.
+func (d *DEX) Price(ctx context.Context, asset stellar.Asset) (*big.Rat, error) {
+	if asset == d.Reference {
+		return big.NewRat(1, 1), nil
+	}
+	key := stellar.AssetKey(asset)
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+	d.mu.Lock()
+	p, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now().Sub(p.at) < d.TTL {
+		return p.price, nil
+	}
+
+	book, err := d.Client.LoadOrderBook(asset, d.Reference, 1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading order book of %s", key)
+	}
+	if len(book.Bids) == 0 || len(book.Asks) == 0 {
+		return nil, errors.WithDetailf(ErrNoPrice, "order book of %s against %s has an empty side", key, stellar.AssetKey(d.Reference))
+	}
+	bid, ask := book.Bids[0].PriceR, book.Asks[0].PriceR
+	if bid.D == 0 || ask.D == 0 {
+		return nil, fmt.Errorf("order book of %s has a zero price denominator", key)
+	}
+	mid := new(big.Rat).Add(big.NewRat(int64(bid.N), int64(bid.D)), big.NewRat(int64(ask.N), int64(ask.D)))
+	mid.Quo(mid, big.NewRat(2, 1))
+
+	d.mu.Lock()
+	if d.cache == nil {
+		d.cache = make(map[string]dexPrice)
+	}
+	d.cache[key] = dexPrice{price: mid, at: now()}
+	d.mu.Unlock()
+	return mid, nil
+}
+
+// Fallback asks each oracle in turn
+// until one has a price.
+type Fallback []Oracle
+
+// Price implements Oracle.
+// If none has a price, the first error is returned.
+func (f Fallback) Price(ctx context.Context, asset stellar.Asset) (*big.Rat, error) {
+	var first error
+	for _, o := range f {
+		price, err := o.Price(ctx, asset)
+		if err == nil {
+			return price, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		first = errors.WithDetailf(ErrNoPrice, "no oracle for %s", stellar.AssetKey(asset))
+	}
+	return nil, first
+}
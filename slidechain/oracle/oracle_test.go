@@ -0,0 +1,108 @@
+package oracle
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+const usd = "USD:GBSTRH4QOTWNSVA6E4HFERETX4ZLSR3CIUBLK7AXYII277PFJC4BBYOG"
+
+var eur = func() stellar.Asset {
+	a, err := stellar.ParseAssetKey("EUR:GBSTRH4QOTWNSVA6E4HFERETX4ZLSR3CIUBLK7AXYII277PFJC4BBYOG")
+	if err != nil {
+		panic(err)
+	}
+	return a
+}()
+
+type testBooks struct {
+	book  stellar.OrderBookSummary
+	loads int
+}
+
+func (b *testBooks) LoadOrderBook(selling, buying stellar.Asset, limit int) (stellar.OrderBookSummary, error) {
+	b.loads++
+	return b.book, nil
+}
+
+func TestStatic(t *testing.T) {
+	ctx := context.Background()
+	for _, bad := range []string{"native", "native=x", "native=-1", "bogus=1"} {
+		if _, err := ParseRates([]string{bad}); err == nil {
+			t.Errorf("parsed rate %q", bad)
+		}
+	}
+	rates, err := ParseRates([]string{"native=0.25", usd + "=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Value(ctx, rates, stellar.NativeAsset(), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Errorf("got value %d for 11 at 0.25, want 2", v)
+	}
+	if _, err = rates.Price(ctx, eur); err == nil {
+		t.Error("priced an asset with no rate")
+	}
+}
+
+func TestDEX(t *testing.T) {
+	ctx := context.Background()
+	ref, err := stellar.ParseAssetKey(usd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := new(testBooks)
+	now := time.Unix(1000, 0)
+	d := &DEX{Client: books, Reference: ref, TTL: time.Minute, Now: func() time.Time { return now }}
+
+	if _, err = d.Price(ctx, stellar.NativeAsset()); err == nil {
+		t.Error("priced an asset with an empty order book")
+	}
+	books.book.Bids = []stellar.PriceLevel{{PriceR: stellar.Price{N: 1, D: 10}}}
+	books.book.Asks = []stellar.PriceLevel{{PriceR: stellar.Price{N: 3, D: 10}}}
+	price, err := d.Price(ctx, stellar.NativeAsset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.Cmp(big.NewRat(1, 5)) != 0 {
+		t.Errorf("got price %s, want the mid-price 1/5", price)
+	}
+	books.book.Asks[0].PriceR = stellar.Price{N: 5, D: 10}
+	d.Price(ctx, stellar.NativeAsset())
+	if books.loads != 2 {
+		t.Errorf("loaded the order book %d times within the TTL, want 2", books.loads)
+	}
+	now = now.Add(time.Minute)
+	price, err = d.Price(ctx, stellar.NativeAsset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.Cmp(big.NewRat(3, 10)) != 0 {
+		t.Errorf("got price %s after the TTL, want 3/10", price)
+	}
+	if price, err = d.Price(ctx, ref); err != nil || price.Cmp(big.NewRat(1, 1)) != 0 {
+		t.Errorf("got price %v, %v for the reference currency, want 1", price, err)
+	}
+
+	// A static rate stands in while the DEX has no price.
+	books.book.Bids = nil
+	now = now.Add(time.Minute)
+	f := Fallback{d, Static{stellar.AssetKey(stellar.NativeAsset()): big.NewRat(1, 4)}}
+	price, err = f.Price(ctx, stellar.NativeAsset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.Cmp(big.NewRat(1, 4)) != 0 {
+		t.Errorf("got fallback price %s, want 1/4", price)
+	}
+	if _, err = f.Price(ctx, eur); err == nil {
+		t.Error("priced an asset no oracle knows")
+	}
+}
@@ -0,0 +1,300 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// The functions in this file parse data the custodian reads from
+// Stellar and txvm transactions, which are built by untrusted users.
+// They must return errors, never panic, on malformed input.
+
+// pegInPayment is a payment to the custodian account
+// and its index among the operations of its Stellar tx.
+type pegInPayment struct {
+	stellar.Payment
+	OpIndex int
+	From    string // the sender, or empty for the tx's source account
+}
+
+// sender returns the account that made p in a tx from source,
+// or "" if it was a contract, which cannot be refunded by a payment.
+// A muxed sender is given by its M-address,
+// so that a refund reaches the same user.
+func (p pegInPayment) sender(source string) string {
+	if p.From == "" {
+		return source
+	}
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, stellar.BaseAccount(p.From)); err != nil {
+		return ""
+	}
+	return p.From
+}
+
+// errHorizonOps is the error of pegInPayments
+// for a tx with ops the stellar package does not model,
+// such as a path_payment_strict_send or an invoke_host_function,
+// which may pay the custodian:
+// its payments are read from its ops in Horizon instead.
+var errHorizonOps = errors.New("tx has ops read only from Horizon")
+
+// pegInPayments decodes a Stellar transaction envelope
+// and returns the nonce hash in its memo
+// and its payments to the custodian account, in order,
+// including those to its muxed accounts.
+// A transaction with no hash memo has no peg-in payments.
+func pegInPayments(envXDR, custodian string) ([]byte, []pegInPayment, error) {
+	tx, err := stellar.DecodeTx(envXDR)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unmarshaling Stellar tx")
+	}
+	hash, ok := tx.Memo.(stellar.MemoHash)
+	if !ok {
+		return nil, nil, nil
+	}
+	if hasOtherOps(tx) {
+		return nil, nil, errHorizonOps
+	}
+	var payments []pegInPayment
+	for i, op := range tx.Ops {
+		payment, ok := op.(stellar.Payment)
+		if !ok || stellar.BaseAccount(payment.Destination) != custodian {
+			continue
+		}
+		payments = append(payments, pegInPayment{Payment: payment, OpIndex: i, From: tx.OpSource(i)})
+	}
+	return hash[:], payments, nil
+}
+
+// hasOtherOps reports whether any op of tx is a stellar.OtherOp.
+func hasOtherOps(tx *stellar.Tx) bool {
+	for _, op := range tx.Ops {
+		if _, ok := op.(stellar.OtherOp); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// exportFromLog recognizes the log of an export tx
+// and returns its parsed export reference data.
+// It returns nil and no error if the log is not an export's.
+func exportFromLog(log []txvm.Tuple, chain Chain) (*pegOut, error) {
+	// Check that the log has either expected length for an export tx.
+	// Confirm that its input, log, and output entries are as expected.
+	// If so, look for a specially formatted log ("L") entry
+	// that specifies the Stellar asset code to peg out and the Stellar recipient account ID.
+	if len(log) != 5 && len(log) != 7 {
+		return nil, nil
+	}
+	if logCode(log[0]) != txvm.InputCode {
+		return nil, nil
+	}
+	if logCode(log[1]) != txvm.LogCode {
+		return nil, nil
+	}
+	if logCode(log[len(log)-2]) != txvm.OutputCode {
+		return nil, nil
+	}
+	exportSeedLogItem := log[len(log)-3]
+	if logCode(exportSeedLogItem) != txvm.LogCode {
+		return nil, nil
+	}
+	seed, ok := logBytes(exportSeedLogItem, 1)
+	if !ok || !bytes.Equal(seed, exportContract1Seed[:]) {
+		return nil, nil
+	}
+	refdata, ok := logBytes(log[1], 2)
+	if !ok {
+		return nil, errors.New("export reference data missing")
+	}
+	return parseExportRefdata(refdata, chain)
+}
+
+// exportIssuanceVersion returns the version of the import-issuance program
+// that issued the value locked by export tx,
+// of the asset pegging assetXDR,
+// or 0 if the value is of no imported asset.
+func exportIssuanceVersion(tx *bc.Tx, assetXDR []byte) int {
+	// The export contract's stack is {'T', {pubkey}}, {'S', refdata}, {'V', amount, assetID, anchor}.
+	for _, out := range tx.Outputs {
+		if out.Seed.Byte32() != exportContract1Seed || len(out.Stack) != 3 {
+			continue
+		}
+		val, ok := snapshotItem(out.Stack[2], txvm.ValueCode, 4)
+		if !ok {
+			continue
+		}
+		assetID, ok := logBytes(val, 2)
+		if !ok || len(assetID) != 32 {
+			continue
+		}
+		return issuanceVersion(bc.HashFromBytes(assetID), assetXDR)
+	}
+	return 0
+}
+
+// parseExportRefdata parses and checks the JSON reference data of an export tx,
+// using chain to check its main-chain asset and addresses.
+func parseExportRefdata(data []byte, chain Chain) (*pegOut, error) {
+	var info pegOut
+	err := json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing export reference data")
+	}
+	if info.Amount <= 0 {
+		return nil, errors.New("export amount must be positive")
+	}
+	if len(info.Anchor) != 32 {
+		return nil, errors.New("export anchor must be 32 bytes")
+	}
+	if len(info.Pubkey) != ed25519.PublicKeySize {
+		return nil, errors.New("export pubkey has wrong size")
+	}
+	err = info.ExportEscrow.check()
+	if err != nil {
+		return nil, err
+	}
+	err = chain.ValidateWithdrawal(info.withdrawal())
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// wrapExportFromTx recognizes a wrapped export tx,
+// which pays the exported value to the custodian's reserve
+// with export reference data,
+// and returns its parsed reference data and reserve output.
+// It returns nil and no error if the tx makes no such payment.
+func wrapExportFromTx(tx *bc.Tx, chain Chain) (*pegOut, *reserveOutput, error) {
+	for _, out := range tx.Outputs {
+		r, refdata := reserveFromOutput(tx, out)
+		if r == nil || len(refdata) == 0 {
+			continue
+		}
+		info, err := parseExportRefdata(refdata, chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.Amount != r.Amount || !bytes.Equal(info.Anchor, r.Anchor) {
+			return nil, nil, errors.New("export reference data does not match the value paid to the reserve")
+		}
+		return info, r, nil
+	}
+	return nil, nil, nil
+}
+
+// reserveFromOutput recognizes a standard pay-to-multisig output
+// locked by the custodian's key alone,
+// returning it as a reserve output,
+// with its reference data.
+// It returns nil if out is not such an output.
+func reserveFromOutput(tx *bc.Tx, out bc.Output) (*reserveOutput, []byte) {
+	m, ok := multisigFromOutput(out)
+	if !ok || m.Quorum != 1 || len(m.Pubkeys) != 1 || !bytes.Equal(m.Pubkeys[0], custodianPub) {
+		return nil, nil
+	}
+	r := &reserveOutput{
+		Anchor:    m.Anchor,
+		TxvmAsset: m.AssetID,
+		Amount:    m.Amount,
+	}
+	// The pay-to-multisig contract logs its reference data
+	// just before its output.
+	if out.LogPos < 1 || out.LogPos > len(tx.Log) || logCode(tx.Log[out.LogPos-1]) != txvm.LogCode {
+		return r, nil
+	}
+	refdata, _ := logBytes(tx.Log[out.LogPos-1], 2)
+	return r, refdata
+}
+
+// A multisigOutput is the value and signers of a standard pay-to-multisig output.
+type multisigOutput struct {
+	Quorum  int64
+	Pubkeys [][]byte
+	Amount  int64
+	AssetID []byte
+	Anchor  []byte
+}
+
+// multisigFromOutput recognizes a standard pay-to-multisig output.
+func multisigFromOutput(out bc.Output) (*multisigOutput, bool) {
+	// The output's contract stack is {'Z', quorum}, {'T', {pubkey, ...}}, {'V', amount, assetID, anchor}.
+	if out.Seed.Byte32() != standard.PayToMultisigSeed1 || len(out.Stack) != 3 {
+		return nil, false
+	}
+	quorum, ok := snapshotItem(out.Stack[0], txvm.IntCode, 2)
+	if !ok {
+		return nil, false
+	}
+	q, ok := quorum[1].(txvm.Int)
+	if !ok {
+		return nil, false
+	}
+	signers, ok := snapshotItem(out.Stack[1], txvm.TupleCode, 2)
+	if !ok {
+		return nil, false
+	}
+	pubkeys, ok := signers[1].(txvm.Tuple)
+	if !ok || len(pubkeys) == 0 {
+		return nil, false
+	}
+	m := &multisigOutput{Quorum: int64(q)}
+	for _, p := range pubkeys {
+		pubkey, ok := p.(txvm.Bytes)
+		if !ok || len(pubkey) != ed25519.PublicKeySize {
+			return nil, false
+		}
+		m.Pubkeys = append(m.Pubkeys, pubkey)
+	}
+	value, ok := snapshotItem(out.Stack[2], txvm.ValueCode, 4)
+	if !ok {
+		return nil, false
+	}
+	amount, ok1 := value[1].(txvm.Int)
+	assetID, ok2 := value[2].(txvm.Bytes)
+	anchor, ok3 := value[3].(txvm.Bytes)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, false
+	}
+	m.Amount, m.AssetID, m.Anchor = int64(amount), assetID, anchor
+	return m, true
+}
+
+// snapshotItem returns an item of a contract snapshot's stack
+// if it is a tuple of n elements with the given type code.
+func snapshotItem(d txvm.Data, code byte, n int) (txvm.Tuple, bool) {
+	t, ok := d.(txvm.Tuple)
+	if !ok || len(t) != n || logCode(t) != code {
+		return nil, false
+	}
+	return t, true
+}
+
+// logCode returns the type code of a txvm log entry, or 0 if it has none.
+func logCode(item txvm.Tuple) byte {
+	b, ok := logBytes(item, 0)
+	if !ok || len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+// logBytes returns the i'th element of a txvm log entry
+// if it is a byte string.
+func logBytes(item txvm.Tuple, i int) (txvm.Bytes, bool) {
+	if i >= len(item) {
+		return nil, false
+	}
+	b, ok := item[i].(txvm.Bytes)
+	return b, ok
+}
@@ -0,0 +1,197 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+func testRefdata(t testing.TB) []byte {
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assetXDR, err := stellar.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refdata, err := json.Marshal(pegOut{
+		AssetXDR: assetXDR,
+		TempAddr: temp.Address(),
+		Seqnum:   1,
+		Exporter: exporter.Address(),
+		Amount:   10,
+		Anchor:   make([]byte, 32),
+		Pubkey:   make([]byte, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refdata
+}
+
+func FuzzPegInPayments(f *testing.F) {
+	custodian, err := keypair.Random()
+	if err != nil {
+		f.Fatal(err)
+	}
+	custodianID := custodian.Address()
+	source, err := keypair.Random()
+	if err != nil {
+		f.Fatal(err)
+	}
+	tx := &stellar.Tx{
+		Network: network.TestNetworkPassphrase,
+		Source:  source.Address(),
+		SeqNum:  1,
+		Memo:    stellar.MemoHash{1, 2, 3},
+		Ops: []stellar.Op{stellar.Payment{
+			Destination: custodian.Address(),
+			Asset:       stellar.NativeAsset(),
+			Amount:      100000000,
+		}},
+	}
+	envXDR, err := tx.Sign(source.Seed())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(envXDR)
+	muxed, err := stellar.MuxedAddress(custodianID, 7)
+	if err != nil {
+		f.Fatal(err)
+	}
+	tx.Ops = []stellar.Op{stellar.Payment{Destination: muxed, Asset: stellar.NativeAsset(), Amount: 1}}
+	envXDR, err = tx.Sign(source.Seed())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(envXDR)
+	f.Add("")
+	f.Add("AAAA")
+
+	f.Fuzz(func(t *testing.T, envXDR string) {
+		nonceHash, payments, err := pegInPayments(envXDR, custodianID)
+		if err != nil {
+			return
+		}
+		if len(payments) > 0 && len(nonceHash) != 32 {
+			t.Errorf("got %d payments with %d-byte nonce hash", len(payments), len(nonceHash))
+		}
+		for _, p := range payments {
+			if stellar.BaseAccount(p.Destination) != custodianID {
+				t.Errorf("got payment to %s, want only payments to the custodian", p.Destination)
+			}
+		}
+	})
+}
+
+func FuzzParseExportRefdata(f *testing.F) {
+	f.Add(testRefdata(f))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"amount":-1}`))
+	f.Add([]byte(`{"asset":"AAAA","amount":1,"exporter":"x"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := parseExportRefdata(data, new(stellarChain))
+		if err != nil {
+			return
+		}
+		if info.Amount <= 0 {
+			t.Errorf("accepted non-positive amount %d", info.Amount)
+		}
+		if _, err := stellar.DecodeAsset(info.AssetXDR); err != nil {
+			t.Errorf("accepted bad asset xdr %x", info.AssetXDR)
+		}
+	})
+}
+
+func FuzzExportFromLog(f *testing.F) {
+	exportLog := []txvm.Tuple{
+		{txvm.Bytes{txvm.InputCode}, txvm.Bytes(make([]byte, 32)), txvm.Bytes(make([]byte, 32))},
+		{txvm.Bytes{txvm.LogCode}, txvm.Bytes(make([]byte, 32)), txvm.Bytes(testRefdata(f))},
+		{txvm.Bytes{txvm.LogCode}, txvm.Bytes(exportContract1Seed[:]), txvm.Bytes(nil)},
+		{txvm.Bytes{txvm.OutputCode}, txvm.Bytes(make([]byte, 32)), txvm.Bytes(make([]byte, 32))},
+		{txvm.Bytes{txvm.FinalizeCode}, txvm.Bytes(make([]byte, 32)), txvm.Int(0), txvm.Bytes(make([]byte, 32))},
+	}
+	info, err := exportFromLog(exportLog, new(stellarChain))
+	if err != nil || info == nil {
+		f.Fatalf("seed export log not recognized: %v", err)
+	}
+	f.Add(encodeFuzzLog(exportLog))
+	f.Add(encodeFuzzLog(exportLog[:4]))
+	f.Add([]byte{5, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		exportFromLog(decodeFuzzLog(data), new(stellarChain))
+	})
+}
+
+// encodeFuzzLog and decodeFuzzLog convert between txvm logs
+// and byte strings for fuzzing:
+// a count of entries, then for each a count of items,
+// each an Int (tag 0, 8 bytes) or Bytes (tag 1, 2-byte length, data).
+// decodeFuzzLog accepts any input.
+func encodeFuzzLog(log []txvm.Tuple) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(len(log)))
+	for _, tup := range log {
+		buf.WriteByte(byte(len(tup)))
+		for _, item := range tup {
+			switch item := item.(type) {
+			case txvm.Int:
+				buf.WriteByte(0)
+				binary.Write(buf, binary.BigEndian, int64(item))
+			case txvm.Bytes:
+				buf.WriteByte(1)
+				binary.Write(buf, binary.BigEndian, uint16(len(item)))
+				buf.Write(item)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeFuzzLog(data []byte) []txvm.Tuple {
+	next := func(n int) []byte {
+		if n > len(data) {
+			n = len(data)
+		}
+		b := data[:n]
+		data = data[n:]
+		return b
+	}
+	nextByte := func() int {
+		b := next(1)
+		if len(b) == 0 {
+			return 0
+		}
+		return int(b[0])
+	}
+	var log []txvm.Tuple
+	for n := nextByte(); n > 0 && len(data) > 0; n-- {
+		var tup txvm.Tuple
+		for k := nextByte(); k > 0 && len(data) > 0; k-- {
+			if nextByte()%2 == 0 {
+				var v [8]byte
+				copy(v[:], next(8))
+				tup = append(tup, txvm.Int(binary.BigEndian.Uint64(v[:])))
+				continue
+			}
+			var l [2]byte
+			copy(l[:], next(2))
+			tup = append(tup, txvm.Bytes(next(int(binary.BigEndian.Uint16(l[:])))))
+		}
+		log = append(log, tup)
+	}
+	return log
+}
@@ -0,0 +1,170 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// pegInPartner returns the partner a peg-in requested by req is attributed to:
+// the caller, if it presents an api.partners key,
+// or else the partner of referral, if any.
+// An unknown referral code is an error.
+func (c *Custodian) pegInPartner(req *http.Request, referral string) (string, error) {
+	cfg := c.config()
+	if tier, caller, ok := apiCaller(cfg, req); ok && tier == tierPartner {
+		return caller, nil
+	}
+	if referral == "" {
+		return "", nil
+	}
+	var partner string
+	if cfg != nil {
+		partner = cfg.PartnerFees.Referrer(referral)
+	}
+	if partner == "" {
+		return "", fmt.Errorf("unknown referral code %q", referral)
+	}
+	return partner, nil
+}
+
+// attributePegIn records the partner of a peg-in,
+// if it has one.
+func (c *Custodian) attributePegIn(ctx context.Context, nonceHash []byte, partner string) error {
+	if partner == "" {
+		return nil
+	}
+	_, err := c.DB.ExecContext(ctx, `UPDATE pegs SET partner=$1 WHERE nonce_hash=$2`, partner, nonceHash)
+	return errors.Wrapf(err, "attributing peg-in %x to %s", nonceHash, partner)
+}
+
+// partnerFee is bps basis points of amount, rounded down.
+func partnerFee(amount, bps int64) int64 {
+	return amount/10000*bps + amount%10000*bps/10000
+}
+
+// accruePartnerFee returns the db update
+// accruing the fee on a completed import or export
+// to the partner it is attributed to,
+// by the partner's schedule in partner_fees.
+// One with no schedule is accrued without a fee,
+// for its volume to be reported.
+// An unattributed import or export accrues nothing.
+func (c *Custodian) accruePartnerFee(ctx context.Context, kind string, key []byte) func(*sql.Tx) error {
+	return func(dbtx *sql.Tx) error {
+		q := `SELECT partner, asset_xdr, amount FROM pegs WHERE nonce_hash=$1 AND partner != ''`
+		if kind == "export" {
+			q = `SELECT partner, asset_xdr, amount FROM exports WHERE txid=$1 AND partner != ''`
+		}
+		var (
+			partner  string
+			assetXDR []byte
+			amount   int64
+		)
+		err := dbtx.QueryRowContext(ctx, q, key).Scan(&partner, &assetXDR, &amount)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading partner of %s %x", kind, key)
+		}
+		var (
+			schedule string
+			bps      int64
+		)
+		if cfg := c.config(); cfg != nil {
+			if s, ok := cfg.PartnerFees.Schedule(partner); ok {
+				schedule, bps = s.Name, s.ImportBPS
+				if kind == "export" {
+					bps = s.ExportBPS
+				}
+			}
+		}
+		const ins = `INSERT OR IGNORE INTO partner_fees (kind, key, partner, schedule, asset_xdr, amount, bps, fee, time_ms) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		_, err = dbtx.ExecContext(ctx, ins, kind, key, partner, schedule, assetXDR, amount, bps, partnerFee(amount, bps), c.nowMS())
+		return errors.Wrapf(err, "accruing partner fee on %s %x", kind, key)
+	}
+}
+
+// partnerTotal is the volume and fees of a partner
+// in one direction and asset,
+// in a partner fee report.
+type partnerTotal struct {
+	Partner string `json:"partner"`
+	Kind    string `json:"kind"` // import or export
+	Asset   string `json:"asset"`
+	Count   int64  `json:"count"`
+	Amount  int64  `json:"amount"`
+	Fees    int64  `json:"fees"`
+}
+
+// partnerTotals totals the fees accrued from fromMS until toMS
+// to partner, or to every partner if it is empty.
+func (c *Custodian) partnerTotals(ctx context.Context, partner string, fromMS, toMS int64) ([]partnerTotal, error) {
+	totals := []partnerTotal{}
+	const q = `SELECT partner, kind, asset_xdr, COUNT(*), SUM(amount), SUM(fee) FROM partner_fees
+		WHERE ($1 = '' OR partner=$1) AND time_ms >= $2 AND time_ms < $3
+		GROUP BY partner, kind, asset_xdr ORDER BY partner, kind, asset_xdr`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, partner, fromMS, toMS, func(partner, kind string, assetXDR []byte, count, amount, fees int64) {
+		totals = append(totals, partnerTotal{Partner: partner, Kind: kind, Asset: assetName(assetXDR), Count: count, Amount: amount, Fees: fees})
+	})
+	return totals, errors.Wrap(err, "totaling partner fees")
+}
+
+// servePartnerTotals responds with the totals of partner
+// over the from_ms and to_ms given in req, both optional.
+func (c *Custodian) servePartnerTotals(w http.ResponseWriter, req *http.Request, partner string) {
+	fromMS, toMS := int64(0), int64(math.MaxInt64)
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{
+		{"from_ms", &fromMS},
+		{"to_ms", &toMS},
+	} {
+		s := req.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing %s: %s", p.name, err)
+			return
+		}
+		*p.dst = n
+	}
+	totals, err := c.partnerTotals(req.Context(), partner, fromMS, toMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(totals)
+}
+
+// PartnerFees is the admin handler reporting the volume and fees
+// accrued to each partner, or to the one named by the partner parameter,
+// by direction and asset.
+func (c *Custodian) PartnerFees(w http.ResponseWriter, req *http.Request) {
+	c.servePartnerTotals(w, req, req.FormValue("partner"))
+}
+
+// PartnerStatement is the handler for /partner/statement,
+// where a partner presenting its api.partners key
+// gets the report of its own volume and fees.
+func (c *Custodian) PartnerStatement(w http.ResponseWriter, req *http.Request) {
+	tier, partner, ok := apiCaller(c.config(), req)
+	if !ok || tier != tierPartner {
+		net.Errorf(w, http.StatusUnauthorized, "a partner API key is required")
+		return
+	}
+	c.servePartnerTotals(w, req, partner)
+}
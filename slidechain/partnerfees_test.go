@@ -0,0 +1,156 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestPartnerFees(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Default()
+	cfg.API.Partners = []string{"acme=s3cret"}
+	cfg.PartnerFees.Schedules = []string{"standard=25/10"}
+	cfg.PartnerFees.Partners = []string{"acme=standard"}
+	cfg.PartnerFees.ReferralCodes = []string{"WELCOME=globex"}
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db, cfg: cfg, now: func() time.Time { return now }}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := func(key string) *http.Request {
+			req := httptest.NewRequest("GET", "/partner/statement", nil)
+			if key != "" {
+				req.Header.Set("X-API-Key", key)
+			}
+			return req
+		}
+		for _, tc := range []struct {
+			key, referral, want string
+			wantErr             bool
+		}{
+			{"s3cret", "WELCOME", "acme", false},
+			{"", "WELCOME", "globex", false},
+			{"", "", "", false},
+			{"", "BOGUS", "", true},
+		} {
+			got, err := c.pegInPartner(request(tc.key), tc.referral)
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("pegInPartner(%q, %q) = %q, %v; want %q, error %v", tc.key, tc.referral, got, err, tc.want, tc.wantErr)
+			}
+		}
+
+		acme := bytes.Repeat([]byte{7}, 32)
+		globex := bytes.Repeat([]byte{8}, 32)
+		const q = `INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, $3, $4, 1, $5)`
+		for _, p := range []struct {
+			nonceHash, recip []byte
+			amount           int64
+			partner          string
+		}{
+			{[]byte("acme"), acme, 1000000, "acme"},
+			{[]byte("globex"), globex, 50000, "globex"},
+			{[]byte("direct"), globex, 70000, ""},
+		} {
+			_, err = db.Exec(q, p.nonceHash, p.amount, nativeXDR, p.recip, pegInPaid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.attributePegIn(ctx, p.nonceHash, p.partner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := c.transitionPegIn(ctx, p.nonceHash, pegInPaid, pegInImported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("peg-in %s was not paid", p.nonceHash)
+			}
+		}
+
+		txid := bytes.Repeat([]byte{1}, 32)
+		err = c.insertExport(ctx, txid, &pegOut{
+			TxID:     txid,
+			AssetXDR: nativeXDR,
+			TempAddr: "temp",
+			Exporter: "exporter",
+			Amount:   400000,
+			Anchor:   []byte{},
+			Pubkey:   acme,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.movePegOut(ctx, txid, pegOutNotYet, pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.movePegOut(ctx, txid, pegOutOK, pegOutRetired)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := func(h http.HandlerFunc, req *http.Request, wantCode int) []partnerTotal {
+			t.Helper()
+			w := httptest.NewRecorder()
+			h(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, wantCode, w.Body)
+			}
+			var totals []partnerTotal
+			if wantCode == http.StatusOK {
+				err := json.NewDecoder(w.Body).Decode(&totals)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return totals
+		}
+		want := []partnerTotal{
+			{Partner: "acme", Kind: "export", Asset: "native", Count: 1, Amount: 400000, Fees: 400},
+			{Partner: "acme", Kind: "import", Asset: "native", Count: 1, Amount: 1000000, Fees: 2500},
+			{Partner: "globex", Kind: "import", Asset: "native", Count: 1, Amount: 50000, Fees: 0},
+		}
+		if got := report(c.PartnerFees, httptest.NewRequest("GET", "/admin/partner-fees", nil), http.StatusOK); !reflect.DeepEqual(got, want) {
+			t.Errorf("got partner fees %+v, want %+v", got, want)
+		}
+		if got := report(c.PartnerStatement, request("s3cret"), http.StatusOK); !reflect.DeepEqual(got, want[:2]) {
+			t.Errorf("got acme statement %+v, want %+v", got, want[:2])
+		}
+		report(c.PartnerStatement, request(""), http.StatusUnauthorized)
+		future := httptest.NewRequest("GET", "/admin/partner-fees?from_ms=9999999999999", nil)
+		if got := report(c.PartnerFees, future, http.StatusOK); len(got) != 0 {
+			t.Errorf("got partner fees %+v after every accrual", got)
+		}
+	})
+}
+
+func TestPartnerFee(t *testing.T) {
+	for _, tc := range []struct{ amount, bps, want int64 }{
+		{1000000, 25, 2500},
+		{9999, 10, 9},
+		{9223372036854775807, 10000, 9223372036854775807},
+		{100, 0, 0},
+	} {
+		if got := partnerFee(tc.amount, tc.bps); got != tc.want {
+			t.Errorf("partnerFee(%d, %d) = %d, want %d", tc.amount, tc.bps, got, tc.want)
+		}
+	}
+}
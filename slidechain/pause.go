@@ -0,0 +1,324 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// Pause scopes, each halting one subsystem until resumed.
+const (
+	pausePegIn     = "pegin"  // importing peg-ins to txvm
+	pausePegOut    = "pegout" // submitting peg-outs and exit payouts to the main chain
+	pauseBlocks    = "blocks" // committing txvm blocks
+	pauseAPIWrites = "api"    // public API requests other than GET and HEAD
+
+	// pausePeg is the scope of a fraud-claim pause,
+	// which halts imports, peg-outs, and new peg-ins.
+	pausePeg = "peg"
+)
+
+const pauseAlert = "pause"
+
+var pauseScopes = []string{pausePegIn, pausePegOut, pauseBlocks, pauseAPIWrites}
+
+// pauseEntry is an active pause, as listed by GET /admin/pause.
+type pauseEntry struct {
+	ID     int64  `json:"id,omitempty"` // zero for the pause file
+	Scope  string `json:"scope"`
+	Reason string `json:"reason"`
+	TimeMS int64  `json:"time_ms"`
+}
+
+// pausePeg stops imports, peg-outs, and new peg-ins
+// until an operator resumes the peg.
+func (c *Custodian) pausePeg(ctx context.Context, reason, source string) error {
+	_, err := c.DB.ExecContext(ctx, `INSERT INTO peg_pauses (time_ms, reason, scope) VALUES ($1, $2, $3)`, c.nowMS(), reason, pausePeg)
+	if err != nil {
+		return errors.Wrap(err, "pausing peg")
+	}
+	return c.recordAudit(ctx, "peg.pause", source, reason)
+}
+
+// pegPaused reports whether the peg has been paused by a fraud claim
+// or by the pause file.
+func (c *Custodian) pegPaused(ctx context.Context) (bool, error) {
+	return c.paused(ctx, pausePeg)
+}
+
+// paused reports whether the given scope is paused,
+// by the admin API, a fraud claim, or the pause file.
+func (c *Custodian) paused(ctx context.Context, scope string) (bool, error) {
+	entries, err := c.filePauses(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Scope == scope {
+			return true, nil
+		}
+	}
+	also := scope
+	if scope == pausePegIn || scope == pausePegOut {
+		also = pausePeg
+	}
+	var n int
+	const q = `SELECT COUNT(*) FROM peg_pauses WHERE resumed_ms IS NULL AND scope IN ($1, $2)`
+	err = c.DB.QueryRowContext(ctx, q, scope, also).Scan(&n)
+	return n > 0, errors.Wrapf(err, "checking for %s pause", scope)
+}
+
+// filePauses returns the pauses in effect from admin.pause_file.
+// An empty file, or one naming an unknown scope, pauses everything,
+// as does a file that exists but cannot be read.
+// The first time the custodian sees each scope paused by a given file,
+// it raises an alert.
+func (c *Custodian) filePauses(ctx context.Context) ([]pauseEntry, error) {
+	cfg := c.config()
+	if cfg == nil || cfg.Admin.PauseFile == "" {
+		return nil, nil
+	}
+	path := cfg.Admin.PauseFile
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var scopes []string
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		scopes = strings.Fields(string(data))
+	}
+	if err != nil {
+		log.Printf("pausing everything: reading pause file: %s", err)
+		scopes = nil
+	}
+	known := map[string]bool{pausePeg: true}
+	for _, s := range pauseScopes {
+		known[s] = true
+	}
+	for _, s := range scopes {
+		if !known[s] {
+			log.Printf("pausing everything: unknown scope %q in pause file %s", s, path)
+			scopes = nil
+			break
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = append([]string{pausePeg}, pauseScopes...)
+	}
+	var timeMS int64
+	if info != nil {
+		timeMS = info.ModTime().UnixNano() / 1e6
+	}
+	var entries []pauseEntry
+	for _, s := range scopes {
+		entries = append(entries, pauseEntry{Scope: s, Reason: "pause file " + path, TimeMS: timeMS})
+		key := []byte(fmt.Sprintf("%s %s %d", path, s, timeMS))
+		alerted, err := c.alerted(ctx, pauseAlert, key)
+		if err != nil {
+			return nil, err
+		}
+		if !alerted {
+			err = c.alert(ctx, pauseAlert, key, fmt.Sprintf("%s paused by pause file %s", s, path))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Pause is the admin handler for pauses.
+// GET lists the active pauses.
+// POST pauses each scope given as a scope parameter,
+// or all of them if there is none,
+// for the reason given as the reason parameter.
+func (c *Custodian) Pause(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		entries, err := c.filePauses(ctx)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		const q = `SELECT id, scope, reason, time_ms FROM peg_pauses WHERE resumed_ms IS NULL ORDER BY id`
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, func(id int64, scope, reason string, timeMS int64) {
+			entries = append(entries, pauseEntry{ID: id, Scope: scope, Reason: reason, TimeMS: timeMS})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading pauses: %s", err)
+			return
+		}
+		if entries == nil {
+			entries = []pauseEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+
+	case http.MethodPost:
+		scopes, ok := pauseScopesParam(req, false)
+		if !ok {
+			net.Errorf(w, http.StatusBadRequest, "scope must be one of %s", strings.Join(pauseScopes, ", "))
+			return
+		}
+		reason := req.FormValue("reason")
+		source := "admin-api " + req.RemoteAddr
+		for _, scope := range scopes {
+			res, err := c.DB.ExecContext(ctx, `INSERT INTO peg_pauses (time_ms, reason, scope) VALUES ($1, $2, $3)`, c.nowMS(), reason, scope)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "pausing %s: %s", scope, err)
+				return
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "pausing %s: %s", scope, err)
+				return
+			}
+			err = c.recordAudit(ctx, "pause."+scope, source, reason)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+			err = c.alert(ctx, pauseAlert, []byte(fmt.Sprintf("pause %d", id)), fmt.Sprintf("%s paused by %s: %s", scope, source, reason))
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "pauses support GET and POST")
+	}
+}
+
+// ResumePeg is the admin handler that ends the pauses
+// of each scope given as a scope parameter,
+// or of all scopes if there is none.
+// It fails with a conflict while the pause file still pauses one of them,
+// or once the custodian is winding down, for any scope but pegout.
+func (c *Custodian) ResumePeg(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "resuming the peg requires POST")
+		return
+	}
+	scopes, ok := pauseScopesParam(req, true)
+	if !ok {
+		net.Errorf(w, http.StatusBadRequest, "scope must be one of %s, %s", strings.Join(pauseScopes, ", "), pausePeg)
+		return
+	}
+	ctx := req.Context()
+	windingDown, err := c.windingDown(ctx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if windingDown {
+		for _, scope := range scopes {
+			if scope != pausePegOut {
+				net.Errorf(w, http.StatusConflict, "the custodian is winding down")
+				return
+			}
+		}
+	}
+	placeholders := make([]string, len(scopes))
+	args := []interface{}{c.nowMS()}
+	for i, scope := range scopes {
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+		args = append(args, scope)
+	}
+	q := `UPDATE peg_pauses SET resumed_ms=$1 WHERE resumed_ms IS NULL AND scope IN (` + strings.Join(placeholders, ", ") + `)`
+	res, err := c.DB.ExecContext(ctx, q, args...)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "resuming peg: %s", err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "resuming peg: %s", err)
+		return
+	}
+	if n > 0 {
+		err = c.recordAudit(ctx, "peg.resume", "admin-api "+req.RemoteAddr, fmt.Sprintf("ended %d pause(s) of %s", n, strings.Join(scopes, ", ")))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if c.imports != nil {
+			c.imports.Broadcast()
+		}
+		if c.exports != nil {
+			c.exports.Broadcast()
+		}
+	}
+	entries, err := c.filePauses(ctx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	for _, e := range entries {
+		for _, scope := range scopes {
+			if e.Scope == scope {
+				net.Errorf(w, http.StatusConflict, "%s is still paused by %s; remove it to resume", scope, e.Reason)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pauseScopesParam returns the scope parameters of req,
+// or all scopes if there are none,
+// and reports whether they are all known.
+// The fraud-claim scope is allowed only with withPeg.
+func pauseScopesParam(req *http.Request, withPeg bool) ([]string, bool) {
+	all := pauseScopes
+	if withPeg {
+		all = append([]string{pausePeg}, pauseScopes...)
+	}
+	scopes := req.URL.Query()["scope"]
+	if len(scopes) == 0 {
+		return all, true
+	}
+	for _, s := range scopes {
+		var ok bool
+		for _, a := range all {
+			ok = ok || s == a
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// PausableWrites wraps a public API handler
+// so that it refuses requests other than GET and HEAD
+// while API writes are paused.
+func (c *Custodian) PausableWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			paused, err := c.paused(req.Context(), pauseAPIWrites)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+			if paused {
+				net.Errorf(w, http.StatusServiceUnavailable, "API writes are paused")
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
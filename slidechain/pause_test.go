@@ -0,0 +1,132 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+func TestPause(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "slidechain-pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.Admin.PauseFile = filepath.Join(dir, "slidechain.pause")
+		c := &Custodian{DB: db, cfg: cfg}
+
+		do := func(h http.HandlerFunc, method, target string, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(method, target, nil))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from %s %s, want %d: %s", w.Code, method, target, wantCode, w.Body)
+			}
+			return w
+		}
+		wantPaused := func(want ...string) {
+			t.Helper()
+			wanted := make(map[string]bool)
+			for _, s := range want {
+				wanted[s] = true
+			}
+			for _, scope := range append([]string{pausePeg}, pauseScopes...) {
+				got, err := c.paused(ctx, scope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != wanted[scope] {
+					t.Errorf("%s paused is %v, want %v", scope, got, wanted[scope])
+				}
+			}
+		}
+		countAlerts := func() int {
+			t.Helper()
+			var n int
+			err := db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, pauseAlert).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		// A fraud-claim pause halts peg-ins and peg-outs but not blocks or the API.
+		err = c.pausePeg(ctx, "fraud claim 1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPaused(pausePeg, pausePegIn, pausePegOut)
+		do(c.ResumePeg, "POST", "/admin/resume?scope=pegout", http.StatusNoContent)
+		wantPaused(pausePeg, pausePegIn, pausePegOut)
+		do(c.ResumePeg, "POST", "/admin/resume", http.StatusNoContent)
+		wantPaused()
+
+		do(c.Pause, "POST", "/admin/pause?scope=bogus", http.StatusBadRequest)
+		do(c.Pause, "POST", "/admin/pause?scope=pegout&scope=api&reason=incident", http.StatusNoContent)
+		wantPaused(pausePegOut, pauseAPIWrites)
+		if n := countAlerts(); n != 2 {
+			t.Errorf("got %d pause alerts, want 2", n)
+		}
+		var entries []pauseEntry
+		err = json.NewDecoder(do(c.Pause, "GET", "/admin/pause", http.StatusOK).Body).Decode(&entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Scope != pausePegOut || entries[1].Reason != "incident" {
+			t.Errorf("got pauses %+v, want pegout and api for incident", entries)
+		}
+
+		h := c.PausableWrites(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		do(h.ServeHTTP, "GET", "/get", http.StatusNoContent)
+		do(h.ServeHTTP, "POST", "/submit", http.StatusServiceUnavailable)
+		do(c.ResumePeg, "POST", "/admin/resume?scope=api", http.StatusNoContent)
+		do(h.ServeHTTP, "POST", "/submit", http.StatusNoContent)
+		wantPaused(pausePegOut)
+		do(c.ResumePeg, "POST", "/admin/resume", http.StatusNoContent)
+
+		// The pause file works without the admin API,
+		// and only its removal resumes what it pauses.
+		err = ioutil.WriteFile(cfg.Admin.PauseFile, []byte("blocks\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPaused(pauseBlocks)
+		wantPaused(pauseBlocks)
+		if n := countAlerts(); n != 3 {
+			t.Errorf("got %d pause alerts, want 3", n)
+		}
+		do(c.ResumePeg, "POST", "/admin/resume", http.StatusConflict)
+		do(c.ResumePeg, "POST", "/admin/resume?scope=api", http.StatusNoContent)
+
+		err = ioutil.WriteFile(cfg.Admin.PauseFile, []byte("blcoks\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPaused(append([]string{pausePeg}, pauseScopes...)...)
+
+		err = os.Remove(cfg.Admin.PauseFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		do(c.ResumePeg, "POST", "/admin/resume", http.StatusNoContent)
+		wantPaused()
+	})
+}
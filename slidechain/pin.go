@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
 )
@@ -23,70 +22,24 @@ import (
 // causing an exit.
 // TODO(bobg): permit caller-defined error handling.
 func (c *Custodian) RunPin(ctx context.Context, name string, f func(context.Context, *bc.Block) error) {
+	c.runMarkedPin(ctx, name, 0, f)
+}
+
+// runMarkedPin is RunPin for a callback with nothing to do
+// on a block with none of the markers in mask,
+// which is passed over without being read from the db.
+// With a mask of 0 it calls the callback on every block.
+func (c *Custodian) runMarkedPin(ctx context.Context, name string, mask blockMarker, f func(context.Context, *bc.Block) error) {
 	defer log.Printf("RunPin(%s) exiting", name)
 
 	r := c.S.w.Reader()
 
-	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO pins (name, height) VALUES ($1, 0)`, name)
-	if ctx.Err() != nil {
-		return
-	}
-	if err != nil {
-		log.Fatalf("creating pin %s: %s", name, err)
-	}
-
-	var lastHeight uint64
-	err = c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name = $1`, name).Scan(&lastHeight)
+	lastHeight, err := c.catchUpPin(ctx, name, mask, f)
 	if ctx.Err() != nil {
 		return
 	}
 	if err != nil {
-		log.Fatalf("getting height of pin %s: %s", name, err)
-	}
-
-	// Start processing after lastHeight.
-
-	var blocks []*bc.Block
-	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT bits, height FROM blocks WHERE height > $1 ORDER BY height`, lastHeight, func(bits []byte, height uint64) error {
-		var block bc.Block
-		err = block.FromBytes(bits)
-		if err != nil {
-			return errors.Wrapf(err, "unmarshaling block %d", height)
-		}
-		blocks = append(blocks, &block)
-		return nil
-	})
-	if ctx.Err() != nil {
-		return
-	}
-	if err != nil {
-		log.Fatalf("processing backlog for pin %s: %s", name, err)
-	}
-
-	processBlock := func(block *bc.Block) error {
-		if block.Height != lastHeight+1 {
-			return fmt.Errorf("missing block %d", lastHeight+1)
-		}
-		err = f(ctx, block)
-		if err != nil {
-			return errors.Wrapf(err, "running pin %s on block %d", name, block.Height)
-		}
-		_, err = c.DB.Exec(`UPDATE pins SET height = $1 WHERE name = $2`, block.Height, name) // n.b. not ExecContext
-		if err != nil {
-			return errors.Wrapf(err, "updating pin %s after block %d", name, block.Height)
-		}
-		lastHeight = block.Height
-		return nil
-	}
-
-	for _, block := range blocks {
-		err = processBlock(block)
-		if ctx.Err() != nil {
-			return
-		}
-		if err != nil {
-			log.Fatalf("processing backlog block %d: %s", block.Height, err)
-		}
+		log.Fatal(err)
 	}
 
 	for {
@@ -101,12 +54,82 @@ func (c *Custodian) RunPin(ctx context.Context, name string, f func(context.Cont
 		if block.Height <= lastHeight {
 			continue
 		}
-		err = processBlock(block)
+		g := f
+		if mask != 0 && blockMarker(blockMarkers(block))&mask == 0 {
+			g = skipBlock
+		}
+		err = c.advancePin(ctx, name, g, lastHeight, block)
 		if ctx.Err() != nil {
 			return
 		}
 		if err != nil {
 			log.Fatalf("processing live block %d: %s", block.Height, err)
 		}
+		lastHeight = block.Height
+	}
+}
+
+// catchUpPin creates the named pin if it does not exist
+// and runs f on each block in the db after the pin's height
+// that has a marker in mask, or on every one if mask is 0.
+// It returns the pin's new height.
+func (c *Custodian) catchUpPin(ctx context.Context, name string, mask blockMarker, f func(context.Context, *bc.Block) error) (uint64, error) {
+	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO pins (name, height) VALUES ($1, 0)`, name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating pin %s", name)
+	}
+
+	var lastHeight uint64
+	err = c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name = $1`, name).Scan(&lastHeight)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting height of pin %s", name)
+	}
+
+	// Start processing after lastHeight.
+
+	backlog, err := pinBlocks(ctx, c.DB, lastHeight, mask)
+	if err != nil {
+		return 0, errors.Wrapf(err, "processing backlog for pin %s", name)
+	}
+
+	var skipped bool
+	for _, pb := range backlog {
+		if pb.block == nil {
+			if pb.height != lastHeight+1 {
+				return 0, fmt.Errorf("missing block %d", lastHeight+1)
+			}
+			lastHeight, skipped = pb.height, true
+			continue
+		}
+		err = c.advancePin(ctx, name, f, lastHeight, pb.block)
+		if err != nil {
+			return 0, errors.Wrapf(err, "processing backlog block %d", pb.height)
+		}
+		lastHeight, skipped = pb.height, false
+	}
+	if skipped {
+		_, err = c.DB.ExecContext(ctx, `UPDATE pins SET height = $1 WHERE name = $2`, lastHeight, name)
+		if err != nil {
+			return 0, errors.Wrapf(err, "updating pin %s after block %d", name, lastHeight)
+		}
+	}
+	return lastHeight, nil
+}
+
+// skipBlock is the callback for a block a pin does not need.
+func skipBlock(context.Context, *bc.Block) error { return nil }
+
+// advancePin runs f on block,
+// which must follow the pin's lastHeight,
+// and updates the pin's height.
+func (c *Custodian) advancePin(ctx context.Context, name string, f func(context.Context, *bc.Block) error, lastHeight uint64, block *bc.Block) error {
+	if block.Height != lastHeight+1 {
+		return fmt.Errorf("missing block %d", lastHeight+1)
+	}
+	err := f(ctx, block)
+	if err != nil {
+		return errors.Wrapf(err, "running pin %s on block %d", name, block.Height)
 	}
+	_, err = c.DB.Exec(`UPDATE pins SET height = $1 WHERE name = $2`, block.Height, name) // n.b. not ExecContext
+	return errors.Wrapf(err, "updating pin %s after block %d", name, block.Height)
 }
@@ -0,0 +1,236 @@
+// Package policy parses and evaluates signing policies:
+// declarative rules over a payment from the custodian
+// that hold it for approval before the custodian signs it.
+//
+// A policy has one rule per line,
+// a name and a colon followed by conditions joined by "and":
+//
+//	# Large payments, and any at night, need approval.
+//	large: amount > 1000000000
+//	night: hour < 6 and destination not in [GA..., GB...]
+//	daily-usd: asset = USD:GISSUER... and daily_total > 50000000000
+//
+// A payment violates a rule if every one of its conditions holds.
+// Blank lines and lines beginning with # are ignored.
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Facts are the fields rules are evaluated over.
+type Facts struct {
+	Kind        string // export, netting, refund, exit, or rebalance
+	Destination string // the main-chain account paid
+	Asset       string // native or CODE:ISSUER
+	Amount      int64
+	Hour        int // UTC hour of day, 0 to 23
+	Weekday     int // UTC day of week, 0 (Sunday) to 6
+
+	// DailyTotal and DailyCount are the amount and number
+	// of payments of Asset passing the policy since UTC midnight,
+	// counting this one.
+	DailyTotal int64
+	DailyCount int64
+}
+
+// A field is what a condition tests.
+type field struct {
+	str func(Facts) string
+	num func(Facts) int64
+}
+
+var fields = map[string]field{
+	"kind":        {str: func(f Facts) string { return f.Kind }},
+	"destination": {str: func(f Facts) string { return f.Destination }},
+	"asset":       {str: func(f Facts) string { return f.Asset }},
+	"amount":      {num: func(f Facts) int64 { return f.Amount }},
+	"hour":        {num: func(f Facts) int64 { return int64(f.Hour) }},
+	"weekday":     {num: func(f Facts) int64 { return int64(f.Weekday) }},
+	"daily_total": {num: func(f Facts) int64 { return f.DailyTotal }},
+	"daily_count": {num: func(f Facts) int64 { return f.DailyCount }},
+}
+
+type cond struct {
+	field field
+	op    string
+	strs  []string
+	nums  []int64
+}
+
+func (c cond) holds(f Facts) bool {
+	if c.field.str != nil {
+		v := c.field.str(f)
+		in := false
+		for _, s := range c.strs {
+			in = in || v == s
+		}
+		switch c.op {
+		case "=", "in":
+			return in
+		}
+		return !in // != and not in
+	}
+	v := c.field.num(f)
+	switch c.op {
+	case "<":
+		return v < c.nums[0]
+	case "<=":
+		return v <= c.nums[0]
+	case ">":
+		return v > c.nums[0]
+	case ">=":
+		return v >= c.nums[0]
+	}
+	in := false
+	for _, n := range c.nums {
+		in = in || v == n
+	}
+	if c.op == "=" || c.op == "in" {
+		return in
+	}
+	return !in
+}
+
+// Rule is one named rule of a policy.
+type Rule struct {
+	Name   string
+	Source string // the rule as written
+	conds  []cond
+}
+
+// Violated reports whether f violates r.
+func (r Rule) Violated(f Facts) bool {
+	for _, c := range r.conds {
+		if !c.holds(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy is a parsed signing policy.
+type Policy struct {
+	Rules []Rule
+}
+
+// Violations returns the names of the rules f violates, in order.
+func (p *Policy) Violations(f Facts) []string {
+	var names []string
+	for _, r := range p.Rules {
+		if r.Violated(f) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// numOps and strOps are the comparisons on each kind of field.
+var (
+	numOps = []string{"<=", ">=", "!=", "<", ">", "=", "not in", "in"}
+	strOps = []string{"!=", "=", "not in", "in"}
+)
+
+// Parse parses a policy.
+// An error names the line it is on.
+func Parse(src string) (*Policy, error) {
+	p := new(Policy)
+	names := make(map[string]bool)
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("line %d: duplicate rule %q", i+1, r.Name)
+		}
+		names[r.Name] = true
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+func parseRule(line string) (Rule, error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return Rule{}, fmt.Errorf("rule %q must be NAME: CONDITION", line)
+	}
+	r := Rule{Name: strings.TrimSpace(line[:colon]), Source: line}
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t") {
+		return Rule{}, fmt.Errorf("bad rule name %q", r.Name)
+	}
+	for _, s := range strings.Split(line[colon+1:], " and ") {
+		c, err := parseCond(strings.TrimSpace(s))
+		if err != nil {
+			return Rule{}, err
+		}
+		r.conds = append(r.conds, c)
+	}
+	return r, nil
+}
+
+func parseCond(s string) (cond, error) {
+	sp := strings.IndexAny(s, " \t<>=!")
+	if sp < 0 {
+		return cond{}, fmt.Errorf("condition %q must be FIELD OP VALUE", s)
+	}
+	name := s[:sp]
+	f, ok := fields[name]
+	if !ok {
+		return cond{}, fmt.Errorf("unknown field %q", name)
+	}
+	rest := strings.TrimSpace(s[sp:])
+	ops := numOps
+	if f.str != nil {
+		ops = strOps
+	}
+	c := cond{field: f}
+	for _, op := range ops {
+		if strings.HasPrefix(rest, op) {
+			c.op = op
+			break
+		}
+	}
+	if c.op == "" {
+		return cond{}, fmt.Errorf("bad comparison of %s in %q", name, s)
+	}
+	value := strings.TrimSpace(rest[len(c.op):])
+	list := c.op == "in" || c.op == "not in"
+	var values []string
+	if list {
+		if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+			return cond{}, fmt.Errorf("%s %s needs a [list] in %q", name, c.op, s)
+		}
+		for _, v := range strings.Split(value[1:len(value)-1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	} else {
+		values = []string{value}
+	}
+	for _, v := range values {
+		if v == "" || strings.ContainsAny(v, " \t[]") {
+			return cond{}, fmt.Errorf("bad value %q in %q", v, s)
+		}
+		if f.str != nil {
+			c.strs = append(c.strs, v)
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cond{}, fmt.Errorf("%s needs a number, not %q", name, v)
+		}
+		c.nums = append(c.nums, n)
+	}
+	if len(values) == 0 {
+		return cond{}, fmt.Errorf("empty list in %q", s)
+	}
+	return c, nil
+}
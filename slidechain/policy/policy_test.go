@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestViolations(t *testing.T) {
+	p, err := Parse(`
+# comments and blank lines are ignored
+
+large: amount > 1000
+night: hour < 6 and destination not in [GA, GB]
+usd-daily: asset = USD:GISSUER and daily_total >= 5000
+weekend: weekday in [0, 6] and daily_count > 2
+refunds: kind = refund and amount > 100
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		f    Facts
+		want []string
+	}{
+		{Facts{Destination: "GA", Asset: "native", Amount: 10, Hour: 12, Weekday: 3, DailyTotal: 10, DailyCount: 1}, nil},
+		{Facts{Destination: "GA", Asset: "native", Amount: 1001, Hour: 3, Weekday: 3, DailyTotal: 1001, DailyCount: 1}, []string{"large"}},
+		{Facts{Destination: "GC", Asset: "native", Amount: 10, Hour: 3, Weekday: 3, DailyTotal: 10, DailyCount: 1}, []string{"night"}},
+		{Facts{Destination: "GA", Asset: "USD:GISSUER", Amount: 1000, Hour: 12, Weekday: 3, DailyTotal: 5000, DailyCount: 5}, []string{"usd-daily"}},
+		{Facts{Destination: "GC", Asset: "USD:GISSUER", Amount: 2000, Hour: 0, Weekday: 6, DailyTotal: 6000, DailyCount: 3}, []string{"large", "night", "usd-daily", "weekend"}},
+		{Facts{Kind: "refund", Destination: "GA", Asset: "native", Amount: 200, Hour: 12, Weekday: 3, DailyTotal: 200, DailyCount: 1}, []string{"refunds"}},
+		{Facts{Kind: "export", Destination: "GA", Asset: "native", Amount: 200, Hour: 12, Weekday: 3, DailyTotal: 200, DailyCount: 1}, nil},
+	} {
+		if got := p.Violations(tc.f); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Violations(%+v) = %v, want %v", tc.f, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src, want string
+	}{
+		{"large amount > 5", "line 1: rule"},
+		{"ok: amount > 5\nbad: color = red", "line 2: unknown field"},
+		{"bad: amount > lots", "needs a number"},
+		{"bad: asset < native", "bad comparison"},
+		{"bad: destination in GA", "needs a [list]"},
+		{"bad: destination in []", "empty list"},
+		{"a: amount > 1\na: hour < 2", "duplicate rule"},
+		{"bad name: amount > 1", "bad rule name"},
+	} {
+		_, err := Parse(tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q): got error %v, want one containing %q", tc.src, err, tc.want)
+		}
+	}
+}
@@ -12,24 +12,44 @@ import (
 	"github.com/chain/txvm/protocol/txvm"
 	"github.com/chain/txvm/protocol/txvm/op"
 	"github.com/chain/txvm/protocol/txvm/txvmutil"
-	"github.com/stellar/go/xdr"
 )
 
-func (c *Custodian) doPostPegOut(ctx context.Context, assetXDR, anchor, txid []byte, amount, seqnum int64, peggedOut pegOutState, exporter, tempAddr string, pubkey []byte) error {
-	var asset xdr.Asset
-	err := asset.UnmarshalBinary(assetXDR)
+// doPostPegOut retires or refunds the value of export p,
+// as its peg-out, in p.State, succeeded or failed.
+func (c *Custodian) doPostPegOut(ctx context.Context, p *pegOut) error {
+	w, err := c.wrappedAssetByXDR(ctx, p.AssetXDR)
 	if err != nil {
-		return errors.Wrap(err, "unmarshaling asset xdr")
+		return err
 	}
-	assetID := bc.NewHash(txvm.AssetID(importIssuanceSeed[:], assetXDR))
+	if w != nil {
+		return c.postPegOutWrapped(ctx, w, p.TxID, p.State, p.Pubkey)
+	}
+	var version int
+	err = c.DB.QueryRowContext(ctx, `SELECT issuance_version FROM exports WHERE txid=$1`, p.TxID).Scan(&version)
+	if err != nil {
+		return errors.Wrapf(err, "reading issuance version of export %x", p.TxID)
+	}
+	ic := issuanceContracts[version]
+	if ic == nil {
+		return fmt.Errorf("export %x has unknown issuance version %d", p.TxID, version)
+	}
+	assetID := ic.assetID(p.AssetXDR)
+	// The reference data must be that of the export tx.
 	ref := pegOut{
-		AssetXDR: assetXDR,
-		TempAddr: tempAddr,
-		Seqnum:   seqnum,
-		Exporter: exporter,
-		Amount:   amount,
-		Anchor:   anchor,
-		Pubkey:   pubkey,
+		AssetXDR:    p.AssetXDR,
+		TempAddr:    p.TempAddr,
+		Seqnum:      p.Seqnum,
+		Exporter:    p.Exporter,
+		Amount:      p.Amount,
+		Anchor:      p.Anchor,
+		Pubkey:      p.Pubkey,
+		TimeBounds:  p.TimeBounds,
+		Destination: p.Destination,
+		Nettable:    p.Nettable,
+		ExportEscrow: ExportEscrow{
+			Watcher:     p.Watcher,
+			ChallengeMS: p.ChallengeMS,
+		},
 	}
 	refdata, err := json.Marshal(ref)
 	if err != nil {
@@ -38,7 +58,7 @@ func (c *Custodian) doPostPegOut(ctx context.Context, assetXDR, anchor, txid []b
 	// The contract needs a non-zero selector to retire funds if the peg-out succeeded.
 	// Else, it requires a zero selector so the funds are returned.
 	var selector int64
-	if peggedOut == pegOutOK {
+	if p.State == pegOutOK {
 		selector = 1
 	}
 	// Build post-peg-out contract.
@@ -50,7 +70,7 @@ func (c *Custodian) doPostPegOut(ctx context.Context, assetXDR, anchor, txid []b
 		contract.Tuple(func(tup *txvmutil.TupleBuilder) { // {'T', pubkey}
 			tup.PushdataByte(txvm.TupleCode)
 			tup.Tuple(func(pktup *txvmutil.TupleBuilder) {
-				pktup.PushdataBytes(pubkey)
+				pktup.PushdataBytes(p.Pubkey)
 			})
 		})
 		contract.Tuple(func(tup *txvmutil.TupleBuilder) { // {'S', refdata}
@@ -59,9 +79,9 @@ func (c *Custodian) doPostPegOut(ctx context.Context, assetXDR, anchor, txid []b
 		})
 		contract.Tuple(func(tup *txvmutil.TupleBuilder) { // {'V', amount, assetID, anchor}
 			tup.PushdataByte(txvm.ValueCode)
-			tup.PushdataInt64(amount)
+			tup.PushdataInt64(p.Amount)
 			tup.PushdataBytes(assetID.Bytes())
-			tup.PushdataBytes(anchor)
+			tup.PushdataBytes(p.Anchor)
 		})
 	})
 	b.PushdataInt64(selector).Op(op.Put) // con stack: snapshot; arg stack: selector
@@ -94,19 +114,19 @@ func (c *Custodian) doPostPegOut(ctx context.Context, assetXDR, anchor, txid []b
 	if err != nil {
 		return errors.Wrap(err, "waiting on post-peg-out tx to hit txvm")
 	}
-	// Delete relevant row from exports table.
+	// Record the export as finished.
 	// TODO(debnil): Implement a mechanism to recover in case of a crash here.
 	// Currently, the txvm funds will be retired or refunded, but the db will not be updated.
-	result, err := c.DB.ExecContext(ctx, `DELETE FROM exports WHERE txid=$1`, txid)
-	if err != nil {
-		return errors.Wrapf(err, "deleting export for tx %x", txid)
+	done := pegOutRetired
+	if p.State != pegOutOK {
+		done = pegOutRefunded
 	}
-	numAffected, err := result.RowsAffected()
+	ok, err := c.transitionPegOut(ctx, p.TxID, p.State, done)
 	if err != nil {
-		return errors.Wrapf(err, "checking rows affected by exports delete query for txid %x", txid)
+		return err
 	}
-	if numAffected != 1 {
-		return fmt.Errorf("got %d rows affected by exports delete query, want 1", numAffected)
+	if !ok {
+		return fmt.Errorf("export %x is no longer in state %s", p.TxID, p.State)
 	}
 	return nil
 }
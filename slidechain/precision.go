@@ -0,0 +1,97 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Stellar amounts are integers of 10^-7 units, stroops, for every asset.
+// The value imported from Stellar is issued in stroops too,
+// but a wrapped asset's txvm units are 10^-decimals of it,
+// by the decimals in its registry entry,
+// so each is worth 10^(7-decimals) stroops of its Stellar form.
+// Amounts are converted only where slidechain meets Stellar:
+// in the peg-out of a wrapped export,
+// the release of a wrapped peg-in,
+// and the reconciliation of a wrapped asset's Stellar supply.
+
+// StellarDecimals is the number of decimal places of Stellar amounts.
+const StellarDecimals = 7
+
+var (
+	errAmountRange = errors.New("amount out of range")
+	errPrecision   = errors.New("amount too precise")
+)
+
+// stroopsPerUnit returns the Stellar amount of one txvm unit
+// of an asset with the given decimals.
+func stroopsPerUnit(decimals int) (int64, error) {
+	if decimals < 0 || decimals > StellarDecimals {
+		return 0, fmt.Errorf("decimals %d must be from 0 to %d", decimals, StellarDecimals)
+	}
+	n := int64(1)
+	for i := decimals; i < StellarDecimals; i++ {
+		n *= 10
+	}
+	return n, nil
+}
+
+// ToStellarAmount converts units, txvm units of an asset with the given decimals,
+// to a Stellar amount in stroops.
+// It is an error if the result overflows an int64.
+func ToStellarAmount(units int64, decimals int) (int64, error) {
+	n, err := stroopsPerUnit(decimals)
+	if err != nil {
+		return 0, err
+	}
+	if units < 0 || units > math.MaxInt64/n {
+		return 0, errors.WithDetailf(errAmountRange, "%d units of an asset with %d decimals exceed the largest Stellar amount", units, decimals)
+	}
+	return units * n, nil
+}
+
+// FromStellarAmount converts a Stellar amount in stroops
+// to txvm units of an asset with the given decimals.
+// It is an error if stroops is not a whole number of units.
+func FromStellarAmount(stroops int64, decimals int) (int64, error) {
+	n, err := stroopsPerUnit(decimals)
+	if err != nil {
+		return 0, err
+	}
+	if stroops < 0 {
+		return 0, errors.WithDetailf(errAmountRange, "negative amount %d", stroops)
+	}
+	if stroops%n != 0 {
+		return 0, errors.WithDetailf(errPrecision, "%d stroops is not a whole number of units of an asset with %d decimals", stroops, decimals)
+	}
+	return stroops / n, nil
+}
+
+// assetDecimals returns the decimals of the txvm units
+// of the main-chain asset assetXDR:
+// those registered for a wrapped asset,
+// and StellarDecimals for any other.
+func (c *Custodian) assetDecimals(ctx context.Context, assetXDR []byte) (int, error) {
+	w, err := c.wrappedAssetByXDR(ctx, assetXDR)
+	if err != nil || w == nil {
+		return StellarDecimals, err
+	}
+	return w.Decimals, nil
+}
+
+// withdrawal is p.withdrawal with its amount converted to stroops.
+func (c *Custodian) withdrawal(ctx context.Context, p *pegOut) (*Withdrawal, error) {
+	w := p.withdrawal()
+	decimals, err := c.assetDecimals(ctx, p.AssetXDR)
+	if err != nil {
+		return nil, err
+	}
+	w.Amount, err = ToStellarAmount(p.Amount, decimals)
+	if err != nil {
+		return nil, errors.Wrapf(err, "converting amount of export %x", p.TxID)
+	}
+	return w, nil
+}
@@ -0,0 +1,126 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"math"
+	"testing"
+	"testing/quick"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestAmountScaling(t *testing.T) {
+	cases := []struct {
+		units    int64
+		decimals int
+		stroops  int64
+		wantErr  error
+	}{
+		{units: 150, decimals: 7, stroops: 150},
+		{units: 150, decimals: 2, stroops: 15000000},
+		{units: 3, decimals: 0, stroops: 30000000},
+		{units: 0, decimals: 0, stroops: 0},
+		{units: math.MaxInt64, decimals: 7, stroops: math.MaxInt64},
+		{units: math.MaxInt64 / 10000000, decimals: 0, stroops: math.MaxInt64 / 10000000 * 10000000},
+		{units: math.MaxInt64/10000000 + 1, decimals: 0, wantErr: errAmountRange},
+		{units: -1, decimals: 7, wantErr: errAmountRange},
+	}
+	for _, tc := range cases {
+		got, err := ToStellarAmount(tc.units, tc.decimals)
+		if errors.Root(err) != tc.wantErr {
+			t.Errorf("ToStellarAmount(%d, %d): got error %v, want %v", tc.units, tc.decimals, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got != tc.stroops {
+			t.Errorf("ToStellarAmount(%d, %d) = %d, want %d", tc.units, tc.decimals, got, tc.stroops)
+		}
+		back, err := FromStellarAmount(got, tc.decimals)
+		if err != nil {
+			t.Errorf("FromStellarAmount(%d, %d): %s", got, tc.decimals, err)
+		} else if back != tc.units {
+			t.Errorf("FromStellarAmount(%d, %d) = %d, want %d", got, tc.decimals, back, tc.units)
+		}
+	}
+
+	if _, err := FromStellarAmount(15000001, 2); errors.Root(err) != errPrecision {
+		t.Errorf("FromStellarAmount of a fraction of a unit: got error %v, want %v", err, errPrecision)
+	}
+	if _, err := ToStellarAmount(1, 8); err == nil {
+		t.Error("ToStellarAmount with 8 decimals: got no error")
+	}
+
+	// Every amount in range round-trips, and every other is an error.
+	roundTrip := func(units int64, d uint8) bool {
+		decimals := int(d % (StellarDecimals + 1))
+		stroops, err := ToStellarAmount(units, decimals)
+		if err != nil {
+			n, _ := stroopsPerUnit(decimals)
+			return errors.Root(err) == errAmountRange && (units < 0 || units > math.MaxInt64/n)
+		}
+		back, err := FromStellarAmount(stroops, decimals)
+		return err == nil && back == units
+	}
+	err := quick.Check(roundTrip, &quick.Config{MaxCount: 10000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWrappedWithdrawal(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accountID := kp.Address()
+		c := &Custodian{
+			DB:        db,
+			AccountID: accountID,
+			chain:     newStellarChain(nil, accountID, kp.Seed(), ""),
+		}
+		err = c.registerWrappedAsset(ctx, &wrappedAsset{Code: "FOO", TxvmAsset: bytes.Repeat([]byte{0xab}, 32), Decimals: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		foo, err := stellar.NewAsset("FOO", kp.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fooXDR, err := foo.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			assetXDR []byte
+			amount   int64
+			want     int64
+		}{
+			{fooXDR, 150, 15000000},
+			{nativeXDR, 150, 150},
+		} {
+			w, err := c.withdrawal(ctx, &pegOut{TxID: []byte("export"), AssetXDR: tc.assetXDR, Amount: tc.amount})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Amount != tc.want {
+				t.Errorf("withdrawal of %d of %x: got %d stroops, want %d", tc.amount, tc.assetXDR, w.Amount, tc.want)
+			}
+		}
+	})
+}
@@ -3,6 +3,7 @@ package slidechain
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,7 +15,9 @@ import (
 	"github.com/chain/txvm/protocol/bc"
 	"github.com/chain/txvm/protocol/txvm"
 	"github.com/chain/txvm/protocol/txvm/asm"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
 	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/starlight/worizon/xlm"
 )
 
 // PrePegIn contains the fields to build a pre-peg-in TxVM tx and record the peg-in transaction in the database.
@@ -24,9 +27,22 @@ type PrePegIn struct {
 	AssetXDR    []byte `json:"asset_xdr"`
 	RecipPubkey []byte `json:"recip_pubkey"`
 	ExpMS       int64  `json:"exp_ms"`
+
+	// Referral is a code in partner_fees.referral_codes
+	// attributing the peg-in to a partner.
+	Referral string `json:"referral,omitempty"`
+
+	// Batch are further peg-ins, for any recipients,
+	// paid by the second and later payments to the custodian
+	// in the Stellar tx whose memo is this peg-in's nonce hash,
+	// in order.
+	// Their own Batch must be empty.
+	Batch []PrePegIn `json:"batch,omitempty"`
 }
 
-func buildPrePegInTx(bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx, error) {
+// buildPrePegInTx builds the pre-peg-in tx creating the uniqueness token
+// of a peg-in to be imported by ic.
+func buildPrePegInTx(ic *issuanceContract, bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx, error) {
 	buf := new(bytes.Buffer)
 	// Set up pre-peg tx arg stack: asset, amount, zeroval, {recip}, quorum
 	fmt.Fprintf(buf, "x'%x' put\n", assetXDR)
@@ -35,7 +51,7 @@ func buildPrePegInTx(bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx,
 	fmt.Fprintf(buf, "{x'%x'} put\n", recip)
 	fmt.Fprintf(buf, "1 put\n") // The signer quorum size of 1 is fixed.
 	// Call create token contract.
-	fmt.Fprintf(buf, "x'%x' contract call\n", createTokenProg)
+	fmt.Fprintf(buf, "x'%x' contract call\n", ic.createTokenProg)
 	fmt.Fprintf(buf, "finalize\n")
 	prog, err := asm.Assemble(buf.String())
 	if err != nil {
@@ -55,56 +71,207 @@ func buildPrePegInTx(bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx,
 }
 
 // DoPrePegIn builds, submits, and waits on the pre-peg-in transaction to TxVM, and records a peg-in in the database.
+// With a batch, it does so for each peg-in of the batch as well,
+// recording which payment of the deposit tx pays each one,
+// and responds with their nonce hashes in order.
 func (c *Custodian) DoPrePegIn(w http.ResponseWriter, req *http.Request) {
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
 		return
 	}
 	// Unmarshal request.
 	var p PrePegIn
 	err = json.Unmarshal(data, &p)
 	if err != nil {
-		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
 		return
 	}
-	// Build pre-peg-in transaction.
-	tx, err := buildPrePegInTx(p.BcID, p.AssetXDR, p.RecipPubkey, p.Amount, p.ExpMS)
-	if err != nil {
-		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
-		return
+	pegs := append([]PrePegIn{p}, p.Batch...)
+	expMSs := make(map[int64]bool)
+	for _, p := range pegs[1:] {
+		if len(p.Batch) > 0 {
+			net.Errorf(w, http.StatusBadRequest, "a batched peg-in cannot have a batch")
+			return
+		}
+	}
+	for _, p := range pegs {
+		if expMSs[p.ExpMS] {
+			net.Errorf(w, http.StatusBadRequest, "peg-ins of a batch must have distinct exp_ms")
+			return
+		}
+		expMSs[p.ExpMS] = true
 	}
-	// Submit pre-peg-in transaction and wait on success.
 	ctx := req.Context()
-	r, err := c.S.submitTx(ctx, tx)
+	for _, p := range pegs {
+		if code, err := c.checkPegIn(ctx, p.AssetXDR); err != nil {
+			net.Errorf(w, code, "%s", err)
+			return
+		}
+		// A wrapped asset is pegged in whole txvm units.
+		decimals, err := c.assetDecimals(ctx, p.AssetXDR)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+			return
+		}
+		if _, err := FromStellarAmount(p.Amount, decimals); err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+	partner, err := c.pegInPartner(req, p.Referral)
 	if err != nil {
-		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
 		return
 	}
-	err = c.S.waitOnTx(ctx, tx.ID, r)
-	if err != nil {
-		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+	for _, p := range pegs {
+		// Build pre-peg-in transaction.
+		tx, err := buildPrePegInTx(c.issuance(), p.BcID, p.AssetXDR, p.RecipPubkey, p.Amount, p.ExpMS)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return
+		}
+		// Submit pre-peg-in transaction and wait on success.
+		r, err := c.S.submitTx(ctx, tx)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return
+		}
+		err = c.S.waitOnTx(ctx, tx.ID, r)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return
+		}
 	}
-	// Record peg in database.
-	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.ExpMS)
-	err = c.insertPegIn(ctx, nonceHash[:], p.RecipPubkey, p.ExpMS)
+	// Record pegs in database.
+	nonceHashes, err := c.insertPegInBatch(ctx, pegs)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
 		return
 	}
-	log.Printf("recorded peg for tx with nonce hash %x in db", nonceHash[:])
+	for _, nonceHash := range nonceHashes {
+		err = c.attributePegIn(ctx, nonceHash, partner)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		log.Printf("recorded peg for tx with nonce hash %x in db", nonceHash)
+	}
 	w.Header().Set("Content-Type", "application/octet-stream")
-	_, err = w.Write(nonceHash[:])
+	_, err = w.Write(bytes.Join(nonceHashes, nil))
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
 		return
 	}
 }
 
+// checkPegIn reports why a peg-in of assetXDR may not be recorded now,
+// with the HTTP status to respond with:
+// the peg is paused, the asset is not allowed,
+// or the custodian cannot front the lumens for its eventual peg-out.
+func (c *Custodian) checkPegIn(ctx context.Context, assetXDR []byte) (int, error) {
+	paused, err := c.pegPaused(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if paused {
+		return http.StatusServiceUnavailable, errors.New("the peg is paused")
+	}
+	allowed, err := c.assetAllowed(assetXDR)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrap(err, "checking asset")
+	}
+	if !allowed {
+		// Wrapped assets can always be pegged back in.
+		wrapped, err := c.wrappedAssetByXDR(ctx, assetXDR)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "checking asset")
+		}
+		allowed = wrapped != nil
+	}
+	if !allowed {
+		err = &scerrors.AssetError{Asset: assetName(assetXDR), Err: scerrors.ErrUnknownAsset}
+		return scerrors.Status(err), err
+	}
+	if sc, ok := c.chain.(*stellarChain); ok {
+		var allowUnknown bool
+		if cfg := c.config(); cfg != nil {
+			allowUnknown = cfg.Horizon.AllowUnknownProtocol
+		}
+		if err := sc.protocolError(allowUnknown); err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		// The custodian fronts the lumens for the peg-out
+		// that will eventually return this value to Stellar.
+		spare, err := c.spareBalance(ctx, sc)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "checking custodian balance")
+		}
+		var minSpare int64
+		if cfg := c.config(); cfg != nil {
+			minSpare = cfg.Balance.MinSpare
+		}
+		if need := xlm.Amount(minSpare) + tempAccountBalance + baseFee; spare < need {
+			err = errors.WithDetailf(scerrors.ErrInsufficientReserve, "custodian has %s spare, needs %s", spare, need)
+			return scerrors.Status(err), err
+		}
+	}
+	return 0, nil
+}
+
+// insertPegIn records a peg-in,
+// to be imported with the custodian's current issuance version.
 func (c *Custodian) insertPegIn(ctx context.Context, nonceHash, recip []byte, expMS int64) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	err = c.insertPegInTx(ctx, dbtx, nonceHash, recip, expMS)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(dbtx.Commit(), "committing peg")
+}
+
+// insertPegInBatch records the peg-ins of a /prepegin batch as one,
+// returning their nonce hashes.
+// Each after the first is bound in peg_batches
+// to its payment in the deposit tx of the first;
+// see paymentNonceHash.
+func (c *Custodian) insertPegInBatch(ctx context.Context, pegs []PrePegIn) ([][]byte, error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	var nonceHashes [][]byte
+	for k, p := range pegs {
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.ExpMS)
+		err = c.insertPegInTx(ctx, dbtx, nonceHash[:], p.RecipPubkey, p.ExpMS)
+		if err != nil {
+			return nil, err
+		}
+		if k > 0 {
+			const q = `INSERT INTO peg_batches (lead_nonce_hash, payment, nonce_hash) VALUES ($1, $2, $3)`
+			_, err = dbtx.ExecContext(ctx, q, nonceHashes[0], k, nonceHash[:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "binding peg-in %x to payment %d of peg-in %x", nonceHash[:], k, nonceHashes[0])
+			}
+		}
+		nonceHashes = append(nonceHashes, nonceHash[:])
+	}
+	return nonceHashes, errors.Wrap(dbtx.Commit(), "committing pegs")
+}
+
+// insertPegInTx records a peg-in in dbtx.
+func (c *Custodian) insertPegInTx(ctx context.Context, dbtx *sql.Tx, nonceHash, recip []byte, expMS int64) error {
 	const q = `INSERT INTO pegs
-		(nonce_hash, recipient_pubkey, nonce_expms)
-		VALUES ($1, $2, $3)`
-	_, err := c.DB.ExecContext(ctx, q, nonceHash, recip, expMS)
-	return errors.Wrap(err, "inserting peg in db")
+		(nonce_hash, recipient_pubkey, nonce_expms, state, issuance_version)
+		VALUES ($1, $2, $3, $4, $5)`
+	_, err := dbtx.ExecContext(ctx, q, nonceHash, recip, expMS, pegInRecorded, c.issuance().version)
+	if err != nil {
+		return errors.Wrap(err, "inserting peg in db")
+	}
+	return recordStateEvent(ctx, dbtx, c.nowMS(), "peg-in", nonceHash, "", pegInRecorded.String())
 }
@@ -0,0 +1,196 @@
+package slidechain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// PegOutPreview is the response of /admin/pegout-preview:
+// the peg-out tx of a pending export,
+// exactly as it will be signed and submitted.
+type PegOutPreview struct {
+	TxID     string `json:"txid"`
+	State    string `json:"state"`
+	FeeLevel int    `json:"fee_level"`
+
+	// Hash is the Stellar hash of the tx,
+	// which the exporter's pre-export tx preauthorized.
+	Hash string `json:"hash"`
+
+	// EnvelopeXDR is the unsigned tx envelope, base64-encoded.
+	EnvelopeXDR string `json:"envelope_xdr"`
+
+	Source     string      `json:"source"`
+	Sequence   int64       `json:"sequence"`
+	Fee        int64       `json:"fee"` // in stroops, for the whole tx
+	MinTime    int64       `json:"min_time,omitempty"`
+	MaxTime    int64       `json:"max_time,omitempty"`
+	MinLedger  uint32      `json:"min_ledger,omitempty"`
+	MaxLedger  uint32      `json:"max_ledger,omitempty"`
+	MinSeqAge  uint64      `json:"min_seq_age,omitempty"`
+	Memo       string      `json:"memo,omitempty"`
+	Operations []PreviewOp `json:"operations"`
+}
+
+// PreviewOp is one operation of a previewed tx.
+type PreviewOp struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+// PegOutPreview is the admin handler for /admin/pegout-preview,
+// serving the peg-out tx of the export whose txvm tx ID is in the txid parameter,
+// built at its current fee level as the next submission will build it.
+// Only an export not yet pegged out or to be retried has one,
+// and not one paid in a netting.
+func (c *Custodian) PegOutPreview(w http.ResponseWriter, req *http.Request) {
+	txid, err := hex.DecodeString(req.FormValue("txid"))
+	if err != nil || len(txid) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "txid must be 32 hex-encoded bytes")
+		return
+	}
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		net.Errorf(w, http.StatusNotImplemented, "peg-out previews are only of Stellar txs")
+		return
+	}
+	ctx := req.Context()
+	ps, err := c.queryExports(ctx, `FROM exports e WHERE e.txid=$1`, txid)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if len(ps) == 0 {
+		net.Errorf(w, http.StatusNotFound, "export %x not found", txid)
+		return
+	}
+	p := ps[0]
+	if p.State != pegOutNotYet && p.State != pegOutRetry {
+		net.Errorf(w, http.StatusConflict, "export %x is in state %s, not pending", txid, p.State)
+		return
+	}
+	var netted bool
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) > 0 FROM netted_exports WHERE txid=$1`, txid).Scan(&netted)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading nettings: %s", err)
+		return
+	}
+	if netted {
+		net.Errorf(w, http.StatusConflict, "export %x is paid in a netting", txid)
+		return
+	}
+	wd, err := c.withdrawal(ctx, &p)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	tx, err := sc.pegOutTx(wd, pegOutFee(p.FeeLevel))
+	if err != nil {
+		net.Errorf(w, http.StatusUnprocessableEntity, "building peg-out tx: %s", err)
+		return
+	}
+	preview, err := previewTx(tx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	preview.TxID = hex.EncodeToString(txid)
+	preview.State = p.State.String()
+	preview.FeeLevel = p.FeeLevel
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// previewTx describes the unsigned tx.
+func previewTx(tx *stellar.Tx) (*PegOutPreview, error) {
+	hash, err := stellar.TxHash(tx)
+	if err != nil {
+		return nil, err
+	}
+	envXDR, err := tx.Sign()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling tx envelope")
+	}
+	preview := &PegOutPreview{
+		Hash:        hash,
+		EnvelopeXDR: envXDR,
+		Source:      tx.Source,
+		Sequence:    int64(tx.SeqNum),
+		Fee:         tx.TotalFee(),
+		MinSeqAge:   tx.MinSeqAge,
+		Memo:        memoString(tx.Memo),
+		Operations:  []PreviewOp{},
+	}
+	if tb := tx.TimeBounds; tb != nil {
+		preview.MinTime, preview.MaxTime = tb.MinTime, tb.MaxTime
+	}
+	if lb := tx.LedgerBounds; lb != nil {
+		preview.MinLedger, preview.MaxLedger = lb.MinLedger, lb.MaxLedger
+	}
+	for i, op := range tx.Ops {
+		preview.Operations = append(preview.Operations, previewOp(op, tx.OpSource(i)))
+	}
+	return preview, nil
+}
+
+// previewOp describes op, whose source account is source.
+func previewOp(op stellar.Op, source string) PreviewOp {
+	p := PreviewOp{Source: source}
+	switch op := op.(type) {
+	case stellar.Payment:
+		p.Type = "payment"
+		p.Description = fmt.Sprintf("pay %s %s to %s", stellar.FormatAmount(op.Amount), stellar.AssetKey(op.Asset), op.Destination)
+	case stellar.AccountMerge:
+		p.Type = "account_merge"
+		p.Description = fmt.Sprintf("merge %s into %s", p.Source, op.Destination)
+	case stellar.ChangeTrust:
+		p.Type = "change_trust"
+		p.Description = fmt.Sprintf("trust %s up to %s", stellar.AssetKey(op.Asset), stellar.FormatAmount(op.Limit))
+	case stellar.AllowTrust:
+		p.Type = "allow_trust"
+		verb := "deauthorize"
+		if op.Authorize {
+			verb = "authorize"
+		}
+		p.Description = fmt.Sprintf("%s the trustline of %s", verb, op.Trustor)
+	case stellar.BumpSequence:
+		p.Type = "bump_sequence"
+		p.Description = fmt.Sprintf("bump the sequence number of %s to %d", p.Source, op.BumpTo)
+	case stellar.PathPayment:
+		p.Type = "path_payment"
+	case stellar.CreateAccount:
+		p.Type = "create_account"
+	case stellar.SetOptions:
+		p.Type = "set_options"
+	case stellar.ManageData:
+		p.Type = "manage_data"
+	case stellar.OtherOp:
+		p.Type = op.Type
+	}
+	if p.Description == "" {
+		p.Description = p.Type
+	}
+	return p
+}
+
+// memoString describes a tx memo, or is empty if there is none.
+func memoString(m stellar.Memo) string {
+	switch m := m.(type) {
+	case stellar.MemoText:
+		return "text " + string(m)
+	case stellar.MemoID:
+		return fmt.Sprintf("id %d", m)
+	case stellar.MemoHash:
+		return "hash " + hex.EncodeToString(m[:])
+	case stellar.MemoReturn:
+		return "return " + hex.EncodeToString(m[:])
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestPegOutPreview(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	now := time.Now()
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := bytes.Repeat([]byte{1}, 32)
+		p := &pegOut{
+			TxID:        txid,
+			AssetXDR:    nativeXDR,
+			TempAddr:    tempKP.Address(),
+			Seqnum:      42,
+			Exporter:    exporterKP.Address(),
+			Amount:      5000000,
+			Anchor:      []byte{},
+			Pubkey:      []byte{},
+			TimeBounds:  TimeBounds{MaxTime: now.Unix() + 3600},
+			Destination: Destination{MemoType: "id", Memo: "7"},
+		}
+		err = c.insertExport(ctx, txid, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		preview := func(txid string, wantCode int) PegOutPreview {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.PegOutPreview(w, httptest.NewRequest("GET", "/admin/pegout-preview?txid="+txid, nil))
+			if w.Code != wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, wantCode, w.Body)
+			}
+			var got PegOutPreview
+			if wantCode == http.StatusOK {
+				err := json.NewDecoder(w.Body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return got
+		}
+		got := preview(hex.EncodeToString(txid), http.StatusOK)
+
+		// The preview is of the tx the exporter preauthorized.
+		tx, err := buildPegOutTx(custKP.Address(), exporterKP.Address(), tempKP.Address(), srv.Passphrase, stellar.NativeAsset(), p.Amount, 42, pegOutFee(0), p.TimeBounds, p.Destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantHash, err := stellar.TxHash(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hash != wantHash || got.State != "not-yet" || got.Source != tempKP.Address() || got.Sequence != 43 || got.Memo != "id 7" || got.MaxTime != p.MaxTime {
+			t.Errorf("got preview %+v, want hash %s", got, wantHash)
+		}
+		env, err := stellar.DecodeTx(got.EnvelopeXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Signatures) != 0 || len(env.Ops) != 2 {
+			t.Errorf("got envelope with %d signatures and %d ops, want 0 and 2", len(env.Signatures), len(env.Ops))
+		}
+		want := []PreviewOp{
+			{Type: "account_merge", Source: tempKP.Address(), Description: "merge " + tempKP.Address() + " into " + exporterKP.Address()},
+			{Type: "payment", Source: custKP.Address(), Description: "pay 0.5000000 native to " + exporterKP.Address()},
+		}
+		if len(got.Operations) != len(want) {
+			t.Fatalf("got ops %+v, want %+v", got.Operations, want)
+		}
+		for i := range want {
+			if got.Operations[i] != want[i] {
+				t.Errorf("op %d: got %+v, want %+v", i, got.Operations[i], want[i])
+			}
+		}
+
+		preview(hex.EncodeToString(bytes.Repeat([]byte{2}, 32)), http.StatusNotFound)
+		preview("nope", http.StatusBadRequest)
+		err = c.movePegOut(ctx, txid, pegOutNotYet, pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preview(hex.EncodeToString(txid), http.StatusConflict)
+	})
+}
@@ -0,0 +1,162 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/merkle"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+// Runs as a goroutine.
+func (c *Custodian) indexTxs(ctx context.Context) {
+	defer log.Println("indexTxs exiting")
+
+	c.RunPin(ctx, "indexTxs", c.indexBlock)
+}
+
+// indexBlock records the header and signatures of b
+// and the position and witness hash of each of its txs,
+// which are all that inclusion proofs need,
+// so that proofs can be served after b itself has expired.
+func (c *Custodian) indexBlock(ctx context.Context, b *bc.Block) error {
+	bits, err := headerBytes(b)
+	if err != nil {
+		return errors.Wrapf(err, "serializing header of block %d", b.Height)
+	}
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db tx")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO block_headers (height, bits) VALUES ($1, $2)`, b.Height, bits)
+	if err != nil {
+		return errors.Wrapf(err, "recording header of block %d", b.Height)
+	}
+	for i, tx := range b.Transactions {
+		const q = `INSERT OR IGNORE INTO block_txs (txid, height, position, witness_hash) VALUES ($1, $2, $3, $4)`
+		_, err = dbtx.ExecContext(ctx, q, tx.ID.Bytes(), b.Height, i, txproof.WitnessHash(tx).Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "indexing tx %x", tx.ID.Bytes())
+		}
+	}
+	return dbtx.Commit()
+}
+
+// txOnChain reports whether the tx with the given ID is on the chain:
+// indexed in block_txs,
+// or in a block after those indexTxs has reached.
+func (c *Custodian) txOnChain(ctx context.Context, txid bc.Hash) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM block_txs WHERE txid=$1`, txid.Bytes()).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "looking up tx %x", txid.Bytes())
+	}
+	if n > 0 {
+		return true, nil
+	}
+	var found bool
+	const q = `SELECT bits FROM blocks WHERE height > COALESCE((SELECT height FROM pins WHERE name='indexTxs'), 0) ORDER BY height`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, func(bits []byte) error {
+		if found {
+			return nil
+		}
+		var b bc.Block
+		err := b.FromBytes(bits)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling block")
+		}
+		for _, tx := range b.Transactions {
+			if tx.ID == txid {
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	return found, errors.Wrapf(err, "looking for tx %x in unindexed blocks", txid.Bytes())
+}
+
+// headerBytes serializes b without its transactions.
+func headerBytes(b *bc.Block) ([]byte, error) {
+	header := &bc.Block{
+		UnsignedBlock: &bc.UnsignedBlock{BlockHeader: b.BlockHeader},
+		Arguments:     b.Arguments,
+	}
+	return header.Bytes()
+}
+
+// txProof builds the inclusion proof for the tx with the given ID.
+// It returns sql.ErrNoRows if the tx has not been indexed.
+func (c *Custodian) txProof(ctx context.Context, txid bc.Hash) (*txproof.Proof, error) {
+	p := &txproof.Proof{TxID: txid}
+	var (
+		height  uint64
+		witness []byte
+	)
+	const q = `SELECT height, position, witness_hash FROM block_txs WHERE txid=$1`
+	err := c.DB.QueryRowContext(ctx, q, txid.Bytes()).Scan(&height, &p.Position, &witness)
+	if err != nil {
+		return nil, err
+	}
+	p.WitnessHash = bc.HashFromBytes(witness)
+
+	var leaves [][]byte
+	const leavesQ = `SELECT txid, witness_hash FROM block_txs WHERE height=$1 ORDER BY position`
+	err = sqlutil.ForQueryRows(ctx, c.DB, leavesQ, height, func(txid, witness []byte) {
+		leaves = append(leaves, append(append([]byte{}, txid...), witness...))
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading txs of block %d", height)
+	}
+	path, err := merkle.Proof(leaves, p.Position)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building merkle path in block %d", height)
+	}
+	for _, h := range path {
+		p.Path = append(p.Path, txproof.Step{Hash: bc.NewHash(h.Val), Right: h.RightOperator})
+	}
+
+	err = c.DB.QueryRowContext(ctx, `SELECT bits FROM block_headers WHERE height=$1`, height).Scan(&p.Block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading header of block %d", height)
+	}
+	return p, nil
+}
+
+// TxProof serves the inclusion proof, a JSON txproof.Proof,
+// for the tx whose hex ID is in the txid parameter.
+func (c *Custodian) TxProof(w http.ResponseWriter, req *http.Request) {
+	txid, err := hex.DecodeString(req.FormValue("txid"))
+	if err != nil || len(txid) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "txid must be 32 hex-encoded bytes")
+		return
+	}
+	p, err := c.txProof(req.Context(), bc.HashFromBytes(txid))
+	if err == sql.ErrNoRows {
+		net.Errorf(w, http.StatusNotFound, "tx %x not found", txid)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(p)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "encoding proof: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,106 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+func TestTxProof(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db}
+
+		var txs []*bc.Tx
+		for i := 0; i < 5; i++ {
+			expMS := int64(bc.Millis(time.Now().Add(time.Duration(i+1) * time.Minute)))
+			tx, err := buildPrePegInTx(issuanceContracts[1], make([]byte, 32), nil, testRecipPubKey, 1, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, tx)
+		}
+		root := bc.TxMerkleRoot(txs)
+		pub, prv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &bc.Block{UnsignedBlock: &bc.UnsignedBlock{
+			BlockHeader: &bc.BlockHeader{
+				Version:          3,
+				Height:           2,
+				TransactionsRoot: &root,
+				NextPredicate:    &bc.Predicate{Version: 1},
+			},
+			Transactions: txs,
+		}}
+		id := b.Hash()
+		b.Arguments = []interface{}{ed25519.Sign(prv, id.Bytes())}
+		err = c.indexBlock(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, tx := range txs {
+			rec := httptest.NewRecorder()
+			c.TxProof(rec, httptest.NewRequest("GET", fmt.Sprintf("/proof?txid=%x", tx.ID.Bytes()), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("tx %d: got status %d", i, rec.Code)
+			}
+			var p txproof.Proof
+			err := json.Unmarshal(rec.Body.Bytes(), &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := txproof.VerifyTx(&p, tx)
+			if err != nil {
+				t.Fatalf("tx %d: %s", i, err)
+			}
+			if got.Hash() != id {
+				t.Errorf("tx %d: proof is for block %x, want %x", i, got.Hash().Bytes(), id.Bytes())
+			}
+			_, err = txproof.VerifyTx(&p, txs[(i+1)%len(txs)])
+			if errors.Root(err) != txproof.ErrTx {
+				t.Errorf("tx %d: verifying against another tx got error %v, want %v", i, err, txproof.ErrTx)
+			}
+			p.WitnessHash = txproof.WitnessHash(txs[(i+1)%len(txs)])
+			_, err = txproof.Verify(&p)
+			if errors.Root(err) != txproof.ErrRoot {
+				t.Errorf("tx %d: verifying a bad leaf got error %v, want %v", i, err, txproof.ErrRoot)
+			}
+		}
+
+		err = txproof.CheckSignatures(b, &bc.Predicate{Version: 1, Quorum: 1, Pubkeys: [][]byte{pub}})
+		if err != nil {
+			t.Error(err)
+		}
+		other, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = txproof.CheckSignatures(b, &bc.Predicate{Version: 1, Quorum: 1, Pubkeys: [][]byte{other}})
+		if errors.Root(err) != txproof.ErrSignatures {
+			t.Errorf("checking signatures against another key got error %v, want %v", err, txproof.ErrSignatures)
+		}
+
+		rec := httptest.NewRecorder()
+		c.TxProof(rec, httptest.NewRequest("GET", fmt.Sprintf("/proof?txid=%x", make([]byte, 32)), nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("unknown tx: got status %d, want %d", rec.Code, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// errUnsupportedProtocol is the error for a Stellar network
+// on a protocol version the custodian does not support.
+var errUnsupportedProtocol = errors.New("unsupported Stellar protocol")
+
+// protocolAlert is the kind of alert raised
+// when the network upgrades to a protocol version
+// that is not fully supported.
+const protocolAlert = "protocol"
+
+// protocolCheckInterval is how often watchProtocol
+// checks the network's protocol version.
+const protocolCheckInterval = 10 * time.Minute
+
+// checkProtocol reports how far protocol version v is supported,
+// returning errUnsupportedProtocol if the custodian cannot run on it:
+// if it is before stellar.MinProtocol,
+// or after stellar.MaxProtocol unless allowUnknown.
+func checkProtocol(v int32, allowUnknown bool) (stellar.Compat, error) {
+	compat := stellar.CheckProtocol(v)
+	if compat == stellar.Unsupported && (v < stellar.MinProtocol || !allowUnknown) {
+		return compat, errors.WithDetailf(errUnsupportedProtocol, "network protocol %d, supported %d to %d", v, stellar.MinProtocol, stellar.MaxProtocol)
+	}
+	return compat, nil
+}
+
+// protocolError returns the error for the last protocol version
+// of sc's network that the custodian saw,
+// if it cannot run on it.
+func (s *stellarChain) protocolError(allowUnknown bool) error {
+	v := atomic.LoadInt32(&s.protocol)
+	if v == 0 {
+		return nil
+	}
+	_, err := checkProtocol(v, allowUnknown)
+	return err
+}
+
+// watchProtocol runs as a goroutine,
+// checking the protocol version of sc's network
+// every protocolCheckInterval until ctx is canceled.
+func (c *Custodian) watchProtocol(ctx context.Context, sc *stellarChain) {
+	defer log.Print("watchProtocol exiting")
+
+	ticker := time.NewTicker(protocolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.checkNetworkProtocol(ctx, sc)
+		if err != nil {
+			log.Printf("checking network protocol: %s", err)
+		}
+	}
+}
+
+// checkNetworkProtocol records the protocol version of sc's network.
+// An upgrade to a version that is not fully supported raises an alert,
+// and while the version is unsupported new peg-ins are refused.
+func (c *Custodian) checkNetworkProtocol(ctx context.Context, sc *stellarChain) error {
+	v, err := stellar.NetworkProtocol(ctx, sc.hclient)
+	if err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&sc.protocol) == v {
+		return nil
+	}
+	var allowUnknown bool
+	if cfg := c.config(); cfg != nil {
+		allowUnknown = cfg.Horizon.AllowUnknownProtocol
+	}
+	compat, err := checkProtocol(v, allowUnknown)
+	if compat != stellar.Supported {
+		detail := fmt.Sprintf("network upgraded to protocol %d, %s (supported %d to %d, fully to %d)", v, compat, stellar.MinProtocol, stellar.MaxProtocol, stellar.XDRProtocol)
+		if err != nil {
+			detail += "; refusing new peg-ins"
+		}
+		err = c.alert(ctx, protocolAlert, []byte(fmt.Sprintf("%d", v)), detail)
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&sc.protocol, v)
+	return nil
+}
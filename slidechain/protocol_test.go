@@ -0,0 +1,101 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestProtocolCheck(t *testing.T) {
+	cases := []struct {
+		version      int32
+		allowUnknown bool
+		want         stellar.Compat
+		wantErr      error
+	}{
+		{version: 9, want: stellar.Unsupported, wantErr: errUnsupportedProtocol},
+		{version: 9, allowUnknown: true, want: stellar.Unsupported, wantErr: errUnsupportedProtocol},
+		{version: 10, want: stellar.Supported},
+		{version: 13, want: stellar.Supported},
+		{version: 23, want: stellar.Supported},
+		{version: 24, want: stellar.Degraded},
+		{version: 25, want: stellar.Degraded},
+		{version: 26, want: stellar.Unsupported, wantErr: errUnsupportedProtocol},
+		{version: 26, allowUnknown: true, want: stellar.Unsupported},
+	}
+	for _, tc := range cases {
+		got, err := checkProtocol(tc.version, tc.allowUnknown)
+		if got != tc.want || errors.Root(err) != tc.wantErr {
+			t.Errorf("checkProtocol(%d, %v) = %s, %v; want %s, %v", tc.version, tc.allowUnknown, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+
+	withTestDB(t, func(db *sql.DB) {
+		// The custodian refuses to start on an unknown protocol.
+		srv.Protocol = stellar.MaxProtocol + 1
+		_, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if errors.Root(err) != errUnsupportedProtocol {
+			t.Fatalf("got error %v starting on protocol %d, want %s", err, srv.Protocol, errUnsupportedProtocol)
+		}
+
+		srv.Protocol = stellar.MaxProtocol
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, err := c.checkPegIn(ctx, nativeXDR); err != nil {
+			t.Fatalf("checking peg-in on protocol %d: %d %s", srv.Protocol, code, err)
+		}
+
+		// An upgrade past it raises an alert and refuses peg-ins.
+		srv.Protocol = stellar.MaxProtocol + 1
+		err = c.checkNetworkProtocol(ctx, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alerted, err := c.alerted(ctx, protocolAlert, []byte(fmt.Sprint(srv.Protocol)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for an unsupported protocol upgrade")
+		}
+		if code, err := c.checkPegIn(ctx, nativeXDR); code != http.StatusServiceUnavailable || errors.Root(err) != errUnsupportedProtocol {
+			t.Errorf("checking peg-in on protocol %d: got %d %v, want %d %s", srv.Protocol, code, err, http.StatusServiceUnavailable, errUnsupportedProtocol)
+		}
+
+		// Unless unknown protocols are allowed.
+		c.cfg.Horizon.AllowUnknownProtocol = true
+		if code, err := c.checkPegIn(ctx, nativeXDR); err != nil {
+			t.Errorf("checking peg-in on protocol %d with unknown protocols allowed: %d %s", srv.Protocol, code, err)
+		}
+	})
+}
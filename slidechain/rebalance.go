@@ -0,0 +1,336 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/oracle"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// reserveHolding is an asset in the response to /admin/rebalance:
+// what the custodian account holds of it
+// against what it owes.
+type reserveHolding struct {
+	Asset   string `json:"asset"`
+	Held    int64  `json:"held"`    // for lumens, less the account reserve
+	Owed    int64  `json:"owed"`    // outstanding issuance and deposits awaiting refund, as clawback checks count it
+	Pending int64  `json:"pending"` // owed to exports awaiting peg-out
+	Surplus int64  `json:"surplus"` // held less owed; negative is a shortfall
+	Trusted bool   `json:"trusted"` // the account can hold the asset
+}
+
+// rebalanceRequest is the body of a POST to /admin/rebalance.
+// With no path, Stellar takes the direct order book.
+type rebalanceRequest struct {
+	SendAsset  string   `json:"send_asset"`
+	SendMax    int64    `json:"send_max"`
+	DestAsset  string   `json:"dest_asset"`
+	DestAmount int64    `json:"dest_amount"`
+	Path       []string `json:"path,omitempty"`
+	Note       string   `json:"note"`
+}
+
+// rebalanceResp is the response to /admin/rebalance.
+type rebalanceResp struct {
+	TxHash   string           `json:"tx_hash,omitempty"` // of a POST
+	Holdings []reserveHolding `json:"holdings"`
+}
+
+// reserveHoldings lists the custodian account's holdings
+// of the lumens and of each pegged-in asset it holds or owes,
+// leaving out the wrapped assets it issues.
+func (c *Custodian) reserveHoldings(ctx context.Context, sc *stellarChain) ([]reserveHolding, error) {
+	tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+	defer cancel()
+	acct, err := stellar.WithContext(tctx, sc.hclient).LoadAccount(sc.account)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading custodian account")
+	}
+	holdings := make(map[string]*reserveHolding)
+	for _, bal := range acct.Balances {
+		key := "native"
+		if bal.AssetType != "native" {
+			key = bal.AssetCode + ":" + bal.AssetIssuer
+		}
+		held, err := stellar.ParseAmount(bal.Balance)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing custodian balance of %s", key)
+		}
+		if key == "native" {
+			held -= int64(2+acct.SubentryCount) * int64(baseReserve)
+		}
+		holdings[key] = &reserveHolding{Asset: key, Held: held, Trusted: true}
+	}
+	var assets [][]byte
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs`, func(assetXDR []byte) {
+		assets = append(assets, assetXDR)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading pegged-in assets")
+	}
+	nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling native asset")
+	}
+	assets = append(assets, nativeXDR)
+
+	var result []reserveHolding
+	seen := make(map[string]bool)
+	for _, assetXDR := range assets {
+		key := assetName(assetXDR)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		w, err := c.wrappedAssetByXDR(ctx, assetXDR)
+		if err != nil {
+			return nil, err
+		}
+		if w != nil {
+			continue
+		}
+		h := holdings[key]
+		if h == nil {
+			h = &reserveHolding{Asset: key}
+		}
+		h.Owed, err = c.owed(ctx, assetXDR)
+		if err != nil {
+			return nil, err
+		}
+		const q = `SELECT COALESCE(SUM(amount), 0) FROM exports WHERE asset_xdr=$1 AND pegged_out IN ($2, $3)`
+		err = c.DB.QueryRowContext(ctx, q, assetXDR, pegOutNotYet, pegOutRetry).Scan(&h.Pending)
+		if err != nil {
+			return nil, errors.Wrapf(err, "totaling pending exports of %s", key)
+		}
+		h.Surplus = h.Held - h.Owed
+		result = append(result, *h)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Asset < result[j].Asset })
+	return result, nil
+}
+
+// rebalanceTx builds the path payment from the custodian account to itself
+// buying destAmount of dest for at most sendMax of send.
+func (s *stellarChain) rebalanceTx(seqnum stellar.SequenceNumber, send stellar.Asset, sendMax int64, dest stellar.Asset, destAmount int64, path []stellar.Asset) (*stellar.Tx, error) {
+	custodian := s.account
+	return &stellar.Tx{
+		Network: s.network,
+		Source:  custodian,
+		SeqNum:  seqnum,
+		Ops: []stellar.Op{
+			stellar.PathPayment{
+				SendAsset:   send,
+				SendMax:     sendMax,
+				Destination: custodian,
+				DestAsset:   dest,
+				DestAmount:  destAmount,
+				Path:        path,
+			},
+		},
+	}, nil
+}
+
+// rebalanceSigning is the path payment of r, as the signing policy sees it:
+// at most send_max of send to the custodian account itself,
+// named by the request, so that a held one passes once approved and resubmitted.
+func rebalanceSigning(r rebalanceRequest, custodian string, send stellar.Asset) (signing, error) {
+	sendXDR, err := send.MarshalBinary()
+	if err != nil {
+		return signing{}, errors.Wrap(err, "marshaling send asset")
+	}
+	reqJSON, err := json.Marshal(r)
+	if err != nil {
+		return signing{}, errors.Wrap(err, "marshaling rebalance")
+	}
+	id := sha3.Sum256(append([]byte("slidechain rebalance\x00"), reqJSON...))
+	return signing{Kind: "rebalance", ID: id[:], Destination: custodian, AssetXDR: sendXDR, Amount: r.SendMax}, nil
+}
+
+// checkRebalanceSlippage checks that at most sendMax of send
+// is worth no more than destAmount of dest
+// by rebalance.max_slippage,
+// if the oracle prices both.
+func (c *Custodian) checkRebalanceSlippage(ctx context.Context, cfg config.Rebalance, send stellar.Asset, sendMax int64, dest stellar.Asset, destAmount int64) error {
+	o := c.oracle()
+	if o == nil {
+		return nil
+	}
+	sendValue, err := oracle.Value(ctx, o, send, sendMax)
+	if err != nil {
+		return nil
+	}
+	destValue, err := oracle.Value(ctx, o, dest, destAmount)
+	if err != nil {
+		return nil
+	}
+	if float64(sendValue) > float64(destValue)*(1+cfg.MaxSlippage) {
+		return fmt.Errorf("send_max is worth %d, more than dest_amount's %d by over rebalance.max_slippage", sendValue, destValue)
+	}
+	return nil
+}
+
+// Rebalance is the admin handler converting the custodian's reserves
+// between assets on the Stellar DEX,
+// as when it lacks an asset it needs for pending peg-outs.
+// GET lists the holdings of the custodian account against what it owes.
+// POST, with rebalance.enabled, takes a JSON rebalanceRequest
+// and submits a path payment from the account to itself
+// selling at most send_max of send_asset, out of its surplus,
+// for dest_amount of dest_asset,
+// unless the custodian account has drifted from the custodian config
+// or the signing policy holds it.
+// A held rebalance passes when resubmitted once approved,
+// and each check passed is spent on the tx it signs.
+func (c *Custodian) Rebalance(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		net.Errorf(w, http.StatusNotFound, "rebalancing requires Stellar as the main chain")
+		return
+	}
+	var resp rebalanceResp
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		cfg := c.config()
+		if cfg == nil || !cfg.Rebalance.Enabled {
+			net.Errorf(w, http.StatusNotFound, "rebalancing is not enabled")
+			return
+		}
+		if c.accountHeld() {
+			net.Errorf(w, http.StatusConflict, "the custodian account has drifted from the custodian config: %s", sc.accountDrift())
+			return
+		}
+		var r rebalanceRequest
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+			return
+		}
+		if r.SendMax <= 0 || r.DestAmount <= 0 {
+			net.Errorf(w, http.StatusBadRequest, "send_max and dest_amount must be positive")
+			return
+		}
+		send, err := stellar.ParseAssetKey(r.SendAsset)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "send_asset: %s", err)
+			return
+		}
+		dest, err := stellar.ParseAssetKey(r.DestAsset)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "dest_asset: %s", err)
+			return
+		}
+		if send == dest {
+			net.Errorf(w, http.StatusBadRequest, "send_asset and dest_asset must differ")
+			return
+		}
+		var path []stellar.Asset
+		for _, s := range r.Path {
+			a, err := stellar.ParseAssetKey(s)
+			if err != nil {
+				net.Errorf(w, http.StatusBadRequest, "path: %s", err)
+				return
+			}
+			path = append(path, a)
+		}
+		err = c.checkRebalanceSlippage(ctx, cfg.Rebalance, send, r.SendMax, dest, r.DestAmount)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		holdings, err := c.reserveHoldings(ctx, sc)
+		if err != nil {
+			net.Errorf(w, http.StatusBadGateway, "%s", err)
+			return
+		}
+		var sendHolding, destHolding *reserveHolding
+		for i := range holdings {
+			switch holdings[i].Asset {
+			case stellar.AssetKey(send):
+				sendHolding = &holdings[i]
+			case stellar.AssetKey(dest):
+				destHolding = &holdings[i]
+			}
+		}
+		if sendHolding == nil || sendHolding.Surplus < r.SendMax {
+			var surplus int64
+			if sendHolding != nil {
+				surplus = sendHolding.Surplus
+			}
+			net.Errorf(w, http.StatusConflict, "send_max %d exceeds the surplus of %s, %d", r.SendMax, r.SendAsset, surplus)
+			return
+		}
+		if destHolding == nil || !destHolding.Trusted {
+			net.Errorf(w, http.StatusConflict, "the custodian account has no trustline to %s", r.DestAsset)
+			return
+		}
+
+		sg, err := rebalanceSigning(r, sc.account, send)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		ok, err := c.checkSigningPolicy(ctx, sg)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if !ok {
+			net.Errorf(w, http.StatusConflict, "rebalance %x is held by the signing policy; resubmit it once approved", sg.ID)
+			return
+		}
+
+		tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		defer cancel()
+		succ, err := sc.seqs.SubmitContext(tctx, sc.account, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return sc.rebalanceTx(seqnum, send, r.SendMax, dest, r.DestAmount, path)
+		}, sc.seed)
+		if err != nil {
+			net.Errorf(w, http.StatusBadGateway, "submitting rebalance: %s", err)
+			return
+		}
+		resp.TxHash = succ.Hash
+		hash, err := hex.DecodeString(succ.Hash)
+		if err == nil {
+			// Rekeyed by its tx, the check counts toward the day's totals
+			// but does not pass the same request again.
+			_, err = c.DB.ExecContext(ctx, `UPDATE policy_checks SET txid=$1 WHERE txid=$2`, hash, sg.ID)
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "spending policy check of rebalance %x: %s", sg.ID, err)
+			return
+		}
+		detail := fmt.Sprintf("at most %d %s for %d %s in tx %s: %s", r.SendMax, r.SendAsset, r.DestAmount, r.DestAsset, succ.Hash, r.Note)
+		err = c.recordAudit(ctx, "rebalance", "admin-api "+req.RemoteAddr, detail)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if c.exports != nil {
+			c.exports.Broadcast()
+		}
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "rebalance supports GET and POST")
+		return
+	}
+
+	var err error
+	resp.Holdings, err = c.reserveHoldings(ctx, sc)
+	if err != nil {
+		net.Errorf(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,134 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), int64(10*xlm.Lumen))
+	usd := "USD:" + issuerKP.Address()
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Admin.PauseFile = ""
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, $3, $4, 1, $5)`, []byte("nonce"), int64(6*xlm.Lumen), nativeXDR, testRecipPubKey, pegInPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebalance := func(method, body string, wantCode int) rebalanceResp {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.Rebalance(w, httptest.NewRequest(method, "/admin/rebalance", strings.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("got status %d from %s %s, want %d: %s", w.Code, method, body, wantCode, w.Body)
+			}
+			var resp rebalanceResp
+			if w.Code == http.StatusOK {
+				err := json.Unmarshal(w.Body.Bytes(), &resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return resp
+		}
+
+		// 10 lumens less the 1-lumen account reserve, 6 of them owed.
+		resp := rebalance("GET", "", http.StatusOK)
+		if len(resp.Holdings) != 1 {
+			t.Fatalf("got holdings %+v, want only lumens", resp.Holdings)
+		}
+		if h := resp.Holdings[0]; h.Asset != "native" || h.Held != int64(9*xlm.Lumen) || h.Owed != int64(6*xlm.Lumen) || h.Surplus != int64(3*xlm.Lumen) || !h.Trusted {
+			t.Errorf("got lumen holding %+v, want 9 held, 6 owed, 3 surplus", h)
+		}
+
+		// A deposit awaiting refund is owed too, until it is paid.
+		_, err = db.Exec(`INSERT INTO deposit_refunds (deposit_txid, op_index, asset_xdr, nonce_hash, sender, amount, reason, deposit_cursor, state) VALUES ('deposit', 0, $1, x'', $2, $3, 'expired', '', $4)`, nativeXDR, issuerKP.Address(), int64(xlm.Lumen), refundWaiting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = rebalance("GET", "", http.StatusOK)
+		if h := resp.Holdings[0]; h.Owed != int64(7*xlm.Lumen) || h.Surplus != int64(2*xlm.Lumen) {
+			t.Errorf("got lumen holding %+v with a refund waiting, want 7 owed, 2 surplus", h)
+		}
+		_, err = db.Exec(`UPDATE deposit_refunds SET state=$1`, refundPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := func(sendMax, destAmount int64) string {
+			b, err := json.Marshal(rebalanceRequest{SendAsset: "native", SendMax: sendMax, DestAsset: usd, DestAmount: destAmount})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(b)
+		}
+		rebalance("POST", body(int64(xlm.Lumen), 1), http.StatusNotFound)
+		cfg.Rebalance.Enabled = true
+		rebalance("POST", body(0, 1), http.StatusBadRequest)
+		rebalance("POST", body(int64(4*xlm.Lumen), 1), http.StatusConflict) // over the surplus
+		rebalance("POST", body(int64(xlm.Lumen), 1), http.StatusConflict)   // no trustline
+
+		// The oracle bounds the price paid.
+		cfg.Oracle.Currency = usd
+		cfg.Oracle.Source = "static"
+		cfg.Oracle.Rates = []string{"native=0.1"}
+		rebalance("POST", body(int64(3*xlm.Lumen), 1000000), http.StatusBadRequest)
+
+		sc := c.chain.(*stellarChain)
+		dest, err := stellar.ParseAssetKey(usd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := sc.rebalanceTx(7, stellar.NativeAsset(), int64(xlm.Lumen), dest, 1000000, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tx.Ops) != 1 {
+			t.Fatalf("got operations %+v, want one path payment", tx.Ops)
+		}
+		pp, ok := tx.Ops[0].(stellar.PathPayment)
+		if !ok {
+			t.Fatalf("got operations %+v, want one path payment", tx.Ops)
+		}
+		if pp.Destination != custKP.Address() || pp.SendMax != int64(xlm.Lumen) || pp.DestAmount != 1000000 || pp.DestAsset != dest {
+			t.Errorf("got path payment %+v, want at most 1 lumen for 0.1 USD to the custodian", pp)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// regional returns the stellar.Regional the custodian's Horizon client
+// sends its requests through, or nil if it has a single Horizon server.
+func (s *stellarChain) regional() *stellar.Regional {
+	hc, ok := s.hclient.(*stellar.HorizonClient)
+	if !ok {
+		return nil
+	}
+	r, _ := hc.HTTP.(*stellar.Regional)
+	return r
+}
+
+// probeHorizon runs as a goroutine,
+// probing the Horizon endpoints every horizon.probe_interval
+// until ctx is canceled.
+func (c *Custodian) probeHorizon(ctx context.Context, r *stellar.Regional) {
+	defer log.Print("probeHorizon exiting")
+
+	interval := 30 * time.Second
+	if cfg := c.config(); cfg != nil && cfg.Horizon.ProbeInterval > 0 {
+		interval = time.Duration(cfg.Horizon.ProbeInterval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		r.Probe(pctx)
+		cancel()
+	}
+}
+
+// writeHorizonMetrics writes the latency of each Horizon endpoint
+// and which is selected, if there are several.
+func (c *Custodian) writeHorizonMetrics(w io.Writer) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return
+	}
+	r := sc.regional()
+	if r == nil {
+		return
+	}
+	latencies := r.Latencies()
+	endpoints := make([]stellar.Endpoint, 0, len(latencies))
+	for e := range latencies {
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].URL < endpoints[j].URL })
+	current := r.Current()
+
+	fmt.Fprint(w, "# HELP slidechain_horizon_latency_seconds Latency of the last probe of each Horizon endpoint; -1 if it failed.\n# TYPE slidechain_horizon_latency_seconds gauge\n")
+	for _, e := range endpoints {
+		v := latencies[e].Seconds()
+		if latencies[e] < 0 {
+			v = -1
+		}
+		fmt.Fprintf(w, "slidechain_horizon_latency_seconds{region=%q,url=%q} %g\n", e.Region, e.URL, v)
+	}
+	fmt.Fprint(w, "# HELP slidechain_horizon_selected Whether the custodian is using each Horizon endpoint.\n# TYPE slidechain_horizon_selected gauge\n")
+	for _, e := range endpoints {
+		var v int
+		if e == current {
+			v = 1
+		}
+		fmt.Fprintf(w, "slidechain_horizon_selected{region=%q,url=%q} %d\n", e.Region, e.URL, v)
+	}
+}
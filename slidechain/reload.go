@@ -0,0 +1,113 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// Reload applies the reloadable settings of cfg to the running custodian,
+// recording an audit entry for each one that changed.
+// Changes to other settings are logged and ignored;
+// they take effect only on restart.
+// Source identifies what triggered the reload.
+// It returns the changes that were applied.
+func (c *Custodian) Reload(ctx context.Context, cfg *config.Config, source string) ([]config.Change, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	c.cfgMu.Lock()
+	defer c.cfgMu.Unlock()
+
+	var applied []config.Change
+	for _, ch := range config.Changes(c.cfg, cfg) {
+		if !ch.Reloadable {
+			log.Printf("ignoring change to %s on reload: requires restart", ch.Key)
+			continue
+		}
+		applied = append(applied, ch)
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	next := *c.cfg
+	config.ApplyReloadable(&next, cfg)
+	for _, ch := range applied {
+		err = c.recordAudit(ctx, "config.reload", source, ch.String())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("reloaded %s (from %s)", ch, source)
+	}
+	c.applyDynamic(&next)
+	c.cfg = &next
+	return applied, nil
+}
+
+// applyDynamic puts the reloadable settings of cfg into effect.
+func (c *Custodian) applyDynamic(cfg *config.Config) {
+	setLogLevel(cfg.Log.Level)
+	for tier, l := range c.limiters {
+		rate, burst, _ := tierLimits(cfg.RateLimit, apiTier(tier))
+		l.SetLimit(rate, burst)
+	}
+	if c.S != nil && c.S.fees != nil {
+		c.S.fees.setStrategy(cfg.Fees)
+	}
+}
+
+// config returns the custodian's current configuration.
+// It must not be modified.
+func (c *Custodian) config() *config.Config {
+	c.cfgMu.Lock()
+	defer c.cfgMu.Unlock()
+	return c.cfg
+}
+
+// EffectiveConfig is the admin handler for /admin/config,
+// serving the custodian's current configuration, as last reloaded,
+// in TOML form with secrets redacted.
+func (c *Custodian) EffectiveConfig(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if cfg == nil {
+		net.Errorf(w, http.StatusNotFound, "custodian has no config")
+		return
+	}
+	var buf bytes.Buffer
+	err := cfg.WriteEffective(&buf)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "writing config: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// assetAllowed reports whether the asset may be pegged in
+// under the current asset allowlist.
+func (c *Custodian) assetAllowed(assetXDR []byte) (bool, error) {
+	cfg := c.config()
+	if cfg == nil || len(cfg.Assets.Allowlist) == 0 {
+		return true, nil
+	}
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return false, errors.Wrap(err, "unmarshaling asset xdr")
+	}
+	for _, a := range cfg.Assets.Allowlist {
+		allowed, err := stellar.ParseAssetKey(a)
+		if err == nil && allowed == asset {
+			return true, nil
+		}
+	}
+	return false, nil
+}
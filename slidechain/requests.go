@@ -0,0 +1,121 @@
+package slidechain
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// maxRequestSkew is how far the timestamp of a signed request
+// may be from the custodian's clock.
+const maxRequestSkew = 10 * time.Minute
+
+var (
+	checkPubkey    = net.Base64(ed25519.PublicKeySize)
+	checkSignature = net.Base64(ed25519.SignatureSize)
+	checkStroops   = net.Int(1, math.MaxInt64)
+	checkTimeMS    = net.Int(1, math.MaxInt64)
+)
+
+// requestSchemas are the checks Validated makes of public API requests.
+// The SEP-31 and SEP-12 routes are left to their handlers,
+// since those SEPs specify their own form of errors.
+var requestSchemas = map[string]net.Schema{
+	"POST /prepegin": {Body: map[string]net.Check{
+		"bc_id":        net.Base64(32),
+		"amount":       checkStroops,
+		"asset_xdr":    net.Base64(0),
+		"recip_pubkey": checkPubkey,
+		"exp_ms":       checkTimeMS,
+	}},
+	"POST /deposit-nonce": {Body: map[string]net.Check{
+		"recip_pubkey": checkPubkey,
+		"asset_xdr":    net.Base64(0),
+		"amount":       checkStroops,
+	}},
+	"POST /deposit-account": {Body: map[string]net.Check{
+		"recip_pubkey": checkPubkey,
+	}},
+	"POST /notifications": {Body: map[string]net.Check{
+		"pubkey":    checkPubkey,
+		"time_ms":   checkTimeMS,
+		"signature": checkSignature,
+	}},
+	"POST /travel-rule": {Body: map[string]net.Check{
+		"txid":      net.Base64(32),
+		"pubkey":    checkPubkey,
+		"time_ms":   checkTimeMS,
+		"signature": checkSignature,
+	}},
+	"GET /kyc/accounts": {Query: map[string]net.Check{
+		"pubkey": net.Hex(ed25519.PublicKeySize),
+	}},
+	"POST /kyc/accounts": {Body: map[string]net.Check{
+		"pubkey": checkPubkey,
+	}},
+	"POST /exit-address": {Body: map[string]net.Check{
+		"pubkey":    checkPubkey,
+		"address":   net.StellarAccount,
+		"time_ms":   checkTimeMS,
+		"signature": checkSignature,
+	}},
+	"POST /export-template": {Body: map[string]net.Check{
+		"asset":        net.Asset,
+		"amount":       checkStroops,
+		"input_amount": checkStroops,
+		"anchor":       net.Base64(32),
+		"exporter":     checkPubkey,
+		"temp_addr":    net.StellarAccount,
+	}},
+	"POST /consolidation": {Body: map[string]net.Check{
+		"pubkey":    checkPubkey,
+		"time_ms":   checkTimeMS,
+		"signature": checkSignature,
+	}},
+	"POST /fraud": {Body: map[string]net.Check{
+		"tx": net.Base64(0),
+	}},
+	"GET /export-estimate": {Query: map[string]net.Check{
+		"asset":       net.Asset,
+		"amount":      checkStroops,
+		"destination": net.StellarAccount,
+	}},
+	"GET /export-status": {Query: map[string]net.Check{
+		"txid": net.Hex(32),
+	}},
+	"GET /proof": {Query: map[string]net.Check{
+		"txid": net.Hex(32),
+	}},
+	"GET /headers": {Query: map[string]net.Check{
+		"from": net.Optional(net.Int(1, math.MaxInt64)),
+	}},
+	"GET /accounts/": {Query: map[string]net.Check{
+		"asset":   net.Optional(net.Asset),
+		"from_ms": net.Optional(net.Int(0, math.MaxInt64)),
+		"to_ms":   net.Optional(net.Int(0, math.MaxInt64)),
+		"cursor":  net.Optional(net.Int(0, math.MaxInt64)),
+		"limit":   net.Optional(net.Int(1, maxHistoryLimit)),
+	}},
+}
+
+// Validated wraps h, a handler of the public API,
+// checking the amounts, keys, Stellar addresses, and assets in requests to it,
+// and replying to one with invalid fields with a net.Problem listing them.
+func Validated(h http.Handler) http.Handler {
+	return net.Validate(requestSchemas, h)
+}
+
+// checkRequestTime checks that timeMS, the timestamp in the named field
+// of a signed request, is within maxRequestSkew of the present,
+// which bounds how long the request can be replayed.
+// If not, it writes an error to w and returns false.
+func (c *Custodian) checkRequestTime(w http.ResponseWriter, name string, timeMS int64) bool {
+	if skew := time.Duration(c.nowMS()-timeMS) * time.Millisecond; skew > maxRequestSkew || skew < -maxRequestSkew {
+		net.Errorf(w, http.StatusBadRequest, "%s must be within %s of the present", name, maxRequestSkew)
+		return false
+	}
+	return true
+}
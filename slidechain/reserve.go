@@ -0,0 +1,436 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/op"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// The reverse peg moves assets issued on slidechain to Stellar,
+// as the wrapped assets registered in the wrapped_assets table.
+//
+// A wrapped export pays the exported value to the custodian's reserve,
+// txvm outputs locked by the custodian's key,
+// instead of retiring it.
+// Its peg-out pays the wrapped asset from the custodian account,
+// its issuer,
+// which issues it on Stellar.
+// If the peg-out fails, the value is refunded from the reserve.
+//
+// Paying the wrapped asset back to the custodian account in a peg-in
+// burns it,
+// and the import releases the value from the reserve to the recipient.
+//
+// The reserve invariant is that the outstanding Stellar supply
+// of each wrapped asset,
+// as recorded in wrapped_assets,
+// equals the reserve value backing it:
+// the reserve outputs of its txvm asset
+// not held for a wrapped export still being pegged out.
+// It is checked in the db transaction of every change to either.
+
+// reserveOutput is a txvm output in the custodian's reserve.
+type reserveOutput struct {
+	Anchor    []byte // of its value
+	TxvmAsset []byte
+	Amount    int64
+}
+
+// BuildWrapExportTx builds a txvm export tx for an asset issued on slidechain,
+// with txvm asset ID assetID,
+// to be pegged out as the wrapped asset,
+// the custodian-issued Stellar asset registered for it.
+// It pays `amount` of the asset to the custodian's reserve,
+// and the remaining input is output back to the original account.
+// The tempAddr, seqnum, bounds, and dest are those of the pre-export tx.
+func BuildWrapExportTx(wrapped stellar.Asset, assetID bc.Hash, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum stellar.SequenceNumber, bounds TimeBounds, dest Destination) (*bc.Tx, error) {
+	assetXDR, err := wrapped.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return buildExportTx(assetXDR, assetID, exportAmt, inputAmt, tempAddr, anchor, prv, seqnum, bounds, dest, ExportEscrow{}, true)
+}
+
+// wrappedAssetByXDR returns the registered wrapped asset
+// that is the Stellar asset assetXDR,
+// or nil if it is not one.
+func (c *Custodian) wrappedAssetByXDR(ctx context.Context, assetXDR []byte) (*wrappedAsset, error) {
+	if _, ok := c.chain.(*stellarChain); !ok {
+		return nil, nil
+	}
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil || asset.IsNative() {
+		return nil, nil
+	}
+	if asset.Issuer != c.AccountID {
+		return nil, nil
+	}
+	code := asset.Code
+	a := wrappedAsset{Code: code}
+	const q = `SELECT txvm_asset, name, description, decimals FROM wrapped_assets WHERE code=$1`
+	err = c.DB.QueryRowContext(ctx, q, code).Scan(&a.TxvmAsset, &a.Name, &a.Desc, &a.Decimals)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up wrapped asset %s", code)
+	}
+	return &a, nil
+}
+
+// recordWrapExport records the wrapped export in tx, if there is one,
+// with its reserve output,
+// and wakes the peg-out goroutine.
+func (c *Custodian) recordWrapExport(ctx context.Context, tx *bc.Tx) error {
+	if _, ok := c.chain.(*stellarChain); !ok {
+		return nil
+	}
+	info, r, err := wrapExportFromTx(tx, c.chain)
+	if err != nil {
+		log.Printf("skipping malformed wrapped export tx %x: %s", tx.ID.Bytes(), err)
+		return nil
+	}
+	if info == nil {
+		return nil
+	}
+	w, err := c.wrappedAssetByXDR(ctx, info.AssetXDR)
+	if err != nil {
+		return err
+	}
+	if w == nil || !bytes.Equal(w.TxvmAsset, r.TxvmAsset) {
+		log.Printf("skipping tx %x paying %d of txvm asset %x to the reserve: not an export of a wrapped asset", tx.ID.Bytes(), r.Amount, r.TxvmAsset)
+		return nil
+	}
+	err = c.insertExport(ctx, tx.ID.Bytes(), info, r)
+	if err != nil {
+		return err
+	}
+	log.Printf("recorded wrapped export: %d of txvm asset %x (Stellar %s) for %s in tx %x", info.Amount, r.TxvmAsset, w.Code, info.Exporter, tx.ID.Bytes())
+	c.exports.Broadcast()
+	return nil
+}
+
+// postPegOutWrapped finishes a wrapped export.
+// If its peg-out succeeded,
+// its reserve output now backs the wrapped asset issued on Stellar.
+// Otherwise the reserve output is refunded to the exporter.
+func (c *Custodian) postPegOutWrapped(ctx context.Context, w *wrappedAsset, txid []byte, peggedOut pegOutState, pubkey []byte) error {
+	r, err := c.exportReserve(ctx, txid)
+	if err != nil {
+		return err
+	}
+	var (
+		done   pegOutState
+		update func(*sql.Tx) error
+	)
+	if peggedOut == pegOutOK {
+		done = pegOutRetired
+		update = func(dbtx *sql.Tx) error {
+			_, err := dbtx.ExecContext(ctx, `UPDATE reserve SET export_txid=NULL WHERE anchor=$1`, r.Anchor)
+			if err != nil {
+				return errors.Wrapf(err, "releasing reserve output for export %x", txid)
+			}
+			return c.changeOutstanding(ctx, dbtx, w, r.Amount)
+		}
+	} else {
+		tx, err := c.buildRefundTx(r, pubkey)
+		if err != nil {
+			return errors.Wrap(err, "building refund tx")
+		}
+		err = c.submitAndWait(ctx, tx)
+		if err != nil {
+			return errors.Wrap(err, "submitting refund tx")
+		}
+		done = pegOutRefunded
+		update = func(dbtx *sql.Tx) error {
+			_, err := dbtx.ExecContext(ctx, `DELETE FROM reserve WHERE anchor=$1`, r.Anchor)
+			return errors.Wrapf(err, "deleting refunded reserve output for export %x", txid)
+		}
+	}
+	// TODO: As in doPostPegOut, a crash after a refund tx
+	// and before this leaves the db out of date.
+	ok, err := c.transitionPegOut(ctx, txid, peggedOut, done, update)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("export %x is no longer in state %s", txid, peggedOut)
+	}
+	return nil
+}
+
+func (c *Custodian) exportReserve(ctx context.Context, txid []byte) (*reserveOutput, error) {
+	var r reserveOutput
+	const q = `SELECT anchor, txvm_asset, amount FROM reserve WHERE export_txid=$1`
+	err := c.DB.QueryRowContext(ctx, q, txid).Scan(&r.Anchor, &r.TxvmAsset, &r.Amount)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading reserve output for export %x", txid)
+	}
+	return &r, nil
+}
+
+// doRelease imports a peg-in of a wrapped asset,
+// releasing its value from the reserve to the recipient.
+// The import tx consumes the peg-in's uniqueness token as usual,
+// retiring the value the import-issuance contract issues for it.
+// The amount, in stroops, is released in whole txvm units of the asset;
+// a peg-in that is not a whole number of them,
+// or that exceeds the reserve,
+// raises an alert and is left unimported.
+func (c *Custodian) doRelease(ctx context.Context, ic *issuanceContract, w *wrappedAsset, nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64) error {
+	units, err := FromStellarAmount(amount, w.Decimals)
+	if err != nil {
+		alerted, aerr := c.alerted(ctx, "precision", nonceHash)
+		if aerr != nil || alerted {
+			return aerr
+		}
+		return c.alert(ctx, "precision", nonceHash, fmt.Sprintf("peg-in %x of wrapped asset %s: %s", nonceHash, w.Code, err))
+	}
+	log.Printf("releasing from the reserve for peg-in with hash %x: %d of txvm asset %x (Stellar %s) for recipient %x", nonceHash, units, w.TxvmAsset, w.Code, recip)
+
+	var (
+		inputs []*reserveOutput
+		total  int64
+	)
+	const q = `SELECT anchor, amount FROM reserve WHERE txvm_asset=$1 AND export_txid IS NULL ORDER BY amount DESC`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, w.TxvmAsset, func(anchor []byte, amt int64) {
+		if total < units {
+			inputs = append(inputs, &reserveOutput{Anchor: anchor, TxvmAsset: w.TxvmAsset, Amount: amt})
+			total += amt
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading reserve")
+	}
+	if total < units {
+		alerted, err := c.alerted(ctx, "reserve-shortfall", nonceHash)
+		if err != nil || alerted {
+			return err
+		}
+		return c.alert(ctx, "reserve-shortfall", nonceHash, fmt.Sprintf("peg-in of %d of wrapped asset %s exceeds its reserve of %d", units, w.Code, total))
+	}
+
+	tx, err := c.buildReleaseTx(ic, inputs, amount, units, expMS, assetXDR, recip)
+	if err != nil {
+		return errors.Wrap(err, "building release tx")
+	}
+	var change *reserveOutput
+	for _, out := range tx.Outputs {
+		if r, _ := reserveFromOutput(tx, out); r != nil {
+			change = r
+		}
+	}
+	err = c.submitAndWait(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "submitting release tx")
+	}
+	ok, err := c.transitionPegIn(ctx, nonceHash, pegInPaid, pegInImported, func(dbtx *sql.Tx) error {
+		for _, r := range inputs {
+			_, err := dbtx.ExecContext(ctx, `DELETE FROM reserve WHERE anchor=$1`, r.Anchor)
+			if err != nil {
+				return errors.Wrap(err, "deleting spent reserve output")
+			}
+		}
+		if change != nil {
+			err := insertReserve(ctx, dbtx, change, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return c.changeOutstanding(ctx, dbtx, w, -units)
+	}, setImportTxID(ctx, nonceHash, tx.ID))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("peg-in %x is no longer in state %s", nonceHash, pegInPaid)
+	}
+	return nil
+}
+
+func insertReserve(ctx context.Context, dbtx *sql.Tx, r *reserveOutput, exportTxID []byte) error {
+	const q = `INSERT INTO reserve (anchor, txvm_asset, amount, export_txid) VALUES ($1, $2, $3, $4)`
+	_, err := dbtx.ExecContext(ctx, q, r.Anchor, r.TxvmAsset, r.Amount, exportTxID)
+	return errors.Wrapf(err, "recording reserve output %x", r.Anchor)
+}
+
+// changeOutstanding adds delta to the outstanding Stellar supply
+// of the wrapped asset
+// and checks the reserve invariant.
+func (c *Custodian) changeOutstanding(ctx context.Context, dbtx *sql.Tx, w *wrappedAsset, delta int64) error {
+	_, err := dbtx.ExecContext(ctx, `UPDATE wrapped_assets SET outstanding=outstanding+$1 WHERE code=$2`, delta, w.Code)
+	if err != nil {
+		return errors.Wrapf(err, "updating outstanding supply of %s", w.Code)
+	}
+	var outstanding, backing int64
+	err = dbtx.QueryRowContext(ctx, `SELECT outstanding FROM wrapped_assets WHERE code=$1`, w.Code).Scan(&outstanding)
+	if err != nil {
+		return errors.Wrapf(err, "reading outstanding supply of %s", w.Code)
+	}
+	const q = `SELECT COALESCE(SUM(amount), 0) FROM reserve WHERE txvm_asset=$1 AND export_txid IS NULL`
+	err = dbtx.QueryRowContext(ctx, q, w.TxvmAsset).Scan(&backing)
+	if err != nil {
+		return errors.Wrapf(err, "reading reserve of %s", w.Code)
+	}
+	if outstanding != backing {
+		return fmt.Errorf("reserve invariant violated: outstanding supply %d of %s, reserve %d", outstanding, w.Code, backing)
+	}
+	return nil
+}
+
+// spendReserve adds to b the spending of reserve output r.
+// It leaves the value on the contract stack,
+// above the deferred signature check for it.
+func spendReserve(b *txvmutil.Builder, r *reserveOutput) {
+	b.PushdataBytes(nil).Op(op.Put) // arg stack: spendrefdata
+	standard.SpendMultisig(b, 1, []ed25519.PublicKey{custodianPub}, r.Amount, bc.HashFromBytes(r.TxvmAsset), r.Anchor, standard.PayToMultisigSeed1[:])
+	b.Op(op.Get).Op(op.Get) // con stack: sigcheck, value
+}
+
+// signReserve adds to b the custodian's signature
+// satisfying the signature check on top of the contract stack
+// for spending reserve output r.
+func (c *Custodian) signReserve(b *txvmutil.Builder, txid [32]byte, r *reserveOutput) {
+	sigProg := standard.VerifyTxID(txid)
+	msg := append(sigProg, r.Anchor...)
+	b.PushdataBytes(ed25519.Sign(c.privkey, msg)).Op(op.Put)
+	b.PushdataBytes(sigProg).Op(op.Put)
+	b.Op(op.Call)
+}
+
+// payTo adds to b the payment of the value on top of the contract stack
+// to the given pubkey, with empty reference data.
+func payTo(b *txvmutil.Builder, pubkey ed25519.PublicKey) {
+	b.PushdataBytes(nil).Op(op.Put)                                                    // arg stack: refdata
+	b.Op(op.Put)                                                                       // arg stack: refdata, value
+	b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // arg stack: refdata, value, {pubkey}
+	b.PushdataInt64(1).Op(op.Put)                                                      // arg stack: refdata, value, {pubkey}, 1
+	b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)
+}
+
+// buildRefundTx builds the tx paying reserve output r
+// back to the exporter of a failed wrapped export.
+func (c *Custodian) buildRefundTx(r *reserveOutput, exporter ed25519.PublicKey) (*bc.Tx, error) {
+	b := new(txvmutil.Builder)
+	spendReserve(b, r)              // con stack: sigcheck, value
+	b.PushdataInt64(0).Op(op.Split) // con stack: sigcheck, value, zeroval
+	b.PushdataInt64(1).Op(op.Roll)  // con stack: sigcheck, zeroval, value
+	payTo(b, exporter)              // con stack: sigcheck, zeroval
+	b.Op(op.Finalize)               // con stack: sigcheck
+	vm, err := txvm.Validate(b.Build(), 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	c.signReserve(b, vm.TxID, r)
+	return newTx(b.Build())
+}
+
+// buildReleaseTx builds the import tx for a peg-in of a wrapped asset.
+// It consumes the peg-in's uniqueness token for amount stroops,
+// retires the import-issued value,
+// and pays units of the asset from the reserve inputs to the recipient,
+// with any change back to the reserve.
+func (c *Custodian) buildReleaseTx(ic *issuanceContract, inputs []*reserveOutput, amount, units, expMS int64, assetXDR, recip []byte) (*bc.Tx, error) {
+	// The uniqueness token, as in buildImportTx.
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+	snapshotNonceHash := txvm.VMHash("Split2", nonceHash[:])
+	b := new(txvmutil.Builder)
+	b.Tuple(func(contract *txvmutil.TupleBuilder) {
+		contract.PushdataByte(txvm.ContractCode)
+		contract.PushdataBytes(ic.createTokenSeed[:])
+		contract.PushdataBytes(ic.consumeTokenProg)
+		contract.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataByte(txvm.IntCode)
+			tup.PushdataInt64(1)
+		})
+		contract.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataByte(txvm.TupleCode)
+			tup.Tuple(func(pktup *txvmutil.TupleBuilder) { pktup.PushdataBytes(recip) })
+		})
+		contract.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataByte(txvm.ValueCode)
+			tup.PushdataInt64(0)
+			tup.PushdataBytes(zeroSeed[:])
+			tup.PushdataBytes(snapshotNonceHash[:])
+		})
+		contract.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataByte(txvm.IntCode)
+			tup.PushdataInt64(amount)
+		})
+		contract.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataByte(txvm.BytesCode)
+			tup.PushdataBytes(assetXDR)
+		})
+	})
+	b.Op(op.Input).Op(op.Put) // arg stack: consumeTokenContract
+	if ic.selector {
+		b.PushdataInt64(0).Op(op.Put) // arg stack: consumeTokenContract, 0
+	}
+	b.PushdataBytes(ic.prog).Op(op.Contract).Op(op.Call)             // arg stack: sigchecker, issuedval, {recip}, quorum
+	b.Op(op.Get).Op(op.Get).Op(op.Get).PushdataInt64(0).Op(op.Split) // con stack: quorum, {recip}, issuedval, zeroval
+	b.PushdataInt64(1).Op(op.Roll).Op(op.Retire)                     // con stack: quorum, {recip}, zeroval
+	for i, r := range inputs {
+		spendReserve(b, r) // con stack: quorum, {recip}, zeroval, sigcheck..., [value,] sigcheck, value
+		if i > 0 {
+			b.PushdataInt64(2).Op(op.Roll).Op(op.Merge) // con stack: quorum, {recip}, zeroval, sigcheck..., sigcheck, value
+		}
+	}
+	n := int64(len(inputs))
+	b.PushdataInt64(units).Op(op.Split) // con stack: quorum, {recip}, zeroval, sigcheck..., change, value
+	b.PushdataBytes(nil).Op(op.Put)     // arg stack: sigchecker, refdata
+	b.Op(op.Put)                        // arg stack: sigchecker, refdata, value
+	var total int64
+	for _, r := range inputs {
+		total += r.Amount
+	}
+	if total > units {
+		payTo(b, custodianPub) // con stack: quorum, {recip}, zeroval, sigcheck...
+	} else {
+		b.Op(op.Drop)
+	}
+	b.PushdataInt64(n + 1).Op(op.Roll).Op(op.Put)                            // arg stack: sigchecker, refdata, value, {recip}
+	b.PushdataInt64(n + 1).Op(op.Roll).Op(op.Put)                            // arg stack: sigchecker, refdata, value, {recip}, quorum
+	b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call) // con stack: zeroval, sigcheck...; arg stack: sigchecker
+	b.PushdataInt64(n).Op(op.Roll).Op(op.Finalize)                           // con stack: sigcheck...
+	vm, err := txvm.Validate(b.Build(), 3, math.MaxInt64, txvm.StopAfterFinalize)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing transaction ID")
+	}
+	b.Op(op.Get).PushdataBytes(ed25519.Sign(c.privkey, vm.TxID[:])).Op(op.Put).Op(op.Call) // check import sig
+	for i := len(inputs) - 1; i >= 0; i-- {
+		c.signReserve(b, vm.TxID, inputs[i])
+	}
+	return newTx(b.Build())
+}
+
+func newTx(prog []byte) (*bc.Tx, error) {
+	var runlimit int64
+	tx, err := bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	if err != nil {
+		return nil, errors.Wrap(err, "making tx")
+	}
+	tx.Runlimit = math.MaxInt64 - runlimit
+	return tx, nil
+}
+
+// submitAndWait submits tx and waits for it to hit txvm.
+func (c *Custodian) submitAndWait(ctx context.Context, tx *bc.Tx) error {
+	r, err := c.S.submitTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(c.S.waitOnTx(ctx, tx.ID, r), "waiting on tx to hit txvm")
+}
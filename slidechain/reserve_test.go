@@ -0,0 +1,208 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/asm"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestReversePeg(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 100 * time.Millisecond
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accountID := kp.Address()
+		c := &Custodian{
+			imports:       sync.NewCond(new(sync.Mutex)),
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			AccountID:     accountID,
+			chain:         newStellarChain(nil, accountID, kp.Seed(), ""),
+			cfg:           config.Default(),
+		}
+		submit := func(tx *bc.Tx) {
+			t.Helper()
+			err := c.submitAndWait(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkReserve := func(wantOutstanding, wantHeld int64) {
+			t.Helper()
+			var outstanding, held int64
+			err := db.QueryRow(`SELECT outstanding FROM wrapped_assets WHERE code='NAT'`).Scan(&outstanding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM reserve WHERE export_txid IS NOT NULL`).Scan(&held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outstanding != wantOutstanding || held != wantHeld {
+				t.Errorf("got outstanding supply %d and %d held for exports, want %d and %d", outstanding, held, wantOutstanding, wantHeld)
+			}
+		}
+
+		// Issue a slidechain-native asset to the exporter.
+		exporterPub, exporterPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issueProg := asm.MustAssemble("get 1000 'NAT' issue put")
+		seed := txvm.ContractSeed(issueProg)
+		assetID := bc.NewHash(txvm.AssetID(seed[:], []byte("NAT")))
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		issueTx, err := newTx(asm.MustAssemble(fmt.Sprintf(
+			"x'%x' %d nonce 0 split '' put put x'%x' contract call {x'%x'} put 1 put x'%x' contract call finalize",
+			c.InitBlockHash.Bytes(), expMS, issueProg, []byte(exporterPub), standard.PayToMultisigProg1,
+		)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(issueTx)
+		anchor := txresult.New(issueTx).Outputs[0].Value.Anchor
+
+		err = c.registerWrappedAsset(ctx, &wrappedAsset{Code: "NAT", TxvmAsset: assetID.Bytes(), Decimals: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped, err := stellar.NewAsset("NAT", kp.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrappedXDR, err := wrapped.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// wrapExport exports amount of the value with the given anchor,
+		// returning the export and the anchor of the change
+		// returned to the exporter.
+		wrapExport := func(amount, input int64, anchor []byte) (*pegOut, []byte) {
+			t.Helper()
+			temp, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, err := BuildWrapExportTx(wrapped, assetID, amount, input, temp.Address(), anchor, exporterPrv, 1, TimeBounds{}, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			submit(tx)
+			err = c.recordExports(ctx, &bc.Block{UnsignedBlock: &bc.UnsignedBlock{Transactions: []*bc.Tx{issueTx, tx}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p pegOut
+			const q = `SELECT txid, exporter, temp_addr, seqnum, anchor, pubkey FROM exports WHERE txid=$1`
+			err = db.QueryRow(q, tx.ID.Bytes()).Scan(&p.TxID, &p.Exporter, &p.TempAddr, &p.Seqnum, &p.Anchor, &p.Pubkey)
+			if err != nil {
+				t.Fatalf("wrapped export not recorded: %s", err)
+			}
+			var change []byte
+			for _, out := range txresult.New(tx).Outputs {
+				if len(out.Pubkeys) == 1 && bytes.Equal(out.Pubkeys[0], exporterPub) {
+					change = out.Value.Anchor
+				}
+			}
+			return &p, change
+		}
+		postPegOut := func(p *pegOut, amount int64, state pegOutState) {
+			t.Helper()
+			err := c.movePegOut(ctx, p.TxID, pegOutNotYet, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.AssetXDR, p.Amount, p.State = wrappedXDR, amount, state
+			err = c.doPostPegOut(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// pegIn pegs in amount of the wrapped asset
+		// and reports whether it was imported.
+		pegIn := func(amount int64) bool {
+			t.Helper()
+			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+			prepegTx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), wrappedXDR, testRecipPubKey, amount, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			submit(prepegTx)
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			_, err = db.Exec("INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, $3, $4, $5, $6)", nonceHash[:], amount, wrappedXDR, testRecipPubKey, expMS, pegInPaid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.importPending(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state pegInState
+			err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash[:]).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state == pegInImported
+		}
+
+		p, change := wrapExport(600, 1000, anchor)
+		checkReserve(0, 600)
+		postPegOut(p, 600, pegOutOK)
+		checkReserve(600, 0)
+
+		if !pegIn(250) {
+			t.Fatal("peg-in of 250 not imported")
+		}
+		checkReserve(350, 0)
+
+		if pegIn(1000) {
+			t.Error("peg-in exceeding the reserve was imported")
+		}
+		var alerts int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind='reserve-shortfall'`).Scan(&alerts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alerts != 1 {
+			t.Errorf("got %d reserve-shortfall alerts, want 1", alerts)
+		}
+
+		p, _ = wrapExport(400, 400, change)
+		checkReserve(350, 400)
+		postPegOut(p, 400, pegOutFail)
+		checkReserve(350, 0)
+		var state pegOutState
+		err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutRefunded {
+			t.Errorf("got failed wrapped export in state %s, want %s", state, pegOutRefunded)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// rollbackAlert is the kind of alert raised
+// when the chain is found to have been rewound.
+const rollbackAlert = "rollback"
+
+// A rollback records that the blocks above Height,
+// through at least LostHeight,
+// are no longer part of the chain,
+// as after a restore of the db from a backup.
+type rollback struct {
+	Height     uint64 `json:"height"`      // of the latest block kept
+	LostHeight uint64 `json:"lost_height"` // of the lost checkpointed block
+	LostID     string `json:"lost_id"`     // hex ID of the lost checkpointed block
+	TipMS      int64  `json:"tip_ms"`      // timestamp of the block at Height
+	TimeMS     int64  `json:"time_ms"`     // when the rollback was found
+}
+
+// detectRollback compares the chain with the checkpoint
+// anchored in the custodian account,
+// which survives a restore of the db.
+// If the checkpointed block is above the tip,
+// the chain has been rewound,
+// and detectRollback records a rollback to the tip and raises an alert.
+// A checkpointed block at or below the tip that is not on the chain
+// means the chain was rewound and rebuilt unnoticed,
+// and is an error.
+func (c *Custodian) detectRollback(ctx context.Context) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil
+	}
+	acct, err := sc.hclient.LoadAccount(sc.account)
+	if err != nil {
+		return errors.Wrap(err, "loading custodian account")
+	}
+	value, err := acct.GetData(checkpointDataName)
+	if err != nil {
+		return errors.Wrap(err, "decoding checkpoint")
+	}
+	if len(value) == 0 {
+		return nil
+	}
+	if len(value) != 40 {
+		return fmt.Errorf("checkpoint is %d bytes, want 40", len(value))
+	}
+	lostHeight := binary.BigEndian.Uint64(value)
+	lostID := value[8:]
+
+	var n int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM rollbacks WHERE lost_id=$1`, lostID).Scan(&n)
+	if err != nil {
+		return errors.Wrap(err, "reading rollbacks")
+	}
+	if n > 0 {
+		// Found already, and the chain has since been rebuilt past it.
+		return nil
+	}
+
+	height := c.S.chain.Height()
+	if lostHeight <= height {
+		b, err := c.S.chain.GetBlock(ctx, lostHeight)
+		if err != nil {
+			return errors.Wrapf(err, "getting checkpointed block %d", lostHeight)
+		}
+		if id := b.Hash(); !bytes.Equal(id.Bytes(), lostID) {
+			return fmt.Errorf("block %d is %x, not the checkpointed block %x", lostHeight, id.Bytes(), lostID)
+		}
+		return nil
+	}
+
+	tip, err := c.S.chain.GetBlock(ctx, height)
+	if err != nil {
+		return errors.Wrapf(err, "getting block %d", height)
+	}
+	r := rollback{
+		Height:     height,
+		LostHeight: lostHeight,
+		LostID:     hex.EncodeToString(lostID),
+		TipMS:      int64(tip.TimestampMs),
+		TimeMS:     c.nowMS(),
+	}
+	const q = `INSERT INTO rollbacks (height, lost_height, lost_id, tip_ms, time_ms) VALUES ($1, $2, $3, $4, $5)`
+	_, err = c.DB.ExecContext(ctx, q, r.Height, r.LostHeight, lostID, r.TipMS, r.TimeMS)
+	if err != nil {
+		return errors.Wrap(err, "recording rollback")
+	}
+	detail := fmt.Sprintf("the chain is at height %d, below checkpointed block %d (%s); the blocks above %d are invalidated", height, lostHeight, r.LostID, height)
+	log.Print(detail)
+	return c.alert(ctx, rollbackAlert, lostID, detail)
+}
+
+// rollbacks returns the recorded rollbacks, oldest first.
+func (c *Custodian) rollbacks(ctx context.Context) ([]rollback, error) {
+	const q = `SELECT height, lost_height, lost_id, tip_ms, time_ms FROM rollbacks ORDER BY time_ms`
+	rows, err := c.DB.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading rollbacks")
+	}
+	defer rows.Close()
+	var rs []rollback
+	for rows.Next() {
+		var (
+			r      rollback
+			lostID []byte
+		)
+		err = rows.Scan(&r.Height, &r.LostHeight, &lostID, &r.TipMS, &r.TimeMS)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning rollback")
+		}
+		r.LostID = hex.EncodeToString(lostID)
+		rs = append(rs, r)
+	}
+	return rs, errors.Wrap(rows.Err(), "reading rollbacks")
+}
+
+// rollbackFor returns the height to which a consumer must roll back
+// whose latest block is at height with the given ID,
+// or false if that block is still on the chain
+// or no recorded rollback explains its loss.
+// With a nil id, only a block above the tip counts as lost.
+func (c *Custodian) rollbackFor(ctx context.Context, height uint64, id []byte) (uint64, bool, error) {
+	if height <= c.S.chain.Height() {
+		if id == nil {
+			return 0, false, nil
+		}
+		b, err := c.S.chain.GetBlock(ctx, height)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "getting block %d", height)
+		}
+		if hash := b.Hash(); bytes.Equal(hash.Bytes(), id) {
+			return 0, false, nil
+		}
+	}
+	var to uint64
+	const q = `SELECT height FROM rollbacks WHERE height < $1 ORDER BY time_ms DESC LIMIT 1`
+	err := c.DB.QueryRowContext(ctx, q, height).Scan(&to)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "reading rollbacks")
+	}
+	return to, true, nil
+}
+
+// lostPegInCutoff returns the timestamp of the restore point
+// of the earliest rollback, or 0 if there has been none.
+// Peg-ins recorded after it were lost with the invalidated blocks,
+// so deposits after it that pay no recorded peg-in are refunded.
+func (c *Custodian) lostPegInCutoff(ctx context.Context) (int64, error) {
+	var tipMS int64
+	err := c.DB.QueryRowContext(ctx, `SELECT COALESCE(MIN(tip_ms), 0) FROM rollbacks`).Scan(&tipMS)
+	return tipMS, errors.Wrap(err, "reading rollbacks")
+}
+
+// Rollbacks is the handler for /rollbacks,
+// listing the recorded rollbacks as JSON, oldest first.
+func (c *Custodian) Rollbacks(w http.ResponseWriter, req *http.Request) {
+	rs, err := c.rollbacks(req.Context())
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if rs == nil {
+		rs = []rollback{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs)
+}
+
+// rolledBack reports whether any rollback has been recorded.
+func (c *Custodian) rolledBack(ctx context.Context) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM rollbacks`).Scan(&n)
+	return n > 0, errors.Wrap(err, "reading rollbacks")
+}
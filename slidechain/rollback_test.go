@@ -0,0 +1,198 @@
+package slidechain
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Checkpoint.Interval = config.Duration(time.Hour)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	// The chain reaches height 3, and its tip is checkpointed.
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			expMS := int64(bc.Millis(now.Add(time.Duration(i+1) * time.Minute)))
+			tx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), nil, testRecipPubKey, 1, expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.S.submitTx(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = c.checkpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Then the db is restored from a backup taken at height 1.
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Restarting finds no further rollback.
+		_, err = NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := c.rollbacks(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 || rs[0].Height != 1 || rs[0].LostHeight != 3 {
+			t.Fatalf("got rollbacks %+v, want one from height 3 to 1", rs)
+		}
+
+		// A subscriber that saw block 3 is told to roll back.
+		server := httptest.NewServer(http.HandlerFunc(c.Headers))
+		defer server.Close()
+		resp, err := http.Get(server.URL + "?from=4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		if !scanner.Scan() {
+			t.Fatalf("no first line: %v", scanner.Err())
+		}
+		var msg headerMsg
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Rollback != 1 || msg.Block != nil {
+			t.Errorf("got first line %s, want a rollback to height 1", scanner.Bytes())
+		}
+		// One whose latest block is still on the chain is not.
+		_, rolledBack, err := c.rollbackFor(ctx, 1, c.InitBlockHash.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rolledBack {
+			t.Error("got a rollback for the initial block")
+		}
+
+		// An export whose record was lost, but which was pegged out,
+		// is looked up rather than paid again.
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		amt := int64(xlm.Lumen)
+		tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amt, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &pegOut{
+			TxID:     []byte("resubmitted"),
+			AssetXDR: nativeXDR,
+			TempAddr: tempAddr,
+			Seqnum:   int64(seqnum),
+			Exporter: exporterKP.Address(),
+			Amount:   amt,
+			Anchor:   []byte{},
+			Pubkey:   []byte{},
+		}
+		_, err = c.chain.SubmitWithdrawal(ctx, p.withdrawal(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.insertExport(ctx, p.TxID, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Inject(horizonmock.EndpointSubmit, horizonmock.ServerError, -1)
+		_, err = c.pegOutPending(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.ClearFaults()
+		var state pegOutState
+		err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutOK {
+			t.Errorf("export is in state %s, want ok", state)
+		}
+
+		// A deposit after the restore point paying an unknown peg-in is refunded,
+		// and one before it is ignored as before.
+		for i, timeMS := range []int64{rs[0].TipMS - 1, rs[0].TipMS + 1} {
+			d := Deposit{
+				TxID:      string(rune('a' + i)),
+				NonceHash: []byte{byte(i)},
+				Asset:     nativeXDR,
+				Amount:    1,
+				Sender:    exporterKP.Address(),
+				TimeMS:    timeMS,
+			}
+			paid, err := c.payPegIn(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paid {
+				t.Errorf("deposit %d pays a peg-in", i)
+			}
+		}
+		var reason string
+		err = db.QueryRow(`SELECT reason FROM deposit_refunds WHERE deposit_txid='b'`).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "lost" {
+			t.Errorf("refund reason is %q, want lost", reason)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM deposit_refunds`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d refunds, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// exportColumns maps the columns of the exports table, aliased e,
+// to the fields of a pegOut.
+// Naming each field by taking its address
+// lets the compiler check the mapping,
+// and selecting exactly the mapped columns
+// keeps a query and its scan from falling out of step.
+var exportColumns = []struct {
+	name  string
+	field func(*pegOut) interface{}
+}{
+	{"e.txid", func(p *pegOut) interface{} { return &p.TxID }},
+	{"e.anchor", func(p *pegOut) interface{} { return &p.Anchor }},
+	{"e.pubkey", func(p *pegOut) interface{} { return &p.Pubkey }},
+	{"e.asset_xdr", func(p *pegOut) interface{} { return &p.AssetXDR }},
+	{"e.amount", func(p *pegOut) interface{} { return &p.Amount }},
+	{"e.seqnum", func(p *pegOut) interface{} { return &p.Seqnum }},
+	{"e.exporter", func(p *pegOut) interface{} { return &p.Exporter }},
+	{"e.temp_addr", func(p *pegOut) interface{} { return &p.TempAddr }},
+	{"e.pegged_out", func(p *pegOut) interface{} { return &p.State }},
+	{"e.fee_level", func(p *pegOut) interface{} { return &p.FeeLevel }},
+	{"e.min_time", func(p *pegOut) interface{} { return &p.MinTime }},
+	{"e.max_time", func(p *pegOut) interface{} { return &p.MaxTime }},
+	{"e.min_ledger", func(p *pegOut) interface{} { return &p.MinLedger }},
+	{"e.max_ledger", func(p *pegOut) interface{} { return &p.MaxLedger }},
+	{"e.min_seq_age", func(p *pegOut) interface{} { return &p.MinSeqAge }},
+	{"e.destination", func(p *pegOut) interface{} { return &p.Account }},
+	{"e.memo_type", func(p *pegOut) interface{} { return &p.MemoType }},
+	{"e.memo", func(p *pegOut) interface{} { return &p.Memo }},
+	{"e.federation", func(p *pegOut) interface{} { return &p.Federation }},
+	{"e.nettable", func(p *pegOut) interface{} { return &p.Nettable }},
+	{"e.issuance_version", func(p *pegOut) interface{} { return &p.IssuanceVersion }},
+	{"e.watcher", func(p *pegOut) interface{} { return &p.Watcher }},
+	{"e.challenge_ms", func(p *pegOut) interface{} { return &p.ChallengeMS }},
+	{"e.challenge_until_ms", func(p *pegOut) interface{} { return &p.ChallengeUntilMS }},
+	{"e.canceled_ms", func(p *pegOut) interface{} { return &p.CanceledMS }},
+}
+
+// pegInColumns maps the columns of the pegs table
+// to the fields of a pegIn.
+var pegInColumns = []struct {
+	name  string
+	field func(*pegIn) interface{}
+}{
+	{"nonce_hash", func(p *pegIn) interface{} { return &p.NonceHash }},
+	{"amount", func(p *pegIn) interface{} { return &p.Amount }},
+	{"asset_xdr", func(p *pegIn) interface{} { return &p.AssetXDR }},
+	{"recipient_pubkey", func(p *pegIn) interface{} { return &p.Recipient }},
+	{"nonce_expms", func(p *pegIn) interface{} { return &p.ExpMS }},
+	{"COALESCE(deposit_txid, '')", func(p *pegIn) interface{} { return &p.DepositTxID }},
+	{"deposit_op", func(p *pegIn) interface{} { return &p.DepositOp }},
+	{"issuance_version", func(p *pegIn) interface{} { return &p.IssuanceVersion }},
+}
+
+// A pegIn is a row of the pegs table
+// paid on Stellar and awaiting import.
+type pegIn struct {
+	NonceHash       []byte
+	Amount          int64
+	AssetXDR        []byte
+	Recipient       []byte
+	ExpMS           int64
+	DepositTxID     string
+	DepositOp       int
+	IssuanceVersion int
+}
+
+// queryExports returns the exports selected by q,
+// the FROM clause and any following ones of a query of the exports table aliased e,
+// with the given args.
+func (c *Custodian) queryExports(ctx context.Context, q string, args ...interface{}) ([]pegOut, error) {
+	names := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		names[i] = col.name
+	}
+	rows, err := c.DB.QueryContext(ctx, "SELECT "+strings.Join(names, ", ")+" "+q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying exports")
+	}
+	defer rows.Close()
+	var ps []pegOut
+	for rows.Next() {
+		var p pegOut
+		dest := make([]interface{}, len(exportColumns))
+		for i, col := range exportColumns {
+			dest[i] = col.field(&p)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning export")
+		}
+		ps = append(ps, p)
+	}
+	return ps, errors.Wrap(rows.Err(), "reading exports")
+}
+
+// pendingExports returns up to limit exports, all of them if limit is 0,
+// that have not been pegged out yet or are to be retried,
+// and are not part of a netting.
+func (c *Custodian) pendingExports(ctx context.Context, limit int) ([]pegOut, error) {
+	q := `FROM exports e WHERE e.pegged_out IN ($1, $2) AND e.txid NOT IN (SELECT txid FROM netted_exports)`
+	if limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return c.queryExports(ctx, q, pegOutNotYet, pegOutRetry)
+}
+
+// pendingImports returns up to limit peg-ins, all of them if limit is 0,
+// paid on Stellar and not yet imported.
+func (c *Custodian) pendingImports(ctx context.Context, limit int) ([]pegIn, error) {
+	names := make([]string, len(pegInColumns))
+	for i, col := range pegInColumns {
+		names[i] = col.name
+	}
+	q := "SELECT " + strings.Join(names, ", ") + " FROM pegs WHERE state=$1"
+	if limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := c.DB.QueryContext(ctx, q, pegInPaid)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying pegs")
+	}
+	defer rows.Close()
+	var ps []pegIn
+	for rows.Next() {
+		var p pegIn
+		dest := make([]interface{}, len(pegInColumns))
+		for i, col := range pegInColumns {
+			dest[i] = col.field(&p)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning peg")
+		}
+		ps = append(ps, p)
+	}
+	return ps, errors.Wrap(rows.Err(), "reading pegs")
+}
+
+// markSubmitted moves the export to the state for the result
+// of submitting its peg-out,
+// recording why Stellar rejected the submission, if it did,
+// in the same db transaction.
+// It updates p.State.
+func (c *Custodian) markSubmitted(ctx context.Context, p *pegOut, result WithdrawalResult, submitErr error) error {
+	return c.markPegOut(ctx, p, result.pegOutState(), submitErr)
+}
+
+// markFailed moves the export to pegOutFail,
+// recording why Stellar rejected its peg-out, if it did,
+// in the same db transaction.
+// It updates p.State.
+func (c *Custodian) markFailed(ctx context.Context, p *pegOut, reason error) error {
+	return c.markPegOut(ctx, p, pegOutFail, reason)
+}
+
+func (c *Custodian) markPegOut(ctx context.Context, p *pegOut, to pegOutState, submitErr error) error {
+	v, err := submitErrorValue(submitErr)
+	if err != nil {
+		return err
+	}
+	ok, err := c.transitionPegOut(ctx, p.TxID, p.State, to, func(dbtx *sql.Tx) error {
+		_, err := dbtx.ExecContext(ctx, `UPDATE exports SET submit_error=$1 WHERE txid=$2`, v, p.TxID)
+		return errors.Wrapf(err, "recording submit error of export %x", p.TxID)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("export %x is no longer in state %s", p.TxID, p.State)
+	}
+	p.State = to
+	return nil
+}
+
+// submitErrorValue is the submit_error column value for err:
+// the JSON of the Stellar rejection it is, or NULL if it is none.
+func submitErrorValue(err error) (interface{}, error) {
+	se := stellar.ParseSubmitError(err)
+	if se == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(se)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling submit error")
+	}
+	return string(b), nil
+}
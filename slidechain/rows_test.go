@@ -0,0 +1,121 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestExportRows(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db}
+		var ps []*pegOut
+		for i := byte(1); i <= 3; i++ {
+			p := &pegOut{
+				TxID:        bytes.Repeat([]byte{i}, 32),
+				AssetXDR:    []byte{i},
+				TempAddr:    "temp",
+				Seqnum:      int64(i),
+				Exporter:    "exporter",
+				Amount:      10 * int64(i),
+				Anchor:      []byte{i, 1},
+				Pubkey:      []byte{i, 2},
+				TimeBounds:  TimeBounds{MinTime: 1, MaxTime: 2, MinLedger: 3, MaxLedger: 4, MinSeqAge: 5},
+				Destination: Destination{Account: "payee", MemoType: "id", Memo: "7"},
+				Nettable:    true,
+			}
+			err = c.insertExport(ctx, p.TxID, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps = append(ps, p)
+		}
+		_, err = db.Exec(`UPDATE exports SET fee_level=2, issuance_version=3 WHERE txid=$1`, ps[0].TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO netted_exports (txid, netting) VALUES ($1, 1)`, ps[2].TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pending, err := c.pendingExports(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 2 {
+			t.Fatalf("got %d pending exports, want 2, leaving out the netted one", len(pending))
+		}
+		want := *ps[0]
+		want.FeeLevel, want.IssuanceVersion = 2, 3
+		if !reflect.DeepEqual(pending[0], want) {
+			t.Errorf("got export\n%+v\nwant\n%+v", pending[0], want)
+		}
+		pending, err = c.pendingExports(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 {
+			t.Errorf("got %d pending exports with limit 1", len(pending))
+		}
+
+		submitError := func(txid []byte) string {
+			t.Helper()
+			var s sql.NullString
+			err := db.QueryRow(`SELECT submit_error FROM exports WHERE txid=$1`, txid).Scan(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s.String
+		}
+		herr := &stellar.HorizonError{Problem: stellar.Problem{Status: http.StatusBadRequest, Extras: map[string]json.RawMessage{
+			"result_codes": json.RawMessage(`{"transaction": "tx_failed", "operations": ["op_no_trust", "op_success"]}`),
+		}}}
+
+		p := &pending[0]
+		err = c.markSubmitted(ctx, p, WithdrawalPending, errors.New("timeout"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.State != pegOutRetry {
+			t.Errorf("got state %s after a pending result, want %s", p.State, pegOutRetry)
+		}
+		if s := submitError(p.TxID); s != "" {
+			t.Errorf("recorded submit error %s for a timeout", s)
+		}
+		err = c.markFailed(ctx, p, errors.Wrap(herr, "submitting peg-out tx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.State != pegOutFail {
+			t.Errorf("got state %s after failing, want %s", p.State, pegOutFail)
+		}
+		if s := submitError(p.TxID); s == "" {
+			t.Error("recorded no submit error for a rejection")
+		}
+		err = c.markSubmitted(ctx, p, WithdrawalApplied, nil)
+		if err == nil {
+			t.Error("moved a failed export to ok")
+		}
+
+		pending, err = c.pendingExports(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 || !bytes.Equal(pending[0].TxID, ps[1].TxID) {
+			t.Errorf("got %d pending exports after failing one, want only %x", len(pending), ps[1].TxID)
+		}
+	})
+}
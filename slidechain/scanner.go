@@ -0,0 +1,288 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// exportScanPin is the pin of the export scanner,
+// the height of the last block it has scanned for exports.
+const exportScanPin = "watchExports"
+
+// exportScanPoll is how often the export scanner
+// looks for blocks saved by another process.
+const exportScanPoll = time.Second
+
+// Runs as a goroutine,
+// scanning each block the custodian commits for exports.
+func (c *Custodian) watchExports(ctx context.Context) {
+	defer log.Println("watchExports exiting")
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		r := c.S.w.Reader()
+		for {
+			_, ok := r.Read(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	err := c.scanExports(ctx, wake)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// scanExports runs the export scanner until ctx is canceled.
+// On each wakeup, and every exportScanPoll,
+// it applies any rewind requested by rewindExportScan
+// and records the exports in the blocks in the db after its pin,
+// passing over those with no export marker.
+// It reads blocks only from the db,
+// so it can follow the blocks saved by a slidechaind in another process.
+func (c *Custodian) scanExports(ctx context.Context, wake <-chan struct{}) error {
+	ticker := time.NewTicker(exportScanPoll)
+	defer ticker.Stop()
+
+	for {
+		err := c.scanExportsPass(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanExportsPass is one pass of the export scanner.
+func (c *Custodian) scanExportsPass(ctx context.Context) error {
+	err := c.applyPinRewind(ctx, exportScanPin)
+	if err != nil {
+		return err
+	}
+	_, err = c.catchUpPin(ctx, exportScanPin, markExport, c.recordExports)
+	return errors.Wrap(err, "scanning for exports")
+}
+
+// ScanExports runs the export scanner of the custodian
+// whose db and config these are until ctx is canceled.
+// It is for a process of its own,
+// leaving the custodian's slidechaind,
+// configured with pegout.scanner = "external",
+// to build blocks and peg out the exports it records.
+func ScanExports(ctx context.Context, db *sql.DB, cfg *config.Config) error {
+	if cfg.PegOut.Scanner != "external" {
+		return fmt.Errorf("pegout.scanner is %q; scan exports in a separate process only with \"external\"", cfg.PegOut.Scanner)
+	}
+	err := setSchema(db)
+	if err != nil {
+		return errors.Wrap(err, "setting db schema")
+	}
+	c := &Custodian{
+		DB:      db,
+		exports: sync.NewCond(new(sync.Mutex)),
+		cfg:     cfg,
+	}
+	// The main chain here only validates the withdrawals of exports.
+	// Paying them is left to slidechaind,
+	// so this one has no account.
+	if cfg.EVM.RPCURL != "" {
+		c.chain, err = newEVMChain(cfg.EVM)
+		if err != nil {
+			return errors.Wrap(err, "configuring EVM chain")
+		}
+	} else {
+		c.chain = newStellarChain(horizonClient(cfg.Horizon), "", "", "")
+	}
+	log.Print("scanning for exports")
+	return c.scanExports(ctx, nil)
+}
+
+// pollExports runs as a goroutine under pegout.scanner = "external",
+// waking the peg-out workers
+// when the scan-exports process records exports.
+func (c *Custodian) pollExports(ctx context.Context) {
+	defer log.Println("pollExports exiting")
+
+	ticker := time.NewTicker(exportScanPoll)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var latest sql.NullInt64
+		err := c.DB.QueryRowContext(ctx, `SELECT MAX(rowid) FROM exports`).Scan(&latest)
+		if err != nil {
+			log.Printf("error polling for exports: %s", err)
+			continue
+		}
+		if latest.Int64 != last {
+			last = latest.Int64
+			c.exports.Broadcast()
+		}
+	}
+}
+
+// exportRecorded tells whether the export in the tx with the given ID
+// is already recorded,
+// as when its block is scanned again after a rewind.
+func (c *Custodian) exportRecorded(ctx context.Context, txid []byte) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM exports WHERE txid=$1`, txid).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking for export tx %x", txid)
+	}
+	return n > 0, nil
+}
+
+// rewindExportScan has the export scanner
+// scan the blocks after height for exports again
+// at the start of its next pass,
+// recording any export it missed.
+// Exports already recorded are left as they are.
+// The blocks after height must still be in the db.
+func (c *Custodian) rewindExportScan(ctx context.Context, height uint64) error {
+	var tip uint64
+	err := c.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(height), 0) FROM blocks`).Scan(&tip)
+	if err != nil {
+		return errors.Wrap(err, "getting the latest block")
+	}
+	if height > tip {
+		return fmt.Errorf("height %d is after the latest block, %d", height, tip)
+	}
+	if height < tip {
+		var n int
+		err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM blocks WHERE height=$1`, height+1).Scan(&n)
+		if err != nil {
+			return errors.Wrapf(err, "checking for block %d", height+1)
+		}
+		if n == 0 {
+			return fmt.Errorf("block %d has expired from the db", height+1)
+		}
+	}
+	_, err = c.DB.ExecContext(ctx, `INSERT OR REPLACE INTO pin_rewinds (name, height) VALUES ($1, $2)`, exportScanPin, height)
+	return errors.Wrapf(err, "requesting rewind of pin %s to %d", exportScanPin, height)
+}
+
+// applyPinRewind sets the named pin to the height of its pending rewind,
+// if it has one, and removes the rewind.
+// It is called by the pin's only writer, between blocks,
+// so that no update of the pin for a block already being processed
+// can undo the rewind.
+func (c *Custodian) applyPinRewind(ctx context.Context, name string) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	var height uint64
+	err = dbtx.QueryRowContext(ctx, `SELECT height FROM pin_rewinds WHERE name=$1`, name).Scan(&height)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "getting rewind of pin %s", name)
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR REPLACE INTO pins (name, height) VALUES ($1, $2)`, name, height)
+	if err != nil {
+		return errors.Wrapf(err, "rewinding pin %s to %d", name, height)
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM pin_rewinds WHERE name=$1`, name)
+	if err != nil {
+		return errors.Wrapf(err, "removing rewind of pin %s", name)
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "committing rewind of pin %s", name)
+	}
+	log.Printf("rewound pin %s to height %d", name, height)
+	return nil
+}
+
+// exportScanResp is the response to /admin/export-scan.
+type exportScanResp struct {
+	Height uint64  `json:"height"`           // of the last block scanned
+	Tip    uint64  `json:"tip"`              // the latest block in the db
+	Rewind *uint64 `json:"rewind,omitempty"` // requested, not yet applied
+}
+
+// ExportScan is the handler for /admin/export-scan.
+// A GET reports the progress of the export scanner.
+// A POST with a height form value
+// rewinds the scanner to scan the blocks after it again.
+func (c *Custodian) ExportScan(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		height, err := strconv.ParseUint(req.FormValue("height"), 10, 64)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "height must be a block height")
+			return
+		}
+		err = c.rewindExportScan(ctx, height)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "rewinding export scanner: %s", err)
+			return
+		}
+		err = c.recordAudit(ctx, "rewind-export-scan", "admin-api "+req.RemoteAddr, fmt.Sprintf("to height %d", height))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "export-scan requires GET or POST")
+		return
+	}
+
+	var resp exportScanResp
+	err := c.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(height), 0) FROM blocks`).Scan(&resp.Tip)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "getting the latest block: %s", err)
+		return
+	}
+	err = c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name=$1`, exportScanPin).Scan(&resp.Height)
+	if err != nil && err != sql.ErrNoRows {
+		net.Errorf(w, http.StatusInternalServerError, "getting height of pin %s: %s", exportScanPin, err)
+		return
+	}
+	var rewind uint64
+	err = c.DB.QueryRowContext(ctx, `SELECT height FROM pin_rewinds WHERE name=$1`, exportScanPin).Scan(&rewind)
+	switch {
+	case err == nil:
+		resp.Rewind = &rewind
+	case err != sql.ErrNoRows:
+		net.Errorf(w, http.StatusInternalServerError, "getting rewind of pin %s: %s", exportScanPin, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
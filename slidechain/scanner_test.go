@@ -0,0 +1,130 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestExportScanRewind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{
+			exports:       sync.NewCond(new(sync.Mutex)),
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+			chain:         new(stellarChain),
+		}
+		// Block 4 has the export.
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		importTx := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		anchor := txvm.VMHash("Split1", importTx.Issuances[0].Anchor)
+		exportTx, err := BuildExportTx(ctx, native, 1, 10, 10, importTestAccountID, anchor[:], prv, 1, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, exportTx)
+
+		exportScan := func(method string, form url.Values) (int, exportScanResp) {
+			t.Helper()
+			req := httptest.NewRequest(method, "/admin/export-scan", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			c.ExportScan(w, req)
+			var resp exportScanResp
+			if w.Code == http.StatusOK {
+				err := json.Unmarshal(w.Body.Bytes(), &resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return w.Code, resp
+		}
+		scan := func() {
+			t.Helper()
+			err := c.scanExportsPass(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		counts := func() (exports, events int) {
+			t.Helper()
+			err := db.QueryRow(`SELECT COUNT(*) FROM exports WHERE txid=$1`, exportTx.ID.Bytes()).Scan(&exports)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.QueryRow(`SELECT COUNT(*) FROM state_events WHERE kind='export' AND key=$1`, exportTx.ID.Bytes()).Scan(&events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return exports, events
+		}
+
+		scan()
+		if n, _ := counts(); n != 1 {
+			t.Fatalf("recorded the export %d times, want once", n)
+		}
+		code, resp := exportScan("GET", nil)
+		if code != http.StatusOK || resp.Height != 4 || resp.Tip != 4 || resp.Rewind != nil {
+			t.Errorf("got status %d, %+v, want scanner at height 4 of 4", code, resp)
+		}
+		if code, _ := exportScan("POST", url.Values{"height": {"5"}}); code != http.StatusBadRequest {
+			t.Errorf("got status %d rewinding past the tip, want %d", code, http.StatusBadRequest)
+		}
+
+		// An export missed by the scanner is recorded after a rewind;
+		// one already recorded is not recorded again.
+		_, err = db.Exec(`DELETE FROM exports`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, resp = exportScan("POST", url.Values{"height": {"2"}})
+		if code != http.StatusOK || resp.Rewind == nil || *resp.Rewind != 2 {
+			t.Fatalf("got status %d, %+v, want a pending rewind to 2", code, resp)
+		}
+		scan()
+		exports, events := counts()
+		if exports != 1 {
+			t.Fatalf("recorded the missed export %d times after a rewind, want once", exports)
+		}
+		code, resp = exportScan("POST", url.Values{"height": {"0"}})
+		if code != http.StatusOK {
+			t.Fatalf("got status %d rewinding to 0", code)
+		}
+		scan()
+		if n, m := counts(); n != 1 || m != events {
+			t.Errorf("got %d exports and %d state events after rescanning, want 1 and %d", n, m, events)
+		}
+		code, resp = exportScan("GET", nil)
+		if code != http.StatusOK || resp.Height != 4 || resp.Rewind != nil {
+			t.Errorf("got status %d, %+v, want scanner back at height 4", code, resp)
+		}
+	})
+}
@@ -1,5 +1,12 @@
 package slidechain
 
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
 const schema = `
 CREATE TABLE IF NOT EXISTS blocks (
   height INTEGER NOT NULL PRIMARY KEY,
@@ -17,17 +24,35 @@ CREATE TABLE IF NOT EXISTS pins (
   height INTEGER NOT NULL DEFAULT 0
 );
 
+CREATE TABLE IF NOT EXISTS pin_rewinds (
+  name TEXT NOT NULL PRIMARY KEY,
+  height INTEGER NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS pegs (
   nonce_hash BLOB NOT NULL,
   amount INTEGER,
   asset_xdr BLOB,
   recipient_pubkey BLOB NOT NULL,
-  imported INTEGER NOT NULL DEFAULT 0,
-  stellar_tx INTEGER NOT NULL DEFAULT 0,
   nonce_expms INTEGER NOT NULL,
+  state INTEGER NOT NULL DEFAULT 0 CHECK (state IN (0, 1, 2)),
+  deposit_txid TEXT,
+  deposit_cursor TEXT,
+  deposit_op INTEGER NOT NULL DEFAULT 0,
+  import_txid BLOB,
+  issuance_version INTEGER NOT NULL DEFAULT 1,
+  partner TEXT NOT NULL DEFAULT '',
   PRIMARY KEY (nonce_hash)
 );
 
+CREATE TABLE IF NOT EXISTS expired_pegs (
+  nonce_hash BLOB NOT NULL PRIMARY KEY,
+  recipient_pubkey BLOB NOT NULL,
+  nonce_expms INTEGER NOT NULL,
+  issuance_version INTEGER NOT NULL,
+  expired_ms INTEGER NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS exports (
   txid BLOB NOT NULL PRIMARY KEY,
   exporter TEXT NOT NULL,
@@ -35,13 +60,684 @@ CREATE TABLE IF NOT EXISTS exports (
   asset_xdr BLOB NOT NULL,
   temp_addr TEXT NOT NULL,
   seqnum INTEGER NOT NULL,
-  pegged_out INTEGER NOT NULL DEFAULT 0,
+  pegged_out INTEGER NOT NULL DEFAULT 0 CHECK (pegged_out BETWEEN 0 AND 5),
+  anchor BLOB NOT NULL,
+  pubkey BLOB NOT NULL,
+  fee_level INTEGER NOT NULL DEFAULT 0,
+  resubmitted_ms INTEGER NOT NULL DEFAULT 0,
+  stellar_tx_hash TEXT,
+  ledger INTEGER,
+  completed_ms INTEGER,
+  issuance_version INTEGER NOT NULL DEFAULT 1,
+  min_time INTEGER NOT NULL DEFAULT 0,
+  max_time INTEGER NOT NULL DEFAULT 0,
+  min_ledger INTEGER NOT NULL DEFAULT 0,
+  max_ledger INTEGER NOT NULL DEFAULT 0,
+  min_seq_age INTEGER NOT NULL DEFAULT 0,
+  submit_error TEXT,
+  destination TEXT NOT NULL DEFAULT '',
+  memo_type TEXT NOT NULL DEFAULT '',
+  memo TEXT NOT NULL DEFAULT '',
+  federation TEXT NOT NULL DEFAULT '',
+  nettable INTEGER NOT NULL DEFAULT 0,
+  watcher BLOB NOT NULL DEFAULT x'',
+  challenge_ms INTEGER NOT NULL DEFAULT 0,
+  challenge_until_ms INTEGER NOT NULL DEFAULT 0,
+  canceled_ms INTEGER NOT NULL DEFAULT 0,
+  partner TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS nettings (
+  id INTEGER NOT NULL PRIMARY KEY,
+  asset_xdr BLOB NOT NULL,
+  payee TEXT NOT NULL,
+  memo_type TEXT NOT NULL,
+  memo TEXT NOT NULL,
+  max_time INTEGER NOT NULL,
+  state INTEGER NOT NULL DEFAULT 0 CHECK (state IN (0, 1, 2)),
+  amount INTEGER NOT NULL DEFAULT 0,
+  seqnum INTEGER NOT NULL DEFAULT 0,
+  stellar_tx_hash TEXT,
+  created_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS netted_exports (
+  txid BLOB NOT NULL PRIMARY KEY,
+  netting INTEGER NOT NULL,
+  settled INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER NOT NULL PRIMARY KEY,
+  time_ms INTEGER NOT NULL,
+  action TEXT NOT NULL,
+  source TEXT NOT NULL,
+  detail TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS state_events (
+  id INTEGER NOT NULL PRIMARY KEY,
+  time_ms INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  key BLOB NOT NULL,
+  from_state TEXT NOT NULL,
+  to_state TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS alerts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  time_ms INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  key BLOB NOT NULL,
+  detail TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS wrapped_assets (
+  code TEXT NOT NULL PRIMARY KEY,
+  txvm_asset BLOB NOT NULL UNIQUE,
+  name TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  decimals INTEGER NOT NULL DEFAULT 7,
+  outstanding INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS reserve (
+  anchor BLOB NOT NULL PRIMARY KEY,
+  txvm_asset BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  export_txid BLOB
+);
+
+CREATE TABLE IF NOT EXISTS block_markers (
+  height INTEGER NOT NULL PRIMARY KEY,
+  markers INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS block_headers (
+  height INTEGER NOT NULL PRIMARY KEY,
+  bits BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS block_txs (
+  txid BLOB NOT NULL PRIMARY KEY,
+  height INTEGER NOT NULL,
+  position INTEGER NOT NULL,
+  witness_hash BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS utxos (
+  output_id BLOB NOT NULL PRIMARY KEY,
+  pubkeys BLOB NOT NULL,
+  quorum INTEGER NOT NULL,
+  txvm_asset BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  height INTEGER NOT NULL,
+  spent_height INTEGER,
+  anchor BLOB
+);
+
+CREATE TABLE IF NOT EXISTS account_balances (
+  pubkey BLOB NOT NULL,
+  txvm_asset BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  outputs INTEGER NOT NULL,
+  PRIMARY KEY (pubkey, txvm_asset)
+);
+
+CREATE TABLE IF NOT EXISTS exit_addresses (
+  pubkey BLOB NOT NULL PRIMARY KEY,
+  address TEXT NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deposit_nonces (
+  nonce_hash BLOB NOT NULL PRIMARY KEY,
+  recipient_pubkey BLOB NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  nonce_expms INTEGER NOT NULL,
+  created_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deposit_ops (
+  deposit_txid TEXT NOT NULL,
+  op_index INTEGER NOT NULL,
+  nonce_hash BLOB NOT NULL,
+  recorded_ms INTEGER NOT NULL,
+  PRIMARY KEY (deposit_txid, op_index)
+);
+
+CREATE TABLE IF NOT EXISTS peg_batches (
+  lead_nonce_hash BLOB NOT NULL,
+  payment INTEGER NOT NULL,
+  nonce_hash BLOB NOT NULL UNIQUE,
+  PRIMARY KEY (lead_nonce_hash, payment)
+);
+
+CREATE TABLE IF NOT EXISTS deposit_refunds (
+  deposit_txid TEXT NOT NULL,
+  op_index INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  nonce_hash BLOB NOT NULL,
+  sender TEXT NOT NULL,
+  amount INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  deposit_cursor TEXT NOT NULL,
+  state INTEGER NOT NULL,
+  submitted_ms INTEGER,
+  stellar_tx_hash TEXT,
+  error TEXT,
+  PRIMARY KEY (deposit_txid, op_index, asset_xdr)
+);
+
+CREATE TABLE IF NOT EXISTS consolidations (
+  pubkey BLOB NOT NULL PRIMARY KEY,
+  enabled INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS wind_down (
+  height INTEGER NOT NULL,
+  cursor TEXT NOT NULL,
+  skipped INTEGER NOT NULL,
+  started_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS exit_payouts (
+  pubkey BLOB NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  state INTEGER NOT NULL,
+  submitted_ms INTEGER,
+  stellar_tx_hash TEXT,
+  error TEXT,
+  PRIMARY KEY (pubkey, asset_xdr)
+);
+
+CREATE TABLE IF NOT EXISTS fraud_claims (
+  id INTEGER NOT NULL PRIMARY KEY,
+  time_ms INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  txid BLOB,
+  claimant TEXT NOT NULL,
+  detail TEXT NOT NULL,
+  valid INTEGER NOT NULL,
+  reason TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS peg_pauses (
+  id INTEGER NOT NULL PRIMARY KEY,
+  time_ms INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  resumed_ms INTEGER,
+  scope TEXT NOT NULL DEFAULT 'peg'
+);
+
+CREATE TABLE IF NOT EXISTS checkpoints (
+  height INTEGER NOT NULL PRIMARY KEY,
+  block_id BLOB NOT NULL,
+  stellar_txid TEXT NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rollbacks (
+  lost_id BLOB NOT NULL PRIMARY KEY,
+  lost_height INTEGER NOT NULL,
+  height INTEGER NOT NULL,
+  tip_ms INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deposit_accounts (
+  idx INTEGER NOT NULL PRIMARY KEY,
+  recipient_pubkey BLOB NOT NULL UNIQUE,
+  address TEXT UNIQUE,
+  cursor TEXT NOT NULL DEFAULT '',
+  created_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deposit_forwards (
+  deposit_txid TEXT NOT NULL,
+  op_index INTEGER NOT NULL,
+  address TEXT NOT NULL,
+  nonce_hash BLOB NOT NULL UNIQUE,
+  nonce_expms INTEGER NOT NULL,
+  forward_txid TEXT,
+  PRIMARY KEY (deposit_txid, op_index)
+);
+
+CREATE TABLE IF NOT EXISTS notify_subscriptions (
+  pubkey BLOB NOT NULL,
+  channel TEXT NOT NULL,
+  address TEXT NOT NULL,
+  events TEXT NOT NULL,
+  time_ms INTEGER NOT NULL,
+  PRIMARY KEY (pubkey, channel)
+);
+
+CREATE TABLE IF NOT EXISTS notify_cursor (
+  last_event INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS screenings (
+  kind TEXT NOT NULL,
+  key BLOB NOT NULL,
+  decision TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  time_ms INTEGER NOT NULL,
+  PRIMARY KEY (kind, key)
+);
+
+CREATE TABLE IF NOT EXISTS sep31_transactions (
+  id TEXT NOT NULL PRIMARY KEY,
+  sender TEXT NOT NULL,
+  nonce_hash BLOB NOT NULL UNIQUE,
+  nonce_expms INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  sender_id TEXT NOT NULL,
+  receiver_id TEXT NOT NULL,
+  callback TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT '',
+  created_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS peg_out_destinations (
+  address TEXT NOT NULL PRIMARY KEY,
+  list TEXT NOT NULL CHECK (list IN ('allow', 'deny')),
+  note TEXT NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS asset_caps (
+  asset_xdr BLOB NOT NULL PRIMARY KEY,
+  cap INTEGER NOT NULL CHECK (cap >= 0),
+  note TEXT NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS travel_rule (
+  txid BLOB NOT NULL PRIMARY KEY,
+  pubkey BLOB NOT NULL,
+  sealed BLOB NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authorization_holds (
+  txid BLOB NOT NULL PRIMARY KEY,
+  payee TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  held_ms INTEGER NOT NULL,
+  hook_ms INTEGER NOT NULL DEFAULT 0,
+  released_ms INTEGER NOT NULL DEFAULT 0,
+  authorized_ms INTEGER NOT NULL DEFAULT 0,
+  revoked_ms INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS memo_holds (
+  txid BLOB NOT NULL PRIMARY KEY,
+  payee TEXT NOT NULL,
+  held_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS supply_checks (
+  code TEXT NOT NULL,
+  time_ms INTEGER NOT NULL,
+  stellar INTEGER NOT NULL,
+  expected INTEGER NOT NULL,
+  PRIMARY KEY (code, time_ms)
+);
+
+CREATE TABLE IF NOT EXISTS wrapped_burns (
+  id INTEGER PRIMARY KEY,
+  code TEXT NOT NULL,
+  amount INTEGER NOT NULL,
+  txid BLOB NOT NULL,
+  time_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+  pubkey BLOB NOT NULL PRIMARY KEY,
+  tier TEXT NOT NULL,
+  reference TEXT NOT NULL,
+  updated_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sep12_customers (
+  pubkey BLOB NOT NULL PRIMARY KEY,
+  client TEXT NOT NULL,
+  sealed BLOB NOT NULL,
+  updated_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS kyc_usage (
+  direction TEXT NOT NULL,
+  key BLOB NOT NULL,
+  pubkey BLOB NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  value INTEGER,
+  time_ms INTEGER NOT NULL,
+  PRIMARY KEY (direction, key)
+);
+
+CREATE TABLE IF NOT EXISTS admin_actions (
+  id INTEGER NOT NULL PRIMARY KEY,
+  method TEXT NOT NULL,
+  uri TEXT NOT NULL,
+  body BLOB NOT NULL,
+  created_ms INTEGER NOT NULL,
+  expires_ms INTEGER NOT NULL,
+  proposer TEXT NOT NULL,
+  approver TEXT,
+  executed_ms INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  path TEXT NOT NULL,
+  key TEXT NOT NULL,
+  request_hash BLOB NOT NULL,
+  status INTEGER NOT NULL DEFAULT 0,
+  content_type TEXT NOT NULL DEFAULT '',
+  body BLOB,
+  created_ms INTEGER NOT NULL,
+  PRIMARY KEY (path, key)
+);
+
+CREATE TABLE IF NOT EXISTS table_stats (
+  name TEXT NOT NULL,
+  time_ms INTEGER NOT NULL,
+  rows INTEGER NOT NULL,
+  PRIMARY KEY (name, time_ms)
+);
+
+CREATE TABLE IF NOT EXISTS clawbacks (
+  id INTEGER PRIMARY KEY,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  detected_ms INTEGER NOT NULL,
+  nonce_hash BLOB,
+  recipient_pubkey BLOB,
+  policy TEXT NOT NULL,
+  clawed_back INTEGER NOT NULL DEFAULT 0,
+  txid BLOB
+);
+
+CREATE TABLE IF NOT EXISTS frozen (
+  pubkey BLOB NOT NULL,
+  txvm_asset BLOB NOT NULL,
+  reason TEXT NOT NULL,
+  clawback INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL,
+  PRIMARY KEY (pubkey, txvm_asset)
+);
+
+CREATE TABLE IF NOT EXISTS escrows (
+  id INTEGER PRIMARY KEY,
+  pubkey BLOB NOT NULL,
+  txvm_asset BLOB NOT NULL,
+  amount INTEGER NOT NULL,
   anchor BLOB NOT NULL,
-  pubkey BLOB NOT NULL
+  txid BLOB NOT NULL,
+  escrowed_ms INTEGER NOT NULL,
+  released_ms INTEGER,
+  release_txid BLOB
+);
+
+CREATE TABLE IF NOT EXISTS peg_latency (
+  day TEXT NOT NULL,
+  kind TEXT NOT NULL CHECK (kind IN ('import', 'export')),
+  samples INTEGER NOT NULL,
+  p50_ms INTEGER NOT NULL,
+  p90_ms INTEGER NOT NULL,
+  p99_ms INTEGER NOT NULL,
+  max_ms INTEGER NOT NULL,
+  PRIMARY KEY (day, kind)
+);
+
+CREATE TABLE IF NOT EXISTS tower (
+  cursor TEXT NOT NULL,
+  height INTEGER NOT NULL,
+  block_hash BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tower_deposits (
+  txid TEXT NOT NULL,
+  op_index INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL,
+  import_txid BLOB,
+  PRIMARY KEY (txid, op_index)
+);
+
+CREATE TABLE IF NOT EXISTS tower_imports (
+  txid BLOB NOT NULL,
+  input INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  recipient BLOB NOT NULL,
+  ref BLOB,
+  height INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL,
+  tx BLOB NOT NULL,
+  deposit_txid TEXT,
+  deposit_op INTEGER,
+  PRIMARY KEY (txid, input)
+);
+
+CREATE TABLE IF NOT EXISTS tower_exports (
+  txid BLOB NOT NULL PRIMARY KEY,
+  output_id BLOB,
+  refdata BLOB NOT NULL,
+  height INTEGER NOT NULL,
+  due_ms INTEGER NOT NULL,
+  spent_txid BLOB,
+  retired INTEGER NOT NULL DEFAULT 0,
+  resolved_ms INTEGER NOT NULL DEFAULT 0,
+  resolution TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS tower_evidence (
+  kind TEXT NOT NULL,
+  txid BLOB NOT NULL,
+  time_ms INTEGER NOT NULL,
+  evidence BLOB NOT NULL,
+  PRIMARY KEY (kind, txid)
 );
 
+CREATE TABLE IF NOT EXISTS partner_fees (
+  kind TEXT NOT NULL,
+  key BLOB NOT NULL,
+  partner TEXT NOT NULL,
+  schedule TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  bps INTEGER NOT NULL,
+  fee INTEGER NOT NULL,
+  time_ms INTEGER NOT NULL,
+  PRIMARY KEY (kind, key)
+);
+
+CREATE TABLE IF NOT EXISTS signing_policies (
+  version INTEGER NOT NULL PRIMARY KEY,
+  policy TEXT NOT NULL,
+  source TEXT NOT NULL,
+  created_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS policy_checks (
+  txid BLOB NOT NULL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  version INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  decision TEXT NOT NULL,
+  violations TEXT NOT NULL,
+  checked_ms INTEGER NOT NULL,
+  decided_ms INTEGER NOT NULL DEFAULT 0,
+  approver TEXT NOT NULL DEFAULT ''
+);
+
+CREATE VIEW IF NOT EXISTS events AS
+  SELECT id, time_ms, kind, key, from_state, to_state,
+    CASE kind || ':' || to_state
+      WHEN 'peg-in:recorded' THEN 'peg_in_recorded'
+      WHEN 'peg-in:paid' THEN 'deposit_detected'
+      WHEN 'peg-in:imported' THEN 'issuance_built'
+      WHEN 'peg-in:expired' THEN 'intent_expired'
+      WHEN 'export:not-yet' THEN 'retirement_detected'
+      WHEN 'export:ok' THEN 'pegout_submitted'
+      WHEN 'export:retry' THEN 'pegout_retried'
+      WHEN 'export:fail' THEN 'pegout_failed'
+      WHEN 'export:retired' THEN 'pegout_retired'
+      WHEN 'export:refunded' THEN 'export_refunded'
+    END AS name
+  FROM state_events;
+
 CREATE TABLE IF NOT EXISTS custodian (
   seed TEXT NOT NULL PRIMARY KEY,
   cursor TEXT NOT NULL DEFAULT ''
 );
 `
+
+// migrateSchema updates a db created with an earlier schema.
+// Pegs used to record their state in two flags,
+// stellar_tx and imported,
+// and did not record their deposit and import txids or deposit op,
+// pegs and exports had no issuance version or partner,
+// exports had no fee level, resubmission time, peg-out tx, destination, or nettable flag,
+// wrapped assets had no outstanding supply,
+// and all peg pauses had the scope of fraud-claim pauses.
+func migrateSchema(db *sql.DB) error {
+	pegsCols, err := columns(db, "pegs")
+	if err != nil {
+		return err
+	}
+	if pegsCols["imported"] && !pegsCols["state"] {
+		_, err = db.Exec(`ALTER TABLE pegs ADD COLUMN state INTEGER NOT NULL DEFAULT 0 CHECK (state IN (0, 1, 2))`)
+		if err != nil {
+			return errors.Wrap(err, "adding pegs state column")
+		}
+		_, err = db.Exec(`UPDATE pegs SET state = CASE WHEN imported=1 THEN $1 WHEN stellar_tx=1 THEN $2 ELSE $3 END`, pegInImported, pegInPaid, pegInRecorded)
+		if err != nil {
+			return errors.Wrap(err, "setting pegs state from flags")
+		}
+	}
+
+	for _, col := range []string{"deposit_txid TEXT", "deposit_cursor TEXT", "deposit_op INTEGER NOT NULL DEFAULT 0", "import_txid BLOB", "issuance_version INTEGER NOT NULL DEFAULT 1", "partner TEXT NOT NULL DEFAULT ''"} {
+		if pegsCols[strings.Fields(col)[0]] {
+			continue
+		}
+		_, err = db.Exec(`ALTER TABLE pegs ADD COLUMN ` + col)
+		if err != nil {
+			return errors.Wrapf(err, "adding pegs %s column", col)
+		}
+	}
+
+	exportsCols, err := columns(db, "exports")
+	if err != nil {
+		return err
+	}
+	for _, col := range []string{"fee_level", "resubmitted_ms", "min_time", "max_time", "nettable", "challenge_ms", "challenge_until_ms", "canceled_ms", "min_ledger", "max_ledger", "min_seq_age"} {
+		if exportsCols[col] {
+			continue
+		}
+		_, err = db.Exec(`ALTER TABLE exports ADD COLUMN ` + col + ` INTEGER NOT NULL DEFAULT 0`)
+		if err != nil {
+			return errors.Wrapf(err, "adding exports %s column", col)
+		}
+	}
+	for _, col := range []string{"stellar_tx_hash TEXT", "ledger INTEGER", "completed_ms INTEGER", "issuance_version INTEGER NOT NULL DEFAULT 1", "submit_error TEXT", "destination TEXT NOT NULL DEFAULT ''", "memo_type TEXT NOT NULL DEFAULT ''", "memo TEXT NOT NULL DEFAULT ''", "federation TEXT NOT NULL DEFAULT ''", "watcher BLOB NOT NULL DEFAULT x''", "partner TEXT NOT NULL DEFAULT ''"} {
+		if exportsCols[strings.Fields(col)[0]] {
+			continue
+		}
+		_, err = db.Exec(`ALTER TABLE exports ADD COLUMN ` + col)
+		if err != nil {
+			return errors.Wrapf(err, "adding exports %s column", col)
+		}
+	}
+
+	wrappedCols, err := columns(db, "wrapped_assets")
+	if err != nil {
+		return err
+	}
+	if !wrappedCols["outstanding"] {
+		_, err = db.Exec(`ALTER TABLE wrapped_assets ADD COLUMN outstanding INTEGER NOT NULL DEFAULT 0`)
+		if err != nil {
+			return errors.Wrap(err, "adding wrapped_assets outstanding column")
+		}
+	}
+
+	utxosCols, err := columns(db, "utxos")
+	if err != nil {
+		return err
+	}
+	if !utxosCols["anchor"] {
+		_, err = db.Exec(`ALTER TABLE utxos ADD COLUMN anchor BLOB`)
+		if err != nil {
+			return errors.Wrap(err, "adding utxos anchor column")
+		}
+	}
+	// Outputs indexed before the account view existed.
+	_, err = db.Exec(`INSERT INTO account_balances (pubkey, txvm_asset, amount, outputs)
+		SELECT pubkeys, txvm_asset, SUM(amount), COUNT(*) FROM utxos
+		WHERE quorum=1 AND LENGTH(pubkeys)=32 AND spent_height IS NULL
+		AND NOT EXISTS (SELECT 1 FROM account_balances)
+		GROUP BY pubkeys, txvm_asset`)
+	if err != nil {
+		return errors.Wrap(err, "populating account_balances")
+	}
+
+	// The initial block has no transactions.
+	_, err = db.Exec(`INSERT OR IGNORE INTO block_markers (height, markers) VALUES (1, 0)`)
+	if err != nil {
+		return errors.Wrap(err, "marking the initial block")
+	}
+
+	pausesCols, err := columns(db, "peg_pauses")
+	if err != nil {
+		return err
+	}
+	if !pausesCols["scope"] {
+		_, err = db.Exec(`ALTER TABLE peg_pauses ADD COLUMN scope TEXT NOT NULL DEFAULT 'peg'`)
+		if err != nil {
+			return errors.Wrap(err, "adding peg_pauses scope column")
+		}
+	}
+
+	usageCols, err := columns(db, "kyc_usage")
+	if err != nil {
+		return err
+	}
+	if !usageCols["value"] {
+		_, err = db.Exec(`ALTER TABLE kyc_usage ADD COLUMN value INTEGER`)
+		if err != nil {
+			return errors.Wrap(err, "adding kyc_usage value column")
+		}
+	}
+	return nil
+}
+
+// columns returns the set of column names of the given table.
+func columns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s columns", table)
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "scanning %s column", table)
+		}
+		cols[name] = true
+	}
+	return cols, errors.Wrapf(rows.Err(), "reading %s columns", table)
+}
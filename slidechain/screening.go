@@ -0,0 +1,181 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/screening"
+)
+
+const (
+	pegHeldAlert   = "peg-held"
+	pegDeniedAlert = "peg-denied"
+)
+
+// screen returns the screener's decision on p,
+// whose key is its nonce hash or export txid.
+// Approvals and denials are final and remembered in the screenings table;
+// a held peg is screened again each time.
+// Each new decision is recorded in the audit log,
+// and operators are alerted to each held or denied peg.
+// A screener error is treated as a hold.
+func (c *Custodian) screen(ctx context.Context, p screening.Peg, key []byte) (screening.Decision, error) {
+	var prev string
+	err := c.DB.QueryRowContext(ctx, `SELECT decision FROM screenings WHERE kind=$1 AND key=$2`, p.Kind, key).Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, errors.Wrapf(err, "reading screening of %s %x", p.Kind, key)
+	}
+	if prev == screening.Approve.String() {
+		return screening.Approve, nil
+	}
+	if prev == screening.Deny.String() {
+		return screening.Deny, nil
+	}
+
+	res, err := c.screener.Screen(ctx, p)
+	if err != nil {
+		log.Printf("screening %s %x: %s", p.Kind, key, err)
+		res = screening.Result{Decision: screening.Hold, Reason: err.Error()}
+	}
+	if res.Decision != screening.Approve && res.Decision != screening.Deny {
+		res.Decision = screening.Hold
+	}
+	if res.Decision.String() != prev {
+		const q = `INSERT INTO screenings (kind, key, decision, reason, time_ms) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (kind, key) DO UPDATE SET decision=excluded.decision, reason=excluded.reason, time_ms=excluded.time_ms`
+		_, err = c.DB.ExecContext(ctx, q, p.Kind, key, res.Decision.String(), res.Reason, c.nowMS())
+		if err != nil {
+			return 0, errors.Wrapf(err, "recording screening of %s %x", p.Kind, key)
+		}
+		detail := fmt.Sprintf("%s %x: %d of %s", p.Kind, key, p.Amount, p.Asset)
+		if res.Reason != "" {
+			detail += ": " + res.Reason
+		}
+		err = c.recordAudit(ctx, "screening."+res.Decision.String(), "screener", detail)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var kind, verb string
+	switch res.Decision {
+	case screening.Hold:
+		kind, verb = pegHeldAlert, "held"
+	case screening.Deny:
+		kind, verb = pegDeniedAlert, "denied"
+	default:
+		return res.Decision, nil
+	}
+	alerted, err := c.alerted(ctx, kind, key)
+	if err != nil {
+		return 0, err
+	}
+	if !alerted {
+		err = c.alert(ctx, kind, key, fmt.Sprintf("%s %s by screening: %s", p.Kind, verb, res.Reason))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return res.Decision, nil
+}
+
+// screenPegOut screens an export before it is first pegged out,
+// reporting whether the peg-out may proceed.
+// An escrowed export is held for its challenge period
+// and moved to the failed state if its watcher cancels it.
+// An export to a federation address is first checked against its resolution.
+// An export to a destination blocked by pegout.destination_policy
+// is held until the destination lists allow it,
+// one with no memo to an account that requires one, per SEP-29,
+// until the account no longer does,
+// and one over a travel_rule.thresholds amount
+// until its travel-rule information is given.
+// An approved export is then held while it exceeds its exporter's KYC limits,
+// while it violates the signing policy until an operator approves it,
+// and while its payee's trustline awaits authorization by the asset's issuer.
+// A denied export is moved to the failed state,
+// from which it is refunded on txvm.
+func (c *Custodian) screenPegOut(ctx context.Context, p *pegOut) (bool, error) {
+	if p.State != pegOutNotYet {
+		return true, nil
+	}
+	ok, err := c.checkExportEscrow(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = c.checkPreconditions(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = c.checkFederation(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = c.checkDestination(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = c.checkMemoRequired(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	travelRule, ok, err := c.checkTravelRule(ctx, p)
+	if err != nil || !ok {
+		return false, err
+	}
+	d, err := c.screen(ctx, screening.Peg{
+		Kind:       "peg-out",
+		ID:         hex.EncodeToString(p.TxID),
+		Account:    p.payee(),
+		Pubkey:     p.Pubkey,
+		Asset:      assetName(p.AssetXDR),
+		Amount:     p.Amount,
+		TravelRule: travelRule,
+	}, p.TxID)
+	if err != nil {
+		return false, err
+	}
+	if d == screening.Deny {
+		err = c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutFail)
+		if err != nil {
+			return false, err
+		}
+		p.State = pegOutFail
+	}
+	if d != screening.Approve {
+		return false, nil
+	}
+	ok, err = c.checkKYC(ctx, "export", p.Pubkey, p.AssetXDR, p.Amount, p.TxID)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = c.checkSigningPolicy(ctx, p.signing())
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.checkAuthorization(ctx, p)
+}
+
+// screenPegIn screens a paid peg-in before its import
+// when screening.pegins is set,
+// reporting whether the import may proceed.
+// A peg-in that is held or denied stays in the paid state,
+// its value held by the custodian on the main chain.
+func (c *Custodian) screenPegIn(ctx context.Context, nonceHash []byte, amount int64, assetXDR, recip []byte, depositTxID string) (bool, error) {
+	if cfg := c.config(); cfg == nil || !cfg.Screening.PegIns {
+		return true, nil
+	}
+	d, err := c.screen(ctx, screening.Peg{
+		Kind:     "peg-in",
+		ID:       hex.EncodeToString(nonceHash),
+		MainTxID: depositTxID,
+		Pubkey:   recip,
+		Asset:    assetName(assetXDR),
+		Amount:   amount,
+	}, nonceHash)
+	return d == screening.Approve, err
+}
@@ -0,0 +1,155 @@
+// Package screening checks pegs against compliance rules,
+// such as sanctions lists, before the custodian completes them.
+package screening
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Decision is a screener's verdict on a peg.
+type Decision int
+
+const (
+	// Approve lets the peg proceed.
+	Approve Decision = iota
+
+	// Deny stops the peg for good.
+	Deny
+
+	// Hold defers the peg; it is screened again later.
+	Hold
+)
+
+var decisionNames = []string{"approve", "deny", "hold"}
+
+func (d Decision) String() string {
+	if d < 0 || int(d) >= len(decisionNames) {
+		return fmt.Sprintf("decision %d", int(d))
+	}
+	return decisionNames[d]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Decision) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Decision) UnmarshalText(text []byte) error {
+	for i, name := range decisionNames {
+		if string(text) == name {
+			*d = Decision(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown decision %q", text)
+}
+
+// Peg describes a peg-in or peg-out to be screened.
+type Peg struct {
+	Kind string `json:"kind"` // "peg-in" or "peg-out"
+	ID   string `json:"id"`   // hex nonce hash of a peg-in, or txvm tx ID of an export
+
+	// Account is the main-chain account paid by a peg-out.
+	// It is empty for a peg-in, whose payer is found from MainTxID.
+	Account string `json:"account,omitempty"`
+
+	// MainTxID is the main-chain tx paying in a peg-in.
+	MainTxID string `json:"main_txid,omitempty"`
+
+	// Pubkey is the slidechain party:
+	// the recipient of a peg-in or the exporter of a peg-out.
+	Pubkey []byte `json:"pubkey"`
+
+	Asset  string `json:"asset"`
+	Amount int64  `json:"amount"`
+
+	// TravelRule is the originator and beneficiary information
+	// attached to a peg-out, if any.
+	TravelRule *TravelRule `json:"travel_rule,omitempty"`
+}
+
+// TravelRule is the originator and beneficiary information
+// that regulated deployments must collect for large transfers.
+type TravelRule struct {
+	Originator  Party `json:"originator"`
+	Beneficiary Party `json:"beneficiary"`
+}
+
+// Party is one side of a transfer.
+type Party struct {
+	Name string `json:"name"`
+
+	// Account identifies the party's account with Institution,
+	// or its own main-chain account.
+	Account string `json:"account,omitempty"`
+
+	Address     string `json:"address,omitempty"`     // physical address
+	NationalID  string `json:"national_id,omitempty"` // or other customer identification number
+	Institution string `json:"institution,omitempty"` // the party's VASP, if any
+}
+
+// Result is the outcome of screening a peg.
+type Result struct {
+	Decision Decision `json:"decision"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// Screener decides whether a peg may proceed.
+// An error, as when a service cannot be reached,
+// is treated by the custodian as a hold.
+type Screener interface {
+	Screen(ctx context.Context, p Peg) (Result, error)
+}
+
+// Noop approves every peg.
+type Noop struct{}
+
+// Screen implements Screener.
+func (Noop) Screen(context.Context, Peg) (Result, error) {
+	return Result{Decision: Approve}, nil
+}
+
+// HTTP asks an external screening service.
+// Each Peg is POSTed to URL as JSON,
+// and the response is a JSON Result.
+type HTTP struct {
+	URL    string
+	APIKey string // if set, sent as a bearer token
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Screen implements Screener.
+func (h *HTTP) Screen(ctx context.Context, p Peg) (Result, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "encoding peg")
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.APIKey)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Result{}, errors.Wrapf(err, "requesting %s", h.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Result{}, fmt.Errorf("status %s from %s", resp.Status, h.URL)
+	}
+	var r Result
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	return r, errors.Wrapf(err, "parsing response from %s", h.URL)
+}
@@ -0,0 +1,136 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/screening"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+type testScreener struct {
+	results map[string]screening.Result // by peg ID
+	calls   int
+	last    screening.Peg
+}
+
+func (s *testScreener) Screen(ctx context.Context, p screening.Peg) (screening.Result, error) {
+	s.calls++
+	s.last = p
+	res, ok := s.results[p.ID]
+	if !ok {
+		return screening.Result{}, errors.New("service unavailable")
+	}
+	return res, nil
+}
+
+func TestScreenPegOut(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		screener := &testScreener{results: make(map[string]screening.Result)}
+		c := &Custodian{DB: db, screener: screener}
+
+		lumenXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		export := func(id string) *pegOut {
+			t.Helper()
+			p := &pegOut{TxID: []byte(id), AssetXDR: lumenXDR, Amount: 10, Exporter: importTestAccountID, Pubkey: testRecipPubKey}
+			_, err := db.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, '', 0, $4, x'', $5)", p.TxID, p.Amount, p.AssetXDR, p.Exporter, p.Pubkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		state := func(p *pegOut) pegOutState {
+			t.Helper()
+			var s pegOutState
+			err := db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, p.TxID).Scan(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+		count := func(q string, args ...interface{}) int {
+			t.Helper()
+			var n int
+			err := db.QueryRow(q, args...).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		approved := export("approved")
+		screener.results[hex.EncodeToString(approved.TxID)] = screening.Result{Decision: screening.Approve}
+		denied := export("denied")
+		screener.results[hex.EncodeToString(denied.TxID)] = screening.Result{Decision: screening.Deny, Reason: "sanctioned"}
+		held := export("held") // the screener fails for it
+
+		for _, tc := range []struct {
+			p         *pegOut
+			wantOK    bool
+			wantState pegOutState
+		}{
+			{approved, true, pegOutNotYet},
+			{denied, false, pegOutFail},
+			{held, false, pegOutNotYet},
+			{held, false, pegOutNotYet},
+		} {
+			ok, err := c.screenPegOut(ctx, tc.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantOK {
+				t.Errorf("screening export %s gave %v, want %v", tc.p.TxID, ok, tc.wantOK)
+			}
+			if got := state(tc.p); got != tc.wantState {
+				t.Errorf("export %s is in state %s, want %s", tc.p.TxID, got, tc.wantState)
+			}
+		}
+		// A final decision is remembered.
+		approved2 := *approved
+		ok, err := c.screenPegOut(ctx, &approved2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("approved export was not released on second screening")
+		}
+		// Only the held export is screened again.
+		if screener.calls != 4 {
+			t.Errorf("screener called %d times, want 4", screener.calls)
+		}
+		for _, action := range []string{"screening.approve", "screening.deny", "screening.hold"} {
+			if n := count(`SELECT COUNT(*) FROM audit_log WHERE action=$1`, action); n != 1 {
+				t.Errorf("got %d %s audit entries, want 1", n, action)
+			}
+		}
+		for _, a := range []struct {
+			kind string
+			p    *pegOut
+		}{{pegDeniedAlert, denied}, {pegHeldAlert, held}} {
+			if n := count(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, a.kind, a.p.TxID); n != 1 {
+				t.Errorf("got %d %s alerts, want 1", n, a.kind)
+			}
+		}
+
+		// Once the service approves it, the held export proceeds.
+		screener.results[hex.EncodeToString(held.TxID)] = screening.Result{Decision: screening.Approve}
+		ok, err = c.screenPegOut(ctx, held)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("approved export was not released")
+		}
+	})
+}
@@ -0,0 +1,366 @@
+// Package secret looks up the secrets a slidechaind server is configured with
+// from where they are kept:
+// environment variables, files, HashiCorp Vault, and cloud secret managers.
+//
+// A reference to a secret has the form SCHEME:REF,
+// and Schemes dispatches it to the Provider for SCHEME.
+// Providers look secrets up anew on each call,
+// so calling again picks up rotated values.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Provider looks up secrets in one kind of store.
+type Provider interface {
+	// Secret returns the secret that ref identifies in the store.
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// Schemes is a Provider of references of the form SCHEME:REF,
+// passing REF to the Provider for SCHEME.
+type Schemes map[string]Provider
+
+// IsRef reports whether s is a reference in one of the schemes.
+func (p Schemes) IsRef(s string) bool {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return false
+	}
+	_, ok := p[s[:i]]
+	return ok
+}
+
+// Secret returns the secret that ref refers to.
+func (p Schemes) Secret(ctx context.Context, ref string) (string, error) {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return "", fmt.Errorf("secret reference %q is not SCHEME:REF", ref)
+	}
+	prov, ok := p[ref[:i]]
+	if !ok {
+		return "", fmt.Errorf("unknown secret scheme %s", ref[:i])
+	}
+	s, err := prov.Secret(ctx, ref[i+1:])
+	return s, errors.Wrapf(err, "looking up %s", ref)
+}
+
+// Env looks up secrets in environment variables, by name.
+type Env struct {
+	Lookup func(string) (string, bool) // nil means os.LookupEnv
+}
+
+// Secret returns the value of the environment variable name.
+func (e Env) Secret(ctx context.Context, name string) (string, error) {
+	lookup := e.Lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	s, ok := lookup(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return s, nil
+}
+
+// File looks up secrets in files, by path.
+// A file must not be readable or writable by group or others.
+type File struct{}
+
+// Secret returns the contents of the file at path,
+// without a trailing newline.
+func (File) Secret(ctx context.Context, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return "", fmt.Errorf("%s has mode %04o; it must not be accessible by group or others", path, mode)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Vault looks up secrets in a HashiCorp Vault key/value engine,
+// by PATH#FIELD, where PATH is the secret's API path,
+// such as secret/data/slidechain for version 2 of the engine.
+type Vault struct {
+	Addr string // base URL, such as https://vault.example.com:8200
+
+	// Token authenticates to Vault.
+	// If TokenFile is set, the token is read from it on each lookup instead,
+	// so that an agent can renew it.
+	Token     string
+	TokenFile string
+
+	Client *http.Client // nil means a client with a 10-second timeout
+}
+
+// Secret returns field FIELD of the secret at PATH.
+func (v *Vault) Secret(ctx context.Context, ref string) (string, error) {
+	path, field := splitField(ref)
+	if field == "" {
+		return "", fmt.Errorf("vault reference %q is not PATH#FIELD", ref)
+	}
+	token := v.Token
+	if v.TokenFile != "" {
+		var err error
+		token, err = File{}.Secret(ctx, v.TokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "reading vault token")
+		}
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(v.Addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	err = getJSON(ctx, v.Client, req, &resp)
+	if err != nil {
+		return "", err
+	}
+	// Version 2 of the engine nests the secret's fields in data.data.
+	data := resp.Data
+	if inner, ok := data["data"]; ok && data["metadata"] != nil {
+		data = nil
+		err = json.Unmarshal(inner, &data)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing vault secret")
+		}
+	}
+	var s string
+	err = json.Unmarshal(data[field], &s)
+	if err != nil {
+		return "", fmt.Errorf("vault secret %s has no string field %s", path, field)
+	}
+	return s, nil
+}
+
+// AWSSecretsManager looks up secrets in AWS Secrets Manager,
+// by ID or ID#FIELD, where ID is a secret's name or ARN
+// and FIELD a key of its JSON object value.
+// Credentials are read on each lookup from the standard environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and, if set, AWS_SESSION_TOKEN.
+type AWSSecretsManager struct {
+	Region string
+
+	Endpoint string                      // empty means the region's
+	Lookup   func(string) (string, bool) // nil means os.LookupEnv
+	Client   *http.Client                // nil means a client with a 10-second timeout
+	Now      func() time.Time            // nil means time.Now
+}
+
+// Secret returns the current value of the secret ID,
+// or field FIELD of it.
+func (a *AWSSecretsManager) Secret(ctx context.Context, ref string) (string, error) {
+	id, field := splitField(ref)
+	lookup, now := a.Lookup, a.Now
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	if now == nil {
+		now = time.Now
+	}
+	keyID, _ := lookup("AWS_ACCESS_KEY_ID")
+	key, _ := lookup("AWS_SECRET_ACCESS_KEY")
+	if keyID == "" || key == "" {
+		return "", errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", a.Region)
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token, _ := lookup("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWS(req, body, a.Region, "secretsmanager", keyID, key, now().UTC())
+	var resp struct {
+		SecretString string
+	}
+	err = getJSON(ctx, a.Client, req, &resp)
+	if err != nil {
+		return "", err
+	}
+	return fieldOf(resp.SecretString, field)
+}
+
+// signAWS signs req, with the given body,
+// with version 4 of the AWS signature algorithm.
+func signAWS(req *http.Request, body []byte, region, service, keyID, key string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if req.Header.Get("X-Amz-Security-Token") != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", name, strings.TrimSpace(v))
+	}
+	signed := strings.Join(names, ";")
+	bodyHash := sha256.Sum256(body)
+	canon := strings.Join([]string{req.Method, "/", "", canonHeaders.String(), signed, hex.EncodeToString(bodyHash[:])}, "\n")
+	canonHash := sha256.Sum256([]byte(canon))
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonHash[:])}, "\n")
+
+	k := []byte("AWS4" + key)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		k = hmacSHA256(k, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", keyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// GCPSecretManager looks up secrets in Google Cloud Secret Manager,
+// by NAME or NAME#FIELD, where NAME is a secret version's resource name,
+// such as projects/P/secrets/S/versions/latest,
+// and FIELD a key of its JSON object value.
+// It authenticates as the service account
+// of the Google Cloud instance slidechaind runs on.
+type GCPSecretManager struct {
+	Endpoint string       // empty means https://secretmanager.googleapis.com
+	TokenURL string       // empty means the instance metadata server's
+	Client   *http.Client // nil means a client with a 10-second timeout
+}
+
+// Secret returns the value of the secret version NAME,
+// or field FIELD of it.
+func (g *GCPSecretManager) Secret(ctx context.Context, ref string) (string, error) {
+	name, field := splitField(ref)
+	tokenURL := g.TokenURL
+	if tokenURL == "" {
+		tokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	}
+	req, err := http.NewRequest("GET", tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = getJSON(ctx, g.Client, req, &token)
+	if err != nil {
+		return "", errors.Wrap(err, "getting access token")
+	}
+
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretmanager.googleapis.com"
+	}
+	req, err = http.NewRequest("GET", endpoint+"/v1/"+(&url.URL{Path: name}).EscapedPath()+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	err = getJSON(ctx, g.Client, req, &resp)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", errors.Wrap(err, "decoding secret payload")
+	}
+	return fieldOf(string(data), field)
+}
+
+// splitField splits a reference of the form REF#FIELD.
+// The field is empty if there is no #.
+func splitField(ref string) (string, string) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// fieldOf returns the string field of the JSON object value,
+// or with no field the whole value.
+func fieldOf(value, field string) (string, error) {
+	if field == "" {
+		return value, nil
+	}
+	var obj map[string]interface{}
+	err := json.Unmarshal([]byte(value), &obj)
+	if err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, so has no field %s", field)
+	}
+	s, ok := obj[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %s", field)
+	}
+	return s, nil
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// getJSON does req with ctx and parses its JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, req *http.Request, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body of an error response holds no secret.
+		return fmt.Errorf("%s from %s: %s", resp.Status, req.URL.Host, bytes.TrimSpace(body))
+	}
+	return errors.Wrap(json.Unmarshal(body, v), "parsing response")
+}
@@ -0,0 +1,156 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchemes(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "private")
+	err = ioutil.WriteFile(private, []byte("s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := filepath.Join(dir, "public")
+	err = ioutil.WriteFile(public, []byte("s3cret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Schemes{
+		"env":  Env{Lookup: func(name string) (string, bool) { return "from-env", name == "SEED" }},
+		"file": File{},
+	}
+	cases := []struct {
+		ref, want, wantErr string
+	}{
+		{ref: "env:SEED", want: "from-env"},
+		{ref: "env:OTHER", wantErr: "OTHER is not set"},
+		{ref: "file:" + private, want: "s3cret"},
+		{ref: "file:" + public, wantErr: "mode 0644"},
+		{ref: "vault:secret#seed", wantErr: "unknown secret scheme vault"},
+	}
+	for _, c := range cases {
+		got, err := p.Secret(ctx, c.ref)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("Secret(%s): got error %v, want it to mention %q", c.ref, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Secret(%s): %s", c.ref, err)
+		} else if got != c.want {
+			t.Errorf("Secret(%s) = %q, want %q", c.ref, got, c.want)
+		}
+	}
+	if p.IsRef("SABC") || !p.IsRef("env:SEED") || p.IsRef("vault:secret#seed") {
+		t.Error("IsRef distinguishes references wrongly")
+	}
+}
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "tok" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/slidechain": // version 2
+			w.Write([]byte(`{"data": {"data": {"seed": "S2"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/slidechain": // version 1
+			w.Write([]byte(`{"data": {"seed": "S1"}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	v := &Vault{Addr: srv.URL, Token: "tok"}
+	for ref, want := range map[string]string{"secret/data/slidechain#seed": "S2", "kv/slidechain#seed": "S1"} {
+		got, err := v.Secret(ctx, ref)
+		if err != nil {
+			t.Errorf("Secret(%s): %s", ref, err)
+		} else if got != want {
+			t.Errorf("Secret(%s) = %q, want %q", ref, got, want)
+		}
+	}
+	if _, err := v.Secret(ctx, "secret/data/slidechain#other"); err == nil {
+		t.Error("got no error for a missing field")
+	}
+	v.Token = "bad"
+	if _, err := v.Secret(ctx, "kv/slidechain#seed"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got error %v with a bad token, want 403", err)
+	}
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20190101/us-east-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target;x-amz-security-token, Signature=") {
+			http.Error(w, "bad authorization "+auth, http.StatusForbidden)
+			return
+		}
+		var r struct{ SecretId string }
+		json.NewDecoder(req.Body).Decode(&r)
+		if req.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || r.SecretId != "slidechain" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"SecretString": "{\"seed\": \"SAWS\"}"}`))
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "key", "AWS_SESSION_TOKEN": "tok"}
+	a := &AWSSecretsManager{
+		Region:   "us-east-1",
+		Endpoint: srv.URL,
+		Lookup:   func(name string) (string, bool) { v, ok := env[name]; return v, ok },
+		Now:      func() time.Time { return time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC) },
+	}
+	got, err := a.Secret(context.Background(), "slidechain#seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "SAWS" {
+		t.Errorf("got %q, want SAWS", got)
+	}
+}
+
+func TestGCPSecretManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/token" && req.Header.Get("Metadata-Flavor") == "Google":
+			w.Write([]byte(`{"access_token": "tok", "expires_in": 3600}`))
+		case req.URL.Path == "/v1/projects/p/secrets/seed/versions/latest:access" && req.Header.Get("Authorization") == "Bearer tok":
+			w.Write([]byte(`{"payload": {"data": "U0dDUA=="}}`)) // SGCP
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	g := &GCPSecretManager{Endpoint: srv.URL, TokenURL: srv.URL + "/token"}
+	got, err := g.Secret(context.Background(), "projects/p/secrets/seed/versions/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "SGCP" {
+		t.Errorf("got %q, want SGCP", got)
+	}
+}
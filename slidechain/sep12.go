@@ -0,0 +1,435 @@
+package slidechain
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/stellar/go/strkey"
+)
+
+// maxSEP12Body bounds the customer information in a SEP-12 PUT.
+const maxSEP12Body = 1 << 20
+
+// sep9Fields describes the SEP-9 natural-person fields
+// that a SEP-12 customer may provide.
+var sep9Fields = map[string]string{
+	"last_name":            "family or last name",
+	"first_name":           "given or first name",
+	"additional_name":      "middle name or other additional name",
+	"address_country_code": "country code of the current address, ISO 3166-1 alpha-3",
+	"state_or_province":    "state, province, region, or prefecture of the current address",
+	"city":                 "city of the current address",
+	"postal_code":          "postal or ZIP code of the current address",
+	"address":              "full current address, as a multi-line string",
+	"mobile_number":        "mobile phone number, in E.164 format",
+	"email_address":        "email address",
+	"birth_date":           "date of birth, as YYYY-MM-DD",
+	"birth_place":          "place of birth",
+	"birth_country_code":   "country of birth, ISO 3166-1 alpha-3",
+	"tax_id":               "tax identifier, such as a social security number",
+	"tax_id_name":          "name of the tax identifier, such as SSN or ITIN",
+	"occupation":           "occupation, as an ISCO code",
+	"employer_name":        "name of employer",
+	"employer_address":     "address of employer",
+	"language_code":        "primary language, ISO 639-1",
+	"id_type":              "type of ID, such as passport, drivers_license, or id_card",
+	"id_country_code":      "country issuing the ID, ISO 3166-1 alpha-3",
+	"id_issue_date":        "date the ID was issued, as YYYY-MM-DD",
+	"id_expiration_date":   "date the ID expires, as YYYY-MM-DD",
+	"id_number":            "passport or ID number",
+	"ip_address":           "IP address of the customer's computer",
+	"sex":                  "male, female, or other",
+}
+
+// sep12Params are the request parameters of SEP-12
+// that are not customer information.
+var sep12Params = map[string]bool{"id": true, "account": true, "memo": true, "memo_type": true, "type": true}
+
+// SEP-12 customer statuses.
+const (
+	sep12Accepted   = "ACCEPTED"
+	sep12Processing = "PROCESSING"
+	sep12NeedsInfo  = "NEEDS_INFO"
+)
+
+// sep12Field describes a field in a SEP-12 GET response.
+type sep12Field struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Status      string `json:"status,omitempty"` // of a provided field
+}
+
+// sep12Customer is the response of GET /sep12/customer.
+type sep12Customer struct {
+	ID             string                `json:"id,omitempty"`
+	Status         string                `json:"status"`
+	Fields         map[string]sep12Field `json:"fields,omitempty"`
+	ProvidedFields map[string]sep12Field `json:"provided_fields,omitempty"`
+	Message        string                `json:"message,omitempty"`
+}
+
+// SEP12 is the handler for the SEP-12 customer endpoints under /sep12/,
+// through which anchors and wallets register the KYC information
+// of slidechain pubkeys:
+//
+//	GET /sep12/customer
+//	PUT /sep12/customer
+//	DELETE /sep12/customer/ACCOUNT
+//
+// A customer is a pubkey,
+// identified by its hex encoding as id
+// or as the Stellar account ID of the same ed25519 key;
+// memos are not supported.
+// Its status is ACCEPTED once it is out of the first of kyc.tiers,
+// PROCESSING when it has provided all of sep12.fields,
+// and NEEDS_INFO until then.
+// Clients authenticate with bearer keys from sep12.clients
+// in place of SEP-10,
+// and see only the customers they registered.
+func (c *Custodian) SEP12(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if cfg == nil || len(cfg.SEP12.Clients) == 0 || len(cfg.KYC.Tiers) == 0 {
+		sep12Error(w, http.StatusNotFound, "SEP-12 is not enabled")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client := sep12Client(cfg.SEP12, req)
+	if client == "" {
+		sep12Error(w, http.StatusForbidden, "missing or unknown bearer key")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/sep12"), "/")
+	switch {
+	case path == "customer" && req.Method == "GET":
+		c.sep12Get(w, req, cfg, client)
+	case path == "customer" && req.Method == "PUT":
+		c.sep12Put(w, req, cfg, client)
+	case strings.HasPrefix(path, "customer/") && req.Method == "DELETE":
+		c.sep12Delete(w, req, client, strings.TrimPrefix(path, "customer/"))
+	default:
+		sep12Error(w, http.StatusNotFound, "no such SEP-12 endpoint")
+	}
+}
+
+// sep12Client returns the name of the client
+// whose key req bears, or "" if none.
+func sep12Client(cfg config.SEP12, req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, s := range cfg.Clients {
+		name, key := config.SplitNamed(s)
+		if name != "" && subtle.ConstantTimeCompare([]byte(key), presented) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// sep12Error replies with an error in the form SEP-12 specifies,
+// also logging it.
+func sep12Error(w http.ResponseWriter, code int, msg string) {
+	sep31Reply(w, code, map[string]string{"error": msg})
+	log.Printf("SEP-12: %s", msg)
+}
+
+// sep12Pubkey returns the pubkey a SEP-12 request identifies
+// by its id or account parameter.
+func sep12Pubkey(params map[string]string) ([]byte, error) {
+	if params["memo"] != "" || params["memo_type"] != "" {
+		return nil, errors.New("memos are not supported: each pubkey is its own customer")
+	}
+	id, account := params["id"], params["account"]
+	switch {
+	case id != "" && account != "":
+		return nil, errors.New("give id or account, not both")
+	case id != "":
+		pubkey, err := hex.DecodeString(id)
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("id must be a hex %d-byte ed25519 public key", ed25519.PublicKeySize)
+		}
+		return pubkey, nil
+	case account != "":
+		pubkey, err := strkey.Decode(strkey.VersionByteAccountID, account)
+		if err != nil {
+			return nil, errors.New("account must be a Stellar account ID")
+		}
+		return pubkey, nil
+	}
+	return nil, errors.New("missing id or account")
+}
+
+func (c *Custodian) sep12Get(w http.ResponseWriter, req *http.Request, cfg *config.Config, client string) {
+	ctx := req.Context()
+	params := make(map[string]string)
+	for name := range sep12Params {
+		params[name] = req.FormValue(name)
+	}
+	pubkey, err := sep12Pubkey(params)
+	if err != nil {
+		sep12Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	owner, fields, err := c.sep12Fields(ctx, cfg.SEP12, pubkey)
+	if err != nil {
+		sep12Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if owner != "" && owner != client {
+		sep12Error(w, http.StatusNotFound, "customer not found")
+		return
+	}
+	var tier string
+	err = c.DB.QueryRowContext(ctx, `SELECT tier FROM accounts WHERE pubkey=$1`, pubkey).Scan(&tier)
+	if err != nil && err != sql.ErrNoRows {
+		sep12Error(w, http.StatusInternalServerError, fmt.Sprintf("looking up account: %s", err))
+		return
+	}
+	tier = kycTier(cfg.KYC, tier)
+
+	resp := sep12Customer{Status: sep12Accepted}
+	if owner != "" {
+		resp.ID = hex.EncodeToString(pubkey)
+	}
+	if tier == cfg.KYC.Tiers[0] {
+		resp.Status = sep12Processing
+		for _, name := range cfg.SEP12.Fields {
+			if fields[name] == "" {
+				if resp.Fields == nil {
+					resp.Fields = make(map[string]sep12Field)
+				}
+				resp.Fields[name] = sep12Field{Type: "string", Description: sep9Fields[name]}
+				resp.Status = sep12NeedsInfo
+			}
+		}
+	}
+	for name := range fields {
+		if resp.ProvidedFields == nil {
+			resp.ProvidedFields = make(map[string]sep12Field)
+		}
+		status := sep12Processing
+		if resp.Status == sep12Accepted {
+			status = sep12Accepted
+		}
+		resp.ProvidedFields[name] = sep12Field{Type: "string", Description: sep9Fields[name], Status: status}
+	}
+	resp.Message = fmt.Sprintf("KYC tier %s", tier)
+	sep31Reply(w, http.StatusOK, resp)
+}
+
+func (c *Custodian) sep12Put(w http.ResponseWriter, req *http.Request, cfg *config.Config, client string) {
+	ctx := req.Context()
+	params, err := sep12Form(w, req)
+	if err != nil {
+		sep12Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pubkey, err := sep12Pubkey(params)
+	if err != nil {
+		sep12Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	required := make(map[string]bool)
+	for _, name := range cfg.SEP12.Fields {
+		required[name] = true
+	}
+	provided := make(map[string]string)
+	var unknown []string
+	for name, v := range params {
+		switch {
+		case sep12Params[name]:
+		case sep9Fields[name] == "" && !required[name]:
+			unknown = append(unknown, name)
+		case v != "":
+			provided[name] = v
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		sep12Error(w, http.StatusBadRequest, fmt.Sprintf("unknown SEP-9 fields: %s", strings.Join(unknown, ", ")))
+		return
+	}
+	owner, fields, err := c.sep12Fields(ctx, cfg.SEP12, pubkey)
+	if err != nil {
+		sep12Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if owner != "" && owner != client {
+		sep12Error(w, http.StatusForbidden, "customer was registered by another client")
+		return
+	}
+	if fields == nil {
+		fields = make(map[string]string)
+	}
+	for name, v := range provided {
+		fields[name] = v
+	}
+	sealed, err := sealSEP12(cfg.SEP12, pubkey, fields)
+	if err != nil {
+		sep12Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	const q = `INSERT INTO sep12_customers (pubkey, client, sealed, updated_ms) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (pubkey) DO UPDATE SET sealed=excluded.sealed, updated_ms=excluded.updated_ms`
+	_, err = c.DB.ExecContext(ctx, q, pubkey, client, sealed, c.nowMS())
+	if err != nil {
+		sep12Error(w, http.StatusInternalServerError, fmt.Sprintf("recording customer: %s", err))
+		return
+	}
+
+	if t := cfg.SEP12.Tier; t != "" && sep12Complete(cfg.SEP12, fields) {
+		var tier string
+		err = c.DB.QueryRowContext(ctx, `SELECT tier FROM accounts WHERE pubkey=$1`, pubkey).Scan(&tier)
+		if err != nil && err != sql.ErrNoRows {
+			sep12Error(w, http.StatusInternalServerError, fmt.Sprintf("looking up account: %s", err))
+			return
+		}
+		if kycTier(cfg.KYC, tier) == cfg.KYC.Tiers[0] && t != cfg.KYC.Tiers[0] {
+			err = c.setKYCTier(ctx, cfg.KYC, pubkey, t, "sep12:"+client, "sep12 "+client)
+			if err != nil {
+				sep12Error(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	sep31Reply(w, http.StatusAccepted, map[string]string{"id": hex.EncodeToString(pubkey)})
+}
+
+func (c *Custodian) sep12Delete(w http.ResponseWriter, req *http.Request, client, account string) {
+	pubkey, err := sep12Pubkey(map[string]string{"account": account})
+	if err != nil {
+		sep12Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := c.DB.ExecContext(req.Context(), `DELETE FROM sep12_customers WHERE pubkey=$1 AND client=$2`, pubkey, client)
+	if err != nil {
+		sep12Error(w, http.StatusInternalServerError, fmt.Sprintf("deleting customer: %s", err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		sep12Error(w, http.StatusNotFound, "customer not found")
+		return
+	}
+	// The customer's tier, and the pegs counted toward its limits, are kept.
+	w.WriteHeader(http.StatusOK)
+}
+
+// sep12Form returns the parameters of a SEP-12 PUT,
+// from a JSON object or a form, urlencoded or multipart.
+func sep12Form(w http.ResponseWriter, req *http.Request) (map[string]string, error) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxSEP12Body)
+	params := make(map[string]string)
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/json" {
+		var raw map[string]interface{}
+		err := json.NewDecoder(req.Body).Decode(&raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing request")
+		}
+		for name, v := range raw {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("field %s must be a string", name)
+			}
+			params[name] = s
+		}
+		return params, nil
+	}
+	err := req.ParseMultipartForm(maxSEP12Body)
+	if err == http.ErrNotMultipart {
+		err = req.ParseForm()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing request")
+	}
+	if req.MultipartForm != nil && len(req.MultipartForm.File) > 0 {
+		return nil, errors.New("binary fields are not supported")
+	}
+	for name, vs := range req.PostForm {
+		if len(vs) > 0 {
+			params[name] = vs[0]
+		}
+	}
+	return params, nil
+}
+
+// sep12Complete reports whether fields include all of sep12.fields.
+func sep12Complete(cfg config.SEP12, fields map[string]string) bool {
+	for _, name := range cfg.Fields {
+		if fields[name] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// sep12Fields returns the client that registered pubkey as a SEP-12 customer
+// and the information it has provided,
+// or "" and nil if it is not one.
+func (c *Custodian) sep12Fields(ctx context.Context, cfg config.SEP12, pubkey []byte) (string, map[string]string, error) {
+	var (
+		client string
+		sealed []byte
+	)
+	err := c.DB.QueryRowContext(ctx, `SELECT client, sealed FROM sep12_customers WHERE pubkey=$1`, pubkey).Scan(&client, &sealed)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "looking up customer %x", pubkey)
+	}
+	fields, err := openSEP12(cfg, pubkey, sealed)
+	return client, fields, err
+}
+
+// sealSEP12 encrypts the information of a SEP-12 customer,
+// bound to its pubkey.
+// The result is the nonce followed by the ciphertext.
+func sealSEP12(cfg config.SEP12, pubkey []byte, fields map[string]string) ([]byte, error) {
+	aead, err := aeadFromHexKey("sep12.key", cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling customer information")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, pubkey), nil
+}
+
+func openSEP12(cfg config.SEP12, pubkey, sealed []byte) (map[string]string, error) {
+	aead, err := aeadFromHexKey("sep12.key", cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("information of customer %x is truncated", pubkey)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], pubkey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting information of customer %x", pubkey)
+	}
+	var fields map[string]string
+	err = json.Unmarshal(plaintext, &fields)
+	return fields, errors.Wrapf(err, "parsing information of customer %x", pubkey)
+}
@@ -0,0 +1,119 @@
+package slidechain
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/stellar/go/strkey"
+)
+
+func TestSEP12(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.KYC.Tiers = []string{"basic", "verified"}
+		cfg.KYC.APIKey = "kyckey"
+		cfg.SEP12.Clients = []string{"wallet=s3cret", "other=hunter2"}
+		cfg.SEP12.Fields = []string{"first_name", "last_name"}
+		cfg.SEP12.Tier = "verified"
+		cfg.SEP12.Key = strings.Repeat("ab", 32)
+		now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, cfg: cfg, now: func() time.Time { return now }}
+
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		account, err := strkey.Encode(strkey.VersionByteAccountID, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		do := func(method, target, key, contentType, body string, wantCode int) []byte {
+			t.Helper()
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+key)
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			w := httptest.NewRecorder()
+			c.SEP12(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from %s %s, want %d: %s", w.Code, method, target, wantCode, w.Body)
+			}
+			return w.Body.Bytes()
+		}
+		get := func(key string) sep12Customer {
+			t.Helper()
+			var resp sep12Customer
+			err := json.Unmarshal(do("GET", "/sep12/customer?account="+account, key, "", "", http.StatusOK), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		do("GET", "/sep12/customer?account="+account, "wrong", "", "", http.StatusForbidden)
+		if resp := get("s3cret"); resp.Status != sep12NeedsInfo || len(resp.Fields) != 2 {
+			t.Errorf("got %+v for a new customer, want NEEDS_INFO with 2 fields", resp)
+		}
+
+		do("PUT", "/sep12/customer", "s3cret", "application/json", `{"account": "`+account+`", "first_name": "Ada"}`, http.StatusAccepted)
+		resp := get("s3cret")
+		if resp.ID != hex.EncodeToString(pub) || resp.Status != sep12NeedsInfo || len(resp.Fields) != 1 || len(resp.ProvidedFields) != 1 {
+			t.Errorf("got %+v with a field provided, want NEEDS_INFO for last_name", resp)
+		}
+		do("PUT", "/sep12/customer", "s3cret", "application/json", `{"account": "`+account+`", "favorite_color": "red"}`, http.StatusBadRequest)
+		do("PUT", "/sep12/customer", "s3cret", "application/json", `{"account": "`+account+`", "memo": "1", "memo_type": "id"}`, http.StatusBadRequest)
+		do("PUT", "/sep12/customer", "hunter2", "application/json", `{"account": "`+account+`", "last_name": "Lovelace"}`, http.StatusForbidden)
+		do("GET", "/sep12/customer?account="+account, "hunter2", "", "", http.StatusNotFound)
+
+		// Completing the fields moves the customer to sep12.tier.
+		form := url.Values{"id": {hex.EncodeToString(pub)}, "last_name": {"Lovelace"}}
+		do("PUT", "/sep12/customer", "s3cret", "application/x-www-form-urlencoded", form.Encode(), http.StatusAccepted)
+		if resp := get("s3cret"); resp.Status != sep12Accepted || len(resp.ProvidedFields) != 2 {
+			t.Errorf("got %+v with all fields provided, want ACCEPTED", resp)
+		}
+
+		req := httptest.NewRequest("GET", "/kyc/accounts?pubkey="+hex.EncodeToString(pub), nil)
+		req.Header.Set("Authorization", "Bearer kyckey")
+		w := httptest.NewRecorder()
+		c.KYCAccounts(w, req)
+		var a KYCAccount
+		err = json.Unmarshal(w.Body.Bytes(), &a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Tier != "verified" || a.Customer["first_name"] != "Ada" || a.Customer["last_name"] != "Lovelace" {
+			t.Errorf("got KYC account %+v, want verified with the customer's name", a)
+		}
+
+		// The information is stored encrypted.
+		var sealed []byte
+		err = db.QueryRow(`SELECT sealed FROM sep12_customers WHERE pubkey=$1`, pub).Scan(&sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, []byte("Lovelace")) {
+			t.Error("customer information is stored in the clear")
+		}
+
+		do("DELETE", "/sep12/customer/"+account, "hunter2", "", "", http.StatusNotFound)
+		do("DELETE", "/sep12/customer/"+account, "s3cret", "", "", http.StatusOK)
+		if resp := get("s3cret"); resp.ID != "" || resp.Status != sep12Accepted {
+			t.Errorf("got %+v after deleting, want ACCEPTED with no id", resp)
+		}
+	})
+}
@@ -0,0 +1,523 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/amount"
+	"github.com/stellar/go/keypair"
+)
+
+const (
+	// sep31Expiry is how long a sending anchor has
+	// to make the Stellar payment for a SEP-31 transaction.
+	sep31Expiry = 24 * time.Hour
+
+	sep31CallbackInterval = 5 * time.Second
+)
+
+// sep31Client sends SEP-31 status callbacks.
+var sep31Client = &http.Client{Timeout: 10 * time.Second}
+
+// sep31ReceiverPubkeyField is the SEP-31 transaction field
+// naming the slidechain recipient.
+const sep31ReceiverPubkeyField = "receiver_pubkey"
+
+// sep31Request is the request body of POST /sep31/transactions.
+type sep31Request struct {
+	Amount      string `json:"amount"`
+	AssetCode   string `json:"asset_code"`
+	AssetIssuer string `json:"asset_issuer"`
+	SenderID    string `json:"sender_id"`
+	ReceiverID  string `json:"receiver_id"`
+	Fields      struct {
+		Transaction map[string]string `json:"transaction"`
+	} `json:"fields"`
+	Callback string `json:"callback"`
+}
+
+// sep31Transaction is a transaction as reported by GET /sep31/transactions/ID
+// and in status callbacks.
+type sep31Transaction struct {
+	ID                    string `json:"id"`
+	Status                string `json:"status"`
+	AmountIn              string `json:"amount_in"`
+	AmountOut             string `json:"amount_out"`
+	AmountFee             string `json:"amount_fee"`
+	StellarAccountID      string `json:"stellar_account_id"`
+	StellarMemoType       string `json:"stellar_memo_type"`
+	StellarMemo           string `json:"stellar_memo"`
+	StartedAt             string `json:"started_at"`
+	CompletedAt           string `json:"completed_at,omitempty"`
+	StellarTransactionID  string `json:"stellar_transaction_id,omitempty"`
+	ExternalTransactionID string `json:"external_transaction_id,omitempty"`
+}
+
+// SEP31 is the handler for the SEP-31 receiving endpoints under /sep31/,
+// through which a sending anchor arranges a Stellar payment
+// that is pegged in to a slidechain recipient:
+//
+//	GET /sep31/info
+//	POST /sep31/transactions
+//	GET /sep31/transactions/ID
+//	PUT /sep31/transactions/ID/callback
+//
+// Sending anchors authenticate with bearer keys from sep31.senders
+// in place of SEP-10.
+func (c *Custodian) SEP31(w http.ResponseWriter, req *http.Request) {
+	sc, ok := c.chain.(*stellarChain)
+	cfg := c.config()
+	if !ok || cfg == nil || len(cfg.SEP31.Assets) == 0 {
+		sep31Error(w, http.StatusNotFound, "SEP-31 is not enabled")
+		return
+	}
+	// SEP-31 endpoints are called from other anchors' servers,
+	// but browsers need this to call them too.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	sender := sep31Sender(cfg.SEP31, req)
+	if sender == "" {
+		sep31Error(w, http.StatusForbidden, "missing or unknown bearer key")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/sep31"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "info" && req.Method == "GET":
+		c.sep31Info(w, cfg.SEP31)
+	case path == "transactions" && req.Method == "POST":
+		c.sep31Create(w, req, sc, cfg.SEP31, sender)
+	case len(parts) == 2 && parts[0] == "transactions" && req.Method == "GET":
+		c.sep31Get(w, req, sc, sender, parts[1])
+	case len(parts) == 3 && parts[0] == "transactions" && parts[2] == "callback" && req.Method == "PUT":
+		c.sep31SetCallback(w, req, sender, parts[1])
+	default:
+		sep31Error(w, http.StatusNotFound, "no such SEP-31 endpoint")
+	}
+}
+
+// sep31Sender returns the name of the sending anchor
+// whose key req bears, or "" if none.
+func sep31Sender(cfg config.SEP31, req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, s := range cfg.Senders {
+		name, key := config.SplitNamed(s)
+		if name != "" && subtle.ConstantTimeCompare([]byte(key), presented) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// sep31Error replies with an error in the form SEP-31 specifies,
+// also logging it.
+func sep31Error(w http.ResponseWriter, code int, msg string) {
+	sep31Reply(w, code, map[string]string{"error": msg})
+	log.Printf("SEP-31: %s", msg)
+}
+
+func sep31Reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sep31Fields describes the SEP-31 transaction fields
+// that a sending anchor must supply.
+var sep31Fields = map[string]interface{}{
+	"transaction": map[string]interface{}{
+		sep31ReceiverPubkeyField: map[string]interface{}{
+			"description": "hex-encoded ed25519 public key of the slidechain recipient",
+		},
+	},
+}
+
+func (c *Custodian) sep31Info(w http.ResponseWriter, cfg config.SEP31) {
+	receive := make(map[string]interface{})
+	for _, a := range cfg.Assets {
+		code := a
+		if i := strings.Index(a, ":"); i >= 0 {
+			code = a[:i]
+		}
+		receive[code] = map[string]interface{}{
+			"enabled":     true,
+			"fee_fixed":   0,
+			"fee_percent": 0,
+			"sep12": map[string]interface{}{
+				"sender":   map[string]interface{}{"types": map[string]interface{}{}},
+				"receiver": map[string]interface{}{"types": map[string]interface{}{}},
+			},
+			"fields": sep31Fields,
+		}
+	}
+	sep31Reply(w, http.StatusOK, map[string]interface{}{"receive": receive})
+}
+
+// sep31Asset returns the asset of sep31.assets
+// with the given code and, if not empty, issuer.
+func sep31Asset(cfg config.SEP31, code, issuer string) (stellar.Asset, bool) {
+	for _, a := range cfg.Assets {
+		asset, err := stellar.ParseAssetKey(a)
+		if err != nil {
+			continue
+		}
+		var gotCode, gotIssuer string
+		if a == "native" {
+			gotCode = "native"
+		} else {
+			parts := strings.Split(a, ":")
+			gotCode, gotIssuer = parts[0], parts[1]
+		}
+		if code == gotCode && (issuer == "" || issuer == gotIssuer) {
+			return asset, true
+		}
+	}
+	return stellar.Asset{}, false
+}
+
+// sep31Create records a SEP-31 transaction
+// and does the pre-peg-in for it,
+// responding with the memo that the sending anchor's payment must carry.
+func (c *Custodian) sep31Create(w http.ResponseWriter, req *http.Request, sc *stellarChain, cfg config.SEP31, sender string) {
+	ctx := req.Context()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("reading request: %s", err))
+		return
+	}
+	var p sep31Request
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		sep31Error(w, http.StatusBadRequest, fmt.Sprintf("parsing request: %s", err))
+		return
+	}
+	asset, ok := sep31Asset(cfg, p.AssetCode, p.AssetIssuer)
+	if !ok {
+		sep31Error(w, http.StatusBadRequest, fmt.Sprintf("asset %s is not received", p.AssetCode))
+		return
+	}
+	amt, err := amount.ParseInt64(p.Amount)
+	if err != nil || amt <= 0 {
+		sep31Error(w, http.StatusBadRequest, fmt.Sprintf("amount %q is not a positive amount", p.Amount))
+		return
+	}
+	recip, err := hex.DecodeString(p.Fields.Transaction[sep31ReceiverPubkeyField])
+	if err != nil || len(recip) != ed25519.PublicKeySize {
+		sep31Reply(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "transaction_info_needed",
+			"fields": sep31Fields,
+		})
+		return
+	}
+	if p.Callback != "" && !isHTTPURL(p.Callback) {
+		sep31Error(w, http.StatusBadRequest, "callback is not an http(s) URL")
+		return
+	}
+	paused, err := c.pegPaused(ctx)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if paused {
+		sep31Error(w, http.StatusServiceUnavailable, "the peg is paused")
+		return
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("marshaling asset: %s", err))
+		return
+	}
+
+	var idBytes [16]byte
+	_, err = rand.Read(idBytes[:])
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("generating transaction ID: %s", err))
+		return
+	}
+	id := hex.EncodeToString(idBytes[:])
+	nonceHash, expMS, err := c.newSEP31Nonce(ctx, id, sender, amt, assetXDR, p)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The transaction is recorded before the pre-peg-in,
+	// so if that fails, its status becomes error when the nonce expires.
+	prepegTx, err := buildPrePegInTx(c.issuance(), c.InitBlockHash.Bytes(), assetXDR, recip, amt, expMS)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("building pre-peg-in tx: %s", err))
+		return
+	}
+	r, err := c.S.submitTx(ctx, prepegTx)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("submitting pre-peg-in tx: %s", err))
+		return
+	}
+	err = c.S.waitOnTx(ctx, prepegTx.ID, r)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("waiting for pre-peg-in tx: %s", err))
+		return
+	}
+	err = c.insertPegIn(ctx, nonceHash, recip, expMS)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("SEP-31 transaction %s from %s: peg-in with nonce hash %x", id, sender, nonceHash)
+	sep31Reply(w, http.StatusCreated, map[string]string{
+		"id":                 id,
+		"stellar_account_id": sc.account,
+		"stellar_memo_type":  "hash",
+		"stellar_memo":       base64.StdEncoding.EncodeToString(nonceHash),
+	})
+}
+
+// newSEP31Nonce records a SEP-31 transaction with a new pre-peg-in nonce,
+// returning its hash and expiration.
+func (c *Custodian) newSEP31Nonce(ctx context.Context, id, sender string, amt int64, assetXDR []byte, p sep31Request) ([]byte, int64, error) {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	expMS, err := c.newNonceExp(ctx, sep31Expiry)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+	const q = `INSERT INTO sep31_transactions
+		(id, sender, nonce_hash, nonce_expms, amount, asset_xdr, sender_id, receiver_id, callback, created_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err = c.DB.ExecContext(ctx, q, id, sender, nonceHash[:], expMS, amt, assetXDR, p.SenderID, p.ReceiverID, p.Callback, c.nowMS())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "recording SEP-31 transaction")
+	}
+	return nonceHash[:], expMS, nil
+}
+
+func (c *Custodian) sep31Get(w http.ResponseWriter, req *http.Request, sc *stellarChain, sender, id string) {
+	tx, err := c.sep31Transaction(req.Context(), sc, sender, id)
+	if err == sql.ErrNoRows {
+		sep31Error(w, http.StatusNotFound, "no such transaction")
+		return
+	}
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sep31Reply(w, http.StatusOK, map[string]interface{}{"transaction": tx})
+}
+
+func (c *Custodian) sep31SetCallback(w http.ResponseWriter, req *http.Request, sender, id string) {
+	var p struct {
+		URL string `json:"url"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&p)
+	if err != nil {
+		sep31Error(w, http.StatusBadRequest, fmt.Sprintf("parsing request: %s", err))
+		return
+	}
+	if !isHTTPURL(p.URL) {
+		sep31Error(w, http.StatusBadRequest, "url is not an http(s) URL")
+		return
+	}
+	res, err := c.DB.ExecContext(req.Context(), `UPDATE sep31_transactions SET callback=$1 WHERE id=$2 AND sender=$3`, p.URL, id, sender)
+	if err != nil {
+		sep31Error(w, http.StatusInternalServerError, fmt.Sprintf("recording callback: %s", err))
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		sep31Error(w, http.StatusNotFound, "no such transaction")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// sep31Transaction returns the SEP-31 transaction id of the sending anchor,
+// or sql.ErrNoRows.
+func (c *Custodian) sep31Transaction(ctx context.Context, sc *stellarChain, sender, id string) (*sep31Transaction, error) {
+	var (
+		nonceHash, importTxID []byte
+		expMS, createdMS      int64
+		paid                  sql.NullInt64
+		state                 sql.NullInt64
+		depositTxID           sql.NullString
+	)
+	const q = `SELECT t.nonce_hash, t.nonce_expms, t.created_ms, p.amount, p.state, p.deposit_txid, p.import_txid
+		FROM sep31_transactions t LEFT JOIN pegs p ON p.nonce_hash = t.nonce_hash
+		WHERE t.id=$1 AND t.sender=$2`
+	err := c.DB.QueryRowContext(ctx, q, id, sender).Scan(&nonceHash, &expMS, &createdMS, &paid, &state, &depositTxID, &importTxID)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading SEP-31 transaction %s", id)
+	}
+	tx := &sep31Transaction{
+		ID:                   id,
+		AmountFee:            "0",
+		StellarAccountID:     sc.account,
+		StellarMemoType:      "hash",
+		StellarMemo:          base64.StdEncoding.EncodeToString(nonceHash),
+		StartedAt:            time.Unix(0, createdMS*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+		StellarTransactionID: depositTxID.String,
+	}
+	if paid.Valid {
+		tx.AmountIn = amount.StringFromInt64(paid.Int64)
+		tx.AmountOut = tx.AmountIn
+	}
+	switch {
+	case state.Valid && pegInState(state.Int64) == pegInImported:
+		tx.Status = "completed"
+		tx.ExternalTransactionID = hex.EncodeToString(importTxID)
+		var doneMS int64
+		const doneQ = `SELECT COALESCE(MAX(time_ms), 0) FROM state_events WHERE kind='peg-in' AND key=$1 AND to_state=$2`
+		err = c.DB.QueryRowContext(ctx, doneQ, nonceHash, pegInImported.String()).Scan(&doneMS)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading completion of SEP-31 transaction %s", id)
+		}
+		tx.CompletedAt = time.Unix(0, doneMS*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	case state.Valid && pegInState(state.Int64) == pegInPaid:
+		tx.Status = "pending_receiver"
+	case c.nowMS() > expMS:
+		// Unpaid, or its pre-peg-in failed.
+		tx.Status = "error"
+	default:
+		tx.Status = "pending_sender"
+	}
+	return tx, nil
+}
+
+// sep31Callbacks posts the status of SEP-31 transactions
+// to their callbacks as it changes.
+// Runs as a goroutine.
+func (c *Custodian) sep31Callbacks(ctx context.Context) {
+	defer log.Print("sep31Callbacks exiting")
+
+	ticker := time.NewTicker(sep31CallbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.sep31Notify(ctx)
+		if err != nil {
+			log.Printf("sending SEP-31 callbacks: %s", err)
+		}
+	}
+}
+
+// sep31Notify posts to its callback each SEP-31 transaction
+// whose status has changed since it was last posted,
+// signed with the custodian's key, the SIGNING_KEY of stellar.toml.
+// A failed callback is tried again on the next call.
+func (c *Custodian) sep31Notify(ctx context.Context) error {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		return nil
+	}
+	type pending struct {
+		id, sender, callback, status string
+	}
+	var ps []pending
+	const q = `SELECT id, sender, callback, status FROM sep31_transactions WHERE status NOT IN ('completed', 'error')`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, func(id, sender, callback, status string) {
+		ps = append(ps, pending{id: id, sender: sender, callback: callback, status: status})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading SEP-31 transactions")
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	kp, err := keypair.Parse(sc.seed)
+	if err != nil {
+		return errors.Wrap(err, "parsing custodian seed")
+	}
+	full, ok := kp.(*keypair.Full)
+	if !ok {
+		return errors.New("custodian seed is not a seed")
+	}
+	for _, p := range ps {
+		tx, err := c.sep31Transaction(ctx, sc, p.sender, p.id)
+		if err != nil {
+			return err
+		}
+		if tx.Status == p.status {
+			continue
+		}
+		if p.callback != "" {
+			err = postSEP31Callback(ctx, full, p.callback, tx, c.nowMS())
+			if err != nil {
+				log.Printf("SEP-31 callback for transaction %s: %s", p.id, err)
+				continue
+			}
+		}
+		_, err = c.DB.ExecContext(ctx, `UPDATE sep31_transactions SET status=$1 WHERE id=$2`, tx.Status, p.id)
+		if err != nil {
+			return errors.Wrapf(err, "recording status of SEP-31 transaction %s", p.id)
+		}
+	}
+	return nil
+}
+
+// postSEP31Callback posts tx to the callback URL
+// with a signature of "TIMESTAMP.HOST.BODY", as SEP-31 specifies.
+func postSEP31Callback(ctx context.Context, kp *keypair.Full, callback string, tx *sep31Transaction, nowMS int64) error {
+	body, err := json.Marshal(map[string]interface{}{"transaction": tx})
+	if err != nil {
+		return errors.Wrap(err, "encoding callback")
+	}
+	u, err := url.Parse(callback)
+	if err != nil {
+		return errors.Wrap(err, "parsing callback URL")
+	}
+	ts := nowMS / 1000
+	sig, err := kp.Sign([]byte(fmt.Sprintf("%d.%s.%s", ts, u.Host, body)))
+	if err != nil {
+		return errors.Wrap(err, "signing callback")
+	}
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sigHeader := fmt.Sprintf("t=%d, s=%s", ts, base64.StdEncoding.EncodeToString(sig))
+	req.Header.Set("Signature", sigHeader)
+	req.Header.Set("X-Stellar-Signature", sigHeader)
+	resp, err := sep31Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "posting to %s", callback)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s from %s", resp.Status, callback)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestSEP31(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	var (
+		mu       sync.Mutex
+		statuses []string
+	)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Signature"), "t=") {
+			t.Errorf("callback has no signature")
+		}
+		var body struct {
+			Transaction sep31Transaction `json:"transaction"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			t.Errorf("decoding callback: %s", err)
+		}
+		mu.Lock()
+		statuses = append(statuses, body.Transaction.Status)
+		mu.Unlock()
+	}))
+	defer callback.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.SEP31.Assets = []string{"native"}
+	cfg.SEP31.Senders = []string{"acme=s3cret", "other=hunter2"}
+	cfg.SEP31.URL = "https://anchor.example"
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		do := func(method, path, key string, body interface{}, wantCode int) []byte {
+			t.Helper()
+			var r *bytes.Reader
+			if body != nil {
+				bits, err := json.Marshal(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = bytes.NewReader(bits)
+			} else {
+				r = bytes.NewReader(nil)
+			}
+			req := httptest.NewRequest(method, path, r)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			w := httptest.NewRecorder()
+			c.SEP31(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("%s %s: status code %d, want %d: %s", method, path, w.Code, wantCode, w.Body)
+			}
+			return w.Body.Bytes()
+		}
+
+		do("GET", "/sep31/info", "", nil, http.StatusForbidden)
+		do("GET", "/sep31/info", "wrong", nil, http.StatusForbidden)
+		var info struct {
+			Receive map[string]json.RawMessage `json:"receive"`
+		}
+		err = json.Unmarshal(do("GET", "/sep31/info", "s3cret", nil, http.StatusOK), &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := info.Receive["native"]; !ok || len(info.Receive) != 1 {
+			t.Errorf("got /info assets %v, want native", info.Receive)
+		}
+
+		req := map[string]interface{}{
+			"amount":     "12.5",
+			"asset_code": "native",
+			"sender_id":  "s1",
+		}
+		body := do("POST", "/sep31/transactions", "s3cret", req, http.StatusBadRequest)
+		if !strings.Contains(string(body), "transaction_info_needed") {
+			t.Errorf("got %s for a transaction with no receiver, want transaction_info_needed", body)
+		}
+		req["fields"] = map[string]interface{}{
+			"transaction": map[string]string{sep31ReceiverPubkeyField: hex.EncodeToString(testRecipPubKey)},
+		}
+		var created struct {
+			ID          string `json:"id"`
+			StellarMemo string `json:"stellar_memo"`
+		}
+		err = json.Unmarshal(do("POST", "/sep31/transactions", "s3cret", req, http.StatusCreated), &created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonceHash, err := base64.StdEncoding.DecodeString(created.StellarMemo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recip []byte
+		err = db.QueryRow(`SELECT recipient_pubkey FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&recip)
+		if err != nil {
+			t.Fatalf("finding peg-in for SEP-31 memo: %s", err)
+		}
+		if !bytes.Equal(recip, testRecipPubKey) {
+			t.Errorf("peg-in is for %x, want %x", recip, testRecipPubKey)
+		}
+
+		txPath := "/sep31/transactions/" + created.ID
+		get := func() sep31Transaction {
+			t.Helper()
+			var resp struct {
+				Transaction sep31Transaction `json:"transaction"`
+			}
+			err := json.Unmarshal(do("GET", txPath, "s3cret", nil, http.StatusOK), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.Transaction
+		}
+		if got := get(); got.Status != "pending_sender" {
+			t.Errorf("got status %s, want pending_sender", got.Status)
+		}
+		do("GET", txPath, "hunter2", nil, http.StatusNotFound)
+		do("PUT", txPath+"/callback", "s3cret", map[string]string{"url": callback.URL}, http.StatusNoContent)
+
+		err = c.sep31Notify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`UPDATE pegs SET amount=125000000 WHERE nonce_hash=$1`, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.transitionPegIn(ctx, nonceHash, pegInRecorded, pegInPaid); err != nil {
+			t.Fatal(err)
+		}
+		err = c.sep31Notify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.transitionPegIn(ctx, nonceHash, pegInPaid, pegInImported); err != nil {
+			t.Fatal(err)
+		}
+		err = c.sep31Notify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Nothing changed since the last call.
+		err = c.sep31Notify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		got := strings.Join(statuses, " ")
+		mu.Unlock()
+		if want := "pending_sender pending_receiver completed"; got != want {
+			t.Errorf("got callbacks %s, want %s", got, want)
+		}
+		if tx := get(); tx.AmountIn != "12.5000000" || tx.CompletedAt == "" {
+			t.Errorf("got completed transaction %+v, want amount_in 12.5000000 and completed_at", tx)
+		}
+
+		rec := httptest.NewRecorder()
+		c.StellarTOML(rec, httptest.NewRequest("GET", "/.well-known/stellar.toml", nil))
+		if want := `DIRECT_PAYMENT_SERVER = "https://anchor.example/sep31"`; !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("stellar.toml does not contain %s:\n%s", want, rec.Body)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/amount"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+// sep7SigPrefix precedes a SEP-7 URI in the payload its signature signs.
+var sep7SigPrefix = append(make([]byte, 35), 4)
+
+// sep7Pay is a SEP-7 payment request: a deposit to the custodian.
+type sep7Pay struct {
+	Destination string
+	AssetXDR    []byte // empty for any asset, as the payer chooses
+	Amount      int64  // in stroops; zero for any
+	Memo        []byte // the nonce hash, sent as MEMO_HASH
+	Network     string // passphrase
+}
+
+// sep7PayURI returns the web+stellar:pay URI requesting p.
+// With an originDomain and the custodian's seed,
+// it is signed as the domain's URI_REQUEST_SIGNING_KEY.
+func sep7PayURI(p sep7Pay, originDomain, seed string) (string, error) {
+	params := [][2]string{{"destination", p.Destination}}
+	if p.Amount > 0 {
+		params = append(params, [2]string{"amount", amount.StringFromInt64(p.Amount)})
+	}
+	if len(p.AssetXDR) > 0 {
+		asset, err := stellar.DecodeAsset(p.AssetXDR)
+		if err != nil {
+			return "", errors.Wrap(err, "unmarshaling asset")
+		}
+		if !asset.IsNative() {
+			params = append(params, [2]string{"asset_code", asset.Code}, [2]string{"asset_issuer", asset.Issuer})
+		}
+	}
+	params = append(params,
+		[2]string{"memo", base64.StdEncoding.EncodeToString(p.Memo)},
+		[2]string{"memo_type", "MEMO_HASH"},
+	)
+	if p.Network != network.PublicNetworkPassphrase {
+		params = append(params, [2]string{"network_passphrase", p.Network})
+	}
+	if originDomain != "" {
+		params = append(params, [2]string{"origin_domain", originDomain})
+	}
+	var parts []string
+	for _, kv := range params {
+		parts = append(parts, kv[0]+"="+sep7Escape(kv[1]))
+	}
+	uri := "web+stellar:pay?" + strings.Join(parts, "&")
+	if originDomain == "" || seed == "" {
+		return uri, nil
+	}
+	kp, err := keypair.Parse(seed)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing custodian seed")
+	}
+	sig, err := kp.Sign(append(append(append([]byte(nil), sep7SigPrefix...), "stellar.sep.7 - URI Scheme"...), uri...))
+	if err != nil {
+		return "", errors.Wrap(err, "signing SEP-7 URI")
+	}
+	return uri + "&signature=" + sep7Escape(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// sep7Escape escapes a SEP-7 parameter value,
+// with spaces as %20 rather than +.
+func sep7Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// DepositURI is the response of /deposit-uri.
+type DepositURI struct {
+	URI string `json:"uri"`
+}
+
+// DepositURI is the handler for /deposit-uri,
+// responding with the SEP-7 URI that pays the peg-in
+// with the hex nonce hash nonce_hash,
+// for a wallet to complete the deposit from a QR code of it.
+// The asset and amount of a deposit nonce are the ones it was issued for;
+// for a /prepegin peg-in, which records neither,
+// they may be given as asset, an asset key such as native or USD:G...,
+// and amount, in stroops.
+func (c *Custodian) DepositURI(w http.ResponseWriter, req *http.Request) {
+	sc, ok := c.chain.(*stellarChain)
+	if !ok {
+		net.Errorf(w, http.StatusNotFound, "custodian has no Stellar account")
+		return
+	}
+	ctx := req.Context()
+	nonceHash, err := hex.DecodeString(req.FormValue("nonce_hash"))
+	if err != nil || len(nonceHash) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "nonce_hash must be a 32-byte hex nonce hash")
+		return
+	}
+	p := sep7Pay{Destination: sc.account, Memo: nonceHash, Network: sc.network}
+	if s := req.FormValue("asset"); s != "" {
+		asset, err := stellar.ParseAssetKey(s)
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		p.AssetXDR, err = asset.MarshalBinary()
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "marshaling asset: %s", err)
+			return
+		}
+	}
+	if s := req.FormValue("amount"); s != "" {
+		p.Amount, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || p.Amount <= 0 {
+			net.Errorf(w, http.StatusBadRequest, "amount must be a positive number of stroops")
+			return
+		}
+	}
+	code, err := c.depositIntent(ctx, nonceHash, &p)
+	if err != nil {
+		net.Errorf(w, code, "%s", err)
+		return
+	}
+
+	var domain string
+	if cfg := c.config(); cfg != nil {
+		domain = cfg.SEP1.HomeDomain
+	}
+	uri, err := sep7PayURI(p, domain, sc.seed)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DepositURI{URI: uri})
+}
+
+// depositIntent checks that the peg-in with the given nonce hash
+// still awaits its deposit,
+// setting the asset and amount of p from its deposit nonce, if any.
+// It returns an HTTP status code with any error.
+func (c *Custodian) depositIntent(ctx context.Context, nonceHash []byte, p *sep7Pay) (int, error) {
+	var state pegInState
+	err := c.DB.QueryRowContext(ctx, `SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&state)
+	if err == sql.ErrNoRows {
+		expired, err := c.pegInHasExpired(ctx, nonceHash)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if expired {
+			return http.StatusGone, errors.New("peg-in has expired")
+		}
+		return http.StatusNotFound, errors.New("no such peg-in")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "reading peg-in %x", nonceHash)
+	}
+	if state != pegInRecorded {
+		return http.StatusConflict, errors.New("peg-in is already paid")
+	}
+	var (
+		assetXDR []byte
+		amt      int64
+		expMS    int64
+	)
+	const q = `SELECT asset_xdr, amount, nonce_expms FROM deposit_nonces WHERE nonce_hash=$1`
+	err = c.DB.QueryRowContext(ctx, q, nonceHash).Scan(&assetXDR, &amt, &expMS)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "reading deposit nonce %x", nonceHash)
+	}
+	if c.nowMS() > expMS {
+		return http.StatusGone, errors.New("deposit nonce has expired")
+	}
+	p.AssetXDR, p.Amount = assetXDR, amt
+	return 0, nil
+}
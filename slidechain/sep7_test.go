@@ -0,0 +1,137 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestSEP7PayURI(t *testing.T) {
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd, err := stellar.ParseAssetKey("USD:" + kp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usdXDR, err := usd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memo := bytes.Repeat([]byte{0xfb}, 32)
+	p := sep7Pay{Destination: kp.Address(), AssetXDR: usdXDR, Amount: 15000000, Memo: memo, Network: "Test SDF Network ; September 2015"}
+	uri, err := sep7PayURI(p, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "web+stellar:pay?destination=" + kp.Address() + "&amount=1.5000000&asset_code=USD&asset_issuer=" + kp.Address() +
+		"&memo=" + url.QueryEscape(base64.StdEncoding.EncodeToString(memo)) + "&memo_type=MEMO_HASH" +
+		"&network_passphrase=Test%20SDF%20Network%20%3B%20September%202015"
+	if uri != want {
+		t.Errorf("got URI\n%s\nwant\n%s", uri, want)
+	}
+
+	signed, err := sep7PayURI(p, "example.com", kp.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.Index(signed, "&signature=")
+	if i < 0 || signed[:i] != uri+"&origin_domain=example.com" {
+		t.Fatalf("got signed URI %s, want %s with origin_domain and signature", signed, uri)
+	}
+	sigStr, err := url.QueryUnescape(signed[i+len("&signature="):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append(append(append([]byte(nil), sep7SigPrefix...), "stellar.sep.7 - URI Scheme"...), signed[:i]...)
+	if err := kp.Verify(payload, sig); err != nil {
+		t.Errorf("signature does not verify: %s", err)
+	}
+}
+
+func TestDepositURI(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prepeg, nonce := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+		for _, nonceHash := range [][]byte{prepeg, nonce} {
+			err = c.insertPegIn(ctx, nonceHash, testRecipPubKey, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		const q = `INSERT INTO deposit_nonces (nonce_hash, recipient_pubkey, asset_xdr, amount, nonce_expms, created_ms) VALUES ($1, $2, $3, 20000000, $4, 0)`
+		_, err = db.Exec(q, nonce, testRecipPubKey, nativeXDR, c.nowMS()+1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get := func(query string, wantCode int) string {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.DepositURI(w, httptest.NewRequest("GET", "/deposit-uri?"+query, nil))
+			if w.Code != wantCode {
+				t.Fatalf("%s: got status %d, want %d: %s", query, w.Code, wantCode, w.Body)
+			}
+			var resp DepositURI
+			json.NewDecoder(w.Body).Decode(&resp)
+			return resp.URI
+		}
+		uri := get("nonce_hash="+hex.EncodeToString(prepeg)+"&asset=native&amount=10000000", http.StatusOK)
+		if !strings.HasPrefix(uri, "web+stellar:pay?destination="+custKP.Address()+"&amount=1.0000000&memo=") {
+			t.Errorf("got URI %s for a /prepegin peg-in, want 1 lumen to the custodian", uri)
+		}
+		uri = get("nonce_hash="+hex.EncodeToString(nonce)+"&amount=1", http.StatusOK)
+		if !strings.Contains(uri, "&amount=2.0000000&") {
+			t.Errorf("got URI %s for a deposit nonce, want its amount of 2 lumens", uri)
+		}
+		if strings.Contains(uri, "signature=") {
+			t.Errorf("got signed URI %s with no home domain", uri)
+		}
+
+		get("nonce_hash="+strings.Repeat("00", 32), http.StatusNotFound)
+		get("nonce_hash=zz", http.StatusBadRequest)
+		now = now.Add(time.Hour)
+		get("nonce_hash="+hex.EncodeToString(nonce), http.StatusGone)
+	})
+}
@@ -0,0 +1,106 @@
+package slidechain
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// defaultShard is the name of the peg-out shard
+// of the assets in no other.
+const defaultShard = "default"
+
+// A pegOutShard is one of the independent peg-out pipelines
+// of pegout.shards:
+// the exports of its assets, pegged out by a worker of its own.
+// A nil *pegOutShard is all the exports.
+type pegOutShard struct {
+	name    string
+	assets  map[string]bool // by asset XDR; for the default shard, those of the others
+	limiter *net.Limiter
+	wait    time.Duration // between peg-outs at the shard's rate, zero for unlimited
+
+	mu   sync.Mutex
+	held bool // a peg-out was held back by the rate
+}
+
+// newPegOutShards returns the shards of cfg,
+// the default one first,
+// or nil if there are none.
+func newPegOutShards(cfg config.PegOut) ([]*pegOutShard, error) {
+	if len(cfg.Shards) == 0 {
+		return nil, nil
+	}
+	def := &pegOutShard{name: defaultShard, assets: make(map[string]bool), limiter: net.NewLimiter(0, 0)}
+	shards := []*pegOutShard{def}
+	for _, s := range cfg.Shards {
+		name, rateStr := config.SplitNamed(s)
+		if name == "" {
+			name, rateStr = s, "0"
+		}
+		asset, err := stellar.ParseAssetKey(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "pegout.shards %s", s)
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshaling asset %s", name)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "pegout.shards %s", s)
+		}
+		sh := &pegOutShard{
+			name:    name,
+			assets:  map[string]bool{string(assetXDR): true},
+			limiter: net.NewLimiter(rate, 1),
+		}
+		if rate > 0 {
+			sh.wait = time.Duration(float64(time.Second) / rate)
+		}
+		def.assets[string(assetXDR)] = true
+		shards = append(shards, sh)
+	}
+	return shards, nil
+}
+
+// has reports whether the exports of the asset are in sh.
+func (sh *pegOutShard) has(assetXDR []byte) bool {
+	if sh == nil {
+		return true
+	}
+	if sh.name == defaultShard {
+		return !sh.assets[string(assetXDR)]
+	}
+	return sh.assets[string(assetXDR)]
+}
+
+// allow reports whether sh may submit a peg-out now,
+// noting it if not, so that its worker comes back later.
+func (sh *pegOutShard) allow(now time.Time) bool {
+	if sh == nil || sh.limiter.Allow(sh.name, now) {
+		return true
+	}
+	sh.mu.Lock()
+	sh.held = true
+	sh.mu.Unlock()
+	return false
+}
+
+// takeHeld reports whether a peg-out was held back by the rate
+// since the last call.
+func (sh *pegOutShard) takeHeld() bool {
+	if sh == nil {
+		return false
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	held := sh.held
+	sh.held = false
+	return held
+}
@@ -0,0 +1,131 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestPegOutShards(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.Shards = []string{"native=1"}
+
+	shards, err := newPegOutShards(cfg.PegOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2 || shards[0].name != defaultShard || shards[1].name != "native" {
+		t.Fatalf("got %d shards, want the default and native", len(shards))
+	}
+	def, native := shards[0], shards[1]
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := stellar.NativeAsset()
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		amt := int64(xlm.Lumen)
+		txids := [][]byte{[]byte("first"), []byte("second")}
+		for _, txid := range txids {
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), asset, amt, TimeBounds{}, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &pegOut{
+				TxID:     txid,
+				AssetXDR: assetXDR,
+				TempAddr: tempAddr,
+				Seqnum:   int64(seqnum),
+				Exporter: exporterKP.Address(),
+				Amount:   amt,
+				Anchor:   []byte{},
+				Pubkey:   []byte{},
+			}
+			err = c.insertExport(ctx, txid, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		states := func() []pegOutState {
+			var ss []pegOutState
+			for _, txid := range txids {
+				var s pegOutState
+				err := db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, txid).Scan(&s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ss = append(ss, s)
+			}
+			return ss
+		}
+
+		// The default shard leaves native exports to their own.
+		ready, err := c.pegOutPending(ctx, def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 0 || def.takeHeld() {
+			t.Errorf("default shard pegged out %d native exports", len(ready))
+		}
+		if ss := states(); ss[0] != pegOutNotYet || ss[1] != pegOutNotYet {
+			t.Errorf("after the default shard, got states %v, want both not yet", ss)
+		}
+
+		// At one peg-out per second, the second waits.
+		ready, err = c.pegOutPending(ctx, native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 1 || !native.takeHeld() {
+			t.Errorf("got %d ready native exports, want 1 with the other held", len(ready))
+		}
+		if ss := states(); ss[0] != pegOutOK || ss[1] != pegOutNotYet {
+			t.Errorf("got states %v, want the first pegged out", ss)
+		}
+
+		now = now.Add(native.wait)
+		ready, err = c.pegOutPending(ctx, native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 1 || native.takeHeld() {
+			t.Errorf("after %s, got %d ready native exports, want the held one", native.wait, len(ready))
+		}
+		if ss := states(); ss[1] != pegOutOK {
+			t.Errorf("got states %v, want both pegged out", ss)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+)
+
+// ResponseDigest returns the message the custodian signs
+// in its response to a query for the given URI (path and query)
+// with the given body, made at timeMS.
+func ResponseDigest(uri string, body []byte, timeMS int64) []byte {
+	bodyHash := sha3.Sum256(body)
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(timeMS))
+	msg := append([]byte("slidechain response\x00"), uri...)
+	msg = append(msg, 0)
+	msg = append(msg, bodyHash[:]...)
+	msg = append(msg, timeBytes[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// Signed wraps a query handler
+// so that the custodian signs each of its responses,
+// giving the time in the X-Custodian-Time header, in milliseconds,
+// and the base64 ed25519 signature of ResponseDigest
+// in X-Custodian-Signature.
+// A response kept with those headers and the request URI
+// can be relayed and checked against the key from SigningKey.
+func (c *Custodian) Signed(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		h.ServeHTTP(buf, req)
+
+		timeMS := c.nowMS()
+		sig := ed25519.Sign(c.privkey, ResponseDigest(req.URL.RequestURI(), buf.body.Bytes(), timeMS))
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Custodian-Time", strconv.FormatInt(timeMS, 10))
+		w.Header().Set("X-Custodian-Signature", base64.StdEncoding.EncodeToString(sig))
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	})
+}
+
+// SigningKey is the handler for /.well-known/slidechain-signing-key,
+// serving the public key that verifies the custodian's signed responses.
+// It is the custodian's txvm key,
+// which also signs its imports and reserve spends.
+func (c *Custodian) SigningKey(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"algorithm": "ed25519",
+		"pubkey":    hex.EncodeToString(c.privkey.Public().(ed25519.PublicKey)),
+	})
+}
+
+// bufferedResponse holds a response until it is signed.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header { return r.header }
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(b)
+}
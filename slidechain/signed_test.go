@@ -0,0 +1,84 @@
+package slidechain
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+)
+
+func TestSigned(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, privkey: custodianPrv, now: func() time.Time { return now }}
+		txvmAsset := []byte{1, 2, 3}
+		_, err = db.Exec(`INSERT INTO wrapped_assets (code, txvm_asset, outstanding) VALUES ('WRAP', $1, 5)`, txvmAsset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO reserve (anchor, txvm_asset, amount) VALUES ('a', $1, 5), ('b', $1, 7)`, txvmAsset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`UPDATE reserve SET export_txid='pending' WHERE anchor='b'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c.SigningKey(w, httptest.NewRequest("GET", "/.well-known/slidechain-signing-key", nil))
+		var key struct{ Pubkey string }
+		err = json.NewDecoder(w.Body).Decode(&key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey, err := hex.DecodeString(key.Pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const uri = "/reserves"
+		w = httptest.NewRecorder()
+		c.Signed(http.HandlerFunc(c.Reserves)).ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code %d from %s: %s", w.Code, uri, w.Body)
+		}
+		timeMS, err := strconv.ParseInt(w.Header().Get("X-Custodian-Time"), 10, 64)
+		if err != nil || timeMS != c.nowMS() {
+			t.Errorf("got X-Custodian-Time %q, want %d", w.Header().Get("X-Custodian-Time"), c.nowMS())
+		}
+		sig, err := base64.StdEncoding.DecodeString(w.Header().Get("X-Custodian-Signature"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := w.Body.Bytes()
+		if !ed25519.Verify(ed25519.PublicKey(pubkey), ResponseDigest(uri, body, timeMS), sig) {
+			t.Error("response signature does not verify")
+		}
+		if ed25519.Verify(ed25519.PublicKey(pubkey), ResponseDigest("/export-status", body, timeMS), sig) {
+			t.Error("response signature verifies for another query")
+		}
+
+		var got []assetReserve
+		err = json.Unmarshal(body, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []assetReserve{{Code: "WRAP", TxvmAsset: "010203", Outstanding: 5, Reserve: 5}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got reserves %+v, want %+v", got, want)
+		}
+	})
+}
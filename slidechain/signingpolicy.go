@@ -0,0 +1,308 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/policy"
+)
+
+const policyViolationAlert = "policy-violation"
+
+// Decisions on payments in the policy_checks table.
+const (
+	policyPass     = "pass"
+	policyHeld     = "held"
+	policyApproved = "approved"
+)
+
+// signingPolicy is a version of the signing policy
+// in the signing_policies table.
+type signingPolicy struct {
+	Version   int64  `json:"version"`
+	Policy    string `json:"policy"`
+	Source    string `json:"source"` // who set it
+	CreatedMS int64  `json:"created_ms"`
+}
+
+// currentPolicy returns the latest version of the signing policy, parsed,
+// or 0 and nil if none has been set.
+func (c *Custodian) currentPolicy(ctx context.Context) (int64, *policy.Policy, error) {
+	var (
+		version int64
+		src     string
+	)
+	err := c.DB.QueryRowContext(ctx, `SELECT version, policy FROM signing_policies ORDER BY version DESC LIMIT 1`).Scan(&version, &src)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "reading signing policy")
+	}
+	// Only a policy that parses is stored.
+	pol, err := policy.Parse(src)
+	return version, pol, errors.Wrapf(err, "parsing signing policy version %d", version)
+}
+
+// signing is a payment of the custodian's funds
+// that it is to sign, as the signing policy sees it.
+type signing struct {
+	Kind        string // export, netting, refund, exit, or rebalance
+	ID          []byte // 32 bytes naming it in policy_checks
+	Destination string
+	AssetXDR    []byte
+	Amount      int64
+}
+
+// signing is the export's peg-out, as the signing policy sees it.
+func (p *pegOut) signing() signing {
+	return signing{Kind: "export", ID: p.TxID, Destination: p.payee(), AssetXDR: p.AssetXDR, Amount: p.Amount}
+}
+
+// signing is the netted payment of n, as the signing policy sees it,
+// named by its ID.
+func (n *netting) signing() signing {
+	id := sha3.Sum256([]byte(fmt.Sprintf("slidechain netting %d", n.ID)))
+	return signing{Kind: "netting", ID: id[:], Destination: n.Payee, AssetXDR: []byte(n.AssetXDR), Amount: n.Amount}
+}
+
+// policyFacts are the facts the signing policy is evaluated over for s,
+// with the totals of the payments of its asset
+// that have passed the policy or been approved since UTC midnight.
+// Netted payments are left out of the totals,
+// since the exports they pay are in them already.
+func (c *Custodian) policyFacts(ctx context.Context, s signing) (policy.Facts, error) {
+	now := time.Unix(0, c.nowMS()*int64(time.Millisecond)).UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	f := policy.Facts{
+		Kind:        s.Kind,
+		Destination: s.Destination,
+		Asset:       assetName(s.AssetXDR),
+		Amount:      s.Amount,
+		Hour:        now.Hour(),
+		Weekday:     int(now.Weekday()),
+	}
+	const q = `SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM policy_checks
+		WHERE asset_xdr=$1 AND decision IN ($2, $3) AND decided_ms >= $4 AND txid != $5 AND kind != 'netting'`
+	err := c.DB.QueryRowContext(ctx, q, s.AssetXDR, policyPass, policyApproved, day.UnixNano()/int64(time.Millisecond), s.ID).Scan(&f.DailyTotal, &f.DailyCount)
+	if err != nil {
+		return f, errors.Wrapf(err, "totaling payments of %s", f.Asset)
+	}
+	if s.Kind != "netting" {
+		f.DailyTotal += s.Amount
+		f.DailyCount++
+	}
+	return f, nil
+}
+
+// checkSigningPolicy reports whether the payment s may be signed
+// under the signing policy.
+// A payment is checked against the current version of the policy
+// until it passes or is approved, which is final.
+// One violating a rule is held until an operator approves it
+// at /admin/signing-policy/holds,
+// or a later version of the policy passes it;
+// the first time, operators are alerted.
+// With no policy set, every payment passes unrecorded,
+// so a policy once set applies to every payment not yet signed.
+func (c *Custodian) checkSigningPolicy(ctx context.Context, s signing) (bool, error) {
+	var (
+		checked  int64
+		decision string
+	)
+	err := c.DB.QueryRowContext(ctx, `SELECT version, decision FROM policy_checks WHERE txid=$1`, s.ID).Scan(&checked, &decision)
+	if err != nil && err != sql.ErrNoRows {
+		return false, errors.Wrapf(err, "reading policy check of %s %x", s.Kind, s.ID)
+	}
+	if decision == policyPass || decision == policyApproved {
+		return true, nil
+	}
+	version, pol, err := c.currentPolicy(ctx)
+	if err != nil {
+		return false, err
+	}
+	if pol == nil {
+		return true, nil
+	}
+	if decision == policyHeld && checked == version {
+		return false, nil
+	}
+	f, err := c.policyFacts(ctx, s)
+	if err != nil {
+		return false, err
+	}
+	violations := pol.Violations(f)
+	decision, decidedMS := policyPass, c.nowMS()
+	if len(violations) > 0 {
+		decision, decidedMS = policyHeld, 0
+	}
+	const q = `INSERT INTO policy_checks (txid, kind, version, asset_xdr, amount, decision, violations, checked_ms, decided_ms) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (txid) DO UPDATE SET version=excluded.version, decision=excluded.decision, violations=excluded.violations, checked_ms=excluded.checked_ms, decided_ms=excluded.decided_ms`
+	_, err = c.DB.ExecContext(ctx, q, s.ID, s.Kind, version, s.AssetXDR, s.Amount, decision, strings.Join(violations, ","), c.nowMS(), decidedMS)
+	if err != nil {
+		return false, errors.Wrapf(err, "recording policy check of %s %x", s.Kind, s.ID)
+	}
+	if decision == policyPass {
+		return true, nil
+	}
+	detail := fmt.Sprintf("%s %x of %d %s to %s violates signing policy version %d: %s", s.Kind, s.ID, s.Amount, f.Asset, f.Destination, version, strings.Join(violations, ", "))
+	err = c.recordAudit(ctx, "policy.hold", "signing-policy", detail)
+	if err != nil {
+		return false, err
+	}
+	alerted, err := c.alerted(ctx, policyViolationAlert, s.ID)
+	if err != nil || alerted {
+		return false, err
+	}
+	return false, c.alert(ctx, policyViolationAlert, s.ID, detail)
+}
+
+// SigningPolicy is the admin handler for the signing policy.
+// GET lists its versions, newest first,
+// and POST sets a new version from the request body,
+// which must parse as a policy; see package policy.
+// Held payments are reconsidered after each change.
+func (c *Custodian) SigningPolicy(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		versions := []signingPolicy{}
+		const q = `SELECT version, policy, source, created_ms FROM signing_policies ORDER BY version DESC`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(version int64, pol, source string, createdMS int64) {
+			versions = append(versions, signingPolicy{Version: version, Policy: pol, Source: source, CreatedMS: createdMS})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading signing policies: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+			return
+		}
+		pol, err := policy.Parse(string(body))
+		if err != nil {
+			net.Errorf(w, http.StatusBadRequest, "parsing policy: %s", err)
+			return
+		}
+		sp := signingPolicy{Policy: string(body), Source: "admin-api " + req.RemoteAddr, CreatedMS: c.nowMS()}
+		const q = `INSERT INTO signing_policies (version, policy, source, created_ms)
+			SELECT COALESCE(MAX(version), 0) + 1, $1, $2, $3 FROM signing_policies`
+		res, err := c.DB.ExecContext(ctx, q, sp.Policy, sp.Source, sp.CreatedMS)
+		if err == nil {
+			sp.Version, err = res.LastInsertId()
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "recording signing policy: %s", err)
+			return
+		}
+		err = c.recordAudit(ctx, "policy.update", sp.Source, fmt.Sprintf("version %d: %d rules", sp.Version, len(pol.Rules)))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if c.exports != nil {
+			c.exports.Broadcast()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sp)
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "the signing policy supports GET and POST")
+	}
+}
+
+// policyHold is a payment held by the signing policy.
+type policyHold struct {
+	TxID       string   `json:"txid"`
+	Kind       string   `json:"kind"`
+	Version    int64    `json:"version"`
+	Asset      string   `json:"asset"`
+	Amount     int64    `json:"amount"`
+	Violations []string `json:"violations"`
+	CheckedMS  int64    `json:"checked_ms"`
+}
+
+// PolicyHolds is the admin handler for payments held by the signing policy.
+// GET lists them,
+// and POST approves the one whose ID is in the txid parameter,
+// which is then signed like any other:
+// an export's txvm tx ID, the memo of a refund or exit payout,
+// the ID logged for a held netted payment,
+// or the ID a held rebalance was answered with.
+func (c *Custodian) PolicyHolds(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		holds := []policyHold{}
+		const q = `SELECT txid, kind, version, asset_xdr, amount, violations, checked_ms FROM policy_checks WHERE decision=$1 ORDER BY checked_ms, txid`
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, policyHeld, func(txid []byte, kind string, version int64, assetXDR []byte, amount int64, violations string, checkedMS int64) {
+			holds = append(holds, policyHold{
+				TxID:       hex.EncodeToString(txid),
+				Kind:       kind,
+				Version:    version,
+				Asset:      assetName(assetXDR),
+				Amount:     amount,
+				Violations: strings.Split(violations, ","),
+				CheckedMS:  checkedMS,
+			})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading policy holds: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(holds)
+
+	case http.MethodPost:
+		txid, err := hex.DecodeString(req.FormValue("txid"))
+		if err != nil || len(txid) != 32 {
+			net.Errorf(w, http.StatusBadRequest, "txid must be 32 hex-encoded bytes")
+			return
+		}
+		source := "admin-api " + req.RemoteAddr
+		const q = `UPDATE policy_checks SET decision=$1, decided_ms=$2, approver=$3 WHERE txid=$4 AND decision=$5`
+		res, err := c.DB.ExecContext(ctx, q, policyApproved, c.nowMS(), source, txid, policyHeld)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "approving %x: %s", txid, err)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			net.Errorf(w, http.StatusNotFound, "%x is not held by the signing policy", txid)
+			return
+		}
+		var kind string
+		err = c.DB.QueryRowContext(ctx, `SELECT kind FROM policy_checks WHERE txid=$1`, txid).Scan(&kind)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading approved %x: %s", txid, err)
+			return
+		}
+		err = c.recordAudit(ctx, "policy.approve", source, fmt.Sprintf("%s %x", kind, txid))
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if c.exports != nil {
+			c.exports.Broadcast()
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "policy holds support GET and POST")
+	}
+}
@@ -0,0 +1,266 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestSigningPolicy(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)
+		c := &Custodian{DB: db, cfg: config.Default(), now: func() time.Time { return now }}
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		export := func(i byte, amount int64, dest string) *pegOut {
+			return &pegOut{
+				TxID:        bytes.Repeat([]byte{i}, 32),
+				AssetXDR:    nativeXDR,
+				Exporter:    "GEXPORTER",
+				Amount:      amount,
+				Destination: Destination{Account: dest},
+			}
+		}
+		check := func(p *pegOut, want bool) {
+			t.Helper()
+			ok, err := c.checkSigningPolicy(ctx, p.signing())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("export %x of %d passed %v, want %v", p.TxID[:1], p.Amount, ok, want)
+			}
+		}
+		setPolicy := func(src string, wantCode int) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.SigningPolicy(w, httptest.NewRequest("POST", "/admin/signing-policy", strings.NewReader(src)))
+			if w.Code != wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+
+		// Without a policy, everything passes.
+		check(export(1, 100, ""), true)
+
+		setPolicy("large: amount > 1000\ndaily: daily_total > 1500 and destination != GTRUSTED", http.StatusOK)
+		setPolicy("broken: amount >", http.StatusBadRequest)
+		check(export(1, 100, ""), true)
+		check(export(2, 600, ""), true)
+		check(export(3, 2000, "GTRUSTED"), false)
+		check(export(4, 600, ""), true)
+		check(export(5, 600, ""), false) // the day's total would be 1900
+		check(export(6, 600, "GTRUSTED"), true)
+		check(export(3, 2000, "GTRUSTED"), false)
+
+		var alerts int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1`, policyViolationAlert).Scan(&alerts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alerts != 2 {
+			t.Errorf("got %d policy violation alerts, want 2", alerts)
+		}
+
+		w := httptest.NewRecorder()
+		c.PolicyHolds(w, httptest.NewRequest("GET", "/admin/signing-policy/holds", nil))
+		var holds []policyHold
+		err = json.NewDecoder(w.Body).Decode(&holds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(holds) != 2 || holds[0].Violations[0] != "large" || holds[1].Violations[0] != "daily" || holds[0].Version != 1 {
+			t.Errorf("got holds %+v", holds)
+		}
+
+		// An operator approves the large export.
+		approve := func(txid []byte, wantCode int) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.PolicyHolds(w, httptest.NewRequest("POST", "/admin/signing-policy/holds?txid="+hex.EncodeToString(txid), nil))
+			if w.Code != wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+		approve(export(3, 0, "").TxID, http.StatusNoContent)
+		approve(export(3, 0, "").TxID, http.StatusNotFound)
+		check(export(3, 2000, "GTRUSTED"), true)
+
+		// A new version of the policy reconsiders the other hold,
+		// and the next day's total starts over.
+		now = now.Add(24 * time.Hour)
+		setPolicy("large: amount > 1000", http.StatusOK)
+		check(export(5, 600, ""), true)
+
+		w = httptest.NewRecorder()
+		c.SigningPolicy(w, httptest.NewRequest("GET", "/admin/signing-policy", nil))
+		var versions []signingPolicy
+		err = json.NewDecoder(w.Body).Decode(&versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || versions[0].Version != 2 || versions[0].Policy != "large: amount > 1000" {
+			t.Errorf("got policy versions %+v", versions)
+		}
+		var audits int
+		err = db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE action IN ('policy.update', 'policy.approve')`).Scan(&audits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if audits != 3 {
+			t.Errorf("got %d policy audit entries, want 3", audits)
+		}
+	})
+}
+
+func TestSigningPolicyHoldsCustodianPayments(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	var kps []*keypair.Full
+	for i := 0; i < 3; i++ {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		kps = append(kps, kp)
+	}
+	custKP, payeeKP, issuerKP := kps[0], kps[1], kps[2]
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	cfg.Rebalance.Enabled = true
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nativeXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const amount = int64(xlm.Lumen)
+		for _, ins := range []struct {
+			q    string
+			args []interface{}
+		}{
+			{`INSERT INTO wind_down (height, cursor, skipped, started_ms) VALUES (1, '', 0, 0)`, nil},
+			{`INSERT INTO exit_addresses (pubkey, address, time_ms) VALUES ($1, $2, 0)`, []interface{}{testRecipPubKey, payeeKP.Address()}},
+			{`INSERT INTO exit_payouts (pubkey, asset_xdr, amount, state) VALUES ($1, $2, $3, $4)`, []interface{}{testRecipPubKey, nativeXDR, amount, exitWaiting}},
+			{`INSERT INTO deposit_refunds (deposit_txid, op_index, asset_xdr, nonce_hash, sender, amount, reason, deposit_cursor, state) VALUES ('deposit', 0, $1, x'', $2, $3, 'test', '', $4)`, []interface{}{nativeXDR, payeeKP.Address(), amount, refundWaiting}},
+		} {
+			_, err = db.Exec(ins.q, ins.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Rebalancing buys only assets pegged in.
+		err = stellar.TrustAsset(srv.Client(), custKP.Seed(), "USD", issuerKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		usd, err := stellar.ParseAssetKey("USD:" + issuerKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, 0, $2, $3, 1, $4)`, []byte("nonce"), usdXDR, testRecipPubKey, pegInRecorded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c.SigningPolicy(w, httptest.NewRequest("POST", "/admin/signing-policy", strings.NewReader("custodian: kind in [refund, exit, rebalance]")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d setting the policy: %s", w.Code, w.Body)
+		}
+
+		pay := func() int {
+			t.Helper()
+			txs := len(srv.Transactions())
+			err := c.payExitsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.payRefundsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(srv.Transactions()) - txs
+		}
+		rebalance := func(wantCode int) string {
+			t.Helper()
+			body := `{"send_asset": "native", "send_max": 10000000, "dest_asset": "USD:` + issuerKP.Address() + `", "dest_amount": 1}`
+			w := httptest.NewRecorder()
+			c.Rebalance(w, httptest.NewRequest("POST", "/admin/rebalance", strings.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("got status %d from rebalance, want %d: %s", w.Code, wantCode, w.Body)
+			}
+			return w.Body.String()
+		}
+
+		if got := pay(); got != 0 {
+			t.Errorf("submitted %d txs the signing policy holds, want none", got)
+		}
+		if body := rebalance(http.StatusConflict); !strings.Contains(body, "held by the signing policy") {
+			t.Errorf("got rebalance refused with %s, want held by the signing policy", body)
+		}
+
+		// All three wait in the same queue as held exports.
+		w = httptest.NewRecorder()
+		c.PolicyHolds(w, httptest.NewRequest("GET", "/admin/signing-policy/holds", nil))
+		var holds []policyHold
+		err = json.NewDecoder(w.Body).Decode(&holds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds := make(map[string]bool)
+		for _, h := range holds {
+			kinds[h.Kind] = true
+			w := httptest.NewRecorder()
+			c.PolicyHolds(w, httptest.NewRequest("POST", "/admin/signing-policy/holds?txid="+h.TxID, nil))
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("got status %d approving %s %s: %s", w.Code, h.Kind, h.TxID, w.Body)
+			}
+		}
+		if len(holds) != 3 || !kinds["refund"] || !kinds["exit"] || !kinds["rebalance"] {
+			t.Errorf("got holds %+v, want a refund, an exit payout, and a rebalance", holds)
+		}
+
+		if got := pay(); got != 2 {
+			t.Errorf("submitted %d txs once approved, want the refund and exit payout", got)
+		}
+		// The approved rebalance is submitted,
+		// and fails only because horizonmock has no path payments.
+		rebalance(http.StatusBadGateway)
+	})
+}
@@ -0,0 +1,69 @@
+package simulate
+
+import (
+	"context"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// crash is the panic value with which the custodian's Horizon client
+// models the custodian process dying during a call.
+// Sim recovers it and restarts the custodian.
+type crash struct {
+	point string
+}
+
+// errLostResponse models a submission that Stellar applied
+// but whose response never reached the custodian.
+var errLostResponse = errors.New("simulated lost response from Horizon")
+
+// custodianClient is the custodian's Horizon client.
+// It talks to the simulated network like any other client,
+// except that it may fail or crash according to the simulation's faults,
+// and its StreamTransactions returns when it has caught up.
+type custodianClient struct {
+	*stellar.HorizonClient
+	sim *Sim
+}
+
+func (h *custodianClient) StreamTransactions(ctx context.Context, accountID string, cursor *stellar.Cursor, handler func(stellar.Transaction)) error {
+	if h.sim.chance(h.sim.cfg.CrashRate) {
+		panic(crash{point: "streaming txs"})
+	}
+	for _, tx := range h.sim.srv.AccountTransactions(accountID, string(*cursor)) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		handler(tx)
+		*cursor = stellar.Cursor(tx.PT)
+	}
+	return nil
+}
+
+func (h *custodianClient) SubmitTransaction(txeBase64 string) (stellar.TransactionSuccess, error) {
+	s := h.sim
+	if s.chance(s.cfg.CrashRate) {
+		panic(crash{point: "before submit"})
+	}
+	if s.chance(s.cfg.SubmitFailRate) {
+		// A rejection before the tx is applied.
+		if s.rand.Intn(2) == 0 {
+			s.srv.Inject(horizonmock.EndpointSubmit, horizonmock.Timeout, 1)
+		} else {
+			s.srv.Inject(horizonmock.EndpointSubmit, horizonmock.BadSeq, 1)
+		}
+	}
+	res, err := h.HorizonClient.SubmitTransaction(txeBase64)
+	if err != nil {
+		return res, err
+	}
+	if s.chance(s.cfg.CrashRate) {
+		panic(crash{point: "after submit"})
+	}
+	if s.chance(s.cfg.SubmitFailRate) {
+		return stellar.TransactionSuccess{}, errLostResponse
+	}
+	return res, nil
+}
@@ -0,0 +1,609 @@
+// Package simulate runs the slidechain custodian deterministically
+// against an in-memory Stellar network and an in-memory database,
+// under a random workload of peg-ins, exports, crashes, and Horizon failures,
+// checking after every action that the custodian's Stellar reserve
+// covers the value it has imported onto txvm.
+//
+// The custodian is driven by Custodian.Step instead of its goroutines,
+// and its clock is a Clock that moves only when the simulation advances it,
+// so a run is reproducible from its Config.Seed.
+// (Temporary export accounts get random keys,
+// but no decision depends on them.)
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+
+	// The in-memory database is sqlite's.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Config configures a simulation run.
+type Config struct {
+	// Seed determines the workload and the faults.
+	Seed int64
+
+	// Users is the number of users pegging in and exporting.
+	Users int
+
+	// Actions is the number of random actions to take
+	// before draining the custodian's pending work.
+	Actions int
+
+	// CrashRate is the probability that the custodian crashes
+	// at each point where it calls Horizon.
+	// The crash may come just after a submitted tx is applied.
+	CrashRate float64
+
+	// SubmitFailRate is the probability that a Horizon submission by the custodian
+	// fails before the tx is applied (with a timeout or tx_bad_seq),
+	// and separately that it is applied but the response is lost.
+	SubmitFailRate float64
+
+	// RestartRate is the probability of restarting the custodian
+	// after each action.
+	RestartRate float64
+}
+
+// Sim is a custodian, Stellar network, and set of users under simulation.
+type Sim struct {
+	cfg    Config
+	rand   *rand.Rand
+	clock  *Clock
+	srv    *horizonmock.Server
+	db     *sql.DB
+	ccfg   *config.Config
+	faulty bool // whether faults are injected; false while draining
+
+	ctx    context.Context
+	cancel context.CancelFunc // stops the current custodian's background work
+	cust   *slidechain.Custodian
+
+	custAddr     string
+	startReserve int64
+	users        []*user
+	expMS        int64              // latest peg-in nonce expiration, to keep nonces unique
+	paid         [][]byte           // nonce hashes of peg-ins paid on Stellar
+	exports      map[bc.Hash]string // txvm export tx ID to its temp account
+	stray        int64              // stroops paid to the custodian outside of peg-ins
+
+	// The unspent txvm outputs, as of block height.
+	height  uint64
+	utxos   map[bc.Hash]utxo
+	assetID *bc.Hash // the txvm asset ID of imported lumens, once seen
+
+	// Log records the actions taken, for diagnosing failures.
+	Log []string
+}
+
+type user struct {
+	prv ed25519.PrivateKey
+	pub ed25519.PublicKey
+	kp  *keypair.Full
+}
+
+type utxo struct {
+	txid bc.Hash
+	out  bc.Output
+}
+
+type value struct {
+	amount  int64
+	assetID bc.Hash
+	anchor  []byte
+}
+
+var (
+	native    = stellar.NativeAsset()
+	nativeXDR []byte
+	dbCount   int64
+)
+
+func init() {
+	var err error
+	nativeXDR, err = native.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// New creates a simulation and starts its custodian.
+// The caller must call Close when done with it.
+func New(ctx context.Context, cfg Config) (*Sim, error) {
+	s := &Sim{
+		cfg:     cfg,
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+		clock:   NewClock(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)),
+		srv:     horizonmock.New(),
+		exports: make(map[bc.Hash]string),
+		utxos:   make(map[bc.Hash]utxo),
+		faulty:  true,
+	}
+
+	// The database lives as long as some connection to it is open,
+	// which s.db keeps across custodian restarts.
+	name := fmt.Sprintf("file:simulate%d?mode=memory&cache=shared", atomic.AddInt64(&dbCount, 1))
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		s.srv.Close()
+		return nil, errors.Wrap(err, "opening db")
+	}
+	s.db = db
+
+	var seed [32]byte
+	s.rand.Read(seed[:])
+	custKP, err := keypair.FromRawSeed(seed)
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "making custodian keypair")
+	}
+	s.custAddr = custKP.Address()
+	s.startReserve = horizonmock.FriendbotAmount
+	s.srv.Fund(s.custAddr, s.startReserve)
+
+	s.ccfg = config.Default()
+	s.ccfg.Custodian.Seed = custKP.Seed()
+	s.ccfg.Horizon.URL = s.srv.URL()
+	s.ccfg.Horizon.FriendbotURL = ""
+
+	for i := 0; i < cfg.Users; i++ {
+		pub, prv, err := ed25519.GenerateKey(s.rand)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "making user key")
+		}
+		copy(seed[:], prv)
+		kp, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "making user keypair")
+		}
+		s.srv.Fund(kp.Address(), horizonmock.FriendbotAmount)
+		s.users = append(s.users, &user{prv: prv, pub: pub, kp: kp})
+	}
+
+	err = s.start(ctx)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close stops the custodian and releases the network and database.
+func (s *Sim) Close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+	s.srv.Close()
+}
+
+// start starts a new custodian process on the simulation's database.
+func (s *Sim) start(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	hclient := &custodianClient{HorizonClient: s.srv.Client(), sim: s}
+	cust, err := slidechain.NewSteppedCustodian(s.ctx, s.db, hclient, s.ccfg, s.clock.Now)
+	if err != nil {
+		return errors.Wrap(err, "starting custodian")
+	}
+	s.cust = cust
+	return nil
+}
+
+// restart models the custodian process dying and starting again.
+// Everything it has not written to the database is lost.
+func (s *Sim) restart(ctx context.Context, why string) error {
+	s.logf("restart custodian (%s)", why)
+	s.cancel()
+	return s.start(ctx)
+}
+
+// Run takes the configured number of random actions,
+// checking the reserve invariant after each,
+// then drains the custodian's pending work with Drain.
+func (s *Sim) Run(ctx context.Context) error {
+	for i := 0; i < s.cfg.Actions; i++ {
+		err := s.act(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "action %d", i)
+		}
+		err = s.CheckReserve(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "after action %d", i)
+		}
+	}
+	return s.Drain(ctx)
+}
+
+func (s *Sim) act(ctx context.Context) error {
+	s.clock.Advance(time.Duration(s.rand.Int63n(int64(30 * time.Second))))
+
+	u := s.users[s.rand.Intn(len(s.users))]
+	var err error
+	switch n := s.rand.Intn(20); {
+	case n < 5:
+		err = s.pegIn(u)
+	case n < 8:
+		err = s.export(ctx, u)
+	case n < 9:
+		err = s.strayPayment(u)
+	default:
+		err = s.step(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if s.chance(s.cfg.RestartRate) {
+		return s.restart(ctx, "between actions")
+	}
+	return nil
+}
+
+// step runs one custodian step,
+// restarting the custodian if it crashes.
+func (s *Sim) step(ctx context.Context) (err error) {
+	s.logf("step custodian")
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		c, ok := r.(crash)
+		if !ok {
+			panic(r)
+		}
+		err = s.restart(ctx, "crash "+c.point)
+	}()
+	return s.cust.Step(s.ctx)
+}
+
+// Drain turns faults off and steps the custodian
+// until it should have finished all pending work,
+// then checks that it has:
+// every peg-in paid on Stellar is imported,
+// every export is retired or refunded,
+// and the reserve equals exactly the imported value outstanding on txvm.
+func (s *Sim) Drain(ctx context.Context) error {
+	s.faulty = false
+	// A peg-out that is retried completes in the second step.
+	for i := 0; i < 3; i++ {
+		err := s.step(ctx)
+		if err != nil {
+			return errors.Wrap(err, "draining")
+		}
+	}
+	for _, nonceHash := range s.paid {
+		ok, err := s.reached(ctx, "peg-in", nonceHash, "imported")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("peg-in %x was paid but not imported", nonceHash)
+		}
+	}
+	for txid := range s.exports {
+		ok, err := s.reached(ctx, "export", txid.Bytes(), "retired", "refunded")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("export %x is still pending", txid.Bytes())
+		}
+	}
+	reserve, live, paidOut, err := s.balances(ctx)
+	if err != nil {
+		return err
+	}
+	if reserve != live || paidOut != 0 {
+		return fmt.Errorf("after draining, reserve is %d, want %d imported value outstanding (with %d paid out but not retired)", reserve, live, paidOut)
+	}
+	return nil
+}
+
+// reached reports whether the custodian's state events show
+// the given peg-in or export reaching one of the given states.
+func (s *Sim) reached(ctx context.Context, kind string, key []byte, states ...string) (bool, error) {
+	for _, state := range states {
+		var n int
+		const q = `SELECT COUNT(*) FROM state_events WHERE kind=$1 AND key=$2 AND to_state=$3`
+		err := s.db.QueryRowContext(ctx, q, kind, key, state).Scan(&n)
+		if err != nil {
+			return false, errors.Wrapf(err, "checking state of %s %x", kind, key)
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckReserve checks that the custodian's reserve on Stellar
+// covers the imported value outstanding on txvm.
+// The reserve is the custodian's balance beyond its starting balance,
+// not counting payments that were not peg-ins.
+// The value locked in export contracts whose peg-outs Stellar has paid
+// is not outstanding:
+// it must be retired.
+// If it is refunded instead, the exporter is paid twice
+// and the invariant breaks.
+func (s *Sim) CheckReserve(ctx context.Context) error {
+	reserve, live, paidOut, err := s.balances(ctx)
+	if err != nil {
+		return err
+	}
+	if reserve < live-paidOut {
+		return fmt.Errorf("reserve %d is less than imported value outstanding %d (%d on txvm, %d of it paid out)", reserve, live-paidOut, live, paidOut)
+	}
+	return nil
+}
+
+// balances returns the custodian's reserve,
+// the imported value on txvm,
+// and the part of that locked in export contracts
+// whose peg-outs Stellar has paid.
+func (s *Sim) balances(ctx context.Context) (reserve, live, paidOut int64, err error) {
+	err = s.scan(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bal, _ := s.srv.Balance(s.custAddr, native)
+	reserve = bal - s.startReserve - s.stray
+	for _, u := range s.utxos {
+		for _, v := range values(u.out.Stack) {
+			if s.assetID == nil || v.assetID != *s.assetID {
+				continue
+			}
+			live += v.amount
+			temp, ok := s.exports[u.txid]
+			if !ok || u.out.Seed == bc.NewHash(standard.PayToMultisigSeed1) {
+				continue
+			}
+			// Only the preauthorized peg-out tx can merge the temp account.
+			if _, exists := s.srv.Balance(temp, native); !exists {
+				paidOut += v.amount
+			}
+		}
+	}
+	return reserve, live, paidOut, nil
+}
+
+// scan brings s.utxos up to date with the blocks
+// the custodian has committed.
+func (s *Sim) scan(ctx context.Context) error {
+	height, err := s.cust.BS.Height(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting height")
+	}
+	for s.height < height {
+		block, err := s.cust.BS.GetBlock(ctx, s.height+1)
+		if err != nil {
+			return errors.Wrapf(err, "getting block %d", s.height+1)
+		}
+		for _, tx := range block.Transactions {
+			for _, iss := range tx.Issuances {
+				if s.assetID == nil {
+					id := iss.AssetID
+					s.assetID = &id
+				}
+				if iss.AssetID != *s.assetID {
+					return fmt.Errorf("unexpected issuance of asset %x in tx %x", iss.AssetID.Bytes(), tx.ID.Bytes())
+				}
+			}
+			for _, in := range tx.Inputs {
+				delete(s.utxos, in.ID)
+			}
+			for _, out := range tx.Outputs {
+				s.utxos[out.ID] = utxo{txid: tx.ID, out: out}
+			}
+		}
+		s.height++
+	}
+	return nil
+}
+
+// pegIn pegs in a random amount of lumens from u,
+// recording the peg-in with the custodian
+// and then paying it on Stellar.
+func (s *Sim) pegIn(u *user) error {
+	amount := int64(1+s.rand.Intn(100)) * int64(xlm.Lumen)
+	expMS := int64(bc.Millis(s.clock.Now().Add(10 * time.Minute)))
+	if expMS <= s.expMS {
+		expMS = s.expMS + 1
+	}
+	s.expMS = expMS
+	s.logf("peg in %d stroops for %s", amount, u.kp.Address())
+
+	body, err := json.Marshal(slidechain.PrePegIn{
+		BcID:        s.cust.InitBlockHash.Bytes(),
+		Amount:      amount,
+		AssetXDR:    nativeXDR,
+		RecipPubkey: u.pub,
+		ExpMS:       expMS,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshaling pre-peg-in")
+	}
+	req := httptest.NewRequest(http.MethodPost, "/prepegin", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.cust.DoPrePegIn(w, req)
+	if w.Code != http.StatusOK {
+		return fmt.Errorf("pre-peg-in: status %d: %s", w.Code, w.Body)
+	}
+	var nonceHash stellar.MemoHash
+	copy(nonceHash[:], w.Body.Bytes())
+
+	err = s.pay(u, nonceHash, amount)
+	if err != nil {
+		return errors.Wrap(err, "paying peg-in")
+	}
+	s.paid = append(s.paid, nonceHash[:])
+	return nil
+}
+
+// strayPayment pays the custodian with a memo matching no peg-in,
+// which it must ignore.
+func (s *Sim) strayPayment(u *user) error {
+	amount := int64(1+s.rand.Intn(10)) * int64(xlm.Lumen)
+	var memo stellar.MemoHash
+	s.rand.Read(memo[:])
+	s.logf("stray payment of %d stroops from %s", amount, u.kp.Address())
+	err := s.pay(u, memo, amount)
+	if err != nil {
+		return errors.Wrap(err, "paying custodian")
+	}
+	s.stray += amount
+	return nil
+}
+
+func (s *Sim) pay(u *user, memo stellar.MemoHash, amount int64) error {
+	hclient := s.srv.Client()
+	seqnum, err := hclient.SequenceForAccount(u.kp.Address())
+	if err != nil {
+		return errors.Wrap(err, "building payment")
+	}
+	tx := &stellar.Tx{
+		Network: s.srv.Passphrase,
+		Source:  u.kp.Address(),
+		SeqNum:  seqnum + 1,
+		BaseFee: 100,
+		Memo:    memo,
+		Ops: []stellar.Op{
+			stellar.Payment{Destination: s.custAddr, Asset: stellar.NativeAsset(), Amount: amount},
+		},
+	}
+	_, err = stellar.SignAndSubmitTx(hclient, tx, u.kp.Seed())
+	return err
+}
+
+// export exports part or all of one of u's txvm values, if u has any.
+func (s *Sim) export(ctx context.Context, u *user) error {
+	err := s.scan(ctx)
+	if err != nil {
+		return err
+	}
+	vals := s.wallet(u)
+	if len(vals) == 0 {
+		return nil
+	}
+	v := vals[s.rand.Intn(len(vals))]
+	amount := 1 + s.rand.Int63n(v.amount)
+	s.logf("export %d of %d stroops for %s", amount, v.amount, u.kp.Address())
+
+	tempAddr, seqnum, err := slidechain.SubmitPreExportTx(s.srv.Client(), u.kp, s.custAddr, native, amount, slidechain.TimeBounds{}, slidechain.Destination{})
+	if err != nil {
+		return errors.Wrap(err, "submitting pre-export tx")
+	}
+	tx, err := slidechain.BuildExportTx(ctx, native, 1, amount, v.amount, tempAddr, v.anchor, u.prv, seqnum, slidechain.TimeBounds{}, slidechain.Destination{})
+	if err != nil {
+		return errors.Wrap(err, "building export tx")
+	}
+	bits, err := proto.Marshal(&bc.RawTx{Version: tx.Version, Runlimit: tx.Runlimit, Program: tx.Program})
+	if err != nil {
+		return errors.Wrap(err, "marshaling export tx")
+	}
+	req := httptest.NewRequest(http.MethodPost, "/submit", bytes.NewReader(bits))
+	w := httptest.NewRecorder()
+	s.cust.S.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		return fmt.Errorf("submitting export tx: status %d: %s", w.Code, w.Body)
+	}
+	s.exports[tx.ID] = tempAddr
+	return nil
+}
+
+// wallet returns the imported values that u can spend,
+// in a deterministic order.
+func (s *Sim) wallet(u *user) []value {
+	var ids []bc.Hash
+	for id, o := range s.utxos {
+		if o.out.Seed == bc.NewHash(standard.PayToMultisigSeed1) && holds(o.out.Stack, u.pub) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i].Bytes(), ids[j].Bytes()) < 0
+	})
+	var vals []value
+	for _, id := range ids {
+		for _, v := range values(s.utxos[id].out.Stack) {
+			if s.assetID != nil && v.assetID == *s.assetID {
+				vals = append(vals, v)
+			}
+		}
+	}
+	return vals
+}
+
+// values returns the values in a contract's stack.
+func values(stack []txvm.Data) []value {
+	var vals []value
+	for _, item := range stack {
+		tup, ok := item.(txvm.Tuple)
+		if !ok || len(tup) != 4 {
+			continue
+		}
+		code, ok := tup[0].(txvm.Bytes)
+		if !ok || len(code) != 1 || code[0] != txvm.ValueCode {
+			continue
+		}
+		amount, ok1 := tup[1].(txvm.Int)
+		assetID, ok2 := tup[2].(txvm.Bytes)
+		anchor, ok3 := tup[3].(txvm.Bytes)
+		if ok1 && ok2 && ok3 && amount > 0 {
+			vals = append(vals, value{amount: int64(amount), assetID: bc.HashFromBytes(assetID), anchor: anchor})
+		}
+	}
+	return vals
+}
+
+// holds reports whether data contains the byte string b.
+func holds(data []txvm.Data, b []byte) bool {
+	for _, item := range data {
+		switch item := item.(type) {
+		case txvm.Bytes:
+			if bytes.Equal(item, b) {
+				return true
+			}
+		case txvm.Tuple:
+			if holds(item, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chance reports true with probability p while faults are on.
+func (s *Sim) chance(p float64) bool {
+	return s.faulty && p > 0 && s.rand.Float64() < p
+}
+
+func (s *Sim) logf(format string, args ...interface{}) {
+	s.Log = append(s.Log, fmt.Sprintf(format, args...))
+}
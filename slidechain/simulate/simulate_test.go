@@ -0,0 +1,61 @@
+package simulate
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	seeds   = flag.Int("simulate.seeds", 10, "number of seeds to simulate per test")
+	actions = flag.Int("simulate.actions", 150, "number of actions per simulation")
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		// The custodian logs every step.
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestReserveInvariant(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"no faults", Config{}},
+		{"crashes", Config{CrashRate: 0.1, RestartRate: 0.05}},
+		{"submit failures", Config{SubmitFailRate: 0.2}},
+		{"all faults", Config{CrashRate: 0.1, SubmitFailRate: 0.2, RestartRate: 0.05}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for seed := int64(1); seed <= int64(*seeds); seed++ {
+				cfg := c.cfg
+				cfg.Seed = seed
+				cfg.Users = 3
+				cfg.Actions = *actions
+				runSim(t, cfg)
+			}
+		})
+	}
+}
+
+func runSim(t *testing.T, cfg Config) {
+	ctx := context.Background()
+	s, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Run(ctx)
+	if err != nil {
+		t.Fatalf("seed %d: %s\nactions:\n%s", cfg.Seed, err, strings.Join(s.Log, "\n"))
+	}
+}
@@ -30,36 +30,14 @@ import (
 	"github.com/chain/txvm/protocol/txvm/txvmutil"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/config"
 	"github.com/interstellar/slingshot/slidechain/stellar"
 	"github.com/interstellar/slingshot/slidechain/store"
 	"github.com/interstellar/starlight/worizon/xlm"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
-	"github.com/stellar/go/xdr"
 )
 
-func makeAsset(typ xdr.AssetType, code string, issuer string) xdr.Asset {
-	var issuerAccountID xdr.AccountId
-	issuerAccountID.SetAddress(issuer)
-	byteArray := []byte(code)
-
-	var asset xdr.Asset
-	switch typ {
-	case xdr.AssetTypeAssetTypeNative:
-		asset, _ = xdr.NewAsset(typ, nil)
-	case xdr.AssetTypeAssetTypeCreditAlphanum4:
-		var codeArray [4]byte
-		copy(codeArray[:], byteArray)
-		asset, _ = xdr.NewAsset(typ, xdr.AssetAlphaNum4{AssetCode: codeArray, Issuer: issuerAccountID})
-	case xdr.AssetTypeAssetTypeCreditAlphanum12:
-		var codeArray [12]byte
-		copy(codeArray[:], byteArray)
-		asset, _ = xdr.NewAsset(typ, xdr.AssetAlphaNum12{AssetCode: codeArray, Issuer: issuerAccountID})
-	}
-	return asset
-}
-
 func TestServer(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
@@ -195,18 +173,13 @@ const importTestAccountID = "GDSBCQO34HWPGUGQSP3QBFEXVTSR2PW46UIGTHVWGWJGQKH3AFN
 func TestImport(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
-	var importtests = []struct {
-		assetType xdr.AssetType
-		code      string
-		issuer    string
-	}{
-		{xdr.AssetTypeAssetTypeNative, "", ""},
-		{xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID},
-		{xdr.AssetTypeAssetTypeCreditAlphanum12, "USDUSD", importTestAccountID},
+	var importtests = []stellar.Asset{
+		stellar.NativeAsset(),
+		{Code: "USD", Issuer: importTestAccountID},
+		{Code: "USDUSD", Issuer: importTestAccountID},
 	}
-	for _, tt := range importtests {
-		log.Printf("testing asset %s", tt.assetType)
-		stellarAsset := makeAsset(tt.assetType, tt.code, tt.issuer)
+	for _, stellarAsset := range importtests {
+		log.Printf("testing asset %s", stellar.AssetKey(stellarAsset))
 		assetXDR, err := stellarAsset.MarshalBinary()
 		if err != nil {
 			t.Fatal(err)
@@ -226,7 +199,7 @@ func TestImport(t *testing.T) {
 			// Without a successful pre-peg-in TxVM tx, the initial input in the import tx will fail.
 			log.Println("building and submitting pre-peg-in tx...")
 			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
-			prepegTx, err := buildPrePegInTx(c.InitBlockHash.Bytes(), assetXDR, testRecipPubKey, 1, expMS)
+			prepegTx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), assetXDR, testRecipPubKey, 1, expMS)
 			if err != nil {
 				t.Fatal("could not build pre-peg-in tx")
 			}
@@ -243,7 +216,7 @@ func TestImport(t *testing.T) {
 			go c.importFromPegIns(ctx, ready)
 			<-ready
 			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
-			_, err = db.Exec("INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, stellar_tx) VALUES ($1, 1, $2, $3, $4, 1)", nonceHash[:], assetXDR, testRecipPubKey, expMS)
+			_, err = db.Exec("INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, 1, $2, $3, $4, $5)", nonceHash[:], assetXDR, testRecipPubKey, expMS, pegInPaid)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -277,7 +250,7 @@ func TestEndToEnd(t *testing.T) {
 		{5 * xlm.Lumen, 3 * xlm.Lumen},
 	}
 	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, sv *httptest.Server, ch *protocol.Chain) {
-		hclient := &horizon.Client{
+		hclient := &stellar.HorizonClient{
 			URL:  "https://horizon-testnet.stellar.org",
 			HTTP: new(http.Client),
 		}
@@ -285,20 +258,20 @@ func TestEndToEnd(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error getting horizon client root: %s", err)
 		}
-		accountID, seed, err := custodianAccount(ctx, db, hclient)
+		accountID, seed, err := custodianAccount(ctx, db, hclient, "", config.Default().Horizon.FriendbotURL)
 		if err != nil {
 			t.Fatalf("error creating custodian account: %s", err)
 		}
 		c := &Custodian{
 			seed:          seed,
-			AccountID:     *accountID,
+			AccountID:     accountID,
 			S:             s,
 			DB:            db,
 			hclient:       hclient,
+			chain:         newStellarChain(hclient, accountID, seed, root.NetworkPassphrase),
 			InitBlockHash: ch.InitialBlockHash,
 			imports:       sync.NewCond(new(sync.Mutex)),
 			exports:       sync.NewCond(new(sync.Mutex)),
-			network:       root.NetworkPassphrase,
 			privkey:       custodianPrv,
 		}
 		c.launch(ctx)
@@ -318,9 +291,7 @@ func TestEndToEnd(t *testing.T) {
 		var exporterPubKeyBytes [32]byte
 		copy(exporterPubKeyBytes[:], exporterPub)
 
-		native := xdr.Asset{
-			Type: xdr.AssetTypeAssetTypeNative,
-		}
+		native := stellar.NativeAsset()
 		nativeAssetBytes, err := native.MarshalBinary()
 		if err != nil {
 			t.Fatalf("error marshaling native asset to xdr: %s", err)
@@ -332,7 +303,7 @@ func TestEndToEnd(t *testing.T) {
 			exportAmount := tt.exportAmount
 			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
 			// Build, submit, and wait on pre-peg-in TxVM tx.
-			prepegTx, err := buildPrePegInTx(c.InitBlockHash.Bytes(), nativeAssetBytes, exporterPubKeyBytes[:], int64(inputAmount), expMS)
+			prepegTx, err := buildPrePegInTx(issuanceContracts[1], c.InitBlockHash.Bytes(), nativeAssetBytes, exporterPubKeyBytes[:], int64(inputAmount), expMS)
 			if err != nil {
 				t.Fatal("could not build pre-peg-in tx")
 			}
@@ -351,11 +322,9 @@ func TestEndToEnd(t *testing.T) {
 			}
 
 			// Build transaction to peg-in funds.
-			pegInTx, err := stellar.BuildPegInTx(exporter.Address(), uniqueNonceHash, inputAmount.HorizonString(), "", "", c.AccountID.Address(), hclient)
-			if err != nil {
-				t.Fatalf("error building peg-in tx: %s", err)
-			}
-			succ, err := stellar.SignAndSubmitTx(hclient, pegInTx, exporter.Seed())
+			succ, err := stellar.NewSequencer(hclient).Submit(exporter.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+				return stellar.BuildPegInTx(exporter.Address(), seqnum, uniqueNonceHash, inputAmount.HorizonString(), "", "", c.AccountID, hclient)
+			}, exporter.Seed())
 			if err != nil {
 				t.Fatalf("error signing and submitting tx: %s", err)
 			}
@@ -384,12 +353,12 @@ func TestEndToEnd(t *testing.T) {
 				}
 			}
 			t.Log("submitting pre-export tx...")
-			tempAddr, seqnum, err := SubmitPreExportTx(hclient, exporter, c.AccountID.Address(), native, int64(exportAmount))
+			tempAddr, seqnum, err := SubmitPreExportTx(hclient, exporter, c.AccountID, native, int64(exportAmount), TimeBounds{}, Destination{})
 			if err != nil {
 				t.Fatalf("pre-submit tx error: %s", err)
 			}
 			t.Log("building export tx...")
-			exportTx, err := BuildExportTx(ctx, native, int64(exportAmount), int64(inputAmount), tempAddr, anchor, exporterPrv, seqnum)
+			exportTx, err := BuildExportTx(ctx, native, 1, int64(exportAmount), int64(inputAmount), tempAddr, anchor, exporterPrv, seqnum, TimeBounds{}, Destination{})
 			if err != nil {
 				t.Fatalf("error building retirement tx %s", err)
 			}
@@ -419,42 +388,40 @@ func TestEndToEnd(t *testing.T) {
 			t.Log("checking for successful retirement...")
 			retire := make(chan struct{})
 			go func() {
-				var cur horizon.Cursor
-				err := c.hclient.StreamTransactions(ctx, exporter.Address(), &cur, func(tx horizon.Transaction) {
+				var cur stellar.Cursor
+				err := c.hclient.StreamTransactions(ctx, exporter.Address(), &cur, func(tx stellar.Transaction) {
 					t.Logf("received tx: %s", tx.EnvelopeXdr)
-					var env xdr.TransactionEnvelope
-					err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
+					ptx, err := stellar.DecodeTx(tx.EnvelopeXdr)
 					if err != nil {
 						t.Fatal(err)
 					}
-					if env.Tx.SourceAccount.Address() != tempAddr {
+					if ptx.Source != tempAddr {
 						t.Log("source accounts don't match, skipping...")
 						return
 					}
 					defer close(retire)
-					if len(env.Tx.Operations) != 2 {
-						t.Fatalf("too many operations got %d, want 2", len(env.Tx.Operations))
+					if len(ptx.Ops) != 2 {
+						t.Fatalf("too many operations got %d, want 2", len(ptx.Ops))
 					}
-					op := env.Tx.Operations[0]
-					if op.Body.Type != xdr.OperationTypeAccountMerge {
-						t.Fatalf("wrong operation type: got %s, want %s", op.Body.Type, xdr.OperationTypeAccountMerge)
+					merge, ok := ptx.Ops[0].(stellar.AccountMerge)
+					if !ok {
+						t.Fatalf("wrong operation type: got %T, want stellar.AccountMerge", ptx.Ops[0])
 					}
-					if op.Body.Destination.Address() != exporter.Address() {
-						t.Fatalf("wrong account merge destination: got %s, want %s", op.Body.Destination.Address(), exporter.Address())
+					if merge.Destination != exporter.Address() {
+						t.Fatalf("wrong account merge destination: got %s, want %s", merge.Destination, exporter.Address())
 					}
-					op = env.Tx.Operations[1]
-					if op.Body.Type != xdr.OperationTypePayment {
-						t.Fatalf("wrong operation type: got %s, want %s", op.Body.Type, xdr.OperationTypePayment)
+					paymentOp, ok := ptx.Ops[1].(stellar.Payment)
+					if !ok {
+						t.Fatalf("wrong operation type: got %T, want stellar.Payment", ptx.Ops[1])
 					}
-					paymentOp := op.Body.PaymentOp
-					if paymentOp.Destination.Address() != exporter.Address() {
-						t.Fatalf("incorrect payment destination got %s, want %s", paymentOp.Destination.Address(), exporter.Address())
+					if paymentOp.Destination != exporter.Address() {
+						t.Fatalf("incorrect payment destination got %s, want %s", paymentOp.Destination, exporter.Address())
 					}
-					if paymentOp.Amount != xdr.Int64(exportAmount) {
+					if paymentOp.Amount != int64(exportAmount) {
 						t.Fatalf("got incorrect payment amount %d, want %d", paymentOp.Amount, exportAmount)
 					}
-					if paymentOp.Asset.Type != xdr.AssetTypeAssetTypeNative {
-						t.Fatalf("got incorrect payment asset %s, want lumens", paymentOp.Asset.String())
+					if !paymentOp.Asset.IsNative() {
+						t.Fatalf("got incorrect payment asset %s, want lumens", stellar.AssetKey(paymentOp.Asset))
 					}
 				})
 				if err != nil {
@@ -544,7 +511,7 @@ func isImportTx(tx *bc.Tx, amount int64, assetXDR []byte, recipPubKey ed25519.Pu
 // {"X", ...}
 // {"L", ...}
 // {"F", ...}
-func isPostPegOutTx(tx *bc.Tx, asset xdr.Asset, amount int64, tempAddr, exporter string, seqnum int64, anchor, pubkey []byte) bool {
+func isPostPegOutTx(tx *bc.Tx, asset stellar.Asset, amount int64, tempAddr, exporter string, seqnum int64, anchor, pubkey []byte) bool {
 	if len(tx.Log) != 4 {
 		return false
 	}
@@ -607,6 +574,7 @@ func withTestServer(ctx context.Context, t *testing.T, fn func(context.Context,
 	if err != nil {
 		t.Fatal(err)
 	}
+	bs.Markers = blockMarkers
 
 	initialBlock, err := bs.GetBlock(ctx, 1)
 	if err != nil {
@@ -0,0 +1,250 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+// The end-to-end latency of a peg-in is from the custodian seeing its deposit
+// to its import tx, when the peg-in moves from paid to imported.
+// That of an export is from the custodian seeing its retirement
+// to its successful peg-out, when the export is recorded and when it moves to ok.
+// Both are read from state_events,
+// and rolled up into daily percentiles in peg_latency
+// once each UTC day is over.
+
+// latencyRollupInterval is how often rollUpLatencies
+// persists the percentiles of finished days.
+const latencyRollupInterval = time.Hour
+
+// maxSLODays is the most days /admin/slo reports.
+const maxSLODays = 366
+
+// latencyQueries select the completion time and latency of each peg-in
+// and export completed in a range of times.
+var latencyQueries = map[string]string{
+	"import": `SELECT done.time_ms, done.time_ms - seen.time_ms FROM state_events done
+		JOIN state_events seen ON seen.kind='peg-in' AND seen.key=done.key AND seen.to_state='paid'
+		WHERE done.kind='peg-in' AND done.to_state='imported' AND done.time_ms >= $1 AND done.time_ms < $2`,
+	"export": `SELECT done.time_ms, done.time_ms - seen.time_ms FROM state_events done
+		JOIN state_events seen ON seen.kind='export' AND seen.key=done.key AND seen.from_state=''
+		WHERE done.kind='export' AND done.to_state='ok' AND done.time_ms >= $1 AND done.time_ms < $2`,
+}
+
+// DayLatency is the latency of the peg-ins or exports
+// completed on one UTC day, in milliseconds.
+type DayLatency struct {
+	Day     string `json:"day"` // YYYY-MM-DD
+	Samples int    `json:"samples"`
+	P50MS   int64  `json:"p50_ms"`
+	P90MS   int64  `json:"p90_ms"`
+	P99MS   int64  `json:"p99_ms"`
+	MaxMS   int64  `json:"max_ms"`
+
+	// Met is whether P99MS is within the target,
+	// absent if there is no target or no samples.
+	Met *bool `json:"met,omitempty"`
+
+	// Partial marks the current day, which is not yet persisted.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// LatencyReport is the daily latency of peg-ins or exports
+// measured against their target, oldest day first.
+type LatencyReport struct {
+	TargetMS   int64        `json:"target_ms,omitempty"`
+	Days       []DayLatency `json:"days"`
+	DaysMet    int          `json:"days_met"`
+	DaysMissed int          `json:"days_missed"`
+}
+
+// SLOReport is the response of /admin/slo.
+type SLOReport struct {
+	Imports LatencyReport `json:"imports"`
+	Exports LatencyReport `json:"exports"`
+}
+
+// rollUpLatencies runs as a goroutine,
+// persisting the latency percentiles of each finished day
+// every latencyRollupInterval until ctx is canceled.
+func (c *Custodian) rollUpLatencies(ctx context.Context) {
+	defer log.Print("rollUpLatencies exiting")
+
+	ticker := time.NewTicker(latencyRollupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.rollUpLatency(ctx)
+		if err != nil {
+			log.Printf("rolling up peg latencies: %s", err)
+		}
+	}
+}
+
+// rollUpLatency records in peg_latency the percentiles
+// of each finished UTC day after the last one recorded,
+// starting from the day of the first completed peg-in or export.
+func (c *Custodian) rollUpLatency(ctx context.Context) error {
+	today := utcDay(c.nowMS())
+	var (
+		last  sql.NullString
+		first sql.NullInt64
+	)
+	err := c.DB.QueryRowContext(ctx, `SELECT MAX(day) FROM peg_latency`).Scan(&last)
+	if err != nil {
+		return errors.Wrap(err, "reading last rolled-up day")
+	}
+	var next time.Time
+	if last.Valid {
+		next, err = time.Parse("2006-01-02", last.String)
+		if err != nil {
+			return errors.Wrapf(err, "parsing rolled-up day %s", last.String)
+		}
+		next = next.AddDate(0, 0, 1)
+	} else {
+		const q = `SELECT MIN(time_ms) FROM state_events WHERE (kind='peg-in' AND to_state='imported') OR (kind='export' AND to_state='ok')`
+		err = c.DB.QueryRowContext(ctx, q).Scan(&first)
+		if err != nil {
+			return errors.Wrap(err, "reading first completion")
+		}
+		if !first.Valid {
+			return nil
+		}
+		next = utcDay(first.Int64)
+	}
+	for ; next.Before(today); next = next.AddDate(0, 0, 1) {
+		for _, kind := range []string{"import", "export"} {
+			d, err := c.dayLatency(ctx, kind, next)
+			if err != nil {
+				return err
+			}
+			const q = `INSERT OR IGNORE INTO peg_latency (day, kind, samples, p50_ms, p90_ms, p99_ms, max_ms) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+			_, err = c.DB.ExecContext(ctx, q, d.Day, kind, d.Samples, d.P50MS, d.P90MS, d.P99MS, d.MaxMS)
+			if err != nil {
+				return errors.Wrapf(err, "recording %s latency of %s", kind, d.Day)
+			}
+		}
+	}
+	return nil
+}
+
+// dayLatency computes the latency percentiles of the peg-ins or exports,
+// by kind, completed on the UTC day starting at day.
+func (c *Custodian) dayLatency(ctx context.Context, kind string, day time.Time) (DayLatency, error) {
+	d := DayLatency{Day: day.Format("2006-01-02")}
+	from := day.UnixNano() / int64(time.Millisecond)
+	to := day.AddDate(0, 0, 1).UnixNano() / int64(time.Millisecond)
+	var ms []int64
+	err := sqlutil.ForQueryRows(ctx, c.DB, latencyQueries[kind], from, to, func(_, latency int64) {
+		ms = append(ms, latency)
+	})
+	if err != nil {
+		return d, errors.Wrapf(err, "reading %s latencies of %s", kind, d.Day)
+	}
+	d.Samples = len(ms)
+	if len(ms) == 0 {
+		return d, nil
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	d.P50MS = percentile(ms, 50)
+	d.P90MS = percentile(ms, 90)
+	d.P99MS = percentile(ms, 99)
+	d.MaxMS = ms[len(ms)-1]
+	return d, nil
+}
+
+// percentile returns the nearest-rank pth percentile of sorted.
+func percentile(sorted []int64, p int) int64 {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+// utcDay returns the start of the UTC day of the time in milliseconds ms.
+func utcDay(ms int64) time.Time {
+	t := time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// SLO is the handler for /admin/slo,
+// reporting the daily peg latencies of the last days days,
+// 30 by default, against the targets in the slo config.
+// Finished days are rolled up first, so they are persisted,
+// and the current day is computed live.
+func (c *Custodian) SLO(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	days := 30
+	if s := req.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSLODays {
+			net.Errorf(w, http.StatusBadRequest, "days must be an integer from 1 to %d", maxSLODays)
+			return
+		}
+		days = n
+	}
+	err := c.rollUpLatency(ctx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	var report SLOReport
+	if cfg := c.config(); cfg != nil {
+		report.Imports.TargetMS = int64(time.Duration(cfg.SLO.ImportP99) / time.Millisecond)
+		report.Exports.TargetMS = int64(time.Duration(cfg.SLO.ExportP99) / time.Millisecond)
+	}
+	today := utcDay(c.nowMS())
+	since := today.AddDate(0, 0, 1-days).Format("2006-01-02")
+	for kind, r := range map[string]*LatencyReport{"import": &report.Imports, "export": &report.Exports} {
+		r.Days = []DayLatency{}
+		const q = `SELECT day, samples, p50_ms, p90_ms, p99_ms, max_ms FROM peg_latency WHERE kind=$1 AND day >= $2 ORDER BY day`
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, kind, since, func(day string, samples int, p50, p90, p99, max int64) {
+			r.Days = append(r.Days, DayLatency{Day: day, Samples: samples, P50MS: p50, P90MS: p90, P99MS: p99, MaxMS: max})
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "reading %s latencies: %s", kind, err)
+			return
+		}
+		d, err := c.dayLatency(ctx, kind, today)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		d.Partial = true
+		r.Days = append(r.Days, d)
+		for i := range r.Days {
+			d := &r.Days[i]
+			if r.TargetMS <= 0 || d.Samples == 0 {
+				continue
+			}
+			met := d.P99MS <= r.TargetMS
+			d.Met = &met
+			if d.Partial {
+				continue
+			}
+			if met {
+				r.DaysMet++
+			} else {
+				r.DaysMissed++
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
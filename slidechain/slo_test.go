@@ -0,0 +1,123 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/stellar/go/keypair"
+)
+
+func TestSLO(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	cfg.SLO.ImportP99 = config.Duration(99 * time.Second)
+	cfg.SLO.ExportP99 = config.Duration(time.Second)
+
+	day1 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := day1.Add(60 * time.Hour)
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := func(at time.Time, kind, key, from, to string) {
+			t.Helper()
+			const q = `INSERT INTO state_events (time_ms, kind, key, from_state, to_state) VALUES ($1, $2, $3, $4, $5)`
+			_, err := db.Exec(q, at.UnixNano()/int64(time.Millisecond), kind, []byte(key), from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// On day 1, 100 peg-ins take 1 to 100 seconds, and one export takes 5.
+		for i := 1; i <= 100; i++ {
+			seen := day1.Add(time.Duration(i) * time.Minute)
+			event(seen, "peg-in", fmt.Sprintf("peg %d", i), "recorded", "paid")
+			event(seen.Add(time.Duration(i)*time.Second), "peg-in", fmt.Sprintf("peg %d", i), "paid", "imported")
+		}
+		event(day1.Add(time.Hour), "export", "export 1", "", "not-yet")
+		event(day1.Add(time.Hour+5*time.Second), "export", "export 1", "not-yet", "ok")
+		// Day 2 is quiet, and one peg-in completes on day 3, today.
+		event(now.Add(-time.Minute), "peg-in", "peg today", "recorded", "paid")
+		event(now, "peg-in", "peg today", "paid", "imported")
+
+		report := func() SLOReport {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.SLO(w, httptest.NewRequest("GET", "/admin/slo?days=7", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+			}
+			var r SLOReport
+			err := json.NewDecoder(w.Body).Decode(&r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+		r := report()
+		report() // rolling up again changes nothing
+
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM peg_latency`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Errorf("got %d persisted day latencies, want 4, for 2 days of imports and exports", n)
+		}
+
+		imports := r.Imports.Days
+		if len(imports) != 3 {
+			t.Fatalf("got import days %+v, want 3", imports)
+		}
+		d := imports[0]
+		if d.Day != "2019-01-01" || d.Samples != 100 || d.P50MS != 50000 || d.P90MS != 90000 || d.P99MS != 99000 || d.MaxMS != 100000 {
+			t.Errorf("got day 1 imports %+v, want 100 samples with p50 50s, p90 90s, p99 99s, max 100s", d)
+		}
+		if d.Met == nil || !*d.Met {
+			t.Errorf("day 1 imports should meet a 99s target")
+		}
+		if d := imports[1]; d.Samples != 0 || d.Met != nil || d.Partial {
+			t.Errorf("got day 2 imports %+v, want no samples", d)
+		}
+		if d := imports[2]; d.Day != "2019-01-03" || !d.Partial || d.Samples != 1 || d.P99MS != 60000 {
+			t.Errorf("got today's imports %+v, want 1 partial sample of 60s", d)
+		}
+		if r.Imports.DaysMet != 1 || r.Imports.DaysMissed != 0 {
+			t.Errorf("got imports met %d days, missed %d, want 1 and 0", r.Imports.DaysMet, r.Imports.DaysMissed)
+		}
+
+		if d := r.Exports.Days[0]; d.Samples != 1 || d.P99MS != 5000 || d.Met == nil || *d.Met {
+			t.Errorf("got day 1 exports %+v, want one 5s sample missing a 1s target", d)
+		}
+		if r.Exports.TargetMS != 1000 || r.Exports.DaysMissed != 1 {
+			t.Errorf("got export target %dms missed %d days, want 1000ms and 1", r.Exports.TargetMS, r.Exports.DaysMissed)
+		}
+
+		w := httptest.NewRecorder()
+		c.SLO(w, httptest.NewRequest("GET", "/admin/slo?days=0", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for days=0, want 400", w.Code)
+		}
+	})
+}
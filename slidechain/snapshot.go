@@ -0,0 +1,218 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/net"
+)
+
+const utxoPin = "indexUTXOs"
+
+// Runs as a goroutine.
+func (c *Custodian) indexUTXOs(ctx context.Context) {
+	defer log.Println("indexUTXOs exiting")
+
+	c.RunPin(ctx, utxoPin, c.indexOutputs)
+}
+
+// indexOutputs records each standard pay-to-multisig output created in b
+// and marks each output b spends with its height,
+// so that balances can be computed as of any indexed height
+// after the blocks themselves have expired.
+// It keeps the account view of outputs locked by one pubkey alone current.
+func (c *Custodian) indexOutputs(ctx context.Context, b *bc.Block) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db tx")
+	}
+	defer dbtx.Rollback()
+
+	for _, tx := range b.Transactions {
+		for _, in := range tx.Inputs {
+			err = spendAccountOutput(ctx, dbtx, in.ID.Bytes())
+			if err != nil {
+				return err
+			}
+			_, err = dbtx.ExecContext(ctx, `UPDATE utxos SET spent_height=$1 WHERE output_id=$2 AND spent_height IS NULL`, b.Height, in.ID.Bytes())
+			if err != nil {
+				return errors.Wrapf(err, "recording spend of output %x", in.ID.Bytes())
+			}
+		}
+		for _, out := range tx.Outputs {
+			m, ok := multisigFromOutput(out)
+			if !ok {
+				continue
+			}
+			var pubkeys []byte
+			for _, p := range m.Pubkeys {
+				pubkeys = append(pubkeys, p...)
+			}
+			const q = `INSERT OR IGNORE INTO utxos (output_id, pubkeys, quorum, txvm_asset, amount, height, anchor) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+			res, err := dbtx.ExecContext(ctx, q, out.ID.Bytes(), pubkeys, m.Quorum, m.AssetID, m.Amount, b.Height, m.Anchor)
+			if err != nil {
+				return errors.Wrapf(err, "recording output %x", out.ID.Bytes())
+			}
+			if n, _ := res.RowsAffected(); n == 1 && m.Quorum == 1 && len(m.Pubkeys) == 1 {
+				err = creditAccount(ctx, dbtx, m)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return dbtx.Commit()
+}
+
+// A balanceSnapshot is the value held in standard pay-to-multisig outputs
+// as of a block, by signers and asset.
+type balanceSnapshot struct {
+	Height   uint64       `json:"height"`
+	BlockID  string       `json:"block_id"`
+	Balances []keyBalance `json:"balances"`
+}
+
+// A keyBalance is the value of one asset
+// locked by one set of signers with one quorum.
+type keyBalance struct {
+	Pubkeys []string `json:"pubkeys"`
+	Quorum  int64    `json:"quorum"`
+	AssetID string   `json:"asset_id"`
+	Asset   string   `json:"asset,omitempty"` // main-chain asset or wrapped code, if known
+	Amount  int64    `json:"amount"`
+	Outputs int64    `json:"outputs"`
+}
+
+// balancesAt computes the balance snapshot as of the block at height,
+// which must have been indexed.
+func (c *Custodian) balancesAt(ctx context.Context, height uint64) (*balanceSnapshot, error) {
+	var bits []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT bits FROM block_headers WHERE height=$1`, height).Scan(&bits)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading header of block %d", height)
+	}
+	var b bc.Block
+	err = b.FromBytes(bits)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing header of block %d", height)
+	}
+	names, err := c.assetNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snap := &balanceSnapshot{
+		Height:   height,
+		BlockID:  hex.EncodeToString(b.Hash().Bytes()),
+		Balances: []keyBalance{},
+	}
+	const q = `SELECT pubkeys, quorum, txvm_asset, SUM(amount), COUNT(*) FROM utxos
+		WHERE height <= $1 AND (spent_height IS NULL OR spent_height > $1)
+		GROUP BY pubkeys, quorum, txvm_asset ORDER BY pubkeys, quorum, txvm_asset`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, height, func(pubkeys []byte, quorum int64, assetID []byte, amount, outputs int64) {
+		kb := keyBalance{
+			Quorum:  quorum,
+			AssetID: hex.EncodeToString(assetID),
+			Asset:   names[bc.HashFromBytes(assetID)],
+			Amount:  amount,
+			Outputs: outputs,
+		}
+		for ; len(pubkeys) >= ed25519.PublicKeySize; pubkeys = pubkeys[ed25519.PublicKeySize:] {
+			kb.Pubkeys = append(kb.Pubkeys, hex.EncodeToString(pubkeys[:ed25519.PublicKeySize]))
+		}
+		snap.Balances = append(snap.Balances, kb)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "summing outputs")
+	}
+	return snap, nil
+}
+
+// assetNames maps the txvm asset IDs of the assets the custodian knows,
+// under every issuance version, to their names.
+func (c *Custodian) assetNames(ctx context.Context) (map[bc.Hash]string, error) {
+	names := make(map[bc.Hash]string)
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs`, func(assetXDR []byte) {
+		for _, ic := range issuanceContracts {
+			names[ic.assetID(assetXDR)] = assetName(assetXDR)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading pegged assets")
+	}
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT code, txvm_asset FROM wrapped_assets`, func(code string, txvmAsset []byte) {
+		names[bc.HashFromBytes(txvmAsset)] = code
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading wrapped assets")
+	}
+	return names, nil
+}
+
+// Snapshot is the admin handler for /admin/snapshot,
+// serving the balance of each set of signers in each asset
+// as of the block at the height parameter,
+// by default the latest indexed block.
+// With format=csv it serves CSV, one row per balance;
+// otherwise JSON.
+func (c *Custodian) Snapshot(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var indexed uint64
+	err := c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name=$1`, utxoPin).Scan(&indexed)
+	if err != nil && err != sql.ErrNoRows {
+		net.Errorf(w, http.StatusInternalServerError, "reading indexed height: %s", err)
+		return
+	}
+	height := indexed
+	if s := req.FormValue("height"); s != "" {
+		height, err = strconv.ParseUint(s, 10, 64)
+		if err != nil || height == 0 {
+			net.Errorf(w, http.StatusBadRequest, "height must be a positive integer")
+			return
+		}
+	}
+	if height == 0 || height > indexed {
+		net.Errorf(w, http.StatusConflict, "outputs are indexed only through block %d", indexed)
+		return
+	}
+	snap, err := c.balancesAt(ctx, height)
+	if errors.Root(err) == sql.ErrNoRows {
+		net.Errorf(w, http.StatusConflict, "block %d is not yet indexed", height)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "computing snapshot: %s", err)
+		return
+	}
+	if req.FormValue("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snap)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"height", "block_id", "pubkeys", "quorum", "asset_id", "asset", "amount", "outputs"})
+	for _, kb := range snap.Balances {
+		cw.Write([]string{
+			strconv.FormatUint(snap.Height, 10),
+			snap.BlockID,
+			strings.Join(kb.Pubkeys, " "),
+			strconv.FormatInt(kb.Quorum, 10),
+			kb.AssetID,
+			kb.Asset,
+			strconv.FormatInt(kb.Amount, 10),
+			strconv.FormatInt(kb.Outputs, 10),
+		})
+	}
+	cw.Flush()
+}
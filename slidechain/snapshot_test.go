@@ -0,0 +1,135 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	native := stellar.NativeAsset()
+	assetXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, prv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, server *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:             s,
+			DB:            db,
+			privkey:       custodianPrv,
+			InitBlockHash: chain.InitialBlockHash,
+		}
+		_, err := db.Exec(`INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, 10, $2, $3, 1, $4)`, []byte("nonce"), assetXDR, []byte(pub), pegInImported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := func() uint64 {
+			t.Helper()
+			_, err := c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			height, err := c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return height
+		}
+		get := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			c.Snapshot(w, httptest.NewRequest("GET", "/admin/snapshot?"+query, nil))
+			return w
+		}
+		balances := func(height uint64) []keyBalance {
+			t.Helper()
+			w := get(fmt.Sprintf("height=%d", height))
+			if w.Code != http.StatusOK {
+				t.Fatalf("snapshot at %d: got status %d: %s", height, w.Code, w.Body)
+			}
+			var snap balanceSnapshot
+			err := json.NewDecoder(w.Body).Decode(&snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []keyBalance
+			for _, kb := range snap.Balances {
+				if len(kb.Pubkeys) == 1 && kb.Pubkeys[0] == hex.EncodeToString(pub) {
+					got = append(got, kb)
+				}
+			}
+			return got
+		}
+
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		v1Import := importTestPeg(ctx, t, c, issuanceContracts[1], assetXDR, pub, 10, expMS)
+		imported := index()
+		v1Asset := issuanceContracts[1].assetID(assetXDR)
+		got := balances(imported)
+		if len(got) != 1 || got[0].AssetID != hex.EncodeToString(v1Asset.Bytes()) || got[0].Amount != 10 || got[0].Asset != assetName(assetXDR) {
+			t.Errorf("after import got balances %+v, want 10 of %x", got, v1Asset.Bytes())
+		}
+
+		anchor := txvm.VMHash("Split1", v1Import.Issuances[0].Anchor)
+		migrateTx, err := BuildMigrateTx(ctx, native, 2, 10, anchor[:], prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitTestTx(ctx, t, c, migrateTx)
+		migrated := index()
+		v2Asset := issuanceContracts[2].assetID(assetXDR)
+		got = balances(migrated)
+		if len(got) != 1 || got[0].AssetID != hex.EncodeToString(v2Asset.Bytes()) || got[0].Amount != 10 {
+			t.Errorf("after migration got balances %+v, want 10 of %x", got, v2Asset.Bytes())
+		}
+		// The earlier snapshot is unchanged.
+		got = balances(imported)
+		if len(got) != 1 || got[0].AssetID != hex.EncodeToString(v1Asset.Bytes()) {
+			t.Errorf("at import height got balances %+v after migration, want 10 of %x", got, v1Asset.Bytes())
+		}
+
+		w := get("format=csv")
+		if w.Code != http.StatusOK {
+			t.Fatalf("csv snapshot: got status %d: %s", w.Code, w.Body)
+		}
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, row := range rows[1:] {
+			if row[0] != fmt.Sprint(migrated) {
+				t.Errorf("csv row %v not at height %d", row, migrated)
+			}
+			if row[2] == hex.EncodeToString(pub) && row[4] == hex.EncodeToString(v2Asset.Bytes()) && row[6] == "10" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("migrated balance not in csv snapshot %v", rows)
+		}
+
+		if w := get(fmt.Sprintf("height=%d", migrated+1)); w.Code != http.StatusConflict {
+			t.Errorf("snapshot past indexed height: got status %d, want %d", w.Code, http.StatusConflict)
+		}
+	})
+}
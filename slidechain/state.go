@@ -0,0 +1,190 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// pegInState is the state of a peg-in,
+// in the state column of the pegs table.
+type pegInState int
+
+const (
+	// The pre-peg-in tx is on txvm; the Stellar payment is awaited.
+	pegInRecorded pegInState = iota
+
+	// The payment to the custodian has been seen on Stellar.
+	pegInPaid
+
+	// The import tx has been submitted to txvm.
+	pegInImported
+
+	// No payment arrived within pegin.intent_ttl.
+	// An expired peg-in is moved from pegs to expired_pegs,
+	// whose state column cannot hold it, by expirePegIn.
+	pegInExpired
+)
+
+var pegInStateNames = []string{"recorded", "paid", "imported", "expired"}
+
+func (s pegInState) String() string {
+	if s < 0 || int(s) >= len(pegInStateNames) {
+		return fmt.Sprintf("peg-in state %d", int(s))
+	}
+	return pegInStateNames[s]
+}
+
+// pegInTransitions lists the allowed changes of a peg-in's state.
+var pegInTransitions = map[pegInState][]pegInState{
+	pegInRecorded: {pegInPaid, pegInExpired},
+	pegInPaid:     {pegInImported},
+}
+
+var pegOutStateNames = []string{"not-yet", "ok", "retry", "fail", "retired", "refunded"}
+
+func (s pegOutState) String() string {
+	if s < 0 || int(s) >= len(pegOutStateNames) {
+		return fmt.Sprintf("peg-out state %d", int(s))
+	}
+	return pegOutStateNames[s]
+}
+
+// pegOutTransitions lists the allowed changes of an export's state.
+// A retried peg-out may need retrying again.
+var pegOutTransitions = map[pegOutState][]pegOutState{
+	pegOutNotYet: {pegOutOK, pegOutRetry, pegOutFail},
+	pegOutRetry:  {pegOutOK, pegOutRetry, pegOutFail},
+	pegOutOK:     {pegOutRetired},
+	pegOutFail:   {pegOutRefunded},
+}
+
+// transitionPegIn moves the peg-in with the given nonce hash
+// from state from to state to,
+// applying any other db updates in the same db transaction.
+// It reports false, changing nothing,
+// if there is no such peg-in in state from.
+// Expiry, which moves the peg-in out of pegs, is done by expirePegIn.
+// Importing it accrues its partner fee.
+func (c *Custodian) transitionPegIn(ctx context.Context, nonceHash []byte, from, to pegInState, updates ...func(*sql.Tx) error) (bool, error) {
+	if !pegInAllowed(from, to) || to == pegInExpired {
+		return false, fmt.Errorf("peg-in %x: transition from %s to %s not allowed", nonceHash, from, to)
+	}
+	if to == pegInImported {
+		updates = append(updates, c.accruePartnerFee(ctx, "import", nonceHash))
+	}
+	return c.transition(ctx, "peg-in", "pegs", "nonce_hash", "state", nonceHash, int(from), int(to), from.String(), to.String(), updates)
+}
+
+// transitionPegOut moves the export with the given txvm tx ID
+// from state from to state to,
+// applying any other db updates in the same db transaction.
+// It reports false, changing nothing,
+// if there is no such export in state from.
+// Retiring it accrues its partner fee.
+func (c *Custodian) transitionPegOut(ctx context.Context, txid []byte, from, to pegOutState, updates ...func(*sql.Tx) error) (bool, error) {
+	if !pegOutAllowed(from, to) {
+		return false, fmt.Errorf("export %x: transition from %s to %s not allowed", txid, from, to)
+	}
+	if to == pegOutRetired {
+		updates = append(updates, c.accruePartnerFee(ctx, "export", txid))
+	}
+	return c.transition(ctx, "export", "exports", "txid", "pegged_out", txid, int(from), int(to), from.String(), to.String(), updates)
+}
+
+// movePegOut moves an export from one state to another,
+// failing if it is no longer in the first.
+func (c *Custodian) movePegOut(ctx context.Context, txid []byte, from, to pegOutState) error {
+	ok, err := c.transitionPegOut(ctx, txid, from, to)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("export %x is no longer in state %s", txid, from)
+	}
+	return nil
+}
+
+func pegInAllowed(from, to pegInState) bool {
+	for _, s := range pegInTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func pegOutAllowed(from, to pegOutState) bool {
+	for _, s := range pegOutTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition changes the state column of the row of table with the given key,
+// records the change in the state_events table,
+// and applies the updates,
+// atomically.
+func (c *Custodian) transition(ctx context.Context, kind, table, keyCol, stateCol string, key []byte, from, to int, fromName, toName string, updates []func(*sql.Tx) error) (bool, error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	q := fmt.Sprintf(`UPDATE %s SET %s=$1 WHERE %s=$2 AND %s=$3`, table, stateCol, keyCol, stateCol)
+	res, err := dbtx.ExecContext(ctx, q, to, key, from)
+	if err != nil {
+		return false, errors.Wrapf(err, "moving %s %x to state %s", kind, key, toName)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected moving %s %x to state %s", kind, key, toName)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if n != 1 {
+		return false, fmt.Errorf("moving %s %x to state %s affected %d rows, want 1", kind, key, toName, n)
+	}
+	err = recordStateEvent(ctx, dbtx, c.nowMS(), kind, key, fromName, toName)
+	if err != nil {
+		return false, err
+	}
+	for _, update := range updates {
+		err = update(dbtx)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "committing %s %x state change", kind, key)
+	}
+	log.Printf("%s %x: %s -> %s", kind, key, fromName, toName)
+	return true, nil
+}
+
+// recordStateEvent records a state change of a peg-in or export.
+// A new peg-in or export has an empty from state.
+func recordStateEvent(ctx context.Context, dbtx *sql.Tx, timeMS int64, kind string, key []byte, from, to string) error {
+	const q = `INSERT INTO state_events (time_ms, kind, key, from_state, to_state) VALUES ($1, $2, $3, $4, $5)`
+	_, err := dbtx.ExecContext(ctx, q, timeMS, kind, key, from, to)
+	return errors.Wrapf(err, "recording %s %x state event", kind, key)
+}
+
+// nowMS is the custodian's current time in milliseconds,
+// for timestamping db records.
+func (c *Custodian) nowMS() int64 {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	return now().UnixNano() / int64(time.Millisecond)
+}
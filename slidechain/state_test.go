@@ -0,0 +1,145 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func withTestDB(t *testing.T, fn func(*sql.DB)) {
+	f, err := ioutil.TempFile("", "slidechainstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile := f.Name()
+	f.Close()
+	defer os.Remove(tmpfile)
+
+	db, err := sql.Open("sqlite3", tmpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fn(db)
+}
+
+func TestTransitions(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{
+			DB:  db,
+			now: func() time.Time { return time.Unix(1, 0) },
+		}
+		nonceHash := []byte("nonce hash")
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, recipient_pubkey, nonce_expms, state) VALUES ($1, $2, 0, $3)`, nonceHash, []byte{}, pegInRecorded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.transitionPegIn(ctx, nonceHash, pegInRecorded, pegInImported)
+		if err == nil {
+			t.Error("got no error skipping from recorded to imported")
+		}
+		ok, err := c.transitionPegIn(ctx, nonceHash, pegInPaid, pegInImported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("moved a recorded peg-in as if it were paid")
+		}
+		for _, to := range []pegInState{pegInPaid, pegInImported} {
+			ok, err = c.transitionPegIn(ctx, nonceHash, to-1, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Errorf("peg-in not moved to %s", to)
+			}
+		}
+
+		rows, err := db.Query(`SELECT time_ms, from_state, to_state FROM state_events WHERE kind='peg-in' AND key=$1 ORDER BY id`, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var (
+				timeMS   int64
+				from, to string
+			)
+			err = rows.Scan(&timeMS, &from, &to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if timeMS != 1000 {
+				t.Errorf("got event time %d, want 1000", timeMS)
+			}
+			got = append(got, from+" -> "+to)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"recorded -> paid", "paid -> imported"}
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("got events %q, want %q", got, want)
+		}
+
+		_, err = c.transitionPegOut(ctx, []byte("txid"), pegOutOK, pegOutRefunded)
+		if err == nil {
+			t.Error("got no error refunding a successful peg-out")
+		}
+	})
+}
+
+func TestMigrateSchema(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		_, err := db.Exec(`
+CREATE TABLE pegs (
+  nonce_hash BLOB NOT NULL,
+  amount INTEGER,
+  asset_xdr BLOB,
+  recipient_pubkey BLOB NOT NULL,
+  imported INTEGER NOT NULL DEFAULT 0,
+  stellar_tx INTEGER NOT NULL DEFAULT 0,
+  nonce_expms INTEGER NOT NULL,
+  PRIMARY KEY (nonce_hash)
+);
+INSERT INTO pegs (nonce_hash, recipient_pubkey, imported, stellar_tx, nonce_expms) VALUES
+  ('a', '', 0, 0, 0),
+  ('b', '', 0, 1, 0),
+  ('c', '', 1, 1, 0);
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]pegInState{"a": pegInRecorded, "b": pegInPaid, "c": pegInImported}
+		for nonceHash, wantState := range want {
+			var state pegInState
+			err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != wantState {
+				t.Errorf("peg-in %s: got state %s, want %s", nonceHash, state, wantState)
+			}
+		}
+
+		// Migrating again changes nothing.
+		err = setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -7,9 +7,8 @@ import (
 	"net/http"
 
 	"github.com/pkg/errors"
-	b "github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
 )
 
 // NewFundedAccount generates a random keypair, creates
@@ -28,9 +27,17 @@ func NewFundedAccount() *keypair.Full {
 	return kp
 }
 
+// TestnetFriendbot is the URL of the Stellar testnet friendbot.
+const TestnetFriendbot = "https://friendbot.stellar.org"
+
 // FundAccount gets friendbot funds for an account on the Stellar testnet
 func FundAccount(address string) error {
-	resp, err := http.Get("https://friendbot.stellar.org/?addr=" + address)
+	return FundAccountFrom(TestnetFriendbot, address)
+}
+
+// FundAccountFrom gets funds for an account from the friendbot at friendbotURL.
+func FundAccountFrom(friendbotURL, address string) error {
+	resp, err := http.Get(friendbotURL + "?addr=" + address)
 	if err != nil {
 		return errors.Wrap(err, "requesting friendbot lumens")
 	}
@@ -45,45 +52,78 @@ func FundAccount(address string) error {
 	return nil
 }
 
+// TopUpFrom gets funds from the friendbot at friendbotURL
+// for the existing account at address.
+// Friendbot only funds new accounts,
+// so this funds a random one and merges it into address.
+func TopUpFrom(hclient Client, friendbotURL, passphrase, address string) error {
+	kp, err := keypair.Random()
+	if err != nil {
+		return errors.Wrap(err, "generating random keypair")
+	}
+	err = FundAccountFrom(friendbotURL, kp.Address())
+	if err != nil {
+		return err
+	}
+	_, err = NewSequencer(hclient).Submit(kp.Address(), func(seqnum SequenceNumber) (*Tx, error) {
+		return &Tx{
+			Network: passphrase,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			Ops:     []Op{AccountMerge{Destination: address}},
+		}, nil
+	}, kp.Seed())
+	return errors.Wrapf(err, "merging friendbot-funded account into %s", address)
+}
+
 // IssueAsset issues an asset from the specified seed account
 // to the destination account.
-func IssueAsset(hclient *horizon.Client, seed, code, amount, destination string) error {
+func IssueAsset(hclient Client, seed, code, amount, destination string) error {
 	kp, err := keypair.Parse(seed)
 	if err != nil {
 		return err
 	}
-	tx, err := b.Transaction(
-		b.SourceAccount{AddressOrSeed: seed},
-		b.TestNetwork,
-		b.AutoSequence{SequenceProvider: hclient},
-		b.Payment(
-			b.Destination{AddressOrSeed: destination},
-			b.CreditAmount{
-				Code:   code,
-				Issuer: kp.Address(),
-				Amount: amount,
-			},
-		),
-	)
+	asset, err := NewAsset(code, kp.Address())
 	if err != nil {
-		return errors.Wrap(err, "building tx")
+		return err
+	}
+	stroops, err := ParseAmount(amount)
+	if err != nil {
+		return err
 	}
-	_, err = SignAndSubmitTx(hclient, tx, seed)
+	_, err = NewSequencer(hclient).Submit(kp.Address(), func(seqnum SequenceNumber) (*Tx, error) {
+		return &Tx{
+			Network: network.TestNetworkPassphrase,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			Ops: []Op{Payment{
+				Destination: destination,
+				Asset:       asset,
+				Amount:      stroops,
+			}},
+		}, nil
+	}, seed)
 	return err
 }
 
 // TrustAsset issues a trustline from the seed account for the specified
 // asset code and issuer.
-func TrustAsset(hclient *horizon.Client, seed, code, issuer string) error {
-	tx, err := b.Transaction(
-		b.SourceAccount{AddressOrSeed: seed},
-		b.TestNetwork,
-		b.AutoSequence{SequenceProvider: hclient},
-		b.Trust(code, issuer),
-	)
+func TrustAsset(hclient Client, seed, code, issuer string) error {
+	kp, err := keypair.Parse(seed)
 	if err != nil {
-		return errors.Wrap(err, "building tx")
+		return err
+	}
+	asset, err := NewAsset(code, issuer)
+	if err != nil {
+		return err
 	}
-	_, err = SignAndSubmitTx(hclient, tx, seed)
+	_, err = NewSequencer(hclient).Submit(kp.Address(), func(seqnum SequenceNumber) (*Tx, error) {
+		return &Tx{
+			Network: network.TestNetworkPassphrase,
+			Source:  kp.Address(),
+			SeqNum:  seqnum,
+			Ops:     []Op{ChangeTrust{Asset: asset, Limit: MaxTrustLimit}},
+		}, nil
+	}, seed)
 	return err
 }
@@ -0,0 +1,32 @@
+package stellar
+
+import (
+	"fmt"
+
+	"github.com/stellar/go/amount"
+)
+
+// Stellar amounts are int64 counts of stroops,
+// 10^-7 units of an asset, for lumens and credit assets alike.
+// Horizon and txnbuild give and take them
+// as decimal strings of whole units.
+
+// FormatAmount returns stroops as a decimal string of whole units.
+func FormatAmount(stroops int64) string {
+	return amount.StringFromInt64(stroops)
+}
+
+// ParseAmount parses a decimal string of whole units into stroops.
+// It is an error if the string is negative,
+// has more than 7 decimal places,
+// or overflows an int64.
+func ParseAmount(s string) (int64, error) {
+	n, err := amount.ParseInt64(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative amount %s", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,57 @@
+package stellar
+
+import (
+	"math"
+	"testing"
+	"testing/quick"
+)
+
+func TestAmountRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, 9999999, 10000000, 10000001, math.MaxInt64 - 1, math.MaxInt64} {
+		got, err := ParseAmount(FormatAmount(n))
+		if err != nil {
+			t.Errorf("parsing %s: %s", FormatAmount(n), err)
+		} else if got != n {
+			t.Errorf("%d round-trips to %d", n, got)
+		}
+	}
+	err := quick.Check(func(n int64) bool {
+		if n < 0 {
+			n = -(n + 1)
+		}
+		got, err := ParseAmount(FormatAmount(n))
+		return err == nil && got == n
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"1", 10000000, true},
+		{"1.5", 15000000, true},
+		{"0.0000001", 1, true},
+		{"922337203685.4775807", math.MaxInt64, true},
+		{"922337203685.4775808", 0, false},
+		{"1000000000000000", 0, false},
+		{"0.00000001", 0, false},
+		{"-1", 0, false},
+		{"", 0, false},
+		{"1e3", 0, false},
+	}
+	for _, tc := range cases {
+		got, err := ParseAmount(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseAmount(%q): got error %v, want ok %t", tc.s, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseAmount(%q) = %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
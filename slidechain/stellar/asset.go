@@ -0,0 +1,65 @@
+package stellar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stellar/go/strkey"
+)
+
+// Asset is a Stellar asset:
+// lumens, the native asset,
+// or a credit asset, by its code and the address of its issuer.
+// The zero Asset is lumens.
+// Assets are stored and hashed in their XDR encoding;
+// see MarshalBinary and DecodeAsset.
+type Asset struct {
+	Code   string
+	Issuer string
+}
+
+// NativeAsset returns the Asset of lumens.
+func NativeAsset() Asset {
+	return Asset{}
+}
+
+// NewAsset returns the credit asset with the given code and issuer.
+func NewAsset(code, issuer string) (Asset, error) {
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, issuer); err != nil {
+		return Asset{}, fmt.Errorf("invalid asset issuer %q", issuer)
+	}
+	if code == "" {
+		return Asset{}, errors.New("invalid asset code: empty")
+	}
+	if len(code) > 12 {
+		return Asset{}, errors.New("invalid asset code: max 12 characters")
+	}
+	return Asset{Code: code, Issuer: issuer}, nil
+}
+
+// IsNative reports whether a is lumens.
+func (a Asset) IsNative() bool {
+	return a == Asset{}
+}
+
+// AssetKey returns the canonical string form of an asset:
+// "native" for lumens, or "CODE:ISSUER" for credit assets.
+func AssetKey(asset Asset) string {
+	if asset.IsNative() {
+		return "native"
+	}
+	return asset.Code + ":" + asset.Issuer
+}
+
+// ParseAssetKey parses the string form produced by AssetKey.
+func ParseAssetKey(s string) (Asset, error) {
+	if s == "native" {
+		return NativeAsset(), nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || parts[0] == "" {
+		return Asset{}, fmt.Errorf("invalid asset %q: want native or CODE:ISSUER", s)
+	}
+	return NewAsset(parts[0], parts[1])
+}
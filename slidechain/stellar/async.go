@@ -0,0 +1,227 @@
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chain/txvm/errors"
+	"github.com/stellar/go/xdr"
+)
+
+// asyncPollInterval is how often SignAndSubmitTxAsync
+// looks up a submitted tx until it is in a ledger.
+const asyncPollInterval = time.Second
+
+// asyncResponse is Horizon's response to POST /transactions_async.
+type asyncResponse struct {
+	Status         string `json:"tx_status"` // PENDING, DUPLICATE, TRY_AGAIN_LATER, or ERROR
+	Hash           string `json:"hash"`
+	ErrorResultXDR string `json:"error_result_xdr"`
+}
+
+// SignAndSubmitTxAsync signs tx with seeds
+// and submits it through Horizon's /transactions_async endpoint,
+// which returns as soon as Stellar Core has accepted (or rejected) it,
+// then looks the tx up by hash until it is in a closed ledger or ctx is done.
+// Unlike synchronous submission,
+// no Horizon request is held open while the network is congested.
+//
+// A rejected or failed tx is reported as a *HorizonError
+// with result codes, as by SignAndSubmitTx.
+// If ctx is done first, the error has none:
+// the tx may still be applied.
+// The Client interface has no call for this,
+// so hclient must be a *HorizonClient.
+func SignAndSubmitTxAsync(ctx context.Context, hclient Client, tx *Tx, seeds ...string) (*TransactionSuccess, error) {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return nil, errors.New("async submission needs an HTTP Horizon client")
+	}
+	txstr, err := tx.Sign(seeds...)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing tx")
+	}
+	base := strings.TrimRight(hc.URL, "/")
+	resp, err := withContext(ctx, hc).PostForm(base+"/transactions_async", url.Values{"tx": {txstr}})
+	if err != nil {
+		return nil, errors.Wrap(err, "submitting tx")
+	}
+	defer resp.Body.Close()
+	var ar asyncResponse
+	err = json.NewDecoder(resp.Body).Decode(&ar)
+	if err != nil || ar.Status == "" {
+		return nil, fmt.Errorf("submitting tx: status %s", resp.Status)
+	}
+	switch ar.Status {
+	case "PENDING", "DUPLICATE":
+		log.Printf("submitted Stellar tx %s, waiting for it to be applied", ar.Hash)
+	case "ERROR":
+		log.Printf("error submitting tx %s\ntx: %s\nresult: %s", ar.Hash, txstr, ar.ErrorResultXDR)
+		return nil, resultXDRError(resp, ar.ErrorResultXDR, txstr)
+	default:
+		// TRY_AGAIN_LATER: Core did not accept the tx, which may be resubmitted.
+		return nil, fmt.Errorf("submitting tx %s: %s", ar.Hash, ar.Status)
+	}
+	return waitForTx(ctx, hc, ar.Hash)
+}
+
+// waitForTx looks up the tx with the given hash
+// until it is in a closed ledger or ctx is done.
+func waitForTx(ctx context.Context, hc *HorizonClient, hash string) (*TransactionSuccess, error) {
+	u := fmt.Sprintf("%s/transactions/%s", strings.TrimRight(hc.URL, "/"), hash)
+	for {
+		resp, err := withContext(ctx, hc).Get(u)
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusOK {
+				return appliedTx(resp, body)
+			}
+			if err == nil && resp.StatusCode != http.StatusNotFound {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("looking up Stellar tx %s: %s", hash, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "waiting for tx %s", hash)
+		case <-time.After(asyncPollInterval):
+		}
+	}
+}
+
+// appliedTx is the result of the tx in a GET /transactions/{hash} response body,
+// which Horizon serves for failed txs too, with successful false.
+func appliedTx(resp *http.Response, body []byte) (*TransactionSuccess, error) {
+	var tx Transaction
+	err := json.Unmarshal(body, &tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding tx")
+	}
+	var status struct {
+		Successful *bool `json:"successful"`
+	}
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding tx")
+	}
+	if status.Successful != nil && !*status.Successful {
+		return nil, resultXDRError(resp, tx.ResultXdr, tx.EnvelopeXdr)
+	}
+	return &TransactionSuccess{
+		Hash:   tx.Hash,
+		Ledger: tx.Ledger,
+		Env:    tx.EnvelopeXdr,
+		Result: tx.ResultXdr,
+		Meta:   tx.ResultMetaXdr,
+	}, nil
+}
+
+// resultXDRError is the *HorizonError that synchronous submission
+// would have returned for the tx with the given result,
+// with its result codes.
+func resultXDRError(resp *http.Response, resultXDR, envXDR string) error {
+	var res xdr.TransactionResult
+	err := xdr.SafeUnmarshalBase64(resultXDR, &res)
+	if err != nil {
+		return errors.Wrapf(err, "decoding tx result %q", resultXDR)
+	}
+	extras := make(map[string]json.RawMessage)
+	for k, v := range map[string]interface{}{
+		"result_codes": resultCodes(res),
+		"result_xdr":   resultXDR,
+		"envelope_xdr": envXDR,
+	} {
+		extras[k], _ = json.Marshal(v)
+	}
+	return &HorizonError{
+		Response: resp,
+		Problem: Problem{
+			Type:   "https://stellar.org/horizon-errors/transaction_failed",
+			Title:  "Transaction Failed",
+			Status: http.StatusBadRequest,
+			Extras: extras,
+		},
+	}
+}
+
+// resultCodes gives the codes of res by the short names Horizon reports them with,
+// such as tx_bad_seq and op_no_trust.
+func resultCodes(res xdr.TransactionResult) TransactionResultCodes {
+	codes := TransactionResultCodes{
+		TransactionCode: codeName(strings.TrimPrefix(res.Result.Code.String(), "TransactionResultCode")),
+	}
+	if res.Result.Results == nil {
+		return codes
+	}
+	for _, op := range *res.Result.Results {
+		codes.OperationCodes = append(codes.OperationCodes, opCodeName(op))
+	}
+	return codes
+}
+
+// opCodeName is the Horizon name of the code of an operation result.
+// Horizon drops the operation type from the names of inner codes:
+// PaymentResultCodePaymentNoTrust is op_no_trust.
+func opCodeName(op xdr.OperationResult) string {
+	switch op.Code {
+	case xdr.OperationResultCodeOpInner:
+	case xdr.OperationResultCodeOpNoAccount:
+		return "op_no_source_account"
+	default:
+		return codeName(strings.TrimPrefix(op.Code.String(), "OperationResultCode"))
+	}
+	if op.Tr == nil {
+		return "op_inner"
+	}
+	// The inner result is the one non-nil pointer arm of the union.
+	tr := reflect.ValueOf(*op.Tr)
+	for i := 0; i < tr.NumField(); i++ {
+		f := tr.Field(i)
+		if f.Kind() != reflect.Ptr || f.IsNil() || f.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		c := f.Elem().FieldByName("Code")
+		if !c.IsValid() {
+			break
+		}
+		code, ok := c.Interface().(fmt.Stringer)
+		if !ok {
+			break
+		}
+		// E.g. PaymentResultCode, then Payment, then the code.
+		name := code.String()
+		if i := strings.Index(name, "ResultCode"); i > 0 {
+			name = strings.TrimPrefix(name[i+len("ResultCode"):], name[:i])
+		}
+		return "op_" + codeName(name)
+	}
+	return "op_inner"
+}
+
+// codeName converts an xdr code name such as TxBadSeq to tx_bad_seq.
+func codeName(s string) string {
+	var out []rune
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				out = append(out, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
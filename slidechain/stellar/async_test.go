@@ -0,0 +1,91 @@
+package stellar_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+)
+
+func TestSignAndSubmitTxAsync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := horizonmock.New()
+	defer srv.Close()
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(from.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(to.Address(), horizonmock.FriendbotAmount)
+
+	hclient := srv.Client()
+	seqnum, err := hclient.SequenceForAccount(from.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &stellar.Tx{
+		Network: srv.Passphrase,
+		Source:  from.Address(),
+		SeqNum:  seqnum + 1,
+		Ops:     []stellar.Op{stellar.Payment{Destination: to.Address(), Amount: 1e7}},
+	}
+	hash, err := stellar.TxHash(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	succ, err := stellar.SignAndSubmitTxAsync(ctx, hclient, tx, from.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if succ.Hash != hash || succ.Ledger == 0 {
+		t.Errorf("got tx %s in ledger %d, want %s in a ledger", succ.Hash, succ.Ledger, hash)
+	}
+
+	// The same tx again reuses its sequence number.
+	_, err = stellar.SignAndSubmitTxAsync(ctx, hclient, tx, from.Seed())
+	if !stellar.IsBadSeq(err) {
+		t.Errorf("got error %v resubmitting tx, want tx_bad_seq", err)
+	}
+}
+
+func TestResultCodes(t *testing.T) {
+	res := xdr.TransactionResult{
+		Result: xdr.TransactionResultResult{
+			Code: xdr.TransactionResultCodeTxFailed,
+			Results: &[]xdr.OperationResult{
+				{
+					Code: xdr.OperationResultCodeOpInner,
+					Tr: &xdr.OperationResultTr{
+						Type:          xdr.OperationTypePayment,
+						PaymentResult: &xdr.PaymentResult{Code: xdr.PaymentResultCodePaymentNoTrust},
+					},
+				},
+				{
+					Code: xdr.OperationResultCodeOpInner,
+					Tr: &xdr.OperationResultTr{
+						Type:               xdr.OperationTypeAccountMerge,
+						AccountMergeResult: &xdr.AccountMergeResult{Code: xdr.AccountMergeResultCodeAccountMergeSuccess},
+					},
+				},
+				{Code: xdr.OperationResultCodeOpBadAuth},
+				{Code: xdr.OperationResultCodeOpNoAccount},
+			},
+		},
+	}
+	got := stellar.ResultCodes(res)
+	want := []string{"op_no_trust", "op_success", "op_bad_auth", "op_no_source_account"}
+	if got.TransactionCode != "tx_failed" || !reflect.DeepEqual(got.OperationCodes, want) {
+		t.Errorf("got result codes %s %v, want tx_failed %v", got.TransactionCode, got.OperationCodes, want)
+	}
+}
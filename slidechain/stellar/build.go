@@ -0,0 +1,323 @@
+package stellar
+
+import (
+	"encoding/hex"
+	"math"
+)
+
+// DefaultBaseFee is the fee per operation, in stroops,
+// of a Tx that sets none:
+// the network's minimum.
+const DefaultBaseFee = 100
+
+// MaxTrustLimit is the Limit of a ChangeTrust
+// that trusts any amount of the asset.
+const MaxTrustLimit = math.MaxInt64
+
+// Flags of an issuing account, set and cleared by SetOptions.
+const (
+	AuthRequired        uint32 = 0x1
+	AuthRevocable       uint32 = 0x2
+	AuthImmutable       uint32 = 0x4
+	AuthClawbackEnabled uint32 = 0x8
+)
+
+// SequenceNumber is the sequence number of a tx,
+// or that of an account: the sequence number of its last tx.
+type SequenceNumber int64
+
+// Tx is a Stellar tx,
+// as it is built and signed here
+// or decoded from its envelope by DecodeTx.
+// Amounts are in stroops.
+type Tx struct {
+	// Network is the passphrase of the network the tx is for,
+	// which its hash commits to.
+	Network string
+
+	Source string // the address of the account that pays the fee, or its M-address
+	SeqNum SequenceNumber
+
+	// BaseFee is the fee per operation.
+	// Zero means DefaultBaseFee.
+	// Fee, if not zero, is the fee of the whole tx instead,
+	// as DecodeTx sets it.
+	BaseFee uint64
+	Fee     uint32
+
+	Memo       Memo        // nil for none
+	TimeBounds *TimeBounds // nil for none
+
+	// The preconditions of protocol 19 bound further
+	// when the tx is valid.
+	// MinSeqNum, if not nil, lets the tx follow any sequence number
+	// of the source account from MinSeqNum up to SeqNum,
+	// not only the one before SeqNum.
+	// MinSeqAge is the seconds, and MinSeqLedgerGap the ledgers,
+	// that must have passed since the source account's sequence number
+	// last changed.
+	LedgerBounds    *LedgerBounds // nil for none
+	MinSeqNum       *SequenceNumber
+	MinSeqAge       uint64
+	MinSeqLedgerGap uint32
+
+	Ops []Op
+
+	// Signatures are those of a decoded tx.
+	// Sign adds to them.
+	Signatures []Signature
+}
+
+// TimeBounds bound the close times of the ledgers
+// a tx is valid in,
+// as Unix times in seconds.
+// A zero MaxTime is no upper bound.
+type TimeBounds struct {
+	MinTime int64
+	MaxTime int64
+}
+
+// LedgerBounds bound the sequence numbers of the ledgers
+// a tx is valid in,
+// from MinLedger up to but not including MaxLedger.
+// A zero MaxLedger is no upper bound.
+type LedgerBounds struct {
+	MinLedger uint32
+	MaxLedger uint32
+}
+
+// FeeBump is a fee-bump tx of protocol 13,
+// which wraps Inner, a signed tx, as it is,
+// and pays its fee from the account at FeeSource instead,
+// so that the fee of a tx can be raised
+// without the signatures of its source account,
+// such as that of a preauthorized tx.
+type FeeBump struct {
+	FeeSource string
+
+	// BaseFee is the fee per operation of Inner,
+	// counting the fee bump itself as one more,
+	// and must be at least that of Inner.
+	// Zero means DefaultBaseFee.
+	// Fee, if not zero, is the fee of the whole tx instead,
+	// as DecodeFeeBump sets it.
+	BaseFee uint64
+	Fee     int64
+
+	// Inner is the tx whose fee is bumped,
+	// whose Network is that of the fee bump.
+	Inner *Tx
+
+	// Signatures are those of a decoded fee bump.
+	// Sign adds to them.
+	Signatures []Signature
+}
+
+// Signature is a signature in a tx envelope,
+// with the last 4 bytes of the signer's public key as a hint.
+type Signature struct {
+	Hint      [4]byte
+	Signature []byte
+}
+
+// TotalFee returns the fee of tx.
+func (tx *Tx) TotalFee() int64 {
+	if tx.Fee != 0 {
+		return int64(tx.Fee)
+	}
+	base := tx.BaseFee
+	if base == 0 {
+		base = DefaultBaseFee
+	}
+	return int64(base) * int64(len(tx.Ops))
+}
+
+// TotalFee returns the fee of fb,
+// which replaces that of its inner tx.
+func (fb *FeeBump) TotalFee() int64 {
+	if fb.Fee != 0 {
+		return fb.Fee
+	}
+	base := fb.BaseFee
+	if base == 0 {
+		base = DefaultBaseFee
+	}
+	return int64(base) * int64(len(fb.Inner.Ops)+1)
+}
+
+// hasPreconditions reports whether tx has preconditions
+// beyond its time bounds.
+func (tx *Tx) hasPreconditions() bool {
+	return tx.LedgerBounds != nil || tx.MinSeqNum != nil || tx.MinSeqAge != 0 || tx.MinSeqLedgerGap != 0
+}
+
+// OpSource returns the address of the source account of the op
+// at index i of tx:
+// its own, if it has one, or the tx's.
+func (tx *Tx) OpSource(i int) string {
+	if s := tx.Ops[i].source(); s != "" {
+		return s
+	}
+	return tx.Source
+}
+
+// TxHash returns the hash of tx in hex, as Horizon identifies it.
+// Signatures are not hashed,
+// so the hash is known before tx is submitted,
+// and a submission that timed out without a response
+// can still be looked up.
+func TxHash(tx *Tx) (string, error) {
+	hash, err := tx.Hash()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Memo is the memo of a tx:
+// a MemoText, MemoID, MemoHash, or MemoReturn.
+type Memo interface {
+	memo()
+}
+
+// MemoText is a text memo of at most 28 bytes.
+type MemoText string
+
+// MemoID is a numeric memo.
+type MemoID uint64
+
+// MemoHash is a memo of a 32-byte hash.
+type MemoHash [32]byte
+
+// MemoReturn is a memo of the hash of the tx
+// a refund is for.
+type MemoReturn [32]byte
+
+func (MemoText) memo()   {}
+func (MemoID) memo()     {}
+func (MemoHash) memo()   {}
+func (MemoReturn) memo() {}
+
+// Op is an operation of a tx: one of the op types below.
+// The Source of each is the address of its source account,
+// or empty for the tx's.
+// Sources, and the destinations of payments and merges,
+// may be the M-addresses of muxed accounts.
+type Op interface {
+	source() string
+}
+
+// Payment pays Amount of Asset to Destination.
+type Payment struct {
+	Source      string
+	Destination string
+	Asset       Asset
+	Amount      int64
+}
+
+// PathPayment pays DestAmount of DestAsset to Destination,
+// converting at most SendMax of SendAsset
+// through the order books of the assets of Path, in order.
+type PathPayment struct {
+	Source      string
+	SendAsset   Asset
+	SendMax     int64
+	Destination string
+	DestAsset   Asset
+	DestAmount  int64
+	Path        []Asset
+}
+
+// CreateAccount creates the account at Destination
+// with a balance of Amount lumens.
+type CreateAccount struct {
+	Source      string
+	Destination string
+	Amount      int64
+}
+
+// AccountMerge merges the source account into Destination,
+// paying it the lumens of the source account,
+// and removes the source account.
+type AccountMerge struct {
+	Source      string
+	Destination string
+}
+
+// ChangeTrust sets the limit of the source account's trustline of Asset,
+// adding it if there is none.
+// A Limit of zero removes it.
+type ChangeTrust struct {
+	Source string
+	Asset  Asset
+	Limit  int64
+}
+
+// SetOptions sets the options of the source account.
+// Those left nil or zero are unchanged.
+type SetOptions struct {
+	Source     string
+	ClearFlags uint32 // AuthRequired and the like
+	SetFlags   uint32
+
+	MasterWeight  *uint32
+	LowThreshold  *uint32
+	MedThreshold  *uint32
+	HighThreshold *uint32
+
+	HomeDomain *string
+
+	// Signer adds a signer, reweights it, or, with weight 0, removes it.
+	Signer *AccountSigner
+}
+
+// AccountSigner is a signer set by SetOptions:
+// an account's key, by its address,
+// or a preauthorized tx hash or hash(x), by its strkey.
+type AccountSigner struct {
+	Key    string
+	Weight uint32
+}
+
+// AllowTrust authorizes, or deauthorizes,
+// the trustline of Trustor
+// of the asset with the given code issued by the source account.
+type AllowTrust struct {
+	Source    string
+	Trustor   string
+	Code      string
+	Authorize bool
+}
+
+// BumpSequence raises the sequence number of the source account to BumpTo,
+// if it is lower.
+type BumpSequence struct {
+	Source string
+	BumpTo SequenceNumber
+}
+
+// ManageData sets the data entry Name of the source account to Value,
+// or, if Value is nil, removes it.
+type ManageData struct {
+	Source string
+	Name   string
+	Value  []byte
+}
+
+// OtherOp is a decoded op of a type not above.
+// Type is its XDR name, such as OperationTypeManageSellOffer.
+type OtherOp struct {
+	Source string
+	Type   string
+}
+
+func (op Payment) source() string       { return op.Source }
+func (op PathPayment) source() string   { return op.Source }
+func (op CreateAccount) source() string { return op.Source }
+func (op AccountMerge) source() string  { return op.Source }
+func (op ChangeTrust) source() string   { return op.Source }
+func (op SetOptions) source() string    { return op.Source }
+func (op AllowTrust) source() string    { return op.Source }
+func (op BumpSequence) source() string  { return op.Source }
+func (op ManageData) source() string    { return op.Source }
+func (op OtherOp) source() string       { return op.Source }
@@ -0,0 +1,58 @@
+package stellar
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithContext returns a Horizon client making the requests of hclient
+// canceled when ctx is done.
+// The Client methods take no context,
+// so this is how a caller bounds them.
+// A client that is not a *HorizonClient, such as a test double,
+// is returned unchanged.
+func WithContext(ctx context.Context, hclient Client) Client {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return hclient
+	}
+	return &HorizonClient{
+		URL:  hc.URL,
+		HTTP: withContext(ctx, hc),
+	}
+}
+
+// withContext returns the HTTP client of hc
+// sending every request with ctx.
+func withContext(ctx context.Context, hc *HorizonClient) ctxHTTP {
+	return ctxHTTP{ctx: ctx, base: hc.http()}
+}
+
+// ctxHTTP is an HTTP sending every request with its context.
+type ctxHTTP struct {
+	ctx  context.Context
+	base HTTP
+}
+
+func (h ctxHTTP) Do(req *http.Request) (*http.Response, error) {
+	return h.base.Do(req.WithContext(h.ctx))
+}
+
+func (h ctxHTTP) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.Do(req)
+}
+
+func (h ctxHTTP) PostForm(url string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return h.Do(req)
+}
@@ -0,0 +1,33 @@
+package stellar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	hclient := &HorizonClient{URL: srv.URL, HTTP: new(http.Client)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := WithContext(ctx, hclient).SubmitTransaction("AAAA")
+	if err == nil {
+		t.Fatal("got no error from a Horizon server that never responds")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("request took %s after its context was done", d)
+	}
+}
@@ -0,0 +1,10 @@
+package stellar
+
+// Exported for the tests of package stellar_test,
+// which use horizonmock, which imports this package.
+var (
+	IsBadSeq    = isBadSeq
+	ResultCodes = resultCodes
+)
+
+const MaxBadSeqTries = maxBadSeqTries
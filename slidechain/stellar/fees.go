@@ -0,0 +1,41 @@
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// AcceptedFee returns the median per-operation fee
+// of the txs in recent ledgers,
+// from Horizon's /fee_stats.
+// The Client interface has no call for it,
+// so hclient must be a *HorizonClient.
+func AcceptedFee(ctx context.Context, hclient Client) (int64, error) {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return 0, errors.New("fee stats need an HTTP Horizon client")
+	}
+	resp, err := withContext(ctx, hc).Get(strings.TrimRight(hc.URL, "/") + "/fee_stats")
+	if err != nil {
+		return 0, errors.Wrap(err, "getting fee stats")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("getting fee stats: status %s", resp.Status)
+	}
+	var stats struct {
+		P50AcceptedFee string `json:"p50_accepted_fee"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding fee stats")
+	}
+	fee, err := strconv.ParseInt(stats.P50AcceptedFee, 10, 64)
+	return fee, errors.Wrapf(err, "parsing accepted fee %q", stats.P50AcceptedFee)
+}
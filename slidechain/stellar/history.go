@@ -0,0 +1,63 @@
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// LedgerCursor is the paging token just before
+// the first tx of the ledger with the given sequence number.
+// Horizon's paging tokens are TOIDs,
+// which hold the ledger sequence in their high 32 bits.
+func LedgerCursor(seq int32) string {
+	return strconv.FormatInt(int64(seq)<<32, 10)
+}
+
+// AccountTransactions returns a page of at most limit txs
+// of the account at addr after cursor, in order.
+// An empty page means there are no more yet.
+// Unlike StreamTransactions, it returns once the page is read,
+// but the Client interface has no call for it,
+// so hclient must be a *HorizonClient.
+func AccountTransactions(ctx context.Context, hclient Client, addr, cursor string, limit int) ([]Transaction, error) {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return nil, errors.New("paging txs needs an HTTP Horizon client")
+	}
+	q := url.Values{
+		"cursor": {cursor},
+		"order":  {"asc"},
+		"limit":  {strconv.Itoa(limit)},
+	}
+	u := fmt.Sprintf("%s/accounts/%s/transactions?%s", strings.TrimRight(hc.URL, "/"), addr, q.Encode())
+	resp, err := withContext(ctx, hc).Get(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting txs of %s", addr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting txs of %s: status %s", addr, resp.Status)
+	}
+	var page struct {
+		Embedded struct {
+			Records []Transaction `json:"records"`
+		} `json:"_embedded"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding txs of %s", addr)
+	}
+	records := page.Embedded.Records
+	if len(records) > limit {
+		// Not every server honors the limit.
+		records = records[:limit]
+	}
+	return records, nil
+}
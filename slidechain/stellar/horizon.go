@@ -0,0 +1,373 @@
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Client is the part of the Horizon API that slidechain calls
+// through an interface,
+// so that tests and simulations can substitute for Horizon.
+// HorizonClient implements it over HTTP.
+type Client interface {
+	Root() (Root, error)
+	LoadAccount(addr string) (Account, error)
+	SequenceForAccount(addr string) (SequenceNumber, error)
+	LoadTransaction(hash string) (Transaction, error)
+	SubmitTransaction(envXDR string) (TransactionSuccess, error)
+	StreamTransactions(ctx context.Context, addr string, cursor *Cursor, handler func(Transaction)) error
+	LoadOrderBook(selling, buying Asset, limit int) (OrderBookSummary, error)
+}
+
+// HTTP is the HTTP client a HorizonClient sends its requests with,
+// such as an *http.Client or a Regional.
+type HTTP interface {
+	Do(req *http.Request) (*http.Response, error)
+	Get(url string) (*http.Response, error)
+	PostForm(url string, data url.Values) (*http.Response, error)
+}
+
+// HorizonClient is a Client of the Horizon server at URL.
+// Functions here that read Horizon resources
+// the Client interface does not cover
+// need one.
+type HorizonClient struct {
+	URL  string
+	HTTP HTTP // nil means http.DefaultClient
+}
+
+// TestnetHorizon is a client of SDF's Horizon server
+// for the Stellar testnet.
+var TestnetHorizon = &HorizonClient{URL: "https://horizon-testnet.stellar.org"}
+
+var _ Client = (*HorizonClient)(nil)
+
+// Cursor is a paging token: the position in a stream
+// after which it continues.
+type Cursor string
+
+// Root is the root resource of Horizon.
+type Root struct {
+	HorizonVersion       string `json:"horizon_version"`
+	StellarCoreVersion   string `json:"core_version"`
+	HorizonSequence      int32  `json:"history_latest_ledger"`
+	HistoryElderSequence int32  `json:"history_elder_ledger"`
+	CoreSequence         int32  `json:"core_latest_ledger"`
+	NetworkPassphrase    string `json:"network_passphrase"`
+	ProtocolVersion      int32  `json:"protocol_version"`
+}
+
+// Account is the Horizon record of an account.
+type Account struct {
+	ID                   string            `json:"id"`
+	PT                   string            `json:"paging_token"`
+	AccountID            string            `json:"account_id"`
+	Sequence             string            `json:"sequence"`
+	SubentryCount        int32             `json:"subentry_count"`
+	InflationDestination string            `json:"inflation_destination,omitempty"`
+	HomeDomain           string            `json:"home_domain,omitempty"`
+	Thresholds           AccountThresholds `json:"thresholds"`
+	Flags                IssuerFlags       `json:"flags"`
+	Balances             []Balance         `json:"balances"`
+	Signers              []Signer          `json:"signers"`
+	Data                 map[string]string `json:"data"` // base64-encoded values
+}
+
+// GetNativeBalance returns the lumen balance of the account.
+func (a Account) GetNativeBalance() (string, error) {
+	for _, bal := range a.Balances {
+		if bal.AssetType == "native" {
+			return bal.Balance, nil
+		}
+	}
+	return "0", errors.New("account does not have a native balance")
+}
+
+// GetData returns the decoded value of the account's data entry
+// with the given key,
+// which is empty if there is none.
+func (a Account) GetData(key string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(a.Data[key])
+}
+
+// AccountThresholds are the weights of signatures
+// needed by the operations of each threshold category.
+type AccountThresholds struct {
+	LowThreshold  byte `json:"low_threshold"`
+	MedThreshold  byte `json:"med_threshold"`
+	HighThreshold byte `json:"high_threshold"`
+}
+
+// Balance is an account's holding of an asset.
+// IsAuthorized, of a trustline, is missing from older Horizons.
+type Balance struct {
+	Balance            string `json:"balance"`
+	Limit              string `json:"limit,omitempty"`
+	BuyingLiabilities  string `json:"buying_liabilities"`
+	SellingLiabilities string `json:"selling_liabilities"`
+	AssetType          string `json:"asset_type"`
+	AssetCode          string `json:"asset_code,omitempty"`
+	AssetIssuer        string `json:"asset_issuer,omitempty"`
+	IsAuthorized       *bool  `json:"is_authorized,omitempty"`
+}
+
+// Asset parses the asset of bal.
+func (bal Balance) Asset() (Asset, error) {
+	if bal.AssetType == "native" {
+		return NativeAsset(), nil
+	}
+	return NewAsset(bal.AssetCode, bal.AssetIssuer)
+}
+
+// Signer is a signer of an account.
+type Signer struct {
+	PublicKey string `json:"public_key"`
+	Weight    int32  `json:"weight"`
+	Key       string `json:"key"`
+	Type      string `json:"type"`
+}
+
+// Transaction is the Horizon record of a tx in a ledger.
+type Transaction struct {
+	ID              string    `json:"id"`
+	PT              string    `json:"paging_token"`
+	Hash            string    `json:"hash"`
+	Ledger          int32     `json:"ledger"`
+	LedgerCloseTime time.Time `json:"created_at"`
+	Account         string    `json:"source_account"`
+	AccountSequence string    `json:"source_account_sequence"`
+	FeePaid         int32     `json:"fee_paid"`
+	OperationCount  int32     `json:"operation_count"`
+	EnvelopeXdr     string    `json:"envelope_xdr"`
+	ResultXdr       string    `json:"result_xdr"`
+	ResultMetaXdr   string    `json:"result_meta_xdr"`
+	FeeMetaXdr      string    `json:"fee_meta_xdr"`
+	MemoType        string    `json:"memo_type"`
+	Memo            string    `json:"memo,omitempty"`
+	Signatures      []string  `json:"signatures"`
+	ValidAfter      string    `json:"valid_after,omitempty"`
+	ValidBefore     string    `json:"valid_before,omitempty"`
+}
+
+// MarshalJSON omits the memo of tx if and only if its type is none,
+// as Horizon does.
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	type plain Transaction
+	v := struct {
+		Memo *string `json:"memo,omitempty"`
+		*plain
+	}{plain: (*plain)(&tx)}
+	if tx.MemoType != "none" {
+		v.Memo = &tx.Memo
+	}
+	return json.Marshal(v)
+}
+
+// TransactionSuccess is Horizon's response to a tx submission
+// that was applied.
+type TransactionSuccess struct {
+	Hash   string `json:"hash"`
+	Ledger int32  `json:"ledger"`
+	Env    string `json:"envelope_xdr"`
+	Result string `json:"result_xdr"`
+	Meta   string `json:"result_meta_xdr"`
+}
+
+// TransactionResultCodes are the result codes of a failed tx
+// by the short names Horizon reports them with,
+// such as tx_bad_seq and op_no_trust.
+type TransactionResultCodes struct {
+	TransactionCode string   `json:"transaction"`
+	OperationCodes  []string `json:"operations,omitempty"`
+}
+
+// OrderBookSummary is the top of the DEX order book
+// of an asset pair.
+type OrderBookSummary struct {
+	Bids []PriceLevel `json:"bids"`
+	Asks []PriceLevel `json:"asks"`
+}
+
+// PriceLevel is the total amount of the offers at a price.
+type PriceLevel struct {
+	PriceR Price  `json:"price_r"`
+	Price  string `json:"price"`
+	Amount string `json:"amount"`
+}
+
+// Price is a price as a fraction.
+type Price struct {
+	N int32 `json:"n"`
+	D int32 `json:"d"`
+}
+
+// Problem is a Horizon error response.
+type Problem struct {
+	Type     string                     `json:"type"`
+	Title    string                     `json:"title"`
+	Status   int                        `json:"status"`
+	Detail   string                     `json:"detail,omitempty"`
+	Instance string                     `json:"instance,omitempty"`
+	Extras   map[string]json.RawMessage `json:"extras,omitempty"`
+}
+
+// HorizonError is the error for a Horizon error response.
+type HorizonError struct {
+	Response *http.Response
+	Problem  Problem
+}
+
+func (herr *HorizonError) Error() string {
+	return fmt.Sprintf("Horizon error: %q (status %d)", herr.Problem.Title, herr.Problem.Status)
+}
+
+// ResultCodes returns the result codes of the tx
+// whose failure herr reports.
+func (herr *HorizonError) ResultCodes() (*TransactionResultCodes, error) {
+	raw, ok := herr.Problem.Extras["result_codes"]
+	if !ok {
+		return nil, errors.New("result_codes not populated")
+	}
+	var codes TransactionResultCodes
+	err := json.Unmarshal(raw, &codes)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding result codes")
+	}
+	return &codes, nil
+}
+
+// ResultString returns the base64 XDR of the result of the tx
+// whose failure herr reports.
+func (herr *HorizonError) ResultString() (string, error) {
+	raw, ok := herr.Problem.Extras["result_xdr"]
+	if !ok {
+		return "", errors.New("result_xdr not populated")
+	}
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, errors.Wrap(err, "decoding result XDR")
+}
+
+// IsNotFound reports whether err is Horizon's response
+// for a resource it does not have,
+// such as an account that does not exist.
+func IsNotFound(err error) bool {
+	herr, ok := errors.Root(err).(*HorizonError)
+	return ok && herr.Problem.Status == http.StatusNotFound
+}
+
+func (c *HorizonClient) http() HTTP {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+// get decodes the response to a GET of path into v.
+func (c *HorizonClient) get(path string, v interface{}) error {
+	resp, err := c.http().Get(strings.TrimRight(c.URL, "/") + path)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, v)
+}
+
+// decodeResponse decodes a successful response into v,
+// or an unsuccessful one into a *HorizonError.
+func decodeResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		herr := &HorizonError{Response: resp}
+		err := dec.Decode(&herr.Problem)
+		if err != nil {
+			return errors.Wrapf(err, "decoding Horizon error response with status %s", resp.Status)
+		}
+		return herr
+	}
+	return errors.Wrap(dec.Decode(v), "decoding Horizon response")
+}
+
+// Root loads the root resource.
+func (c *HorizonClient) Root() (Root, error) {
+	var root Root
+	err := c.get("/", &root)
+	return root, err
+}
+
+// LoadAccount loads the account at addr,
+// or, for an M-address, its base account.
+func (c *HorizonClient) LoadAccount(addr string) (Account, error) {
+	var acct Account
+	err := c.get("/accounts/"+BaseAccount(addr), &acct)
+	return acct, err
+}
+
+// SequenceForAccount returns the sequence number of the account at addr,
+// that of its last tx.
+func (c *HorizonClient) SequenceForAccount(addr string) (SequenceNumber, error) {
+	acct, err := c.LoadAccount(addr)
+	if err != nil {
+		return 0, errors.Wrap(err, "loading account")
+	}
+	seq, err := strconv.ParseInt(acct.Sequence, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing sequence number")
+	}
+	return SequenceNumber(seq), nil
+}
+
+// LoadTransaction loads the tx with the given hash.
+func (c *HorizonClient) LoadTransaction(hash string) (Transaction, error) {
+	var tx Transaction
+	err := c.get("/transactions/"+hash, &tx)
+	return tx, err
+}
+
+// SubmitTransaction submits the tx envelope envXDR
+// and waits for it to be applied.
+// A tx that fails is reported as a *HorizonError
+// with its result codes.
+func (c *HorizonClient) SubmitTransaction(envXDR string) (TransactionSuccess, error) {
+	var succ TransactionSuccess
+	resp, err := c.http().PostForm(strings.TrimRight(c.URL, "/")+"/transactions", url.Values{"tx": {envXDR}})
+	if err != nil {
+		return succ, errors.Wrap(err, "posting tx")
+	}
+	err = decodeResponse(resp, &succ)
+	return succ, err
+}
+
+// LoadOrderBook loads the best limit price levels
+// on each side of the order book of selling against buying.
+func (c *HorizonClient) LoadOrderBook(selling, buying Asset, limit int) (OrderBookSummary, error) {
+	q := url.Values{"limit": {strconv.Itoa(limit)}}
+	addAssetQuery(q, "selling", selling)
+	addAssetQuery(q, "buying", buying)
+	var book OrderBookSummary
+	err := c.get("/order_book?"+q.Encode(), &book)
+	return book, err
+}
+
+func addAssetQuery(q url.Values, prefix string, asset Asset) {
+	if asset.IsNative() {
+		q.Set(prefix+"_asset_type", "native")
+		return
+	}
+	typ := "credit_alphanum4"
+	if len(asset.Code) > 4 {
+		typ = "credit_alphanum12"
+	}
+	q.Set(prefix+"_asset_type", typ)
+	q.Set(prefix+"_asset_code", asset.Code)
+	q.Set(prefix+"_asset_issuer", asset.Issuer)
+}
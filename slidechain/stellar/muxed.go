@@ -0,0 +1,41 @@
+package stellar
+
+import "github.com/stellar/go/strkey"
+
+// IsMuxed reports whether addr is the M-address of a muxed account:
+// an account's key with a 64-bit ID,
+// by which an exchange tells apart the users
+// sharing one Stellar account.
+func IsMuxed(addr string) bool {
+	return strkey.IsValidMuxedAccountEd25519PublicKey(addr)
+}
+
+// BaseAccount returns the address of the account
+// of the M-address addr,
+// which is the account Horizon knows and the ledger debits and credits,
+// or addr itself if it is not an M-address.
+func BaseAccount(addr string) string {
+	if !IsMuxed(addr) {
+		return addr
+	}
+	m, err := strkey.DecodeMuxedAccount(addr)
+	if err != nil {
+		return addr
+	}
+	base, err := m.AccountID()
+	if err != nil {
+		return addr
+	}
+	return base
+}
+
+// MuxedAddress returns the M-address of the muxed account
+// with the given ID of the account at addr.
+func MuxedAddress(addr string, id uint64) (string, error) {
+	var m strkey.MuxedAccount
+	if err := m.SetAccountID(addr); err != nil {
+		return "", err
+	}
+	m.SetID(id)
+	return m.Address()
+}
@@ -0,0 +1,96 @@
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Operation is the Horizon record of an operation of a tx,
+// with the fields slidechain reads.
+// It is how the ops of a tx the vendored XDR cannot decode,
+// such as one of a later protocol,
+// and the contract transfers of a Soroban tx, are read.
+type Operation struct {
+	Type          string `json:"type"`
+	SourceAccount string `json:"source_account"`
+
+	// Payment and path payment fields.
+	// The asset and amount are those received by To.
+	From        string `json:"from"`
+	To          string `json:"to"`
+	AssetType   string `json:"asset_type"`
+	AssetCode   string `json:"asset_code"`
+	AssetIssuer string `json:"asset_issuer"`
+	Amount      string `json:"amount"`
+
+	// Into is the account an account_merge merges into.
+	Into string `json:"into"`
+
+	// Limit is the limit a change_trust sets
+	// on the trustline of the asset above.
+	Limit string `json:"limit"`
+
+	// Fields of a set_options, each present only if it sets them.
+	SignerKey       string `json:"signer_key"`
+	MasterKeyWeight *int   `json:"master_key_weight"`
+	LowThreshold    *int   `json:"low_threshold"`
+	MedThreshold    *int   `json:"med_threshold"`
+	HighThreshold   *int   `json:"high_threshold"`
+
+	// AssetBalanceChanges are the transfers of an invoke_host_function.
+	AssetBalanceChanges []assetBalanceChange `json:"asset_balance_changes"`
+}
+
+// IsPayment reports whether op pays To:
+// a payment or any kind of path payment.
+func (op Operation) IsPayment() bool {
+	switch op.Type {
+	case "payment", "path_payment", "path_payment_strict_receive", "path_payment_strict_send":
+		return true
+	}
+	return false
+}
+
+// Asset parses the asset of op.
+func (op Operation) Asset() (Asset, error) {
+	if op.AssetType == "native" {
+		return NativeAsset(), nil
+	}
+	return NewAsset(op.AssetCode, op.AssetIssuer)
+}
+
+// TxOperations returns the operations of the tx with the given hash,
+// in order, as Horizon reports them.
+// Records are indexed as the ops of the tx are.
+// The hclient must be a *HorizonClient.
+func TxOperations(ctx context.Context, hclient Client, txHash string) ([]Operation, error) {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return nil, errors.New("reading tx operations needs an HTTP Horizon client")
+	}
+	// A tx has at most 100 operations.
+	u := fmt.Sprintf("%s/transactions/%s/operations?order=asc&limit=200", strings.TrimRight(hc.URL, "/"), txHash)
+	resp, err := withContext(ctx, hc).Get(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting operations of tx %s", txHash)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting operations of tx %s: status %s", txHash, resp.Status)
+	}
+	var page struct {
+		Embedded struct {
+			Records []Operation `json:"records"`
+		} `json:"_embedded"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding operations of tx %s", txHash)
+	}
+	return page.Embedded.Records, nil
+}
@@ -1,80 +1,35 @@
 package stellar
 
-import (
-	"errors"
-
-	b "github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
-	"github.com/stellar/go/xdr"
-)
+import "github.com/chain/txvm/errors"
 
 // BuildPegInTx builds a slidechain peg-in transaction
-func BuildPegInTx(source string, nonceHash [32]byte, amount, code, issuer, destination string, hclient *horizon.Client) (*b.TransactionBuilder, error) {
+// with the given sequence number.
+func BuildPegInTx(source string, seqnum SequenceNumber, nonceHash [32]byte, amount, code, issuer, destination string, hclient Client) (*Tx, error) {
 	root, err := hclient.Root()
 	if err != nil {
 		return nil, err
 	}
-	var paymentOp b.PaymentBuilder
-	if code == "" && issuer == "" {
-		paymentOp = b.Payment(
-			b.Destination{AddressOrSeed: destination},
-			b.NativeAmount{Amount: amount},
-		)
-	} else {
-		paymentOp = b.Payment(
-			b.Destination{AddressOrSeed: destination},
-			b.CreditAmount{
-				Code:   code,
-				Issuer: issuer,
-				Amount: amount,
-			},
-		)
+	asset := NativeAsset()
+	if code != "" || issuer != "" {
+		asset, err = NewAsset(code, issuer)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return b.Transaction(
-		b.Network{Passphrase: root.NetworkPassphrase},
-		b.SourceAccount{AddressOrSeed: source},
-		b.AutoSequence{SequenceProvider: hclient},
-		b.BaseFee{Amount: 100},
-		b.MemoHash{Value: xdr.Hash(nonceHash)},
-		paymentOp,
-	)
-}
-
-// NewAsset returns an xdr.Asset for the given code and issuer.
-func NewAsset(code, issuer string) (xdr.Asset, error) {
-	var issuerAccountID xdr.AccountId
-	err := issuerAccountID.SetAddress(issuer)
+	stroops, err := ParseAmount(amount)
 	if err != nil {
-		return xdr.Asset{}, err
-	}
-	if len(code) > 12 {
-		return xdr.Asset{}, errors.New("invalid asset code: max 12 characters")
+		return nil, errors.Wrapf(err, "parsing amount %s", amount)
 	}
-	if len(code) > 4 {
-		var assetCode [12]byte
-		copy(assetCode[:], []byte(code))
-		return xdr.Asset{
-			Type: xdr.AssetTypeAssetTypeCreditAlphanum12,
-			AlphaNum12: &xdr.AssetAlphaNum12{
-				AssetCode: assetCode,
-				Issuer:    issuerAccountID,
-			},
-		}, nil
-	}
-	var assetCode [4]byte
-	copy(assetCode[:], []byte(code))
-	return xdr.Asset{
-		Type: xdr.AssetTypeAssetTypeCreditAlphanum4,
-		AlphaNum4: &xdr.AssetAlphaNum4{
-			AssetCode: assetCode,
-			Issuer:    issuerAccountID,
-		},
+	return &Tx{
+		Network: root.NetworkPassphrase,
+		Source:  source,
+		SeqNum:  seqnum,
+		BaseFee: 100,
+		Memo:    MemoHash(nonceHash),
+		Ops: []Op{Payment{
+			Destination: destination,
+			Asset:       asset,
+			Amount:      stroops,
+		}},
 	}, nil
 }
-
-// NativeAsset returns the xdr.Asset object for lumens.
-func NativeAsset() xdr.Asset {
-	return xdr.Asset{
-		Type: xdr.AssetTypeAssetTypeNative,
-	}
-}
@@ -0,0 +1,71 @@
+package stellar
+
+import (
+	"context"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Stellar protocol upgrades change the XDR of txs and their results,
+// and the versions below bound the networks slidechain is known to work on.
+const (
+	// MinProtocol is the earliest protocol supported.
+	MinProtocol = 10
+
+	// XDRProtocol is the protocol of the vendored SDK's XDR.
+	// Txs of later protocols that it cannot decode
+	// are read from their ops in Horizon where the custodian needs them,
+	// as for deposits and the account guard; see TxOperations.
+	XDRProtocol = 23
+
+	// MaxProtocol is the latest protocol supported,
+	// that of the public and test networks since early 2026.
+	MaxProtocol = 25
+)
+
+// Compat is how far a protocol version is supported.
+type Compat int
+
+const (
+	// Unsupported is a version before MinProtocol or after MaxProtocol.
+	Unsupported Compat = iota
+
+	// Degraded is a version after XDRProtocol:
+	// some of its txs can be read only through Horizon's JSON,
+	// and features needing their XDR are not available.
+	Degraded
+
+	// Supported is a version the vendored XDR fully decodes.
+	Supported
+)
+
+func (c Compat) String() string {
+	switch c {
+	case Supported:
+		return "supported"
+	case Degraded:
+		return "degraded"
+	}
+	return "unsupported"
+}
+
+// CheckProtocol returns how far protocol version v is supported.
+func CheckProtocol(v int32) Compat {
+	switch {
+	case v < MinProtocol || v > MaxProtocol:
+		return Unsupported
+	case v > XDRProtocol:
+		return Degraded
+	}
+	return Supported
+}
+
+// NetworkProtocol returns the protocol version of the Stellar network
+// as the root of its Horizon server reports it.
+func NetworkProtocol(ctx context.Context, hclient Client) (int32, error) {
+	root, err := WithContext(ctx, hclient).Root()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting horizon root")
+	}
+	return root.ProtocolVersion, nil
+}
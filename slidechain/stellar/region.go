@@ -0,0 +1,205 @@
+package stellar
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Endpoint is a Horizon server in a region.
+type Endpoint struct {
+	Region string
+	URL    string
+}
+
+// Regional is an HTTP that sends each request,
+// made to the URL of the first of its endpoints,
+// to the selected endpoint instead:
+// the one with the lowest latency among the healthy ones in its home region,
+// or, while none there is healthy, among the healthy ones elsewhere.
+// Probe measures the endpoints and reselects,
+// so a failover returns home once an endpoint there recovers.
+// A request that fails to reach the selected endpoint
+// marks it unhealthy and is retried once on the next selection.
+type Regional struct {
+	home      string
+	endpoints []Endpoint
+	base      HTTP
+
+	mu      sync.Mutex
+	latency []time.Duration // of each endpoint's last probe; negative if it failed
+	current int
+}
+
+// NewRegional returns a Regional over the given endpoints,
+// all of the same network,
+// preferring those in home.
+// Until the first probe every endpoint counts as healthy,
+// and the first is selected.
+// Requests are sent with base, or http.DefaultClient if it is nil.
+func NewRegional(home string, endpoints []Endpoint, base HTTP) *Regional {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	r := &Regional{
+		home:      home,
+		endpoints: make([]Endpoint, len(endpoints)),
+		base:      base,
+		latency:   make([]time.Duration, len(endpoints)),
+	}
+	for i, e := range endpoints {
+		r.endpoints[i] = Endpoint{Region: e.Region, URL: strings.TrimRight(e.URL, "/")}
+	}
+	return r
+}
+
+// Current returns the selected endpoint.
+func (r *Regional) Current() Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endpoints[r.current]
+}
+
+// Latencies returns each endpoint's latency at its last probe,
+// negative for one that failed it.
+func (r *Regional) Latencies() map[Endpoint]time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[Endpoint]time.Duration, len(r.endpoints))
+	for i, e := range r.endpoints {
+		m[e] = r.latency[i]
+	}
+	return m
+}
+
+// Probe requests the root of each endpoint,
+// recording its latency or failure,
+// and reselects.
+func (r *Regional) Probe(ctx context.Context) {
+	latency := make([]time.Duration, len(r.endpoints))
+	for i, e := range r.endpoints {
+		req, err := http.NewRequest("GET", e.URL+"/", nil)
+		if err != nil {
+			latency[i] = -1
+			continue
+		}
+		start := time.Now()
+		resp, err := r.base.Do(req.WithContext(ctx))
+		if err != nil {
+			latency[i] = -1
+			continue
+		}
+		resp.Body.Close()
+		latency[i] = time.Since(start)
+		if resp.StatusCode != http.StatusOK {
+			latency[i] = -1
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copy(r.latency, latency)
+	r.reselect()
+}
+
+// reselect selects the endpoint by the recorded latencies.
+// The caller holds r.mu.
+func (r *Regional) reselect() {
+	best := -1
+	better := func(i int) bool {
+		if r.latency[i] < 0 {
+			return false
+		}
+		if best < 0 {
+			return true
+		}
+		if home, bestHome := r.endpoints[i].Region == r.home, r.endpoints[best].Region == r.home; home != bestHome {
+			return home
+		}
+		return r.latency[i] < r.latency[best]
+	}
+	for i := range r.endpoints {
+		if better(i) {
+			best = i
+		}
+	}
+	if best < 0 {
+		// None is healthy: stay put.
+		return
+	}
+	if best != r.current {
+		log.Printf("switching Horizon from %s (%s) to %s (%s)", r.endpoints[r.current].URL, r.endpoints[r.current].Region, r.endpoints[best].URL, r.endpoints[best].Region)
+		r.current = best
+	}
+}
+
+// fail marks endpoint i unhealthy after a failed request and reselects,
+// returning the new selection.
+func (r *Regional) fail(i int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latency[i] = -1
+	r.reselect()
+	return r.current
+}
+
+func (r *Regional) Do(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	i := r.current
+	r.mu.Unlock()
+	resp, err := r.base.Do(r.redirect(req, i))
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	next := r.fail(i)
+	if next == i || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+	retry := req.WithContext(req.Context())
+	if req.GetBody != nil {
+		body, berr := req.GetBody()
+		if berr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+	return r.base.Do(r.redirect(retry, next))
+}
+
+func (r *Regional) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.Do(req)
+}
+
+func (r *Regional) PostForm(url string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r.Do(req)
+}
+
+// redirect returns req sent to endpoint i
+// in place of the first endpoint.
+func (r *Regional) redirect(req *http.Request, i int) *http.Request {
+	primary := r.endpoints[0].URL
+	u := req.URL.String()
+	if i == 0 || !strings.HasPrefix(u, primary) {
+		return req
+	}
+	target, err := url.Parse(r.endpoints[i].URL + strings.TrimPrefix(u, primary))
+	if err != nil {
+		return req
+	}
+	out := req.WithContext(req.Context())
+	out.URL = target
+	out.Host = target.Host
+	return out
+}
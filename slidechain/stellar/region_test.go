@@ -0,0 +1,82 @@
+package stellar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegional(t *testing.T) {
+	type server struct {
+		srv  *httptest.Server
+		down atomic.Value
+		hits int32
+	}
+	newServer := func(delay time.Duration) *server {
+		s := new(server)
+		s.down.Store(false)
+		s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if s.down.Load().(bool) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			time.Sleep(delay)
+			if req.URL.Path != "/" {
+				atomic.AddInt32(&s.hits, 1)
+			}
+			w.Write([]byte(`{}`))
+		}))
+		return s
+	}
+	// The home region's slower server is still preferred
+	// over the faster one abroad.
+	home, homeSlow, abroad := newServer(0), newServer(20*time.Millisecond), newServer(0)
+	defer home.srv.Close()
+	defer homeSlow.srv.Close()
+	defer abroad.srv.Close()
+	r := NewRegional("us", []Endpoint{
+		{Region: "us", URL: home.srv.URL},
+		{Region: "eu", URL: abroad.srv.URL},
+		{Region: "us", URL: homeSlow.srv.URL},
+	}, nil)
+	hclient := &HorizonClient{URL: home.srv.URL, HTTP: r}
+	ctx := context.Background()
+	get := func(want *server) {
+		t.Helper()
+		before := atomic.LoadInt32(&want.hits)
+		resp, err := hclient.HTTP.Get(hclient.URL + "/accounts/G")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if atomic.LoadInt32(&want.hits) != before+1 {
+			t.Errorf("request did not reach %s; selected %s", want.srv.URL, r.Current().URL)
+		}
+	}
+
+	r.Probe(ctx)
+	get(home)
+
+	home.down.Store(true)
+	r.Probe(ctx)
+	get(homeSlow)
+
+	homeSlow.down.Store(true)
+	r.Probe(ctx)
+	get(abroad)
+
+	// Failback.
+	home.down.Store(false)
+	r.Probe(ctx)
+	get(home)
+
+	// A server that cannot be reached fails over at once.
+	home.srv.Close()
+	get(abroad)
+	if r.Current().URL != abroad.srv.URL {
+		t.Errorf("selected %s after the home server vanished", r.Current().URL)
+	}
+}
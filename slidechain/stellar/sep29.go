@@ -0,0 +1,32 @@
+package stellar
+
+import (
+	"context"
+
+	"github.com/chain/txvm/errors"
+)
+
+// memoRequiredKey is the data entry by which an account
+// requires payments to it to carry a memo, per SEP-29.
+const memoRequiredKey = "config.memo_required"
+
+// MemoRequired reports whether the account at addr
+// requires payments to it to carry a memo:
+// whether its config.memo_required data entry is "1",
+// as an exchange's deposit account sets it per SEP-29.
+// An account that does not exist requires none,
+// nor does an M-address, whose ID already tells its user apart.
+func MemoRequired(ctx context.Context, hclient Client, addr string) (bool, error) {
+	if IsMuxed(addr) {
+		return false, nil
+	}
+	acct, err := WithContext(ctx, hclient).LoadAccount(addr)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "loading account %s", addr)
+	}
+	v, err := acct.GetData(memoRequiredKey)
+	return err == nil && string(v) == "1", nil
+}
@@ -0,0 +1,129 @@
+package stellar
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/chain/txvm/errors"
+)
+
+// maxBadSeqTries is how many times Sequencer.Submit tries a tx
+// that Stellar rejects with tx_bad_seq.
+const maxBadSeqTries = 3
+
+// Sequencer assigns sequence numbers to the txs of Stellar accounts.
+// It loads an account's sequence number from Horizon
+// on first use and after a failed submission,
+// and otherwise counts up from the last one it assigned,
+// so txs from the same account need not each wait for a Horizon round-trip.
+// It is safe for concurrent use,
+// and serializes the submissions from each account.
+type Sequencer struct {
+	hclient Client
+
+	mu    sync.Mutex
+	last  map[string]SequenceNumber // last sequence number assigned, by account address
+	locks map[string]*sync.Mutex    // held through each submission, by account address
+}
+
+// NewSequencer returns a Sequencer that loads sequence numbers from hclient.
+func NewSequencer(hclient Client) *Sequencer {
+	return &Sequencer{
+		hclient: hclient,
+		last:    make(map[string]SequenceNumber),
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Next reserves and returns the sequence number
+// of the next tx from the account with the given address.
+func (s *Sequencer) Next(addr string) (SequenceNumber, error) {
+	return s.next(s.hclient, addr)
+}
+
+func (s *Sequencer) next(hclient Client, addr string) (SequenceNumber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.last[addr]
+	if !ok {
+		var err error
+		last, err = hclient.SequenceForAccount(addr)
+		if err != nil {
+			return 0, errors.Wrapf(err, "getting sequence number for %s", addr)
+		}
+	}
+	s.last[addr] = last + 1
+	return last + 1, nil
+}
+
+// Reset discards the cached sequence number of the account,
+// so that the next call to Next loads it from Horizon.
+func (s *Sequencer) Reset(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.last, addr)
+}
+
+// Submit builds a tx from the account with the given address
+// by calling build with the tx's sequence number,
+// then signs it with seeds and submits it.
+// If Stellar rejects it with tx_bad_seq,
+// Submit reloads the sequence number from Horizon
+// and rebuilds, re-signs, and resubmits the tx,
+// up to a few times.
+// After any other failure the cached sequence number is discarded,
+// since the tx may or may not have used it.
+// A submission from the account waits for any other to finish,
+// so that each is built on the sequence number the last one used.
+func (s *Sequencer) Submit(addr string, build func(SequenceNumber) (*Tx, error), seeds ...string) (*TransactionSuccess, error) {
+	return s.submit(s.hclient, addr, build, seeds)
+}
+
+// SubmitContext is Submit with its Horizon requests canceled when ctx is done.
+func (s *Sequencer) SubmitContext(ctx context.Context, addr string, build func(SequenceNumber) (*Tx, error), seeds ...string) (*TransactionSuccess, error) {
+	return s.submit(WithContext(ctx, s.hclient), addr, build, seeds)
+}
+
+func (s *Sequencer) submit(hclient Client, addr string, build func(SequenceNumber) (*Tx, error), seeds []string) (*TransactionSuccess, error) {
+	lock := s.lock(addr)
+	lock.Lock()
+	defer lock.Unlock()
+	for try := 1; ; try++ {
+		seqnum, err := s.next(hclient, addr)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := build(seqnum)
+		if err != nil {
+			s.Reset(addr)
+			return nil, errors.Wrap(err, "building tx")
+		}
+		succ, err := SignAndSubmitTx(hclient, tx, seeds...)
+		if err == nil {
+			return succ, nil
+		}
+		s.Reset(addr)
+		if !isBadSeq(err) || try >= maxBadSeqTries {
+			return succ, err
+		}
+		log.Printf("tx from %s with sequence number %d rejected with tx_bad_seq, rebuilding", addr, seqnum)
+	}
+}
+
+// lock returns the lock serializing the submissions from addr.
+func (s *Sequencer) lock(addr string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locks[addr]
+	if !ok {
+		l = new(sync.Mutex)
+		s.locks[addr] = l
+	}
+	return l
+}
+
+func isBadSeq(err error) bool {
+	se := ParseSubmitError(err)
+	return se != nil && se.TxCode == "tx_bad_seq"
+}
@@ -0,0 +1,101 @@
+package stellar_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+// countingClient counts sequence number loads.
+type countingClient struct {
+	*stellar.HorizonClient
+	loads int
+}
+
+func (c *countingClient) SequenceForAccount(addr string) (stellar.SequenceNumber, error) {
+	c.loads++
+	return c.HorizonClient.SequenceForAccount(addr)
+}
+
+func TestSequencer(t *testing.T) {
+	srv := horizonmock.New()
+	defer srv.Close()
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(from.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(to.Address(), horizonmock.FriendbotAmount)
+
+	hclient := &countingClient{HorizonClient: srv.Client()}
+	pay := func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: srv.Passphrase,
+			Source:  from.Address(),
+			SeqNum:  seqnum,
+			Ops:     []stellar.Op{stellar.Payment{Destination: to.Address(), Amount: 1e7}},
+		}, nil
+	}
+	submit := func(s *stellar.Sequencer) {
+		t.Helper()
+		_, err := s.Submit(from.Address(), pay, from.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seqs := stellar.NewSequencer(hclient)
+	for i := 0; i < 3; i++ {
+		submit(seqs)
+	}
+	if hclient.loads != 1 {
+		t.Errorf("loaded sequence number %d times for 3 txs, want 1", hclient.loads)
+	}
+
+	// Another user of the account makes the cache stale.
+	submit(stellar.NewSequencer(srv.Client()))
+	hclient.loads = 0
+	submit(seqs)
+	if hclient.loads != 1 {
+		t.Errorf("loaded sequence number %d times after it went stale, want 1", hclient.loads)
+	}
+
+	srv.Inject(horizonmock.EndpointSubmit, horizonmock.BadSeq, stellar.MaxBadSeqTries-1)
+	submit(seqs)
+
+	srv.Inject(horizonmock.EndpointSubmit, horizonmock.BadSeq, stellar.MaxBadSeqTries)
+	_, err = seqs.Submit(from.Address(), pay, from.Seed())
+	if !stellar.IsBadSeq(err) {
+		t.Errorf("got error %v, want tx_bad_seq after %d tries", err, stellar.MaxBadSeqTries)
+	}
+
+	// Concurrent submissions from the account take turns,
+	// so none is rejected and reloads the sequence number.
+	submit(seqs)
+	hclient.loads = 0
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = seqs.Submit(from.Address(), pay, from.Seed())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if hclient.loads != 0 {
+		t.Errorf("loaded sequence number %d times for concurrent txs, want 0", hclient.loads)
+	}
+}
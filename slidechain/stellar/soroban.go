@@ -0,0 +1,65 @@
+package stellar
+
+import "github.com/chain/txvm/errors"
+
+// ContractTransfer is a transfer of a classic Stellar asset
+// by its Stellar Asset Contract,
+// made by an invoke_host_function operation of a Soroban tx.
+type ContractTransfer struct {
+	OpIndex  int    // index of the operation in its tx
+	From, To string // G... accounts or C... contracts
+	Asset    Asset
+	Amount   int64 // stroops
+}
+
+// assetBalanceChange is an entry of the asset_balance_changes
+// of an invoke_host_function operation,
+// which Horizon derives from the contract events in the tx meta.
+type assetBalanceChange struct {
+	AssetType   string `json:"asset_type"`
+	AssetCode   string `json:"asset_code"`
+	AssetIssuer string `json:"asset_issuer"`
+	Type        string `json:"type"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      string `json:"amount"`
+}
+
+// ContractTransfers returns the asset contract transfers
+// among the operations of a tx, in order.
+// They are derived from the contract events in the tx meta,
+// which Horizon does for the tx's operations,
+// so they are read from those; see TxOperations.
+func ContractTransfers(ops []Operation) ([]ContractTransfer, error) {
+	var transfers []ContractTransfer
+	for i, op := range ops {
+		if op.Type != "invoke_host_function" {
+			continue
+		}
+		for _, c := range op.AssetBalanceChanges {
+			if c.Type != "transfer" {
+				continue
+			}
+			asset := NativeAsset()
+			if c.AssetType != "native" {
+				var err error
+				asset, err = NewAsset(c.AssetCode, c.AssetIssuer)
+				if err != nil {
+					return nil, errors.Wrapf(err, "parsing asset of op %d", i)
+				}
+			}
+			amount, err := ParseAmount(c.Amount)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing amount of op %d", i)
+			}
+			transfers = append(transfers, ContractTransfer{
+				OpIndex: i,
+				From:    c.From,
+				To:      c.To,
+				Asset:   asset,
+				Amount:  amount,
+			})
+		}
+	}
+	return transfers, nil
+}
@@ -0,0 +1,149 @@
+package stellar
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// StreamTransactions calls handler with each tx of the account at addr
+// after cursor, in order, as Horizon streams them,
+// until ctx is done, when it returns nil.
+// The stream is reopened after the cursor of the last tx
+// whenever the server closes it.
+// A nil cursor starts at the beginning.
+func (c *HorizonClient) StreamTransactions(ctx context.Context, addr string, cursor *Cursor, handler func(Transaction)) error {
+	return c.stream(ctx, "/accounts/"+addr+"/transactions", cursor, func(data []byte) error {
+		var tx Transaction
+		err := json.Unmarshal(data, &tx)
+		if err != nil {
+			return errors.Wrap(err, "decoding tx")
+		}
+		handler(tx)
+		return nil
+	})
+}
+
+// StreamPayments is StreamTransactions for the payment-like operations
+// to or from the account at addr.
+func (c *HorizonClient) StreamPayments(ctx context.Context, addr string, cursor *Cursor, handler func(Operation)) error {
+	return c.stream(ctx, "/accounts/"+addr+"/payments", cursor, func(data []byte) error {
+		var op Operation
+		err := json.Unmarshal(data, &op)
+		if err != nil {
+			return errors.Wrap(err, "decoding payment")
+		}
+		handler(op)
+		return nil
+	})
+}
+
+// stream calls handler with the data of each message event
+// of the server-sent event stream at path.
+// Streams are long-lived, so it sends its requests
+// with an HTTP client that has no timeout,
+// not c.HTTP.
+func (c *HorizonClient) stream(ctx context.Context, path string, cursor *Cursor, handler func([]byte) error) error {
+	q := url.Values{}
+	if cursor != nil {
+		q.Set("cursor", string(*cursor))
+	}
+	for {
+		req, err := http.NewRequest("GET", strings.TrimRight(c.URL, "/")+path+"?"+q.Encode(), nil)
+		if err != nil {
+			return errors.Wrap(err, "building stream request")
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := new(http.Client).Do(req.WithContext(ctx))
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "opening stream")
+		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return fmt.Errorf("opening stream: status %s", resp.Status)
+		}
+		err = readEvents(resp.Body, func(id string, data []byte) error {
+			if id != "" {
+				q.Set("cursor", id)
+			}
+			return handler(data)
+		})
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readEvents reads server-sent events from r until it ends,
+// calling f with the ID and data of each message event.
+// Other events, such as the open event Horizon starts with,
+// are skipped.
+func readEvents(r io.Reader, f func(id string, data []byte) error) error {
+	var (
+		br      = bufio.NewReader(r)
+		event   string
+		id      string
+		data    strings.Builder
+		hasData bool
+	)
+	dispatch := func() error {
+		var err error
+		if hasData && (event == "" || event == "message") {
+			err = f(id, []byte(data.String()))
+		}
+		event, id, hasData = "", "", false
+		data.Reset()
+		return err
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "reading stream")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if derr := dispatch(); derr != nil {
+				return derr
+			}
+		case strings.HasPrefix(line, ":"):
+			// A comment, such as a keepalive.
+		default:
+			field, value := line, ""
+			if i := strings.IndexByte(line, ':'); i >= 0 {
+				field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+			}
+			switch field {
+			case "event":
+				event = value
+			case "id":
+				id = value
+			case "data":
+				if hasData {
+					data.WriteByte('\n')
+				}
+				data.WriteString(value)
+				hasData = true
+			}
+		}
+		if err == io.EOF {
+			// So does the end of the stream.
+			return dispatch()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package stellar
+
+import (
+	"strings"
+
+	"github.com/chain/txvm/errors"
+)
+
+// SubmitError is the rejection of a submitted tx by Stellar,
+// by the result codes Horizon reports it with.
+type SubmitError struct {
+	TxCode  string   `json:"tx_code"`            // e.g. tx_failed
+	OpCodes []string `json:"op_codes,omitempty"` // e.g. op_success, op_no_trust
+
+	// Message says in words why the tx was rejected,
+	// e.g. "destination has no trustline for the asset".
+	Message string `json:"message"`
+
+	// Retriable means the same tx may yet be applied if it is submitted again.
+	Retriable bool `json:"retriable"`
+
+	err *HorizonError
+}
+
+func (e *SubmitError) Error() string {
+	codes := e.TxCode
+	if len(e.OpCodes) > 0 {
+		codes += " (" + strings.Join(e.OpCodes, ", ") + ")"
+	}
+	return codes + ": " + e.Message
+}
+
+// Unwrap returns the Horizon error e was parsed from.
+func (e *SubmitError) Unwrap() error {
+	return e.err
+}
+
+// ParseSubmitError returns the SubmitError in err,
+// from SignAndSubmitTx, SignAndSubmitTxAsync, or a Sequencer,
+// or nil if err is not a rejection with result codes,
+// such as a timeout.
+func ParseSubmitError(err error) *SubmitError {
+	if se, ok := errors.Root(err).(*SubmitError); ok {
+		return se
+	}
+	herr, ok := errors.Root(err).(*HorizonError)
+	if !ok {
+		return nil
+	}
+	codes, cerr := herr.ResultCodes()
+	if cerr != nil || codes == nil || codes.TransactionCode == "" {
+		return nil
+	}
+	se := &SubmitError{
+		TxCode:    codes.TransactionCode,
+		OpCodes:   codes.OperationCodes,
+		Retriable: retriableTxCodes[codes.TransactionCode],
+		err:       herr,
+	}
+	var msgs []string
+	for _, code := range codes.OperationCodes {
+		if code == "op_success" {
+			continue
+		}
+		msg, ok := opCodeMessages[code]
+		if !ok {
+			msg = "an operation failed with " + code
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		msg, ok := txCodeMessages[codes.TransactionCode]
+		if !ok {
+			msg = "the tx failed with " + codes.TransactionCode
+		}
+		msgs = append(msgs, msg)
+	}
+	se.Message = strings.Join(msgs, "; ")
+	return se
+}
+
+// retriableTxCodes are the tx result codes of rejections
+// that the passage of time or a rebuilt sequence number may cure.
+var retriableTxCodes = map[string]bool{
+	"tx_bad_seq":               true,
+	"tx_insufficient_fee":      true,
+	"tx_too_early":             true,
+	"tx_bad_minseq_age_or_gap": true,
+}
+
+var txCodeMessages = map[string]string{
+	"tx_failed":                "an operation failed",
+	"tx_too_early":             "the tx's time or ledger bounds have not yet begun",
+	"tx_too_late":              "the tx's time or ledger bounds have passed",
+	"tx_bad_minseq_age_or_gap": "the source account's sequence number changed too recently",
+	"tx_missing_operation":     "the tx has no operations",
+	"tx_bad_seq":               "the source account's sequence number has changed",
+	"tx_bad_auth":              "the tx lacks the signatures it needs",
+	"tx_insufficient_balance":  "the fee would take the source account below its lumen reserve",
+	"tx_no_account":            "the source account does not exist",
+	"tx_insufficient_fee":      "the fee is too low",
+	"tx_bad_auth_extra":        "the tx has unneeded signatures",
+	"tx_internal_error":        "Stellar had an internal error",
+}
+
+var opCodeMessages = map[string]string{
+	"op_bad_auth":           "an operation lacks the signatures it needs",
+	"op_no_source_account":  "an operation's source account does not exist",
+	"op_no_account":         "the account does not exist",
+	"op_malformed":          "an operation is malformed",
+	"op_underfunded":        "the sender has too little of the asset",
+	"op_src_no_trust":       "the sender has no trustline for the asset",
+	"op_src_not_authorized": "the sender is not authorized to send the asset",
+	"op_no_destination":     "destination account does not exist",
+	"op_no_trust":           "destination has no trustline for the asset",
+	"op_not_authorized":     "destination is not authorized to hold the asset",
+	"op_line_full":          "destination's trustline limit would be exceeded",
+	"op_no_issuer":          "the asset's issuer does not exist",
+	"op_low_reserve":        "the account would fall below its lumen reserve",
+	"op_already_exists":     "the account already exists",
+	"op_has_sub_entries":    "the merged account still has trustlines or offers",
+	"op_immutable_set":      "the merged account's flags are immutable",
+	"op_dest_full":          "destination cannot hold more lumens",
+}
@@ -0,0 +1,61 @@
+package stellar_test
+
+import (
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestParseSubmitError(t *testing.T) {
+	srv := horizonmock.New()
+	defer srv.Close()
+	issuer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(issuer.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(to.Address(), horizonmock.FriendbotAmount)
+
+	usd := stellar.Asset{Code: "USD", Issuer: issuer.Address()}
+	pay := func(dest string) func(stellar.SequenceNumber) (*stellar.Tx, error) {
+		return func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  issuer.Address(),
+				SeqNum:  seqnum,
+				Ops:     []stellar.Op{stellar.Payment{Destination: dest, Asset: usd, Amount: 1e7}},
+			}, nil
+		}
+	}
+	_, err = stellar.NewSequencer(srv.Client()).Submit(issuer.Address(), pay(to.Address()), issuer.Seed())
+	se := stellar.ParseSubmitError(errors.Wrap(err, "paying"))
+	if se == nil {
+		t.Fatalf("got no SubmitError from %v", err)
+	}
+	if se.TxCode != "tx_failed" || len(se.OpCodes) != 1 || se.OpCodes[0] != "op_no_trust" || se.Retriable {
+		t.Errorf("got %+v, want a non-retriable tx_failed with op_no_trust", se)
+	}
+	if se.Message != "destination has no trustline for the asset" {
+		t.Errorf("got message %q", se.Message)
+	}
+	if again := stellar.ParseSubmitError(errors.Sub(se, err)); again != se {
+		t.Errorf("got %v from a SubmitError, want it back", again)
+	}
+
+	srv.Inject(horizonmock.EndpointSubmit, horizonmock.BadSeq, stellar.MaxBadSeqTries)
+	_, err = stellar.NewSequencer(srv.Client()).Submit(issuer.Address(), pay(issuer.Address()), issuer.Seed())
+	if se := stellar.ParseSubmitError(err); se == nil || se.TxCode != "tx_bad_seq" || !se.Retriable {
+		t.Errorf("got %+v, want a retriable tx_bad_seq", se)
+	}
+
+	if se := stellar.ParseSubmitError(errors.New("timeout")); se != nil {
+		t.Errorf("got %+v from an error without result codes", se)
+	}
+}
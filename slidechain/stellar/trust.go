@@ -0,0 +1,112 @@
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/stellar/go/amount"
+)
+
+// Trustline reports whether the account at addr
+// has a trustline to the credit asset,
+// and whether its issuer has authorized it.
+// A trustline of an asset whose issuer does not require authorization
+// is authorized.
+func Trustline(ctx context.Context, hclient Client, addr string, asset Asset) (trusted, authorized bool, err error) {
+	acct, err := WithContext(ctx, hclient).LoadAccount(addr)
+	if err != nil {
+		return false, false, errors.Wrapf(err, "getting account %s", addr)
+	}
+	for _, bal := range acct.Balances {
+		if bal.AssetCode == asset.Code && bal.AssetIssuer == asset.Issuer {
+			// Horizons that predate is_authorized
+			// cannot say otherwise.
+			return true, bal.IsAuthorized == nil || *bal.IsAuthorized, nil
+		}
+	}
+	return false, false, nil
+}
+
+// IssuerFlags are the flags of an issuing account
+// that govern the trustlines to its assets.
+type IssuerFlags struct {
+	AuthRequired  bool `json:"auth_required"`
+	AuthRevocable bool `json:"auth_revocable"`
+	Clawback      bool `json:"auth_clawback_enabled"`
+}
+
+// AccountFlags returns the issuer flags of the account at addr.
+func AccountFlags(ctx context.Context, hclient Client, addr string) (IssuerFlags, error) {
+	acct, err := WithContext(ctx, hclient).LoadAccount(addr)
+	return acct.Flags, errors.Wrapf(err, "getting account %s", addr)
+}
+
+// AssetSupply returns the total amount of the credit asset
+// held in trustlines, authorized or not,
+// in stroops.
+// An asset no account trusts has no supply.
+// The Client interface has no call for it,
+// so hclient must be a *HorizonClient.
+func AssetSupply(ctx context.Context, hclient Client, code, issuer string) (int64, error) {
+	var page struct {
+		Embedded struct {
+			Records []struct {
+				Amount   string `json:"amount"`
+				Balances *struct {
+					Authorized                      string `json:"authorized"`
+					AuthorizedToMaintainLiabilities string `json:"authorized_to_maintain_liabilities"`
+					Unauthorized                    string `json:"unauthorized"`
+				} `json:"balances"`
+			} `json:"records"`
+		} `json:"_embedded"`
+	}
+	path := "assets?" + url.Values{"asset_code": {code}, "asset_issuer": {issuer}}.Encode()
+	err := getJSON(ctx, hclient, path, &page)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting asset %s:%s", code, issuer)
+	}
+	if len(page.Embedded.Records) == 0 {
+		return 0, nil
+	}
+	rec := page.Embedded.Records[0]
+	amounts := []string{rec.Amount}
+	if rec.Balances != nil {
+		// Horizons that break down the supply
+		// count only authorized trustlines in amount.
+		amounts = []string{rec.Balances.Authorized, rec.Balances.AuthorizedToMaintainLiabilities, rec.Balances.Unauthorized}
+	}
+	var total int64
+	for _, a := range amounts {
+		if a == "" {
+			continue
+		}
+		n, err := amount.ParseInt64(a)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing supply of %s:%s", code, issuer)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// getJSON decodes the JSON response to a GET of path on the Horizon server.
+func getJSON(ctx context.Context, hclient Client, path string, v interface{}) error {
+	hc, ok := hclient.(*HorizonClient)
+	if !ok {
+		return errors.New("reading raw Horizon resources needs an HTTP Horizon client")
+	}
+	resp, err := withContext(ctx, hc).Get(strings.TrimRight(hc.URL, "/") + "/" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "decoding response")
+}
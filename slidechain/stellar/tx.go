@@ -4,34 +4,28 @@ import (
 	"log"
 
 	"github.com/chain/txvm/errors"
-	b "github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
-	"github.com/stellar/go/xdr"
 )
 
 // SignAndSubmitTx signs and submits a transaction to the Stellar network. If there is
 // an error, SubmitTx will log the Result string to the console and return the error.
-func SignAndSubmitTx(hclient horizon.ClientInterface, tx *b.TransactionBuilder, seeds ...string) (*horizon.TransactionSuccess, error) {
-	txenv, err := tx.Sign(seeds...)
+func SignAndSubmitTx(hclient Client, tx *Tx, seeds ...string) (*TransactionSuccess, error) {
+	txstr, err := tx.Sign(seeds...)
 	if err != nil {
 		return nil, errors.Wrap(err, "signing tx")
 	}
-	txstr, err := xdr.MarshalBase64(txenv.E)
-	if err != nil {
-		return nil, errors.Wrap(err, "marshaling pre-export txenv")
-	}
 	resp, submitErr := hclient.SubmitTransaction(txstr)
 	if submitErr != nil {
 		// Attempt to extract more detailed result information
-		log.Printf("error submitting tx: %s\ntx: %s", submitErr, txstr)
+		hash, _ := TxHash(tx)
+		log.Printf("error submitting tx %s: %s\ntx: %s", hash, submitErr, txstr)
 		var (
 			resultStr string
 			err       error
 		)
-		if herr, ok := submitErr.(*horizon.Error); ok {
+		if herr, ok := submitErr.(*HorizonError); ok {
 			resultStr, err = herr.ResultString()
 			if err != nil {
-				log.Print(err, "extracting result string from horizon.Error")
+				log.Print(err, "extracting result string from HorizonError")
 				resultStr = ""
 			}
 		}
@@ -45,3 +39,17 @@ func SignAndSubmitTx(hclient horizon.ClientInterface, tx *b.TransactionBuilder,
 	}
 	return &resp, submitErr
 }
+
+// LoadAppliedTx returns the tx with the given hash,
+// or nil if Horizon has no such tx:
+// it has not been applied, or not yet.
+func LoadAppliedTx(hclient Client, hash string) (*Transaction, error) {
+	tx, err := hclient.LoadTransaction(hash)
+	if err == nil {
+		return &tx, nil
+	}
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	return nil, errors.Wrapf(err, "loading tx %s", hash)
+}
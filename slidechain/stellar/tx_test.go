@@ -0,0 +1,60 @@
+package stellar_test
+
+import (
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestTxHash(t *testing.T) {
+	srv := horizonmock.New()
+	defer srv.Close()
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(from.Address(), horizonmock.FriendbotAmount)
+	srv.Fund(to.Address(), horizonmock.FriendbotAmount)
+	seqnum, err := srv.Client().SequenceForAccount(from.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &stellar.Tx{
+		Network: srv.Passphrase,
+		Source:  from.Address(),
+		SeqNum:  seqnum + 1,
+		Ops:     []stellar.Op{stellar.Payment{Destination: to.Address(), Amount: 1e7}},
+	}
+	hash, err := stellar.TxHash(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := stellar.LoadAppliedTx(srv.Client(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != nil {
+		t.Fatalf("found tx %s before submitting it", hash)
+	}
+
+	resp, err := stellar.SignAndSubmitTx(srv.Client(), tx, from.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Hash != hash {
+		t.Errorf("submitted tx has hash %s, want %s", resp.Hash, hash)
+	}
+	applied, err = stellar.LoadAppliedTx(srv.Client(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied == nil || applied.Hash != hash {
+		t.Errorf("got %+v looking up tx %s after submitting it", applied, hash)
+	}
+}
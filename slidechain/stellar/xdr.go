@@ -0,0 +1,664 @@
+package stellar
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+	"github.com/stellar/go/xdr"
+)
+
+// The types of this package stand in for those of the SDK,
+// its XDR and txnbuild, which nothing outside this package uses,
+// so that an SDK upgrade is confined to it.
+// This file converts between them.
+
+// MarshalBinary returns the XDR encoding of a.
+func (a Asset) MarshalBinary() ([]byte, error) {
+	xa, err := xdrAsset(a)
+	if err != nil {
+		return nil, err
+	}
+	return xa.MarshalBinary()
+}
+
+// DecodeAsset decodes the XDR encoding of an asset.
+func DecodeAsset(b []byte) (Asset, error) {
+	var xa xdr.Asset
+	err := xdr.SafeUnmarshal(b, &xa)
+	if err != nil {
+		return Asset{}, errors.Wrap(err, "decoding asset")
+	}
+	return assetFromXDR(xa)
+}
+
+// MarshalAccountID returns the XDR encoding of the account ID
+// with the given address.
+func MarshalAccountID(addr string) ([]byte, error) {
+	id, err := xdrAccountID(addr)
+	if err != nil {
+		return nil, err
+	}
+	return id.MarshalBinary()
+}
+
+// DecodeAccountID decodes the XDR encoding of an account ID,
+// returning its address.
+func DecodeAccountID(b []byte) (string, error) {
+	var id xdr.AccountId
+	err := xdr.SafeUnmarshal(b, &id)
+	if err != nil {
+		return "", errors.Wrap(err, "decoding account ID")
+	}
+	return id.Address(), nil
+}
+
+// Hash returns the hash of tx, which its signatures sign.
+func (tx *Tx) Hash() ([32]byte, error) {
+	t, err := tx.txnbuild()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	hash, err := t.Hash(tx.Network)
+	return hash, errors.Wrap(err, "hashing tx")
+}
+
+// Sign returns the base64 XDR envelope of tx
+// with its Signatures and those of seeds.
+// With no seeds, it is the envelope of tx as it is.
+func (tx *Tx) Sign(seeds ...string) (string, error) {
+	t, err := tx.txnbuild()
+	if err != nil {
+		return "", err
+	}
+	kps, err := parseSeeds(seeds)
+	if err != nil {
+		return "", err
+	}
+	t, err = t.Sign(tx.Network, kps...)
+	if err != nil {
+		return "", errors.Wrap(err, "signing tx")
+	}
+	envXDR, err := t.Base64()
+	return envXDR, errors.Wrap(err, "marshaling tx envelope")
+}
+
+// DecodeTx decodes a base64 XDR tx envelope,
+// or the inner tx of a fee-bump envelope.
+// The network is not in it,
+// so the Network of the tx is empty until the caller sets it.
+func DecodeTx(envXDR string) (*Tx, error) {
+	gtx, err := txnbuild.TransactionFromXDR(envXDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding tx envelope")
+	}
+	t, ok := gtx.Transaction()
+	if !ok {
+		fb, _ := gtx.FeeBump()
+		t = fb.InnerTransaction()
+	}
+	return txFromTxnbuild(t)
+}
+
+// Hash returns the hash of fb, which its signatures sign.
+func (fb *FeeBump) Hash() ([32]byte, error) {
+	t, err := fb.txnbuild()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	hash, err := t.Hash(fb.Inner.Network)
+	return hash, errors.Wrap(err, "hashing fee bump")
+}
+
+// Sign returns the base64 XDR envelope of fb
+// with its Signatures and those of seeds.
+// The signatures of its inner tx are those of Inner.
+func (fb *FeeBump) Sign(seeds ...string) (string, error) {
+	t, err := fb.txnbuild()
+	if err != nil {
+		return "", err
+	}
+	kps, err := parseSeeds(seeds)
+	if err != nil {
+		return "", err
+	}
+	t, err = t.Sign(fb.Inner.Network, kps...)
+	if err != nil {
+		return "", errors.Wrap(err, "signing fee bump")
+	}
+	envXDR, err := t.Base64()
+	return envXDR, errors.Wrap(err, "marshaling fee-bump envelope")
+}
+
+// DecodeFeeBump decodes a base64 XDR fee-bump envelope.
+// The Network of its inner tx is empty until the caller sets it.
+func DecodeFeeBump(envXDR string) (*FeeBump, error) {
+	gtx, err := txnbuild.TransactionFromXDR(envXDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding fee-bump envelope")
+	}
+	t, ok := gtx.FeeBump()
+	if !ok {
+		return nil, errors.New("not a fee-bump envelope")
+	}
+	inner, err := txFromTxnbuild(t.InnerTransaction())
+	if err != nil {
+		return nil, errors.Wrap(err, "inner tx")
+	}
+	return &FeeBump{
+		FeeSource:  t.FeeAccount(),
+		Fee:        t.MaxFee(),
+		Inner:      inner,
+		Signatures: signaturesFromXDR(t.Signatures()),
+	}, nil
+}
+
+// txnbuild returns tx as a txnbuild tx, with its Signatures.
+//
+// txnbuild gives every tx time bounds
+// and a fee of its base fee per op.
+// A tx with no preconditions is given none instead,
+// so that it has the hash it had
+// when the earlier SDK built it as a v0 envelope,
+// as a tx preauthorized by that hash must,
+// and a tx with a Fee is given that.
+func (tx *Tx) txnbuild() (*txnbuild.Transaction, error) {
+	if tx.Network == "" {
+		return nil, errors.New("tx has no network passphrase")
+	}
+	fee := tx.TotalFee()
+	if fee > math.MaxUint32 {
+		return nil, fmt.Errorf("tx fee %d overflows", fee)
+	}
+	params := txnbuild.TransactionParams{
+		SourceAccount: &txnbuild.SimpleAccount{AccountID: tx.Source, Sequence: int64(tx.SeqNum)},
+		Preconditions: tx.preconditions(),
+	}
+	var err error
+	params.Memo, err = txnbuildMemo(tx.Memo)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range tx.Ops {
+		tbop, err := txnbuildOp(op)
+		if err != nil {
+			return nil, errors.Wrapf(err, "op %d", i)
+		}
+		params.Operations = append(params.Operations, tbop)
+	}
+	t, err := txnbuild.NewTransaction(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "building tx")
+	}
+	env := t.ToXDR()
+	if tx.TimeBounds == nil && !tx.hasPreconditions() {
+		env.V1.Tx.Cond = xdr.Preconditions{Type: xdr.PreconditionTypePrecondNone}
+	}
+	env.V1.Tx.Fee = xdr.Uint32(fee)
+	env.V1.Signatures = signaturesToXDR(tx.Signatures)
+	gtx, err := reparse(env)
+	if err != nil {
+		return nil, err
+	}
+	t, _ = gtx.Transaction()
+	return t, nil
+}
+
+// txnbuild returns fb as a txnbuild fee bump, with its Signatures.
+func (fb *FeeBump) txnbuild() (*txnbuild.FeeBumpTransaction, error) {
+	if fb.Inner == nil {
+		return nil, errors.New("fee bump has no inner tx")
+	}
+	inner, err := fb.Inner.txnbuild()
+	if err != nil {
+		return nil, errors.Wrap(err, "inner tx")
+	}
+	fee := fb.TotalFee()
+	t, err := txnbuild.NewFeeBumpTransaction(txnbuild.FeeBumpTransactionParams{
+		Inner:      inner,
+		FeeAccount: fb.FeeSource,
+		BaseFee:    fee / int64(len(fb.Inner.Ops)+1),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "building fee bump")
+	}
+	env := t.ToXDR()
+	env.FeeBump.Tx.Fee = xdr.Int64(fee)
+	env.FeeBump.Signatures = signaturesToXDR(fb.Signatures)
+	gtx, err := reparse(env)
+	if err != nil {
+		return nil, err
+	}
+	t, _ = gtx.FeeBump()
+	return t, nil
+}
+
+// reparse returns the txnbuild tx of env,
+// an envelope txnbuild built and this file then changed.
+func reparse(env xdr.TransactionEnvelope) (*txnbuild.GenericTransaction, error) {
+	envXDR, err := xdr.MarshalBase64(env)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling tx envelope")
+	}
+	gtx, err := txnbuild.TransactionFromXDR(envXDR)
+	return gtx, errors.Wrap(err, "decoding tx envelope")
+}
+
+// preconditions returns the txnbuild preconditions of tx.
+// A tx with no time bounds has unbounded ones.
+func (tx *Tx) preconditions() txnbuild.Preconditions {
+	cond := txnbuild.Preconditions{
+		TimeBounds:                 txnbuild.NewInfiniteTimeout(),
+		MinSequenceNumberAge:       tx.MinSeqAge,
+		MinSequenceNumberLedgerGap: tx.MinSeqLedgerGap,
+	}
+	if tb := tx.TimeBounds; tb != nil {
+		cond.TimeBounds = txnbuild.NewTimebounds(tb.MinTime, tb.MaxTime)
+	}
+	if lb := tx.LedgerBounds; lb != nil {
+		cond.LedgerBounds = &txnbuild.LedgerBounds{MinLedger: lb.MinLedger, MaxLedger: lb.MaxLedger}
+	}
+	if tx.MinSeqNum != nil {
+		n := int64(*tx.MinSeqNum)
+		cond.MinSequenceNumber = &n
+	}
+	return cond
+}
+
+func txFromTxnbuild(t *txnbuild.Transaction) (*Tx, error) {
+	env := t.ToXDR()
+	tx := &Tx{
+		Source:     t.SourceAccount().AccountID,
+		SeqNum:     SequenceNumber(t.SequenceNumber()),
+		Fee:        env.Fee(),
+		Signatures: signaturesFromXDR(t.Signatures()),
+	}
+	setPreconditions(tx, env.Preconditions())
+	var err error
+	tx.Memo, err = memoFromTxnbuild(t.Memo())
+	if err != nil {
+		return nil, err
+	}
+	xops := env.Operations()
+	for i, tbop := range t.Operations() {
+		op, err := opFromTxnbuild(tbop, xops[i].Body.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding op %d", i)
+		}
+		tx.Ops = append(tx.Ops, op)
+	}
+	return tx, nil
+}
+
+// setPreconditions sets the time bounds and other preconditions of tx
+// from cond.
+// Those of protocol 19 always have time bounds,
+// which are none if they are zero.
+func setPreconditions(tx *Tx, cond xdr.Preconditions) {
+	switch cond.Type {
+	case xdr.PreconditionTypePrecondTime:
+		tb := cond.MustTimeBounds()
+		tx.TimeBounds = &TimeBounds{MinTime: int64(tb.MinTime), MaxTime: int64(tb.MaxTime)}
+
+	case xdr.PreconditionTypePrecondV2:
+		v2 := cond.MustV2()
+		if tb := v2.TimeBounds; tb != nil && *tb != (xdr.TimeBounds{}) {
+			tx.TimeBounds = &TimeBounds{MinTime: int64(tb.MinTime), MaxTime: int64(tb.MaxTime)}
+		}
+		if lb := v2.LedgerBounds; lb != nil {
+			tx.LedgerBounds = &LedgerBounds{MinLedger: uint32(lb.MinLedger), MaxLedger: uint32(lb.MaxLedger)}
+		}
+		if v2.MinSeqNum != nil {
+			n := SequenceNumber(*v2.MinSeqNum)
+			tx.MinSeqNum = &n
+		}
+		tx.MinSeqAge = uint64(v2.MinSeqAge)
+		tx.MinSeqLedgerGap = uint32(v2.MinSeqLedgerGap)
+	}
+}
+
+// parseSeeds returns the keypairs of seeds.
+func parseSeeds(seeds []string) ([]*keypair.Full, error) {
+	var kps []*keypair.Full
+	for _, seed := range seeds {
+		kp, err := keypair.Parse(seed)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing seed")
+		}
+		full, ok := kp.(*keypair.Full)
+		if !ok {
+			return nil, errors.New("signing with an address, not a seed")
+		}
+		kps = append(kps, full)
+	}
+	return kps, nil
+}
+
+func signaturesToXDR(sigs []Signature) []xdr.DecoratedSignature {
+	var xsigs []xdr.DecoratedSignature
+	for _, sig := range sigs {
+		xsigs = append(xsigs, xdr.DecoratedSignature{
+			Hint:      xdr.SignatureHint(sig.Hint),
+			Signature: xdr.Signature(sig.Signature),
+		})
+	}
+	return xsigs
+}
+
+func signaturesFromXDR(xsigs []xdr.DecoratedSignature) []Signature {
+	var sigs []Signature
+	for _, sig := range xsigs {
+		sigs = append(sigs, Signature{Hint: [4]byte(sig.Hint), Signature: []byte(sig.Signature)})
+	}
+	return sigs
+}
+
+func txnbuildMemo(m Memo) (txnbuild.Memo, error) {
+	switch m := m.(type) {
+	case nil:
+		return nil, nil
+	case MemoText:
+		if len(m) > 28 {
+			return nil, fmt.Errorf("memo text %q is over 28 bytes", string(m))
+		}
+		return txnbuild.MemoText(m), nil
+	case MemoID:
+		return txnbuild.MemoID(m), nil
+	case MemoHash:
+		return txnbuild.MemoHash(m), nil
+	case MemoReturn:
+		return txnbuild.MemoReturn(m), nil
+	}
+	return nil, fmt.Errorf("unknown memo type %T", m)
+}
+
+func memoFromTxnbuild(m txnbuild.Memo) (Memo, error) {
+	switch m := m.(type) {
+	case nil:
+		return nil, nil
+	case txnbuild.MemoText:
+		return MemoText(m), nil
+	case txnbuild.MemoID:
+		return MemoID(m), nil
+	case txnbuild.MemoHash:
+		return MemoHash(m), nil
+	case txnbuild.MemoReturn:
+		return MemoReturn(m), nil
+	}
+	return nil, fmt.Errorf("unknown memo type %T", m)
+}
+
+func txnbuildOp(op Op) (txnbuild.Operation, error) {
+	src := op.source()
+	switch op := op.(type) {
+	case Payment:
+		return &txnbuild.Payment{
+			SourceAccount: src,
+			Destination:   op.Destination,
+			Asset:         txnbuildAsset(op.Asset),
+			Amount:        FormatAmount(op.Amount),
+		}, nil
+
+	case PathPayment:
+		p := &txnbuild.PathPayment{
+			SourceAccount: src,
+			SendAsset:     txnbuildAsset(op.SendAsset),
+			SendMax:       FormatAmount(op.SendMax),
+			Destination:   op.Destination,
+			DestAsset:     txnbuildAsset(op.DestAsset),
+			DestAmount:    FormatAmount(op.DestAmount),
+		}
+		for _, a := range op.Path {
+			p.Path = append(p.Path, txnbuildAsset(a))
+		}
+		return p, nil
+
+	case CreateAccount:
+		return &txnbuild.CreateAccount{SourceAccount: src, Destination: op.Destination, Amount: FormatAmount(op.Amount)}, nil
+
+	case AccountMerge:
+		return &txnbuild.AccountMerge{SourceAccount: src, Destination: op.Destination}, nil
+
+	case ChangeTrust:
+		if op.Asset.IsNative() {
+			return nil, errors.New("trustline of lumens")
+		}
+		return &txnbuild.ChangeTrust{
+			SourceAccount: src,
+			Line:          txnbuild.CreditAsset{Code: op.Asset.Code, Issuer: op.Asset.Issuer}.MustToChangeTrustAsset(),
+			Limit:         FormatAmount(op.Limit),
+		}, nil
+
+	case SetOptions:
+		s := &txnbuild.SetOptions{
+			SourceAccount: src,
+			ClearFlags:    txnbuildFlags(op.ClearFlags),
+			SetFlags:      txnbuildFlags(op.SetFlags),
+			HomeDomain:    op.HomeDomain,
+		}
+		var err error
+		for _, t := range []struct {
+			v   *uint32
+			tbv **txnbuild.Threshold
+		}{
+			{op.MasterWeight, &s.MasterWeight},
+			{op.LowThreshold, &s.LowThreshold},
+			{op.MedThreshold, &s.MediumThreshold},
+			{op.HighThreshold, &s.HighThreshold},
+		} {
+			*t.tbv, err = txnbuildThreshold(t.v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if op.Signer != nil {
+			w, err := txnbuildThreshold(&op.Signer.Weight)
+			if err != nil {
+				return nil, errors.Wrap(err, "signer")
+			}
+			s.Signer = &txnbuild.Signer{Address: op.Signer.Key, Weight: *w}
+		}
+		return s, nil
+
+	case AllowTrust:
+		return &txnbuild.AllowTrust{
+			SourceAccount: src,
+			Trustor:       op.Trustor,
+			Type:          txnbuild.CreditAsset{Code: op.Code},
+			Authorize:     op.Authorize,
+		}, nil
+
+	case BumpSequence:
+		return &txnbuild.BumpSequence{SourceAccount: src, BumpTo: int64(op.BumpTo)}, nil
+
+	case ManageData:
+		return &txnbuild.ManageData{SourceAccount: src, Name: op.Name, Value: op.Value}, nil
+	}
+	return nil, fmt.Errorf("cannot build op of type %T", op)
+}
+
+// opFromTxnbuild returns the Op of tbop,
+// whose XDR type is typ.
+func opFromTxnbuild(tbop txnbuild.Operation, typ xdr.OperationType) (Op, error) {
+	source := tbop.GetSourceAccount()
+	switch tbop := tbop.(type) {
+	case *txnbuild.Payment:
+		asset, err := assetFromTxnbuild(tbop.Asset)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := ParseAmount(tbop.Amount)
+		return Payment{
+			Source:      source,
+			Destination: tbop.Destination,
+			Asset:       asset,
+			Amount:      amount,
+		}, err
+
+	case *txnbuild.PathPayment:
+		send, err := assetFromTxnbuild(tbop.SendAsset)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := assetFromTxnbuild(tbop.DestAsset)
+		if err != nil {
+			return nil, err
+		}
+		op := PathPayment{
+			Source:      source,
+			SendAsset:   send,
+			Destination: tbop.Destination,
+			DestAsset:   dest,
+		}
+		op.SendMax, err = ParseAmount(tbop.SendMax)
+		if err != nil {
+			return nil, err
+		}
+		op.DestAmount, err = ParseAmount(tbop.DestAmount)
+		if err != nil {
+			return nil, err
+		}
+		for _, tba := range tbop.Path {
+			a, err := assetFromTxnbuild(tba)
+			if err != nil {
+				return nil, err
+			}
+			op.Path = append(op.Path, a)
+		}
+		return op, nil
+
+	case *txnbuild.CreateAccount:
+		amount, err := ParseAmount(tbop.Amount)
+		return CreateAccount{Source: source, Destination: tbop.Destination, Amount: amount}, err
+
+	case *txnbuild.AccountMerge:
+		return AccountMerge{Source: source, Destination: tbop.Destination}, nil
+
+	case *txnbuild.ChangeTrust:
+		if _, ok := tbop.Line.GetLiquidityPoolID(); ok {
+			// A trustline of pool shares.
+			break
+		}
+		asset, err := assetFromTxnbuild(tbop.Line)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := ParseAmount(tbop.Limit)
+		return ChangeTrust{Source: source, Asset: asset, Limit: limit}, err
+
+	case *txnbuild.SetOptions:
+		op := SetOptions{
+			Source:        source,
+			ClearFlags:    flagsFromTxnbuild(tbop.ClearFlags),
+			SetFlags:      flagsFromTxnbuild(tbop.SetFlags),
+			MasterWeight:  thresholdFromTxnbuild(tbop.MasterWeight),
+			LowThreshold:  thresholdFromTxnbuild(tbop.LowThreshold),
+			MedThreshold:  thresholdFromTxnbuild(tbop.MediumThreshold),
+			HighThreshold: thresholdFromTxnbuild(tbop.HighThreshold),
+			HomeDomain:    tbop.HomeDomain,
+		}
+		if s := tbop.Signer; s != nil {
+			op.Signer = &AccountSigner{Key: s.Address, Weight: uint32(s.Weight)}
+		}
+		return op, nil
+
+	case *txnbuild.AllowTrust:
+		return AllowTrust{
+			Source:    source,
+			Trustor:   tbop.Trustor,
+			Code:      tbop.Type.GetCode(),
+			Authorize: tbop.Authorize,
+		}, nil
+
+	case *txnbuild.BumpSequence:
+		return BumpSequence{Source: source, BumpTo: SequenceNumber(tbop.BumpTo)}, nil
+
+	case *txnbuild.ManageData:
+		return ManageData{Source: source, Name: tbop.Name, Value: tbop.Value}, nil
+	}
+	return OtherOp{Source: source, Type: typ.String()}, nil
+}
+
+// txnbuildFlags splits the bits of flags.
+func txnbuildFlags(flags uint32) []txnbuild.AccountFlag {
+	var tbflags []txnbuild.AccountFlag
+	for f := uint32(1); f != 0 && f <= flags; f <<= 1 {
+		if flags&f != 0 {
+			tbflags = append(tbflags, txnbuild.AccountFlag(f))
+		}
+	}
+	return tbflags
+}
+
+func flagsFromTxnbuild(tbflags []txnbuild.AccountFlag) uint32 {
+	var flags uint32
+	for _, f := range tbflags {
+		flags |= uint32(f)
+	}
+	return flags
+}
+
+func txnbuildThreshold(v *uint32) (*txnbuild.Threshold, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if *v > math.MaxUint8 {
+		return nil, fmt.Errorf("weight %d is over %d", *v, math.MaxUint8)
+	}
+	return txnbuild.NewThreshold(txnbuild.Threshold(*v)), nil
+}
+
+func thresholdFromTxnbuild(t *txnbuild.Threshold) *uint32 {
+	if t == nil {
+		return nil
+	}
+	v := uint32(*t)
+	return &v
+}
+
+func txnbuildAsset(a Asset) txnbuild.Asset {
+	if a.IsNative() {
+		return txnbuild.NativeAsset{}
+	}
+	return txnbuild.CreditAsset{Code: a.Code, Issuer: a.Issuer}
+}
+
+func assetFromTxnbuild(a txnbuild.BasicAsset) (Asset, error) {
+	if a.IsNative() {
+		return NativeAsset(), nil
+	}
+	code := a.GetCode()
+	if strings.ContainsRune(code, 0) {
+		return Asset{}, fmt.Errorf("invalid asset code %q", code)
+	}
+	return Asset{Code: code, Issuer: a.GetIssuer()}, nil
+}
+
+func xdrAccountID(addr string) (xdr.AccountId, error) {
+	var id xdr.AccountId
+	err := id.SetAddress(addr)
+	return id, errors.Wrapf(err, "account %q", addr)
+}
+
+func xdrAsset(a Asset) (xdr.Asset, error) {
+	xa, err := txnbuildAsset(a).ToXDR()
+	return xa, errors.Wrapf(err, "asset %s", AssetKey(a))
+}
+
+func assetFromXDR(xa xdr.Asset) (Asset, error) {
+	if xa.Type == xdr.AssetTypeAssetTypeNative {
+		return NativeAsset(), nil
+	}
+	var code, issuer string
+	err := xa.Extract(new(xdr.AssetType), &code, &issuer)
+	if err != nil {
+		return Asset{}, errors.Wrap(err, "extracting asset")
+	}
+	if strings.ContainsRune(code, 0) {
+		return Asset{}, fmt.Errorf("invalid asset code %q", code)
+	}
+	return Asset{Code: code, Issuer: issuer}, nil
+}
@@ -0,0 +1,191 @@
+package stellar_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+func TestDecodeTx(t *testing.T) {
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd := stellar.Asset{Code: "USD", Issuer: from.Address()}
+	long := stellar.Asset{Code: "LONGASSET12", Issuer: to.Address()}
+	two := uint32(2)
+	domain := "example.com"
+	ops := []stellar.Op{
+		stellar.Payment{Destination: to.Address(), Asset: usd, Amount: 1},
+		stellar.PathPayment{Source: to.Address(), SendAsset: stellar.NativeAsset(), SendMax: 10, Destination: from.Address(), DestAsset: long, DestAmount: 5, Path: []stellar.Asset{usd}},
+		stellar.CreateAccount{Destination: to.Address(), Amount: 1e7},
+		stellar.AccountMerge{Destination: to.Address()},
+		stellar.ChangeTrust{Asset: long, Limit: stellar.MaxTrustLimit},
+		stellar.SetOptions{SetFlags: stellar.AuthRequired | stellar.AuthRevocable, MasterWeight: &two, HomeDomain: &domain, Signer: &stellar.AccountSigner{Key: to.Address(), Weight: 1}},
+		stellar.AllowTrust{Trustor: to.Address(), Code: "USD", Authorize: true},
+		stellar.BumpSequence{BumpTo: 99},
+		stellar.ManageData{Name: "config.memo_required", Value: []byte("1")},
+	}
+	memos := []stellar.Memo{
+		nil,
+		stellar.MemoText("hello"),
+		stellar.MemoID(18446744073709551615),
+		stellar.MemoHash{1, 2, 3},
+		stellar.MemoReturn{4, 5, 6},
+	}
+	for _, memo := range memos {
+		tx := &stellar.Tx{
+			Network:    network.TestNetworkPassphrase,
+			Source:     from.Address(),
+			SeqNum:     7,
+			BaseFee:    200,
+			Memo:       memo,
+			TimeBounds: &stellar.TimeBounds{MinTime: 1, MaxTime: 2},
+			Ops:        ops,
+		}
+		env, err := tx.Sign(from.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := stellar.DecodeTx(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Source != tx.Source || got.SeqNum != tx.SeqNum || got.TotalFee() != tx.TotalFee() || !reflect.DeepEqual(got.Memo, memo) || *got.TimeBounds != *tx.TimeBounds {
+			t.Errorf("decoded tx %+v, want %+v", got, tx)
+		}
+		if !reflect.DeepEqual(got.Ops, ops) {
+			t.Errorf("decoded ops %+v, want %+v", got.Ops, ops)
+		}
+		if len(got.Signatures) != 1 {
+			t.Errorf("decoded %d signatures, want 1", len(got.Signatures))
+		}
+	}
+
+	if _, err := stellar.DecodeTx("AAAA"); err == nil {
+		t.Error("decoded a truncated envelope")
+	}
+}
+
+func TestDecodeTxPreconditions(t *testing.T) {
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := stellar.MuxedAddress(from.Address(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := stellar.MuxedAddress(to.Address(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minSeq := stellar.SequenceNumber(3)
+	ops := []stellar.Op{
+		stellar.Payment{Source: source, Destination: dest, Asset: stellar.NativeAsset(), Amount: 1},
+		stellar.AccountMerge{Destination: dest},
+	}
+	for _, tx := range []*stellar.Tx{
+		{LedgerBounds: &stellar.LedgerBounds{MinLedger: 10, MaxLedger: 20}},
+		{TimeBounds: &stellar.TimeBounds{MinTime: 1}, MinSeqNum: &minSeq},
+		{MinSeqAge: 60, MinSeqLedgerGap: 5},
+	} {
+		tx.Network = network.TestNetworkPassphrase
+		tx.Source = source
+		tx.SeqNum = 7
+		tx.Ops = ops
+		env, err := tx.Sign(from.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := stellar.DecodeTx(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Network = tx.Network
+		got.Signatures = nil
+		got.Fee = 0
+		if !reflect.DeepEqual(got, tx) {
+			t.Errorf("decoded tx %+v, want %+v", got, tx)
+		}
+	}
+}
+
+func TestFeeBump(t *testing.T) {
+	from, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &stellar.Tx{
+		Network: network.TestNetworkPassphrase,
+		Source:  from.Address(),
+		SeqNum:  7,
+		Ops:     []stellar.Op{stellar.BumpSequence{BumpTo: 9}},
+	}
+	innerEnv, err := inner.Sign(from.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := stellar.DecodeTx(innerEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.Network = inner.Network
+	fb := &stellar.FeeBump{FeeSource: payer.Address(), BaseFee: 500, Inner: signed}
+	if got := fb.TotalFee(); got != 1000 {
+		t.Errorf("got fee %d, want 1000", got)
+	}
+	env, err := fb.Sign(payer.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stellar.DecodeFeeBump(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Inner.Network = inner.Network
+	if got.FeeSource != fb.FeeSource || got.TotalFee() != fb.TotalFee() || len(got.Signatures) != 1 {
+		t.Errorf("decoded fee bump %+v, want %+v with 1 signature", got, fb)
+	}
+	wantHash, err := fb.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := got.Hash(); err != nil || hash != wantHash {
+		t.Errorf("decoded fee bump with hash %x (%v), want %x", hash, err, wantHash)
+	}
+	// The inner tx, and so its hash, is unchanged.
+	innerHash, err := stellar.TxHash(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := stellar.TxHash(got.Inner); err != nil || hash != innerHash {
+		t.Errorf("decoded inner tx with hash %s (%v), want %s", hash, err, innerHash)
+	}
+	if d, err := stellar.DecodeTx(env); err != nil || len(d.Signatures) != 1 || d.Source != from.Address() {
+		t.Errorf("DecodeTx of fee bump gave %+v (%v), want the signed inner tx", d, err)
+	}
+	if _, err := stellar.DecodeFeeBump(innerEnv); err == nil {
+		t.Error("decoded a tx envelope as a fee bump")
+	}
+	fb.BaseFee = 50
+	if _, err := fb.Sign(payer.Seed()); err == nil {
+		t.Error("signed a fee bump with a base fee below that of its inner tx")
+	}
+}
@@ -0,0 +1,413 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// stellarChain is the Stellar implementation of Chain.
+// Deposits are payments to the custodian account
+// with the nonce hash as their tx memo.
+// Withdrawals are the peg-out txs preauthorized
+// by the exporter's pre-export tx,
+// one per fee level in pegOutFees.
+type stellarChain struct {
+	hclient stellar.Client
+	account string // the custodian's address
+	seed    string
+	network string
+	async   bool               // submit peg-outs with SignAndSubmitTxAsync
+	seqs    *stellar.Sequencer // sequences every tx from the custodian account
+
+	protocol int32        // the network's protocol version, accessed atomically; see watchProtocol
+	drift    atomic.Value // a string, how the custodian account differs from config; see Custodian.checkAccountConfig
+
+	// nonceHash, if set, returns the nonce hash of the peg-in
+	// paid by payment k of a tx with the given memo;
+	// see Custodian.paymentNonceHash.
+	// Otherwise every payment pays the peg-in named by the memo.
+	nonceHash func(ctx context.Context, memo []byte, k int) ([]byte, error)
+
+	// guard, if set, is called on each tx of the custodian account
+	// before its deposits; see Custodian.guardAccount.
+	guard func(ctx context.Context, tx stellar.Transaction) error
+
+	// unreadable, if set, is called on each tx of the custodian account
+	// whose deposits cannot be read, with the reason,
+	// instead of skipping it; see Custodian.unreadableDeposit.
+	unreadable func(ctx context.Context, tx stellar.Transaction, err error) error
+}
+
+// asyncPegOutWait bounds how long an asynchronously submitted peg-out
+// is waited on before it is left for a retry.
+const asyncPegOutWait = 2 * time.Minute
+
+func newStellarChain(hclient stellar.Client, account, seed, network string) *stellarChain {
+	return &stellarChain{
+		hclient: hclient,
+		account: account,
+		seed:    seed,
+		network: network,
+		seqs:    stellar.NewSequencer(hclient),
+	}
+}
+
+// WatchDeposits calls f on each payment to the custodian in turn.
+// All but the last of a tx's deposits
+// have the cursor of the tx before it,
+// so that watching resumes at the tx
+// until every payment in it is recorded.
+func (s *stellarChain) WatchDeposits(ctx context.Context, cursor string, f func(Deposit) error) (string, error) {
+	prev := cursor
+	return s.watchAccount(ctx, s.account, cursor, func(tx stellar.Transaction) error {
+		if s.guard != nil {
+			err := s.guard(ctx, tx)
+			if err != nil {
+				return err
+			}
+		}
+		var deposits []Deposit
+		err := s.deposits(ctx, tx, func(d Deposit) error {
+			deposits = append(deposits, d)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, d := range deposits {
+			if i < len(deposits)-1 {
+				d.Cursor = prev
+			}
+			err = f(d)
+			if err != nil {
+				return err
+			}
+		}
+		prev = tx.PT
+		return nil
+	})
+}
+
+// watchAccount calls f on each Stellar tx of the account at addr after cursor
+// until the stream ends or f returns an error,
+// returning the cursor of the last tx streamed.
+func (s *stellarChain) watchAccount(ctx context.Context, addr, cursor string, f func(stellar.Transaction) error) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cur := stellar.Cursor(cursor)
+	var fErr error
+	err := s.hclient.StreamTransactions(ctx, addr, &cur, func(tx stellar.Transaction) {
+		if fErr != nil {
+			return
+		}
+		fErr = f(tx)
+		if fErr != nil {
+			cancel()
+		}
+	})
+	if fErr != nil {
+		return string(cur), fErr
+	}
+	return string(cur), err
+}
+
+// deposits calls f on the peg-in payments in a Stellar tx
+// to the custodian account, in order.
+func (s *stellarChain) deposits(ctx context.Context, tx stellar.Transaction, f func(Deposit) error) error {
+	debugf("handling Stellar tx %s", tx.ID)
+
+	nonceHash, payments, err := pegInPayments(tx.EnvelopeXdr, s.account)
+	if err != nil && tx.MemoType != "hash" {
+		// As in a tx it can decode, there are no deposits to read.
+		return nil
+	}
+	if err != nil {
+		// The deposits of a tx the vendored XDR cannot decode,
+		// such as one of a later protocol or one without an envelope,
+		// or with ops it does not model (see errHorizonOps),
+		// are read from its ops in Horizon instead.
+		ops, oerr := stellar.TxOperations(ctx, s.hclient, tx.Hash)
+		if oerr != nil {
+			return errors.Wrapf(oerr, "reading Stellar tx %s", tx.ID)
+		}
+		nonceHash, payments, err = s.opPayments(tx, ops)
+	}
+	if err != nil {
+		if s.unreadable != nil {
+			return s.unreadable(ctx, tx, err)
+		}
+		log.Printf("skipping Stellar tx %s: %s", tx.ID, err)
+		return nil
+	}
+	var timeMS int64
+	if !tx.LedgerCloseTime.IsZero() {
+		timeMS = tx.LedgerCloseTime.UnixNano() / int64(time.Millisecond)
+	}
+	for k, payment := range payments {
+		assetXDR, err := payment.Asset.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "marshaling asset xdr")
+		}
+		paid := nonceHash
+		if s.nonceHash != nil {
+			paid, err = s.nonceHash(ctx, nonceHash, k)
+			if err != nil {
+				return errors.Wrapf(err, "finding peg-in paid by op %d of tx %s", payment.OpIndex, tx.ID)
+			}
+		}
+		err = f(Deposit{
+			TxID:      tx.ID,
+			OpIndex:   payment.OpIndex,
+			Cursor:    tx.PT,
+			NonceHash: paid,
+			Asset:     assetXDR,
+			Amount:    int64(payment.Amount),
+			Sender:    payment.sender(tx.Account),
+			TimeMS:    timeMS,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opPayments returns the nonce hash in the hash memo of tx
+// and its payments to the custodian account among ops,
+// its operations in Horizon,
+// as pegInPayments does from its XDR.
+// Those of a Soroban tx are its asset contract transfers to the custodian.
+func (s *stellarChain) opPayments(tx stellar.Transaction, ops []stellar.Operation) ([]byte, []pegInPayment, error) {
+	memo, err := base64.StdEncoding.DecodeString(tx.Memo)
+	if err != nil || len(memo) != len(stellar.MemoHash{}) {
+		return nil, nil, fmt.Errorf("bad hash memo %q", tx.Memo)
+	}
+	custodian := s.account
+	var payments []pegInPayment
+	for i, op := range ops {
+		if !op.IsPayment() || op.To != custodian {
+			continue
+		}
+		payment, err := opPayment(op, s.account)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "op %d", i)
+		}
+		payments = append(payments, pegInPayment{Payment: payment, OpIndex: i, From: op.From})
+	}
+	transfers, err := stellar.ContractTransfers(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range transfers {
+		if t.To != custodian {
+			continue
+		}
+		payments = append(payments, pegInPayment{
+			Payment: stellar.Payment{Destination: s.account, Asset: t.Asset, Amount: t.Amount},
+			OpIndex: t.OpIndex,
+			From:    t.From,
+		})
+	}
+	return memo, payments, nil
+}
+
+// opPayment is the payment to dest that op, a payment-like op, makes.
+func opPayment(op stellar.Operation, dest string) (stellar.Payment, error) {
+	asset, err := op.Asset()
+	if err != nil {
+		return stellar.Payment{}, errors.Wrap(err, "parsing asset")
+	}
+	amount, err := stellar.ParseAmount(op.Amount)
+	if err != nil {
+		return stellar.Payment{}, errors.Wrap(err, "parsing amount")
+	}
+	return stellar.Payment{Destination: dest, Asset: asset, Amount: amount}, nil
+}
+
+func (s *stellarChain) SubmitWithdrawal(ctx context.Context, w *Withdrawal, feeLevel int) (WithdrawalResult, error) {
+	tx, err := s.pegOutTx(w, pegOutFee(feeLevel))
+	if err != nil {
+		// Only a malformed export makes an unbuildable peg-out tx.
+		return WithdrawalRejected, errors.Wrap(err, "building peg-out tx")
+	}
+	if s.async {
+		wctx, cancel := context.WithTimeout(ctx, asyncPegOutWait)
+		_, err = stellar.SignAndSubmitTxAsync(wctx, s.hclient, tx, s.seed)
+		cancel()
+	} else {
+		_, err = stellar.SignAndSubmitTx(stellar.WithContext(ctx, s.hclient), tx, s.seed)
+	}
+	if feeLevel > 0 && resultCode(err) == "tx_bad_auth" {
+		// The export's pre-export tx preauthorized only the base fee,
+		// so the bumped peg-out was rejected without being applied.
+		return WithdrawalPending, errors.Wrapf(ErrFeeNotAuthorized, "peg-out at fee %d", pegOutFee(feeLevel))
+	}
+	if resultCode(err) == "tx_too_late" {
+		// Stellar checks time bounds before the temp account,
+		// so an expired peg-out may have been applied by an earlier submission.
+		// Otherwise it never can be,
+		// and is refunded for the exporter to export again.
+		applied, ferr := s.findPegOut(ctx, w)
+		if ferr != nil {
+			return WithdrawalPending, errors.Wrap(ferr, "looking up expired peg-out")
+		}
+		if applied != nil {
+			return WithdrawalApplied, nil
+		}
+		return WithdrawalRejected, errors.Wrap(err, "peg-out expired")
+	}
+	result := pegOutResult(err)
+	if se := stellar.ParseSubmitError(err); se != nil {
+		err = errors.Sub(se, err)
+	}
+	return result, errors.Wrap(err, "submitting peg-out tx")
+}
+
+// VerifyFinality looks up the peg-out tx at each fee level by hash.
+// A tx in a closed ledger is final on Stellar.
+func (s *stellarChain) VerifyFinality(ctx context.Context, w *Withdrawal) (bool, error) {
+	tx, err := s.findPegOut(ctx, w)
+	return tx != nil, err
+}
+
+// findPegOut returns the applied peg-out tx of w,
+// at whichever fee level it was applied,
+// or nil if there is none.
+func (s *stellarChain) findPegOut(ctx context.Context, w *Withdrawal) (*stellar.Transaction, error) {
+	for _, fee := range pegOutFees {
+		tx, err := s.pegOutTx(w, fee)
+		if err != nil {
+			return nil, errors.Wrap(err, "building peg-out tx")
+		}
+		applied, err := s.loadTx(ctx, tx)
+		if err != nil || applied != nil {
+			return applied, err
+		}
+	}
+	return nil, nil
+}
+
+// loadTx returns tx as applied on Stellar,
+// or nil if it has not been.
+func (s *stellarChain) loadTx(ctx context.Context, tx *stellar.Tx) (*stellar.Transaction, error) {
+	hash, err := stellar.TxHash(tx)
+	if err != nil {
+		return nil, err
+	}
+	return stellar.LoadAppliedTx(stellar.WithContext(ctx, s.hclient), hash)
+}
+
+// VerifyDeposit looks up the deposit's tx by hash.
+func (s *stellarChain) VerifyDeposit(ctx context.Context, d Deposit) (bool, error) {
+	tx, err := stellar.WithContext(ctx, s.hclient).LoadTransaction(d.TxID)
+	if stellar.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "loading tx %s", d.TxID)
+	}
+	var found bool
+	err = s.deposits(ctx, tx, func(got Deposit) error {
+		found = found || sameDeposit(got, d)
+		return nil
+	})
+	return found, err
+}
+
+func (s *stellarChain) ValidateWithdrawal(w *Withdrawal) error {
+	_, err := stellar.DecodeAsset(w.Asset)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling export asset")
+	}
+	_, err = strkey.Decode(strkey.VersionByteAccountID, w.Recipient)
+	if err != nil {
+		return errors.Wrapf(err, "parsing exporter address %q", w.Recipient)
+	}
+	_, err = strkey.Decode(strkey.VersionByteAccountID, w.TempAddr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing temp address %q", w.TempAddr)
+	}
+	if err := w.TimeBounds.check(); err != nil {
+		return err
+	}
+	return w.Destination.check()
+}
+
+func (s *stellarChain) FeeLevels() int {
+	return len(pegOutFees)
+}
+
+// pegOutTx builds the peg-out tx for the withdrawal with the given fee.
+func (s *stellarChain) pegOutTx(w *Withdrawal, fee uint64) (*stellar.Tx, error) {
+	asset, err := stellar.DecodeAsset(w.Asset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling asset from XDR %x", w.Asset)
+	}
+	return buildPegOutTx(s.account, w.Recipient, w.TempAddr, s.network, asset, w.Amount, stellar.SequenceNumber(w.Seqnum), fee, w.TimeBounds, w.Destination)
+}
+
+// pegOutResult classifies the outcome of submitting a peg-out tx.
+// Only a definite rejection by Stellar is a failure,
+// which refunds the exported value on txvm.
+// Any other error may have come after the tx was applied
+// (e.g. a timeout, or a crash before the result was recorded),
+// so the peg-out is retried,
+// as it is when its fee was too low
+// or its time or ledger bounds have not yet begun,
+// or its minimum sequence age has not yet passed.
+// A retry of an applied peg-out finds the temp account gone:
+// only the preauthorized peg-out tx can merge it,
+// so tx_no_account means the peg-out succeeded.
+func pegOutResult(err error) WithdrawalResult {
+	if err == nil {
+		return WithdrawalApplied
+	}
+	se := stellar.ParseSubmitError(err)
+	switch {
+	case se == nil || se.Retriable:
+		return WithdrawalPending
+	case se.TxCode == "tx_no_account":
+		return WithdrawalApplied
+	}
+	return WithdrawalRejected
+}
+
+// resultCode is the Horizon transaction result code in err,
+// if there is one.
+func resultCode(err error) string {
+	if se := stellar.ParseSubmitError(err); se != nil {
+		return se.TxCode
+	}
+	return ""
+}
+
+// resultError is the slidechain/errors error
+// for the Horizon result codes in err,
+// or nil if they are not ones it defines.
+func resultError(err error) error {
+	se := stellar.ParseSubmitError(err)
+	if se == nil {
+		return nil
+	}
+	for _, code := range append([]string{se.TxCode}, se.OpCodes...) {
+		switch code {
+		case "op_no_trust":
+			return scerrors.ErrNoTrustline
+		case "op_not_authorized":
+			return scerrors.ErrNotAuthorized
+		case "op_underfunded", "op_low_reserve", "tx_insufficient_balance":
+			return scerrors.ErrInsufficientReserve
+		}
+	}
+	return nil
+}
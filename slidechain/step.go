@@ -0,0 +1,136 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/slingshot/slidechain/store"
+)
+
+// NewSteppedCustodian returns a Custodian that works only when Step is called,
+// for deterministic simulation and testing.
+// It launches no goroutines.
+// Each txvm tx it accepts is committed in its own block before submission returns,
+// and block and audit timestamps come from now.
+//
+// The hclient's StreamTransactions must return
+// once it has delivered the transactions after the cursor,
+// which the real Horizon client never does,
+// so that the custodian's WatchDeposits returns too.
+func NewSteppedCustodian(ctx context.Context, db *sql.DB, hclient stellar.Client, cfg *config.Config, now func() time.Time) (*Custodian, error) {
+	err := setSchema(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting db schema")
+	}
+	err = store.Init(db, now())
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing block store")
+	}
+	c, err := newCustodian(ctx, db, hclient, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.now = now
+	c.S.now = now
+	c.S.blockInterval = 0
+	c.applyDynamic(cfg)
+	return c, nil
+}
+
+// Step does one round of the work
+// that GetCustodian's goroutines do continuously:
+// recording new peg-ins from the main chain,
+// forwarding payments to deposit accounts,
+// importing peg-ins,
+// recording new exports and pegging them out,
+// indexing txs for inclusion proofs and outputs for balance snapshots,
+// remediating stuck peg-outs,
+// retiring or refunding the exports whose peg-outs are done,
+// anchoring a checkpoint when one is due,
+// paying exit payouts while winding down and deposit refunds,
+// and notifying users and SEP-31 senders of state changes.
+func (c *Custodian) Step(ctx context.Context) error {
+	var cur string
+	err := c.DB.QueryRowContext(ctx, "SELECT cursor FROM custodian").Scan(&cur)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "reading cursor")
+	}
+	_, err = c.chain.WatchDeposits(ctx, cur, func(d Deposit) error {
+		err := c.recordDeposit(ctx, d)
+		if scerrors.Is(err, scerrors.ErrDuplicateDeposit) {
+			log.Printf("ignoring deposit: %s", err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "watching main chain deposits")
+	}
+	if sc, ok := c.chain.(*stellarChain); ok {
+		accts, err := c.depositAccounts(ctx)
+		if err != nil {
+			return err
+		}
+		for _, acct := range accts {
+			err = c.forwardDeposits(ctx, sc, acct)
+			if err != nil {
+				return errors.Wrapf(err, "forwarding deposits to %s", acct.address)
+			}
+		}
+	}
+	err = c.importPending(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.catchUpPin(ctx, exportScanPin, markExport, c.recordExports)
+	if err != nil {
+		return err
+	}
+	_, err = c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+	if err != nil {
+		return err
+	}
+	_, err = c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+	if err != nil {
+		return err
+	}
+	// The exports that pegOutPending finishes are picked up
+	// by postPegOutPending from the db.
+	_, err = c.pegOutPending(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.remediateStuck(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = c.postPegOutPending(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.checkpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if sc, ok := c.chain.(*stellarChain); ok {
+		err = c.payExitsPending(ctx, sc)
+		if err != nil {
+			return err
+		}
+		err = c.payRefundsPending(ctx, sc)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.sep31Notify(ctx)
+	if err != nil {
+		return err
+	}
+	return c.notifyPending(ctx)
+}
@@ -15,32 +15,47 @@ import (
 type BlockStore struct {
 	db      *sql.DB
 	heights chan<- uint64
+
+	// Markers, if set, summarizes each block SaveBlock saves
+	// as a bit set recorded in the block_markers table,
+	// which keeps it after ExpireBlocks removes the block.
+	Markers func(*bc.Block) uint64
 }
 
 func New(db *sql.DB, heights chan<- uint64) (*BlockStore, error) {
+	err := Init(db, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &BlockStore{
+		db:      db,
+		heights: heights,
+	}, nil
+}
+
+// Init writes a genesis block with the given timestamp to db
+// if it has no blocks yet.
+func Init(db *sql.DB, genesis time.Time) error {
 	var height uint64
 	err := db.QueryRow("SELECT height FROM blocks ORDER BY height DESC LIMIT 1").Scan(&height)
 	if err == sql.ErrNoRows {
-		initialBlock, err := protocol.NewInitialBlock(nil, 0, time.Now())
+		initialBlock, err := protocol.NewInitialBlock(nil, 0, genesis)
 		if err != nil {
-			return nil, errors.Wrap(err, "producing genesis block")
+			return errors.Wrap(err, "producing genesis block")
 		}
 		h := initialBlock.Hash().Bytes()
 		bits, err := initialBlock.Bytes()
 		if err != nil {
-			return nil, errors.Wrap(err, "marshaling genesis block for writing to db")
+			return errors.Wrap(err, "marshaling genesis block for writing to db")
 		}
 		_, err = db.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES (1, $1, $2)", h, bits)
 		if err != nil {
-			return nil, errors.Wrap(err, "writing genesis block to db")
+			return errors.Wrap(err, "writing genesis block to db")
 		}
 	} else if err != nil {
-		return nil, errors.Wrap(err, "getting blockchain height")
+		return errors.Wrap(err, "getting blockchain height")
 	}
-	return &BlockStore{
-		db:      db,
-		heights: heights,
-	}, nil
+	return nil
 }
 
 func (s *BlockStore) Height(context.Context) (uint64, error) {
@@ -80,8 +95,24 @@ func (s *BlockStore) SaveBlock(_ context.Context, b *bc.Block) error {
 	if err != nil {
 		return errors.Wrapf(err, "marshaling block %d for writing to db", b.Height)
 	}
-	_, err = s.db.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES ($1, $2, $3)", b.Height, h, bits)
-	return errors.Wrapf(err, "writing block %d to db", b.Height)
+	if s.Markers == nil {
+		_, err = s.db.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES ($1, $2, $3)", b.Height, h, bits)
+		return errors.Wrapf(err, "writing block %d to db", b.Height)
+	}
+	dbtx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	_, err = dbtx.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES ($1, $2, $3)", b.Height, h, bits)
+	if err != nil {
+		return errors.Wrapf(err, "writing block %d to db", b.Height)
+	}
+	_, err = dbtx.Exec("INSERT OR IGNORE INTO block_markers (height, markers) VALUES ($1, $2)", b.Height, int64(s.Markers(b)))
+	if err != nil {
+		return errors.Wrapf(err, "writing markers of block %d to db", b.Height)
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing block %d", b.Height)
 }
 
 func (s *BlockStore) FinalizeHeight(_ context.Context, height uint64) error {
@@ -101,6 +132,7 @@ func (s *BlockStore) SaveSnapshot(_ context.Context, snapshot *state.Snapshot) e
 // ExpireBlocks runs as a goroutine,
 // periodically removing blocks from the db when they are no longer needed.
 // A block is needed if any existing pin has not processed it yet,
+// or would not after a pending rewind,
 // or if no snapshot is stored at or above its height.
 // The initial block and the latest block are always needed.
 func (s *BlockStore) ExpireBlocks(ctx context.Context) {
@@ -123,7 +155,7 @@ func (s *BlockStore) ExpireBlocks(ctx context.Context) {
 
 			height := snap.Header.Height
 
-			const q = `SELECT MIN(height) FROM pins`
+			const q = `SELECT MIN(height) FROM (SELECT height FROM pins UNION ALL SELECT height FROM pin_rewinds)`
 			var lowestPin uint64
 			err = s.db.QueryRowContext(ctx, q).Scan(&lowestPin)
 			if err != nil {
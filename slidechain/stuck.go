@@ -0,0 +1,177 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+)
+
+// stuckPegOutAlert is the kind of alert raised for a peg-out
+// that stays unconfirmed at the highest fee level,
+// or that cannot be bumped.
+const stuckPegOutAlert = "stuck-peg-out"
+
+// remediateStuck finds the exports whose peg-outs were submitted
+// but have not been confirmed on the main chain within the stuck_after period
+// since the export was recorded or last remediated,
+// and checks whether each of their withdrawals was applied after all.
+// One that was is marked succeeded.
+// Otherwise it is resubmitted at the next fee level,
+// and if it is already at the highest,
+// an operator is alerted.
+// Netted exports are left to their nettings,
+// and exports not yet submitted, as when held, to pegOutPending.
+// Like pegOutPending,
+// it returns the exports ready for the post-peg-out tx.
+//
+// Only the exports of sh are remediated, all of them if it is nil,
+// and resubmitted no faster than its rate allows.
+// It must not run concurrently with pegOutPending for the same exports,
+// and does nothing while peg-out submission is paused
+// or the custodian account has drifted from the custodian config.
+func (c *Custodian) remediateStuck(ctx context.Context, sh *pegOutShard) ([]pegOut, error) {
+	paused, err := c.paused(ctx, pausePegOut)
+	if err != nil || paused {
+		return nil, err
+	}
+	if c.accountHeld() {
+		return nil, nil
+	}
+	stuckAfter := time.Duration(c.pegOutConfig().StuckAfter)
+	cutoff := c.nowMS() - int64(stuckAfter/time.Millisecond)
+
+	const q = `
+		FROM exports e
+		WHERE e.pegged_out = $1
+		AND e.txid NOT IN (SELECT txid FROM netted_exports)
+		AND MAX(e.resubmitted_ms, COALESCE((SELECT MIN(time_ms) FROM state_events s WHERE s.kind='export' AND s.key=e.txid), 0)) < $2
+	`
+	stuck, err := c.queryExports(ctx, q, pegOutRetry, cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading stuck exports")
+	}
+
+	var ready []pegOut
+	for _, p := range stuck {
+		if !sh.has(p.AssetXDR) {
+			continue
+		}
+		// One held by screening since its submission is not resubmitted.
+		ok, err := c.screenPegOut(ctx, &p)
+		if err != nil {
+			return nil, err
+		}
+		if p.State == pegOutFail {
+			ready = append(ready, p)
+		}
+		if !ok {
+			continue
+		}
+		peggedOut, err := c.remediatePegOut(ctx, sh, p, stuckAfter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "remediating stuck peg-out of export %x", p.TxID)
+		}
+		if peggedOut == pegOutOK || peggedOut == pegOutFail {
+			p.State = peggedOut
+			ready = append(ready, p)
+		}
+	}
+	return ready, nil
+}
+
+// remediatePegOut deals with a single stuck peg-out,
+// returning the export's new state.
+// One that sh's rate holds back is left stuck for the next check.
+func (c *Custodian) remediatePegOut(ctx context.Context, sh *pegOutShard, p pegOut, stuckAfter time.Duration) (pegOutState, error) {
+	w, err := c.withdrawal(ctx, &p)
+	if err != nil {
+		return 0, err
+	}
+	confirmed, err := c.verifyFinality(ctx, w)
+	if err != nil {
+		// The main chain is unavailable; try again at the next check.
+		log.Printf("looking up stuck peg-out of export %x: %s", p.TxID, err)
+		return p.State, nil
+	}
+	if confirmed {
+		log.Printf("stuck peg-out of export %x found on the main chain", p.TxID)
+		err = c.markSubmitted(ctx, &p, WithdrawalApplied, nil)
+		if err != nil {
+			return 0, err
+		}
+		_, err = c.recordPegOutReceipt(ctx, &p)
+		return pegOutOK, err
+	}
+	if !sh.allow(time.Unix(0, c.nowMS()*int64(time.Millisecond))) {
+		return p.State, nil
+	}
+
+	feeLevel := p.FeeLevel
+	if feeLevel+1 < c.chain.FeeLevels() {
+		feeLevel++
+	} else {
+		err = c.alertStuck(ctx, p.TxID, fmt.Sprintf("peg-out of export %x to %s unconfirmed for %s at the highest fee level, %d", p.TxID, p.payee(), stuckAfter, feeLevel))
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = c.setFeeLevel(ctx, p.TxID, feeLevel)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("resubmitting stuck peg-out of export %x at fee level %d", p.TxID, feeLevel)
+
+	result, err := c.submitWithdrawal(ctx, w, feeLevel)
+	if errors.Root(err) == ErrFeeNotAuthorized {
+		// Leave the export for retrying at the base fee.
+		err = c.setFeeLevel(ctx, p.TxID, 0)
+		if err != nil {
+			return 0, err
+		}
+		err = c.alertStuck(ctx, p.TxID, fmt.Sprintf("peg-out of export %x to %s is stuck and does not authorize a higher fee", p.TxID, p.payee()))
+		if err != nil {
+			return 0, err
+		}
+		return pegOutRetry, c.movePegOut(ctx, p.TxID, p.State, pegOutRetry)
+	}
+	if err != nil {
+		log.Printf("peg-out of export %x: %s", p.TxID, err)
+	}
+	err = c.markSubmitted(ctx, &p, result, err)
+	if err != nil || p.State != pegOutOK {
+		return p.State, err
+	}
+	_, err = c.recordPegOutReceipt(ctx, &p)
+	return pegOutOK, err
+}
+
+// setFeeLevel sets the fee level at which the export is pegged out
+// and restarts the wait before it is next considered stuck.
+func (c *Custodian) setFeeLevel(ctx context.Context, txid []byte, level int) error {
+	const q = `UPDATE exports SET fee_level=$1, resubmitted_ms=$2 WHERE txid=$3`
+	_, err := c.DB.ExecContext(ctx, q, level, c.nowMS(), txid)
+	return errors.Wrapf(err, "setting fee level of export %x", txid)
+}
+
+// pegOutConfig returns the custodian's peg-out settings,
+// or the defaults if it has no config.
+func (c *Custodian) pegOutConfig() config.PegOut {
+	if cfg := c.config(); cfg != nil {
+		return cfg.PegOut
+	}
+	return config.Default().PegOut
+}
+
+// alertStuck raises a stuck-peg-out alert about the export with the given txid,
+// unless one has been raised already.
+func (c *Custodian) alertStuck(ctx context.Context, txid []byte, detail string) error {
+	alerted, err := c.alerted(ctx, stuckPegOutAlert, txid)
+	if err != nil || alerted {
+		return err
+	}
+	return c.alert(ctx, stuckPegOutAlert, txid, detail)
+}
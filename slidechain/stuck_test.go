@@ -0,0 +1,547 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestRemediateStuck(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	stuckAfter := time.Duration(cfg.PegOut.StuckAfter)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// newExport records an export whose peg-out was submitted
+		// without a result.
+		newExport := func(txid string) *pegOut {
+			amount := int64(xlm.Lumen)
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, TimeBounds{}, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &pegOut{
+				TxID:     []byte(txid),
+				AssetXDR: nativeXDR,
+				TempAddr: tempAddr,
+				Seqnum:   int64(seqnum),
+				Exporter: exporterKP.Address(),
+				Amount:   amount,
+				Anchor:   []byte{},
+				Pubkey:   []byte{},
+			}
+			err = c.insertExport(ctx, p.TxID, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutRetry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		check := func(p *pegOut, wantState pegOutState, wantLevel int) {
+			t.Helper()
+			var (
+				state pegOutState
+				level int
+			)
+			err := db.QueryRow(`SELECT pegged_out, fee_level FROM exports WHERE txid=$1`, p.TxID).Scan(&state, &level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != wantState || level != wantLevel {
+				t.Errorf("export %s: got state %s at fee level %d, want %s at %d", p.TxID, state, level, wantState, wantLevel)
+			}
+		}
+		remediate := func(wantReady int) {
+			t.Helper()
+			ready, err := c.remediateStuck(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ready) != wantReady {
+				t.Errorf("got %d exports ready for post-peg-out, want %d", len(ready), wantReady)
+			}
+		}
+
+		bumped := newExport("bumped")
+		remediate(0)
+		check(bumped, pegOutRetry, 0)
+
+		// Stuck, and stuck again at the next fee level.
+		now = now.Add(stuckAfter + time.Second)
+		srv.Inject(horizonmock.EndpointSubmit, horizonmock.Timeout, 1)
+		remediate(0)
+		check(bumped, pegOutRetry, 1)
+		remediate(0)
+		check(bumped, pegOutRetry, 1)
+
+		now = now.Add(stuckAfter + time.Second)
+		remediate(1)
+		check(bumped, pegOutOK, 2)
+		if _, ok := srv.Balance(bumped.TempAddr, native); ok {
+			t.Error("temp account still exists after bumped peg-out")
+		}
+
+		// Applied on Stellar, but the custodian never learned of it.
+		applied := newExport("applied")
+		_, err = c.chain.SubmitWithdrawal(ctx, applied.withdrawal(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(stuckAfter + time.Second)
+		txs := srv.Transactions()
+		remediate(1)
+		check(applied, pegOutOK, 0)
+		if got := len(srv.Transactions()); got != len(txs) {
+			t.Errorf("resubmitted a peg-out found on Stellar")
+		}
+		var (
+			hash   string
+			ledger int32
+		)
+		err = db.QueryRow(`SELECT stellar_tx_hash, ledger FROM exports WHERE txid=$1`, applied.TxID).Scan(&hash, &ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peggedOut := txs[len(txs)-1]; hash != peggedOut.Hash || ledger != peggedOut.Ledger {
+			t.Errorf("recorded peg-out tx %s in ledger %d, want %s in %d", hash, ledger, peggedOut.Hash, peggedOut.Ledger)
+		}
+
+		// Stuck at the highest fee level.
+		top := newExport("top")
+		_, err = db.Exec(`UPDATE exports SET fee_level=$1 WHERE txid=$2`, c.chain.FeeLevels()-1, top.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			now = now.Add(stuckAfter + time.Second)
+			srv.Inject(horizonmock.EndpointSubmit, horizonmock.Timeout, 1)
+			remediate(0)
+			check(top, pegOutRetry, c.chain.FeeLevels()-1)
+		}
+		var nAlerts int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, stuckPegOutAlert, top.TxID).Scan(&nAlerts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nAlerts != 1 {
+			t.Errorf("got %d alerts for export stuck at the highest fee, want 1", nAlerts)
+		}
+	})
+}
+
+func TestRemediateStuckHeld(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.PegOut.Shards = []string{"native=0.001"}
+	shards, err := newPegOutShards(cfg.PegOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := shards[1]
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		newExport := func(txid string) *pegOut {
+			amount := int64(xlm.Lumen)
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, TimeBounds{}, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &pegOut{
+				TxID:     []byte(txid),
+				AssetXDR: nativeXDR,
+				TempAddr: tempAddr,
+				Seqnum:   int64(seqnum),
+				Exporter: exporterKP.Address(),
+				Amount:   amount,
+				Anchor:   []byte{},
+				Pubkey:   []byte{},
+			}
+			err = c.insertExport(ctx, p.TxID, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		remediate := func(sh *pegOutShard) {
+			t.Helper()
+			txs := len(srv.Transactions())
+			ready, err := c.remediateStuck(ctx, sh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ready) != 0 || len(srv.Transactions()) != txs {
+				t.Errorf("got %d exports ready and %d txs submitted, want none", len(ready), len(srv.Transactions())-txs)
+			}
+		}
+		check := func(p *pegOut, wantState pegOutState) {
+			t.Helper()
+			var (
+				state pegOutState
+				level int
+			)
+			err := db.QueryRow(`SELECT pegged_out, fee_level FROM exports WHERE txid=$1`, p.TxID).Scan(&state, &level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != wantState || level != 0 {
+				t.Errorf("export %s: got state %s at fee level %d, want %s at 0", p.TxID, state, level, wantState)
+			}
+		}
+
+		// An export never submitted, as when held, is not stuck.
+		held := newExport("held")
+		submitted := newExport("submitted")
+		err = c.movePegOut(ctx, submitted.TxID, pegOutNotYet, pegOutRetry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Duration(cfg.PegOut.StuckAfter) + time.Second)
+
+		sc.drift.Store("custodian account signers differ")
+		remediate(nil)
+		check(held, pegOutNotYet)
+		check(submitted, pegOutRetry)
+		sc.drift.Store("")
+
+		// The shard's rate has been used up by another peg-out.
+		if !sh.allow(now) {
+			t.Fatal("shard held its first peg-out")
+		}
+		remediate(sh)
+		check(held, pegOutNotYet)
+		check(submitted, pegOutRetry)
+		if !sh.takeHeld() {
+			t.Error("shard did not note the peg-out it held back")
+		}
+
+		// Only the submitted export is resubmitted once allowed.
+		ready, err := c.remediateStuck(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 1 || string(ready[0].TxID) != "submitted" {
+			t.Errorf("got %d exports ready, want the submitted one", len(ready))
+		}
+		check(held, pegOutNotYet)
+	})
+}
+
+func TestPegOutTimeBounds(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	srv.Now = clock
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		newWithdrawal := func(bounds TimeBounds) *Withdrawal {
+			amount := int64(xlm.Lumen)
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, bounds, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &pegOut{
+				AssetXDR:   nativeXDR,
+				TempAddr:   tempAddr,
+				Seqnum:     int64(seqnum),
+				Exporter:   exporterKP.Address(),
+				Amount:     amount,
+				TimeBounds: bounds,
+			}
+			return p.withdrawal()
+		}
+		submit := func(w *Withdrawal, want WithdrawalResult) {
+			t.Helper()
+			got, err := c.chain.SubmitWithdrawal(ctx, w, 0)
+			if got != want {
+				t.Errorf("got result %d (error %v), want %d", got, err, want)
+			}
+		}
+
+		submit(newWithdrawal(PegOutTimeBounds(now.Add(time.Hour), time.Hour)), WithdrawalPending)
+		submit(newWithdrawal(PegOutTimeBounds(now.Add(-2*time.Hour), time.Hour)), WithdrawalRejected)
+
+		// Applied, then expired before the custodian learned of it.
+		w := newWithdrawal(PegOutTimeBounds(now, time.Hour))
+		submit(w, WithdrawalApplied)
+		now = now.Add(2 * time.Hour)
+		submit(w, WithdrawalApplied)
+
+		w.TimeBounds = TimeBounds{MinTime: 2, MaxTime: 1}
+		if err := c.chain.ValidateWithdrawal(w); err == nil {
+			t.Error("validated a withdrawal with max time before min time")
+		}
+	})
+}
+
+func TestPegOutPreconditions(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	srv.Now = clock
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := func() uint32 {
+			t.Helper()
+			root, err := srv.Client().Root()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return uint32(root.HorizonSequence)
+		}
+		newWithdrawal := func(bounds TimeBounds) *Withdrawal {
+			amount := int64(xlm.Lumen)
+			tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, bounds, Destination{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &pegOut{
+				AssetXDR:   nativeXDR,
+				TempAddr:   tempAddr,
+				Seqnum:     int64(seqnum),
+				Exporter:   exporterKP.Address(),
+				Amount:     amount,
+				TimeBounds: bounds,
+			}
+			return p.withdrawal()
+		}
+		submit := func(w *Withdrawal, want WithdrawalResult) {
+			t.Helper()
+			got, err := c.chain.SubmitWithdrawal(ctx, w, 0)
+			if got != want {
+				t.Errorf("got result %d (error %v), want %d", got, err, want)
+			}
+		}
+
+		submit(newWithdrawal(TimeBounds{MinLedger: latest() + 100}), WithdrawalPending)
+		submit(newWithdrawal(TimeBounds{MinLedger: 1, MaxLedger: latest()}), WithdrawalRejected)
+		submit(newWithdrawal(TimeBounds{MinLedger: latest(), MaxLedger: latest() + 100}), WithdrawalApplied)
+
+		// Too young until a minute after the pre-export tx.
+		w := newWithdrawal(TimeBounds{MinSeqAge: 60})
+		submit(w, WithdrawalPending)
+		now = now.Add(time.Minute)
+		submit(w, WithdrawalApplied)
+
+		for _, bounds := range []TimeBounds{{MinLedger: 5, MaxLedger: 5}, {MinSeqAge: -1}} {
+			w.TimeBounds = bounds
+			if err := c.chain.ValidateWithdrawal(w); err == nil {
+				t.Errorf("validated a withdrawal with bounds %+v", bounds)
+			}
+		}
+	})
+}
+
+func TestRetryAppliedPegOut(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	exporterKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(exporterKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		native := stellar.NativeAsset()
+		nativeXDR, err := native.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount := int64(xlm.Lumen)
+		tempAddr, seqnum, err := SubmitPreExportTx(srv.Client(), exporterKP, custKP.Address(), native, amount, TimeBounds{}, Destination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &pegOut{
+			TxID:     []byte("timedout"),
+			AssetXDR: nativeXDR,
+			TempAddr: tempAddr,
+			Seqnum:   int64(seqnum),
+			Exporter: exporterKP.Address(),
+			Amount:   amount,
+			Anchor:   []byte{},
+			Pubkey:   []byte{},
+		}
+		err = c.insertExport(ctx, p.TxID, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The peg-out is applied, but its submission times out.
+		_, err = c.chain.SubmitWithdrawal(ctx, p.withdrawal(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.movePegOut(ctx, p.TxID, pegOutNotYet, pegOutRetry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A resubmission would fail.
+		srv.Inject(horizonmock.EndpointSubmit, horizonmock.ServerError, -1)
+		txs := srv.Transactions()
+		ready, err := c.pegOutPending(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != 1 {
+			t.Errorf("got %d exports ready for post-peg-out, want 1", len(ready))
+		}
+		var (
+			state pegOutState
+			hash  string
+		)
+		err = db.QueryRow(`SELECT pegged_out, stellar_tx_hash FROM exports WHERE txid=$1`, p.TxID).Scan(&state, &hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutOK {
+			t.Errorf("export is in state %s, want ok", state)
+		}
+		if hash != txs[len(txs)-1].Hash {
+			t.Errorf("recorded peg-out tx %s, want %s", hash, txs[len(txs)-1].Hash)
+		}
+	})
+}
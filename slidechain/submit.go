@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"sync"
@@ -15,6 +16,7 @@ import (
 	"github.com/chain/txvm/protocol/bc"
 	"github.com/chain/txvm/protocol/state"
 	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/gossip"
 	"github.com/interstellar/slingshot/slidechain/net"
 )
 
@@ -42,60 +44,211 @@ type submitter struct {
 
 	chain *protocol.Chain
 
+	// If zero, each tx is committed in its own block before submitTx returns.
 	blockInterval time.Duration
+
+	// now is the source of block timestamps; nil means time.Now.
+	now func() time.Time
+
+	// If non-nil, the validators that must sign each block.
+	validators *validatorSet
+
+	// If non-nil, new blocks and submitted txs are published here.
+	gossip *gossip.Node
+
+	// If non-nil, reports whether block production is paused.
+	paused func(context.Context) (bool, error)
+
+	// If non-nil, reports an error for a tx spending frozen value.
+	frozen func(context.Context, *bc.Tx) error
+
+	// If non-nil, the fees that txs submitted from outside must pay.
+	// The txs of the block a-building are then also kept in pool,
+	// and ordered by fee when the block is built.
+	fees        *feeSchedule
+	pool        []pooledTx
+	timestampMS uint64
 }
 
+// submitTx adds a tx of the custodian's own,
+// which pays no fee, to the block a-building.
 func (s *submitter) submitTx(ctx context.Context, tx *bc.Tx) (*multichan.R, error) {
+	return s.addTx(ctx, pooledTx{tx: tx, exempt: true})
+}
+
+// submitPaidTx adds a tx from outside the custodian to the block a-building,
+// provided it pays at least the minimum fee.
+func (s *submitter) submitPaidTx(ctx context.Context, tx *bc.Tx) (*multichan.R, error) {
+	if s.frozen != nil {
+		err := s.frozen(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := pooledTx{tx: tx}
+	if s.fees != nil {
+		p.fee = s.fees.paid(tx)
+		if min, _ := s.fees.strategy(); p.fee < min {
+			return nil, errors.WithDetailf(errFeeTooLow, "tx pays %d, and the minimum is %d", p.fee, min)
+		}
+	}
+	return s.addTx(ctx, p)
+}
+
+func (s *submitter) addTx(ctx context.Context, p pooledTx) (*multichan.R, error) {
 	s.bbmu.Lock()
 	defer s.bbmu.Unlock()
 
 	r := s.w.Reader()
 	if s.bb == nil {
-		s.bb = protocol.NewBlockBuilder()
-		nextBlockTime := time.Now().Add(s.blockInterval)
-
-		st := s.chain.State()
-		if st.Header == nil {
-			err := st.ApplyBlockHeader(s.initialBlock.BlockHeader)
-			if err != nil {
-				return nil, errors.Wrap(err, "initializing empty state")
-			}
+		err := s.startBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx := p.tx
+	err := s.bb.AddTx(bc.NewCommitmentsTx(tx))
+	if err != nil {
+		if s.blockInterval == 0 {
+			s.bb = nil
+		}
+		return nil, errors.Wrap(err, "adding tx to pool")
+	}
+	if s.fees != nil {
+		s.pool = append(s.pool, p)
+	}
+	debugf("added tx %x to the pending block", tx.ID.Bytes())
+	if s.blockInterval == 0 {
+		err = s.buildBlock(ctx)
+		if err != nil {
+			return nil, err
 		}
+	}
+	return r, nil
+}
 
-		err := s.bb.Start(s.chain.State(), bc.Millis(nextBlockTime))
+// startBlock starts a new block a-building,
+// to be committed after the block interval.
+// It must be called with s.bbmu held.
+func (s *submitter) startBlock() error {
+	s.bb = protocol.NewBlockBuilder()
+	if s.fees != nil {
+		// The pool may hold more txs than fit in a block;
+		// orderByFee applies the cap.
+		s.bb.MaxBlockTxs = math.MaxInt32
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	nextBlockTime := now().Add(s.blockInterval)
+
+	st := s.chain.State()
+	if st.Header == nil {
+		err := st.ApplyBlockHeader(s.initialBlock.BlockHeader)
 		if err != nil {
-			return nil, errors.Wrap(err, "starting a new tx pool")
+			s.bb = nil
+			return errors.Wrap(err, "initializing empty state")
 		}
+	}
+
+	// Block timestamps must increase even if the clock does not.
+	timestampMS := bc.Millis(nextBlockTime)
+	if prev := s.chain.State().Header.TimestampMs; timestampMS <= prev {
+		timestampMS = prev + 1
+	}
+	err := s.bb.Start(s.chain.State(), timestampMS)
+	if err != nil {
+		s.bb = nil
+		return errors.Wrap(err, "starting a new tx pool")
+	}
+	s.timestampMS = timestampMS
+	if s.blockInterval > 0 {
 		log.Printf("starting new block, will commit at %s", nextBlockTime)
-		time.AfterFunc(s.blockInterval, func() {
-			s.bbmu.Lock()
-			defer s.bbmu.Unlock()
+		s.buildBlockLater()
+	}
+	return nil
+}
 
-			defer func() { s.bb = nil }()
+// buildBlockLater calls buildBlock after the block interval.
+func (s *submitter) buildBlockLater() {
+	time.AfterFunc(s.blockInterval, func() {
+		s.bbmu.Lock()
+		defer s.bbmu.Unlock()
 
-			unsignedBlock, newSnapshot, err := s.bb.Build()
-			if err != nil {
-				log.Fatalf("building new block: %s", err)
-			}
-			if len(unsignedBlock.Transactions) == 0 {
-				log.Print("skipping commit of empty block")
-				return
-			}
-			b := &bc.Block{UnsignedBlock: unsignedBlock}
-			err = s.commitBlock(ctx, b, newSnapshot)
-			if err != nil {
-				log.Fatalf("committing new block: %s", err)
+		// Not ctx, which belongs to the submitter of the first tx
+		// and may be done before the block is signed.
+		err := s.buildBlock(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+// buildBlock commits the block a-building, if it has any txs,
+// and resets s.bb.
+// While block production is paused,
+// the block keeps collecting txs and is retried after the block interval,
+// or with no block interval is discarded with an error.
+// With fees, the block takes the pool's txs by fee,
+// and those left out start the next block.
+// It must be called with s.bbmu held.
+func (s *submitter) buildBlock(ctx context.Context) error {
+	if s.paused != nil {
+		paused, err := s.paused(ctx)
+		if err != nil {
+			return err
+		}
+		if paused {
+			if s.blockInterval == 0 {
+				s.bb, s.pool = nil, nil
+				return errors.New("block production is paused")
 			}
-			log.Printf("committed block %d with %d transaction(s)", unsignedBlock.Height, len(unsignedBlock.Transactions))
-		})
+			log.Print("block production is paused, holding the pending block")
+			s.buildBlockLater()
+			return nil
+		}
 	}
+	defer func() {
+		s.bb = nil
+		if len(s.pool) > 0 {
+			s.carryOver()
+		}
+	}()
 
-	err := s.bb.AddTx(bc.NewCommitmentsTx(tx))
+	if s.fees != nil {
+		err := s.orderByFee()
+		if err != nil {
+			s.pool = nil
+			return err
+		}
+	}
+	unsignedBlock, newSnapshot, err := s.bb.Build()
 	if err != nil {
-		return nil, errors.Wrap(err, "adding tx to pool")
+		s.pool = nil
+		return errors.Wrap(err, "building new block")
 	}
-	log.Printf("added tx %x to the pending block", tx.ID.Bytes())
-	return r, nil
+	if len(unsignedBlock.Transactions) == 0 {
+		log.Print("skipping commit of empty block")
+		return nil
+	}
+	b, newSnapshot, err := s.signBlock(ctx, unsignedBlock, newSnapshot)
+	if err != nil {
+		s.pool = nil
+		return errors.Wrap(err, "signing new block")
+	}
+	err = s.commitBlock(ctx, b, newSnapshot)
+	if err != nil {
+		s.pool = nil
+		return errors.Wrap(err, "committing new block")
+	}
+	if s.fees != nil {
+		log.Printf("committed block %d with %d transaction(s) paying %d in fees, %d left for the next block", unsignedBlock.Height, len(unsignedBlock.Transactions), s.blockFees(unsignedBlock), len(s.pool))
+		return nil
+	}
+	log.Printf("committed block %d with %d transaction(s)", unsignedBlock.Height, len(unsignedBlock.Transactions))
+	return nil
 }
 
 func (s *submitter) commitBlock(ctx context.Context, b *bc.Block, snapshot *state.Snapshot) error {
@@ -108,7 +261,7 @@ func (s *submitter) commitBlock(ctx context.Context, b *bc.Block, snapshot *stat
 }
 
 func (s *submitter) waitOnTx(ctx context.Context, txid bc.Hash, r *multichan.R) error {
-	log.Printf("waiting on tx %x to hit txvm", txid.Bytes())
+	debugf("waiting on tx %x to hit txvm", txid.Bytes())
 	for {
 		got, ok := r.Read(ctx)
 		if !ok {
@@ -154,11 +307,22 @@ func (s *submitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r, err := s.submitTx(ctx, tx)
+	r, err := s.submitPaidTx(ctx, tx)
+	if errors.Root(err) == errFeeTooLow {
+		net.Errorf(w, http.StatusPaymentRequired, "submitting tx: %s", err)
+		return
+	}
+	if errors.Root(err) == errFrozen {
+		net.Errorf(w, http.StatusForbidden, "submitting tx: %s", err)
+		return
+	}
 	if err != nil {
 		net.Errorf(w, http.StatusBadRequest, "submitting tx: %s", err)
 		return
 	}
+	if s.gossip != nil {
+		s.gossip.Publish(gossip.Tx, bits)
+	}
 	if wait {
 		err = s.waitOnTx(ctx, tx.ID, r)
 		if err != nil {
@@ -170,6 +334,13 @@ func (s *submitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *submitter) Get(w http.ResponseWriter, req *http.Request) {
+	getBlock(w, req, s.chain)
+}
+
+// getBlock serves the block of chain at the requested height,
+// waiting for it if necessary.
+// Height 0 means the latest block.
+func getBlock(w http.ResponseWriter, req *http.Request, chain *protocol.Chain) {
 	wantStr := req.FormValue("height")
 	var (
 		want uint64 = 1
@@ -183,13 +354,13 @@ func (s *submitter) Get(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	height := s.chain.Height()
+	height := chain.Height()
 	if want == 0 {
 		want = height
 	}
 	if want > height {
 		ctx := req.Context()
-		waiter := s.chain.BlockWaiter(want)
+		waiter := chain.BlockWaiter(want)
 		select {
 		case <-waiter:
 			// ok
@@ -201,7 +372,7 @@ func (s *submitter) Get(w http.ResponseWriter, req *http.Request) {
 
 	ctx := req.Context()
 
-	b, err := s.chain.GetBlock(ctx, want)
+	b, err := chain.GetBlock(ctx, want)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "getting block %d: %s", want, err)
 		return
@@ -0,0 +1,258 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+const (
+	maxSyncHeaders = 1000 // per /sync/headers response
+	maxSyncBlocks  = 100  // per /sync/blocks request
+)
+
+// errDiverged means a server's chain does not extend the local one.
+var errDiverged = errors.New("chains have diverged")
+
+// syncHeaders is the response to /sync/headers.
+type syncHeaders struct {
+	Height  uint64   `json:"height"`  // of the server's latest block
+	Headers [][]byte `json:"headers"` // blocks with no transactions, as in txproof.Proof
+}
+
+// SyncHeaders is the handler for /sync/headers.
+func (c *Custodian) SyncHeaders(w http.ResponseWriter, req *http.Request) {
+	serveSyncHeaders(w, req, c.DB, c.S.chain)
+}
+
+// SyncBlocks is the handler for /sync/blocks.
+func (c *Custodian) SyncBlocks(w http.ResponseWriter, req *http.Request) {
+	serveSyncBlocks(w, req, c.DB)
+}
+
+// serveSyncHeaders responds with the headers and signatures of the blocks
+// at heights from (default 1) through to (default the latest),
+// at most maxSyncHeaders of them.
+func serveSyncHeaders(w http.ResponseWriter, req *http.Request, db *sql.DB, chain *protocol.Chain) {
+	ctx := req.Context()
+	height := chain.Height()
+	from, to := uint64(1), height
+	for _, p := range []struct {
+		name string
+		v    *uint64
+	}{{"from", &from}, {"to", &to}} {
+		s := req.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v == 0 {
+			net.Errorf(w, http.StatusBadRequest, "%s must be a positive height", p.name)
+			return
+		}
+		*p.v = v
+	}
+	if to > height {
+		to = height
+	}
+	if to >= from+maxSyncHeaders {
+		to = from + maxSyncHeaders - 1
+	}
+
+	resp := syncHeaders{Height: height, Headers: [][]byte{}}
+	if from <= to {
+		indexed := make(map[uint64][]byte)
+		const q = `SELECT height, bits FROM block_headers WHERE height >= $1 AND height <= $2`
+		err := sqlutil.ForQueryRows(ctx, db, q, from, to, func(height uint64, bits []byte) {
+			indexed[height] = bits
+		})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "getting block headers: %s", err)
+			return
+		}
+		for h := from; h <= to; h++ {
+			bits, ok := indexed[h]
+			if !ok {
+				// Not yet indexed, or not indexed at all, as at a follower.
+				b, err := chain.GetBlock(ctx, h)
+				if err != nil {
+					net.Errorf(w, http.StatusInternalServerError, "getting block %d: %s", h, err)
+					return
+				}
+				bits, err = headerBytes(b)
+				if err != nil {
+					net.Errorf(w, http.StatusInternalServerError, "serializing header %d: %s", h, err)
+					return
+				}
+			}
+			resp.Headers = append(resp.Headers, bits)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveSyncBlocks responds with the blocks
+// whose hex IDs are given in id parameters, at most maxSyncBlocks of them,
+// as a JSON array of serialized blocks in the same order.
+func serveSyncBlocks(w http.ResponseWriter, req *http.Request, db *sql.DB) {
+	ctx := req.Context()
+	err := req.ParseForm()
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	ids := req.Form["id"]
+	if len(ids) > maxSyncBlocks {
+		net.Errorf(w, http.StatusBadRequest, "at most %d blocks may be requested at once", maxSyncBlocks)
+		return
+	}
+	blocks := [][]byte{}
+	for _, s := range ids {
+		id, err := hex.DecodeString(s)
+		if err != nil || len(id) != 32 {
+			net.Errorf(w, http.StatusBadRequest, "block ID %q is not 32 hex-encoded bytes", s)
+			return
+		}
+		var bits []byte
+		err = db.QueryRowContext(ctx, `SELECT bits FROM blocks WHERE hash=$1`, id).Scan(&bits)
+		if err == sql.ErrNoRows {
+			net.Errorf(w, http.StatusNotFound, "block %s is not stored here", s)
+			return
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "getting block %s: %s", s, err)
+			return
+		}
+		blocks = append(blocks, bits)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// syncFrom fetches from the server at the base URL server
+// the blocks after prev, through height to,
+// or through the server's latest block if to is 0,
+// passing each to commit in order.
+// It checks that the server's chain includes prev,
+// that the headers after it link to it and each other
+// and are signed by the validators named in the one before,
+// and that each block matches its header.
+func syncFrom(ctx context.Context, server string, prev *bc.Block, to uint64, commit func(*bc.Block) error) error {
+	for {
+		// Asking for prev's header too shows that it is on the server's chain.
+		q := url.Values{"from": {strconv.FormatUint(prev.Height, 10)}}
+		if to > 0 {
+			q.Set("to", strconv.FormatUint(to, 10))
+		}
+		var resp syncHeaders
+		err := getJSON(ctx, server+"/sync/headers?"+q.Encode(), &resp)
+		if err != nil {
+			return err
+		}
+		if resp.Height < prev.Height {
+			return errors.WithDetailf(errDiverged, "%s is at height %d, below %d", server, resp.Height, prev.Height)
+		}
+		if len(resp.Headers) == 0 {
+			return fmt.Errorf("no headers from %s at height %d", server, prev.Height)
+		}
+		first := new(bc.Block)
+		err = first.FromBytes(resp.Headers[0])
+		if err != nil {
+			return errors.Wrap(err, "parsing header")
+		}
+		if first.Hash() != prev.Hash() {
+			return errors.WithDetailf(errDiverged, "block %d at %s is %x, not %x", prev.Height, server, first.Hash().Bytes(), prev.Hash().Bytes())
+		}
+		if len(resp.Headers) == 1 {
+			if to > resp.Height {
+				return fmt.Errorf("%s has no blocks after %d, want through %d", server, resp.Height, to)
+			}
+			return nil
+		}
+
+		headers := make([]*bc.Block, 0, len(resp.Headers)-1)
+		for _, bits := range resp.Headers[1:] {
+			h := new(bc.Block)
+			err = h.FromBytes(bits)
+			if err != nil {
+				return errors.Wrap(err, "parsing header")
+			}
+			if h.Height != prev.Height+1 || h.PreviousBlockId == nil || *h.PreviousBlockId != prev.Hash() {
+				return errors.WithDetailf(errDiverged, "header %d from %s does not follow block %d %x", h.Height, server, prev.Height, prev.Hash().Bytes())
+			}
+			err = txproof.CheckSignatures(h, prev.NextPredicate)
+			if err != nil {
+				return errors.Wrapf(err, "checking header %d", h.Height)
+			}
+			headers = append(headers, h)
+			prev = h
+		}
+
+		for len(headers) > 0 {
+			batch := headers
+			if len(batch) > maxSyncBlocks {
+				batch = batch[:maxSyncBlocks]
+			}
+			headers = headers[len(batch):]
+			q := url.Values{}
+			for _, h := range batch {
+				q.Add("id", hex.EncodeToString(h.Hash().Bytes()))
+			}
+			var blocks [][]byte
+			err = getJSON(ctx, server+"/sync/blocks?"+q.Encode(), &blocks)
+			if err != nil {
+				return err
+			}
+			if len(blocks) != len(batch) {
+				return fmt.Errorf("got %d blocks from %s, want %d", len(blocks), server, len(batch))
+			}
+			for i, bits := range blocks {
+				b := new(bc.Block)
+				err = b.FromBytes(bits)
+				if err != nil {
+					return errors.Wrapf(err, "parsing block %d", batch[i].Height)
+				}
+				if b.Hash() != batch[i].Hash() {
+					return fmt.Errorf("block %d from %s does not match its header", batch[i].Height, server)
+				}
+				err = commit(b)
+				if err != nil {
+					return errors.Wrapf(err, "committing block %d", b.Height)
+				}
+			}
+		}
+		if to > 0 && prev.Height >= to {
+			return nil
+		}
+	}
+}
+
+// getJSON gets url and parses the JSON response into v.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	resp, err := net.PeerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "requesting %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status code %d from %s", resp.StatusCode, url)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "parsing response from %s", url)
+}
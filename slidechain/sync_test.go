@@ -0,0 +1,126 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+		c := &Custodian{S: s, DB: db}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/get", s.Get)
+		mux.HandleFunc("/sync/headers", c.SyncHeaders)
+		mux.HandleFunc("/sync/blocks", c.SyncBlocks)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		var expMS int64
+		submit := func() {
+			t.Helper()
+			expMS++
+			tx, err := buildPrePegInTx(issuanceContracts[1], s.initialBlock.Hash().Bytes(), nil, testRecipPubKey, 1, int64(bc.Millis(time.Now().Add(time.Hour)))+expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.submitTx(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := ioutil.TempFile("", "follower")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		fdb, err := sql.Open("sqlite3", f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fdb.Close()
+		follower, err := NewFollower(ctx, fdb, server.URL, s.initialBlock.Hash(), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		catchUp := func() {
+			t.Helper()
+			err := follower.CatchUp(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if follower.Height() != chain.Height() {
+				t.Fatalf("follower at height %d, want %d", follower.Height(), chain.Height())
+			}
+			theirs, err := follower.chain.GetBlock(ctx, follower.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ours, err := chain.GetBlock(ctx, chain.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if theirs.Hash() != ours.Hash() {
+				t.Fatalf("follower's block %d differs from the primary's", theirs.Height)
+			}
+		}
+
+		// Some headers are indexed and some are only in the block store.
+		for i := 0; i < 3; i++ {
+			submit()
+		}
+		_, err = c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit()
+		catchUp()
+
+		// A follower that missed blocks catches up.
+		for i := 0; i < 5; i++ {
+			submit()
+		}
+		catchUp()
+		catchUp()
+
+		// A follower with a block the primary does not have
+		// is not on the primary's chain.
+		bb := protocol.NewBlockBuilder()
+		err = bb.Start(follower.chain.State(), bc.Millis(time.Now())+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, _, err := bb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = follower.chain.CommitBlock(ctx, &bc.Block{UnsignedBlock: ub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = follower.CatchUp(ctx)
+		if errors.Root(err) != errDiverged {
+			t.Errorf("catching up when ahead: got error %v, want %s", err, errDiverged)
+		}
+		submit()
+		err = follower.CatchUp(ctx)
+		if errors.Root(err) != errDiverged {
+			t.Errorf("catching up after a fork: got error %v, want %s", err, errDiverged)
+		}
+	})
+}
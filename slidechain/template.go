@@ -0,0 +1,286 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/txvmutil"
+	"github.com/interstellar/slingshot/slidechain/config"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// ExportTemplate is the request body of /export-template:
+// an unsigned export tx, as described by the integrator building it.
+// Its input is a pay-to-multisig output,
+// which may require the custodian's signature among others,
+// and its change goes back to the same signers.
+type ExportTemplate struct {
+	Asset       string `json:"asset"` // "native" or "CODE:ISSUER"
+	Amount      int64  `json:"amount"`
+	InputAmount int64  `json:"input_amount"`
+
+	// Version is the issuance contract version of an imported asset.
+	// It is ignored for a wrapped asset.
+	Version int `json:"version"`
+
+	// Anchor, Quorum, and Pubkeys are those of the input.
+	Anchor  []byte   `json:"anchor"`
+	Quorum  int      `json:"quorum"`
+	Pubkeys [][]byte `json:"pubkeys"`
+
+	// Exporter is the pubkey of the exporter,
+	// whose Stellar account the export is pegged out to
+	// and to which it is refunded if it fails.
+	Exporter []byte `json:"exporter"`
+
+	// TempAddr, Seqnum, and TimeBounds are those of the pre-export tx.
+	TempAddr   string     `json:"temp_addr"`
+	Seqnum     int64      `json:"seqnum"`
+	TimeBounds TimeBounds `json:"time_bounds"`
+
+	// Nettable means the pre-export tx, like SubmitPreExportTx's,
+	// also preauthorized the settlement tx.
+	Nettable bool `json:"nettable,omitempty"`
+}
+
+// SignedTemplate is the response of /export-template.
+// Each signer of the input signs SigProg followed by the input's anchor;
+// Tx completes the export tx with the signatures.
+type SignedTemplate struct {
+	Template ExportTemplate `json:"template"`
+	TxID     []byte         `json:"txid"`
+	SigProg  []byte         `json:"sig_prog"`
+
+	// Program is the export tx program through its finalize.
+	Program []byte `json:"program"`
+
+	// Signatures are by position in Template.Pubkeys:
+	// the custodian's, if Cosigned, and otherwise empty.
+	Signatures [][]byte `json:"signatures"`
+	Cosigned   bool     `json:"cosigned"`
+}
+
+// Tx returns the export tx signed with sigs,
+// by position in Template.Pubkeys,
+// and with the custodian's signature in place of any left empty.
+func (s *SignedTemplate) Tx(sigs [][]byte) (*bc.Tx, error) {
+	if len(sigs) != len(s.Template.Pubkeys) {
+		return nil, fmt.Errorf("got %d signatures for %d signers", len(sigs), len(s.Template.Pubkeys))
+	}
+	all := make([][]byte, len(sigs))
+	for i, sig := range sigs {
+		all[i] = sig
+		if len(sig) == 0 && i < len(s.Signatures) {
+			all[i] = s.Signatures[i]
+		}
+	}
+	b := new(txvmutil.Builder)
+	signExportProg(b, all, s.SigProg)
+	prog := append(append([]byte{}, s.Program...), b.Build()...)
+	var runlimit int64
+	tx, err := bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	if err != nil {
+		return nil, errors.Wrap(err, "making export tx")
+	}
+	tx.Runlimit = math.MaxInt64 - runlimit
+	return tx, nil
+}
+
+// SignExportTemplate is the handler for /export-template.
+// It checks the template's amount and destination
+// and returns it as a SignedTemplate,
+// countersigned if the custodian is among the signers of its input.
+// The custodian does not submit the tx,
+// and its peg-out is checked again like any other export's.
+func (c *Custodian) SignExportTemplate(w http.ResponseWriter, req *http.Request) {
+	cfg := c.config()
+	if _, ok := c.chain.(*stellarChain); !ok || cfg == nil || !cfg.ExportTemplates.Enabled {
+		net.Errorf(w, http.StatusNotFound, "export templates are not enabled")
+		return
+	}
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "export templates must be POSTed")
+		return
+	}
+	ctx := req.Context()
+	var t ExportTemplate
+	err := json.NewDecoder(req.Body).Decode(&t)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing template: %s", err)
+		return
+	}
+	if err := t.check(); err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	asset, err := stellar.ParseAssetKey(t.Asset)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing asset: %s", err)
+		return
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "marshaling asset: %s", err)
+		return
+	}
+	var assetID bc.Hash
+	wrapped, err := c.wrappedAssetByXDR(ctx, assetXDR)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+		return
+	}
+	if wrapped != nil {
+		assetID = bc.HashFromBytes(wrapped.TxvmAsset)
+	} else {
+		allowed, err := c.assetAllowed(assetXDR)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "checking asset: %s", err)
+			return
+		}
+		if !allowed {
+			err = &scerrors.AssetError{Asset: stellar.AssetKey(asset), Err: scerrors.ErrUnknownAsset}
+			net.Errorf(w, scerrors.Status(err), "%s", err)
+			return
+		}
+		ic := issuanceContracts[t.Version]
+		if ic == nil {
+			net.Errorf(w, http.StatusBadRequest, "unknown issuance version %d", t.Version)
+			return
+		}
+		assetID = ic.assetID(assetXDR)
+	}
+	if max, ok := maxTemplateAmount(cfg.ExportTemplates, stellar.AssetKey(asset)); ok && t.Amount > max {
+		net.Errorf(w, http.StatusForbidden, "amount %d exceeds the limit of %d for %s", t.Amount, max, stellar.AssetKey(asset))
+		return
+	}
+	dest, err := strkey.Encode(strkey.VersionByteAccountID, t.Exporter)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "encoding exporter address: %s", err)
+		return
+	}
+	allowed, err := c.destinationAllowed(ctx, dest)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if !allowed {
+		net.Errorf(w, http.StatusForbidden, "destination %s is blocked", dest)
+		return
+	}
+
+	st, err := t.sign(assetXDR, assetID, wrapped != nil, c.privkey)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "building export tx: %s", err)
+		return
+	}
+	if st.Cosigned {
+		detail := fmt.Sprintf("export tx %x of %d %s to %s", st.TxID, t.Amount, stellar.AssetKey(asset), dest)
+		err = c.recordAudit(ctx, "export.cosign", "export-template "+req.RemoteAddr, detail)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// check reports what is malformed in t.
+func (t *ExportTemplate) check() error {
+	if t.Amount <= 0 || t.InputAmount < t.Amount {
+		return fmt.Errorf("amount %d must be positive and at most the input amount %d", t.Amount, t.InputAmount)
+	}
+	if len(t.Anchor) != 32 {
+		return errors.New("anchor must be 32 bytes")
+	}
+	if len(t.Pubkeys) == 0 || t.Quorum < 1 || t.Quorum > len(t.Pubkeys) {
+		return fmt.Errorf("quorum %d must be from 1 to the %d pubkeys", t.Quorum, len(t.Pubkeys))
+	}
+	for _, p := range append([][]byte{t.Exporter}, t.Pubkeys...) {
+		if len(p) != ed25519.PublicKeySize {
+			return fmt.Errorf("pubkey %x is not a %d-byte ed25519 public key", p, ed25519.PublicKeySize)
+		}
+	}
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, t.TempAddr); err != nil {
+		return fmt.Errorf("temp address %q is not a Stellar account ID", t.TempAddr)
+	}
+	return t.TimeBounds.check()
+}
+
+// sign builds the export tx of t for the txvm asset assetID,
+// pegged out as assetXDR,
+// signing it with prv if its pubkey is among the signers.
+func (t *ExportTemplate) sign(assetXDR []byte, assetID bc.Hash, wrapped bool, prv ed25519.PrivateKey) (*SignedTemplate, error) {
+	exporter, err := strkey.Encode(strkey.VersionByteAccountID, t.Exporter)
+	if err != nil {
+		return nil, err
+	}
+	retireAnchor1 := txvm.VMHash("Split2", t.Anchor)
+	retireAnchor := txvm.VMHash("Split1", retireAnchor1[:])
+	ref := pegOut{
+		AssetXDR:   assetXDR,
+		TempAddr:   t.TempAddr,
+		Seqnum:     t.Seqnum,
+		Exporter:   exporter,
+		Amount:     t.Amount,
+		Anchor:     retireAnchor[:],
+		Pubkey:     t.Exporter,
+		TimeBounds: t.TimeBounds,
+		Nettable:   t.Nettable,
+	}
+	pubkeys := make([]ed25519.PublicKey, len(t.Pubkeys))
+	for i, p := range t.Pubkeys {
+		pubkeys[i] = p
+	}
+	b, txid, err := unsignedExportProg(&ref, assetID, t.InputAmount, t.Anchor, t.Quorum, pubkeys, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	st := &SignedTemplate{
+		Template:   *t,
+		TxID:       txid[:],
+		SigProg:    standard.VerifyTxID(txid),
+		Program:    b.Build(),
+		Signatures: make([][]byte, len(pubkeys)),
+	}
+	if prv == nil {
+		return st, nil
+	}
+	pub := prv.Public().(ed25519.PublicKey)
+	for i, p := range pubkeys {
+		if bytes.Equal(p, pub) {
+			st.Signatures[i] = ed25519.Sign(prv, append(append([]byte{}, st.SigProg...), t.Anchor...))
+			st.Cosigned = true
+		}
+	}
+	return st, nil
+}
+
+// maxTemplateAmount returns the largest export of the asset
+// that the custodian countersigns,
+// and whether there is a limit.
+func maxTemplateAmount(cfg config.ExportTemplates, asset string) (int64, bool) {
+	for _, m := range cfg.MaxAmounts {
+		name, amount := config.SplitNamed(m)
+		if name != asset {
+			continue
+		}
+		n, err := strconv.ParseInt(amount, 10, 64)
+		if err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,121 @@
+package slidechain
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+)
+
+func TestSignExportTemplate(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config.Default()
+		cfg.ExportTemplates.Enabled = true
+		cfg.ExportTemplates.MaxAmounts = []string{"native=1000"}
+		c := &Custodian{DB: db, cfg: cfg, chain: &stellarChain{}, privkey: custodianPrv}
+
+		exporterPub, exporterPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempKP, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := ExportTemplate{
+			Asset:       "native",
+			Amount:      600,
+			InputAmount: 1000,
+			Version:     1,
+			Anchor:      bytes.Repeat([]byte{1}, 32),
+			Quorum:      2,
+			Pubkeys:     [][]byte{exporterPub, custodianPub},
+			Exporter:    exporterPub,
+			TempAddr:    tempKP.Address(),
+			Seqnum:      7,
+		}
+		sign := func(tmpl ExportTemplate, wantCode int) *SignedTemplate {
+			t.Helper()
+			body, err := json.Marshal(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.SignExportTemplate(w, httptest.NewRequest("POST", "/export-template", bytes.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from /export-template, want %d: %s", w.Code, wantCode, w.Body)
+			}
+			if wantCode != 200 {
+				return nil
+			}
+			var st SignedTemplate
+			err = json.NewDecoder(w.Body).Decode(&st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &st
+		}
+
+		st := sign(tmpl, 200)
+		if !st.Cosigned || len(st.Signatures[1]) == 0 {
+			t.Fatal("custodian did not countersign a template it is a signer of")
+		}
+		if _, err := st.Tx([][]byte{nil, nil}); err == nil {
+			t.Error("completed an export tx without the exporter's signature")
+		}
+		exporterSig := ed25519.Sign(exporterPrv, append(st.SigProg, tmpl.Anchor...))
+		tx, err := st.Tx([][]byte{exporterSig, nil})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx.ID.Bytes(), st.TxID) {
+			t.Errorf("got export txid %x, want %x", tx.ID.Bytes(), st.TxID)
+		}
+		p, err := exportFromLog(tx.Log, c.chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil || p.Amount != tmpl.Amount || !bytes.Equal(p.Pubkey, exporterPub) {
+			t.Errorf("got export %+v, want one of %d by %x", p, tmpl.Amount, exporterPub)
+		}
+
+		// Not a signer: validated, but not countersigned.
+		solo := tmpl
+		solo.Quorum, solo.Pubkeys = 1, [][]byte{exporterPub}
+		if st := sign(solo, 200); st.Cosigned {
+			t.Error("custodian countersigned a template it is not a signer of")
+		}
+
+		over := tmpl
+		over.Amount = 1001
+		over.InputAmount = 1001
+		sign(over, 403)
+
+		dest, err := strkey.Encode(strkey.VersionByteAccountID, exporterPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO peg_out_destinations (address, list, note, time_ms) VALUES ($1, 'deny', '', 0)`, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sign(tmpl, 403)
+
+		bad := tmpl
+		bad.Quorum = 3
+		sign(bad, 400)
+
+		cfg.ExportTemplates.Enabled = false
+		sign(tmpl, 404)
+	})
+}
@@ -0,0 +1,233 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/screening"
+)
+
+const travelRuleMissingAlert = "travel-rule-missing"
+
+// TravelRuleRequest is the request body of /travel-rule.
+type TravelRuleRequest struct {
+	// TxID is the ID of the txvm export tx,
+	// which need not have been submitted yet.
+	TxID []byte `json:"txid"`
+
+	// Pubkey is the exporter's,
+	// which must match the export tx.
+	Pubkey []byte `json:"pubkey"`
+
+	Info screening.TravelRule `json:"info"`
+
+	// TimeMS is when the request was made.
+	// A request older than the last one for the same export is refused.
+	TimeMS int64 `json:"time_ms"`
+
+	// Signature is by Pubkey of SigMsg.
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message signed in a /travel-rule request.
+func (r *TravelRuleRequest) SigMsg() []byte {
+	info, _ := json.Marshal(r.Info) // a struct of strings always marshals
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(r.TimeMS))
+	msg := []byte("slidechain travel rule\x00")
+	msg = append(msg, r.TxID...)
+	msg = append(msg, r.Pubkey...)
+	msg = append(msg, info...)
+	msg = append(msg, timeBytes[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// TravelRule is the handler for /travel-rule,
+// where an exporter attaches originator and beneficiary information
+// to an export.
+// The information is stored encrypted and never goes on either chain.
+func (c *Custodian) TravelRule(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "travel-rule information must be POSTed")
+		return
+	}
+	cfg := c.config()
+	if cfg == nil || cfg.TravelRule.Key == "" {
+		net.Errorf(w, http.StatusNotFound, "travel-rule information is not configured")
+		return
+	}
+	ctx := req.Context()
+	var r TravelRuleRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(r.TxID) != 32 {
+		net.Errorf(w, http.StatusBadRequest, "txid must be 32 bytes")
+		return
+	}
+	if len(r.Pubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	if r.Info.Originator.Name == "" || r.Info.Beneficiary.Name == "" {
+		net.Errorf(w, http.StatusBadRequest, "originator and beneficiary names are required")
+		return
+	}
+	if !c.checkRequestTime(w, "time_ms", r.TimeMS) {
+		return
+	}
+	if !ed25519.Verify(r.Pubkey, r.SigMsg(), r.Signature) {
+		net.Errorf(w, http.StatusUnauthorized, "bad signature")
+		return
+	}
+	var exporter []byte
+	err = c.DB.QueryRowContext(ctx, `SELECT pubkey FROM exports WHERE txid=$1`, r.TxID).Scan(&exporter)
+	if err != nil && err != sql.ErrNoRows {
+		net.Errorf(w, http.StatusInternalServerError, "looking up export: %s", err)
+		return
+	}
+	if err == nil && !bytes.Equal(exporter, r.Pubkey) {
+		net.Errorf(w, http.StatusForbidden, "pubkey is not the exporter's")
+		return
+	}
+
+	sealed, err := sealTravelRule(cfg.TravelRule, r.TxID, r.Info)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	const q = `INSERT INTO travel_rule (txid, pubkey, sealed, time_ms) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (txid) DO UPDATE SET sealed=excluded.sealed, time_ms=excluded.time_ms
+		WHERE excluded.pubkey = travel_rule.pubkey AND excluded.time_ms > travel_rule.time_ms`
+	res, err := c.DB.ExecContext(ctx, q, r.TxID, r.Pubkey, sealed, r.TimeMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording travel-rule information: %s", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		net.Errorf(w, http.StatusConflict, "newer travel-rule information for this export has been given")
+		return
+	}
+	if c.exports != nil {
+		c.exports.Broadcast()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTravelRule returns the travel-rule information attached to an export,
+// and reports whether the export may proceed:
+// it may not if the information is required and missing.
+// The first time an export is held for it,
+// operators are alerted.
+func (c *Custodian) checkTravelRule(ctx context.Context, p *pegOut) (*screening.TravelRule, bool, error) {
+	cfg := c.config()
+	if cfg == nil || cfg.TravelRule.Key == "" {
+		return nil, true, nil
+	}
+	var sealed []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT sealed FROM travel_rule WHERE txid=$1 AND pubkey=$2`, p.TxID, p.Pubkey).Scan(&sealed)
+	if err == nil {
+		info, err := openTravelRule(cfg.TravelRule, p.TxID, sealed)
+		return info, err == nil, err
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, errors.Wrapf(err, "looking up travel-rule information of export %x", p.TxID)
+	}
+	asset := assetName(p.AssetXDR)
+	threshold, ok := travelRuleThreshold(cfg.TravelRule, asset)
+	if !ok || p.Amount < threshold {
+		return nil, true, nil
+	}
+	alerted, err := c.alerted(ctx, travelRuleMissingAlert, p.TxID)
+	if err != nil || alerted {
+		return nil, false, err
+	}
+	detail := fmt.Sprintf("export %x of %d %s held for travel-rule information (threshold %d)", p.TxID, p.Amount, asset, threshold)
+	return nil, false, c.alert(ctx, travelRuleMissingAlert, p.TxID, detail)
+}
+
+// travelRuleThreshold returns the amount of the asset
+// at and above which peg-outs require travel-rule information,
+// and whether there is one.
+func travelRuleThreshold(cfg config.TravelRule, asset string) (int64, bool) {
+	for _, th := range cfg.Thresholds {
+		name, amount := config.SplitNamed(th)
+		if name != asset {
+			continue
+		}
+		n, err := strconv.ParseInt(amount, 10, 64)
+		if err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// aeadFromHexKey returns the AES-GCM AEAD with the hex key
+// of the named setting, such as travel_rule.key.
+func aeadFromHexKey(setting, hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", setting)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, setting)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTravelRule encrypts the travel-rule information of an export,
+// bound to its txid.
+// The result is the nonce followed by the ciphertext.
+func sealTravelRule(cfg config.TravelRule, txid []byte, info screening.TravelRule) ([]byte, error) {
+	aead, err := aeadFromHexKey("travel_rule.key", cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(info)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling travel-rule information")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, txid), nil
+}
+
+func openTravelRule(cfg config.TravelRule, txid, sealed []byte) (*screening.TravelRule, error) {
+	aead, err := aeadFromHexKey("travel_rule.key", cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("travel-rule information of export %x is truncated", txid)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], txid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting travel-rule information of export %x", txid)
+	}
+	info := new(screening.TravelRule)
+	err = json.Unmarshal(plaintext, info)
+	return info, errors.Wrapf(err, "parsing travel-rule information of export %x", txid)
+}
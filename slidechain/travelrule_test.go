@@ -0,0 +1,120 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/screening"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+func TestTravelRule(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		screener := &testScreener{results: make(map[string]screening.Result)}
+		cfg := config.Default()
+		cfg.TravelRule.Thresholds = []string{"native=1000"}
+		cfg.TravelRule.Key = hex.EncodeToString(bytes.Repeat([]byte{7}, 32))
+		c := &Custodian{DB: db, screener: screener, cfg: cfg}
+
+		pub, prv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		export := func(b byte, amount int64) *pegOut {
+			t.Helper()
+			p := &pegOut{TxID: bytes.Repeat([]byte{b}, 32), AssetXDR: lumenXDR, Amount: amount, Exporter: importTestAccountID, Pubkey: pub}
+			_, err := db.Exec("INSERT INTO exports (txid, amount, asset_xdr, temp_addr, seqnum, exporter, anchor, pubkey) VALUES ($1, $2, $3, '', 0, $4, x'', $5)", p.TxID, p.Amount, p.AssetXDR, p.Exporter, p.Pubkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			screener.results[hex.EncodeToString(p.TxID)] = screening.Result{Decision: screening.Approve}
+			return p
+		}
+		check := func(p *pegOut, want bool) {
+			t.Helper()
+			ok, err := c.screenPegOut(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("screening export of %d gave %v, want %v", p.Amount, ok, want)
+			}
+		}
+		info := screening.TravelRule{
+			Originator:  screening.Party{Name: "Alice Originator", NationalID: "123-45-6789"},
+			Beneficiary: screening.Party{Name: "Bob Beneficiary", Account: importTestAccountID},
+		}
+		attach := func(p *pegOut, signer ed25519.PrivateKey, timeMS int64, wantCode int) {
+			t.Helper()
+			r := TravelRuleRequest{TxID: p.TxID, Pubkey: pub, Info: info, TimeMS: timeMS}
+			r.Signature = ed25519.Sign(signer, r.SigMsg())
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.TravelRule(w, httptest.NewRequest("POST", "/travel-rule", bytes.NewReader(body)))
+			if w.Code != wantCode {
+				t.Fatalf("status code %d from /travel-rule, want %d: %s", w.Code, wantCode, w.Body)
+			}
+		}
+
+		// Small exports need no information.
+		check(export(1, 999), true)
+		if screener.last.TravelRule != nil {
+			t.Errorf("got travel-rule information %+v for export without any", screener.last.TravelRule)
+		}
+
+		large := export(2, 1000)
+		check(large, false)
+		check(large, false)
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE kind=$1 AND key=$2`, travelRuleMissingAlert, large.TxID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d %s alerts, want 1", n, travelRuleMissingAlert)
+		}
+
+		_, otherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := c.nowMS()
+		attach(large, otherPrv, now, http.StatusUnauthorized)
+		attach(large, prv, now, http.StatusNoContent)
+		attach(large, prv, now, http.StatusConflict)
+
+		var sealed []byte
+		err = db.QueryRow(`SELECT sealed FROM travel_rule WHERE txid=$1`, large.TxID).Scan(&sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, []byte("Alice")) {
+			t.Error("travel-rule information stored in the clear")
+		}
+
+		check(large, true)
+		if got := screener.last.TravelRule; got == nil || *got != info {
+			t.Errorf("screener got travel-rule information %+v, want %+v", got, info)
+		}
+	})
+}
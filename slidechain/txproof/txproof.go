@@ -0,0 +1,150 @@
+// Package txproof verifies proofs that a transaction
+// is included in a slidechain block,
+// without the rest of the block's transactions.
+//
+// A proof carries the block with its transactions removed:
+// the header, which commits to the transactions in its TransactionsRoot,
+// and the block signatures.
+// A light client that trusts the block's ID,
+// or the predicate of the block before it,
+// can check a proof with nothing else.
+package txproof
+
+import (
+	"bytes"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+)
+
+// Proof is a merkle proof that a transaction is in a block.
+type Proof struct {
+	TxID bc.Hash `json:"txid"`
+
+	// WitnessHash commits to the tx's version, runlimit, and program.
+	// Together with TxID it is the tx's leaf in the merkle tree.
+	WitnessHash bc.Hash `json:"witness_hash"`
+
+	// Position is the tx's index in the block.
+	Position int `json:"position"`
+
+	// Path is the sibling hashes from the tx's leaf up to the root.
+	Path []Step `json:"path"`
+
+	// Block is the serialized block with no transactions.
+	Block []byte `json:"block"`
+}
+
+// Step is one sibling hash in a merkle path.
+type Step struct {
+	Hash bc.Hash `json:"hash"`
+
+	// Right tells whether Hash is the right-hand operand.
+	Right bool `json:"right"`
+}
+
+var (
+	// ErrRoot means the merkle path does not lead to the block's transactions root.
+	ErrRoot = errors.New("merkle path does not match transactions root")
+
+	// ErrTx means a transaction does not match the proof.
+	ErrTx = errors.New("transaction does not match proof")
+
+	// ErrSignatures means the block signatures do not satisfy a predicate.
+	ErrSignatures = errors.New("block signatures do not satisfy predicate")
+)
+
+// WitnessHash computes the witness hash of tx,
+// as committed to in the merkle tree of the block containing it.
+func WitnessHash(tx *bc.Tx) bc.Hash {
+	return bc.NewHash(txvm.VMHash("WitnessHash", txvm.Encode(txvm.Tuple{
+		txvm.Int(tx.Version),
+		txvm.Int(tx.Runlimit),
+		txvm.Bytes(tx.Program),
+	})))
+}
+
+// Verify checks that the merkle path in p leads from its tx
+// to the transactions root of its block,
+// and returns the block, with no transactions.
+// It does not check the block's signatures;
+// the caller must compare the block's ID with one it trusts
+// or use CheckSignatures.
+func Verify(p *Proof) (*bc.Block, error) {
+	b := new(bc.Block)
+	err := b.FromBytes(p.Block)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing block")
+	}
+	if b.BlockHeader == nil || b.TransactionsRoot == nil {
+		return nil, errors.New("block has no header")
+	}
+	var leaf bytes.Buffer
+	p.TxID.WriteTo(&leaf)
+	p.WitnessHash.WriteTo(&leaf)
+	h := hash(0x00, leaf.Bytes())
+	for _, s := range p.Path {
+		if s.Right {
+			h = hash(0x01, h[:], s.Hash.Bytes())
+		} else {
+			h = hash(0x01, s.Hash.Bytes(), h[:])
+		}
+	}
+	if bc.NewHash(h) != *b.TransactionsRoot {
+		return nil, ErrRoot
+	}
+	return b, nil
+}
+
+// VerifyTx is like Verify
+// but also checks that p is a proof for tx.
+func VerifyTx(p *Proof, tx *bc.Tx) (*bc.Block, error) {
+	if tx.ID != p.TxID || WitnessHash(tx) != p.WitnessHash {
+		return nil, ErrTx
+	}
+	return Verify(p)
+}
+
+// CheckSignatures checks the signatures of b
+// against pred, the NextPredicate of the block before it.
+func CheckSignatures(b *bc.Block, pred *bc.Predicate) error {
+	if pred.Version != 1 {
+		return errors.WithDetailf(ErrSignatures, "unknown predicate version %d", pred.Version)
+	}
+	if pred.Quorum == 0 {
+		return nil
+	}
+	if len(b.Arguments) != len(pred.Pubkeys) {
+		return errors.WithDetailf(ErrSignatures, "%d signatures for %d pubkeys", len(b.Arguments), len(pred.Pubkeys))
+	}
+	id := b.Hash()
+	var n int32
+	for i, arg := range b.Arguments {
+		sig, ok := arg.([]byte)
+		if !ok || len(sig) == 0 {
+			continue
+		}
+		pk := pred.Pubkeys[i]
+		if len(pk) != ed25519.PublicKeySize || !ed25519.Verify(pk, id.Bytes(), sig) {
+			return errors.WithDetailf(ErrSignatures, "bad signature %d", i)
+		}
+		n++
+	}
+	if n < pred.Quorum {
+		return errors.WithDetailf(ErrSignatures, "%d signatures, quorum %d", n, pred.Quorum)
+	}
+	return nil
+}
+
+// hash computes the merkle tree hash with the given prefix,
+// 0 for leaves and 1 for interior nodes.
+func hash(prefix byte, items ...[]byte) [32]byte {
+	buf := []byte{prefix}
+	for _, item := range items {
+		buf = append(buf, item...)
+	}
+	return sha3.Sum256(buf)
+}
@@ -0,0 +1,245 @@
+// Package validator implements a slidechain validator node,
+// one of the set of nodes a quorum of which must sign each block.
+//
+// The block-producing slidechaind proposes each block
+// to every validator with POST /sign.
+// A validator signs a block only if it validly extends
+// the latest block it has verified,
+// replaying the committed chain from slidechaind to catch up,
+// and it never signs two different blocks at the same height.
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/state"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+)
+
+var (
+	// ErrInvalid means a block does not validly extend
+	// the validator's latest verified block.
+	ErrInvalid = errors.New("invalid block")
+
+	// ErrConflict means the validator has already signed
+	// a different block at the same height.
+	ErrConflict = errors.New("conflicting block")
+)
+
+// Proposal is the request body of POST /sign.
+type Proposal struct {
+	Block []byte `json:"block"` // a serialized bc.Block without signatures
+}
+
+// Signature is the response to a Proposal.
+type Signature struct {
+	Pubkey    []byte `json:"pubkey"`
+	Signature []byte `json:"signature"` // of the block ID
+}
+
+// Node is a validator.
+type Node struct {
+	key    ed25519.PrivateKey
+	source string // base URL of the slidechaind producing blocks
+
+	mu       sync.Mutex
+	snapshot *state.Snapshot    // after the latest verified committed block
+	signed   map[uint64]bc.Hash // blocks signed above the snapshot, by height
+}
+
+// New returns a validator that signs with key
+// the blocks of the chain with the given initial block,
+// fetching committed blocks from the slidechaind at source.
+func New(key ed25519.PrivateKey, initial *bc.Block, source string) (*Node, error) {
+	snapshot := state.Empty()
+	err := snapshot.ApplyBlock(initial.UnsignedBlock)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying initial block")
+	}
+	return &Node{
+		key:      key,
+		source:   strings.TrimRight(source, "/"),
+		snapshot: snapshot,
+		signed:   make(map[uint64]bc.Hash),
+	}, nil
+}
+
+// Pubkey returns the validator's public key.
+func (n *Node) Pubkey() ed25519.PublicKey {
+	return n.key.Public().(ed25519.PublicKey)
+}
+
+// Height returns the height of the latest verified committed block.
+func (n *Node) Height() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.snapshot.Height()
+}
+
+// Sign verifies b and returns the validator's signature of it.
+// Committed blocks below b are first fetched and verified.
+func (n *Node) Sign(ctx context.Context, b *bc.Block) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for n.snapshot.Height()+1 < b.Height {
+		committed, err := n.fetch(ctx, n.snapshot.Height()+1)
+		if err != nil {
+			return nil, err
+		}
+		err = n.apply(committed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "committed block %d", committed.Height)
+		}
+	}
+	if b.Height != n.snapshot.Height()+1 {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d does not follow block %d", b.Height, n.snapshot.Height())
+	}
+	id := b.Hash()
+	if prev, ok := n.signed[b.Height]; ok && prev != id {
+		return nil, errors.WithDetailf(ErrConflict, "already signed block %x at height %d", prev.Bytes(), b.Height)
+	}
+	_, err := n.verify(b)
+	if err != nil {
+		return nil, err
+	}
+	n.signed[b.Height] = id
+	return ed25519.Sign(n.key, id.Bytes()), nil
+}
+
+// apply verifies a committed block, including its signatures,
+// and makes it the latest.
+func (n *Node) apply(b *bc.Block) error {
+	err := txproof.CheckSignatures(b, n.snapshot.Header.NextPredicate)
+	if err != nil {
+		return err
+	}
+	snapshot, err := n.verify(b)
+	if err != nil {
+		return err
+	}
+	n.snapshot = snapshot
+	for h := range n.signed {
+		if h <= b.Height {
+			delete(n.signed, h)
+		}
+	}
+	return nil
+}
+
+// verify checks that b validly extends the latest verified block,
+// returning the state after it.
+// The validator set may be changed only from that of an unsigned chain.
+func (n *Node) verify(b *bc.Block) (*state.Snapshot, error) {
+	prev := n.snapshot.Header
+	if b.PreviousBlockId == nil || *b.PreviousBlockId != prev.Hash() {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d does not follow the latest block", b.Height)
+	}
+	if b.TimestampMs <= prev.TimestampMs {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d timestamp does not increase", b.Height)
+	}
+	if b.NextPredicate == nil {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d has no next predicate", b.Height)
+	}
+	if prev.NextPredicate.Quorum > 0 && !proto.Equal(b.NextPredicate, prev.NextPredicate) {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d changes the validator set", b.Height)
+	}
+	if b.TransactionsRoot == nil || bc.TxMerkleRoot(b.Transactions) != *b.TransactionsRoot {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d has a bad transactions root", b.Height)
+	}
+	for _, tx := range b.Transactions {
+		for _, tr := range tx.Timeranges {
+			if (tr.MaxMS > 0 && b.TimestampMs > uint64(tr.MaxMS)) || (tr.MinMS > 0 && b.TimestampMs < uint64(tr.MinMS)) {
+				return nil, errors.WithDetailf(ErrInvalid, "tx %x is outside its time range", tx.ID.Bytes())
+			}
+		}
+	}
+	snapshot := state.Copy(n.snapshot)
+	err := snapshot.ApplyBlock(b.UnsignedBlock)
+	if err != nil {
+		return nil, errors.WithDetailf(ErrInvalid, "applying block %d: %s", b.Height, err)
+	}
+	if b.ContractsRoot == nil || b.ContractsRoot.Byte32() != snapshot.ContractsTree.RootHash() {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d has a bad contracts root", b.Height)
+	}
+	if b.NoncesRoot == nil || b.NoncesRoot.Byte32() != snapshot.NonceTree.RootHash() {
+		return nil, errors.WithDetailf(ErrInvalid, "block %d has a bad nonces root", b.Height)
+	}
+	return snapshot, nil
+}
+
+// fetch gets the committed block at the given height from the source.
+func (n *Node) fetch(ctx context.Context, height uint64) (*bc.Block, error) {
+	url := fmt.Sprintf("%s/get?height=%d", n.source, height)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building request")
+	}
+	resp, err := net.PeerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("status code %d from %s", resp.StatusCode, url)
+	}
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading block %d", height)
+	}
+	b := new(bc.Block)
+	err = b.FromBytes(bits)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing block %d", height)
+	}
+	if b.Height != height {
+		return nil, fmt.Errorf("got block %d from %s", b.Height, url)
+	}
+	return b, nil
+}
+
+// ServeHTTP handles POST /sign.
+func (n *Node) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "signing requires POST")
+		return
+	}
+	var p Proposal
+	err := json.NewDecoder(req.Body).Decode(&p)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	b := new(bc.Block)
+	err = b.FromBytes(p.Block)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing block: %s", err)
+		return
+	}
+	sig, err := n.Sign(req.Context(), b)
+	switch errors.Root(err) {
+	case nil:
+	case ErrInvalid:
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	case ErrConflict:
+		net.Errorf(w, http.StatusConflict, "%s", err)
+		return
+	default:
+		net.Errorf(w, http.StatusBadGateway, "signing block %d: %s", b.Height, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Signature{Pubkey: n.Pubkey(), Signature: sig})
+}
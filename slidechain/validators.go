@@ -0,0 +1,177 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/state"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/validator"
+)
+
+// signTimeout bounds each request to a validator for a signature.
+const signTimeout = 10 * time.Second
+
+// validatorSet is the set of validator nodes that sign blocks.
+type validatorSet struct {
+	pred *bc.Predicate
+	urls map[string]string // base URLs by hex pubkey
+}
+
+// newValidatorSet returns the validator set of cfg,
+// or nil if blocks are not signed.
+func newValidatorSet(cfg config.Validators) (*validatorSet, error) {
+	if len(cfg.Pubkeys) == 0 {
+		return nil, nil
+	}
+	v := &validatorSet{
+		pred: &bc.Predicate{Version: 1, Quorum: int32(cfg.Quorum)},
+		urls: make(map[string]string),
+	}
+	for i, s := range cfg.Pubkeys {
+		pubkey, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding validator pubkey %s", s)
+		}
+		v.pred.Pubkeys = append(v.pred.Pubkeys, pubkey)
+		v.urls[hex.EncodeToString(pubkey)] = strings.TrimRight(cfg.URLs[i], "/")
+	}
+	return v, nil
+}
+
+// checkValidators checks that v can sign the blocks after the one with header h.
+// The validator set of an unsigned chain can be set,
+// but that of a signed chain cannot be changed.
+func checkValidators(v *validatorSet, h *bc.BlockHeader) error {
+	if h.NextPredicate.Quorum == 0 {
+		return nil
+	}
+	if v == nil || !proto.Equal(v.pred, h.NextPredicate) {
+		return fmt.Errorf("validators config does not match the validator set of block %d, which cannot be changed", h.Height)
+	}
+	return nil
+}
+
+// sign returns b with the signatures of a quorum of the validator set
+// named by prev, the header of the block before b.
+func (v *validatorSet) sign(ctx context.Context, b *bc.UnsignedBlock, prev *bc.BlockHeader) (*bc.Block, error) {
+	pred := prev.NextPredicate
+	proposal := new(bytes.Buffer)
+	bits, err := (&bc.Block{UnsignedBlock: b}).Bytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "serializing block")
+	}
+	err = json.NewEncoder(proposal).Encode(validator.Proposal{Block: bits})
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding proposal")
+	}
+
+	id := b.Hash()
+	sigs := make([][]byte, len(pred.Pubkeys))
+	var wg sync.WaitGroup
+	for i, pubkey := range pred.Pubkeys {
+		url, ok := v.urls[hex.EncodeToString(pubkey)]
+		if !ok || pred.Quorum == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pubkey []byte, url string) {
+			defer wg.Done()
+			sig, err := requestSignature(ctx, url, proposal.Bytes())
+			if err != nil {
+				log.Printf("getting block %d signed by validator %x: %s", b.Height, pubkey, err)
+				return
+			}
+			if !ed25519.Verify(pubkey, id.Bytes(), sig) {
+				log.Printf("bad signature of block %d from validator %x", b.Height, pubkey)
+				return
+			}
+			sigs[i] = sig
+		}(i, pubkey, url)
+	}
+	wg.Wait()
+
+	signed, err := bc.SignBlock(b, prev, func(i int) (interface{}, error) {
+		if sigs[i] == nil {
+			return nil, nil
+		}
+		return sigs[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A missing signature must still hold its place.
+	for i, arg := range signed.Arguments {
+		if arg == nil {
+			signed.Arguments[i] = []byte{}
+		}
+	}
+	return signed, nil
+}
+
+// requestSignature proposes a block to the validator at url.
+func requestSignature(ctx context.Context, url string, proposal []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, signTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", url+"/sign", bytes.NewReader(proposal))
+	if err != nil {
+		return nil, errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := net.PeerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s/sign", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("status code %d from %s/sign", resp.StatusCode, url)
+	}
+	var sig validator.Signature
+	err = json.NewDecoder(resp.Body).Decode(&sig)
+	return sig.Signature, errors.Wrap(err, "parsing signature")
+}
+
+// signBlock signs b, the block a-building, with snapshot its resulting state.
+// If the validator set is being set, it becomes b's NextPredicate.
+// Without a quorum of signatures b cannot be committed,
+// so signBlock retries until it has one or ctx is done.
+func (s *submitter) signBlock(ctx context.Context, b *bc.UnsignedBlock, snapshot *state.Snapshot) (*bc.Block, *state.Snapshot, error) {
+	prev := s.chain.State().Header
+	if s.validators == nil {
+		return &bc.Block{UnsignedBlock: b}, snapshot, nil
+	}
+	if !proto.Equal(b.NextPredicate, s.validators.pred) {
+		b.NextPredicate = s.validators.pred
+		snapshot = state.Copy(s.chain.State())
+		err := snapshot.ApplyBlock(b)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "applying block with new validator set")
+		}
+	}
+	for {
+		signed, err := s.validators.sign(ctx, b, prev)
+		if err == nil {
+			return signed, snapshot, nil
+		}
+		log.Printf("signing block %d: %s", b.Height, err)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
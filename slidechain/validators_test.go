@@ -0,0 +1,141 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/txproof"
+	"github.com/interstellar/slingshot/slidechain/validator"
+)
+
+func TestValidators(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, _ *sql.DB, s *submitter, srv *httptest.Server, chain *protocol.Chain) {
+		s.blockInterval = 0
+
+		var (
+			cfg     = config.Validators{Quorum: 2}
+			nodes   []*validator.Node
+			servers []*httptest.Server
+		)
+		for i := 0; i < 3; i++ {
+			_, key, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node, err := validator.New(key, s.initialBlock, srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewServer(node)
+			defer server.Close()
+			nodes = append(nodes, node)
+			servers = append(servers, server)
+			cfg.Pubkeys = append(cfg.Pubkeys, hex.EncodeToString(node.Pubkey()))
+			cfg.URLs = append(cfg.URLs, server.URL)
+		}
+		var err error
+		s.validators, err = newValidatorSet(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expMS int64
+		submit := func(ctx context.Context) error {
+			expMS++
+			tx, err := buildPrePegInTx(issuanceContracts[1], s.initialBlock.Hash().Bytes(), nil, testRecipPubKey, 1, int64(bc.Millis(time.Now().Add(time.Hour)))+expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.submitTx(ctx, tx)
+			return err
+		}
+		// checkSigned checks that the latest block
+		// is validly signed by the given validators.
+		checkSigned := func(signers ...int) {
+			t.Helper()
+			b, err := chain.GetBlock(ctx, chain.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			prev, err := chain.GetBlock(ctx, b.Height-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = txproof.CheckSignatures(b, prev.NextPredicate)
+			if err != nil {
+				t.Fatalf("block %d: %s", b.Height, errors.Detail(err))
+			}
+			var got []int
+			for i, arg := range b.Arguments {
+				if sig, _ := arg.([]byte); len(sig) > 0 {
+					got = append(got, i)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(signers) {
+				t.Errorf("block %d is signed by validators %v, want %v", b.Height, got, signers)
+			}
+		}
+
+		// The first block sets the validator set,
+		// which signs the blocks after it.
+		err = submit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSigned()
+		err = submit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSigned(0, 1)
+
+		servers[0].Close()
+		err = submit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSigned(1, 2)
+
+		// Without a quorum, no block is committed.
+		servers[1].Close()
+		height := chain.Height()
+		shortCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		err = submit(shortCtx)
+		if err == nil {
+			t.Fatal("committed a block without a quorum")
+		}
+		if chain.Height() != height {
+			t.Fatalf("chain height %d, want %d", chain.Height(), height)
+		}
+
+		// The remaining validator signed that block
+		// and will not sign another at its height.
+		bb := protocol.NewBlockBuilder()
+		err = bb.Start(chain.State(), bc.Millis(time.Now())+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, _, err := bb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = nodes[2].Sign(ctx, &bc.Block{UnsignedBlock: ub})
+		if errors.Root(err) != validator.ErrConflict {
+			t.Errorf("signing a conflicting block: got error %v, want %s", err, validator.ErrConflict)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/oracle"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// oracle returns the oracle pricing assets in oracle.currency,
+// or nil if none is configured.
+// With oracle.source = "dex" the DEX is asked first,
+// falling back to oracle.rates,
+// in which the currency itself is worth 1.
+func (c *Custodian) oracle() oracle.Oracle {
+	cfg := c.config()
+	if cfg == nil || cfg.Oracle.Currency == "" {
+		return nil
+	}
+	rates, err := oracle.ParseRates(cfg.Oracle.Rates)
+	if err != nil {
+		// Validated on load.
+		rates = make(oracle.Static)
+	}
+	if ref, err := stellar.ParseAssetKey(cfg.Oracle.Currency); err == nil {
+		rates[stellar.AssetKey(ref)] = big.NewRat(1, 1)
+	}
+	if c.dex != nil {
+		return oracle.Fallback{c.dex, rates}
+	}
+	return rates
+}
+
+// pegValue is the worth of amount of the asset in oracle.currency.
+func (c *Custodian) pegValue(ctx context.Context, assetXDR []byte, amount int64) (int64, error) {
+	o := c.oracle()
+	if o == nil {
+		return 0, errors.WithDetail(oracle.ErrNoPrice, "no oracle.currency")
+	}
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return 0, errors.Wrap(err, "unmarshaling asset")
+	}
+	return oracle.Value(ctx, o, asset, amount)
+}
+
+// valuationEntry is an asset in the response to /admin/valuation.
+type valuationEntry struct {
+	Asset       string `json:"asset"`
+	Outstanding int64  `json:"outstanding"`
+	Value       *int64 `json:"value,omitempty"` // nil if the asset has no price
+	Error       string `json:"error,omitempty"`
+}
+
+// valuationResp is the response to /admin/valuation.
+type valuationResp struct {
+	Currency string           `json:"currency"`
+	Assets   []valuationEntry `json:"assets"`
+	Total    int64            `json:"total"` // of the assets with a price
+}
+
+// Valuation is the admin handler reporting the outstanding issuance
+// of each pegged-in asset and its worth in oracle.currency.
+func (c *Custodian) Valuation(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	cfg := c.config()
+	if cfg == nil || cfg.Oracle.Currency == "" {
+		net.Errorf(w, http.StatusNotFound, "valuation is not configured")
+		return
+	}
+	var assets [][]byte
+	const q = `SELECT DISTINCT asset_xdr FROM pegs WHERE state IN ($1, $2) ORDER BY asset_xdr`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegInPaid, pegInImported, func(assetXDR []byte) {
+		assets = append(assets, assetXDR)
+	})
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading pegged-in assets: %s", err)
+		return
+	}
+	resp := valuationResp{Currency: cfg.Oracle.Currency, Assets: []valuationEntry{}}
+	for _, assetXDR := range assets {
+		e := valuationEntry{Asset: assetName(assetXDR)}
+		e.Outstanding, err = c.outstandingIssuance(ctx, assetXDR, false)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		value, err := c.pegValue(ctx, assetXDR, e.Outstanding)
+		if err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Value = &value
+			resp.Total += value
+		}
+		resp.Assets = append(resp.Assets, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
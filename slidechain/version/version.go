@@ -0,0 +1,84 @@
+// Package version describes the running slidechain build.
+//
+// The go command stamps a binary built in a git checkout
+// with its commit and the commit's time,
+// which serves as the build time:
+// unlike the wall-clock time of the build,
+// it is the same each time the same commit is built,
+// so that a build with -trimpath and the same toolchain is reproducible.
+// The release version, and the commit and time of a build
+// made outside a checkout, are set at link time:
+//
+//	go build -trimpath -ldflags "-X github.com/interstellar/slingshot/slidechain/version.Version=v1.2.0" ./cmd/slidechaind
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// These are set at link time with -X.
+// Commit and BuildTime override the VCS stamp.
+var (
+	Version   = "dev"
+	Commit    string
+	BuildTime string // RFC 3339
+)
+
+// Info describes a build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built with uncommitted changes
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+
+	// Features lists the optional capabilities
+	// the running server's config enables.
+	Features []string `json:"features"`
+}
+
+// Get returns the Info of this binary,
+// with no Features.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if Commit == "" {
+				info.Commit = s.Value
+			}
+		case "vcs.time":
+			if BuildTime == "" {
+				info.BuildTime = s.Value
+			}
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// String is a one-line description of the build.
+func (info Info) String() string {
+	s := info.Version
+	if info.Commit != "" {
+		s += " " + info.Commit
+		if info.Modified {
+			s += "+modified"
+		}
+	}
+	if info.BuildTime != "" {
+		s += " " + info.BuildTime
+	}
+	return s + " " + info.GoVersion
+}
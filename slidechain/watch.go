@@ -1,96 +1,50 @@
 package slidechain
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"fmt"
 	"log"
 	"time"
 
-	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
-	"github.com/chain/txvm/protocol/txvm"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
 	i10rnet "github.com/interstellar/starlight/net"
-	"github.com/stellar/go/clients/horizon"
-	"github.com/stellar/go/xdr"
 )
 
+// duplicateDepositAlert is the kind of alert raised for a deposit
+// reusing the nonce of a peg-in that another deposit paid.
+const duplicateDepositAlert = "duplicate-deposit"
+
 // Runs as a goroutine until ctx is canceled.
 func (c *Custodian) watchPegIns(ctx context.Context) {
 	defer log.Println("watchPegIns exiting")
 	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
 
-	var cur horizon.Cursor
+	var cur string
 	err := c.DB.QueryRow("SELECT cursor FROM custodian").Scan(&cur)
 	if err != nil && err != sql.ErrNoRows {
 		log.Fatal(err)
 	}
 
 	for {
-		err := c.hclient.StreamTransactions(ctx, c.AccountID.Address(), &cur, func(tx horizon.Transaction) {
-			log.Printf("handling Stellar tx %s", tx.ID)
-
-			var env xdr.TransactionEnvelope
-			err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
-			if err != nil {
-				log.Fatal("error unmarshaling Stellar tx: ", err)
+		cur, err = c.chain.WatchDeposits(ctx, cur, func(d Deposit) error {
+			err := c.recordDeposit(ctx, d)
+			if scerrors.Is(err, scerrors.ErrDuplicateDeposit) {
+				log.Printf("ignoring deposit: %s", err)
+				return nil
 			}
-
-			if env.Tx.Memo.Type != xdr.MemoTypeMemoHash {
-				return
-			}
-
-			nonceHash := (*env.Tx.Memo.Hash)[:]
-			for _, op := range env.Tx.Operations {
-				if op.Body.Type != xdr.OperationTypePayment {
-					continue
-				}
-				payment := op.Body.PaymentOp
-				if !payment.Destination.Equals(c.AccountID) {
-					continue
-				}
-
-				// This operation is a payment to the custodian's account - i.e., a peg.
-				// We update the db to note that we saw this entry on the Stellar network.
-				// We also populate the amount and asset_xdr with the values in the Stellar tx.
-				assetXDR, err := payment.Asset.MarshalBinary()
-				if err != nil {
-					log.Fatalf("marshaling asset xdr: %s", err)
-					return
-				}
-				resulted, err := c.DB.ExecContext(ctx, `UPDATE pegs SET amount=$1, asset_xdr=$2, stellar_tx=1 WHERE nonce_hash=$3 AND stellar_tx=0`, payment.Amount, assetXDR, nonceHash)
-				if err != nil {
-					log.Fatalf("updating stellar_tx=1 for hash %x: %s", nonceHash, err)
-				}
-
-				// We confirm that only a single row was affected by the update query.
-				numAffected, err := resulted.RowsAffected()
-				if err != nil {
-					log.Fatalf("checking rows affected by update query for hash %x: %s", nonceHash, err)
-				}
-				if numAffected != 1 {
-					log.Fatalf("multiple rows affected by update query for hash %x", nonceHash)
-				}
-
-				// We update the cursor to avoid double-processing a transaction.
-				_, err = c.DB.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE seed=$2`, tx.PT, c.seed)
-				if err != nil {
-					log.Fatalf("updating cursor: %s", err)
-					return
-				}
-
-				// Wake up a goroutine that executes imports for not-yet-imported pegs.
-				log.Printf("broadcasting import for tx with nonce hash %x", nonceHash)
-				c.imports.Broadcast()
+			if err != nil {
+				log.Fatal(err)
 			}
+			return nil
 		})
 		if err == context.Canceled {
 			return
 		}
 		if err != nil {
-			log.Printf("error streaming from horizon: %s, retrying...", err)
+			log.Printf("error watching main chain deposits: %s, retrying...", err)
 		}
 		ch := make(chan struct{})
 		go func() {
@@ -105,64 +59,264 @@ func (c *Custodian) watchPegIns(ctx context.Context) {
 	}
 }
 
-// Runs as a goroutine.
-func (c *Custodian) watchExports(ctx context.Context) {
-	defer log.Println("watchExports exiting")
-
-	c.RunPin(ctx, "watchExports", func(ctx context.Context, b *bc.Block) error {
-		for _, tx := range b.Transactions {
-			// Check if the transaction has either expected length for an export tx.
-			// Confirm that its input, log, and output entries are as expected.
-			// If so, look for a specially formatted log ("L") entry
-			// that specifies the Stellar asset code to peg out and the Stellar recipient account ID.
-			if len(tx.Log) != 5 && len(tx.Log) != 7 {
-				continue
-			}
-			if tx.Log[0][0].(txvm.Bytes)[0] != txvm.InputCode {
-				continue
-			}
-			if tx.Log[1][0].(txvm.Bytes)[0] != txvm.LogCode {
-				continue
-			}
+// recordDeposit records a peg-in deposit on the main chain,
+// advances the watch cursor past it,
+// and wakes the importer.
+// Each deposit, an op of a main-chain tx, is handled once:
+// seen again, when watching resumes partway through a tx, it is skipped.
+// A deposit reusing the nonce of a peg-in already paid by another deposit
+// is not recorded:
+// it raises an alert, so that an operator can refund it,
+// and recordDeposit returns ErrDuplicateDeposit.
+// A deposit reusing a deposit nonce, or paying one after it expires,
+// is instead queued for refund to its sender,
+// as is one after the restore point of a rollback that pays no recorded peg-in.
+func (c *Custodian) recordDeposit(ctx context.Context, d Deposit) error {
+	recorded, err := c.depositRecorded(ctx, d)
+	if err != nil {
+		return err
+	}
+	if recorded {
+		log.Printf("skipping deposit in op %d of tx %s, already recorded", d.OpIndex, d.TxID)
+		return nil
+	}
+	paid, err := c.payPegIn(ctx, d)
+	if err != nil {
+		return err
+	}
+	err = c.recordDepositOp(ctx, d)
+	if err != nil {
+		return err
+	}
+	if !paid {
+		return nil
+	}
 
-			outputIndex := len(tx.Log) - 2
-			if tx.Log[outputIndex][0].(txvm.Bytes)[0] != txvm.OutputCode {
-				continue
-			}
+	// We update the cursor to avoid double-processing a transaction.
+	_, err = c.DB.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE seed=$2`, d.Cursor, c.seed)
+	if err != nil {
+		return errors.Wrap(err, "updating cursor")
+	}
 
-			exportSeedLogItem := tx.Log[len(tx.Log)-3]
-			if exportSeedLogItem[0].(txvm.Bytes)[0] != txvm.LogCode {
-				continue
-			}
-			if !bytes.Equal(exportSeedLogItem[1].(txvm.Bytes), exportContract1Seed[:]) {
-				continue
-			}
+	// Wake up a goroutine that executes imports for not-yet-imported pegs.
+	log.Printf("broadcasting import for tx with nonce hash %x", d.NonceHash)
+	c.imports.Broadcast()
+	return nil
+}
+
+// depositRecorded reports whether the op of deposit d has been recorded,
+// whichever peg-in it was taken to pay.
+func (c *Custodian) depositRecorded(ctx context.Context, d Deposit) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM deposit_ops WHERE deposit_txid=$1 AND op_index=$2`, d.TxID, d.OpIndex).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking for op %d of tx %s", d.OpIndex, d.TxID)
+	}
+	return n > 0, nil
+}
+
+// recordDepositOp records that the op of deposit d has been handled.
+func (c *Custodian) recordDepositOp(ctx context.Context, d Deposit) error {
+	const q = `INSERT OR IGNORE INTO deposit_ops (deposit_txid, op_index, nonce_hash, recorded_ms) VALUES ($1, $2, $3, $4)`
+	_, err := c.DB.ExecContext(ctx, q, d.TxID, d.OpIndex, d.NonceHash, c.nowMS())
+	return errors.Wrapf(err, "recording op %d of tx %s", d.OpIndex, d.TxID)
+}
+
+// paymentNonceHash returns the nonce hash of the peg-in
+// paid by payment k, counting from 0,
+// of the payments to the custodian in a Stellar tx with the given memo.
+// The first pays the peg-in named by the memo,
+// and payment k the one /prepegin bound to it in that peg-in's batch,
+// so that one tx can pay several peg-ins, for any recipients.
+// If there is no such peg-in, payment k pays the one named by the memo,
+// as a deposit reusing its nonce, and is refunded.
+func (c *Custodian) paymentNonceHash(ctx context.Context, memo []byte, k int) ([]byte, error) {
+	if k == 0 {
+		return memo, nil
+	}
+	var nonceHash []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT nonce_hash FROM peg_batches WHERE lead_nonce_hash=$1 AND payment=$2`, memo, k).Scan(&nonceHash)
+	if err == sql.ErrNoRows {
+		return memo, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading payment %d of peg-in %x", k, memo)
+	}
+	return nonceHash, nil
+}
+
+// payPegIn marks the recorded peg-in the deposit d pays as paid,
+// reporting false if d pays none.
+// It returns ErrDuplicateDeposit as recordDeposit does.
+func (c *Custodian) payPegIn(ctx context.Context, d Deposit) (bool, error) {
+	reason, err := c.depositRefundReason(ctx, d)
+	if err != nil {
+		return false, err
+	}
+	if reason == "" && c.assetsConfig().CapAction == "refund" {
+		over, err := c.overPegCap(ctx, d)
+		if err != nil {
+			return false, err
+		}
+		if over {
+			reason = "cap"
+		}
+	}
+	if reason != "" {
+		return false, c.queueRefund(ctx, d, reason)
+	}
+
+	// We update the db to note that we saw this deposit on the main chain.
+	// We also populate the amount and asset_xdr with the values in the deposit.
+	// The deposit's tx, cursor, and op index are kept so that it can be verified again later
+	// and its import tx derived from it.
+	const q = `UPDATE pegs SET amount=$1, asset_xdr=$2, deposit_txid=$3, deposit_cursor=$4, deposit_op=$5 WHERE nonce_hash=$6 AND state=$7`
+	resulted, err := c.DB.ExecContext(ctx, q, d.Amount, d.Asset, d.TxID, d.Cursor, d.OpIndex, d.NonceHash, pegInRecorded)
+	if err != nil {
+		return false, errors.Wrapf(err, "updating amount for hash %x", d.NonceHash)
+	}
 
-			exportDataInfoItem := tx.Log[1]
-			var info pegOut
-			err := json.Unmarshal(exportDataInfoItem[2].(txvm.Bytes), &info)
+	// We confirm that only a single row was affected by the update query.
+	// A deposit whose nonce hash matches no recorded peg is not a peg-in:
+	// anyone can pay the custodian with any memo.
+	numAffected, err := resulted.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected by update query for hash %x", d.NonceHash)
+	}
+	if numAffected == 0 {
+		var otherTxID string
+		const q = `SELECT deposit_txid FROM pegs WHERE nonce_hash=$1 AND deposit_txid IS NOT NULL AND deposit_txid != $2`
+		err = c.DB.QueryRowContext(ctx, q, d.NonceHash, d.TxID).Scan(&otherTxID)
+		if err == nil {
+			key := []byte(fmt.Sprintf("%s %x", d.TxID, d.NonceHash))
+			detail := fmt.Sprintf("deposit of %d %s in tx %s reuses the nonce hash %x of the peg-in paid in tx %s; refund it by hand", d.Amount, assetName(d.Asset), d.TxID, d.NonceHash, otherTxID)
+			alerted, err := c.alerted(ctx, duplicateDepositAlert, key)
 			if err != nil {
-				continue
+				return false, err
+			}
+			if !alerted {
+				err = c.alert(ctx, duplicateDepositAlert, key, detail)
+				if err != nil {
+					return false, err
+				}
 			}
-			exportedAssetBytes := txvm.AssetID(importIssuanceSeed[:], info.AssetXDR)
-
-			// Record the export in the db,
-			// then wake up a goroutine that executes peg-outs on the main chain.
-			const q = `
-				INSERT INTO exports 
-				(txid, exporter, amount, asset_xdr, temp_addr, seqnum, anchor, pubkey)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-			_, err = c.DB.ExecContext(ctx, q, tx.ID.Bytes(), info.Exporter, info.Amount, info.AssetXDR, info.TempAddr, info.Seqnum, info.Anchor, info.Pubkey)
+			return false, errors.Wrapf(scerrors.ErrDuplicateDeposit, "tx %s with nonce hash %x, paid in tx %s", d.TxID, d.NonceHash, otherTxID)
+		}
+		if err != sql.ErrNoRows {
+			return false, errors.Wrapf(err, "checking for earlier deposit with hash %x", d.NonceHash)
+		}
+		cutoff, err := c.lostPegInCutoff(ctx)
+		if err != nil {
+			return false, err
+		}
+		if cutoff > 0 && d.TimeMS > cutoff {
+			// The peg-in it pays may have been recorded
+			// in blocks invalidated by a rollback.
+			return false, c.queueRefund(ctx, d, "lost")
+		}
+		log.Printf("no pending peg for deposit in tx %s with nonce hash %x, ignoring", d.TxID, d.NonceHash)
+		return false, nil
+	}
+	if numAffected != 1 {
+		return false, fmt.Errorf("multiple rows affected by update query for hash %x", d.NonceHash)
+	}
+	ok, err := c.transitionPegIn(ctx, d.NonceHash, pegInRecorded, pegInPaid)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("peg-in %x is no longer in state %s", d.NonceHash, pegInRecorded)
+	}
+	return true, nil
+}
+
+// recordExports records the export txs in b
+// and wakes the peg-out goroutine if there are any.
+// Those already recorded are skipped.
+func (c *Custodian) recordExports(ctx context.Context, b *bc.Block) error {
+	for _, tx := range b.Transactions {
+		recorded, err := c.exportRecorded(ctx, tx.ID.Bytes())
+		if err != nil {
+			return err
+		}
+		if recorded {
+			continue
+		}
+		info, err := exportFromLog(tx.Log, c.chain)
+		if err != nil {
+			log.Printf("skipping malformed export tx %x: %s", tx.ID.Bytes(), err)
+			continue
+		}
+		if info == nil {
+			err = c.recordWrapExport(ctx, tx)
 			if err != nil {
-				return errors.Wrapf(err, "recording export tx %x", tx.ID.Bytes())
+				return err
 			}
+			continue
+		}
+		info.IssuanceVersion = exportIssuanceVersion(tx, info.AssetXDR)
+		if info.IssuanceVersion == 0 {
+			log.Printf("skipping export tx %x: its value is not of an imported asset", tx.ID.Bytes())
+			continue
+		}
+		exportedAssetBytes := issuanceContracts[info.IssuanceVersion].assetID(info.AssetXDR).Bytes()
 
-			log.Printf("recorded export: %d of txvm asset %x (Stellar %x) for %s in tx %x", info.Amount, exportedAssetBytes, info.AssetXDR, info.Exporter, tx.ID.Bytes())
+		// Record the export in the db,
+		// then wake up a goroutine that executes peg-outs on the main chain.
+		err = c.insertExport(ctx, tx.ID.Bytes(), info, nil)
+		if err != nil {
+			return err
+		}
 
-			c.exports.Broadcast()
+		log.Printf("recorded export: %d of txvm asset %x (main chain %x) for %s in tx %x", info.Amount, exportedAssetBytes, info.AssetXDR, info.Exporter, tx.ID.Bytes())
+
+		c.exports.Broadcast()
+	}
+	return nil
+}
+
+// insertExport records an export,
+// with its reserve output if it is a wrapped export,
+// attributed to the partner of its exporter's latest attributed peg-in.
+func (c *Custodian) insertExport(ctx context.Context, txid []byte, info *pegOut, reserve *reserveOutput) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const q = `
+		INSERT INTO exports 
+		(txid, exporter, amount, asset_xdr, temp_addr, seqnum, anchor, pubkey, pegged_out, issuance_version, min_time, max_time, min_ledger, max_ledger, min_seq_age, destination, memo_type, memo, federation, nettable, watcher, challenge_ms, challenge_until_ms, partner)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23,
+			COALESCE((SELECT partner FROM pegs WHERE recipient_pubkey=$8 AND partner != '' ORDER BY nonce_expms DESC LIMIT 1), ''))`
+	version := info.IssuanceVersion
+	if version == 0 {
+		version = 1
+	}
+	var until int64
+	if len(info.Watcher) > 0 {
+		until = c.nowMS() + info.ChallengeMS
+	}
+	watcher := info.Watcher
+	if watcher == nil {
+		watcher = []byte{}
+	}
+	_, err = dbtx.ExecContext(ctx, q, txid, info.Exporter, info.Amount, info.AssetXDR, info.TempAddr, info.Seqnum, info.Anchor, info.Pubkey, pegOutNotYet, version, info.MinTime, info.MaxTime, info.MinLedger, info.MaxLedger, info.MinSeqAge, info.Destination.Account, info.MemoType, info.Memo, info.Federation, info.Nettable, watcher, info.ChallengeMS, until)
+	if err != nil {
+		return errors.Wrapf(err, "recording export tx %x", txid)
+	}
+	err = recordStateEvent(ctx, dbtx, c.nowMS(), "export", txid, "", pegOutNotYet.String())
+	if err != nil {
+		return err
+	}
+	if reserve != nil {
+		err = insertReserve(ctx, dbtx, reserve, txid)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing export tx %x", txid)
 }
 
 // Runs as a goroutine.
@@ -176,41 +330,37 @@ func (c *Custodian) watchPegOuts(ctx context.Context, pegouts <-chan pegOut) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			const q = `SELECT amount, asset_xdr, exporter, temp_addr, seqnum, anchor, pubkey FROM exports WHERE pegged_out IN ($1, $2)`
-			var (
-				txids, anchors, assetXDRs, pubkeys [][]byte
-				amounts, seqnums                   []int64
-				exporters, tempAddrs               []string
-				peggedOuts                         []pegOutState
-			)
-			err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutOK, pegOutFail, func(txid []byte, amount int64, assetXDR []byte, exporter, tempAddr string, seqnum, peggedOut int64, anchor, pubkey []byte) {
-				txids = append(txids, txid)
-				amounts = append(amounts, amount)
-				assetXDRs = append(assetXDRs, assetXDR)
-				exporters = append(exporters, exporter)
-				tempAddrs = append(tempAddrs, tempAddr)
-				seqnums = append(seqnums, seqnum)
-				peggedOuts = append(peggedOuts, pegOutState(peggedOut))
-				anchors = append(anchors, anchor)
-				pubkeys = append(pubkeys, pubkey)
-			})
-			if err != nil {
-				log.Fatalf("querying peg-outs: %s", err)
-			}
-			for i, txid := range txids {
-				err = c.doPostPegOut(ctx, assetXDRs[i], anchors[i], txid, amounts[i], seqnums[i], peggedOuts[i], exporters[i], tempAddrs[i], pubkeys[i])
-				if err != nil {
-					log.Fatalf("doing post-peg-out: %s", err)
-				}
+			err := c.postPegOutPending(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Fatal(err)
 			}
 		case p, ok := <-pegouts:
 			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
 				log.Fatalf("peg-outs channel closed")
 			}
-			err := c.doPostPegOut(ctx, p.AssetXDR, p.Anchor, p.TxID, p.Amount, p.Seqnum, p.State, p.Exporter, p.TempAddr, p.Pubkey)
-			if err != nil {
+			err := c.doPostPegOut(ctx, &p)
+			if err != nil && ctx.Err() == nil {
 				log.Fatalf("doing post-peg-out: %s", err)
 			}
 		}
 	}
 }
+
+// postPegOutPending retires or refunds the exports
+// whose peg-outs have succeeded or failed.
+func (c *Custodian) postPegOutPending(ctx context.Context) error {
+	ps, err := c.queryExports(ctx, `FROM exports e WHERE e.pegged_out IN ($1, $2)`, pegOutOK, pegOutFail)
+	if err != nil {
+		return errors.Wrap(err, "querying peg-outs")
+	}
+	for i := range ps {
+		err = c.doPostPegOut(ctx, &ps[i])
+		if err != nil {
+			return errors.Wrap(err, "doing post-peg-out")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,589 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	scerrors "github.com/interstellar/slingshot/slidechain/errors"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+)
+
+func TestDuplicateDeposit(t *testing.T) {
+	ctx := context.Background()
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Custodian{DB: db, imports: sync.NewCond(new(sync.Mutex))}
+		assetXDR, err := stellar.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonceHash := uniqueNonceHash(bc.NewHash([32]byte{}).Bytes(), 1)
+		err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deposit := Deposit{TxID: "deposit", NonceHash: nonceHash[:], Asset: assetXDR, Amount: 10}
+		for i := 0; i < 2; i++ {
+			// Seeing the same deposit again is not a duplicate.
+			err = c.recordDeposit(ctx, deposit)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		deposit.TxID = "again"
+		err = c.recordDeposit(ctx, deposit)
+		if !scerrors.Is(err, scerrors.ErrDuplicateDeposit) {
+			t.Fatalf("got error %v, want ErrDuplicateDeposit", err)
+		}
+		if got := scerrors.Status(err); got != http.StatusConflict {
+			t.Errorf("got status %d for %s, want %d", got, err, http.StatusConflict)
+		}
+		alerted, err := c.alerted(ctx, duplicateDepositAlert, []byte(fmt.Sprintf("again %x", nonceHash[:])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !alerted {
+			t.Error("no alert for duplicate deposit")
+		}
+	})
+}
+
+func TestMultiPaymentDeposit(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+	otherKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(otherKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+
+		// Alice records a batch of two peg-ins,
+		// one tx to pay both,
+		// and bob records a peg-in whose nonce expires between them.
+		alice := []PrePegIn{
+			{RecipPubkey: testRecipPubKey, ExpMS: 1000},
+			{RecipPubkey: testRecipPubKey, ExpMS: 1002},
+		}
+		nonceHashes, err := c.insertPegInBatch(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobNonce := uniqueNonceHash(c.InitBlockHash.Bytes(), 1001)
+		err = c.insertPegIn(ctx, bobNonce[:], bytes.Repeat([]byte{2}, 32), 1001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var memo stellar.MemoHash
+		copy(memo[:], nonceHashes[0])
+		_, err = stellar.NewSequencer(srv.Client()).Submit(payerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  payerKP.Address(),
+				SeqNum:  seqnum,
+				Memo:    memo,
+				Ops: []stellar.Op{
+					stellar.Payment{Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 10},
+					stellar.Payment{Destination: otherKP.Address(), Asset: stellar.NativeAsset(), Amount: 15},
+					stellar.Payment{Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 20},
+				},
+			}, nil
+		}, payerKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The watcher stops after recording the first payment,
+		// as if the custodian had crashed, and then resumes from its cursor.
+		errStop := errors.New("stop")
+		var deposits []Deposit
+		_, err = sc.WatchDeposits(ctx, "", func(d Deposit) error {
+			deposits = append(deposits, d)
+			err := c.recordDeposit(ctx, d)
+			if err != nil {
+				return err
+			}
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("got error %v watching deposits, want %s", err, errStop)
+		}
+		var cur string
+		err = db.QueryRow(`SELECT cursor FROM custodian`).Scan(&cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = sc.WatchDeposits(ctx, cur, func(d Deposit) error {
+			deposits = append(deposits, d)
+			err := c.recordDeposit(ctx, d)
+			if err != nil {
+				return err
+			}
+			if d.OpIndex == 2 {
+				return errStop
+			}
+			return nil
+		})
+		if err != errStop {
+			t.Fatalf("got error %v resuming watching deposits, want %s", err, errStop)
+		}
+		txs := srv.AccountTransactions(custKP.Address(), "")
+		if len(txs) == 0 {
+			t.Fatal("no custodian txs")
+		}
+		last := txs[len(txs)-1].PT
+		if len(deposits) != 3 || deposits[0].OpIndex != 0 || deposits[1].OpIndex != 0 || deposits[2].OpIndex != 2 {
+			t.Fatalf("got deposits %+v, want ops 0, 0 again, and 2", deposits)
+		}
+		if deposits[0].Cursor == last || deposits[2].Cursor != last {
+			t.Errorf("got deposit cursors %q and %q, want the first before %q", deposits[0].Cursor, deposits[2].Cursor, last)
+		}
+
+		// Each payment pays alice's peg-ins, once;
+		// bob's is left alone.
+		for _, d := range deposits {
+			err = c.recordDeposit(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rep := new(BackfillReport)
+			err = c.backfillDeposit(ctx, d, rep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Known != 1 {
+				t.Errorf("backfill of op %d: got report %+v, want it known", d.OpIndex, rep)
+			}
+		}
+		for i, want := range []int64{10, 20} {
+			var (
+				amount int64
+				state  pegInState
+			)
+			err = db.QueryRow(`SELECT amount, state FROM pegs WHERE nonce_hash=$1`, nonceHashes[i]).Scan(&amount, &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if amount != want || state != pegInPaid {
+				t.Errorf("peg-in %d: got %d in state %s, want %d paid", i, amount, state, want)
+			}
+		}
+		var bobState pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, bobNonce[:]).Scan(&bobState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bobState != pegInRecorded {
+			t.Errorf("got bob's peg-in in state %s, want recorded", bobState)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM deposit_ops`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %d recorded deposit ops, want 2", n)
+		}
+	})
+}
+
+func TestUnboundPaymentRefunded(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+	otherKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(otherKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), 1000)
+		err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Three payments with the peg-in's memo and no batch,
+		// the last made by another account than the tx's source.
+		_, err = stellar.NewSequencer(srv.Client()).Submit(payerKP.Address(), func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+			return &stellar.Tx{
+				Network: srv.Passphrase,
+				Source:  payerKP.Address(),
+				SeqNum:  seqnum,
+				Memo:    stellar.MemoHash(nonceHash),
+				Ops: []stellar.Op{
+					stellar.Payment{Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 10},
+					stellar.Payment{Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 20},
+					stellar.Payment{Source: otherKP.Address(), Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 30},
+				},
+			}, nil
+		}, payerKP.Seed(), otherKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		errStop := errors.New("stop")
+		_, err = sc.WatchDeposits(ctx, "", func(d Deposit) error {
+			err := c.recordDeposit(ctx, d)
+			if err != nil {
+				return err
+			}
+			if d.OpIndex == 2 {
+				return errStop
+			}
+			return nil
+		})
+		if err != errStop {
+			t.Fatalf("got error %v watching deposits, want %s", err, errStop)
+		}
+
+		var amount int64
+		err = db.QueryRow(`SELECT amount FROM pegs WHERE nonce_hash=$1`, nonceHash[:]).Scan(&amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amount != 10 {
+			t.Errorf("peg-in paid %d, want the first payment's 10", amount)
+		}
+		// Both refunds are kept, though they are of one asset in one tx.
+		// Each goes to the account that made its payment.
+		refunded := make(map[int]int64)
+		err = sqlutil.ForQueryRows(ctx, db, `SELECT op_index, reason, sender, amount FROM deposit_refunds`, func(op int, reason, sender string, amount int64) {
+			payer := payerKP.Address()
+			if op == 2 {
+				payer = otherKP.Address()
+			}
+			if reason != "reused" || sender != payer {
+				t.Errorf("got refund of op %d to %s for %q, want to %s for reused", op, sender, reason, payer)
+			}
+			refunded[op] = amount
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refunded) != 2 || refunded[1] != 20 || refunded[2] != 30 {
+			t.Errorf("got refunds %v by op, want 20 for op 1 and 30 for op 2", refunded)
+		}
+	})
+}
+
+func TestContractDeposit(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), 1000)
+		err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A contract wallet pays the custodian through the lumens' asset contract.
+		const wallet = "CDLZFC3SYJYDZT7K67VZ75HPJVIEUVNIXF47ZG2FB2RMQQVU2HHGCYSC"
+		_, err = srv.ContractTransfer(payerKP.Address(), wallet, custKP.Address(), stellar.NativeAsset(), 30, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errStop := errors.New("stop")
+		var d Deposit
+		_, err = sc.WatchDeposits(ctx, "", func(got Deposit) error {
+			d = got
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("got error %v watching deposits, want %s", err, errStop)
+		}
+		if !bytes.Equal(d.NonceHash, nonceHash[:]) || d.Amount != 30 || d.Sender != "" {
+			t.Errorf("got deposit of %d with nonce hash %x from %q, want 30 with %x from no account", d.Amount, d.NonceHash, d.Sender, nonceHash[:])
+		}
+		ok, err := sc.VerifyDeposit(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("contract deposit not verified")
+		}
+		err = c.recordDeposit(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash[:]).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegInPaid {
+			t.Errorf("got peg-in state %s, want %s", state, pegInPaid)
+		}
+	})
+}
+
+func TestFutureEnvelopeDeposit(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	hclient := srv.Client()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, hclient, cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), 1000)
+		err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A wallet pays the custodian in a tx of a later protocol,
+		// after setting its home domain in the same tx.
+		seqnum, err := hclient.SequenceForAccount(payerKP.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		homeDomain := "example.com"
+		tx := &stellar.Tx{
+			Network: srv.Passphrase,
+			Source:  payerKP.Address(),
+			SeqNum:  seqnum + 1,
+			Memo:    stellar.MemoHash(nonceHash),
+			Ops: []stellar.Op{
+				stellar.SetOptions{HomeDomain: &homeDomain},
+				stellar.Payment{Destination: custKP.Address(), Asset: stellar.NativeAsset(), Amount: 30},
+			},
+		}
+		env, err := tx.Sign(payerKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		future, err := horizonmock.FutureEnvelope(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = hclient.SubmitTransaction(future)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := pegInPayments(future, sc.account); err == nil {
+			t.Fatal("decoded an envelope of a later protocol")
+		}
+
+		errStop := errors.New("stop")
+		var d Deposit
+		_, err = sc.WatchDeposits(ctx, "", func(got Deposit) error {
+			d = got
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("got error %v watching deposits, want %s", err, errStop)
+		}
+		if !bytes.Equal(d.NonceHash, nonceHash[:]) || d.Amount != 30 || d.OpIndex != 1 || d.Sender != payerKP.Address() {
+			t.Errorf("got deposit of %d in op %d with nonce hash %x from %q, want 30 in op 1 with %x from the payer", d.Amount, d.OpIndex, d.NonceHash, d.Sender, nonceHash[:])
+		}
+		ok, err := sc.VerifyDeposit(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("deposit in a later protocol not verified")
+		}
+		err = c.recordDeposit(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state pegInState
+		err = db.QueryRow(`SELECT state FROM pegs WHERE nonce_hash=$1`, nonceHash[:]).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegInPaid {
+			t.Errorf("got peg-in state %s, want %s", state, pegInPaid)
+		}
+	})
+}
+
+func TestMuxedDeposit(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+	hclient := srv.Client()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	payerKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(payerKP.Address(), horizonmock.FriendbotAmount)
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, hclient, cfg, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), 1000)
+		err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An exchange pays a muxed account of the custodian
+		// from the muxed account of one of its users.
+		from, err := stellar.MuxedAddress(payerKP.Address(), 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to, err := stellar.MuxedAddress(custKP.Address(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqnum, err := hclient.SequenceForAccount(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := &stellar.Tx{
+			Network: srv.Passphrase,
+			Source:  from,
+			SeqNum:  seqnum + 1,
+			Memo:    stellar.MemoHash(nonceHash),
+			Ops: []stellar.Op{
+				stellar.Payment{Destination: to, Asset: stellar.NativeAsset(), Amount: 30},
+			},
+		}
+		env, err := tx.Sign(payerKP.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = hclient.SubmitTransaction(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errStop := errors.New("stop")
+		var d Deposit
+		_, err = sc.WatchDeposits(ctx, "", func(got Deposit) error {
+			d = got
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("got error %v watching deposits, want %s", err, errStop)
+		}
+		if !bytes.Equal(d.NonceHash, nonceHash[:]) || d.Amount != 30 || d.Sender != from {
+			t.Errorf("got deposit of %d with nonce hash %x from %q, want 30 with %x from %q", d.Amount, d.NonceHash, d.Sender, nonceHash[:], from)
+		}
+		ok, err := sc.VerifyDeposit(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("muxed deposit not verified")
+		}
+	})
+}
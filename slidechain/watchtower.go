@@ -0,0 +1,680 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/golang/protobuf/proto"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	i10rnet "github.com/interstellar/starlight/net"
+	"github.com/stellar/go/strkey"
+)
+
+// The kinds of evidence a watchtower publishes.
+const (
+	// evidenceIssuance is an import issuance
+	// that no deposit to the custodian pays.
+	evidenceIssuance = "unbacked-issuance"
+
+	// evidencePegOut is an export
+	// neither pegged out nor refunded within the watchtower's SLA.
+	evidencePegOut = "late-peg-out"
+)
+
+// towerPoll is how often a watchtower checks
+// the imports and exports it has not yet settled.
+const towerPoll = 30 * time.Second
+
+// Watchtower independently checks a custodian's conduct
+// against the public record of both chains:
+// the deposits to the custodian account on Stellar,
+// and the import and export txs on slidechain.
+// It publishes signed Evidence of an import issuance
+// that no deposit pays,
+// and of an export whose value is neither pegged out on Stellar
+// nor refunded on slidechain within its SLA.
+// It needs nothing from the custodian but its blocks,
+// which it may get as well from a follower.
+type Watchtower struct {
+	// SLA is how long an export may await its peg-out or refund,
+	// after its block and any escrow challenge period.
+	SLA time.Duration
+
+	// Grace is how long an import may await
+	// the watchtower's sight of its deposit,
+	// as when Horizon lags slidechain.
+	Grace time.Duration
+
+	// WebhookURL, if set, is sent each piece of evidence
+	// as an alert of its kind.
+	WebhookURL string
+
+	// ClaimFraud submits each unbacked issuance
+	// to the slidechaind as a fraud claim,
+	// pausing the peg if the custodian finds it valid.
+	ClaimFraud bool
+
+	db          *sql.DB
+	chain       *stellarChain
+	slidechaind string
+	bcid        bc.Hash
+	key         ed25519.PrivateKey
+	now         func() time.Time // nil means time.Now
+}
+
+// NewWatchtower returns a Watchtower of the custodian account at custodian
+// on the Stellar network of hclient,
+// and of the chain with initial block bcid
+// served by the slidechaind at the base URL slidechaind,
+// storing what it has seen in db
+// and signing its evidence with key.
+func NewWatchtower(ctx context.Context, db *sql.DB, hclient stellar.Client, custodian, slidechaind string, bcid bc.Hash, key ed25519.PrivateKey) (*Watchtower, error) {
+	err := setSchema(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "setting db schema")
+	}
+	_, err = strkey.Decode(strkey.VersionByteAccountID, custodian)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing custodian address %q", custodian)
+	}
+	root, err := hclient.Root()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting horizon client root")
+	}
+	_, err = db.Exec(`INSERT INTO tower (cursor, height, block_hash) SELECT '', 0, x'' WHERE NOT EXISTS (SELECT 1 FROM tower)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "storing watchtower row")
+	}
+	return &Watchtower{
+		SLA:         time.Hour,
+		Grace:       10 * time.Minute,
+		db:          db,
+		chain:       newStellarChain(hclient, custodian, "", root.NetworkPassphrase),
+		slidechaind: strings.TrimRight(slidechaind, "/"),
+		bcid:        bcid,
+		key:         key,
+	}, nil
+}
+
+// Pubkey returns the key that verifies the watchtower's evidence.
+func (w *Watchtower) Pubkey() ed25519.PublicKey {
+	return w.key.Public().(ed25519.PublicKey)
+}
+
+func (w *Watchtower) nowMS() int64 {
+	now := time.Now
+	if w.now != nil {
+		now = w.now
+	}
+	return int64(bc.Millis(now()))
+}
+
+// Run watches both chains and checks what it sees
+// until ctx is canceled.
+func (w *Watchtower) Run(ctx context.Context) {
+	go w.watchDeposits(ctx)
+	go w.followChain(ctx)
+
+	ticker := time.NewTicker(towerPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.check(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("error checking imports and exports: %s", err)
+		}
+	}
+}
+
+// watchDeposits records the deposits to the custodian account
+// until ctx is canceled.
+func (w *Watchtower) watchDeposits(ctx context.Context) {
+	defer log.Println("watchDeposits exiting")
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+
+	var cur string
+	err := w.db.QueryRow(`SELECT cursor FROM tower`).Scan(&cur)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		cur, err = w.chain.WatchDeposits(ctx, cur, func(d Deposit) error {
+			return w.recordDeposit(ctx, d)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("error watching deposits: %s, retrying...", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// recordDeposit records d, if it is new,
+// and advances the deposit cursor past it.
+func (w *Watchtower) recordDeposit(ctx context.Context, d Deposit) error {
+	dbtx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	timeMS := d.TimeMS
+	if timeMS == 0 {
+		timeMS = w.nowMS()
+	}
+	const q = `INSERT OR IGNORE INTO tower_deposits (txid, op_index, asset_xdr, amount, time_ms) VALUES ($1, $2, $3, $4, $5)`
+	_, err = dbtx.ExecContext(ctx, q, d.TxID, d.OpIndex, d.Asset, d.Amount, timeMS)
+	if err != nil {
+		return errors.Wrapf(err, "recording op %d of deposit tx %s", d.OpIndex, d.TxID)
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE tower SET cursor=$1`, d.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "advancing deposit cursor")
+	}
+	return errors.Wrap(dbtx.Commit(), "committing deposit")
+}
+
+// followChain scans each slidechain block in turn
+// until ctx is canceled.
+func (w *Watchtower) followChain(ctx context.Context) {
+	defer log.Println("followChain exiting")
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+
+	for {
+		var (
+			height uint64
+			hash   []byte
+		)
+		err := w.db.QueryRowContext(ctx, `SELECT height, block_hash FROM tower`).Scan(&height, &hash)
+		if err == nil {
+			var b *bc.Block
+			b, err = fetchBlock(ctx, w.slidechaind, height+1)
+			if err == nil {
+				err = w.scanBlock(ctx, b, hash)
+			}
+			if err == nil {
+				backoff = i10rnet.Backoff{Base: 100 * time.Millisecond}
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("error following slidechain at height %d: %s, retrying...", height+1, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// scanBlock records the imports and exports in b,
+// and the spends of recorded exports,
+// checking that b follows the block with hash prev.
+func (w *Watchtower) scanBlock(ctx context.Context, b *bc.Block, prev []byte) error {
+	if b.Height == 1 {
+		if b.Hash() != w.bcid {
+			return fmt.Errorf("initial block is %x, not %x", b.Hash().Bytes(), w.bcid.Bytes())
+		}
+	} else if b.PreviousBlockId == nil || !bytes.Equal(b.PreviousBlockId.Bytes(), prev) {
+		return fmt.Errorf("block %d does not follow the block scanned before it", b.Height)
+	}
+	dbtx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	for _, tx := range b.Transactions {
+		err = w.scanTx(ctx, dbtx, b, tx)
+		if err != nil {
+			return errors.Wrapf(err, "scanning tx %x", tx.ID.Bytes())
+		}
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE tower SET height=$1, block_hash=$2`, b.Height, b.Hash().Bytes())
+	if err != nil {
+		return errors.Wrap(err, "advancing watchtower height")
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing block %d", b.Height)
+}
+
+// scanTx records the imports and export in tx, of block b,
+// and the spends of recorded exports.
+func (w *Watchtower) scanTx(ctx context.Context, dbtx *sql.Tx, b *bc.Block, tx *bc.Tx) error {
+	var rawTx []byte
+	retiring := len(tx.Retirements) > 0
+	for i, in := range tx.Inputs {
+		_, err := dbtx.ExecContext(ctx, `UPDATE tower_exports SET spent_txid=$1, retired=$2 WHERE output_id=$3 AND spent_txid IS NULL`, tx.ID.Bytes(), retiring, in.ID.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "recording export spend")
+		}
+		imp, ok := importFromInput(tx, in)
+		if !ok {
+			continue
+		}
+		if rawTx == nil {
+			rawTx, err = proto.Marshal(&tx.RawTx)
+			if err != nil {
+				return errors.Wrap(err, "serializing tx")
+			}
+		}
+		const q = `INSERT OR IGNORE INTO tower_imports (txid, input, asset_xdr, amount, recipient, ref, height, time_ms, tx) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		_, err = dbtx.ExecContext(ctx, q, tx.ID.Bytes(), i, imp.AssetXDR, imp.Amount, imp.Recipient, imp.Ref, b.Height, b.TimestampMs, rawTx)
+		if err != nil {
+			return errors.Wrap(err, "recording import")
+		}
+	}
+
+	p, err := exportFromLog(tx.Log, w.chain)
+	if err != nil || p == nil {
+		return nil
+	}
+	if exportIssuanceVersion(tx, p.AssetXDR) == 0 {
+		return nil
+	}
+	var outputID []byte
+	for _, out := range tx.Outputs {
+		if out.Seed.Byte32() == exportContract1Seed {
+			outputID = out.ID.Bytes()
+		}
+	}
+	refdata, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "marshaling export")
+	}
+	due := int64(b.TimestampMs) + p.ChallengeMS + int64(w.SLA/time.Millisecond)
+	const q = `INSERT OR IGNORE INTO tower_exports (txid, output_id, refdata, height, due_ms) VALUES ($1, $2, $3, $4, $5)`
+	_, err = dbtx.ExecContext(ctx, q, tx.ID.Bytes(), outputID, refdata, b.Height, due)
+	return errors.Wrap(err, "recording export")
+}
+
+// towerImport is an import issuance seen by a watchtower.
+type towerImport struct {
+	AssetXDR  []byte
+	Amount    int64
+	Recipient []byte
+	Ref       []byte // from depositRef, if any
+}
+
+// importFromInput recognizes the peg-in token consumed by an import tx,
+// returning what the import issues
+// and the reference data of its payment to the recipient.
+func importFromInput(tx *bc.Tx, in bc.Input) (*towerImport, bool) {
+	// The token's stack is {'Z', 1}, {'T', {recip}}, {'V', 0, zeroseed, anchor}, {'Z', amount}, {'S', assetXDR}.
+	var ic *issuanceContract
+	for _, candidate := range issuanceContracts {
+		if in.Seed.Byte32() == candidate.createTokenSeed {
+			ic = candidate
+		}
+	}
+	if ic == nil || len(in.Stack) != 5 {
+		return nil, false
+	}
+	signers, ok1 := snapshotItem(in.Stack[1], txvm.TupleCode, 2)
+	amount, ok2 := snapshotItem(in.Stack[3], txvm.IntCode, 2)
+	asset, ok3 := snapshotItem(in.Stack[4], txvm.BytesCode, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, false
+	}
+	recips, ok1 := signers[1].(txvm.Tuple)
+	n, ok2 := amount[1].(txvm.Int)
+	assetXDR, ok3 := asset[1].(txvm.Bytes)
+	if !ok1 || !ok2 || !ok3 || len(recips) != 1 {
+		return nil, false
+	}
+	recip, ok := recips[0].(txvm.Bytes)
+	if !ok {
+		return nil, false
+	}
+	imp := &towerImport{AssetXDR: assetXDR, Amount: int64(n), Recipient: recip}
+	assetID := ic.assetID(assetXDR).Bytes()
+	for _, out := range tx.Outputs {
+		m, ok := multisigFromOutput(out)
+		if !ok || m.Amount != imp.Amount || !bytes.Equal(m.AssetID, assetID) || len(m.Pubkeys) != 1 || !bytes.Equal(m.Pubkeys[0], recip) {
+			continue
+		}
+		// The pay-to-multisig contract logs its reference data
+		// just before its output.
+		if out.LogPos >= 1 && out.LogPos <= len(tx.Log) && logCode(tx.Log[out.LogPos-1]) == txvm.LogCode {
+			imp.Ref, _ = logBytes(tx.Log[out.LogPos-1], 2)
+		}
+		break
+	}
+	return imp, true
+}
+
+// check matches the unmatched imports to deposits
+// and settles the unsettled exports,
+// publishing evidence of those that cannot be.
+func (w *Watchtower) check(ctx context.Context) error {
+	err := w.checkImports(ctx)
+	if err != nil {
+		return err
+	}
+	return w.checkExports(ctx)
+}
+
+// checkImports matches each unmatched import to the deposit paying it:
+// the one its depositRef names,
+// or for an import with none, any unmatched deposit of its asset and amount.
+// An import still unmatched after Grace
+// is evidence of an unbacked issuance.
+func (w *Watchtower) checkImports(ctx context.Context) error {
+	type unmatched struct {
+		txid                 []byte
+		input                int
+		assetXDR, recip, ref []byte
+		amount               int64
+		height               uint64
+		timeMS               int64
+		tx                   []byte
+	}
+	var imports []unmatched
+	const q = `SELECT txid, input, asset_xdr, amount, recipient, ref, height, time_ms, tx FROM tower_imports WHERE deposit_txid IS NULL`
+	err := sqlutil.ForQueryRows(ctx, w.db, q, func(txid []byte, input int, assetXDR []byte, amount int64, recip, ref []byte, height uint64, timeMS int64, tx []byte) {
+		imports = append(imports, unmatched{txid, input, assetXDR, recip, ref, amount, height, timeMS, tx})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading unmatched imports")
+	}
+	for _, imp := range imports {
+		var (
+			depositTxID string
+			depositOp   int
+		)
+		const q = `SELECT txid, op_index FROM tower_deposits WHERE asset_xdr=$1 AND amount=$2 AND import_txid IS NULL ORDER BY time_ms`
+		err = sqlutil.ForQueryRows(ctx, w.db, q, imp.assetXDR, imp.amount, func(txid string, op int) {
+			if depositTxID != "" {
+				return
+			}
+			if len(imp.ref) == 0 || bytes.Equal(imp.ref, depositRef(txid, op, imp.amount, imp.recip)) {
+				depositTxID, depositOp = txid, op
+			}
+		})
+		if err != nil {
+			return errors.Wrap(err, "reading unmatched deposits")
+		}
+		if depositTxID != "" {
+			err = w.matchImport(ctx, imp.txid, imp.input, depositTxID, depositOp)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if w.nowMS()-imp.timeMS < int64(w.Grace/time.Millisecond) {
+			continue
+		}
+		detail := fmt.Sprintf("issuance of %d %s in slidechain tx %x matches no deposit to the custodian", imp.amount, assetName(imp.assetXDR), imp.txid)
+		err = w.publish(ctx, Evidence{Kind: evidenceIssuance, TxID: imp.txid, Height: imp.height, Detail: detail, Tx: imp.tx})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchImport records that input of import tx txid
+// is paid by the given deposit.
+func (w *Watchtower) matchImport(ctx context.Context, txid []byte, input int, depositTxID string, depositOp int) error {
+	dbtx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	_, err = dbtx.ExecContext(ctx, `UPDATE tower_deposits SET import_txid=$1 WHERE txid=$2 AND op_index=$3`, txid, depositTxID, depositOp)
+	if err != nil {
+		return errors.Wrap(err, "matching deposit")
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE tower_imports SET deposit_txid=$1, deposit_op=$2 WHERE txid=$3 AND input=$4`, depositTxID, depositOp, txid, input)
+	if err != nil {
+		return errors.Wrap(err, "matching import")
+	}
+	return errors.Wrap(dbtx.Commit(), "committing match")
+}
+
+// checkExports settles each unsettled export:
+// by its final peg-out on Stellar,
+// by a refund, spending its value on slidechain without retiring it,
+// or, for a nettable export, by its retirement,
+// since a netted payment cannot be matched to it.
+// An export not settled when due
+// is evidence of a late peg-out.
+func (w *Watchtower) checkExports(ctx context.Context) error {
+	type unsettled struct {
+		p       pegOut
+		height  uint64
+		dueMS   int64
+		spent   bool
+		retired bool
+	}
+	var exports []unsettled
+	const q = `SELECT txid, refdata, height, due_ms, spent_txid IS NOT NULL, retired FROM tower_exports WHERE resolved_ms=0`
+	var scanErr error
+	err := sqlutil.ForQueryRows(ctx, w.db, q, func(txid, refdata []byte, height uint64, dueMS int64, spent, retired bool) {
+		e := unsettled{height: height, dueMS: dueMS, spent: spent, retired: retired}
+		if err := json.Unmarshal(refdata, &e.p); err != nil && scanErr == nil {
+			scanErr = errors.Wrapf(err, "parsing export %x", txid)
+		}
+		e.p.TxID = txid
+		exports = append(exports, e)
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading unsettled exports")
+	}
+	for _, e := range exports {
+		var resolution string
+		switch {
+		case e.spent && !e.retired:
+			resolution = "refund"
+		case e.retired && e.p.Nettable:
+			resolution = "netted"
+		default:
+			vctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+			final, err := w.chain.VerifyFinality(vctx, e.p.withdrawal())
+			cancel()
+			if err != nil {
+				return errors.Wrapf(err, "looking up peg-out of export %x", e.p.TxID)
+			}
+			if final {
+				resolution = "peg-out"
+			}
+		}
+		if resolution != "" {
+			_, err = w.db.ExecContext(ctx, `UPDATE tower_exports SET resolved_ms=$1, resolution=$2 WHERE txid=$3`, w.nowMS(), resolution, e.p.TxID)
+			if err != nil {
+				return errors.Wrapf(err, "settling export %x", e.p.TxID)
+			}
+			continue
+		}
+		if w.nowMS() < e.dueMS {
+			continue
+		}
+		detail := fmt.Sprintf("export %x of %d %s is neither pegged out nor refunded within %s", e.p.TxID, e.p.Amount, assetName(e.p.AssetXDR), w.SLA)
+		if e.retired {
+			detail = fmt.Sprintf("export %x of %d %s is retired on slidechain with no peg-out on Stellar", e.p.TxID, e.p.Amount, assetName(e.p.AssetXDR))
+		}
+		err = w.publish(ctx, Evidence{Kind: evidencePegOut, TxID: e.p.TxID, Height: e.height, Detail: detail})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evidence is a watchtower's signed finding
+// that the custodian has broken the peg.
+type Evidence struct {
+	Kind   string `json:"kind"`
+	TxID   []byte `json:"txid"`   // of the slidechain import or export tx
+	Height uint64 `json:"height"` // of its block
+	Detail string `json:"detail"`
+	TimeMS int64  `json:"time_ms"` // when the watchtower found it
+
+	// Tx is the serialized import tx of an unbacked issuance,
+	// as for a fraud claim.
+	Tx []byte `json:"tx,omitempty"`
+
+	// Signature is by the watchtower's Pubkey of SigMsg.
+	Pubkey    []byte `json:"pubkey"`
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message the watchtower signs:
+// the SHA3-256 hash of "slidechain watchtower evidence", a zero byte,
+// the kind, a zero byte, the tx ID, the height and time as 8 big-endian bytes each,
+// and the SHA3-256 hashes of the detail and of the tx.
+func (e *Evidence) SigMsg() []byte {
+	var n [8]byte
+	msg := []byte("slidechain watchtower evidence\x00")
+	msg = append(msg, e.Kind...)
+	msg = append(msg, 0)
+	msg = append(msg, e.TxID...)
+	binary.BigEndian.PutUint64(n[:], e.Height)
+	msg = append(msg, n[:]...)
+	binary.BigEndian.PutUint64(n[:], uint64(e.TimeMS))
+	msg = append(msg, n[:]...)
+	detail := sha3.Sum256([]byte(e.Detail))
+	msg = append(msg, detail[:]...)
+	tx := sha3.Sum256(e.Tx)
+	msg = append(msg, tx[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// publish signs and records e,
+// unless evidence of its kind about its tx is already recorded,
+// logs it, sends it to the webhook,
+// and for an unbacked issuance, claims fraud if configured.
+func (w *Watchtower) publish(ctx context.Context, e Evidence) error {
+	e.TimeMS = w.nowMS()
+	e.Pubkey = w.Pubkey()
+	e.Signature = ed25519.Sign(w.key, e.SigMsg())
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshaling evidence")
+	}
+	const q = `INSERT OR IGNORE INTO tower_evidence (kind, txid, time_ms, evidence) VALUES ($1, $2, $3, $4)`
+	res, err := w.db.ExecContext(ctx, q, e.Kind, e.TxID, e.TimeMS, body)
+	if err != nil {
+		return errors.Wrapf(err, "recording %s evidence", e.Kind)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	log.Printf("EVIDENCE %s %x: %s", e.Kind, e.TxID, e.Detail)
+	if w.WebhookURL != "" {
+		go postAlert(w.WebhookURL, alert{TimeMS: e.TimeMS, Kind: e.Kind, Key: hex.EncodeToString(e.TxID), Detail: e.Detail})
+	}
+	if w.ClaimFraud && e.Kind == evidenceIssuance {
+		go w.claimFraud(e)
+	}
+	return nil
+}
+
+// claimFraud submits the unbacked issuance e to the slidechaind.
+// Failure is only logged.
+func (w *Watchtower) claimFraud(e Evidence) {
+	claim := fraudClaim{
+		Kind:     "issuance",
+		Tx:       e.Tx,
+		Claimant: fmt.Sprintf("watchtower %x", []byte(w.Pubkey())),
+		Detail:   e.Detail,
+	}
+	body, err := json.Marshal(claim)
+	if err != nil {
+		log.Printf("marshaling fraud claim: %s", err)
+		return
+	}
+	resp, err := net.PeerClient.Post(w.slidechaind+"/fraud", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("claiming fraud in tx %x: %s", e.TxID, err)
+		return
+	}
+	defer resp.Body.Close()
+	var v fraudVerdict
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if resp.StatusCode/100 != 2 || err != nil {
+		log.Printf("claiming fraud in tx %x: status %s", e.TxID, resp.Status)
+		return
+	}
+	log.Printf("fraud claim %d about tx %x: valid %t, %s", v.ID, e.TxID, v.Valid, v.Reason)
+}
+
+// towerStatus is the response to a watchtower's /status.
+type towerStatus struct {
+	Pubkey          []byte `json:"pubkey"`
+	Height          uint64 `json:"height"` // of the latest block scanned
+	Cursor          string `json:"cursor"` // after the latest deposit seen
+	UnmatchedImport int    `json:"unmatched_imports"`
+	UnsettledExport int    `json:"unsettled_exports"`
+	Evidence        int    `json:"evidence"`
+}
+
+// Status is the handler reporting how far the watchtower has got.
+func (w *Watchtower) Status(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	s := towerStatus{Pubkey: w.Pubkey()}
+	const q = `SELECT height, cursor,
+		(SELECT COUNT(*) FROM tower_imports WHERE deposit_txid IS NULL),
+		(SELECT COUNT(*) FROM tower_exports WHERE resolved_ms=0),
+		(SELECT COUNT(*) FROM tower_evidence)
+		FROM tower`
+	err := w.db.QueryRowContext(ctx, q).Scan(&s.Height, &s.Cursor, &s.UnmatchedImport, &s.UnsettledExport, &s.Evidence)
+	if err != nil {
+		net.Errorf(rw, http.StatusInternalServerError, "reading status: %s", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(s)
+}
+
+// ListEvidence is the handler serving the watchtower's evidence,
+// oldest first, optionally of one kind.
+func (w *Watchtower) ListEvidence(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	q := `SELECT evidence FROM tower_evidence`
+	var args []interface{}
+	if kind := req.FormValue("kind"); kind != "" {
+		q += ` WHERE kind=$1`
+		args = append(args, kind)
+	}
+	q += ` ORDER BY time_ms`
+	list := []json.RawMessage{}
+	err := sqlutil.ForQueryRows(ctx, w.db, q, append(args, func(body []byte) {
+		list = append(list, body)
+	})...)
+	if err != nil {
+		net.Errorf(rw, http.StatusInternalServerError, "reading evidence: %s", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(list)
+}
@@ -0,0 +1,207 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+func TestWatchtower(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	cust, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := cust.Address()
+	usd, err := stellar.NewAsset("USD", cust.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usdXDR, err := usd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recip, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, towerKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Custodian{privkey: custodianPrv, InitBlockHash: bc.NewHash([32]byte{1})}
+	ic := issuanceContracts[LatestIssuanceVersion]
+	importTx := func(expMS int64, ref []byte) *bc.Tx {
+		t.Helper()
+		prog, err := c.buildImportTx(ic, 100, expMS, usdXDR, recip, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		tx, err := bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	backed := importTx(1000, depositRef("deposit", 2, 100, recip))
+	unbacked := importTx(2000, depositRef("missing", 0, 100, recip))
+	exportTx := func(anchor byte) *bc.Tx {
+		t.Helper()
+		temp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := Destination{Account: cust.Address(), MemoType: "id", Memo: "42"}
+		tx, err := buildExportTx(usdXDR, issuanceContracts[1].assetID(usdXDR), 10, 15, temp.Address(), bytes32(anchor), exporterPrv, 7, TimeBounds{}, dest, ExportEscrow{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	refunded, late := exportTx(1), exportTx(2)
+
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO tower (cursor, height, block_hash) VALUES ('', 0, x'')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Unix(1000, 0)
+		w := &Watchtower{
+			SLA:   time.Hour,
+			Grace: 10 * time.Minute,
+			db:    db,
+			chain: newStellarChain(srv.Client(), account, "", network.TestNetworkPassphrase),
+			key:   towerKey,
+			now:   func() time.Time { return now },
+		}
+		block := func(height uint64, prev *bc.Block, txs ...*bc.Tx) *bc.Block {
+			root := bc.TxMerkleRoot(txs)
+			b := &bc.Block{UnsignedBlock: &bc.UnsignedBlock{
+				BlockHeader: &bc.BlockHeader{
+					Version:          3,
+					Height:           height,
+					TimestampMs:      uint64(w.nowMS()),
+					TransactionsRoot: &root,
+					ContractsRoot:    &root,
+					NoncesRoot:       &root,
+					NextPredicate:    &bc.Predicate{Version: 1},
+				},
+				Transactions: txs,
+			}}
+			if prev != nil {
+				id := prev.Hash()
+				b.PreviousBlockId = &id
+			}
+			return b
+		}
+		b1 := block(1, nil, backed, unbacked, refunded, late)
+		w.bcid = b1.Hash()
+		err = w.scanBlock(ctx, b1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outputID []byte
+		err = db.QueryRow(`SELECT output_id FROM tower_exports WHERE txid=$1`, refunded.ID.Bytes()).Scan(&outputID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A tx spending the export's value without retiring it refunds it.
+		refund := &bc.Tx{ID: bc.NewHash([32]byte{9}), Inputs: []bc.Input{{ID: bc.HashFromBytes(outputID)}}}
+		err = w.scanBlock(ctx, block(2, nil, refund), nil)
+		if err == nil {
+			t.Error("scanned a block not following the last")
+		}
+		err = w.scanBlock(ctx, block(2, b1, refund), b1.Hash().Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.recordDeposit(ctx, Deposit{TxID: "deposit", OpIndex: 2, Cursor: "c1", Asset: usdXDR, Amount: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		evidence := func() []Evidence {
+			t.Helper()
+			err := w.check(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			w.ListEvidence(rec, httptest.NewRequest("GET", "/evidence", nil))
+			var list []Evidence
+			err = json.Unmarshal(rec.Body.Bytes(), &list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return list
+		}
+		if list := evidence(); len(list) != 0 {
+			t.Fatalf("got evidence %+v within the grace period and SLA", list)
+		}
+		var importTxID []byte
+		err = db.QueryRow(`SELECT import_txid FROM tower_deposits WHERE txid='deposit'`).Scan(&importTxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bc.HashFromBytes(importTxID) != backed.ID {
+			t.Errorf("deposit matched import %x, want %x", importTxID, backed.ID.Bytes())
+		}
+
+		now = now.Add(2 * time.Hour)
+		list := evidence()
+		if len(list) != 2 {
+			t.Fatalf("got %d pieces of evidence, want 2", len(list))
+		}
+		want := map[string]bc.Hash{evidenceIssuance: unbacked.ID, evidencePegOut: late.ID}
+		for _, e := range list {
+			if id, ok := want[e.Kind]; !ok || bc.HashFromBytes(e.TxID) != id {
+				t.Errorf("got %s evidence about tx %x", e.Kind, e.TxID)
+			}
+			if !ed25519.Verify(e.Pubkey, e.SigMsg(), e.Signature) {
+				t.Errorf("bad signature on %s evidence", e.Kind)
+			}
+		}
+		if list := evidence(); len(list) != 2 {
+			t.Errorf("got %d pieces of evidence checking again, want 2", len(list))
+		}
+		var resolution string
+		err = db.QueryRow(`SELECT resolution FROM tower_exports WHERE txid=$1`, refunded.ID.Bytes()).Scan(&resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolution != "refund" {
+			t.Errorf("got resolution %q of the refunded export, want refund", resolution)
+		}
+	})
+}
+
+func bytes32(b byte) []byte {
+	var a [32]byte
+	a[0] = b
+	return a[:]
+}
@@ -0,0 +1,492 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/crypto/sha3"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/stellar/go/strkey"
+)
+
+// States of an exit payout.
+const (
+	exitWaiting    = 0 // for an exit address, or for the next pass
+	exitSubmitting = 1 // submitted, and possibly applied
+	exitPaid       = 2
+)
+
+var exitStateNames = map[int]string{
+	exitWaiting:    "waiting",
+	exitSubmitting: "submitting",
+	exitPaid:       "paid",
+}
+
+const exitAlert = "wind-down"
+
+// exitPayoutInterval is how often the custodian pays out
+// the exit payouts it can while winding down.
+const exitPayoutInterval = 30 * time.Second
+
+// exitTxTTL bounds the time in which an exit payout tx can be applied,
+// after which one not in the custodian account's history never will be.
+const exitTxTTL = 2 * time.Minute
+
+// ExitAddressRequest is the request body of /exit-address.
+type ExitAddressRequest struct {
+	Pubkey  []byte `json:"pubkey"`
+	Address string `json:"address"` // Stellar account
+
+	// TimeMS is when the request was made.
+	// A request older than the last one for the same pubkey is refused.
+	TimeMS int64 `json:"time_ms"`
+
+	// Signature is by Pubkey of SigMsg.
+	Signature []byte `json:"signature"`
+}
+
+// SigMsg returns the message signed in an /exit-address request.
+func (r *ExitAddressRequest) SigMsg() []byte {
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(r.TimeMS))
+	msg := []byte("slidechain exit address\x00")
+	msg = append(msg, r.Pubkey...)
+	msg = append(msg, r.Address...)
+	msg = append(msg, 0)
+	msg = append(msg, timeBytes[:]...)
+	h := sha3.Sum256(msg)
+	return h[:]
+}
+
+// ExitAddress is the handler for /exit-address,
+// where the holder of a pubkey registers the Stellar account
+// to which its balance is paid if the custodian winds down.
+// It works during a wind-down too.
+func (c *Custodian) ExitAddress(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "registering an exit address requires POST")
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var r ExitAddressRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	if len(r.Pubkey) != ed25519.PublicKeySize {
+		net.Errorf(w, http.StatusBadRequest, "pubkey must be a %d-byte ed25519 public key", ed25519.PublicKeySize)
+		return
+	}
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, r.Address); err != nil {
+		net.Errorf(w, http.StatusBadRequest, "address %q is not a Stellar account", r.Address)
+		return
+	}
+	if !c.checkRequestTime(w, "time_ms", r.TimeMS) {
+		return
+	}
+	if !ed25519.Verify(r.Pubkey, r.SigMsg(), r.Signature) {
+		net.Errorf(w, http.StatusUnauthorized, "bad signature")
+		return
+	}
+	const q = `INSERT INTO exit_addresses (pubkey, address, time_ms) VALUES ($1, $2, $3)
+		ON CONFLICT (pubkey) DO UPDATE SET address=excluded.address, time_ms=excluded.time_ms
+		WHERE excluded.time_ms > exit_addresses.time_ms`
+	res, err := c.DB.ExecContext(req.Context(), q, r.Pubkey, r.Address, r.TimeMS)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "recording exit address: %s", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		net.Errorf(w, http.StatusConflict, "a newer request for this pubkey has been made")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// windingDown reports whether the custodian has begun winding down.
+func (c *Custodian) windingDown(ctx context.Context) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM wind_down`).Scan(&n)
+	return n > 0, errors.Wrap(err, "checking for wind-down")
+}
+
+// windDownStatus is the response of /admin/wind-down.
+type windDownStatus struct {
+	Height    uint64           `json:"height"`
+	StartedMS int64            `json:"started_ms"`
+	Payouts   map[string]int64 `json:"payouts"` // count by state
+	Paid      map[string]int64 `json:"paid"`    // amount by asset
+	Owed      map[string]int64 `json:"owed"`    // amount by asset, not yet paid
+	NoAddress int64            `json:"no_address"`
+	Skipped   int64            `json:"skipped"` // balances not paid automatically
+}
+
+// WindDown is the admin handler for /admin/wind-down.
+// POST begins decommissioning the slidechain:
+// it pauses imports, txvm blocks, and API writes,
+// takes the balance snapshot as of the last block,
+// and records a payout on Stellar of each imported balance held by a single key.
+// The custodian then pays each to the key's exit address as it is registered.
+// Balances held by several keys, or of other assets,
+// are left for manual settlement from the snapshot.
+// GET reports the progress of the payouts.
+func (c *Custodian) WindDown(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		ok, err := c.windingDown(ctx)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		if ok {
+			net.Errorf(w, http.StatusConflict, "the custodian is already winding down")
+			return
+		}
+		if _, ok := c.chain.(*stellarChain); !ok {
+			net.Errorf(w, http.StatusNotFound, "custodian has no Stellar account")
+			return
+		}
+		err = c.startWindDown(ctx, "admin-api "+req.RemoteAddr)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "winding down: %s", err)
+			return
+		}
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "wind-down supports GET and POST")
+		return
+	}
+	status, err := c.windDownStatus(ctx)
+	if err == sql.ErrNoRows {
+		net.Errorf(w, http.StatusNotFound, "the custodian is not winding down")
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// startWindDown pauses everything but peg-outs,
+// waits for any block being committed,
+// and records the exit payouts of the balances as of the last block.
+func (c *Custodian) startWindDown(ctx context.Context, source string) error {
+	for _, scope := range []string{pausePegIn, pauseBlocks, pauseAPIWrites} {
+		_, err := c.DB.ExecContext(ctx, `INSERT INTO peg_pauses (time_ms, reason, scope) VALUES ($1, $2, $3)`, c.nowMS(), "wind-down", scope)
+		if err != nil {
+			return errors.Wrapf(err, "pausing %s", scope)
+		}
+	}
+	// A block that passed the pause check before the pause
+	// is committed before the lock is released.
+	c.S.bbmu.Lock()
+	c.S.bbmu.Unlock()
+	height := c.S.chain.Height()
+
+	_, err := c.catchUpPin(ctx, "indexTxs", 0, c.indexBlock)
+	if err != nil {
+		return err
+	}
+	_, err = c.catchUpPin(ctx, utxoPin, 0, c.indexOutputs)
+	if err != nil {
+		return err
+	}
+	snap, err := c.balancesAt(ctx, height)
+	if err != nil {
+		return err
+	}
+	imported := make(map[bc.Hash][]byte)
+	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs`, func(assetXDR []byte) {
+		for _, ic := range issuanceContracts {
+			imported[ic.assetID(assetXDR)] = assetXDR
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading pegged assets")
+	}
+	var cursor string
+	err = c.DB.QueryRowContext(ctx, `SELECT cursor FROM custodian`).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "reading cursor")
+	}
+
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db tx")
+	}
+	defer dbtx.Rollback()
+
+	var skipped int64
+	for _, kb := range snap.Balances {
+		assetID, err := hex.DecodeString(kb.AssetID)
+		if err != nil {
+			return errors.Wrap(err, "decoding asset ID")
+		}
+		assetXDR := imported[bc.HashFromBytes(assetID)]
+		if assetXDR == nil || kb.Quorum != 1 || len(kb.Pubkeys) != 1 {
+			skipped++
+			continue
+		}
+		pubkey, err := hex.DecodeString(kb.Pubkeys[0])
+		if err != nil {
+			return errors.Wrap(err, "decoding pubkey")
+		}
+		if bytes.Equal(pubkey, custodianPub) {
+			skipped++
+			continue
+		}
+		// Value of the same asset under different issuance versions
+		// is paid out together.
+		const q = `INSERT INTO exit_payouts (pubkey, asset_xdr, amount, state) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (pubkey, asset_xdr) DO UPDATE SET amount=exit_payouts.amount+excluded.amount`
+		_, err = dbtx.ExecContext(ctx, q, pubkey, assetXDR, kb.Amount, exitWaiting)
+		if err != nil {
+			return errors.Wrap(err, "recording exit payout")
+		}
+	}
+	const q = `INSERT INTO wind_down (height, cursor, skipped, started_ms) VALUES ($1, $2, $3, $4)`
+	_, err = dbtx.ExecContext(ctx, q, height, cursor, skipped, c.nowMS())
+	if err != nil {
+		return errors.Wrap(err, "recording wind-down")
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing wind-down")
+	}
+	detail := fmt.Sprintf("winding down at block %d", height)
+	err = c.recordAudit(ctx, "wind-down.start", source, detail)
+	if err != nil {
+		return err
+	}
+	return c.alert(ctx, exitAlert, []byte(fmt.Sprint(height)), fmt.Sprintf("%s, by %s", detail, source))
+}
+
+// windDownStatus reports the progress of the wind-down,
+// or sql.ErrNoRows if there is none.
+func (c *Custodian) windDownStatus(ctx context.Context) (*windDownStatus, error) {
+	s := &windDownStatus{
+		Payouts: make(map[string]int64),
+		Paid:    make(map[string]int64),
+		Owed:    make(map[string]int64),
+	}
+	err := c.DB.QueryRowContext(ctx, `SELECT height, skipped, started_ms FROM wind_down`).Scan(&s.Height, &s.Skipped, &s.StartedMS)
+	if err != nil {
+		return nil, err
+	}
+	const q = `SELECT p.asset_xdr, p.amount, p.state, a.address IS NULL FROM exit_payouts p LEFT JOIN exit_addresses a ON a.pubkey=p.pubkey`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, func(assetXDR []byte, amount int64, state int, noAddress bool) {
+		s.Payouts[exitStateNames[state]]++
+		if state == exitPaid {
+			s.Paid[assetName(assetXDR)] += amount
+			return
+		}
+		s.Owed[assetName(assetXDR)] += amount
+		if noAddress {
+			s.NoAddress++
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading exit payouts")
+	}
+	return s, nil
+}
+
+// payExits runs as a goroutine,
+// paying exit payouts every exitPayoutInterval once the custodian is winding down.
+func (c *Custodian) payExits(ctx context.Context, sc *stellarChain) {
+	defer log.Print("payExits exiting")
+
+	ticker := time.NewTicker(exitPayoutInterval)
+	defer ticker.Stop()
+	for {
+		err := c.payExitsPending(ctx, sc)
+		if err != nil {
+			log.Printf("paying exit payouts: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// payExitsPending pays each waiting exit payout whose pubkey has an exit address
+// and that the signing policy passes.
+// A payout left submitting, as by a crash,
+// is first looked for in the custodian account's history since the wind-down began
+// once its tx can no longer be applied:
+// it is paid if its memo is found there, and waiting otherwise.
+// Nothing is paid while peg-out submission is paused
+// or the custodian account has drifted from the custodian config.
+func (c *Custodian) payExitsPending(ctx context.Context, sc *stellarChain) error {
+	paused, err := c.paused(ctx, pausePegOut)
+	if err != nil || paused || c.accountHeld() {
+		return err
+	}
+	var cursor string
+	err = c.DB.QueryRowContext(ctx, `SELECT cursor FROM wind_down`).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading wind-down")
+	}
+	err = c.resolveExitsSubmitting(ctx, sc, cursor)
+	if err != nil {
+		return err
+	}
+
+	type payout struct {
+		pubkey, assetXDR []byte
+		amount           int64
+		address          string
+	}
+	var payouts []payout
+	const q = `SELECT p.pubkey, p.asset_xdr, p.amount, a.address FROM exit_payouts p JOIN exit_addresses a ON a.pubkey=p.pubkey
+		WHERE p.state=$1 ORDER BY p.pubkey, p.asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, exitWaiting, func(pubkey, assetXDR []byte, amount int64, address string) {
+		payouts = append(payouts, payout{pubkey: pubkey, assetXDR: assetXDR, amount: amount, address: address})
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading exit payouts")
+	}
+	for _, p := range payouts {
+		memo := exitMemo(p.pubkey, p.assetXDR)
+		ok, err := c.checkSigningPolicy(ctx, signing{Kind: "exit", ID: memo[:], Destination: p.address, AssetXDR: p.assetXDR, Amount: p.amount})
+		if err == nil && ok {
+			err = c.payExit(ctx, sc, p.pubkey, p.assetXDR, p.amount, p.address)
+		}
+		if err != nil {
+			log.Printf("paying exit payout of %d %s to %s: %s", p.amount, assetName(p.assetXDR), p.address, err)
+		}
+	}
+	return nil
+}
+
+// payExit pays one exit payout to address,
+// with the payout's memo so that it can be found again.
+func (c *Custodian) payExit(ctx context.Context, sc *stellarChain, pubkey, assetXDR []byte, amt int64, address string) error {
+	asset, err := stellar.DecodeAsset(assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling asset")
+	}
+	nowMS := c.nowMS()
+	_, err = c.DB.ExecContext(ctx, `UPDATE exit_payouts SET state=$1, submitted_ms=$2 WHERE pubkey=$3 AND asset_xdr=$4`, exitSubmitting, nowMS, pubkey, assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "recording exit payout submission")
+	}
+	maxTime := int64((time.Duration(nowMS)*time.Millisecond + exitTxTTL) / time.Second)
+	custodian := sc.account
+	succ, err := sc.seqs.SubmitContext(ctx, custodian, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network:    sc.network,
+			Source:     custodian,
+			SeqNum:     seqnum,
+			TimeBounds: &stellar.TimeBounds{MaxTime: maxTime},
+			Memo:       exitMemo(pubkey, assetXDR),
+			Ops: []stellar.Op{
+				stellar.Payment{Destination: address, Asset: asset, Amount: amt},
+			},
+		}, nil
+	}, sc.seed)
+	if resultCode(err) != "" {
+		// Rejected by Stellar, so not applied; try again next pass.
+		_, dberr := c.DB.ExecContext(ctx, `UPDATE exit_payouts SET state=$1, error=$2 WHERE pubkey=$3 AND asset_xdr=$4`, exitWaiting, err.Error(), pubkey, assetXDR)
+		if dberr != nil {
+			return errors.Wrap(dberr, "recording exit payout failure")
+		}
+		return err
+	}
+	if err != nil {
+		// Possibly applied; resolved from the account's history next pass.
+		return err
+	}
+	return c.recordExitPaid(ctx, pubkey, assetXDR, succ.Hash)
+}
+
+func (c *Custodian) recordExitPaid(ctx context.Context, pubkey, assetXDR []byte, hash string) error {
+	const q = `UPDATE exit_payouts SET state=$1, stellar_tx_hash=$2, error=NULL WHERE pubkey=$3 AND asset_xdr=$4`
+	_, err := c.DB.ExecContext(ctx, q, exitPaid, hash, pubkey, assetXDR)
+	if err != nil {
+		return errors.Wrap(err, "recording exit payout")
+	}
+	log.Printf("paid exit payout of %s to pubkey %x in Stellar tx %s", assetName(assetXDR), pubkey, hash)
+	return nil
+}
+
+// resolveExitsSubmitting settles the payouts left submitting past exitTxTTL
+// by looking for their memos among the custodian account's txs after cursor.
+func (c *Custodian) resolveExitsSubmitting(ctx context.Context, sc *stellarChain, cursor string) error {
+	pending := make(map[string][2][]byte)
+	const q = `SELECT pubkey, asset_xdr FROM exit_payouts WHERE state=$1 AND submitted_ms < $2`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, exitSubmitting, c.nowMS()-int64(exitTxTTL/time.Millisecond), func(pubkey, assetXDR []byte) {
+		memo := exitMemo(pubkey, assetXDR)
+		pending[base64.StdEncoding.EncodeToString(memo[:])] = [2][]byte{pubkey, assetXDR}
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading submitted exit payouts")
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	const pageSize = 200
+	for {
+		tctx, cancel := context.WithTimeout(ctx, chainCallTimeout)
+		txs, err := stellar.AccountTransactions(tctx, sc.hclient, sc.account, cursor, pageSize)
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "reading custodian txs")
+		}
+		for _, tx := range txs {
+			cursor = tx.PT
+			if k, ok := pending[tx.Memo]; ok && tx.MemoType == "hash" && tx.Account == sc.account {
+				err = c.recordExitPaid(ctx, k[0], k[1], tx.Hash)
+				if err != nil {
+					return err
+				}
+				delete(pending, tx.Memo)
+			}
+		}
+		if len(txs) < pageSize {
+			break
+		}
+	}
+	// The rest were never applied.
+	for _, k := range pending {
+		_, err = c.DB.ExecContext(ctx, `UPDATE exit_payouts SET state=$1 WHERE pubkey=$2 AND asset_xdr=$3`, exitWaiting, k[0], k[1])
+		if err != nil {
+			return errors.Wrap(err, "resetting exit payout")
+		}
+	}
+	return nil
+}
+
+// exitMemo is the memo of the exit payout of assetXDR to pubkey.
+func exitMemo(pubkey, assetXDR []byte) stellar.MemoHash {
+	msg := append([]byte("slidechain exit\x00"), pubkey...)
+	return sha3.Sum256(append(msg, assetXDR...))
+}
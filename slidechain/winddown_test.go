@@ -0,0 +1,201 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/horizonmock"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+	"github.com/interstellar/starlight/worizon/xlm"
+	"github.com/stellar/go/keypair"
+)
+
+func TestWindDown(t *testing.T) {
+	ctx := context.Background()
+	srv := horizonmock.New()
+	defer srv.Close()
+
+	custKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fund(custKP.Address(), horizonmock.FriendbotAmount)
+	var exitKPs [2]*keypair.Full
+	for i := range exitKPs {
+		exitKPs[i], err = keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Fund(exitKPs[i].Address(), int64(10*xlm.Lumen))
+	}
+
+	cfg := config.Default()
+	cfg.Custodian.Seed = custKP.Seed()
+	cfg.Horizon.URL = srv.URL()
+	cfg.Horizon.FriendbotURL = ""
+	cfg.Admin.PauseFile = ""
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.Now = func() time.Time { return now }
+	native := stellar.NativeAsset()
+	nativeXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestDB(t, func(db *sql.DB) {
+		c, err := NewSteppedCustodian(ctx, db, srv.Client(), cfg, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := c.chain.(*stellarChain)
+		_, err = db.Exec(`INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, state) VALUES ($1, 1, $2, $3, 1, $4)`, []byte("nonce"), nativeXDR, testRecipPubKey, pegInImported)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var holders [2]ed25519.PrivateKey
+		expMS := int64(bc.Millis(now.Add(10 * time.Minute)))
+		for i, amount := range []int64{int64(5 * xlm.Lumen), int64(3 * xlm.Lumen)} {
+			pub, prv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			holders[i] = prv
+			importTestPeg(ctx, t, c, issuanceContracts[1], nativeXDR, pub, amount, expMS+int64(i))
+		}
+		register := func(i int) {
+			t.Helper()
+			r := ExitAddressRequest{
+				Pubkey:  holders[i].Public().(ed25519.PublicKey),
+				Address: exitKPs[i].Address(),
+				TimeMS:  int64(bc.Millis(now)),
+			}
+			r.Signature = ed25519.Sign(holders[i], r.SigMsg())
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.ExitAddress(w, httptest.NewRequest("POST", "/exit-address", bytes.NewReader(body)))
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("registering exit address %d: got status %d: %s", i, w.Code, w.Body)
+			}
+		}
+		windDown := func(method string) (*windDownStatus, int) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			c.WindDown(w, httptest.NewRequest(method, "/admin/wind-down", nil))
+			if w.Code != http.StatusOK {
+				return nil, w.Code
+			}
+			var s windDownStatus
+			err := json.NewDecoder(w.Body).Decode(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &s, w.Code
+		}
+		pay := func() {
+			t.Helper()
+			err := c.payExitsPending(ctx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		balance := func(i int) int64 {
+			bal, _ := srv.Balance(exitKPs[i].Address(), native)
+			return bal
+		}
+
+		register(0)
+		if _, code := windDown("GET"); code != http.StatusNotFound {
+			t.Errorf("wind-down status before winding down: got status %d, want %d", code, http.StatusNotFound)
+		}
+		s, code := windDown("POST")
+		if code != http.StatusOK {
+			t.Fatalf("winding down: got status %d", code)
+		}
+		if s.Payouts["waiting"] != 2 || s.Owed[assetName(nativeXDR)] != int64(8*xlm.Lumen) || s.NoAddress != 1 {
+			t.Errorf("after winding down got status %+v, want 2 waiting payouts of 8 lumens, 1 without an address", s)
+		}
+		for _, scope := range []string{pausePegIn, pauseBlocks, pauseAPIWrites} {
+			if paused, err := c.paused(ctx, scope); err != nil || !paused {
+				t.Errorf("%s not paused while winding down (err %v)", scope, err)
+			}
+		}
+		if _, code := windDown("POST"); code != http.StatusConflict {
+			t.Errorf("winding down again: got status %d, want %d", code, http.StatusConflict)
+		}
+		w := httptest.NewRecorder()
+		c.ResumePeg(w, httptest.NewRequest("POST", "/admin/resume", nil))
+		if w.Code != http.StatusConflict {
+			t.Errorf("resuming while winding down: got status %d, want %d", w.Code, http.StatusConflict)
+		}
+
+		// An operator pause of peg-outs holds the exit payouts too,
+		// and can still be resumed.
+		w = httptest.NewRecorder()
+		c.Pause(w, httptest.NewRequest("POST", "/admin/pause?scope=pegout&reason=incident", nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("pausing peg-outs: got status %d: %s", w.Code, w.Body)
+		}
+		before := balance(0)
+		pay()
+		if got := balance(0) - before; got != 0 {
+			t.Errorf("exit address 0 got %d stroops with peg-outs paused, want none", got)
+		}
+		w = httptest.NewRecorder()
+		c.ResumePeg(w, httptest.NewRequest("POST", "/admin/resume?scope=pegout", nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("resuming peg-outs while winding down: got status %d: %s", w.Code, w.Body)
+		}
+
+		pay()
+		if got := balance(0) - before; got != int64(5*xlm.Lumen) {
+			t.Errorf("exit address 0 got %d stroops, want %d", got, 5*xlm.Lumen)
+		}
+		var hash string
+		err = db.QueryRow(`SELECT stellar_tx_hash FROM exit_payouts WHERE state=$1`, exitPaid).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A payout left submitting is found in the account's history, not paid again.
+		_, err = db.Exec(`UPDATE exit_payouts SET state=$1, submitted_ms=0, stellar_tx_hash=NULL WHERE state=$2`, exitSubmitting, exitPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pay()
+		if got := balance(0) - before; got != int64(5*xlm.Lumen) {
+			t.Errorf("after resuming exit address 0 got %d stroops, want %d", got, 5*xlm.Lumen)
+		}
+		var again string
+		err = db.QueryRow(`SELECT stellar_tx_hash FROM exit_payouts WHERE state=$1`, exitPaid).Scan(&again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != hash {
+			t.Errorf("resolved payout to tx %s, want %s", again, hash)
+		}
+
+		register(1)
+		before = balance(1)
+		pay()
+		if got := balance(1) - before; got != int64(3*xlm.Lumen) {
+			t.Errorf("exit address 1 got %d stroops, want %d", got, 3*xlm.Lumen)
+		}
+		s, _ = windDown("GET")
+		if s == nil || s.Payouts["paid"] != 2 || s.Paid[assetName(nativeXDR)] != int64(8*xlm.Lumen) || len(s.Owed) != 0 {
+			t.Errorf("after paying got status %+v, want 2 paid payouts of 8 lumens", s)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package slidechain
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/interstellar/slingshot/slidechain/net"
+	"github.com/interstellar/slingshot/slidechain/stellar"
+)
+
+// wrappedAsset is a Stellar credit asset issued by the custodian
+// to represent a slidechain-native asset,
+// as recorded in the wrapped_assets table, the asset registry.
+type wrappedAsset struct {
+	Code      string `json:"code"`
+	TxvmAsset []byte `json:"txvm_asset"` // txvm asset ID
+	Name      string `json:"name"`
+	Desc      string `json:"desc"`
+	Decimals  int    `json:"decimals"`
+}
+
+func (a *wrappedAsset) validate() error {
+	if n := len(a.Code); n < 1 || n > 12 {
+		return fmt.Errorf("asset code %q must be 1 to 12 characters", a.Code)
+	}
+	for _, r := range a.Code {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return fmt.Errorf("asset code %q must be alphanumeric", a.Code)
+		}
+	}
+	if len(a.TxvmAsset) != 32 {
+		return errors.New("txvm asset ID must be 32 bytes")
+	}
+	if _, err := stroopsPerUnit(a.Decimals); err != nil {
+		return err
+	}
+	return nil
+}
+
+// registerWrappedAsset adds the asset to the registry,
+// or updates its metadata.
+// Its decimals, which scale its amounts on Stellar (see precision.go),
+// cannot change.
+func (c *Custodian) registerWrappedAsset(ctx context.Context, a *wrappedAsset) error {
+	err := a.validate()
+	if err != nil {
+		return err
+	}
+	const q = `
+		INSERT INTO wrapped_assets (code, txvm_asset, name, description, decimals) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (code) DO UPDATE SET name=excluded.name, description=excluded.description
+		WHERE txvm_asset=excluded.txvm_asset AND decimals=excluded.decimals
+	`
+	res, err := c.DB.ExecContext(ctx, q, a.Code, a.TxvmAsset, a.Name, a.Desc, a.Decimals)
+	if err != nil {
+		return errors.Wrapf(err, "registering wrapped asset %s", a.Code)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "registering wrapped asset %s", a.Code)
+	}
+	if n == 0 {
+		var decimals int
+		err = c.DB.QueryRowContext(ctx, `SELECT decimals FROM wrapped_assets WHERE code=$1 AND txvm_asset=$2`, a.Code, a.TxvmAsset).Scan(&decimals)
+		if err == nil {
+			return fmt.Errorf("asset code %s is registered with %d decimals, which cannot change", a.Code, decimals)
+		}
+		return fmt.Errorf("asset code %s already stands for another txvm asset", a.Code)
+	}
+	return nil
+}
+
+func (c *Custodian) wrappedAssets(ctx context.Context) ([]wrappedAsset, error) {
+	var assets []wrappedAsset
+	const q = `SELECT code, txvm_asset, name, description, decimals FROM wrapped_assets ORDER BY code`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, func(code string, txvmAsset []byte, name, desc string, decimals int) {
+		assets = append(assets, wrappedAsset{
+			Code:      code,
+			TxvmAsset: txvmAsset,
+			Name:      name,
+			Desc:      desc,
+			Decimals:  decimals,
+		})
+	})
+	return assets, errors.Wrap(err, "reading wrapped assets")
+}
+
+// RegisterWrappedAsset is the admin handler that adds a wrapped asset
+// to the registry, or updates its metadata.
+// The request is a JSON wrappedAsset.
+func (c *Custodian) RegisterWrappedAsset(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "registering a wrapped asset requires POST")
+		return
+	}
+	var a wrappedAsset
+	err := json.NewDecoder(req.Body).Decode(&a)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	err = c.registerWrappedAsset(req.Context(), &a)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	err = c.recordAudit(req.Context(), "wrapped-asset.register", "admin-api "+req.RemoteAddr, fmt.Sprintf("%s = txvm asset %x", a.Code, a.TxvmAsset))
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// assetReserve is an entry of the /reserves response.
+type assetReserve struct {
+	Code        string `json:"code"`
+	TxvmAsset   string `json:"txvm_asset"` // hex txvm asset ID
+	Outstanding int64  `json:"outstanding"`
+	Reserve     int64  `json:"reserve"`
+}
+
+// Reserves is the handler for /reserves,
+// serving the outstanding Stellar supply of each wrapped asset
+// and the txvm reserve backing it,
+// which the reserve invariant keeps equal.
+// Reserve outputs held for a wrapped export still being pegged out
+// back no Stellar supply yet and are not counted.
+func (c *Custodian) Reserves(w http.ResponseWriter, req *http.Request) {
+	const q = `SELECT w.code, w.txvm_asset, w.outstanding,
+		(SELECT COALESCE(SUM(r.amount), 0) FROM reserve r WHERE r.txvm_asset=w.txvm_asset AND r.export_txid IS NULL)
+		FROM wrapped_assets w ORDER BY w.code`
+	reserves := []assetReserve{}
+	err := sqlutil.ForQueryRows(req.Context(), c.DB, q, func(code string, txvmAsset []byte, outstanding, reserve int64) {
+		reserves = append(reserves, assetReserve{
+			Code:        code,
+			TxvmAsset:   hex.EncodeToString(txvmAsset),
+			Outstanding: outstanding,
+			Reserve:     reserve,
+		})
+	})
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading reserves: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reserves)
+}
+
+// StellarTOML serves the SEP-1 stellar.toml file
+// listing the wrapped assets in the registry,
+// for /.well-known/stellar.toml on the configured home domain.
+func (c *Custodian) StellarTOML(w http.ResponseWriter, req *http.Request) {
+	if _, ok := c.chain.(*stellarChain); !ok {
+		net.Errorf(w, http.StatusNotFound, "custodian has no Stellar account")
+		return
+	}
+	assets, err := c.wrappedAssets(req.Context())
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	var (
+		sep1     config.SEP1
+		sep31URL string
+		sep12URL string
+	)
+	if cfg := c.config(); cfg != nil {
+		sep1 = cfg.SEP1
+		if len(cfg.SEP31.Assets) > 0 {
+			sep31URL = cfg.SEP31.URL
+		}
+		if len(cfg.SEP12.Clients) > 0 {
+			sep12URL = cfg.SEP12.URL
+		}
+	}
+	// SEP-1 requires that wallets on any origin can fetch the file.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeStellarTOML(w, sep1, sep31URL, sep12URL, c.AccountID, assets)
+}
+
+func writeStellarTOML(w io.Writer, sep1 config.SEP1, sep31URL, sep12URL, issuer string, assets []wrappedAsset) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "ACCOUNTS = [%s]\n", tomlString(issuer))
+	if sep1.HomeDomain != "" {
+		// SEP-7 deposit URIs are signed by the custodian account.
+		fmt.Fprintf(bw, "URI_REQUEST_SIGNING_KEY = %s\n", tomlString(issuer))
+	}
+	if sep31URL != "" {
+		// SEP-31 callbacks are signed by the custodian account.
+		fmt.Fprintf(bw, "DIRECT_PAYMENT_SERVER = %s\n", tomlString(strings.TrimRight(sep31URL, "/")+"/sep31"))
+		fmt.Fprintf(bw, "SIGNING_KEY = %s\n", tomlString(issuer))
+	}
+	if sep12URL != "" {
+		fmt.Fprintf(bw, "KYC_SERVER = %s\n", tomlString(strings.TrimRight(sep12URL, "/")+"/sep12"))
+	}
+	if sep1.OrgName != "" || sep1.OrgURL != "" {
+		fmt.Fprintf(bw, "\n[DOCUMENTATION]\n")
+		if sep1.OrgName != "" {
+			fmt.Fprintf(bw, "ORG_NAME = %s\n", tomlString(sep1.OrgName))
+		}
+		if sep1.OrgURL != "" {
+			fmt.Fprintf(bw, "ORG_URL = %s\n", tomlString(sep1.OrgURL))
+		}
+	}
+	for _, a := range assets {
+		fmt.Fprintf(bw, "\n[[CURRENCIES]]\n")
+		fmt.Fprintf(bw, "code = %s\n", tomlString(a.Code))
+		fmt.Fprintf(bw, "issuer = %s\n", tomlString(issuer))
+		fmt.Fprintf(bw, "display_decimals = %d\n", a.Decimals)
+		if a.Name != "" {
+			fmt.Fprintf(bw, "name = %s\n", tomlString(a.Name))
+		}
+		if a.Desc != "" {
+			fmt.Fprintf(bw, "desc = %s\n", tomlString(a.Desc))
+		}
+		fmt.Fprintf(bw, "is_asset_anchored = true\n")
+		fmt.Fprintf(bw, "anchor_asset_type = \"other\"\n")
+		fmt.Fprintf(bw, "anchor_asset = %s\n", tomlString("slidechain:"+hex.EncodeToString(a.TxvmAsset)))
+	}
+	return bw.Flush()
+}
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, "\\u%04x", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// setHomeDomain sets the home domain of the custodian account,
+// the issuer of the wrapped assets,
+// so that wallets can find its stellar.toml.
+// It does nothing if the domain is already set.
+func (s *stellarChain) setHomeDomain(domain string) error {
+	acct, err := s.hclient.LoadAccount(s.account)
+	if err != nil {
+		return errors.Wrap(err, "getting custodian home domain")
+	}
+	if acct.HomeDomain == domain {
+		return nil
+	}
+	addr := s.account
+	_, err = s.seqs.Submit(addr, func(seqnum stellar.SequenceNumber) (*stellar.Tx, error) {
+		return &stellar.Tx{
+			Network: s.network,
+			Source:  addr,
+			SeqNum:  seqnum,
+			Ops:     []stellar.Op{stellar.SetOptions{HomeDomain: &domain}},
+		}, nil
+	}, s.seed)
+	return errors.Wrapf(err, "setting custodian home domain to %s", domain)
+}
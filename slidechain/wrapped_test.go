@@ -0,0 +1,81 @@
+package slidechain
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interstellar/slingshot/slidechain/config"
+	"github.com/stellar/go/keypair"
+)
+
+func TestWrappedAssets(t *testing.T) {
+	withTestDB(t, func(db *sql.DB) {
+		err := setSchema(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accountID := kp.Address()
+		cfg := config.Default()
+		cfg.SEP1.OrgName = `The "Slidechain" Custodian`
+		c := &Custodian{
+			DB:        db,
+			AccountID: accountID,
+			chain:     newStellarChain(nil, accountID, kp.Seed(), ""),
+			cfg:       cfg,
+			now:       func() time.Time { return time.Unix(1, 0) },
+		}
+
+		register := func(a wrappedAsset) int {
+			body, err := json.Marshal(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			c.RegisterWrappedAsset(rec, httptest.NewRequest("POST", "/admin/wrapped-assets", bytes.NewReader(body)))
+			return rec.Code
+		}
+		asset := bytes.Repeat([]byte{0xab}, 32)
+		if code := register(wrappedAsset{Code: "FOO", TxvmAsset: asset, Name: "Foo", Decimals: 2}); code != http.StatusNoContent {
+			t.Fatalf("registering FOO: got status %d", code)
+		}
+		if code := register(wrappedAsset{Code: "FOO!", TxvmAsset: asset}); code != http.StatusBadRequest {
+			t.Errorf("registering a bad code: got status %d, want %d", code, http.StatusBadRequest)
+		}
+		if code := register(wrappedAsset{Code: "FOO", TxvmAsset: bytes.Repeat([]byte{0xcd}, 32)}); code != http.StatusBadRequest {
+			t.Errorf("registering FOO for another asset: got status %d, want %d", code, http.StatusBadRequest)
+		}
+		if code := register(wrappedAsset{Code: "FOO", TxvmAsset: asset, Decimals: 3}); code != http.StatusBadRequest {
+			t.Errorf("changing the decimals of FOO: got status %d, want %d", code, http.StatusBadRequest)
+		}
+
+		rec := httptest.NewRecorder()
+		c.StellarTOML(rec, httptest.NewRequest("GET", "/.well-known/stellar.toml", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d", rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want *", got)
+		}
+		toml := rec.Body.String()
+		for _, want := range []string{
+			`ACCOUNTS = ["` + kp.Address() + `"]`,
+			`ORG_NAME = "The \"Slidechain\" Custodian"`,
+			"[[CURRENCIES]]\ncode = \"FOO\"\nissuer = \"" + kp.Address() + "\"\ndisplay_decimals = 2\nname = \"Foo\"\n",
+			`anchor_asset = "slidechain:` + strings.Repeat("ab", 32) + `"`,
+		} {
+			if !strings.Contains(toml, want) {
+				t.Errorf("stellar.toml does not contain %q:\n%s", want, toml)
+			}
+		}
+	})
+}